@@ -3140,6 +3140,70 @@ func (m *sessionDataMutator) SetCostScansWithDefaultColSize(val bool) {
 	m.data.CostScansWithDefaultColSize = val
 }
 
+func (m *sessionDataMutator) SetOptimizerDisableRules(val string) {
+	m.data.OptimizerDisableRules = val
+}
+
+func (m *sessionDataMutator) SetOptimizerExternalRules(val string) {
+	m.data.OptimizerExternalRules = val
+}
+
+func (m *sessionDataMutator) SetOptimizerLeadingTables(val string) {
+	m.data.OptimizerLeadingTables = val
+}
+
+func (m *sessionDataMutator) SetOptimizerUseTopKEnforcer(val bool) {
+	m.data.OptimizerUseTopKEnforcer = val
+}
+
+func (m *sessionDataMutator) SetOptimizerRiskAversion(val float64) {
+	m.data.OptimizerRiskAversion = val
+}
+
+func (m *sessionDataMutator) SetOptimizerMaxMemoExprs(val int64) {
+	m.data.OptimizerMaxMemoExprs = val
+}
+
+func (m *sessionDataMutator) SetOptimizerPlanGuardrail(val sessiondatapb.PlanGuardrailMode) {
+	m.data.OptimizerPlanGuardrail = val
+}
+
+func (m *sessionDataMutator) SetOptimizerUseWorkMemCosting(val bool) {
+	m.data.OptimizerUseWorkMemCosting = val
+}
+
+func (m *sessionDataMutator) SetOptimizerUseStreamingProperty(val bool) {
+	m.data.OptimizerUseStreamingProperty = val
+}
+
+func (m *sessionDataMutator) SetOptimizerUseJoinLimitHints(val bool) {
+	m.data.OptimizerUseJoinLimitHints = val
+}
+
+func (m *sessionDataMutator) SetOptimizerDeterministicTieBreaking(val bool) {
+	m.data.OptimizerDeterministicTieBreaking = val
+}
+
+func (m *sessionDataMutator) SetOptimizerExploreApplyJoins(val bool) {
+	m.data.OptimizerExploreApplyJoins = val
+}
+
+func (m *sessionDataMutator) SetOptimizerGoal(val sessiondatapb.OptimizerGoal) {
+	m.data.OptimizerGoal = val
+}
+
+func (m *sessionDataMutator) SetOptimizerHeuristicPlanningThreshold(val int64) {
+	m.data.OptimizerHeuristicPlanningThreshold = val
+}
+
+func (m *sessionDataMutator) SetReorderJoinsSearchBudget(val time.Duration) {
+	m.data.ReorderJoinsSearchBudget = val
+}
+
+func (m *sessionDataMutator) SetReorderJoinsShape(val sessiondatapb.JoinShapeMode) {
+	m.data.ReorderJoinsShape = val
+}
+
 // Utility functions related to scrubbing sensitive information on SQL Stats.
 
 // quantizeCounts ensures that the Count field in the
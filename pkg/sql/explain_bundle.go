@@ -128,6 +128,7 @@ func buildStatementBundle(
 
 	b.addStatement()
 	b.addOptPlans()
+	b.addRuleDecisions()
 	b.addExecPlan(planString)
 	b.addDistSQLDiagrams()
 	b.addExplainVec()
@@ -248,6 +249,16 @@ func (b *stmtBundleBuilder) addOptPlans() {
 	b.z.AddFile("opt-vv.txt", formatOptPlan(memo.ExprFmtHideQualifications))
 }
 
+// addRuleDecisions adds the recording of the decisions made for the rules
+// matched by the optimizer as file rule-decisions.txt, so that the plan can be
+// replayed from the bundle (see opttester.ReplayBundle).
+func (b *stmtBundleBuilder) addRuleDecisions() {
+	if b.plan.instrumentation == nil || b.plan.instrumentation.ruleDecisions == "" {
+		return
+	}
+	b.z.AddFile("rule-decisions.txt", b.plan.instrumentation.ruleDecisions)
+}
+
 // addExecPlan adds the EXPLAIN (VERBOSE) plan as file plan.txt.
 func (b *stmtBundleBuilder) addExecPlan(plan string) {
 	if plan != "" {
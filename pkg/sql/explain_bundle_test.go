@@ -48,7 +48,7 @@ CREATE SCHEMA s;
 CREATE TABLE s.a (a INT PRIMARY KEY);`)
 
 	base := "statement.sql trace.json trace.txt trace-jaeger.json env.sql"
-	plans := "schema.sql opt.txt opt-v.txt opt-vv.txt plan.txt"
+	plans := "schema.sql opt.txt opt-v.txt opt-vv.txt rule-decisions.txt plan.txt"
 
 	// Set a small chunk size to test splitting into chunks. The bundle files are
 	// on the order of 10KB.
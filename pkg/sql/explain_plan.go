@@ -126,6 +126,12 @@ func (e *explainPlanNode) startExec(params runParams) error {
 			// For the JSON flag, we only want to emit the diagram JSON.
 			rows = []string{diagramJSON}
 		} else {
+			// Warn if a join tree was too large to be fully reordered. With the
+			// VERBOSE flag, describe the join search space of any reordered join.
+			joinStats := params.p.instrumentation.joinReorderStats
+			if joinStats.ReorderLimitReached || (e.flags.Verbose && joinStats.Reorders > 0) {
+				ob.AddTopLevelField("join reordering", joinStats.String())
+			}
 			if err := emitExplain(ob, params.EvalContext(), params.p.ExecCfg().Codec, e.plan); err != nil {
 				return err
 			}
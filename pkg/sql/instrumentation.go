@@ -25,6 +25,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/execstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/exec"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/exec/explain"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
 	"github.com/cockroachdb/cockroach/pkg/sql/physicalplan"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessionphase"
@@ -128,6 +129,20 @@ type instrumentationHelper struct {
 	// indexRecommendations is a string slice containing index recommendations for
 	// the planned statement. This is only set for EXPLAIN statements.
 	indexRecommendations []string
+
+	// joinReorderStats describes the join orderings that were considered by the
+	// optimizer. It is shown by EXPLAIN if a join tree was not fully reordered.
+	joinReorderStats xform.JoinReorderStats
+
+	// planningReport summarizes the resources used by the optimizer to plan the
+	// statement. It is shown by EXPLAIN ANALYZE (VERBOSE) and included in
+	// statement diagnostics bundles.
+	planningReport xform.PlanningReport
+
+	// ruleDecisions is the encoded recording of the decisions made for the
+	// rules matched while planning the statement. It is only set when a
+	// diagnostics bundle is collected, and is included in the bundle.
+	ruleDecisions string
 }
 
 // outputMode indicates how the statement output needs to be populated (for
@@ -459,6 +474,11 @@ func (ih *instrumentationHelper) emitExplainAnalyzePlanToOutputBuilder(
 		return ob
 	}
 	ob.AddPlanningTime(phaseTimes.GetPlanningLatency())
+	if flags.Verbose && ih.planningReport.Optimized {
+		ob.AddRedactableTopLevelField(
+			explain.RedactVolatile, "planning report", ih.planningReport.String(),
+		)
+	}
 	ob.AddExecutionTime(phaseTimes.GetRunLatency())
 	ob.AddDistribution(ih.distribution.String())
 	ob.AddVectorized(ih.vectorized)
@@ -458,6 +458,22 @@ var (
 	disableOptRuleProbability = flag.Float64(
 		"disable-opt-rule-probability", 0,
 		"disable transformation rules in the cost-based optimizer with the given probability.")
+	disableOptRuleSeed = flag.Int64(
+		"disable-opt-rule-seed", 0,
+		"seed used to choose the rules disabled by -disable-opt-rule-probability. If zero, a "+
+			"seed is chosen at random and printed if the test fails.")
+	disableOptRuleProtect = flag.String(
+		"disable-opt-rule-protect", "",
+		"comma-separated names of rules that are never disabled by "+
+			"-disable-opt-rule-probability, in addition to the essential rules.")
+	disableOptRuleUnprotect = flag.String(
+		"disable-opt-rule-unprotect", "",
+		"comma-separated names of essential rules that may be disabled by "+
+			"-disable-opt-rule-probability.")
+	logDisabledOptRules = flag.Bool(
+		"log-disabled-opt-rules", false,
+		"log the names of all the rules disabled by -disable-opt-rule-probability when "+
+			"optimization of a statement fails.")
 	optimizerCostPerturbation = flag.Float64(
 		"optimizer-cost-perturbation", 0,
 		"randomly perturb the estimated cost of each expression in the query tree by at most the "+
@@ -1430,6 +1446,22 @@ func (t *logicTest) newCluster(serverArgs TestServerArgs, opts []clusterOpt) {
 		// we don't want those to take long on large machines).
 		serverArgs.maxSQLMemoryLimit = 192 * 1024 * 1024
 	}
+	// If rules are disabled at random, choose the rules with a seed that is
+	// printed if the test fails, so that the failure can be reproduced.
+	optRuleSeed := *disableOptRuleSeed
+	if *disableOptRuleProbability > 0 {
+		if optRuleSeed == 0 {
+			optRuleSeed = randutil.NewPseudoSeed()
+		}
+		tt := t.t()
+		tt.Cleanup(func() {
+			if tt.Failed() {
+				tt.Logf("optimizer rules were disabled with -disable-opt-rule-probability=%v "+
+					"-disable-opt-rule-seed=%d", *disableOptRuleProbability, optRuleSeed)
+			}
+		})
+	}
+
 	var tempStorageConfig base.TempStorageConfig
 	if serverArgs.tempStorageDiskLimit == 0 {
 		tempStorageConfig = base.DefaultTestTempStorageConfig(cluster.MakeTestingClusterSettings())
@@ -1451,6 +1483,10 @@ func (t *logicTest) newCluster(serverArgs TestServerArgs, opts []clusterOpt) {
 					AssertUnaryExprReturnTypes:      true,
 					AssertFuncExprReturnTypes:       true,
 					DisableOptimizerRuleProbability: *disableOptRuleProbability,
+					DisableOptimizerRuleSeed:        optRuleSeed,
+					DisableOptimizerRuleProtect:     splitRuleNames(*disableOptRuleProtect),
+					DisableOptimizerRuleUnprotect:   splitRuleNames(*disableOptRuleUnprotect),
+					LogDisabledOptimizerRules:       *logDisabledOptRules,
 					OptimizerCostPerturbation:       *optimizerCostPerturbation,
 					ForceProductionBatchSizes:       serverArgs.forceProductionBatchSizes,
 				},
@@ -1737,6 +1773,15 @@ func (t *logicTest) shutdownCluster() {
 	t.db = nil
 }
 
+// splitRuleNames splits a comma-separated list of optimizer rule names, as
+// given to the -disable-opt-rule-protect and -disable-opt-rule-unprotect flags.
+func splitRuleNames(names string) []string {
+	if names == "" {
+		return nil
+	}
+	return strings.Split(names, ",")
+}
+
 // setup creates the initial cluster for the logic test and populates the
 // relevant fields on logicTest. It is expected to be called only once (per test
 // file), and before processing any test files - unless a mock logicTest is
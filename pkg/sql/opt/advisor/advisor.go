@@ -0,0 +1,274 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package advisor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// Kind identifies a query anti-pattern.
+type Kind uint8
+
+const (
+	// NonSargablePredicate is a comparison between a constant and an
+	// expression that wraps a column, such as lower(s) = 'foo'. Since the
+	// column is wrapped, the predicate cannot be used to constrain a scan of
+	// an index on the column.
+	NonSargablePredicate Kind = iota
+
+	// CrossJoin is an inner join with no join condition between two inputs
+	// that may each return more than one row, which is usually the result of a
+	// missing join condition.
+	CrossJoin
+
+	// OffsetPagination is an OFFSET over an ordered input. Each page must
+	// read and discard all the rows of the previous pages, so the cost of
+	// paginating grows quadratically with the number of pages.
+	OffsetPagination
+)
+
+// String implements the fmt.Stringer interface.
+func (k Kind) String() string {
+	switch k {
+	case NonSargablePredicate:
+		return "non-sargable predicate"
+	case CrossJoin:
+		return "cross join"
+	case OffsetPagination:
+		return "offset pagination"
+	default:
+		return fmt.Sprintf("Kind(%d)", k)
+	}
+}
+
+// Advisory describes an anti-pattern found in a query, along with a suggested
+// rewrite.
+type Advisory struct {
+	Kind Kind
+
+	// Message describes where the anti-pattern occurs in the query.
+	Message string
+
+	// Suggestion describes how the query can be rewritten to avoid the
+	// anti-pattern.
+	Suggestion string
+}
+
+// String implements the fmt.Stringer interface.
+func (a Advisory) String() string {
+	return fmt.Sprintf("%s: %s; %s", a.Kind, a.Message, a.Suggestion)
+}
+
+// FindAdvisories returns advisories for the anti-patterns found in the given
+// normalized expression tree. Because it operates on the normalized tree
+// rather than on the query text, it only reports anti-patterns that remain
+// after the optimizer has simplified the query. For example, a cross join in
+// the FROM clause whose join condition is in the WHERE clause is not reported,
+// since normalization pushes the condition into the join. Duplicate advisories
+// are omitted.
+func FindAdvisories(rootExpr opt.Expr, md *opt.Metadata) []Advisory {
+	f := finder{md: md, seen: make(map[Advisory]struct{})}
+	f.find(rootExpr)
+	return f.advisories
+}
+
+// finder walks an expression tree and collects advisories.
+type finder struct {
+	md         *opt.Metadata
+	advisories []Advisory
+	seen       map[Advisory]struct{}
+}
+
+func (f *finder) add(a Advisory) {
+	if _, ok := f.seen[a]; ok {
+		return
+	}
+	f.seen[a] = struct{}{}
+	f.advisories = append(f.advisories, a)
+}
+
+// find adds advisories for the given expression, then recurses into its
+// children.
+func (f *finder) find(expr opt.Expr) {
+	switch t := expr.(type) {
+	case *memo.InnerJoinExpr:
+		f.checkCrossJoin(t)
+
+	case *memo.OffsetExpr:
+		f.checkOffset(t)
+
+	case *memo.FiltersItem:
+		f.checkSargable(t.Condition)
+	}
+
+	for i, n := 0, expr.ChildCount(); i < n; i++ {
+		f.find(expr.Child(i))
+	}
+}
+
+// checkCrossJoin adds an advisory if the given join has no join condition and
+// both of its inputs may return more than one row.
+func (f *finder) checkCrossJoin(join *memo.InnerJoinExpr) {
+	if len(join.On) != 0 {
+		return
+	}
+	if join.Left.Relational().Cardinality.IsZeroOrOne() ||
+		join.Right.Relational().Cardinality.IsZeroOrOne() {
+		return
+	}
+	f.add(Advisory{
+		Kind: CrossJoin,
+		Message: fmt.Sprintf(
+			"%s is cross joined with %s", f.tableNames(join.Left), f.tableNames(join.Right),
+		),
+		Suggestion: "add a join condition, or use an explicit CROSS JOIN if the cross product is intended",
+	})
+}
+
+// checkOffset adds an advisory if the given offset is used to paginate an
+// ordered input.
+func (f *finder) checkOffset(offset *memo.OffsetExpr) {
+	if offset.Ordering.Any() {
+		return
+	}
+	if c, ok := offset.Offset.(*memo.ConstExpr); ok {
+		if i, ok := c.Value.(*tree.DInt); ok && *i <= 0 {
+			return
+		}
+	}
+	f.add(Advisory{
+		Kind:    OffsetPagination,
+		Message: fmt.Sprintf("OFFSET is applied to rows ordered by %s", f.orderingCols(offset)),
+		Suggestion: "use keyset pagination by filtering on the ordering columns using the " +
+			"values from the last row of the previous page, instead of OFFSET",
+	})
+}
+
+// checkSargable adds an advisory for each comparison in the given condition
+// that compares a constant to an expression wrapping a column.
+func (f *finder) checkSargable(cond opt.ScalarExpr) {
+	switch cond.Op() {
+	case opt.AndOp, opt.OrOp:
+		f.checkSargable(cond.Child(0).(opt.ScalarExpr))
+		f.checkSargable(cond.Child(1).(opt.ScalarExpr))
+		return
+
+	case opt.EqOp, opt.LtOp, opt.GtOp, opt.LeOp, opt.GeOp:
+
+	default:
+		return
+	}
+
+	left, right := cond.Child(0).(opt.ScalarExpr), cond.Child(1).(opt.ScalarExpr)
+	if isConstant(left) {
+		left, right = right, left
+	}
+	if !isConstant(right) {
+		return
+	}
+	col, ok := f.wrappedColumn(left)
+	if !ok {
+		return
+	}
+	colName := f.md.ColumnMeta(col).Alias
+	var suggestion string
+	if fn, ok := left.(*memo.FunctionExpr); ok {
+		suggestion = fmt.Sprintf(
+			"compare %s directly, or create an index on the expression %s(...)", colName, fn.Name,
+		)
+	} else {
+		suggestion = fmt.Sprintf(
+			"rewrite the comparison so that %s is not part of an expression, "+
+				"e.g. by moving arithmetic to the constant side", colName,
+		)
+	}
+	f.add(Advisory{
+		Kind:       NonSargablePredicate,
+		Message:    fmt.Sprintf("column %s is wrapped in an expression in a %s comparison", colName, cond.Op()),
+		Suggestion: suggestion,
+	})
+}
+
+// wrappedColumn returns the table column referenced by the given expression,
+// if the expression is a function, cast, or arithmetic expression that
+// references exactly one column.
+func (f *finder) wrappedColumn(e opt.ScalarExpr) (_ opt.ColumnID, ok bool) {
+	switch e.Op() {
+	case opt.FunctionOp, opt.CastOp, opt.PlusOp, opt.MinusOp, opt.MultOp, opt.DivOp:
+	default:
+		return 0, false
+	}
+	var col opt.ColumnID
+	var count int
+	var collect func(e opt.Expr)
+	collect = func(e opt.Expr) {
+		if v, ok := e.(*memo.VariableExpr); ok {
+			col = v.Col
+			count++
+			return
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			collect(e.Child(i))
+		}
+	}
+	collect(e)
+	if count != 1 || f.md.ColumnMeta(col).Table == 0 {
+		return 0, false
+	}
+	return col, true
+}
+
+// isConstant returns true if the given expression is a constant or a
+// placeholder.
+func isConstant(e opt.ScalarExpr) bool {
+	return opt.IsConstValueOp(e) || e.Op() == opt.PlaceholderOp || memo.CanExtractConstTuple(e)
+}
+
+// tableNames returns the names of the tables whose columns are output by the
+// given expression, or "a subquery" if there are none.
+func (f *finder) tableNames(e memo.RelExpr) string {
+	var names []string
+	var seen opt.TableID
+	e.Relational().OutputCols.ForEach(func(col opt.ColumnID) {
+		tab := f.md.ColumnMeta(col).Table
+		if tab == 0 || tab == seen {
+			return
+		}
+		seen = tab
+		name := f.md.TableMeta(tab).Alias.Object()
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+	})
+	if len(names) == 0 {
+		return "a subquery"
+	}
+	return strings.Join(names, ", ")
+}
+
+// orderingCols returns the names of the columns in the ordering of the given
+// offset.
+func (f *finder) orderingCols(offset *memo.OffsetExpr) string {
+	var names []string
+	for i := range offset.Ordering.Columns {
+		col := offset.Ordering.Columns[i].AnyID()
+		names = append(names, f.md.ColumnMeta(col).Alias)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package advisor_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/advisor"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/opttester"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/testcat"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestFindAdvisories tests that FindAdvisories reports non-sargable
+// predicates, cross joins and offset pagination in normalized queries, and
+// nothing for queries without them.
+func TestFindAdvisories(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := testcat.New()
+	if _, err := catalog.ExecuteDDL(
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		sql      string
+		expected []advisor.Kind
+	}{
+		{sql: "SELECT * FROM abc WHERE b = 1 AND c = 'foo'"},
+		{sql: "SELECT * FROM abc WHERE a + 1 = b"},
+		{
+			sql:      "SELECT * FROM abc WHERE lower(c) = 'foo'",
+			expected: []advisor.Kind{advisor.NonSargablePredicate},
+		},
+		{
+			sql:      "SELECT * FROM abc WHERE b * 2 > 10 OR a = 1",
+			expected: []advisor.Kind{advisor.NonSargablePredicate},
+		},
+		{sql: "SELECT * FROM abc AS x, abc AS y WHERE x.a = y.b"},
+		{
+			sql:      "SELECT * FROM abc AS x, abc AS y WHERE x.b = 1",
+			expected: []advisor.Kind{advisor.CrossJoin},
+		},
+		{sql: "SELECT * FROM abc AS x, abc AS y WHERE y.a = 1"},
+		{sql: "SELECT * FROM abc OFFSET 10"},
+		{
+			sql:      "SELECT * FROM abc ORDER BY a LIMIT 10 OFFSET 100",
+			expected: []advisor.Kind{advisor.OffsetPagination},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.sql, func(t *testing.T) {
+			expr, err := opttester.New(catalog, tc.sql).OptNorm()
+			if err != nil {
+				t.Fatal(err)
+			}
+			md := expr.(memo.RelExpr).Memo().Metadata()
+			advisories := advisor.FindAdvisories(expr, md)
+			if len(advisories) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, advisories)
+			}
+			for i := range advisories {
+				if advisories[i].Kind != tc.expected[i] {
+					t.Errorf("expected %v, got %v", tc.expected, advisories)
+				}
+			}
+		})
+	}
+}
@@ -192,6 +192,33 @@ type Index interface {
 	// Partition returns the ith PARTITION BY LIST partition within the index
 	// definition, where i < PartitionCount.
 	Partition(i int) Partition
+
+	// RangeDistribution returns information about how the index's key space is
+	// split into ranges, and how the leases for those ranges are spread across
+	// nodes. If this information is not known, the zero value is returned.
+	//
+	// Only the test catalog currently provides a range distribution; the SQL
+	// catalog always returns the zero value.
+	RangeDistribution() RangeDistribution
+}
+
+// RangeDistribution describes how an index is distributed across the ranges
+// and nodes of the cluster. It allows the coster to distinguish a scan that
+// touches a single range from a scan of the same estimated row count that
+// touches hundreds of ranges on many different nodes.
+type RangeDistribution struct {
+	// RangeCount is the number of ranges that the index's span is split into.
+	// It is zero if the number of ranges is not known.
+	RangeCount int
+
+	// LeaseholderCount is the number of distinct nodes that hold leases for the
+	// index's ranges. It is zero if the lease distribution is not known.
+	LeaseholderCount int
+}
+
+// Known returns true if the range distribution is known.
+func (r RangeDistribution) Known() bool {
+	return r.RangeCount > 0
 }
 
 // IndexColumn describes a single column that is part of an index definition.
@@ -0,0 +1,42 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cat
+
+// StatsProvider supplies the table statistics that the optimizer uses to
+// estimate cardinalities. It decouples access to statistics from the Catalog,
+// so that tests, the index advisor, and external statistics services (e.g. a
+// store of learned cardinalities) can supply estimates without implementing a
+// full catalog.
+type StatsProvider interface {
+	// StatisticCount returns the number of statistics available for the given
+	// table.
+	StatisticCount(tab Table) int
+
+	// Statistic returns the ith statistic for the given table, where
+	// i < StatisticCount. Statistics must be ordered with the most recent first.
+	Statistic(tab Table, i int) TableStatistic
+}
+
+// TableStatsProvider is the default StatsProvider, which supplies the
+// statistics stored with each table in the catalog.
+var TableStatsProvider StatsProvider = tableStatsProvider{}
+
+type tableStatsProvider struct{}
+
+// StatisticCount is part of the StatsProvider interface.
+func (tableStatsProvider) StatisticCount(tab Table) int {
+	return tab.StatisticCount()
+}
+
+// Statistic is part of the StatsProvider interface.
+func (tableStatsProvider) Statistic(tab Table, i int) TableStatistic {
+	return tab.Statistic(i)
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package opt
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+)
+
+// DisabledRulesClusterSetting is a comma-separated list of the names of the
+// optimizer rules that are disabled for every session. Any rule in the RuleName
+// enumeration can be named, so that a rule that produces incorrect results or
+// poor plans can be turned off cluster-wide as a mitigation, without waiting
+// for a patch release. The rules are disabled in addition to the rules named
+// by the optimizer_disable_rules session variable. It is defined here rather
+// than in the xform package so that memo staleness checks can consult it.
+var DisabledRulesClusterSetting = settings.RegisterValidatedStringSetting(
+	settings.TenantWritable,
+	"sql.optimizer.disabled_rules",
+	"comma-separated list of optimizer rules that are disabled for all sessions, in addition to "+
+		"those disabled by the optimizer_disable_rules session variable; rules that the optimizer "+
+		"requires to produce a plan cannot be disabled and are ignored",
+	"", /* defaultValue */
+	func(_ *settings.Values, val string) error {
+		_, err := ParseRuleNames(val)
+		return err
+	},
+)
+
+// ParseRuleNames returns the rules named in the given comma-separated list.
+// Whitespace around each name and empty names are ignored. It returns an error
+// if any of the names is not the name of a rule.
+func ParseRuleNames(list string) ([]RuleName, error) {
+	var rules []RuleName
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		r, ok := ParseRuleName(name)
+		if !ok {
+			return nil, pgerror.Newf(pgcode.InvalidParameterValue, "unknown optimizer rule %q", name)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -237,9 +237,15 @@ func (b *Builder) buildRelational(e memo.RelExpr) (execPlan, error) {
 	case *memo.SortExpr:
 		ep, err = b.buildSort(t)
 
+	case *memo.TopKSortExpr:
+		ep, err = b.buildTopKSort(t)
+
 	case *memo.DistributeExpr:
 		ep, err = b.buildDistribute(t)
 
+	case *memo.GatherExpr:
+		ep, err = b.buildGather(t)
+
 	case *memo.IndexJoinExpr:
 		ep, err = b.buildIndexJoin(t)
 
@@ -261,6 +267,9 @@ func (b *Builder) buildRelational(e memo.RelExpr) (execPlan, error) {
 	case *memo.Max1RowExpr:
 		ep, err = b.buildMax1Row(t)
 
+	case *memo.BarrierExpr:
+		ep, err = b.buildBarrier(t)
+
 	case *memo.ProjectSetExpr:
 		ep, err = b.buildProjectSet(t)
 
@@ -379,10 +388,21 @@ func (b *Builder) buildRelational(e memo.RelExpr) (execPlan, error) {
 	// information.
 	if ef, ok := b.factory.(exec.ExplainFactory); ok {
 		stats := &e.Relational().Stats
+		breakdown := b.mem.CostBreakdown(e)
+		selfBreakdown := b.mem.SelfCostBreakdown(e)
 		val := exec.EstimatedStats{
 			TableStatsAvailable: stats.Available,
 			RowCount:            stats.RowCount,
 			Cost:                float64(e.Cost()),
+			CPUCost:             float64(breakdown.CPU),
+			IOCost:              float64(breakdown.IO),
+			NetworkCost:         float64(breakdown.Network),
+			MemoryCost:          float64(breakdown.Memory),
+			SelfCost:            float64(b.mem.SelfCost(e)),
+			SelfCPUCost:         float64(selfBreakdown.CPU),
+			SelfIOCost:          float64(selfBreakdown.IO),
+			SelfNetworkCost:     float64(selfBreakdown.Network),
+			SelfMemoryCost:      float64(selfBreakdown.Memory),
 		}
 		if scan, ok := e.(*memo.ScanExpr); ok {
 			tab := b.mem.Metadata().Table(scan.Table)
@@ -559,7 +579,9 @@ func (b *Builder) scanParams(
 			}
 		}
 
-		return exec.ScanParams{}, opt.ColMap{}, err
+		return exec.ScanParams{}, opt.ColMap{}, xform.NewOptimizationError(
+			xform.HintConflictError, opt.ScanOp, opt.InvalidRuleName, err,
+		)
 	}
 
 	locking := scan.Locking
@@ -667,7 +689,8 @@ func (b *Builder) buildScan(scan *memo.ScanExpr) (execPlan, error) {
 	}
 
 	if scan.Flags.ForceZigzag {
-		return execPlan{}, fmt.Errorf("could not produce a query plan conforming to the FORCE_ZIGZAG hint")
+		return execPlan{}, xform.NewOptimizationError(xform.HintConflictError, scan.Op(), opt.InvalidRuleName,
+			errors.New("could not produce a query plan conforming to the FORCE_ZIGZAG hint"))
 	}
 
 	isUnfiltered := scan.IsUnfiltered(md)
@@ -677,7 +700,8 @@ func (b *Builder) buildScan(scan *memo.ScanExpr) (execPlan, error) {
 		// user has explicitly forced the partial index *and* used NO_FULL_SCAN, we
 		// disallow the full index scan.
 		if isUnfiltered || (scan.Flags.ForceIndex && scan.IsFullIndexScan(md)) {
-			return execPlan{}, fmt.Errorf("could not produce a query plan conforming to the NO_FULL_SCAN hint")
+			return execPlan{}, xform.NewOptimizationError(xform.HintConflictError, scan.Op(), opt.InvalidRuleName,
+				errors.New("could not produce a query plan conforming to the NO_FULL_SCAN hint"))
 		}
 	}
 
@@ -1089,9 +1113,8 @@ func (b *Builder) buildHashJoin(join memo.RelExpr) (execPlan, error) {
 			hint = tree.AstInverted
 		}
 
-		return execPlan{}, errors.Errorf(
-			"could not produce a query plan conforming to the %s JOIN hint", hint,
-		)
+		return execPlan{}, xform.NewOptimizationError(xform.HintConflictError, join.Op(), opt.InvalidRuleName,
+			errors.Errorf("could not produce a query plan conforming to the %s JOIN hint", hint))
 	}
 
 	joinType := joinOpToJoinType(join.Op())
@@ -1658,6 +1681,39 @@ func (b *Builder) buildSort(sort *memo.SortExpr) (execPlan, error) {
 	return execPlan{root: node, outputCols: input.outputCols}, nil
 }
 
+// buildTopKSort builds a plan for a TopKSortOp, which is an enforcer that only
+// returns the first K rows in the required ordering.
+func (b *Builder) buildTopKSort(sort *memo.TopKSortExpr) (execPlan, error) {
+	input, err := b.buildRelational(sort.Input)
+	if err != nil {
+		return execPlan{}, err
+	}
+
+	ordering := sort.ProvidedPhysical().Ordering
+	inputOrdering := sort.Input.ProvidedPhysical().Ordering
+	alreadyOrderedPrefix := 0
+	for i := range inputOrdering {
+		if i == len(ordering) {
+			return execPlan{}, errors.AssertionFailedf("sort ordering already provided by input")
+		}
+		if inputOrdering[i] != ordering[i] {
+			break
+		}
+		alreadyOrderedPrefix = i + 1
+	}
+
+	node, err := b.factory.ConstructTopK(
+		input.root,
+		sort.K,
+		exec.OutputOrdering(input.sqlOrdering(ordering)),
+		alreadyOrderedPrefix,
+	)
+	if err != nil {
+		return execPlan{}, err
+	}
+	return execPlan{root: node, outputCols: input.outputCols}, nil
+}
+
 func (b *Builder) buildDistribute(distribute *memo.DistributeExpr) (execPlan, error) {
 	input, err := b.buildRelational(distribute.Input)
 	if err != nil {
@@ -1678,6 +1734,18 @@ func (b *Builder) buildDistribute(distribute *memo.DistributeExpr) (execPlan, er
 	return input, err
 }
 
+func (b *Builder) buildGather(gather *memo.GatherExpr) (execPlan, error) {
+	// This is currently a no-op. The DistSQL planner decides how to parallelize
+	// the input; the Gather enforcer only allows the optimizer to cost the
+	// parallel plan.
+	return b.buildRelational(gather.Input)
+}
+
+func (b *Builder) buildBarrier(barrier *memo.BarrierExpr) (execPlan, error) {
+	// A Barrier only affects optimization, so it is not executed.
+	return b.buildRelational(barrier.Input)
+}
+
 func (b *Builder) buildOrdinality(ord *memo.OrdinalityExpr) (execPlan, error) {
 	input, err := b.buildRelational(ord.Input)
 	if err != nil {
@@ -2632,6 +2700,7 @@ var boundedStalenessAllowList = map[opt.Operator]struct{}{
 	opt.SortOp:             {},
 	opt.OrdinalityOp:       {},
 	opt.Max1RowOp:          {},
+	opt.BarrierOp:          {},
 	opt.ProjectSetOp:       {},
 	opt.WindowOp:           {},
 	opt.ExplainOp:          {},
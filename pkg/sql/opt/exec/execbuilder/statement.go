@@ -96,9 +96,11 @@ func (b *Builder) buildExplainOpt(explain *memo.ExplainExpr) (execPlan, error) {
 		// TODO(radu): add views, sequences
 	}
 
-	// If MEMO option was passed, show the memo.
+	// If MEMO option was passed, show the memo. The memo may have been detached
+	// from the optimizer, e.g. if it was cached, so format it using the lowest
+	// cost expressions that the optimizer retained in it.
 	if explain.Options.Flags[tree.ExplainFlagMemo] {
-		planText.WriteString(b.optimizer.FormatMemo(xform.FmtPretty))
+		planText.WriteString(xform.FormatOptimizedMemo(b.mem, xform.FmtPretty))
 	}
 
 	f := memo.MakeExprFmtCtx(fmtFlags, b.mem, b.catalog)
@@ -475,7 +475,18 @@ func (e *emitter) emitNodeAttributes(n *Node) error {
 				}
 			}
 		}
-		// TODO(radu): we may want to emit estimated cost in Verbose mode.
+		if e.ob.flags.ShowCosts && !e.ob.flags.OnlyShape {
+			e.ob.AddField("estimated cost", fmt.Sprintf("%.9g", s.Cost))
+			e.ob.AddField("estimated cost breakdown", fmt.Sprintf(
+				"cpu: %.9g, io: %.9g, network: %.9g, memory: %.9g",
+				s.CPUCost, s.IOCost, s.NetworkCost, s.MemoryCost,
+			))
+			e.ob.AddField("estimated self cost", fmt.Sprintf("%.9g", s.SelfCost))
+			e.ob.AddField("estimated self cost breakdown", fmt.Sprintf(
+				"cpu: %.9g, io: %.9g, network: %.9g, memory: %.9g",
+				s.SelfCPUCost, s.SelfIOCost, s.SelfNetworkCost, s.SelfMemoryCost,
+			))
+		}
 	}
 
 	ob := e.ob
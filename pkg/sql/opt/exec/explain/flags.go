@@ -29,6 +29,10 @@ type Flags struct {
 	// This is used for EXPLAIN(SHAPE), which is used for the statement-bundle
 	// debug tool.
 	OnlyShape bool
+	// If ShowCosts is true, the estimated cost of each operator is shown, along
+	// with its breakdown by resource and the cost of the operator itself. This
+	// is used for EXPLAIN (COSTS).
+	ShowCosts bool
 
 	// Redaction control (for testing purposes).
 	Redact RedactFlags
@@ -74,6 +78,9 @@ func MakeFlags(options *tree.ExplainOptions) Flags {
 		f.Verbose = true
 		f.ShowTypes = true
 	}
+	if options.Flags[tree.ExplainFlagCosts] {
+		f.ShowCosts = true
+	}
 	if options.Flags[tree.ExplainFlagShape] {
 		f.HideValues = true
 		f.OnlyShape = true
@@ -0,0 +1,169 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package explain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/errors"
+)
+
+// PlanIncompatibility describes a reason that a plan encoded in a gist cannot
+// be reproduced by the current version of the optimizer.
+type PlanIncompatibility struct {
+	// Reason describes the incompatibility.
+	Reason string
+}
+
+func (p PlanIncompatibility) String() string {
+	return p.Reason
+}
+
+// CheckPlanGistCompatibility verifies whether the plan encoded in the given
+// gist, which may have been produced by an older version, can be reproduced by
+// the current version against the given catalog. It reports each of the
+// following incompatibilities:
+//
+//   - The gist was encoded with an unsupported version of the gist encoding,
+//     which means the set of operators may have changed.
+//   - The gist contains an operator that no longer exists.
+//   - The plan references a table or index that no longer exists.
+//
+// An empty result indicates that the plan is compatible. An error is returned
+// only if the gist is not valid base64. CheckPlanGistCompatibility is intended
+// to support subsystems which persist plans across upgrades, such as plan
+// baselines and plan export.
+func CheckPlanGistCompatibility(
+	gist string, catalog cat.Catalog,
+) ([]PlanIncompatibility, error) {
+	b, err := base64.StdEncoding.DecodeString(gist)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid plan gist")
+	}
+
+	ver, err := binary.ReadVarint(bytes.NewReader(b))
+	if err != nil {
+		return []PlanIncompatibility{{Reason: "plan gist is missing a version"}}, nil
+	}
+	if int(ver) > gistVersion {
+		return []PlanIncompatibility{{Reason: fmt.Sprintf(
+			"plan gist version %d is newer than the current version %d", ver, gistVersion,
+		)}}, nil
+	}
+	if int(ver) != gistVersion {
+		return []PlanIncompatibility{{Reason: fmt.Sprintf(
+			"plan gist version %d is no longer supported (current version %d)", ver, gistVersion,
+		)}}, nil
+	}
+
+	plan, err := DecodePlanGistToPlan(gist, catalog)
+	if err != nil {
+		// The version is supported, so the most likely reason that the gist
+		// cannot be decoded is that it contains an operator that no longer
+		// exists.
+		return []PlanIncompatibility{{Reason: fmt.Sprintf("unable to decode plan: %v", err)}}, nil
+	}
+
+	var c planCompatChecker
+	c.checkNode(plan.Root)
+	for i := range plan.Subqueries {
+		if n, ok := plan.Subqueries[i].Root.(*Node); ok {
+			c.checkNode(n)
+		}
+	}
+	for _, n := range plan.Checks {
+		c.checkNode(n)
+	}
+	return c.incompatibilities, nil
+}
+
+// planCompatChecker walks a plan decoded from a gist and accumulates
+// incompatibilities.
+type planCompatChecker struct {
+	incompatibilities []PlanIncompatibility
+}
+
+func (c *planCompatChecker) add(format string, args ...interface{}) {
+	c.incompatibilities = append(c.incompatibilities, PlanIncompatibility{
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkTable reports an incompatibility if the given table could not be
+// resolved when the gist was decoded.
+func (c *planCompatChecker) checkTable(opName string, table cat.Table) bool {
+	if table == nil {
+		c.add("%s references a table that no longer exists", opName)
+		return false
+	}
+	return true
+}
+
+// checkIndex reports an incompatibility if the given index of the given table
+// could not be resolved when the gist was decoded.
+func (c *planCompatChecker) checkIndex(opName string, table cat.Table, index cat.Index) {
+	if c.checkTable(opName, table) && index == nil {
+		c.add("%s references an index of table %s that no longer exists", opName, table.Name())
+	}
+}
+
+func (c *planCompatChecker) checkNode(n *Node) {
+	if n == nil {
+		return
+	}
+	switch n.op {
+	case scanOp:
+		a := n.args.(*scanArgs)
+		c.checkIndex("scan", a.Table, a.Index)
+
+	case indexJoinOp:
+		c.checkTable("index join", n.args.(*indexJoinArgs).Table)
+
+	case lookupJoinOp:
+		a := n.args.(*lookupJoinArgs)
+		c.checkIndex("lookup join", a.Table, a.Index)
+
+	case invertedJoinOp:
+		a := n.args.(*invertedJoinArgs)
+		c.checkIndex("inverted join", a.Table, a.Index)
+
+	case zigzagJoinOp:
+		a := n.args.(*zigzagJoinArgs)
+		c.checkIndex("zigzag join", a.LeftTable, a.LeftIndex)
+		c.checkIndex("zigzag join", a.RightTable, a.RightIndex)
+
+	case insertOp:
+		c.checkTable("insert", n.args.(*insertArgs).Table)
+
+	case insertFastPathOp:
+		c.checkTable("insert", n.args.(*insertFastPathArgs).Table)
+
+	case upsertOp:
+		c.checkTable("upsert", n.args.(*upsertArgs).Table)
+
+	case updateOp:
+		c.checkTable("update", n.args.(*updateArgs).Table)
+
+	case deleteOp:
+		c.checkTable("delete", n.args.(*deleteArgs).Table)
+
+	case deleteRangeOp:
+		c.checkTable("delete range", n.args.(*deleteRangeArgs).Table)
+	}
+
+	for _, child := range n.children {
+		c.checkNode(child)
+	}
+}
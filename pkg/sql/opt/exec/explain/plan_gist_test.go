@@ -146,3 +146,48 @@ func TestPlanGistHashEquivalency(t *testing.T) {
 		t.Errorf("gists should be different! %s == %s", gist1.String(), gist2.String())
 	}
 }
+
+// TestCheckPlanGistCompatibility tests that CheckPlanGistCompatibility reports
+// a plan gist that references a table that no longer exists.
+func TestCheckPlanGistCompatibility(t *testing.T) {
+	catalog := testcat.New()
+	_, err := catalog.ExecuteDDL("CREATE TABLE foo (x int);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot := opttester.New(catalog, "SELECT * FROM foo;")
+	gist := makeGist(ot, t)
+
+	incompatibilities, err := explain.CheckPlanGistCompatibility(gist.String(), catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incompatibilities) != 0 {
+		t.Errorf("expected no incompatibilities, got %v", incompatibilities)
+	}
+
+	// The table is recreated with a new ID, so the gist no longer references
+	// an existing table.
+	_, err = catalog.ExecuteDDL("DROP TABLE foo;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = catalog.ExecuteDDL("CREATE TABLE foo (x int);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incompatibilities, err = explain.CheckPlanGistCompatibility(gist.String(), catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incompatibilities) != 1 {
+		t.Fatalf("expected one incompatibility, got %v", incompatibilities)
+	}
+	if expected := "scan references a table that no longer exists"; incompatibilities[0].Reason != expected {
+		t.Errorf("expected %q, got %q", expected, incompatibilities[0].Reason)
+	}
+
+	if _, err := explain.CheckPlanGistCompatibility("not base64!", catalog); err == nil {
+		t.Error("expected error for invalid gist")
+	}
+}
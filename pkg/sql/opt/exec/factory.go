@@ -304,6 +304,20 @@ type EstimatedStats struct {
 	// Cost is the estimated cost of the operator. This cost includes the costs of
 	// the child operators.
 	Cost float64
+	// CPUCost, IOCost, NetworkCost and MemoryCost divide Cost between the
+	// resources that contribute to it. See memo.CostBreakdown for details.
+	CPUCost     float64
+	IOCost      float64
+	NetworkCost float64
+	MemoryCost  float64
+	// SelfCost is the estimated cost of the operator itself, excluding the costs
+	// of the child operators. SelfCPUCost, SelfIOCost, SelfNetworkCost and
+	// SelfMemoryCost divide it between resources.
+	SelfCost        float64
+	SelfCPUCost     float64
+	SelfIOCost      float64
+	SelfNetworkCost float64
+	SelfMemoryCost  float64
 	// LimitHint is the "soft limit" of the number of result rows that may be
 	// required. See physical.Required for details.
 	LimitHint float64
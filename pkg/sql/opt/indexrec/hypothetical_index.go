@@ -222,3 +222,8 @@ func (hi *hypotheticalIndex) PartitionCount() int {
 func (hi *hypotheticalIndex) Partition(i int) cat.Partition {
 	return nil
 }
+
+// RangeDistribution is part of the cat.Index interface.
+func (hi *hypotheticalIndex) RangeDistribution() cat.RangeDistribution {
+	return cat.RangeDistribution{}
+}
@@ -30,6 +30,14 @@ import (
 	"github.com/cockroachdb/errors"
 )
 
+// jsonOrArrayJoinPlanner extracts inverted join conditions from containment
+// predicates (@> and <@) between an indexed JSON or array column and a column
+// of the join input. It is used by the GenerateInvertedJoins and
+// GenerateInvertedJoinsFromSelect exploration rules, which add an inverted join
+// to the memo alongside the hash, merge and lookup joins generated by other
+// rules, so that the choice between them is made by the coster (see
+// computeInvertedJoinCost). Either argument of the predicate may be the indexed
+// column; if it is the second argument, the predicate is commuted.
 type jsonOrArrayJoinPlanner struct {
 	factory   *norm.Factory
 	tabID     opt.TableID
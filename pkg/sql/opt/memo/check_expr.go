@@ -40,19 +40,8 @@ func (m *Memo) CheckExpr(e opt.Expr) {
 		t.Relational().Verify()
 
 		// If the expression was added to an existing group, cross-check its
-		// properties against the properties of the group. Skip this check if the
-		// operator is known to not have code for building logical props.
-		if t != t.FirstExpr() && t.Op() != opt.MergeJoinOp && t.Op() != opt.PlaceholderScanOp {
-			var relProps props.Relational
-			// Don't build stats when verifying logical props - unintentionally
-			// building stats for non-normalized expressions could add extra colStats
-			// to the output in opt_tester in cases where checkExpr runs (i.e. testrace)
-			// compared to cases where it doesn't.
-			m.logPropsBuilder.disableStats = true
-			m.logPropsBuilder.buildProps(t, &relProps)
-			m.logPropsBuilder.disableStats = false
-			t.Relational().VerifyAgainst(&relProps)
-		}
+		// properties against the properties of the group.
+		m.VerifyMemberProps(t)
 
 	case ScalarPropsExpr:
 		t.ScalarProps().Verify()
@@ -374,6 +363,30 @@ func (m *Memo) CheckExpr(e opt.Expr) {
 	}
 }
 
+// VerifyMemberProps rebuilds the logical properties of the given expression,
+// and panics with an assertion failure if they are inconsistent with the
+// properties of its memo group. It does nothing if the expression is the first
+// member of its group, whose properties are the properties of the group, or if
+// its operator is known to not have code for building logical props. Like
+// props.Relational.VerifyAgainst, it is only defined in crdb_test builds.
+func (m *Memo) VerifyMemberProps(e RelExpr) {
+	if !buildutil.CrdbTestBuild {
+		return
+	}
+	if e == e.FirstExpr() || e.Op() == opt.MergeJoinOp || e.Op() == opt.PlaceholderScanOp {
+		return
+	}
+	var relProps props.Relational
+	// Don't build stats when verifying logical props - unintentionally
+	// building stats for non-normalized expressions could add extra colStats
+	// to the output in opt_tester in cases where checkExpr runs (i.e. testrace)
+	// compared to cases where it doesn't.
+	m.logPropsBuilder.disableStats = true
+	m.logPropsBuilder.buildProps(e, &relProps)
+	m.logPropsBuilder.disableStats = false
+	e.Relational().VerifyAgainst(&relProps)
+}
+
 func (m *Memo) checkColListLen(colList opt.OptionalColList, expectedLen int, listName string) {
 	if len(colList) != expectedLen {
 		panic(errors.AssertionFailedf("column list %s expected length = %d, actual length = %d",
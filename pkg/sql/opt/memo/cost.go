@@ -10,7 +10,10 @@
 
 package memo
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
 
 // Cost is the best-effort approximation of the actual cost of executing a
 // particular operator tree.
@@ -41,3 +44,66 @@ func (c Cost) Less(other Cost) bool {
 func (c Cost) Sub(other Cost) Cost {
 	return c - other
 }
+
+// CostBreakdown divides a Cost between the resources that contribute to it. It
+// is used to explain where the cost of an expression comes from; the Cost
+// itself remains the only value used to compare expressions.
+type CostBreakdown struct {
+	// CPU is the cost of processing rows, along with any cost that cannot be
+	// attributed to another resource, such as penalties for plans that should
+	// be avoided.
+	CPU Cost
+
+	// IO is the cost of reading and writing KV data, such as scanning rows,
+	// seeking to the start of spans, and writing index entries.
+	IO Cost
+
+	// Network is the cost of communicating with other nodes, such as visiting
+	// ranges with different leaseholders and exchanging rows between parallel
+	// streams.
+	Network Cost
+
+	// Memory is the cost of buffering rows, including the expected cost of
+	// spilling them to disk when they do not fit in memory.
+	Memory Cost
+}
+
+// Total returns the sum of the costs of all resources.
+func (b CostBreakdown) Total() Cost {
+	return b.CPU + b.IO + b.Network + b.Memory
+}
+
+// Add adds the costs in the other breakdown to this breakdown.
+func (b *CostBreakdown) Add(other CostBreakdown) {
+	b.CPU += other.CPU
+	b.IO += other.IO
+	b.Network += other.Network
+	b.Memory += other.Memory
+}
+
+// Scale multiplies the cost of each resource by the given factor.
+func (b *CostBreakdown) Scale(factor float64) {
+	b.CPU *= Cost(factor)
+	b.IO *= Cost(factor)
+	b.Network *= Cost(factor)
+	b.Memory *= Cost(factor)
+}
+
+func (b CostBreakdown) String() string {
+	return fmt.Sprintf("cpu: %.9g, io: %.9g, network: %.9g, memory: %.9g",
+		b.CPU, b.IO, b.Network, b.Memory)
+}
+
+// CostInterval is the range within which the actual cost of executing an
+// operator tree is expected to fall, given that the row counts on which the
+// estimated cost is based may be wrong.
+type CostInterval struct {
+	// Low is the best-case cost.
+	Low Cost
+
+	// Estimate is the estimated cost.
+	Estimate Cost
+
+	// High is the worst-case cost.
+	High Cost
+}
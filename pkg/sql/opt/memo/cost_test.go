@@ -51,3 +51,21 @@ func TestCostSub(t *testing.T) {
 	testSub(memo.Cost(3.0), memo.Cost(10.0), memo.Cost(-7.0))
 	testSub(memo.Cost(10.0), memo.Cost(10.0), memo.Cost(0.0))
 }
+
+// TestCostBreakdown tests adding, scaling and formatting cost breakdowns.
+func TestCostBreakdown(t *testing.T) {
+	var b memo.CostBreakdown
+	b.Add(memo.CostBreakdown{CPU: 1, IO: 2})
+	b.Add(memo.CostBreakdown{Network: 3, Memory: 4})
+	if b.Total() != 10 {
+		t.Errorf("expected total cost 10, got %v", b.Total())
+	}
+	b.Scale(0.5)
+	expected := memo.CostBreakdown{CPU: 0.5, IO: 1, Network: 1.5, Memory: 2}
+	if b != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+	if s := b.String(); s != "cpu: 0.5, io: 1, network: 1.5, memory: 2" {
+		t.Errorf("unexpected string %q", s)
+	}
+}
@@ -97,7 +97,21 @@ type RelExpr interface {
 
 	// setNext sets this expression's next pointer to point to the given
 	// expression. setNext will panic if the next pointer has already been set.
+	//
+	// Groups are append-only: once an expression is added to a group, it is
+	// never removed, even if it can never be part of the lowest cost plan. The
+	// optimizer tracks which members have been explored and fully optimized by
+	// their ordinal position in the group, separately for each set of required
+	// properties, so removing a member would invalidate that state. The removed
+	// expression would also remain in the interner, so an identical expression
+	// generated later would be deduplicated to an expression that is not in any
+	// group.
 	setNext(e RelExpr)
+
+	// replaceNext sets this expression's next pointer to point to the given
+	// expression, which may be nil, replacing any existing next pointer. It is
+	// only used by Memo.Compact, once the memo has been optimized and detached.
+	replaceNext(e RelExpr)
 }
 
 // ScalarPropsExpr is implemented by scalar expressions which cache scalar
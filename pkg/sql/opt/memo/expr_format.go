@@ -821,6 +821,9 @@ func (f *ExprFmtCtx) formatRelational(e RelExpr, tp treeprinter.Node) {
 		if required.LimitHint != 0 {
 			tp.Childf("limit hint: %.2f", required.LimitHint)
 		}
+		if required.HardLimit != 0 {
+			tp.Childf("hard limit: %d", required.HardLimit)
+		}
 
 		// Show the required distribution, if any, and also show the provided input
 		// distribution if this is a Distribute expression.
@@ -830,6 +833,18 @@ func (f *ExprFmtCtx) formatRelational(e RelExpr, tp treeprinter.Node) {
 		if distribute, ok := e.(*DistributeExpr); ok {
 			tp.Childf("input distribution: %s", distribute.Input.ProvidedPhysical().Distribution.String())
 		}
+		if required.MaxParallelism != 0 {
+			tp.Childf("max parallelism: %d", required.MaxParallelism)
+		}
+		if required.Parallelism != 0 {
+			tp.Childf("parallelism: %d", required.Parallelism)
+		}
+		if required.Streaming {
+			tp.Child("streaming")
+		}
+		if required.NoFullScan {
+			tp.Child("no full scan")
+		}
 	}
 
 	if !f.HasFlags(ExprFmtHideRuleProps) {
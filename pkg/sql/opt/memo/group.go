@@ -56,4 +56,12 @@ type bestProps struct {
 
 	// Cost of the best expression.
 	cost Cost
+
+	// Breakdown of the cost of the best expression by resource.
+	breakdown CostBreakdown
+
+	// Cost of the best expression itself, excluding the costs of its children,
+	// and its breakdown by resource.
+	selfCost      Cost
+	selfBreakdown CostBreakdown
 }
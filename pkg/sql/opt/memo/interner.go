@@ -28,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/errors"
 )
 
@@ -37,6 +38,13 @@ const (
 
 	// prime64 is a large-ish prime number used in hashing and taken from fnv.go.
 	prime64 = 1099511628211
+
+	// numInternShards is the number of shards into which the interned items are
+	// partitioned. It must be a power of two.
+	numInternShards = 32
+
+	// internShardMask selects the bits of a hash value that determine its shard.
+	internShardMask = numInternShards - 1
 )
 
 // internHash is a 64-bit hash value, computed using the FNV-1a algorithm.
@@ -88,6 +96,14 @@ type internHash uint64
 // This pattern enables very low overhead hashing of expressions - the
 // allocation of a Go map with a fast 64-bit key, plus a couple of reusable
 // scratch byte arrays.
+//
+// The interned items are partitioned by hash value into shards. An interner is
+// not safe for concurrent use, but it can be forked into several interners that
+// share the same shards, each of which can be used by a different goroutine.
+// Once an interner has been forked, every lookup locks the shard it accesses,
+// so goroutines that intern expressions with different hash values rarely
+// contend with each other. The memo does not yet fork its interner, since the
+// rest of its group storage is not safe for concurrent use (see Memo.interner).
 type interner struct {
 	// hasher is a helper struct to compute hashes and test equality.
 	hasher hasher
@@ -97,11 +113,45 @@ type interner struct {
 	cache internCache
 }
 
+// maxRetainedInternedItems is the maximum number of items an interner can
+// have held for reset to retain its maps. Go maps never shrink, so the maps of
+// an interner that held a very large memo are released rather than retained.
+const maxRetainedInternedItems = 1 << 14
+
+// reset removes all interned items. The maps that held them are retained, so
+// that the next memo that is built by the same factory does not need to
+// allocate them again, unless they are shared with another interner (see
+// fork) or are too large to be worth retaining.
+func (in *interner) reset() {
+	shards := in.cache.shards
+	if shards == nil || shards.concurrent || in.Count() > maxRetainedInternedItems {
+		*in = interner{hasher: in.hasher}
+		return
+	}
+	for i := range shards.shards {
+		items := shards.shards[i].items
+		for hash := range items {
+			delete(items, hash)
+		}
+	}
+	*in = interner{hasher: in.hasher, cache: internCache{shards: shards}}
+}
+
 // Count returns the number of expressions that have been interned.
 func (in *interner) Count() int {
 	return in.cache.Count()
 }
 
+// fork returns a new interner that shares the interned items of this interner.
+// The new interner can be used by another goroutine concurrently with this one.
+// fork must not be called concurrently with any use of the interners that
+// share its items.
+func (in *interner) fork() interner {
+	in.cache.initShards()
+	in.cache.shards.concurrent = true
+	return interner{cache: internCache{shards: in.cache.shards}}
+}
+
 var physPropsType = reflect.TypeOf((*physical.Required)(nil))
 var physPropsTypePtr = uint64(reflect.ValueOf(physPropsType).Pointer())
 
@@ -111,6 +161,30 @@ var physPropsTypePtr = uint64(reflect.ValueOf(physPropsType).Pointer())
 // to the heap. It does this by making a copy of the physical properties before
 // adding them to the cache.
 func (in *interner) InternPhysicalProps(val *physical.Required) *physical.Required {
+	if existing := in.lookupPhysicalProps(val); existing != nil {
+		in.cache.Finish()
+		return existing
+	}
+
+	// Shallow copy the props to prevent "val" from escaping.
+	copy := *val
+	in.cache.Add(&copy)
+	return &copy
+}
+
+// isInternedPhysicalProps returns true if the given physical properties were
+// returned by InternPhysicalProps, rather than being an equal copy of them.
+func (in *interner) isInternedPhysicalProps(val *physical.Required) bool {
+	existing := in.lookupPhysicalProps(val)
+	in.cache.Finish()
+	return existing == val
+}
+
+// lookupPhysicalProps returns the interned physical properties that are equal
+// to the given properties, or nil if there are none. If it returns nil, the
+// cache is positioned so that the properties can be added by calling Add. The
+// caller must finish the lookup by calling either Add or Finish.
+func (in *interner) lookupPhysicalProps(val *physical.Required) *physical.Required {
 	// Hash the physical.Required reflect type to distinguish it from other values.
 	in.hasher.Init()
 	in.hasher.HashUint64(physPropsTypePtr)
@@ -127,11 +201,7 @@ func (in *interner) InternPhysicalProps(val *physical.Required) *physical.Requir
 			}
 		}
 	}
-
-	// Shallow copy the props to prevent "val" from escaping.
-	copy := *val
-	in.cache.Add(&copy)
-	return &copy
+	return nil
 }
 
 // internCache is a helper class that implements the interning pattern described
@@ -142,19 +212,28 @@ func (in *interner) InternPhysicalProps(val *physical.Required) *physical.Requir
 //   for cache.Next() {
 //     if isEqual(cache.Item(), other) {
 //       // Found existing item in cache.
+//       cache.Finish()
+//       return
 //     }
 //   }
 //   cache.Add(other)
 //
 // The calls to the Next method iterate over any entries with the same hash,
 // until either a match is found or it is proven their are no matches, in which
-// case the new item can be added to the cache.
+// case the new item can be added to the cache. Every lookup must be ended by a
+// call to either Finish or Add, which unlock the shard of the lookup if the
+// cache is shared by several goroutines.
 type internCache struct {
-	// cache is a Go map that's being used as if it were a hash table of size
-	// 2^64. Items are hashed according to their 64-bit hash value, and any
-	// colliding entries are linked together using the collision field in
-	// cacheEntry.
-	cache map[internHash]cacheEntry
+	// shards stores the cached items. It may be shared with other internCaches
+	// (see interner.fork).
+	shards *internShards
+
+	// shard is the shard that contains the items with the hash value passed to
+	// Start.
+	shard *internShard
+
+	// locked is true if the lookup holds the lock of shard.
+	locked bool
 
 	// hash stores the lookup value used by the next call to the Next method.
 	hash internHash
@@ -163,6 +242,26 @@ type internCache struct {
 	prev cacheEntry
 }
 
+// internShards partitions the items of an internCache by the low bits of their
+// hash values. Colliding entries are always linked to entries in the same shard,
+// so a lookup only ever accesses a single shard.
+type internShards struct {
+	// concurrent is true if the shards are shared by several goroutines, in
+	// which case each lookup locks its shard.
+	concurrent bool
+
+	shards [numInternShards]internShard
+}
+
+// internShard is a Go map that's being used as if it were a hash table of size
+// 2^64. Items are hashed according to their 64-bit hash value, and any
+// colliding entries are linked together using the collision field in
+// cacheEntry.
+type internShard struct {
+	mu    syncutil.Mutex
+	items map[internHash]cacheEntry
+}
+
 // cacheEntry is the Go map value. In case of hash value collisions it functions
 // as a linked list node; its collision field is a randomly generated re-hash
 // value that "points" to the colliding node. That node in turn can point to yet
@@ -182,19 +281,54 @@ func (c *internCache) Item() interface{} {
 
 // Count returns the number of items in the cache.
 func (c *internCache) Count() int {
-	return len(c.cache)
+	if c.shards == nil {
+		return 0
+	}
+	count := 0
+	for i := range c.shards.shards {
+		shard := &c.shards.shards[i]
+		if c.shards.concurrent {
+			shard.mu.Lock()
+		}
+		count += len(shard.items)
+		if c.shards.concurrent {
+			shard.mu.Unlock()
+		}
+	}
+	return count
+}
+
+// initShards allocates the shards of the cache if that has not yet been done.
+func (c *internCache) initShards() {
+	if c.shards == nil {
+		c.shards = &internShards{}
+	}
 }
 
 // Start prepares to look up an item in the cache by its hash value. It must be
 // called before Next.
 func (c *internCache) Start(hash internHash) {
-	if c.cache == nil {
-		c.cache = make(map[internHash]cacheEntry)
+	c.initShards()
+	c.shard = &c.shards.shards[hash&internShardMask]
+	if c.shards.concurrent {
+		c.shard.mu.Lock()
+		c.locked = true
+	}
+	if c.shard.items == nil {
+		c.shard.items = make(map[internHash]cacheEntry)
 	}
 	c.hash = hash
 	c.prev = cacheEntry{}
 }
 
+// Finish ends a lookup that found an existing item.
+func (c *internCache) Finish() {
+	if c.locked {
+		c.shard.mu.Unlock()
+		c.locked = false
+	}
+}
+
 // Next iterates over a collision list of cache items. It begins with the hash
 // value set via the call to Start, and continues with any collision hash values
 // it finds in the collision list. If it is at the end of an existing collision
@@ -215,34 +349,36 @@ func (c *internCache) Next() bool {
 	}
 
 	var ok bool
-	c.prev, ok = c.cache[c.hash]
+	c.prev, ok = c.shard.items[c.hash]
 	return ok
 }
 
-// Add inserts the given item into the cache. The caller should have already
-// checked that the item is not yet in the cache.
+// Add inserts the given item into the cache and finishes the lookup. The caller
+// should have already checked that the item is not yet in the cache.
 func (c *internCache) Add(item interface{}) {
+	defer c.Finish()
 	if item == nil {
 		panic(errors.AssertionFailedf("cannot add the nil value to the cache"))
 	}
 
 	if c.prev.item == nil {
 		// There was no collision, so directly insert the item into the cache.
-		c.cache[c.hash] = cacheEntry{item: item}
+		c.shard.items[c.hash] = cacheEntry{item: item}
 		return
 	}
 
 	// There was a collision, so re-hash the item and link it to the existing
-	// item. Loop until the generated random hash value doesn't collide with any
-	// existing item.
+	// item. The new hash value keeps the shard bits of the existing one, so that
+	// the collision list stays within the shard. Loop until the generated random
+	// hash value doesn't collide with any existing item.
 	for {
 		// Using global rand is OK, since collisions of 64-bit random values should
 		// virtually never happen, so there won't be contention.
-		newHash := internHash(rand.Uint64())
+		newHash := internHash(rand.Uint64())&^internShardMask | c.hash&internShardMask
 		if newHash != 0 {
-			if _, ok := c.cache[newHash]; !ok {
-				c.cache[c.hash] = cacheEntry{item: c.prev.item, collision: newHash}
-				c.cache[newHash] = cacheEntry{item: item}
+			if _, ok := c.shard.items[newHash]; !ok {
+				c.shard.items[c.hash] = cacheEntry{item: c.prev.item, collision: newHash}
+				c.shard.items[newHash] = cacheEntry{item: item}
 				return
 			}
 		}
@@ -630,9 +766,14 @@ func (h *hasher) HashPhysProps(val *physical.Required) {
 	}
 	h.HashOrderingChoice(val.Ordering)
 	h.HashFloat64(val.LimitHint)
+	h.HashInt64(val.HardLimit)
 	for _, region := range val.Distribution.Regions {
 		h.HashString(region)
 	}
+	h.HashInt(val.MaxParallelism)
+	h.HashInt(val.Parallelism)
+	h.HashBool(val.Streaming)
+	h.HashBool(val.NoFullScan)
 }
 
 func (h *hasher) HashLockingItem(val *tree.LockingItem) {
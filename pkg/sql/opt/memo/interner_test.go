@@ -11,9 +11,11 @@
 package memo
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
@@ -633,6 +635,15 @@ func TestInternerPhysProps(t *testing.T) {
 			t.Errorf("expected physical props to not yet be in cache: %s", tc.phys)
 		}
 		inCache[interned] = true
+
+		// The props passed to InternPhysicalProps are copied, so only the
+		// interned props can be found by pointer.
+		if in.lookupPhysicalProps(tc.phys) != interned {
+			t.Errorf("expected lookup to return the interned physical props: %s", tc.phys)
+		}
+		if interned == tc.phys {
+			t.Errorf("expected physical props to be copied when interned: %s", tc.phys)
+		}
 	}
 }
 
@@ -689,6 +700,46 @@ func TestInternerCollision(t *testing.T) {
 	}
 }
 
+// TestInternerFork tests that forks of an interner that are used concurrently
+// intern the same expression to the same instance.
+func TestInternerFork(t *testing.T) {
+	const numGoroutines = 8
+	const numExprs = 1000
+
+	// Every goroutine interns the same expressions, in different orders. All of
+	// them must get back the same instances.
+	var in interner
+	forks := make([]interner, numGoroutines)
+	for g := range forks {
+		forks[g] = in.fork()
+	}
+	interned := make([][]*VariableExpr, numGoroutines)
+	var wg sync.WaitGroup
+	for g := range forks {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			interned[g] = make([]*VariableExpr, numExprs)
+			for i := 0; i < numExprs; i++ {
+				col := (i + g*numExprs/numGoroutines) % numExprs
+				interned[g][col] = forks[g].InternVariable(&VariableExpr{Col: opt.ColumnID(col + 1)})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := 1; g < numGoroutines; g++ {
+		for i := range interned[g] {
+			if interned[g][i] != interned[0][i] {
+				t.Fatalf("expected goroutines to intern the same expression for column %d", i+1)
+			}
+		}
+	}
+	if in.Count() != numExprs {
+		t.Errorf("expected %d interned expressions, got %d", numExprs, in.Count())
+	}
+}
+
 func BenchmarkEncodeDatum(b *testing.B) {
 	r := rand.New(rand.NewSource(0))
 	datums := make([]tree.Datum, 10000)
@@ -719,3 +770,30 @@ func BenchmarkIsDatumEqual(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkInternerConcurrent measures the throughput of interning distinct
+// expressions with an increasing number of goroutines that share the same
+// interned items.
+func BenchmarkInternerConcurrent(b *testing.B) {
+	for _, numGoroutines := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("goroutines=%d", numGoroutines), func(b *testing.B) {
+			var in interner
+			forks := make([]interner, numGoroutines)
+			for g := range forks {
+				forks[g] = in.fork()
+			}
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for g := range forks {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; i < b.N; i += numGoroutines {
+						forks[g].InternVariable(&VariableExpr{Col: opt.ColumnID(i + 1)})
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package memo
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
+)
+
+// JoinSelectivityEstimator estimates the selectivity of the equality
+// conditions of a join from statistics that span the columns of both inputs,
+// such as multi-column sketches or cross-table statistics stored in the
+// catalog. By default, the statistics builder assumes that the values of the
+// columns of each input are independent, and derives the selectivity from the
+// distinct counts of the columns alone. An estimator can be set via
+// Memo.SetJoinSelectivityEstimator.
+type JoinSelectivityEstimator interface {
+	// JoinSelectivity returns the fraction of the cross product of the inputs
+	// of the given join that satisfies the equalities leftCols[i] =
+	// rightCols[i], where each leftCols[i] is an output column of the left
+	// input and each rightCols[i] an output column of the right input. If the
+	// estimator has no statistics that cover the columns, it returns ok=false,
+	// and the statistics builder falls back to its own estimate. The
+	// selectivity must be in the range [0, 1].
+	JoinSelectivity(
+		md *opt.Metadata, join RelExpr, leftCols, rightCols opt.ColList,
+	) (selectivity float64, ok bool)
+}
+
+// SetJoinSelectivityEstimator sets the estimator that is consulted for the
+// selectivity of the equality conditions of inner and outer joins. If it is
+// nil, the statistics builder always uses its own estimate. It must be called
+// after Init and before any expressions are added to the memo.
+func (m *Memo) SetJoinSelectivityEstimator(estimator JoinSelectivityEstimator) {
+	m.joinSelectivity = estimator
+	m.logPropsBuilder.sb.joinSelectivity = estimator
+}
+
+// JoinSelectivityEstimator returns the estimator set via
+// SetJoinSelectivityEstimator, or nil if there is none.
+func (m *Memo) JoinSelectivityEstimator() JoinSelectivityEstimator {
+	return m.joinSelectivity
+}
+
+// selectivityFromJoinEstimator returns the selectivity of the equalities
+// between the columns of the left and right inputs of the given join that are
+// implied by the given equivalencies, as estimated by the memo's
+// JoinSelectivityEstimator. It returns ok=false if there is no estimator, if
+// there are no such equalities, or if the estimator cannot estimate their
+// selectivity.
+func (sb *statisticsBuilder) selectivityFromJoinEstimator(
+	equivReps opt.ColSet, filterFD *props.FuncDepSet, join RelExpr, h *joinPropsHelper,
+) (_ props.Selectivity, ok bool) {
+	if sb.joinSelectivity == nil {
+		return props.OneSelectivity, false
+	}
+	var leftCols, rightCols opt.ColList
+	equivReps.ForEach(func(rep opt.ColumnID) {
+		group := filterFD.ComputeEquivGroup(rep)
+		left := group.Intersection(h.leftProps.OutputCols)
+		right := group.Intersection(h.rightProps.OutputCols)
+		if left.Empty() || right.Empty() {
+			return
+		}
+		// The other columns in the group are equal to these, so a single
+		// equality between the inputs describes the group.
+		l, _ := left.Next(0)
+		r, _ := right.Next(0)
+		leftCols = append(leftCols, l)
+		rightCols = append(rightCols, r)
+	})
+	if len(leftCols) == 0 {
+		return props.OneSelectivity, false
+	}
+	selectivity, ok := sb.joinSelectivity.JoinSelectivity(sb.md, join, leftCols, rightCols)
+	if !ok {
+		return props.OneSelectivity, false
+	}
+	return props.MakeSelectivity(selectivity), true
+}
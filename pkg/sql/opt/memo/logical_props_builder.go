@@ -27,6 +27,11 @@ import (
 
 var fdAnnID = opt.NewTableAnnID()
 
+// notNullAnnID is the annotation of a table that caches the result of
+// tableNotNullCols, which is requested for every scan of the table and every
+// column statistic that is derived from the table's statistics.
+var notNullAnnID = opt.NewTableAnnID()
+
 // logicalPropsBuilder is a helper class that consolidates the code that derives
 // a parent expression's logical properties from those of its children.
 //
@@ -57,7 +62,8 @@ func (b *logicalPropsBuilder) init(evalCtx *tree.EvalContext, mem *Memo) {
 		evalCtx: evalCtx,
 		mem:     mem,
 	}
-	b.sb.init(evalCtx, mem.Metadata())
+	b.sb.init(evalCtx, mem.Metadata(), mem.StatsProvider())
+	b.sb.joinSelectivity = mem.JoinSelectivityEstimator()
 }
 
 func (b *logicalPropsBuilder) clear() {
@@ -66,6 +72,78 @@ func (b *logicalPropsBuilder) clear() {
 	b.sb.clear()
 }
 
+// rebuildStats re-derives the statistics of the given expression from the
+// statistics of its inputs and the current table statistics, leaving its other
+// logical properties unchanged. The statistics of its inputs must already have
+// been rebuilt. It returns false if the statistics of the expression's operator
+// cannot be rebuilt in this way.
+func (b *logicalPropsBuilder) rebuildStats(e RelExpr) bool {
+	if b.disableStats {
+		return true
+	}
+	rel := e.Relational()
+	switch t := e.(type) {
+	case *ScanExpr:
+		b.sb.buildScan(t, rel)
+	case *SelectExpr:
+		b.sb.buildSelect(t, rel)
+	case *ProjectExpr:
+		b.sb.buildProject(t, rel)
+	case *InvertedFilterExpr:
+		b.sb.buildInvertedFilter(t, rel)
+	case *IndexJoinExpr:
+		b.sb.buildIndexJoin(t, rel)
+	case *LookupJoinExpr, *InvertedJoinExpr, *ZigzagJoinExpr, *MergeJoinExpr:
+		var h joinPropsHelper
+		h.init(b, e)
+		b.sb.buildJoin(e, rel, &h)
+	case *GroupByExpr, *ScalarGroupByExpr, *DistinctOnExpr, *EnsureDistinctOnExpr,
+		*UpsertDistinctOnExpr, *EnsureUpsertDistinctOnExpr:
+		b.sb.buildGroupBy(e, rel)
+	case *UnionExpr, *IntersectExpr, *ExceptExpr, *UnionAllExpr, *IntersectAllExpr,
+		*ExceptAllExpr, *LocalityOptimizedSearchExpr:
+		b.sb.buildSetNode(e, rel)
+	case *ValuesExpr:
+		b.sb.buildValues(t, rel)
+	case *WithExpr:
+		rel.Stats = t.Main.Relational().Stats
+	case *WithScanExpr:
+		bindingProps := b.mem.Metadata().WithBinding(t.With).(RelExpr).Relational()
+		b.sb.buildWithScan(t, rel, bindingProps)
+	case *LimitExpr:
+		b.sb.buildLimit(t, rel)
+	case *TopKExpr:
+		b.sb.buildTopK(t, rel)
+	case *OffsetExpr:
+		b.sb.buildOffset(t, rel)
+	case *Max1RowExpr:
+		b.sb.buildMax1Row(t, rel)
+	case *BarrierExpr:
+		b.sb.buildBarrier(t, rel)
+	case *OrdinalityExpr:
+		b.sb.buildOrdinality(t, rel)
+	case *WindowExpr:
+		b.sb.buildWindow(t, rel)
+	case *ProjectSetExpr:
+		b.sb.buildProjectSet(t, rel)
+	case *SortExpr, *TopKSortExpr, *DistributeExpr, *GatherExpr:
+		// Enforcers share the logical properties of their input, whose statistics
+		// have already been rebuilt.
+	default:
+		switch {
+		case opt.IsJoinOp(e):
+			var h joinPropsHelper
+			h.init(b, e)
+			b.sb.buildJoin(e, rel, &h)
+		case opt.IsMutationOp(e):
+			b.sb.buildMutation(e, rel)
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (b *logicalPropsBuilder) buildScanProps(scan *ScanExpr, rel *props.Relational) {
 	md := scan.Memo().Metadata()
 	hardLimit := scan.HardLimit.RowCount()
@@ -1192,6 +1270,42 @@ func (b *logicalPropsBuilder) buildOffsetProps(offset *OffsetExpr, rel *props.Re
 	}
 }
 
+func (b *logicalPropsBuilder) buildBarrierProps(barrier *BarrierExpr, rel *props.Relational) {
+	BuildSharedProps(barrier, &rel.Shared, b.evalCtx)
+
+	inputProps := barrier.Input.Relational()
+
+	// Output Columns
+	// --------------
+	// Output columns are inherited from input.
+	rel.OutputCols = inputProps.OutputCols
+
+	// Not Null Columns
+	// ----------------
+	// Not null columns are inherited from input.
+	rel.NotNullCols = inputProps.NotNullCols
+
+	// Outer Columns
+	// -------------
+	// Outer columns were already derived by BuildSharedProps.
+
+	// Functional Dependencies
+	// -----------------------
+	// Functional dependencies are inherited from input.
+	rel.FuncDeps.CopyFrom(&inputProps.FuncDeps)
+
+	// Cardinality
+	// -----------
+	// Cardinality is inherited from input.
+	rel.Cardinality = inputProps.Cardinality
+
+	// Statistics
+	// ----------
+	if !b.disableStats {
+		b.sb.buildBarrier(barrier, rel)
+	}
+}
+
 func (b *logicalPropsBuilder) buildMax1RowProps(max1Row *Max1RowExpr, rel *props.Relational) {
 	BuildSharedProps(max1Row, &rel.Shared, b.evalCtx)
 
@@ -2173,6 +2287,12 @@ func ensureInputPropsForIndex(
 
 // tableNotNullCols returns the set of not-NULL non-mutation columns from the given table.
 func tableNotNullCols(md *opt.Metadata, tabID opt.TableID) opt.ColSet {
+	if cs, ok := md.TableAnnotation(tabID, notNullAnnID).(opt.ColSet); ok {
+		// Already made. Callers may modify the returned set, so return a copy.
+		return cs.Copy()
+	}
+
+	// Make now and annotate the metadata table with it for next time.
 	cs := opt.ColSet{}
 	tab := md.Table(tabID)
 
@@ -2185,7 +2305,8 @@ func tableNotNullCols(md *opt.Metadata, tabID opt.TableID) opt.ColSet {
 			cs.Add(tabID.ColumnID(i))
 		}
 	}
-	return cs
+	md.SetTableAnnotation(tabID, notNullAnnID, cs)
+	return cs.Copy()
 }
 
 // addOuterColsToFuncDep adds the given outer columns and columns equivalent to
@@ -2562,6 +2683,9 @@ func (h *joinPropsHelper) cardinality() props.Cardinality {
 
 func (b *logicalPropsBuilder) buildFakeRelProps(fake *FakeRelExpr, rel *props.Relational) {
 	*rel = *fake.Props
+	// The column statistics are added to lazily, so they must not share storage
+	// with those of the private.
+	rel.Stats.ColStats.CopyFrom(&fake.Props.Stats.ColStats)
 }
 
 func (b *logicalPropsBuilder) buildNormCycleTestRelProps(
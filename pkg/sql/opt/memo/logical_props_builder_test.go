@@ -16,6 +16,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 )
 
 func TestJoinCardinality(t *testing.T) {
@@ -203,3 +204,40 @@ func TestJoinCardinality(t *testing.T) {
 		})
 	}
 }
+
+// TestTableNotNullCols tests that the not-null columns of a table are cached in
+// the metadata, separately for each table, and that the cached set cannot be
+// modified by callers.
+func TestTableNotNullCols(t *testing.T) {
+	ob := makeOpBuilder(t)
+	ob.createTables(`
+		CREATE TABLE t (k INT PRIMARY KEY, a INT NOT NULL, b INT);
+		CREATE TABLE u (x INT PRIMARY KEY, y INT NOT NULL)
+	`)
+	md := ob.mem.Metadata()
+	tn := tree.NewUnqualifiedTableName("t")
+	tabID := md.AddTable(ob.cat.Table(tn), tn)
+	un := tree.NewUnqualifiedTableName("u")
+	unID := md.AddTable(ob.cat.Table(un), un)
+
+	expected := opt.MakeColSet(tabID.ColumnID(0), tabID.ColumnID(1))
+	notNullCols := tableNotNullCols(md, tabID)
+	if !notNullCols.Equals(expected) {
+		t.Fatalf("expected %s, got %s", expected, notNullCols)
+	}
+	if cached, ok := md.TableAnnotation(tabID, notNullAnnID).(opt.ColSet); !ok || !cached.Equals(expected) {
+		t.Fatalf("expected %s to be cached, got %v", expected, md.TableAnnotation(tabID, notNullAnnID))
+	}
+
+	// Modifying the returned set must not modify the cached set.
+	notNullCols.Add(tabID.ColumnID(2))
+	if res := tableNotNullCols(md, tabID); !res.Equals(expected) {
+		t.Fatalf("expected %s, got %s", expected, res)
+	}
+
+	// Each table has its own cached set.
+	expected = opt.MakeColSet(unID.ColumnID(0), unID.ColumnID(1))
+	if res := tableNotNullCols(md, unID); !res.Equals(expected) {
+		t.Fatalf("expected %s, got %s", expected, res)
+	}
+}
@@ -12,12 +12,14 @@ package memo
 
 import (
 	"context"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/util/duration"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil/pgdate"
@@ -58,6 +60,14 @@ import (
 // when they are not) results in invalid transformations and invalid plans.
 // But placing two logically equivalent expressions in different groups has a
 // much gentler failure mode: the memo and transformations are less efficient.
+//
+// In particular, the same table referenced twice in a query, as in a self-join
+// or in two branches of a UNION, is scanned using different column IDs, so the
+// two scans and any identical filters above them are placed in different
+// groups. The lowest cost tree therefore does not share subtrees that could be
+// computed once and replayed; the only way to do so is to bind the subtree in
+// a With expression and reference it with WithScans, which remap its columns.
+//
 // Expressions within the memo may have different physical properties. For
 // example, a memo group might contain both hash join and merge join
 // expressions which produce the same set of output rows, but produce them in
@@ -113,6 +123,13 @@ type Memo struct {
 
 	// interner interns all expressions in the memo, ensuring that there is at
 	// most one instance of each expression in the memo.
+	//
+	// TODO: the interner can be forked so that several goroutines can
+	// intern expressions concurrently (see interner.fork), but the memo does not
+	// fork it yet. Adding expressions to disjoint groups concurrently also
+	// requires memEstimate and exprCount to be updated atomically, a
+	// logPropsBuilder per goroutine, and the columns that exploration rules add
+	// to the metadata to be allocated safely.
 	interner interner
 
 	// logPropsBuilder is inlined in the memo so that it can be reused each time
@@ -131,6 +148,13 @@ type Memo struct {
 	// memEstimate is the approximate memory usage of the memo, in bytes.
 	memEstimate int64
 
+	// exprCount is the number of expressions that have been added to the memo.
+	exprCount int
+
+	// compacted is true if the alternatives to the lowest cost tree have been
+	// removed from the memo by Compact.
+	compacted bool
+
 	// The following are selected fields from SessionData which can affect
 	// planning. We need to cross-check these before reusing a cached memo.
 	// NOTE: If you add new fields here, be sure to add them to the relevant
@@ -152,6 +176,37 @@ type Memo struct {
 	largeFullScanRows           float64
 	nullOrderedLast             bool
 	costScansWithDefaultColSize bool
+	disableRules                string
+	disableRulesSetting         string
+	externalRules               string
+	maxMemoExprs                int64
+	heuristicPlanningThreshold  int64
+	reorderJoinsSearchBudget    time.Duration
+	reorderJoinsShape           sessiondatapb.JoinShapeMode
+	leadingTables               string
+	useTopKEnforcer             bool
+	riskAversion                float64
+	planGuardrail               sessiondatapb.PlanGuardrailMode
+	useWorkMemCosting           bool
+	workMemLimit                int64
+	useStreamingProperty        bool
+	useJoinLimitHints           bool
+	deterministicTieBreaking    bool
+	exploreApplyJoins           bool
+	optimizerGoal               sessiondatapb.OptimizerGoal
+
+	// statsProvider supplies the table statistics used to derive the logical
+	// properties of expressions in the memo.
+	statsProvider cat.StatsProvider
+
+	// joinSelectivity, if non-nil, estimates the selectivity of the equality
+	// conditions of joins. See SetJoinSelectivityEstimator.
+	joinSelectivity JoinSelectivityEstimator
+
+	// groupBests describes the lowest cost expression of each group for each
+	// set of required physical properties that was optimized. It is only set if
+	// the optimizer was asked to retain it; see SetGroupBests.
+	groupBests []GroupBest
 
 	// curRank is the highest currently in-use scalar expression rank.
 	curRank opt.ScalarRank
@@ -182,6 +237,7 @@ func (m *Memo) Init(evalCtx *tree.EvalContext) {
 	// reused. Field reuse must be explicit.
 	*m = Memo{
 		metadata:                    m.metadata,
+		interner:                    m.interner,
 		reorderJoinsLimit:           int(evalCtx.SessionData().ReorderJoinsLimit),
 		zigzagJoinEnabled:           evalCtx.SessionData().ZigzagJoinEnabled,
 		useHistograms:               evalCtx.SessionData().OptimizerUseHistograms,
@@ -199,11 +255,41 @@ func (m *Memo) Init(evalCtx *tree.EvalContext) {
 		largeFullScanRows:           evalCtx.SessionData().LargeFullScanRows,
 		nullOrderedLast:             evalCtx.SessionData().NullOrderedLast,
 		costScansWithDefaultColSize: evalCtx.SessionData().CostScansWithDefaultColSize,
+		disableRules:                evalCtx.SessionData().OptimizerDisableRules,
+		disableRulesSetting:         disabledRulesSetting(evalCtx),
+		externalRules:               evalCtx.SessionData().OptimizerExternalRules,
+		maxMemoExprs:                evalCtx.SessionData().OptimizerMaxMemoExprs,
+		heuristicPlanningThreshold:  evalCtx.SessionData().OptimizerHeuristicPlanningThreshold,
+		reorderJoinsSearchBudget:    evalCtx.SessionData().ReorderJoinsSearchBudget,
+		reorderJoinsShape:           evalCtx.SessionData().ReorderJoinsShape,
+		leadingTables:               evalCtx.SessionData().OptimizerLeadingTables,
+		useTopKEnforcer:             evalCtx.SessionData().OptimizerUseTopKEnforcer,
+		riskAversion:                evalCtx.SessionData().OptimizerRiskAversion,
+		planGuardrail:               evalCtx.SessionData().OptimizerPlanGuardrail,
+		useWorkMemCosting:           evalCtx.SessionData().OptimizerUseWorkMemCosting,
+		workMemLimit:                evalCtx.SessionData().WorkMemLimit,
+		useStreamingProperty:        evalCtx.SessionData().OptimizerUseStreamingProperty,
+		useJoinLimitHints:           evalCtx.SessionData().OptimizerUseJoinLimitHints,
+		deterministicTieBreaking:    evalCtx.SessionData().OptimizerDeterministicTieBreaking,
+		exploreApplyJoins:           evalCtx.SessionData().OptimizerExploreApplyJoins,
+		optimizerGoal:               evalCtx.SessionData().OptimizerGoal,
+		statsProvider:               cat.TableStatsProvider,
 	}
 	m.metadata.Init()
+	m.interner.reset()
 	m.logPropsBuilder.init(evalCtx, m)
 }
 
+// disabledRulesSetting returns the value of the cluster setting that disables
+// optimizer rules for every session, or the empty string if the settings are
+// not available.
+func disabledRulesSetting(evalCtx *tree.EvalContext) string {
+	if evalCtx.Settings == nil {
+		return ""
+	}
+	return opt.DisabledRulesClusterSetting.Get(&evalCtx.Settings.SV)
+}
+
 // ResetLogProps resets the logPropsBuilder. It should be used in combination
 // with the perturb-cost OptTester flag in order to update the query plan tree
 // after optimization is complete with the real computed cost, not the perturbed
@@ -212,6 +298,20 @@ func (m *Memo) ResetLogProps(evalCtx *tree.EvalContext) {
 	m.logPropsBuilder.init(evalCtx, m)
 }
 
+// SetStatsProvider overrides the source of the table statistics that are used
+// to derive the logical properties of expressions in the memo. By default, the
+// statistics stored with each table in the catalog are used. It must be called
+// after Init and before any expressions are added to the memo.
+func (m *Memo) SetStatsProvider(statsProvider cat.StatsProvider) {
+	m.statsProvider = statsProvider
+	m.logPropsBuilder.sb.statsProvider = statsProvider
+}
+
+// StatsProvider returns the source of the table statistics used by the memo.
+func (m *Memo) StatsProvider() cat.StatsProvider {
+	return m.statsProvider
+}
+
 // NotifyOnNewGroup sets a callback function which is invoked each time we
 // create a new memo group.
 func (m *Memo) NotifyOnNewGroup(fn func(opt.Expr)) {
@@ -225,6 +325,56 @@ func (m *Memo) IsEmpty() bool {
 	return m.interner.Count() == 0 && m.rootExpr == nil
 }
 
+// UseTopKEnforcer returns true if a TopKSort enforcer can be used to provide a
+// required ordering when the expression's rows are consumed by a limit. It is
+// set from the optimizer_use_topk_enforcer session setting.
+func (m *Memo) UseTopKEnforcer() bool {
+	return m.useTopKEnforcer
+}
+
+// UseStreamingProperty returns true if operators that need bounded memory
+// should require the Streaming physical property of their inputs. It is set
+// from the optimizer_use_streaming_property session setting.
+func (m *Memo) UseStreamingProperty() bool {
+	return m.useStreamingProperty
+}
+
+// UseJoinLimitHints returns true if the limit hint of a join should be passed
+// to its inputs and used to cost them. It is set from the
+// optimizer_use_join_limit_hints session setting.
+func (m *Memo) UseJoinLimitHints() bool {
+	return m.useJoinLimitHints
+}
+
+// DeterministicTieBreaking returns true if ties between expressions with equal
+// estimated costs should be broken independently of the order in which the
+// expressions were costed. It is set from the
+// optimizer_deterministic_tie_breaking session setting.
+func (m *Memo) DeterministicTieBreaking() bool {
+	return m.deterministicTieBreaking
+}
+
+// ExploreApplyJoins returns true if apply joins should be explored as
+// alternatives to decorrelated joins, and costed by the number of times that
+// their right input is re-planned and executed. It is set from the
+// optimizer_explore_apply_joins session setting.
+func (m *Memo) ExploreApplyJoins() bool {
+	return m.exploreApplyJoins
+}
+
+// OptimizerGoal returns the objective that the optimizer minimizes: the total
+// cost of the plan, or the cost of producing its first row. It is set from the
+// optimizer_goal session setting.
+func (m *Memo) OptimizerGoal() sessiondatapb.OptimizerGoal {
+	return m.optimizerGoal
+}
+
+// ExprCount returns the number of expressions that have been added to the memo,
+// including scalar expressions and the members of every group.
+func (m *Memo) ExprCount() int {
+	return m.exprCount
+}
+
 // MemoryEstimate returns a rough estimate of the memo's memory usage, in bytes.
 // It only includes memory usage that is proportional to the size and complexity
 // of the query, rather than constant overhead bytes.
@@ -253,17 +403,24 @@ func (m *Memo) RootProps() *physical.Required {
 
 // SetRoot stores the root memo expression when it is a relational expression,
 // and also stores the physical properties required of the root group.
+//
+// A memo has a single root, and is optimized once. Setting the optimized root
+// frees the interner, and the lowest cost tree is recorded in the expressions
+// themselves (see bestProps), so several statements cannot be optimized in the
+// same memo to share interned expressions; each statement needs its own memo.
 func (m *Memo) SetRoot(e RelExpr, phys *physical.Required) {
 	m.rootExpr = e
 	if m.rootProps != phys {
 		m.rootProps = m.InternPhysicalProps(phys)
 	}
 
-	// Once memo is optimized, release reference to the eval context and free up
-	// the memory used by the interner.
+	// Once memo is optimized, release reference to the eval context and the
+	// interned expressions. The maps of the interner are retained for reuse by
+	// the next call to Init; they are released by Detach if the memo outlives
+	// the factory that built it.
 	if m.IsOptimized() {
 		m.logPropsBuilder.clear()
-		m.interner = interner{}
+		m.interner.reset()
 	}
 }
 
@@ -323,7 +480,25 @@ func (m *Memo) IsStale(
 		m.disallowFullTableScans != evalCtx.SessionData().DisallowFullTableScans ||
 		m.largeFullScanRows != evalCtx.SessionData().LargeFullScanRows ||
 		m.nullOrderedLast != evalCtx.SessionData().NullOrderedLast ||
-		m.costScansWithDefaultColSize != evalCtx.SessionData().CostScansWithDefaultColSize {
+		m.costScansWithDefaultColSize != evalCtx.SessionData().CostScansWithDefaultColSize ||
+		m.disableRules != evalCtx.SessionData().OptimizerDisableRules ||
+		m.disableRulesSetting != disabledRulesSetting(evalCtx) ||
+		m.externalRules != evalCtx.SessionData().OptimizerExternalRules ||
+		m.maxMemoExprs != evalCtx.SessionData().OptimizerMaxMemoExprs ||
+		m.heuristicPlanningThreshold != evalCtx.SessionData().OptimizerHeuristicPlanningThreshold ||
+		m.reorderJoinsSearchBudget != evalCtx.SessionData().ReorderJoinsSearchBudget ||
+		m.reorderJoinsShape != evalCtx.SessionData().ReorderJoinsShape ||
+		m.leadingTables != evalCtx.SessionData().OptimizerLeadingTables ||
+		m.useTopKEnforcer != evalCtx.SessionData().OptimizerUseTopKEnforcer ||
+		m.riskAversion != evalCtx.SessionData().OptimizerRiskAversion ||
+		m.planGuardrail != evalCtx.SessionData().OptimizerPlanGuardrail ||
+		m.useWorkMemCosting != evalCtx.SessionData().OptimizerUseWorkMemCosting ||
+		(m.useWorkMemCosting && m.workMemLimit != evalCtx.SessionData().WorkMemLimit) ||
+		m.useStreamingProperty != evalCtx.SessionData().OptimizerUseStreamingProperty ||
+		m.useJoinLimitHints != evalCtx.SessionData().OptimizerUseJoinLimitHints ||
+		m.deterministicTieBreaking != evalCtx.SessionData().OptimizerDeterministicTieBreaking ||
+		m.exploreApplyJoins != evalCtx.SessionData().OptimizerExploreApplyJoins ||
+		m.optimizerGoal != evalCtx.SessionData().OptimizerGoal {
 		return true, nil
 	}
 
@@ -350,12 +525,29 @@ func (m *Memo) InternPhysicalProps(phys *physical.Required) *physical.Required {
 	return m.interner.InternPhysicalProps(phys)
 }
 
+// IsInternedPhysicalProps returns true if the given physical props were
+// returned by InternPhysicalProps, rather than being an equal copy of them.
+// Callers that compare physical props by pointer, such as the optimizer when it
+// looks up the state of a group, rely on this. It always returns false once the
+// memo has been optimized, since the interner is then released.
+func (m *Memo) IsInternedPhysicalProps(phys *physical.Required) bool {
+	if phys == physical.MinRequired {
+		return true
+	}
+	return m.interner.isInternedPhysicalProps(phys)
+}
+
 // SetBestProps updates the physical properties, provided ordering, and cost of
-// a relational expression's memo group (see the relevant methods of RelExpr).
-// It is called by the optimizer once it determines the expression in the group
-// that is part of the lowest cost tree (for the overall query).
+// a relational expression's memo group (see the relevant methods of RelExpr),
+// along with the breakdown of the cost by resource (see CostBreakdown). It is
+// called by the optimizer once it determines the expression in the group that
+// is part of the lowest cost tree (for the overall query).
 func (m *Memo) SetBestProps(
-	e RelExpr, required *physical.Required, provided *physical.Provided, cost Cost,
+	e RelExpr,
+	required *physical.Required,
+	provided *physical.Provided,
+	cost Cost,
+	breakdown CostBreakdown,
 ) {
 	if e.RequiredPhysical() != nil {
 		if e.RequiredPhysical() != required ||
@@ -377,6 +569,36 @@ func (m *Memo) SetBestProps(
 	bp.required = required
 	bp.provided = provided
 	bp.cost = cost
+	bp.breakdown = breakdown
+}
+
+// CostBreakdown returns the breakdown by resource of the cost of the given
+// expression tree. Like RelExpr.Cost, it is set when optimization is complete,
+// only for the expressions in the final tree.
+func (m *Memo) CostBreakdown(e RelExpr) CostBreakdown {
+	return e.bestProps().breakdown
+}
+
+// SetSelfCost sets the cost of a relational expression in the lowest cost tree,
+// excluding the costs of its children, along with its breakdown by resource.
+// It is called by the optimizer after SetBestProps, so that EXPLAIN can show
+// which expressions contribute the most to the cost of the tree.
+func (m *Memo) SetSelfCost(e RelExpr, cost Cost, breakdown CostBreakdown) {
+	bp := e.bestProps()
+	bp.selfCost = cost
+	bp.selfBreakdown = breakdown
+}
+
+// SelfCost returns the cost of the given expression, excluding the costs of its
+// children. Like RelExpr.Cost, it is set when optimization is complete, only
+// for the expressions in the final tree.
+func (m *Memo) SelfCost(e RelExpr) Cost {
+	return e.bestProps().selfCost
+}
+
+// SelfCostBreakdown returns the breakdown by resource of SelfCost.
+func (m *Memo) SelfCostBreakdown(e RelExpr) CostBreakdown {
+	return e.bestProps().selfBreakdown
 }
 
 // ResetCost updates the cost of a relational expression's memo group. It
@@ -385,6 +607,41 @@ func (m *Memo) ResetCost(e RelExpr, cost Cost) {
 	e.bestProps().cost = cost
 }
 
+// GroupBest describes the lowest cost expression found by the optimizer for a
+// memo group with respect to a set of required physical properties.
+type GroupBest struct {
+	// Group is the first expression in the memo group.
+	Group RelExpr
+
+	// Required is the set of physical properties that were required of the
+	// group.
+	Required *physical.Required
+
+	// Best is the lowest cost expression that provides the required properties.
+	// It is either a member of the group, or an enforcer whose input is the
+	// group.
+	Best RelExpr
+
+	// Cost is the estimated cost of Best, including the cost of its inputs.
+	Cost Cost
+}
+
+// SetGroupBests records the lowest cost expression of each group for each set
+// of required physical properties that was optimized, rather than only those
+// in the lowest cost tree. It is called by the optimizer once optimization is
+// complete, and only if requested, so that the alternatives that were costed
+// can be shown after the optimizer state is discarded, e.g. by EXPLAIN (OPT,
+// MEMO) for a memo that was detached.
+func (m *Memo) SetGroupBests(bests []GroupBest) {
+	m.groupBests = bests
+}
+
+// GroupBests returns the lowest cost expressions recorded by SetGroupBests, in
+// no particular order. It returns nil if they were not recorded.
+func (m *Memo) GroupBests() []GroupBest {
+	return m.groupBests
+}
+
 // IsOptimized returns true if the memo has been fully optimized.
 func (m *Memo) IsOptimized() bool {
 	// The memo is optimized once the root expression has its physical properties
@@ -474,6 +731,126 @@ func (m *Memo) Detach() {
 	clearColStats(m.RootExpr())
 }
 
+// Compact removes the expressions that are not part of the lowest cost tree
+// from the groups of an optimized, detached memo, so that they and the groups
+// that only they reference can be garbage collected. The remaining groups keep
+// their first expression, which is allocated together with the group, and the
+// expression chosen for the lowest cost tree. The memory estimate of the memo
+// is reduced in proportion to the number of expressions that are removed.
+//
+// A compacted memo can still be execbuilt and formatted as usual, without any
+// rehydration step. However, it can no longer be re-costed (see
+// ResetForRecosting), since the alternatives to the lowest cost tree are gone.
+// Compact does nothing if the memo is not optimized or not detached.
+func (m *Memo) Compact() {
+	if !m.IsOptimized() || m.interner.Count() != 0 {
+		return
+	}
+
+	kept := 0
+	var compact func(e opt.Expr)
+	compact = func(e opt.Expr) {
+		kept++
+		if rel, ok := e.(RelExpr); ok && !opt.IsEnforcerOp(rel) {
+			if first := rel.FirstExpr(); first != rel {
+				first.replaceNext(rel)
+				kept++
+			}
+			rel.replaceNext(nil)
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			compact(e.Child(i))
+		}
+	}
+	compact(m.RootExpr())
+	m.compacted = true
+
+	if kept < m.exprCount {
+		m.memEstimate = m.memEstimate * int64(kept) / int64(m.exprCount)
+		m.exprCount = kept
+	}
+}
+
+// ResetForRecosting prepares a detached memo to be optimized again after the
+// table statistics have changed, without repeating exploration. It re-derives
+// the statistics of every group reachable from the root using the current
+// statistics, and clears the best expressions chosen by the previous
+// optimization, so that the optimizer can cost the existing expressions and
+// choose a new lowest cost tree. The other logical properties of the groups
+// are unchanged, since they do not depend on statistics.
+//
+// ResetForRecosting returns false if the memo has been compacted, or if the
+// statistics of some group cannot be rebuilt, in which case the memo must be
+// discarded and the query optimized from scratch. The memo must not be in use
+// by any other query while it is being reset and re-optimized.
+func (m *Memo) ResetForRecosting(evalCtx *tree.EvalContext) bool {
+	if m.compacted {
+		return false
+	}
+	root, ok := m.rootExpr.(RelExpr)
+	if !ok {
+		return false
+	}
+	m.logPropsBuilder.init(evalCtx, m)
+
+	// Discard the cached table statistics so that they are fetched again from
+	// the stats provider.
+	for _, tab := range m.metadata.AllTables() {
+		m.metadata.SetTableAnnotation(tab.MetaID, statsAnnID, nil)
+	}
+
+	// Rebuild the statistics of each group after those of its inputs. Groups
+	// are identified by their first expression, since the optimizer may have
+	// replaced children with other members of the same group. Children may also
+	// have been replaced with enforcers that wrap them, which are not members
+	// of a group, so the statistics of their input are rebuilt instead.
+	visited := make(map[RelExpr]struct{})
+	var rebuild func(e opt.Expr) bool
+	rebuild = func(e opt.Expr) bool {
+		rel, ok := e.(RelExpr)
+		if ok {
+			*rel.bestProps() = bestProps{}
+			if opt.IsEnforcerOp(rel) {
+				if !rebuild(rel.Child(0)) {
+					return false
+				}
+				return m.logPropsBuilder.rebuildStats(rel)
+			}
+			rel = rel.FirstExpr()
+			if _, ok := visited[rel]; ok {
+				return true
+			}
+			visited[rel] = struct{}{}
+			for member := rel; member != nil; member = member.NextExpr() {
+				*member.bestProps() = bestProps{}
+				for i, n := 0, member.ChildCount(); i < n; i++ {
+					if !rebuild(member.Child(i)) {
+						return false
+					}
+				}
+			}
+			return m.logPropsBuilder.rebuildStats(rel)
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if !rebuild(e.Child(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	if !rebuild(root) {
+		return false
+	}
+	m.rootExpr = root.FirstExpr()
+	m.groupBests = nil
+
+	// The interner was cleared when the memo was optimized, so re-intern the
+	// root properties to ensure that they are shared with any identical
+	// properties required by the optimizer.
+	m.rootProps = m.InternPhysicalProps(m.rootProps)
+	return true
+}
+
 // DisableCheckExpr disables expression validation performed by CheckExpr,
 // if the crdb_test build tag is set. If the crdb_test build tag is not set,
 // CheckExpr is always a no-op, so DisableCheckExpr has no effect.
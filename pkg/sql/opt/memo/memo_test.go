@@ -14,8 +14,10 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/optbuilder"
@@ -25,6 +27,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/duration"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil/pgdate"
@@ -278,6 +281,113 @@ func TestMemoIsStale(t *testing.T) {
 	evalCtx.SessionData().CostScansWithDefaultColSize = false
 	notStale()
 
+	// Stale disabled rules.
+	evalCtx.SessionData().OptimizerDisableRules = "GenerateIndexScans"
+	stale()
+	evalCtx.SessionData().OptimizerDisableRules = ""
+	notStale()
+
+	// Stale disabled rules cluster setting.
+	opt.DisabledRulesClusterSetting.Override(ctx, &evalCtx.Settings.SV, "GenerateIndexScans")
+	stale()
+	opt.DisabledRulesClusterSetting.Override(ctx, &evalCtx.Settings.SV, "")
+	notStale()
+
+	// Stale external rules.
+	evalCtx.SessionData().OptimizerExternalRules = "MyRule"
+	stale()
+	evalCtx.SessionData().OptimizerExternalRules = ""
+	notStale()
+
+	// Stale max memo expressions.
+	evalCtx.SessionData().OptimizerMaxMemoExprs = 100
+	stale()
+	evalCtx.SessionData().OptimizerMaxMemoExprs = 0
+	notStale()
+
+	// Stale heuristic planning threshold.
+	evalCtx.SessionData().OptimizerHeuristicPlanningThreshold = 100
+	stale()
+	evalCtx.SessionData().OptimizerHeuristicPlanningThreshold = 0
+	notStale()
+
+	// Stale join reorder search budget.
+	evalCtx.SessionData().ReorderJoinsSearchBudget = time.Second
+	stale()
+	evalCtx.SessionData().ReorderJoinsSearchBudget = 0
+	notStale()
+
+	// Stale join reorder shape.
+	evalCtx.SessionData().ReorderJoinsShape = sessiondatapb.JoinShapeBushy
+	stale()
+	evalCtx.SessionData().ReorderJoinsShape = sessiondatapb.JoinShapeAuto
+	notStale()
+
+	// Stale leading tables.
+	evalCtx.SessionData().OptimizerLeadingTables = "abc,xyz"
+	stale()
+	evalCtx.SessionData().OptimizerLeadingTables = ""
+	notStale()
+
+	// Stale use TopK enforcer.
+	evalCtx.SessionData().OptimizerUseTopKEnforcer = true
+	stale()
+	evalCtx.SessionData().OptimizerUseTopKEnforcer = false
+	notStale()
+
+	// Stale risk aversion.
+	evalCtx.SessionData().OptimizerRiskAversion = 0.1
+	stale()
+	evalCtx.SessionData().OptimizerRiskAversion = 0
+	notStale()
+
+	// Stale plan guardrail.
+	evalCtx.SessionData().OptimizerPlanGuardrail = sessiondatapb.PlanGuardrailWarn
+	stale()
+	evalCtx.SessionData().OptimizerPlanGuardrail = sessiondatapb.PlanGuardrailOff
+	notStale()
+
+	// Stale work mem costing. The work mem limit only affects the memo if work
+	// mem costing is enabled.
+	evalCtx.SessionData().OptimizerUseWorkMemCosting = true
+	stale()
+	evalCtx.SessionData().OptimizerUseWorkMemCosting = false
+	notStale()
+	evalCtx.SessionData().WorkMemLimit = 1 << 20
+	notStale()
+	evalCtx.SessionData().WorkMemLimit = 0
+	notStale()
+
+	// Stale streaming property.
+	evalCtx.SessionData().OptimizerUseStreamingProperty = true
+	stale()
+	evalCtx.SessionData().OptimizerUseStreamingProperty = false
+	notStale()
+
+	// Stale join limit hints.
+	evalCtx.SessionData().OptimizerUseJoinLimitHints = true
+	stale()
+	evalCtx.SessionData().OptimizerUseJoinLimitHints = false
+	notStale()
+
+	// Stale deterministic tie breaking.
+	evalCtx.SessionData().OptimizerDeterministicTieBreaking = true
+	stale()
+	evalCtx.SessionData().OptimizerDeterministicTieBreaking = false
+	notStale()
+
+	// Stale explore apply joins.
+	evalCtx.SessionData().OptimizerExploreApplyJoins = true
+	stale()
+	evalCtx.SessionData().OptimizerExploreApplyJoins = false
+	notStale()
+
+	// Stale optimizer goal.
+	evalCtx.SessionData().OptimizerGoal = sessiondatapb.OptimizerGoalFirstRow
+	stale()
+	evalCtx.SessionData().OptimizerGoal = sessiondatapb.OptimizerGoalTotalCost
+	notStale()
+
 	// Stale data sources and schema. Create new catalog so that data sources are
 	// recreated and can be modified independently.
 	catalog = testcat.New()
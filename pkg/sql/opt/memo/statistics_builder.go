@@ -16,6 +16,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/constraint"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
@@ -216,22 +217,32 @@ const (
 //
 // See props/statistics.go for more details.
 type statisticsBuilder struct {
-	evalCtx *tree.EvalContext
-	md      *opt.Metadata
+	evalCtx       *tree.EvalContext
+	md            *opt.Metadata
+	statsProvider cat.StatsProvider
+
+	// joinSelectivity, if non-nil, estimates the selectivity of the equality
+	// conditions of joins. See Memo.SetJoinSelectivityEstimator.
+	joinSelectivity JoinSelectivityEstimator
 }
 
-func (sb *statisticsBuilder) init(evalCtx *tree.EvalContext, md *opt.Metadata) {
+func (sb *statisticsBuilder) init(
+	evalCtx *tree.EvalContext, md *opt.Metadata, statsProvider cat.StatsProvider,
+) {
 	// This initialization pattern ensures that fields are not unwittingly
 	// reused. Field reuse must be explicit.
 	*sb = statisticsBuilder{
-		evalCtx: evalCtx,
-		md:      md,
+		evalCtx:       evalCtx,
+		md:            md,
+		statsProvider: statsProvider,
 	}
 }
 
 func (sb *statisticsBuilder) clear() {
 	sb.evalCtx = nil
 	sb.md = nil
+	sb.statsProvider = nil
+	sb.joinSelectivity = nil
 }
 
 // colStatFromChild retrieves a column statistic from a specific child of the
@@ -387,6 +398,14 @@ func (sb *statisticsBuilder) colStatFromInput(
 // colStat recursively tries to find it in the children of the expression,
 // lazily populating s.ColStats with the statistic as it gets passed up the
 // expression tree.
+//
+// The ColStats of a group act as a memo-wide cache keyed by (group, column
+// set): statistics are only derived when requested, and are shared by every
+// member of the group and by every set of required physical properties, so
+// expressions added by exploration reuse the statistics derived for the
+// normalized expression. Table column statistics are likewise cached in the
+// statistics annotation of the table. Both caches are invalidated when the
+// statistics of the memo are rebuilt by ResetForRecosting.
 func (sb *statisticsBuilder) colStat(colSet opt.ColSet, e RelExpr) *props.ColumnStatistic {
 	if colSet.Empty() {
 		panic(errors.AssertionFailedf("column statistics cannot be determined for empty column set"))
@@ -444,6 +463,9 @@ func (sb *statisticsBuilder) colStat(colSet opt.ColSet, e RelExpr) *props.Column
 	case opt.Max1RowOp:
 		return sb.colStatMax1Row(colSet, e.(*Max1RowExpr))
 
+	case opt.BarrierOp:
+		return sb.colStatBarrier(colSet, e.(*BarrierExpr))
+
 	case opt.OrdinalityOp:
 		return sb.colStatOrdinality(colSet, e.(*OrdinalityExpr))
 
@@ -610,7 +632,8 @@ func (sb *statisticsBuilder) makeTableStatistics(tabID opt.TableID) *props.Stati
 
 	// Make now and annotate the metadata table with it for next time.
 	stats = &props.Statistics{}
-	if tab.StatisticCount() == 0 {
+	statCount := sb.statsProvider.StatisticCount(tab)
+	if statCount == 0 {
 		// No statistics.
 		stats.Available = false
 		stats.RowCount = unknownRowCount
@@ -618,7 +641,7 @@ func (sb *statisticsBuilder) makeTableStatistics(tabID opt.TableID) *props.Stati
 		// Get the RowCount from the most recent statistic. Stats are ordered
 		// with most recent first.
 		stats.Available = true
-		stats.RowCount = float64(tab.Statistic(0).RowCount())
+		stats.RowCount = float64(sb.statsProvider.Statistic(tab, 0).RowCount())
 
 		// Make sure the row count is at least 1. The stats may be stale, and we
 		// can end up with weird and inefficient plans if we estimate 0 rows.
@@ -626,8 +649,8 @@ func (sb *statisticsBuilder) makeTableStatistics(tabID opt.TableID) *props.Stati
 
 		// Add all the column statistics, using the most recent statistic for each
 		// column set. Stats are ordered with most recent first.
-		for i := 0; i < tab.StatisticCount(); i++ {
-			stat := tab.Statistic(i)
+		for i := 0; i < statCount; i++ {
+			stat := sb.statsProvider.Statistic(tab, i)
 			if stat.ColumnCount() > 1 && !sb.evalCtx.SessionData().OptimizerUseMultiColStats {
 				continue
 			}
@@ -1258,7 +1281,13 @@ func (sb *statisticsBuilder) buildJoin(
 			equivReps.UnionWith(h.selfJoinCols)
 		}
 
-		s.ApplySelectivity(sb.selectivityFromEquivalencies(equivReps, &h.filtersFD, join, s))
+		// Prefer the estimate of the JoinSelectivityEstimator, which may be based
+		// on statistics that do not assume that the inputs are independent.
+		if sel, ok := sb.selectivityFromJoinEstimator(equivReps, &h.filtersFD, join, h); ok {
+			s.ApplySelectivity(sel)
+		} else {
+			s.ApplySelectivity(sb.selectivityFromEquivalencies(equivReps, &h.filtersFD, join, s))
+		}
 	}
 
 	if join.Op() == opt.InvertedJoinOp || hasInvertedJoinCond(h.filters) {
@@ -2241,6 +2270,40 @@ func (sb *statisticsBuilder) colStatMax1Row(
 	return colStat
 }
 
+// +---------+
+// | Barrier |
+// +---------+
+
+func (sb *statisticsBuilder) buildBarrier(barrier *BarrierExpr, relProps *props.Relational) {
+	s := &relProps.Stats
+	if zeroCardinality := s.Init(relProps); zeroCardinality {
+		// Short cut if cardinality is 0.
+		return
+	}
+	s.Available = sb.availabilityFromInput(barrier)
+
+	inputStats := &barrier.Input.Relational().Stats
+
+	s.RowCount = inputStats.RowCount
+	sb.finalizeFromCardinality(relProps)
+}
+
+func (sb *statisticsBuilder) colStatBarrier(
+	colSet opt.ColSet, barrier *BarrierExpr,
+) *props.ColumnStatistic {
+	s := &barrier.Relational().Stats
+
+	colStat, _ := s.ColStats.Add(colSet)
+
+	// Barrier returns the rows of its input unchanged.
+	inputColStat := sb.colStatFromChild(colSet, barrier, 0 /* childIdx */)
+	colStat.DistinctCount = inputColStat.DistinctCount
+	colStat.NullCount = inputColStat.NullCount
+	colStat.AvgSize = inputColStat.AvgSize
+	sb.finalizeFromRowCountAndDistinctCounts(colStat, s)
+	return colStat
+}
+
 // +------------+
 // | Row Number |
 // +------------+
@@ -4201,6 +4264,6 @@ func (sb *statisticsBuilder) numConjunctsInConstraint(
 // expression. This is used for testing.
 func RequestColStat(evalCtx *tree.EvalContext, e RelExpr, cols opt.ColSet) {
 	var sb statisticsBuilder
-	sb.init(evalCtx, e.Memo().Metadata())
+	sb.init(evalCtx, e.Memo().Metadata(), e.Memo().StatsProvider())
 	sb.colStat(cols, e)
 }
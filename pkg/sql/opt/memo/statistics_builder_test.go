@@ -15,6 +15,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/constraint"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/testcat"
@@ -103,7 +104,7 @@ func TestGetStatsFromConstraint(t *testing.T) {
 		}
 
 		sb := &statisticsBuilder{}
-		sb.init(&evalCtx, mem.Metadata())
+		sb.init(&evalCtx, mem.Metadata(), cat.TableStatsProvider)
 
 		// Make the scan.
 		scan := mem.MemoizeScan(&ScanPrivate{Table: tabID, Cols: cols})
@@ -238,3 +239,69 @@ func testStats(t *testing.T, s *props.Statistics, expectedStats string) {
 		t.Fatalf("\nexpected: %s\nactual  : %s", expectedStats, actual)
 	}
 }
+
+// overrideStatsProvider is a cat.StatsProvider that supplies the statistics of
+// one table in place of another.
+type overrideStatsProvider struct {
+	target, source cat.Table
+}
+
+func (p *overrideStatsProvider) table(tab cat.Table) cat.Table {
+	if tab.ID() == p.target.ID() {
+		return p.source
+	}
+	return tab
+}
+
+func (p *overrideStatsProvider) StatisticCount(tab cat.Table) int {
+	return p.table(tab).StatisticCount()
+}
+
+func (p *overrideStatsProvider) Statistic(tab cat.Table, i int) cat.TableStatistic {
+	return p.table(tab).Statistic(i)
+}
+
+// Test that statistics are retrieved from the memo's stats provider rather
+// than directly from the catalog.
+func TestStatsProvider(t *testing.T) {
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	catalog := testcat.New()
+	for _, ddl := range []string{
+		"CREATE TABLE t (a INT)",
+		"CREATE TABLE s (a INT)",
+		`ALTER TABLE s INJECT STATISTICS '[
+		{
+			"columns": ["a"],
+			"created_at": "2018-01-01 1:00:00.00000+00:00",
+			"row_count": 12345,
+			"distinct_count": 100
+		}
+	]'`,
+	} {
+		if _, err := catalog.ExecuteDDL(ddl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tn := tree.NewUnqualifiedTableName("t")
+	tab := catalog.Table(tn)
+	source := catalog.Table(tree.NewUnqualifiedTableName("s"))
+
+	scanRowCount := func(statsProvider cat.StatsProvider) float64 {
+		var mem Memo
+		mem.Init(&evalCtx)
+		if statsProvider != nil {
+			mem.SetStatsProvider(statsProvider)
+		}
+		tabID := mem.Metadata().AddTable(tab, tn)
+		scan := mem.MemoizeScan(&ScanPrivate{Table: tabID, Cols: opt.MakeColSet(tabID.ColumnID(0))})
+		return scan.Relational().Stats.RowCount
+	}
+
+	if rowCount := scanRowCount(nil); rowCount != unknownRowCount {
+		t.Errorf("expected %v rows with default stats provider, got %v", unknownRowCount, rowCount)
+	}
+	if rowCount := scanRowCount(&overrideStatsProvider{target: tab, source: source}); rowCount != 12345 {
+		t.Errorf("expected 12345 rows with override stats provider, got %v", rowCount)
+	}
+}
@@ -35,6 +35,28 @@ type ReplaceFunc func(e opt.Expr) opt.Expr
 // the rule is not applied (i.e. skipped).
 type MatchedRuleFunc func(ruleName opt.RuleName) bool
 
+// RuleMatch describes the match of an optimization rule. It is passed to a
+// MatchedRuleContextFunc.
+type RuleMatch struct {
+	// Rule is the name of the matched rule.
+	Rule opt.RuleName
+
+	// Source is the group member that was matched by an exploration rule. It
+	// is nil for a normalization rule, which matches the operands of an
+	// expression before the expression is constructed.
+	Source memo.RelExpr
+
+	// Required is the set of physical properties that was required of the
+	// group of Source when it was explored. It is nil for a normalization rule.
+	Required *physical.Required
+}
+
+// MatchedRuleContextFunc is like MatchedRuleFunc, but it is passed a
+// description of the match rather than only the name of the matched rule, so
+// that it can decide whether to apply the rule based on what was matched. It is
+// set via the NotifyOnMatchedRuleContext method of the optimizer or factory.
+type MatchedRuleContextFunc func(match RuleMatch) bool
+
 // AppliedRuleFunc defines the callback function for the NotifyOnAppliedRule
 // event supported by the optimizer and factory. It is invoked each time an
 // optimization rule (Normalize or Explore) has been applied.
@@ -144,6 +166,15 @@ func (f *Factory) FoldingControl() *FoldingControl {
 // execution time, since the stats are just recalculated anyway when
 // placeholders are assigned. If there are no placeholders, there is no need
 // for column statistics, since the memo is already fully optimized.
+//
+// The detached memo is never shared with the factory that later assigns its
+// placeholders; AssignPlaceholders always copies it. Every relational group
+// records the memo that owns it, and the optimizer updates the best
+// expressions and lazily derived properties of a memo in place, while a
+// detached memo may be read concurrently through the query cache. Sharing its
+// groups with a new memo would require cloning them on first write, and since
+// assigning placeholders re-runs normalization, few groups would survive
+// unchanged.
 func (f *Factory) DetachMemo() *memo.Memo {
 	m := f.mem
 	f.mem = nil
@@ -168,6 +199,25 @@ func (f *Factory) NotifyOnMatchedRule(matchedRule MatchedRuleFunc) {
 	f.matchedRule = matchedRule
 }
 
+// NotifyOnMatchedRuleContext is like NotifyOnMatchedRule, but the callback is
+// passed a description of the match. Since normalization rules match before the
+// expression is constructed, only the Rule field of the description is set.
+func (f *Factory) NotifyOnMatchedRuleContext(matchedRule MatchedRuleContextFunc) {
+	if matchedRule == nil {
+		f.matchedRule = nil
+		return
+	}
+	f.matchedRule = func(ruleName opt.RuleName) bool {
+		return matchedRule(RuleMatch{Rule: ruleName})
+	}
+}
+
+// MatchedRule returns the callback function set via NotifyOnMatchedRule, or
+// nil if there is none.
+func (f *Factory) MatchedRule() MatchedRuleFunc {
+	return f.matchedRule
+}
+
 // NotifyOnAppliedRule sets a callback function which is invoked each time a
 // normalize rule has been applied by the factory. If appliedRule is nil, then
 // no further notifications are sent.
@@ -175,6 +225,12 @@ func (f *Factory) NotifyOnAppliedRule(appliedRule AppliedRuleFunc) {
 	f.appliedRule = appliedRule
 }
 
+// AppliedRule returns the callback function set via NotifyOnAppliedRule, or
+// nil if there is none.
+func (f *Factory) AppliedRule() AppliedRuleFunc {
+	return f.appliedRule
+}
+
 // Memo returns the memo structure that the factory is operating upon.
 func (f *Factory) Memo() *memo.Memo {
 	return f.mem
@@ -297,6 +353,14 @@ func (f *Factory) AssignPlaceholders(from *memo.Memo) (err error) {
 	return nil
 }
 
+// ResetConstructorStackDepth resets the constructor stack depth to zero. It
+// must only be called when no constructor function is executing, after a
+// panic that unwound one or more constructor functions has been recovered, so
+// that their depth was not decremented.
+func (f *Factory) ResetConstructorStackDepth() {
+	f.constructorStackDepth = 0
+}
+
 // CheckConstructorStackDepth panics in test builds if the constructor stack
 // depth is not zero. The stack depth should be 0 after a top-level constructor
 // function returns. It is used to verify that the stack depth is correctly
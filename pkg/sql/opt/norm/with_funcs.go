@@ -20,6 +20,14 @@ import (
 // 1. binding has no volatile expressions (because once it's inlined, there's no
 //    guarantee it will be executed fully), and
 // 2. binding is referenced at most once in expr.
+//
+// The decision is made during normalization rather than by comparing the cost
+// of inlining with the cost of buffering. A binding that is referenced more than
+// once cannot be inlined by InlineWith, since every reference would produce the
+// same column IDs; inlining it would require each copy to be rebuilt with new
+// columns. Similarly, the binding is optimized before Main, with only the
+// BindingOrdering required of it, so the orderings required of its WithScans
+// are not known when the binding's plan is chosen.
 func (c *CustomFuncs) CanInlineWith(binding, expr memo.RelExpr, private *memo.WithPrivate) bool {
 	// If materialization is set, ignore the checks below.
 	if private.Mtr.Set {
@@ -25,6 +25,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/privilege"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/errorutil"
 	"github.com/cockroachdb/cockroach/pkg/util/errorutil/unimplemented"
 	"github.com/cockroachdb/errors"
@@ -68,6 +69,13 @@ type Builder struct {
 	// This is used when re-preparing invalidated queries.
 	KeepPlaceholders bool
 
+	// Barriers is a control knob: each data source in the FROM clause with one
+	// of these aliases is wrapped in a Barrier operator, so that the optimizer
+	// does not transform expressions across it. It is set from the barrier
+	// statement hint (see xform.StatementHints). Build returns an error if an
+	// alias does not name a data source.
+	Barriers []string
+
 	// -- Results --
 	//
 	// These fields are set during the building process and can be used after
@@ -144,6 +152,10 @@ type Builder struct {
 	// (without ON CONFLICT) or false otherwise. All mutated tables will have an
 	// entry in the map.
 	areAllTableMutationsSimpleInserts map[cat.StableID]bool
+
+	// appliedBarriers is the set of indexes of the aliases in Barriers that
+	// named a data source.
+	appliedBarriers util.FastIntSet
 }
 
 // New creates a new Builder structure initialized with the given
@@ -213,6 +225,7 @@ func (b *Builder) Build() (err error) {
 	// Build the memo, and call SetRoot on the memo to indicate the root group
 	// and physical properties.
 	outScope := b.buildStmtAtRoot(b.stmt, nil /* desiredTypes */)
+	b.checkBarriers()
 
 	physical := outScope.makePhysicalProps()
 	b.factory.Memo().SetRoot(outScope.expr, physical)
@@ -63,6 +63,8 @@ func (b *Builder) buildDataSource(
 			outScope = b.buildWithOrdinality(outScope)
 		}
 
+		b.maybeBuildBarrier(source.As.Alias, outScope)
+
 		// Overwrite output properties with any alias information.
 		b.renameSource(source.As, outScope)
 
@@ -823,6 +825,33 @@ func (b *Builder) buildWithOrdinality(inScope *scope) (outScope *scope) {
 	return inScope
 }
 
+// maybeBuildBarrier wraps the expression of the given scope, which was built
+// for a data source with the given alias, in a Barrier operator if the alias
+// is one of the aliases in b.Barriers.
+func (b *Builder) maybeBuildBarrier(alias tree.Name, inScope *scope) {
+	if alias == "" {
+		return
+	}
+	for i := range b.Barriers {
+		if b.Barriers[i] == string(alias) {
+			b.appliedBarriers.Add(i)
+			inScope.expr = b.factory.ConstructBarrier(inScope.expr)
+			return
+		}
+	}
+}
+
+// checkBarriers raises an error if an alias in b.Barriers did not name a data
+// source of the statement, so that a mistyped hint is not silently ignored.
+func (b *Builder) checkBarriers() {
+	for i := range b.Barriers {
+		if !b.appliedBarriers.Contains(i) {
+			panic(pgerror.Newf(pgcode.UndefinedObject,
+				"optimizer hint barrier(%s) does not name a data source", b.Barriers[i]))
+		}
+	}
+}
+
 // buildSelectStmt builds a set of memo groups that represent the given select
 // statement.
 //
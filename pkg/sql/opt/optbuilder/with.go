@@ -295,6 +295,8 @@ func (b *Builder) buildCTE(
 	// Set it to 1 to match the cardinality.
 	if bindingProps.Stats.RowCount < 1 {
 		bindingProps.Stats.RowCount = 1
+	} else {
+		b.buildWorkingTableColStats(bindingProps, initialScope, cteSrc.cols)
 	}
 	cteSrc.expr = b.factory.ConstructFakeRel(&memo.FakeRelPrivate{
 		Props: bindingProps,
@@ -355,6 +357,32 @@ func (b *Builder) buildCTE(
 	return expr, cteSrc.cols, nil
 }
 
+// buildWorkingTableColStats adds column statistics to the given properties of
+// the binding of the working table of a recursive CTE, which are copied from
+// the columns of the initial query. Like the row count, they only hold for the
+// first iteration of the recursive query, but they are a better estimate of
+// each iteration than the defaults. Without them, the selectivity of the joins
+// between the working table and other tables in the recursive query is based
+// on default distinct counts, so lookup joins into those tables are costed as
+// if each iteration returned far more rows than it usually does.
+func (b *Builder) buildWorkingTableColStats(
+	bindingProps *props.Relational, initialScope *scope, cols physical.Presentation,
+) {
+	initial := initialScope.expr
+	bindingProps.Stats.Available = initial.Relational().Stats.Available
+	for i := range cols {
+		initialCol := opt.MakeColSet(initialScope.cols[i].id)
+		initialStat, ok := b.factory.Memo().RequestColStat(initial, initialCol)
+		if !ok {
+			return
+		}
+		colStat, _ := bindingProps.Stats.ColStats.Add(opt.MakeColSet(cols[i].ID))
+		colStat.DistinctCount = initialStat.DistinctCount
+		colStat.NullCount = initialStat.NullCount
+		colStat.AvgSize = initialStat.AvgSize
+	}
+}
+
 // getCTECols returns a presentation for the scope, renaming the columns to
 // those provided in the AliasClause (if any). Throws an error if there is a
 // mismatch in the number of columns.
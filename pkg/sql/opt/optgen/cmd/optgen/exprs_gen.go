@@ -397,6 +397,11 @@ func (g *exprsGen) genExprFuncs(define *lang.DefineExpr) {
 		fmt.Fprintf(g.w, "  e.next = member\n")
 		fmt.Fprintf(g.w, "}\n\n")
 
+		// Generate the replaceNext method.
+		fmt.Fprintf(g.w, "func (e *%s) replaceNext(member RelExpr) {\n", opTyp.name)
+		fmt.Fprintf(g.w, "  e.next = member\n")
+		fmt.Fprintf(g.w, "}\n\n")
+
 		// Generate the setGroup method.
 		fmt.Fprintf(g.w, "func (e *%s) setGroup(member RelExpr) {\n", opTyp.name)
 		fmt.Fprintf(g.w, "  if e.grp != nil {\n")
@@ -502,6 +507,11 @@ func (g *exprsGen) genEnforcerFuncs(define *lang.DefineExpr) {
 	fmt.Fprintf(g.w, "  panic(errors.AssertionFailedf(\"setNext cannot be called on enforcers\"))\n")
 	fmt.Fprintf(g.w, "}\n\n")
 
+	// Generate the replaceNext method.
+	fmt.Fprintf(g.w, "func (e *%s) replaceNext(member RelExpr) {\n", opTyp.name)
+	fmt.Fprintf(g.w, "  panic(errors.AssertionFailedf(\"replaceNext cannot be called on enforcers\"))\n")
+	fmt.Fprintf(g.w, "}\n\n")
+
 	// Generate the setGroup method.
 	fmt.Fprintf(g.w, "func (e *%s) setGroup(member exprGroup) {\n", opTyp.name)
 	fmt.Fprintf(g.w, "  panic(errors.AssertionFailedf(\"setGroup cannot be called on enforcers\"))\n")
@@ -648,6 +658,7 @@ func (g *exprsGen) genMemoizeFuncs() {
 			fmt.Fprintf(g.w, "  grp.rel.Populated = true\n")
 		}
 		fmt.Fprintf(g.w, "    m.memEstimate += size\n")
+		fmt.Fprintf(g.w, "    m.exprCount++\n")
 		fmt.Fprintf(g.w, "    m.CheckExpr(e)\n")
 		fmt.Fprintf(g.w, "  }\n")
 		if define.Tags.Contains("Scalar") {
@@ -704,6 +715,7 @@ func (g *exprsGen) genAddToGroupFuncs() {
 		}
 		fmt.Fprintf(g.w, "    e.setGroup(grp)\n")
 		fmt.Fprintf(g.w, "    m.memEstimate += size\n")
+		fmt.Fprintf(g.w, "    m.exprCount++\n")
 		fmt.Fprintf(g.w, "    m.CheckExpr(e)\n")
 		fmt.Fprintf(g.w, "  } else if interned.group() != grp.group() {\n")
 		fmt.Fprintf(g.w, "    // This is a group collision, do nothing.\n")
@@ -794,16 +806,19 @@ func (g *exprsGen) genInternFuncs() {
 
 		if !first {
 			fmt.Fprintf(g.w, " {\n")
+			fmt.Fprintf(g.w, "        in.cache.Finish()\n")
 			fmt.Fprintf(g.w, "        return existing\n")
 			fmt.Fprintf(g.w, "      }\n")
 		} else {
 			// Handle expressions with no children.
+			fmt.Fprintf(g.w, "      in.cache.Finish()\n")
 			fmt.Fprintf(g.w, "      return existing\n")
 		}
 		fmt.Fprintf(g.w, "    }\n")
 		fmt.Fprintf(g.w, "  }\n\n")
 
-		// Generate code to add expression to the cache.
+		// Generate code to add expression to the cache. Add also finishes the
+		// lookup.
 		fmt.Fprintf(g.w, "  in.cache.Add(val)\n")
 		fmt.Fprintf(g.w, "  return val\n")
 		fmt.Fprintf(g.w, "}\n\n")
@@ -43,6 +43,8 @@ func (g *ruleNamesGen) generate(compiled *lang.CompiledExpr, w io.Writer) {
 	fmt.Fprintf(g.w, "  // NumRuleNames tracks the total count of rule names.\n")
 	fmt.Fprintf(g.w, "  NumRuleNames\n")
 	fmt.Fprintf(g.w, ")\n\n")
+
+	g.genRuleOps()
 }
 
 func (g *ruleNamesGen) genRuleNameEnumByTag(tag string) {
@@ -64,3 +66,113 @@ func (g *ruleNamesGen) genRuleNameEnumByTag(tag string) {
 	}
 	fmt.Fprintf(g.w, "\n")
 }
+
+// ruleOps describes the operators that a rule matches and constructs.
+type ruleOps struct {
+	matched     []string
+	constructed []string
+	dynamic     bool
+}
+
+// genRuleOps generates tables that describe, for each rule, the operators
+// that it matches and the operators that its replace pattern constructs. The
+// tables are indexed by rule name.
+func (g *ruleNamesGen) genRuleOps() {
+	var names []lang.StringExpr
+	ops := make(map[lang.StringExpr]*ruleOps)
+	for _, tag := range []string{"Normalize", "Explore"} {
+		for _, rule := range g.compiled.Rules {
+			if !rule.Tags.Contains(tag) {
+				continue
+			}
+			r, ok := ops[rule.Name]
+			if !ok {
+				r = &ruleOps{}
+				ops[rule.Name] = r
+				names = append(names, rule.Name)
+			}
+
+			// Rules that match several operators have been expanded into a rule
+			// for each operator.
+			r.matched = appendUniqueOp(r.matched, rule.Match.SingleName())
+			g.findConstructedOps(rule.Replace, r)
+		}
+	}
+
+	fmt.Fprintf(g.w, "// ruleMatchedOps lists the operators that each rule matches at the\n")
+	fmt.Fprintf(g.w, "// top level.\n")
+	fmt.Fprintf(g.w, "var ruleMatchedOps = [NumRuleNames][]Operator{\n")
+	for _, name := range names {
+		g.genOpList(name, ops[name].matched)
+	}
+	fmt.Fprintf(g.w, "}\n\n")
+
+	fmt.Fprintf(g.w, "// ruleConstructedOps lists the operators that each rule's replace pattern\n")
+	fmt.Fprintf(g.w, "// constructs. It does not include operators that are constructed by custom\n")
+	fmt.Fprintf(g.w, "// functions or by constructors with dynamic names (see ruleHasDynamicReplace).\n")
+	fmt.Fprintf(g.w, "var ruleConstructedOps = [NumRuleNames][]Operator{\n")
+	for _, name := range names {
+		g.genOpList(name, ops[name].constructed)
+	}
+	fmt.Fprintf(g.w, "}\n\n")
+
+	fmt.Fprintf(g.w, "// ruleHasDynamicReplace is true for each rule whose replace pattern invokes\n")
+	fmt.Fprintf(g.w, "// a custom function or a constructor with a dynamic name, and so may construct\n")
+	fmt.Fprintf(g.w, "// operators that are not listed in ruleConstructedOps.\n")
+	fmt.Fprintf(g.w, "var ruleHasDynamicReplace = [NumRuleNames]bool{\n")
+	for _, name := range names {
+		if ops[name].dynamic {
+			fmt.Fprintf(g.w, "  %s: true,\n", name)
+		}
+	}
+	fmt.Fprintf(g.w, "}\n\n")
+}
+
+// findConstructedOps walks the given replace expression and adds the
+// operators that it constructs to r.
+func (g *ruleNamesGen) findConstructedOps(e lang.Expr, r *ruleOps) {
+	switch t := e.(type) {
+	case *lang.FuncExpr:
+		if t.HasDynamicName() {
+			r.dynamic = true
+		} else {
+			for _, name := range t.NameChoice() {
+				r.constructed = appendUniqueOp(r.constructed, string(name))
+			}
+		}
+
+	case *lang.CustomFuncExpr:
+		r.dynamic = true
+	}
+
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		if child := e.Child(i); child != nil {
+			g.findConstructedOps(child, r)
+		}
+	}
+}
+
+func (g *ruleNamesGen) genOpList(name lang.StringExpr, ops []string) {
+	if len(ops) == 0 {
+		return
+	}
+	fmt.Fprintf(g.w, "  %s: {", name)
+	for i, op := range ops {
+		if i > 0 {
+			fmt.Fprintf(g.w, ", ")
+		}
+		fmt.Fprintf(g.w, "%sOp", op)
+	}
+	fmt.Fprintf(g.w, "},\n")
+}
+
+// appendUniqueOp appends the given operator name to the list, unless it is
+// already in the list.
+func appendUniqueOp(ops []string, op string) []string {
+	for _, existing := range ops {
+		if existing == op {
+			return ops
+		}
+	}
+	return append(ops, op)
+}
@@ -352,8 +352,11 @@ func convertSlice(
 }
 
 // populateBestProps sets the physical properties and costs of the expressions
-// in the tree. Returns the cost of the expression tree.
-func (eg *exprGen) populateBestProps(expr opt.Expr, required *physical.Required) memo.Cost {
+// in the tree. Returns the cost of the expression tree, along with its
+// breakdown by resource.
+func (eg *exprGen) populateBestProps(
+	expr opt.Expr, required *physical.Required,
+) (memo.Cost, memo.CostBreakdown) {
 	rel, _ := expr.(memo.RelExpr)
 	if rel != nil {
 		if !xform.CanProvidePhysicalProps(eg.f.EvalContext(), rel, required) {
@@ -362,6 +365,7 @@ func (eg *exprGen) populateBestProps(expr opt.Expr, required *physical.Required)
 	}
 
 	var cost memo.Cost
+	var breakdown memo.CostBreakdown
 	for i, n := 0, expr.ChildCount(); i < n; i++ {
 		var childProps *physical.Required
 		if rel != nil {
@@ -369,7 +373,9 @@ func (eg *exprGen) populateBestProps(expr opt.Expr, required *physical.Required)
 		} else {
 			childProps = xform.BuildChildPhysicalPropsScalar(eg.mem, expr, i)
 		}
-		cost += eg.populateBestProps(expr.Child(i), childProps)
+		childCost, childBreakdown := eg.populateBestProps(expr.Child(i), childProps)
+		cost += childCost
+		breakdown.Add(childBreakdown)
 	}
 
 	if rel != nil {
@@ -378,8 +384,12 @@ func (eg *exprGen) populateBestProps(expr opt.Expr, required *physical.Required)
 		// it must run after the recursive calls on the children.
 		provided.Ordering = ordering.BuildProvided(rel, &required.Ordering)
 
-		cost += eg.coster.ComputeCost(rel, required)
-		eg.mem.SetBestProps(rel, required, provided, cost)
+		selfCost := eg.coster.ComputeCost(rel, required)
+		selfBreakdown := eg.coster.ComputeCostBreakdown(rel, required)
+		cost += selfCost
+		breakdown.Add(selfBreakdown)
+		eg.mem.SetBestProps(rel, required, provided, cost, breakdown)
+		eg.mem.SetSelfCost(rel, selfCost, selfBreakdown)
 	}
-	return cost
+	return cost, breakdown
 }
@@ -0,0 +1,28 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package optpb defines the structured events that the optimizer emits while
+// it optimizes a memo. See xform.Optimizer.SetEventSink.
+package optpb
+
+import "fmt"
+
+// String formats the expression in the same way as the memo, e.g. G3 for the
+// first member of group 3 and G3.1 for the second. Scalar expressions that are
+// not part of a group are formatted using their operator name.
+func (e Expr) String() string {
+	if e.Group == 0 {
+		return e.Op
+	}
+	if e.Member == 0 {
+		return fmt.Sprintf("G%d(%s)", e.Group, e.Op)
+	}
+	return fmt.Sprintf("G%d.%d(%s)", e.Group, e.Member, e.Op)
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package ordering
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
+)
+
+func gatherCanProvideOrdering(expr memo.RelExpr, required *props.OrderingChoice) bool {
+	// Gather operator interleaves the rows of its input streams, so it cannot
+	// provide any ordering.
+	return required.Any()
+}
+
+func gatherBuildChildReqOrdering(
+	parent memo.RelExpr, required *props.OrderingChoice, childIdx int,
+) props.OrderingChoice {
+	// No ordering is required of the input.
+	return props.OrderingChoice{}
+}
+
+func gatherBuildProvided(expr memo.RelExpr, required *props.OrderingChoice) opt.Ordering {
+	return nil
+}
@@ -33,7 +33,8 @@ func DeriveInterestingOrderings(e memo.RelExpr) props.OrderingSet {
 	var res props.OrderingSet
 	switch e.Op() {
 	case opt.ScanOp:
-		res = interestingOrderingsForScan(e.(*memo.ScanExpr))
+		scan := e.(*memo.ScanExpr)
+		res = interestingOrderingsForScan(scan, scan.Cols)
 
 	case opt.SelectOp, opt.IndexJoinOp, opt.LookupJoinOp:
 		res = interestingOrderingsForExpr(e)
@@ -41,7 +42,8 @@ func DeriveInterestingOrderings(e memo.RelExpr) props.OrderingSet {
 	case opt.ProjectOp:
 		res = interestingOrderingsForProject(e.(*memo.ProjectExpr))
 
-	case opt.GroupByOp, opt.ScalarGroupByOp:
+	case opt.GroupByOp, opt.ScalarGroupByOp, opt.DistinctOnOp, opt.EnsureDistinctOnOp,
+		opt.UpsertDistinctOnOp, opt.EnsureUpsertDistinctOnOp:
 		res = interestingOrderingsForGroupBy(e)
 
 	case opt.LimitOp, opt.OffsetOp:
@@ -66,13 +68,14 @@ func DeriveInterestingOrderings(e memo.RelExpr) props.OrderingSet {
 }
 
 // interestingOrderingsForScan calculates interesting orderings of a scan based
-// on the indexes on underlying table.
+// on the indexes on underlying table. The orderings are restricted to the given
+// columns, which are usually the columns produced by the scan.
 //
 // Note that partial indexes are considered here, even though they don't provide
 // an interesting ordering for all values in the column. This is required in
 // order to consider partial indexes for certain optimization rules, such as
 // GenerateMergeJoins.
-func interestingOrderingsForScan(scan *memo.ScanExpr) props.OrderingSet {
+func interestingOrderingsForScan(scan *memo.ScanExpr, cols opt.ColSet) props.OrderingSet {
 	md := scan.Memo().Metadata()
 	tab := md.Table(scan.Table)
 	var ord props.OrderingSet
@@ -97,7 +100,7 @@ func interestingOrderingsForScan(scan *memo.ScanExpr) props.OrderingSet {
 		if o.CanSimplify(fds) {
 			o.Simplify(fds)
 		}
-		o.RestrictToCols(scan.Cols)
+		o.RestrictToCols(cols)
 		if !o.Any() {
 			ord.Add(&o)
 		}
@@ -129,6 +132,17 @@ func interestingOrderingsForExpr(e memo.RelExpr) props.OrderingSet {
 
 func interestingOrderingsForProject(prj *memo.ProjectExpr) props.OrderingSet {
 	inOrd := DeriveInterestingOrderings(prj.Input)
+	if scan, ok := prj.Input.(*memo.ScanExpr); ok && scan.IsCanonical() {
+		// Virtual computed columns projected on top of a canonical scan can be
+		// produced directly by a scan of a secondary index that contains them
+		// (see the GenerateIndexScansWithVirtualCols rule), so orderings on them
+		// are also interesting.
+		virtualCols := scan.Memo().Metadata().TableMeta(scan.Table).VirtualComputedColumns()
+		virtualCols.IntersectionWith(prj.Relational().OutputCols)
+		if !virtualCols.Empty() {
+			inOrd = interestingOrderingsForScan(scan, scan.Cols.Union(virtualCols))
+		}
+	}
 	res := inOrd.Copy()
 	outCols := prj.Relational().OutputCols
 	fds := prj.InternalFDs()
@@ -136,6 +150,12 @@ func interestingOrderingsForProject(prj *memo.ProjectExpr) props.OrderingSet {
 	return res
 }
 
+// interestingOrderingsForGroupBy calculates the interesting orderings of a
+// grouping operator, such as GroupBy or DistinctOn. These are the orderings of
+// its input, or else its internal ordering, restricted to the grouping columns.
+// DistinctOn can pass through an ordering on the grouping columns to its input,
+// so these orderings allow a Sort above DistinctOn to reuse a partial ordering
+// of its input (see the longest common prefix logic in enforceProps).
 func interestingOrderingsForGroupBy(rel memo.RelExpr) props.OrderingSet {
 	private := rel.Private().(*memo.GroupingPrivate)
 	if private.GroupingCols.Empty() {
@@ -216,11 +216,26 @@ func init() {
 		buildChildReqOrdering: sortBuildChildReqOrdering,
 		buildProvidedOrdering: sortBuildProvided,
 	}
+	funcMap[opt.TopKSortOp] = funcs{
+		canProvideOrdering:    nil, // should never get called
+		buildChildReqOrdering: topKSortBuildChildReqOrdering,
+		buildProvidedOrdering: sortBuildProvided,
+	}
 	funcMap[opt.DistributeOp] = funcs{
 		canProvideOrdering:    distributeCanProvideOrdering,
 		buildChildReqOrdering: distributeBuildChildReqOrdering,
 		buildProvidedOrdering: distributeBuildProvided,
 	}
+	funcMap[opt.BarrierOp] = funcs{
+		canProvideOrdering:    barrierCanProvideOrdering,
+		buildChildReqOrdering: barrierBuildChildReqOrdering,
+		buildProvidedOrdering: barrierBuildProvided,
+	}
+	funcMap[opt.GatherOp] = funcs{
+		canProvideOrdering:    gatherCanProvideOrdering,
+		buildChildReqOrdering: gatherBuildChildReqOrdering,
+		buildProvidedOrdering: gatherBuildProvided,
+	}
 	funcMap[opt.InsertOp] = funcs{
 		canProvideOrdering:    mutationCanProvideOrdering,
 		buildChildReqOrdering: mutationBuildChildReqOrdering,
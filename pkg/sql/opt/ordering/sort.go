@@ -28,3 +28,10 @@ func sortBuildChildReqOrdering(
 ) props.OrderingChoice {
 	return parent.(*memo.SortExpr).InputOrdering
 }
+
+func topKSortBuildChildReqOrdering(
+	parent memo.RelExpr, required *props.OrderingChoice, childIdx int,
+) props.OrderingChoice {
+	// No ordering is required of the input.
+	return props.OrderingChoice{}
+}
@@ -47,7 +47,8 @@ import (
 //   atom A => AND-expr B iff:      A => each of B's children
 //   atom A => OR-expr B iff:       A => any of B's children
 //
-//   AND-expr A => atom B iff:      any of A's children => B
+//   AND-expr A => atom B iff:      any of A's children => B OR
+//                                    A's atoms together => B
 //   AND-expr A => AND-expr B iff:  A => each of B's children
 //   AND-expr A => OR-expr B iff:   A => any of B's children OR
 //                                    any of A's children => B
@@ -353,6 +354,65 @@ func (im *Implicator) filtersExprImpliesPredicate(
 		}
 	}
 
+	// No single child of A implies the atom B, but the children may imply it
+	// together.
+	switch pred.Op() {
+	case opt.FiltersOp, opt.RangeOp, opt.AndOp, opt.OrOp:
+		return false
+	}
+	return im.conjunctionImpliesAtom(*e, pred)
+}
+
+// conjunctionImpliesAtom returns true if the conjunction of the atoms in e
+// implies the atom pred, even though no single atom implies it. For example:
+//
+//   a > 3 AND a < 5
+//   =>
+//   a = 4
+//
+// The constraints of the atoms are intersected, and pred is implied if any of
+// the resulting constraints is contained by the constraint of pred. Atoms whose
+// constraints are not tight are ignored, as in atomImpliesAtom; ignoring an
+// atom only widens the intersection, so implication is never falsely proven.
+//
+// None of the atoms are added to exactMatches, because no single atom is
+// equivalent to pred, so they must all remain in the remaining filters.
+func (im *Implicator) conjunctionImpliesAtom(e memo.FiltersExpr, pred opt.ScalarExpr) bool {
+	if len(e) < 2 {
+		return false
+	}
+	predSet, predTight := im.buildConstraint(pred)
+	if !predTight || predSet == constraint.Contradiction || predSet.Length() != 1 {
+		return false
+	}
+	predConstraint := predSet.Constraint(0)
+
+	combined := constraint.Unconstrained
+	atoms := 0
+	for i := range e {
+		switch e[i].Condition.Op() {
+		case opt.FiltersOp, opt.RangeOp, opt.AndOp, opt.OrOp:
+			continue
+		}
+		eSet, eTight := im.buildConstraint(e[i].Condition)
+		if !eTight {
+			continue
+		}
+		combined = combined.Intersect(im.evalCtx, eSet)
+		atoms++
+	}
+	if atoms < 2 {
+		return false
+	}
+	if combined == constraint.Contradiction {
+		return true
+	}
+	for i, n := 0, combined.Length(); i < n; i++ {
+		c := combined.Constraint(i)
+		if predConstraint.Columns.IsPrefixOf(&c.Columns) && predConstraint.Contains(im.evalCtx, c) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -511,16 +571,8 @@ func (im *Implicator) atomImpliesAtom(
 	}
 
 	// Build constraint sets for e and pred, unless they have been cached.
-	eSet, eTight, ok := im.fetchConstraint(e)
-	if !ok {
-		eSet, eTight = memo.BuildConstraints(e, im.md, im.evalCtx)
-		im.cacheConstraint(e, eSet, eTight)
-	}
-	predSet, predTight, ok := im.fetchConstraint(pred)
-	if !ok {
-		predSet, predTight = memo.BuildConstraints(pred, im.md, im.evalCtx)
-		im.cacheConstraint(pred, predSet, predTight)
-	}
+	eSet, eTight := im.buildConstraint(e)
+	predSet, predTight := im.buildConstraint(pred)
 
 	// If e is a contradiction, it represents an empty set of rows. The empty
 	// set is contained by all sets, so a contradiction implies all predicates.
@@ -668,6 +720,17 @@ func (im *Implicator) twoVarComparisonImpliesTwoVarComparison(
 	return false, true
 }
 
+// buildConstraint returns the constraint set and tight boolean for the given
+// scalar expression, building and caching them if they have not been cached.
+func (im *Implicator) buildConstraint(e opt.ScalarExpr) (_ *constraint.Set, tight bool) {
+	c, tight, ok := im.fetchConstraint(e)
+	if !ok {
+		c, tight = memo.BuildConstraints(e, im.md, im.evalCtx)
+		im.cacheConstraint(e, c, tight)
+	}
+	return c, tight
+}
+
 // initConstraintCache initializes the constraintCache field if it has not yet
 // been initialized.
 func (im *Implicator) initConstraintCache() {
@@ -54,6 +54,14 @@ type Required struct {
 	// using math.Ceil.
 	LimitHint float64
 
+	// HardLimit specifies the maximum number of result rows that will be
+	// consumed from the expression. Unlike LimitHint, which is an estimate, it
+	// is guaranteed that no more than HardLimit rows are needed, so the
+	// expression may stop after returning them. A HardLimit of 0 indicates "no
+	// limit". It is only set if a TopKSort enforcer can be used (see
+	// Memo.UseTopKEnforcer).
+	HardLimit int64
+
 	// Distribution specifies the physical distribution of result rows. This is
 	// defined as the set of regions that may contain result rows. If
 	// Distribution is not defined, then no particular distribution is required.
@@ -61,6 +69,41 @@ type Required struct {
 	// distribution is the root, since data must always be returned to the gateway
 	// region.
 	Distribution Distribution
+
+	// MaxParallelism specifies the maximum number of nodes that may
+	// concurrently execute the expression and its inputs. It allows admission
+	// control and session settings to bound the parallelism of a plan, in which
+	// case the optimizer should prefer serial alternatives, or alternatives that
+	// fan out to fewer nodes. A MaxParallelism of 0 indicates "no limit".
+	MaxParallelism int
+
+	// Parallelism specifies the number of parallel streams in which result rows
+	// must be produced. Each stream produces a disjoint subset of the rows, so
+	// the work of producing them is divided between the streams. A Parallelism
+	// of 0 indicates that rows are produced serially, in a single stream. The
+	// optimizer only requires parallelism of expressions below a Gather
+	// enforcer, which combines the streams into one.
+	Parallelism int
+
+	// Streaming specifies that the expression should produce its result rows
+	// without first buffering an unbounded number of rows from its inputs. It is
+	// required by operators that need bounded memory, such as a Limit, which
+	// only consumes a few rows of its input, or the right side of an apply join,
+	// which is re-executed for every row on the left side. Unlike the other
+	// properties, it cannot be enforced by adding an operator on top of an
+	// expression that buffers rows, so it is only a preference: buffering
+	// operators can still provide it, but are costed as though their buffered
+	// rows spill to disk.
+	Streaming bool
+
+	// NoFullScan specifies that the expression and its inputs must not contain
+	// a large full scan of a table or index, i.e. an unconstrained scan that is
+	// estimated to return more than the large_full_scan_rows session setting,
+	// or for which there are no statistics. Like MaxParallelism, it applies to
+	// the entire subtree. It is required of the root when the
+	// disallow_full_table_scans session setting is enabled, so that the
+	// optimizer chooses the best plan without such a scan, if there is one.
+	NoFullScan bool
 }
 
 // MinRequired are the default physical properties that require nothing and
@@ -70,7 +113,9 @@ var MinRequired = &Required{}
 // Defined is true if any physical property is defined. If none is defined, then
 // this is an instance of MinRequired.
 func (p *Required) Defined() bool {
-	return !p.Presentation.Any() || !p.Ordering.Any() || p.LimitHint != 0 || !p.Distribution.Any()
+	return !p.Presentation.Any() || !p.Ordering.Any() || p.LimitHint != 0 || p.HardLimit != 0 ||
+		!p.Distribution.Any() || p.MaxParallelism != 0 || p.Parallelism != 0 || p.Streaming ||
+		p.NoFullScan
 }
 
 // ColSet returns the set of columns used by any of the physical properties.
@@ -104,9 +149,24 @@ func (p *Required) String() string {
 	if p.LimitHint != 0 {
 		output("limit hint", func(buf *bytes.Buffer) { fmt.Fprintf(buf, "%.2f", p.LimitHint) })
 	}
+	if p.HardLimit != 0 {
+		output("hard limit", func(buf *bytes.Buffer) { fmt.Fprintf(buf, "%d", p.HardLimit) })
+	}
 	if !p.Distribution.Any() {
 		output("distribution", p.Distribution.format)
 	}
+	if p.MaxParallelism != 0 {
+		output("max parallelism", func(buf *bytes.Buffer) { fmt.Fprintf(buf, "%d", p.MaxParallelism) })
+	}
+	if p.Parallelism != 0 {
+		output("parallelism", func(buf *bytes.Buffer) { fmt.Fprintf(buf, "%d", p.Parallelism) })
+	}
+	if p.Streaming {
+		output("streaming", func(buf *bytes.Buffer) { buf.WriteString("true") })
+	}
+	if p.NoFullScan {
+		output("no full scan", func(buf *bytes.Buffer) { buf.WriteString("true") })
+	}
 
 	// Handle empty properties case.
 	if buf.Len() == 0 {
@@ -118,7 +178,10 @@ func (p *Required) String() string {
 // Equals returns true if the two physical properties are identical.
 func (p *Required) Equals(rhs *Required) bool {
 	return p.Presentation.Equals(rhs.Presentation) && p.Ordering.Equals(&rhs.Ordering) &&
-		p.LimitHint == rhs.LimitHint && p.Distribution.Equals(rhs.Distribution)
+		p.LimitHint == rhs.LimitHint && p.HardLimit == rhs.HardLimit &&
+		p.Distribution.Equals(rhs.Distribution) &&
+		p.MaxParallelism == rhs.MaxParallelism && p.Parallelism == rhs.Parallelism &&
+		p.Streaming == rhs.Streaming && p.NoFullScan == rhs.NoFullScan
 }
 
 // Presentation specifies the naming, membership (including duplicates), and
@@ -59,6 +59,44 @@ func TestRequiredProps(t *testing.T) {
 	ordering := props.ParseOrderingChoice("+1,+5")
 	phys.Ordering = ordering
 	testRequiredProps(t, phys, "[presentation: a:1,b:2] [ordering: +1,+5]")
+
+	// Add max parallelism props.
+	phys.MaxParallelism = 4
+	testRequiredProps(t, phys, "[presentation: a:1,b:2] [ordering: +1,+5] [max parallelism: 4]")
+
+	if !(&physical.Required{MaxParallelism: 1}).Defined() {
+		t.Error("max parallelism should be defined")
+	}
+
+	if phys.Equals(&physical.Required{Presentation: presentation, Ordering: ordering}) {
+		t.Error("props with different max parallelism should not be equal")
+	}
+
+	// Add parallelism props.
+	phys.Parallelism = 8
+	testRequiredProps(t, phys,
+		"[presentation: a:1,b:2] [ordering: +1,+5] [max parallelism: 4] [parallelism: 8]")
+
+	if !(&physical.Required{Parallelism: 2}).Defined() {
+		t.Error("parallelism should be defined")
+	}
+
+	if !(&physical.Required{HardLimit: 10}).Defined() {
+		t.Error("hard limit should be defined")
+	}
+	testRequiredProps(t, &physical.Required{LimitHint: 10, HardLimit: 10},
+		"[limit hint: 10.00] [hard limit: 10]")
+
+	streaming := &physical.Required{Streaming: true}
+	testRequiredProps(t, streaming, "[streaming: true]")
+
+	if !streaming.Defined() {
+		t.Error("streaming should be defined")
+	}
+
+	if streaming.Equals(&physical.Required{}) {
+		t.Error("props with different streaming should not be equal")
+	}
 }
 
 func testRequiredProps(t *testing.T, physProps *physical.Required, expected string) {
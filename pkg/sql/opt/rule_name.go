@@ -41,6 +41,36 @@ func (r RuleName) IsExplore() bool {
 	return r > startExploreRule
 }
 
+// MatchedOperators returns the operators that r matches at the top level of its
+// match pattern. It returns nil for manual rules.
+func (r RuleName) MatchedOperators() []Operator {
+	return ruleMatchedOps[r]
+}
+
+// ConstructedOperators returns the operators that the replace pattern of r
+// constructs. If complete is false, r may also construct other operators, for
+// example because its replace pattern invokes a custom function. Manual rules
+// are never complete. Along with MatchedOperators, this allows a rule
+// dependency graph to be computed, in which r can enable each rule that matches
+// one of the operators it constructs.
+func (r RuleName) ConstructedOperators() (ops []Operator, complete bool) {
+	if r < NumManualRuleNames {
+		return nil, false
+	}
+	return ruleConstructedOps[r], !ruleHasDynamicReplace[r]
+}
+
+// ParseRuleName returns the rule with the given name. It returns ok=false if
+// there is no such rule.
+func ParseRuleName(name string) (_ RuleName, ok bool) {
+	for r := RuleName(1); r < NumRuleNames; r++ {
+		if r.String() == name {
+			return r, true
+		}
+	}
+	return InvalidRuleName, false
+}
+
 // Make linter happy.
 var _ = InvalidRuleName
 var _ = NumManualRuleNames
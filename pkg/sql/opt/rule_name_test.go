@@ -0,0 +1,45 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package opt
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestRuleOperators verifies that every generated rule matches at least one
+// operator, and that the operators constructed by a rule are only reported as
+// complete if its replace pattern does not invoke custom functions.
+func TestRuleOperators(t *testing.T) {
+	for r := NumManualRuleNames + 1; r < NumRuleNames; r++ {
+		if r == startExploreRule {
+			continue
+		}
+		if len(r.MatchedOperators()) == 0 {
+			t.Errorf("%s does not match any operators", r)
+		}
+	}
+
+	// CommuteVar constructs the operator that it matches.
+	matched := CommuteVar.MatchedOperators()
+	if ops, complete := CommuteVar.ConstructedOperators(); !complete || !reflect.DeepEqual(ops, matched) {
+		t.Errorf("expected CommuteVar to construct %v, got %v (complete=%t)", matched, ops, complete)
+	}
+	if ops, complete := EliminateNot.ConstructedOperators(); !complete || len(ops) != 0 {
+		t.Errorf("expected EliminateNot to construct no operators, got %v (complete=%t)", ops, complete)
+	}
+	if _, complete := GenerateIndexScans.ConstructedOperators(); complete {
+		t.Errorf("expected GenerateIndexScans to invoke a custom function")
+	}
+	if _, complete := PruneRootCols.ConstructedOperators(); complete {
+		t.Errorf("expected manual rules to be incomplete")
+	}
+}
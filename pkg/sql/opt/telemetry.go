@@ -20,10 +20,22 @@ import (
 // "Telemetry" tag. All other operators have nil values.
 var OpTelemetryCounters [NumOperators]telemetry.Counter
 
+// RuleTelemetryCounters stores telemetry counters for exploration rules, which
+// are incremented each time the rule is applied and adds at least one
+// expression to the memo. Rules that match but do not generate anything are
+// not counted. Normalization rules have nil values, since they are applied far
+// more often and almost never change.
+var RuleTelemetryCounters [NumRuleNames]telemetry.Counter
+
 func init() {
 	for _, op := range TelemetryOperators {
 		OpTelemetryCounters[op] = sqltelemetry.OptNodeCounter(op.String())
 	}
+	for r := RuleName(1); r < NumRuleNames; r++ {
+		if r.IsExplore() {
+			RuleTelemetryCounters[r] = sqltelemetry.OptRuleCounter(r.String())
+		}
+	}
 }
 
 // JoinTypeToUseCounter returns the JoinTypeXyzUseCounter for the given join
@@ -28,22 +28,34 @@ import (
 func BuildQuery(
 	t *testing.T, o *xform.Optimizer, catalog cat.Catalog, evalCtx *tree.EvalContext, sql string,
 ) {
+	o.Init(evalCtx, catalog)
+	if err := BuildInitializedQuery(o, catalog, sql); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BuildInitializedQuery builds the given sql statement using an optimizer that
+// has already been initialized. It can be used as an xform.BenchmarkBuildFunc.
+func BuildInitializedQuery(o *xform.Optimizer, catalog cat.Catalog, sql string) error {
 	stmt, err := parser.ParseOne(sql)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
 
 	ctx := context.Background()
 	semaCtx := tree.MakeSemaContext()
 	if err := semaCtx.Placeholders.Init(stmt.NumPlaceholders, nil /* typeHints */); err != nil {
-		t.Fatal(err)
+		return err
 	}
 	semaCtx.Annotations = tree.MakeAnnotations(stmt.NumAnnotations)
-	o.Init(evalCtx, catalog)
-	err = optbuilder.New(ctx, &semaCtx, evalCtx, catalog, o.Factory(), stmt.AST).Build()
+	evalCtx := o.Factory().EvalContext()
+	bld := optbuilder.New(ctx, &semaCtx, evalCtx, catalog, o.Factory(), stmt.AST)
+	hints, err := xform.ParseStatementHints(evalCtx.OptimizerHints)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
+	bld.Barriers = hints.Barriers
+	return bld.Build()
 }
 
 // BuildScalar builds the given input string as a ScalarExpr and returns it.
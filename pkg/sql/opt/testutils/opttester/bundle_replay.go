@@ -0,0 +1,241 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package opttester
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/testcat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+// BundleReplay is the result of replaying the planning of the statement in a
+// statement diagnostics bundle. See ReplayBundle.
+type BundleReplay struct {
+	// SQL is the statement that was planned.
+	SQL string
+
+	// Plan is the lowest cost plan found by the replayed optimizer, formatted
+	// in the same way as opt.txt in the bundle.
+	Plan string
+
+	// Trace records each rule that was applied while the statement was built
+	// and optimized, along with the expressions that it added.
+	Trace *xform.OptimizerTrace
+
+	// ReplayedDecisions is true if the bundle contained the decisions made for
+	// the rules matched when the statement was originally planned, and they
+	// were replayed. In that case the plan is the one that the statement had
+	// when the bundle was collected. Otherwise, the plan is only the one that
+	// the local optimizer would choose, given the catalog, statistics and
+	// settings of the bundle.
+	ReplayedDecisions bool
+}
+
+// ReplayBundle reconstructs the optimizer that planned the statement of an
+// unzipped statement diagnostics bundle, i.e. a bundle collected by EXPLAIN
+// ANALYZE (DEBUG) or by a statement diagnostics request, and re-runs the
+// optimization locally with tracing enabled. The test catalog is populated
+// with the schema and statistics of the bundle (schema.sql and stats-*.sql),
+// the session settings that affect planning are restored from env.sql, and the
+// rule decisions recorded in rule-decisions.txt, if any, are replayed, so that
+// the plan chosen on the customer's cluster is reproduced exactly.
+//
+// Replay fails with an error if the local optimizer matches a rule that was
+// not matched when the bundle was collected, e.g. because the bundle was
+// collected by a different version, or because only a subset of the schema is
+// supported by the test catalog. Statements with placeholders are not
+// supported.
+func ReplayBundle(dir string) (*BundleReplay, error) {
+	readFile := func(name string) (string, error) {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(contents), err
+	}
+
+	stmt, err := readFile("statement.sql")
+	if err != nil {
+		return nil, err
+	}
+	stmt = stripBundleArguments(stmt)
+	parsed, err := parser.ParseOne(stmt)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing statement.sql")
+	}
+	if parsed.NumPlaceholders > 0 {
+		return nil, errors.New("replaying statements with placeholders is not supported")
+	}
+
+	catalog := testcat.New()
+	if schema, err := readFile("schema.sql"); err == nil {
+		if err := catalog.ExecuteMultipleDDL(schema); err != nil {
+			return nil, errors.Wrap(err, "executing schema.sql")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	statsFiles, err := filepath.Glob(filepath.Join(dir, "stats-*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(statsFiles)
+	for _, path := range statsFiles {
+		stats, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := catalog.ExecuteMultipleDDL(string(stats)); err != nil {
+			return nil, errors.Wrapf(err, "executing %s", filepath.Base(path))
+		}
+	}
+
+	ot := New(catalog, stmt)
+	if env, err := readFile("env.sql"); err == nil {
+		if err := applyBundleSettings(ot.evalCtx.SessionData(), env); err != nil {
+			return nil, errors.Wrap(err, "applying env.sql")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var decisions *xform.RuleDecisions
+	if encoded, err := readFile("rule-decisions.txt"); err == nil {
+		if decisions, err = xform.ParseRuleDecisions(strings.TrimSpace(encoded)); err != nil {
+			return nil, errors.Wrap(err, "parsing rule-decisions.txt")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	o := ot.makeOptimizer()
+	o.Factory().FoldingControl().AllowStableFolds()
+	if decisions != nil {
+		o.ReplayRuleDecisions(decisions)
+	}
+	o.EnableTracing()
+	root, err := ot.optimizeExpr(o, nil /* tables */)
+	if err != nil {
+		return nil, err
+	}
+	return &BundleReplay{
+		SQL:               stmt,
+		Plan:              ot.FormatExpr(root),
+		Trace:             o.Trace(),
+		ReplayedDecisions: decisions != nil,
+	}, nil
+}
+
+// stripBundleArguments removes the placeholder arguments that are appended to
+// the statement in statement.sql, which are formatted as a comment.
+func stripBundleArguments(stmt string) string {
+	if i := strings.Index(stmt, "\n\n-- Arguments:\n"); i >= 0 {
+		return stmt[:i]
+	}
+	return stmt
+}
+
+var (
+	// bundleSetRE matches a session setting with a value other than its
+	// default in env.sql.
+	bundleSetRE = regexp.MustCompile(`^SET (\w+) = (.*?);`)
+
+	// bundleDefaultRE matches a session setting with its default value in
+	// env.sql.
+	bundleDefaultRE = regexp.MustCompile(`^-- (\w+) has the default value: (.*)$`)
+)
+
+// bundleSettings contains the session settings listed in env.sql that affect
+// planning, and the functions that apply their values to the session data.
+// Settings that only affect execution, such as distsql and vectorize, are
+// ignored.
+var bundleSettings = map[string]func(sd *sessiondata.SessionData, value string) error{
+	"reorder_joins_limit": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.ReorderJoinsLimit, err = strconv.ParseInt(value, 10, 64)
+		return err
+	},
+	"enable_zigzag_join": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.ZigzagJoinEnabled, err = parseBundleBool(value)
+		return err
+	},
+	"optimizer_use_histograms": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.OptimizerUseHistograms, err = parseBundleBool(value)
+		return err
+	},
+	"optimizer_use_multicol_stats": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.OptimizerUseMultiColStats, err = parseBundleBool(value)
+		return err
+	},
+	"locality_optimized_partitioned_index_scan": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.LocalityOptimizedSearch, err = parseBundleBool(value)
+		return err
+	},
+	"propagate_input_ordering": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.PropagateInputOrdering, err = parseBundleBool(value)
+		return err
+	},
+	"prefer_lookup_joins_for_fks": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.PreferLookupJoinsForFKs, err = parseBundleBool(value)
+		return err
+	},
+	"disallow_full_table_scans": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.DisallowFullTableScans, err = parseBundleBool(value)
+		return err
+	},
+	"large_full_scan_rows": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.LargeFullScanRows, err = strconv.ParseFloat(value, 64)
+		return err
+	},
+	"cost_scans_with_default_col_size": func(sd *sessiondata.SessionData, value string) (err error) {
+		sd.CostScansWithDefaultColSize, err = parseBundleBool(value)
+		return err
+	},
+}
+
+// applyBundleSettings applies the values of the session settings listed in
+// the given contents of env.sql to the session data.
+func applyBundleSettings(sd *sessiondata.SessionData, env string) error {
+	for _, line := range strings.Split(env, "\n") {
+		m := bundleSetRE.FindStringSubmatch(line)
+		if m == nil {
+			m = bundleDefaultRE.FindStringSubmatch(line)
+		}
+		if m == nil {
+			continue
+		}
+		name, value := m[1], strings.Trim(strings.TrimSpace(m[2]), "'")
+		if apply, ok := bundleSettings[name]; ok {
+			if err := apply(sd, value); err != nil {
+				return errors.Wrapf(err, "invalid value for %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseBundleBool parses the value of a boolean session setting, as printed by
+// SHOW.
+func parseBundleBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true":
+		return true, nil
+	case "off", "false":
+		return false, nil
+	}
+	return false, errors.Newf("invalid boolean %q", value)
+}
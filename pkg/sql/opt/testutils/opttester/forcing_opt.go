@@ -175,3 +175,33 @@ func (fc *forcingCoster) ComputeCost(e memo.RelExpr, required *physical.Required
 
 	return fc.inner.ComputeCost(e, required)
 }
+
+// ComputeCosts is part of the xform.BatchCoster interface.
+func (fc *forcingCoster) ComputeCosts(
+	candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	xform.ComputeCosts(fc.inner, candidates, required, costs)
+	if fc.restricted == nil {
+		return
+	}
+	for i, e := range candidates {
+		loc := fc.groups.MemoLoc(e)
+		if mIdx, ok := fc.restricted[loc.group]; ok && loc.member != mIdx {
+			costs[i] = memo.MaxCost
+		}
+	}
+}
+
+// ComputeCostBreakdown is part of the xform.Coster interface.
+func (fc *forcingCoster) ComputeCostBreakdown(
+	e memo.RelExpr, required *physical.Required,
+) memo.CostBreakdown {
+	return fc.inner.ComputeCostBreakdown(e, required)
+}
+
+// ComputeCostInterval is part of the xform.Coster interface.
+func (fc *forcingCoster) ComputeCostInterval(
+	e memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.CostInterval {
+	return fc.inner.ComputeCostInterval(e, required, cost)
+}
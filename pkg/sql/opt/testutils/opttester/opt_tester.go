@@ -174,9 +174,17 @@ type Flags struct {
 	// the coster will be in the range [c - 0.5 * c, c + 0.5 * c).
 	PerturbCost float64
 
+	// CostModelVersion, if non-zero, is the version of the cost model used by
+	// the optimizer, instead of the version in the cluster settings.
+	CostModelVersion xform.CostModelVersion
+
 	// JoinLimit is the default value for SessionData.ReorderJoinsLimit.
 	JoinLimit int
 
+	// ReorderJoinsSearchBudget is the default value for
+	// SessionData.ReorderJoinsSearchBudget.
+	ReorderJoinsSearchBudget time.Duration
+
 	// PreferLookupJoinsForFK is the default value for
 	// SessionData.PreferLookupJoinsForFKs.
 	PreferLookupJoinsForFKs bool
@@ -189,6 +197,30 @@ type Flags struct {
 	// SessionData.NullOrderedLast.
 	NullOrderedLast bool
 
+	// UseJoinLimitHints is the default value for
+	// SessionData.OptimizerUseJoinLimitHints.
+	UseJoinLimitHints bool
+
+	// ExploreApplyJoins is the default value for
+	// SessionData.OptimizerExploreApplyJoins.
+	ExploreApplyJoins bool
+
+	// UseTopKEnforcer is the default value for
+	// SessionData.OptimizerUseTopKEnforcer.
+	UseTopKEnforcer bool
+
+	// UseStreamingProperty is the default value for
+	// SessionData.OptimizerUseStreamingProperty.
+	UseStreamingProperty bool
+
+	// Parallelism is the number of parallel streams that the optimizer may
+	// consider executing expressions in (see xform.Optimizer.SetParallelism).
+	Parallelism int
+
+	// MaxParallelism, if non-zero, bounds the number of nodes that may
+	// concurrently execute the plan (see xform.Optimizer.SetMaxParallelism).
+	MaxParallelism int
+
 	// Locality specifies the location of the planning node as a set of user-
 	// defined key/value pairs, ordered from most inclusive to least inclusive.
 	// If there are no tiers, then the node's location is not known. Examples:
@@ -245,6 +277,11 @@ type Flags struct {
 
 	// QueryArgs are values for placeholders, used for assign-placeholders-*.
 	QueryArgs []string
+
+	// RestrictPlaceholderExploration is used with assign-placeholders-opt to
+	// only apply the exploration rules that are applied when a prepared memo is
+	// executed (see xform.Optimizer.RestrictExplorationForPlaceholders).
+	RestrictPlaceholderExploration bool
 }
 
 // New constructs a new instance of the OptTester for the given SQL statement.
@@ -274,6 +311,9 @@ func New(catalog cat.Catalog, sql string) *OptTester {
 	ot.evalCtx.SessionData().ReorderJoinsLimit = opt.DefaultJoinOrderLimit
 	ot.evalCtx.SessionData().InsertFastPath = true
 
+	// Apply the hint comment of the statement, if any.
+	ot.evalCtx.OptimizerHints = xform.ExtractHintComment(sql)
+
 	return ot
 }
 
@@ -400,6 +440,14 @@ func New(catalog cat.Catalog, sql string) *OptTester {
 //    check-size will result in a test error if the rule application or memo
 //    group count exceeds the corresponding limit.
 //
+//  - check-rule-order
+//
+//    Fully optimizes the given query several times, each time applying the
+//    exploration rules in a different random order, and results in a test
+//    error if the cost of the lowest cost plan differs from the cost when the
+//    rules are applied in their usual order. This catches rules that depend on
+//    the order in which rules are applied.
+//
 //  - index-candidates
 //
 //    Walks through the SQL statement to determine candidates for index
@@ -450,6 +498,26 @@ func New(catalog cat.Catalog, sql string) *OptTester {
 //    expression in the query tree for the purpose of creating alternate query
 //    plans in the optimizer.
 //
+//  - cost-model-version: used to set the version of the cost model used by
+//    the optimizer, e.g. cost-model-version=3. See xform.CostModelVersion.
+//
+//  - reorder-joins-search-budget: sets the reorder_joins_search_budget session
+//    setting, e.g. reorder-joins-search-budget=1s. Join trees with more joins
+//    than the join limit are searched for good orderings for up to this long.
+//
+//  - use-topk-enforcer: sets the optimizer_use_topk_enforcer session setting,
+//    which allows a TopKSort enforcer to provide the ordering required by a
+//    Limit.
+//
+//  - use-streaming-property: sets the optimizer_use_streaming_property session
+//    setting, which requires the input of a Limit to stream its rows.
+//
+//  - parallelism: used to set the number of parallel streams that the optimizer
+//    may consider executing expressions in, e.g. parallelism=8.
+//
+//  - max-parallelism: used to bound the number of nodes that may concurrently
+//    execute the plan, e.g. max-parallelism=4.
+//
 //  - locality: used to set the locality of the node that plans the query. This
 //    can affect costing when there are multiple possible indexes to choose
 //    from, each in different localities.
@@ -496,6 +564,10 @@ func New(catalog cat.Catalog, sql string) *OptTester {
 //  - group-limit: used with check-size to set a max limit on the number of
 //    groups that can be added to the memo before a testing error is returned.
 //
+//  - restrict-placeholder-exploration: used with assign-placeholders-opt to
+//    only apply the exploration rules that are applied after the placeholders
+//    of a prepared memo are assigned (see RestrictExplorationForPlaceholders).
+//
 func (ot *OptTester) RunCommand(tb testing.TB, d *datadriven.TestData) string {
 	// Allow testcases to override the flags.
 	for _, a := range d.CmdArgs {
@@ -508,11 +580,16 @@ func (ot *OptTester) RunCommand(tb testing.TB, d *datadriven.TestData) string {
 	ot.semaCtx.Placeholders = tree.PlaceholderInfo{}
 
 	ot.evalCtx.SessionData().ReorderJoinsLimit = int64(ot.Flags.JoinLimit)
+	ot.evalCtx.SessionData().ReorderJoinsSearchBudget = ot.Flags.ReorderJoinsSearchBudget
 	ot.evalCtx.SessionData().PreferLookupJoinsForFKs = ot.Flags.PreferLookupJoinsForFKs
 	ot.evalCtx.SessionData().PropagateInputOrdering = ot.Flags.PropagateInputOrdering
 	ot.evalCtx.SessionData().NullOrderedLast = ot.Flags.NullOrderedLast
 
+	ot.evalCtx.SessionData().OptimizerUseJoinLimitHints = ot.Flags.UseJoinLimitHints
 	ot.evalCtx.TestingKnobs.OptimizerCostPerturbation = ot.Flags.PerturbCost
+	ot.evalCtx.SessionData().OptimizerExploreApplyJoins = ot.Flags.ExploreApplyJoins
+	ot.evalCtx.SessionData().OptimizerUseTopKEnforcer = ot.Flags.UseTopKEnforcer
+	ot.evalCtx.SessionData().OptimizerUseStreamingProperty = ot.Flags.UseStreamingProperty
 	ot.evalCtx.Locality = ot.Flags.Locality
 	ot.evalCtx.SessionData().SaveTablesPrefix = ot.Flags.SaveTablesPrefix
 	ot.evalCtx.Placeholders = nil
@@ -727,6 +804,13 @@ func (ot *OptTester) RunCommand(tb testing.TB, d *datadriven.TestData) string {
 		}
 		return result
 
+	case "check-rule-order":
+		result, err := ot.CheckRuleOrder()
+		if err != nil {
+			d.Fatalf(tb, "%+v", err)
+		}
+		return result
+
 	case "index-candidates":
 		result, err := ot.IndexCandidates()
 		if err != nil {
@@ -880,6 +964,16 @@ func (f *Flags) Set(arg datadriven.CmdArg) error {
 		}
 		f.JoinLimit = int(limit)
 
+	case "reorder-joins-search-budget":
+		if len(arg.Vals) != 1 {
+			return fmt.Errorf("reorder-joins-search-budget requires a single argument")
+		}
+		budget, err := time.ParseDuration(arg.Vals[0])
+		if err != nil {
+			return errors.Wrap(err, "reorder-joins-search-budget")
+		}
+		f.ReorderJoinsSearchBudget = budget
+
 	case "prefer-lookup-joins-for-fks":
 		f.PreferLookupJoinsForFKs = true
 
@@ -889,6 +983,44 @@ func (f *Flags) Set(arg datadriven.CmdArg) error {
 		}
 		f.NullOrderedLast = true
 
+	case "join-limit-hints":
+		f.UseJoinLimitHints = true
+
+	case "explore-apply-joins":
+		f.ExploreApplyJoins = true
+
+	case "use-topk-enforcer":
+		f.UseTopKEnforcer = true
+
+	case "use-streaming-property":
+		f.UseStreamingProperty = true
+
+	case "parallelism":
+		if len(arg.Vals) != 1 {
+			return fmt.Errorf("parallelism requires a single argument")
+		}
+		parallelism, err := strconv.Atoi(arg.Vals[0])
+		if err != nil {
+			return errors.Wrap(err, "parallelism")
+		}
+		if parallelism < 0 {
+			return fmt.Errorf("parallelism must not be negative")
+		}
+		f.Parallelism = parallelism
+
+	case "max-parallelism":
+		if len(arg.Vals) != 1 {
+			return fmt.Errorf("max-parallelism requires a single argument")
+		}
+		maxParallelism, err := strconv.Atoi(arg.Vals[0])
+		if err != nil {
+			return errors.Wrap(err, "max-parallelism")
+		}
+		if maxParallelism < 0 {
+			return fmt.Errorf("max-parallelism must not be negative")
+		}
+		f.MaxParallelism = maxParallelism
+
 	case "rule":
 		if len(arg.Vals) != 1 {
 			return fmt.Errorf("rule requires one argument")
@@ -940,6 +1072,21 @@ func (f *Flags) Set(arg datadriven.CmdArg) error {
 			return err
 		}
 
+	case "cost-model-version":
+		if len(arg.Vals) != 1 {
+			return fmt.Errorf("cost-model-version requires one argument")
+		}
+		version, err := strconv.Atoi(arg.Vals[0])
+		if err != nil {
+			return err
+		}
+		settings := xform.DefaultCostModelSettings()
+		settings.Version = xform.CostModelVersion(version)
+		if err := settings.Validate(); err != nil {
+			return err
+		}
+		f.CostModelVersion = settings.Version
+
 	case "locality":
 		// Recombine multiple arguments, separated by commas.
 		locality := strings.Join(arg.Vals, ",")
@@ -1047,6 +1194,9 @@ func (f *Flags) Set(arg datadriven.CmdArg) error {
 	case "query-args":
 		f.QueryArgs = arg.Vals
 
+	case "restrict-placeholder-exploration":
+		f.RestrictPlaceholderExploration = true
+
 	case "propagate-input-ordering":
 		f.PropagateInputOrdering = true
 
@@ -1174,6 +1324,9 @@ func (ot *OptTester) AssignPlaceholders(
 	if err := o.Factory().AssignPlaceholders(prepMemo); err != nil {
 		return nil, err
 	}
+	if explore && ot.Flags.RestrictPlaceholderExploration {
+		o.RestrictExplorationForPlaceholders()
+	}
 	return o.Optimize()
 }
 
@@ -2024,6 +2177,50 @@ func (ot *OptTester) CheckSize() (string, error) {
 	return fmt.Sprintf("Rules Applied: %d\nGroups Added: %d\n", ruleApplications, groups), nil
 }
 
+// ruleOrderTrials is the number of random rule orders tried by CheckRuleOrder.
+const ruleOrderTrials = 10
+
+// CheckRuleOrder optimizes the query with the exploration rules applied in
+// their usual order, and then in ruleOrderTrials random orders, and returns an
+// error if the cost of the lowest cost plan is not the same for every order.
+// The random orders are seeded deterministically so that failures can be
+// reproduced.
+func (ot *OptTester) CheckRuleOrder() (string, error) {
+	optimize := func(scheduler xform.ExplorationScheduler) (opt.Expr, error) {
+		o := ot.makeOptimizer()
+		o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+			return !ot.Flags.DisableRules.Contains(int(ruleName))
+		})
+		if scheduler != nil {
+			o.SetExplorationScheduler(scheduler)
+		}
+		o.Factory().FoldingControl().AllowStableFolds()
+		return ot.optimizeExpr(o, nil)
+	}
+
+	expected, err := optimize(nil)
+	if err != nil {
+		return "", err
+	}
+	expectedCost := expected.(memo.RelExpr).Cost()
+	for seed := int64(1); seed <= ruleOrderTrials; seed++ {
+		actual, err := optimize(xform.NewRandomExplorationScheduler(seed))
+		if err != nil {
+			return "", errors.Wrapf(err, "rule order seed %d", seed)
+		}
+		// Allow for differences in floating point rounding when the costs of
+		// the same expressions are summed in a different order.
+		actualCost := actual.(memo.RelExpr).Cost()
+		if math.Abs(float64(actualCost-expectedCost)) > 1e-9*math.Abs(float64(expectedCost)) {
+			return "", errors.Errorf(
+				"rule order seed %d: expected cost %.2f, got %.2f:\n%s\nexpected:\n%s",
+				seed, expectedCost, actualCost, ot.FormatExpr(actual), ot.FormatExpr(expected),
+			)
+		}
+	}
+	return fmt.Sprintf("cost is invariant over %d rule orders\n", ruleOrderTrials), nil
+}
+
 // IndexCandidates is used with the index-candidates option. It finds index
 // candidates for the SQL statement and formats them as a sorted string.
 func (ot *OptTester) IndexCandidates() (string, error) {
@@ -2102,6 +2299,11 @@ func (ot *OptTester) buildExpr(factory *norm.Factory) error {
 	ot.semaCtx.Annotations = tree.MakeAnnotations(stmt.NumAnnotations)
 	ot.semaCtx.TypeResolver = ot.catalog
 	b := optbuilder.New(ot.ctx, &ot.semaCtx, &ot.evalCtx, ot.catalog, factory, stmt.AST)
+	hints, err := xform.ParseStatementHints(ot.evalCtx.OptimizerHints)
+	if err != nil {
+		return err
+	}
+	b.Barriers = hints.Barriers
 	return b.Build()
 }
 
@@ -2110,6 +2312,12 @@ func (ot *OptTester) buildExpr(factory *norm.Factory) error {
 func (ot *OptTester) makeOptimizer() *xform.Optimizer {
 	var o xform.Optimizer
 	o.Init(&ot.evalCtx, ot.catalog)
+	if ot.Flags.CostModelVersion != 0 {
+		settings := xform.MakeCostModelSettings(&ot.evalCtx.Settings.SV)
+		settings.Version = ot.Flags.CostModelVersion
+		o.SetCostModelSettings(settings)
+	}
+	o.SetParallelism(ot.Flags.Parallelism)
 	o.NotifyOnAppliedRule(func(ruleName opt.RuleName, source, target opt.Expr) {
 		// Exploration rules are marked as "applied" if they generate one or
 		// more new expressions.
@@ -2132,6 +2340,9 @@ func (ot *OptTester) optimizeExpr(
 	if tables != nil {
 		o.Memo().Metadata().UpdateTableMeta(tables)
 	}
+	if ot.Flags.MaxParallelism != 0 {
+		o.SetMaxParallelism(ot.Flags.MaxParallelism)
+	}
 	root, err := o.Optimize()
 	if err != nil {
 		return nil, err
@@ -2165,12 +2376,9 @@ func (ot *OptTester) indent(str string) {
 // ruleFromString returns the rule that matches the given string,
 // or InvalidRuleName if there is no such rule.
 func ruleFromString(str string) (opt.RuleName, error) {
-	for i := opt.RuleName(1); i < opt.NumRuleNames; i++ {
-		if i.String() == str {
-			return i, nil
-		}
+	if r, ok := opt.ParseRuleName(str); ok {
+		return r, nil
 	}
-
 	return opt.InvalidRuleName, fmt.Errorf("rule '%s' does not exist", str)
 }
 
@@ -11,13 +11,21 @@
 package opttester_test
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	opttestutils "github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/opttester"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/testcat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/datadriven"
 )
 
@@ -38,3 +46,122 @@ func TestOptTester(t *testing.T) {
 		})
 	})
 }
+
+// TestRuleFuzzer tests that the rule fuzzer checks each query that covers new
+// rules, and adds it to the corpus.
+func TestRuleFuzzer(t *testing.T) {
+	catalog := testcat.New()
+	if _, err := catalog.ExecuteDDL(
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c INT, INDEX (b), INDEX (c))",
+	); err != nil {
+		t.Fatal(err)
+	}
+	rnd, seed := randutil.NewTestRand()
+	corpus := []string{
+		"SELECT * FROM abc WHERE b = 1 AND c > 2",
+		"SELECT * FROM abc AS x JOIN abc AS y ON x.b = y.c WHERE x.a < 10 OR y.a > 20",
+	}
+	var checked int
+	f, err := opttester.NewRuleFuzzer(
+		catalog, rnd, corpus, nil, /* mutate */
+		func(sql string, disabled opttester.RuleSet) error {
+			if disabled.Empty() {
+				t.Errorf("expected newly covered rules for %q", sql)
+			}
+			checked++
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := f.Coverage().Len()
+	if failures := f.Run(100); len(failures) != 0 {
+		t.Fatalf("seed %d: unexpected failure for %q: %v", seed, failures[0].SQL, failures[0].Err)
+	}
+	if f.Coverage().Len() < before || len(f.Corpus()) != len(corpus)+checked {
+		t.Errorf("seed %d: corpus did not grow with coverage", seed)
+	}
+}
+
+// TestReplayBundle tests that a statement bundle is replayed with its schema
+// and session settings, and that the recorded rule decisions reproduce the
+// plan of the bundle.
+func TestReplayBundle(t *testing.T) {
+	const schema = "CREATE TABLE public.abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (c));"
+	const stmt = "SELECT * FROM abc WHERE c = 'foo'"
+	catalog := testcat.New()
+	if err := catalog.ExecuteMultipleDDL(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plan the statement as the server would when collecting a bundle, with
+	// the session settings of env.sql below, and with constrained scans
+	// disabled so that the recorded plan differs from the default one.
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	evalCtx.SessionData().ZigzagJoinEnabled = true
+	evalCtx.SessionData().OptimizerUseHistograms = true
+	evalCtx.SessionData().OptimizerUseMultiColStats = true
+	evalCtx.SessionData().LocalityOptimizedSearch = true
+	evalCtx.SessionData().ReorderJoinsLimit = opt.DefaultJoinOrderLimit
+	evalCtx.SessionData().InsertFastPath = true
+	var o xform.Optimizer
+	o.Init(&evalCtx, catalog)
+	o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+		return ruleName != opt.GenerateConstrainedScans
+	})
+	o.RecordRuleDecisions()
+	if err := opttestutils.BuildInitializedQuery(&o, catalog, stmt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	files := map[string]string{
+		"statement.sql": stmt,
+		"schema.sql":    schema,
+		"env.sql": `-- Version: CockroachDB CCL v21.2.0
+
+-- reorder_joins_limit has the default value: 8
+-- enable_zigzag_join has the default value: on
+SET optimizer_use_histograms = on;  -- default value: off
+-- optimizer_use_multicol_stats has the default value: on
+-- locality_optimized_partitioned_index_scan has the default value: on
+-- distsql has the default value: auto
+`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without the rule decisions, the local optimizer chooses its own plan.
+	replay, err := opttester.ReplayBundle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.ReplayedDecisions || !strings.HasPrefix(replay.Plan, "index-join") {
+		t.Errorf("expected an index join without replayed decisions, got:\n%s", replay.Plan)
+	}
+
+	// With the rule decisions, the recorded plan is reproduced.
+	decisions := o.RuleDecisions().String()
+	path := filepath.Join(dir, "rule-decisions.txt")
+	if err := ioutil.WriteFile(path, []byte(decisions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replay, err = opttester.ReplayBundle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replay.ReplayedDecisions || !strings.HasPrefix(replay.Plan, "select") {
+		t.Errorf("expected the recorded plan to be replayed, got:\n%s", replay.Plan)
+	}
+	if replay.Trace == nil || len(replay.Trace.Events) == 0 {
+		t.Error("expected the replay to be traced")
+	}
+}
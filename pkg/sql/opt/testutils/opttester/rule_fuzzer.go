@@ -0,0 +1,290 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package opttester
+
+import (
+	"math/rand"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree/treecmp"
+	"github.com/cockroachdb/errors"
+)
+
+// QueryMutator returns a variant of the given query. It returns ok=false if it
+// was unable to mutate the query.
+type QueryMutator func(rnd *rand.Rand, sql string) (_ string, ok bool)
+
+// EquivalenceChecker checks that the given query returns the same results when
+// the given rules are disabled as when all rules are enabled, and returns an
+// error describing the difference if not. It is supplied by the caller, since
+// checking results requires executing the query.
+type EquivalenceChecker func(sql string, disabled RuleSet) error
+
+// RuleFuzzFailure describes a query found by RuleFuzzer that either caused an
+// internal error during optimization, or that failed the equivalence check.
+type RuleFuzzFailure struct {
+	// SQL is the query that failed.
+	SQL string
+
+	// Rules is the set of rules that were applied while optimizing the query.
+	Rules RuleSet
+
+	// Err is the internal error or the error returned by the
+	// EquivalenceChecker.
+	Err error
+}
+
+// RuleFuzzer is a coverage-guided fuzzer which searches for queries that
+// exercise rarely applied optimizer rules. Starting from a corpus of queries,
+// it repeatedly mutates a query chosen from the corpus, optimizes the result,
+// and adds it to the corpus if it applied a rule, or a pair of exploration
+// rules, that no previous query applied. Queries which apply rare rules are
+// chosen for mutation more often.
+//
+// Each time a query reaches new coverage, it is passed to the
+// EquivalenceChecker (if any) with the newly covered rules disabled, so that
+// transformations that change the results of a query are detected.
+type RuleFuzzer struct {
+	catalog cat.Catalog
+	rnd     *rand.Rand
+	mutate  QueryMutator
+	check   EquivalenceChecker
+
+	// corpus contains the queries that reached new coverage, along with the
+	// rules they applied.
+	corpus []fuzzEntry
+
+	// ruleCounts counts the number of queries which applied each rule.
+	ruleCounts []int
+
+	// pairCounts counts the number of queries which applied each pair of
+	// exploration rules.
+	pairCounts map[[2]opt.RuleName]int
+}
+
+type fuzzEntry struct {
+	sql   string
+	rules RuleSet
+}
+
+// NewRuleFuzzer returns a RuleFuzzer that optimizes queries using the given
+// catalog, and starts from the given corpus of queries. If mutate is nil,
+// MutatePredicates is used. If check is nil, only internal errors are
+// reported.
+func NewRuleFuzzer(
+	catalog cat.Catalog,
+	rnd *rand.Rand,
+	corpus []string,
+	mutate QueryMutator,
+	check EquivalenceChecker,
+) (*RuleFuzzer, error) {
+	if mutate == nil {
+		mutate = MutatePredicates
+	}
+	f := &RuleFuzzer{
+		catalog:    catalog,
+		rnd:        rnd,
+		mutate:     mutate,
+		check:      check,
+		ruleCounts: make([]int, opt.NumRuleNames),
+		pairCounts: make(map[[2]opt.RuleName]int),
+	}
+	for _, sql := range corpus {
+		rules, err := f.optimize(sql)
+		if err != nil {
+			return nil, errors.Wrapf(err, "optimizing corpus query %q", sql)
+		}
+		f.addCoverage(rules)
+		f.corpus = append(f.corpus, fuzzEntry{sql: sql, rules: rules})
+	}
+	if len(f.corpus) == 0 {
+		return nil, errors.New("rule fuzzer requires a non-empty corpus")
+	}
+	return f, nil
+}
+
+// Run performs the given number of fuzzing iterations, and returns the queries
+// that failed.
+func (f *RuleFuzzer) Run(iterations int) []RuleFuzzFailure {
+	var failures []RuleFuzzFailure
+	for i := 0; i < iterations; i++ {
+		sql, ok := f.mutate(f.rnd, f.choose().sql)
+		if !ok {
+			continue
+		}
+		rules, err := f.optimize(sql)
+		if err != nil {
+			// Mutations frequently produce queries that are invalid, which are
+			// skipped. Only internal errors indicate a bug.
+			if errors.HasAssertionFailure(err) {
+				failures = append(failures, RuleFuzzFailure{SQL: sql, Rules: rules, Err: err})
+			}
+			continue
+		}
+		newRules := f.addCoverage(rules)
+		if newRules.Empty() {
+			continue
+		}
+		f.corpus = append(f.corpus, fuzzEntry{sql: sql, rules: rules})
+		if f.check != nil {
+			if err := f.check(sql, newRules); err != nil {
+				failures = append(failures, RuleFuzzFailure{SQL: sql, Rules: rules, Err: err})
+			}
+		}
+	}
+	return failures
+}
+
+// Corpus returns the queries in the corpus, including the queries that were
+// added because they reached new coverage.
+func (f *RuleFuzzer) Corpus() []string {
+	res := make([]string, len(f.corpus))
+	for i := range f.corpus {
+		res[i] = f.corpus[i].sql
+	}
+	return res
+}
+
+// Coverage returns the set of rules that were applied by at least one query in
+// the corpus.
+func (f *RuleFuzzer) Coverage() RuleSet {
+	var res RuleSet
+	for i, n := range f.ruleCounts {
+		if n > 0 {
+			res.Add(i)
+		}
+	}
+	return res
+}
+
+// optimize optimizes the given query, and returns the set of rules that were
+// applied.
+func (f *RuleFuzzer) optimize(sql string) (RuleSet, error) {
+	ot := New(f.catalog, sql)
+	_, err := ot.Optimize()
+	return ot.appliedRules, err
+}
+
+// addCoverage records that a query applied the given rules, and returns the
+// rules which are part of a rule or pair of exploration rules that had not been
+// applied by a previous query.
+func (f *RuleFuzzer) addCoverage(rules RuleSet) (newRules RuleSet) {
+	rules.ForEach(func(i int) {
+		if f.ruleCounts[i] == 0 {
+			newRules.Add(i)
+		}
+		f.ruleCounts[i]++
+		if !opt.RuleName(i).IsExplore() {
+			return
+		}
+		rules.ForEach(func(j int) {
+			if j <= i || !opt.RuleName(j).IsExplore() {
+				return
+			}
+			pair := [2]opt.RuleName{opt.RuleName(i), opt.RuleName(j)}
+			if f.pairCounts[pair] == 0 {
+				newRules.Add(i)
+				newRules.Add(j)
+			}
+			f.pairCounts[pair]++
+		})
+	})
+	return newRules
+}
+
+// choose returns a random entry from the corpus. Entries are weighted by the
+// rarity of the rules they applied, so that queries exercising rarely applied
+// rules are mutated more often.
+func (f *RuleFuzzer) choose() *fuzzEntry {
+	weights := make([]float64, len(f.corpus))
+	var total float64
+	for i := range f.corpus {
+		// Every entry has a small base weight so that entries which only apply
+		// common rules are still chosen occasionally.
+		weights[i] = 0.1
+		f.corpus[i].rules.ForEach(func(r int) {
+			weights[i] += 1 / float64(f.ruleCounts[r])
+		})
+		total += weights[i]
+	}
+	pick := f.rnd.Float64() * total
+	for i := range weights {
+		pick -= weights[i]
+		if pick <= 0 {
+			return &f.corpus[i]
+		}
+	}
+	return &f.corpus[len(f.corpus)-1]
+}
+
+// MutatePredicates is a QueryMutator which parses the given query and makes a
+// random change to one of its predicates: it either changes the operator of a
+// comparison, swaps an AND for an OR (or vice versa), or negates a predicate.
+func MutatePredicates(rnd *rand.Rand, sql string) (_ string, ok bool) {
+	stmt, err := parser.ParseOne(sql)
+	if err != nil {
+		return "", false
+	}
+
+	// Count the candidate expressions, then pick one of them to mutate.
+	var candidates int
+	isCandidate := func(expr tree.Expr) bool {
+		switch t := expr.(type) {
+		case *tree.ComparisonExpr:
+			return t.Operator.Symbol <= treecmp.NE
+		case *tree.AndExpr, *tree.OrExpr:
+			return true
+		}
+		return false
+	}
+	if _, err := tree.SimpleStmtVisit(stmt.AST, func(expr tree.Expr) (bool, tree.Expr, error) {
+		if isCandidate(expr) {
+			candidates++
+		}
+		return true, expr, nil
+	}); err != nil || candidates == 0 {
+		return "", false
+	}
+
+	target := rnd.Intn(candidates)
+	mutated, err := tree.SimpleStmtVisit(stmt.AST, func(expr tree.Expr) (bool, tree.Expr, error) {
+		if !isCandidate(expr) {
+			return true, expr, nil
+		}
+		target--
+		if target != -1 {
+			return true, expr, nil
+		}
+		if rnd.Intn(3) == 0 {
+			return false, &tree.NotExpr{Expr: &tree.ParenExpr{Expr: expr}}, nil
+		}
+		switch t := expr.(type) {
+		case *tree.ComparisonExpr:
+			cmp := *t
+			cmp.Operator = treecmp.MakeComparisonOperator(
+				treecmp.ComparisonOperatorSymbol(rnd.Intn(int(treecmp.NE) + 1)),
+			)
+			return false, &cmp, nil
+		case *tree.AndExpr:
+			return false, &tree.OrExpr{Left: t.Left, Right: t.Right}, nil
+		case *tree.OrExpr:
+			return false, &tree.AndExpr{Left: t.Left, Right: t.Right}, nil
+		}
+		return true, expr, nil
+	})
+	if err != nil {
+		return "", false
+	}
+	return tree.AsString(mutated), true
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package testcat
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/errors"
+)
+
+// Split is a partial implementation of the ALTER TABLE/INDEX ... SPLIT AT
+// statement. Only SPLIT AT VALUES is supported. Each split point adds a new
+// range to the index. The test catalog assumes that the ranges have been
+// scattered, so that each range's lease is held by a different node.
+func (tc *Catalog) Split(stmt *tree.Split) {
+	// Update the table name to include catalog and schema if not provided.
+	tabName := stmt.TableOrIndex.Table
+	tc.qualifyTableName(&tabName)
+	tab := tc.Table(&tabName)
+
+	var index *Index
+	if stmt.TableOrIndex.Index == "" {
+		// The split is in the primary index.
+		index = tab.Indexes[0]
+	} else {
+		for _, idx := range tab.Indexes {
+			if idx.IdxName == string(stmt.TableOrIndex.Index) {
+				index = idx
+				break
+			}
+		}
+	}
+	if index == nil {
+		panic(fmt.Errorf("\"%q\" is not an index", stmt.TableOrIndex.Index))
+	}
+
+	values, ok := stmt.Rows.Select.(*tree.ValuesClause)
+	if !ok {
+		panic(errors.AssertionFailedf("only SPLIT AT VALUES is supported"))
+	}
+
+	if !index.rangeDist.Known() {
+		index.rangeDist.RangeCount = 1
+	}
+	index.rangeDist.RangeCount += len(values.Rows)
+	index.rangeDist.LeaseholderCount = index.rangeDist.RangeCount
+}
@@ -405,6 +405,10 @@ func (tc *Catalog) ExecuteDDLWithIndexVersion(
 		tc.SetZoneConfig(stmt)
 		return "", nil
 
+	case *tree.Split:
+		tc.Split(stmt)
+		return "", nil
+
 	case *tree.ShowCreate:
 		tn := stmt.Name.ToTableName()
 		ds, _, err := tc.ResolveDataSource(context.Background(), cat.Flags{}, &tn)
@@ -868,6 +872,10 @@ type Index struct {
 
 	// version is the index descriptor version of the index.
 	version descpb.IndexDescriptorVersion
+
+	// rangeDist is the range distribution of the index. It is only known if the
+	// index has been split with ALTER ... SPLIT AT.
+	rangeDist cat.RangeDistribution
 }
 
 // ID is part of the cat.Index interface.
@@ -983,6 +991,11 @@ func (ti *Index) Partition(i int) cat.Partition {
 	return &ti.partitions[i]
 }
 
+// RangeDistribution is part of the cat.Index interface.
+func (ti *Index) RangeDistribution() cat.RangeDistribution {
+	return ti.rangeDist
+}
+
 // Partition implements the cat.Partition interface for testing purposes.
 type Partition struct {
 	name   string
@@ -0,0 +1,170 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// groupStatePageSize is the number of groupState structs in each page
+// allocated by optimizerArena.
+const groupStatePageSize = 64
+
+// enforcerPageSize is the number of enforcers of each type in each page
+// allocated by optimizerArena.
+const enforcerPageSize = 16
+
+// maxRetainedGroupStates is the maximum number of groupState structs, and
+// slots of the stateTable, that are retained for reuse when the optimizer is
+// re-initialized. Larger allocations are released, so that a single complex
+// query does not inflate the memory held by an idle optimizer.
+const maxRetainedGroupStates = 4096
+
+// optimizerArena allocates the transient state of an optimization in pages,
+// rather than individually on the heap, in order to reduce the number of
+// allocations and the pressure on the garbage collector when many queries are
+// planned. It is owned by an Optimizer, and is reset when the optimizer is
+// re-initialized.
+//
+// Pages of groupState structs are reused after a reset, since a groupState is
+// never referenced once the optimizer that allocated it is re-initialized.
+// Enforcers, on the other hand, can become part of the lowest cost tree, which
+// outlives the optimizer if its memo is detached, so their pages are discarded
+// by reset rather than reused. The required physical properties are not
+// allocated by the arena at all, since they are interned by the memo and
+// referenced by the lowest cost tree.
+type optimizerArena struct {
+	// states contains the pages of groupState structs. The structs before
+	// next in the page at index page have been allocated since the last reset.
+	states [][]groupState
+	page   int
+	next   int
+
+	sorts       []memo.SortExpr
+	topKSorts   []memo.TopKSortExpr
+	distributes []memo.DistributeExpr
+	gathers     []memo.GatherExpr
+}
+
+// reset makes all the groupState structs in the arena available for reuse,
+// and discards the pages of enforcers.
+func (a *optimizerArena) reset() {
+	// Clear the structs that were allocated, so that they do not keep the
+	// expressions of the previous memo alive, and are empty when reused.
+	for i := 0; i <= a.page && i < len(a.states); i++ {
+		page := a.states[i]
+		if i == a.page {
+			page = page[:a.next]
+		}
+		for j := range page {
+			page[j] = groupState{}
+		}
+	}
+	states := a.states
+	if len(states) > maxRetainedGroupStates/groupStatePageSize {
+		states = states[:maxRetainedGroupStates/groupStatePageSize]
+	}
+	*a = optimizerArena{states: states}
+}
+
+// allocateState returns a pointer to a new, empty groupState struct. The
+// pointer is stable, meaning that its location won't change as other
+// groupState structs are allocated.
+func (a *optimizerArena) allocateState() *groupState {
+	if a.page < len(a.states) && a.next == groupStatePageSize {
+		a.page++
+		a.next = 0
+	}
+	if a.page == len(a.states) {
+		a.states = append(a.states, make([]groupState, groupStatePageSize))
+	}
+	state := &a.states[a.page][a.next]
+	a.next++
+	return state
+}
+
+// newSort returns a new Sort enforcer with the given input.
+func (a *optimizerArena) newSort(input memo.RelExpr) *memo.SortExpr {
+	if len(a.sorts) == 0 {
+		a.sorts = make([]memo.SortExpr, enforcerPageSize)
+	}
+	e := &a.sorts[0]
+	a.sorts = a.sorts[1:]
+	e.Input = input
+	return e
+}
+
+// newTopKSort returns a new TopKSort enforcer with the given input and limit.
+func (a *optimizerArena) newTopKSort(input memo.RelExpr, k int64) *memo.TopKSortExpr {
+	if len(a.topKSorts) == 0 {
+		a.topKSorts = make([]memo.TopKSortExpr, enforcerPageSize)
+	}
+	e := &a.topKSorts[0]
+	a.topKSorts = a.topKSorts[1:]
+	e.Input = input
+	e.K = k
+	return e
+}
+
+// newDistribute returns a new Distribute enforcer with the given input.
+func (a *optimizerArena) newDistribute(input memo.RelExpr) *memo.DistributeExpr {
+	if len(a.distributes) == 0 {
+		a.distributes = make([]memo.DistributeExpr, enforcerPageSize)
+	}
+	e := &a.distributes[0]
+	a.distributes = a.distributes[1:]
+	e.Input = input
+	return e
+}
+
+// newGather returns a new, empty Gather enforcer.
+func (a *optimizerArena) newGather() *memo.GatherExpr {
+	if len(a.gathers) == 0 {
+		a.gathers = make([]memo.GatherExpr, enforcerPageSize)
+	}
+	e := &a.gathers[0]
+	a.gathers = a.gathers[1:]
+	return e
+}
+
+var optimizerPool = sync.Pool{
+	New: func() interface{} {
+		return &Optimizer{}
+	},
+}
+
+// NewPooledOptimizer returns an initialized Optimizer from a pool of
+// optimizers, whose memo and arena are reused, rather than allocated, where
+// possible. Release must be called once the optimizer is no longer needed.
+func NewPooledOptimizer(evalCtx *tree.EvalContext, catalog cat.Catalog) *Optimizer {
+	o := optimizerPool.Get().(*Optimizer)
+	o.Init(evalCtx, catalog)
+	return o
+}
+
+// Release returns an optimizer allocated by NewPooledOptimizer to the pool.
+// The optimizer's memo is reused by the next optimizer taken from the pool, so
+// neither the memo nor the expressions in it can be used after Release is
+// called, unless the memo was first detached with DetachMemo.
+func (o *Optimizer) Release() {
+	o.arena.reset()
+	o.stateTable.reset(maxRetainedGroupStates)
+	*o = Optimizer{
+		f:          o.f,
+		stateTable: o.stateTable,
+		arena:      o.arena,
+	}
+	optimizerPool.Put(o)
+}
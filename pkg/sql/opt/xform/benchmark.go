@@ -0,0 +1,198 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// BenchmarkQuery is a named query in the corpus of a PlanningBenchmark.
+type BenchmarkQuery struct {
+	// Name identifies the query in the output of the benchmark. It should be
+	// stable across releases, so that the results can be compared.
+	Name string
+
+	// SQL is the query to plan.
+	SQL string
+}
+
+// BenchmarkBuildFunc builds the given SQL statement into the memo of the given
+// optimizer, which has already been initialized with the catalog and eval
+// context of the benchmark. It is provided by the caller of PlanningBenchmark,
+// since xform cannot depend on the parser and optbuilder. See
+// testutils.BuildInitializedQuery.
+type BenchmarkBuildFunc func(o *Optimizer, catalog cat.Catalog, sql string) error
+
+// PlanningBenchmark builds and optimizes each query in a corpus repeatedly,
+// and reports the time spent in each phase of planning, the allocations, the
+// size of the memo and the number of rules applied. It is intended to track
+// the performance of the planner across releases, e.g. by running it against
+// a fixed corpus and comparing the output with benchstat.
+type PlanningBenchmark struct {
+	// Catalog is the catalog against which the queries are built.
+	Catalog cat.Catalog
+
+	// EvalCtx is the eval context with which the optimizer is initialized.
+	EvalCtx *tree.EvalContext
+
+	// Build builds each query into the memo of the optimizer.
+	Build BenchmarkBuildFunc
+
+	// Queries is the corpus of queries to plan.
+	Queries []BenchmarkQuery
+
+	// Iterations is the number of times each query is planned. If it is zero,
+	// each query is planned once.
+	Iterations int
+}
+
+// BenchmarkResult describes the planning of one query of a PlanningBenchmark.
+// Timings, allocations and rule counts are averaged over the iterations.
+type BenchmarkResult struct {
+	// Name is the name of the query.
+	Name string
+
+	// Iterations is the number of times the query was planned.
+	Iterations int
+
+	// Time is the wall time spent building and optimizing the query.
+	Time time.Duration
+
+	// NormalizeTime, ExploreTime, CostTime and SetLowestCostTreeTime are the
+	// wall times spent in each phase of planning, as reported by Metrics. The
+	// normalization phase includes the time taken by BenchmarkBuildFunc, such as
+	// the time to parse the query.
+	NormalizeTime         time.Duration
+	ExploreTime           time.Duration
+	CostTime              time.Duration
+	SetLowestCostTreeTime time.Duration
+
+	// Allocs and AllocBytes are the number of heap allocations and the number of
+	// bytes allocated.
+	Allocs     int64
+	AllocBytes int64
+
+	// Groups and Exprs are the number of groups and member expressions of the
+	// optimized memo that are reachable from the root. They are the same for
+	// each iteration.
+	Groups int
+	Exprs  int
+
+	// NormRulesApplied and ExploreRulesApplied are the number of normalization
+	// and exploration rules that were applied.
+	NormRulesApplied    int64
+	ExploreRulesApplied int64
+}
+
+// Run plans each query of the benchmark, and returns a result for each query,
+// in the order of the corpus. It returns an error if any query fails to build
+// or optimize.
+func (b *PlanningBenchmark) Run() ([]BenchmarkResult, error) {
+	iterations := b.Iterations
+	if iterations <= 0 {
+		iterations = 1
+	}
+	results := make([]BenchmarkResult, len(b.Queries))
+	var o Optimizer
+	for i, q := range b.Queries {
+		res := &results[i]
+		res.Name = q.Name
+		res.Iterations = iterations
+
+		var normRules, exploreRules int64
+		countApplied := func(ruleName opt.RuleName, source, target opt.Expr) {
+			if ruleName.IsExplore() {
+				exploreRules++
+			} else {
+				normRules++
+			}
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		start := timeutil.Now()
+		for n := 0; n < iterations; n++ {
+			o.Init(b.EvalCtx, b.Catalog)
+			o.NotifyOnAppliedRule(countApplied)
+			o.Factory().NotifyOnAppliedRule(countApplied)
+			if err := b.Build(&o, b.Catalog, q.SQL); err != nil {
+				return nil, errors.Wrapf(err, "building query %s", q.Name)
+			}
+			if _, err := o.Optimize(); err != nil {
+				return nil, errors.Wrapf(err, "optimizing query %s", q.Name)
+			}
+			metrics := o.Metrics()
+			res.NormalizeTime += metrics.NormalizeTime
+			res.ExploreTime += metrics.ExploreTime
+			res.CostTime += metrics.CostTime
+			res.SetLowestCostTreeTime += metrics.SetLowestCostTreeTime
+			res.Groups, res.Exprs = metrics.Groups, metrics.Exprs
+		}
+		res.Time = timeutil.Since(start)
+		runtime.ReadMemStats(&after)
+
+		n := int64(iterations)
+		res.Time /= time.Duration(n)
+		res.NormalizeTime /= time.Duration(n)
+		res.ExploreTime /= time.Duration(n)
+		res.CostTime /= time.Duration(n)
+		res.SetLowestCostTreeTime /= time.Duration(n)
+		res.Allocs = int64(after.Mallocs-before.Mallocs) / n
+		res.AllocBytes = int64(after.TotalAlloc-before.TotalAlloc) / n
+		res.NormRulesApplied = normRules / n
+		res.ExploreRulesApplied = exploreRules / n
+	}
+	return results, nil
+}
+
+// String formats the result as a line in the format of Go benchmarks, so that
+// the results of different releases can be compared using benchstat. The
+// format is stable: new measurements are only added at the end of the line.
+// For example:
+//
+//   BenchmarkPlanning/q1 100 81234 ns/op 31021 normalize-ns/op ...
+//
+func (r BenchmarkResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BenchmarkPlanning/%s %d", strings.Join(strings.Fields(r.Name), "_"), r.Iterations)
+	fmt.Fprintf(&b, " %d ns/op", r.Time.Nanoseconds())
+	fmt.Fprintf(&b, " %d normalize-ns/op", r.NormalizeTime.Nanoseconds())
+	fmt.Fprintf(&b, " %d explore-ns/op", r.ExploreTime.Nanoseconds())
+	fmt.Fprintf(&b, " %d cost-ns/op", r.CostTime.Nanoseconds())
+	fmt.Fprintf(&b, " %d set-lowest-cost-tree-ns/op", r.SetLowestCostTreeTime.Nanoseconds())
+	fmt.Fprintf(&b, " %d B/op", r.AllocBytes)
+	fmt.Fprintf(&b, " %d allocs/op", r.Allocs)
+	fmt.Fprintf(&b, " %d memo-groups", r.Groups)
+	fmt.Fprintf(&b, " %d memo-exprs", r.Exprs)
+	fmt.Fprintf(&b, " %d norm-rules/op", r.NormRulesApplied)
+	fmt.Fprintf(&b, " %d explore-rules/op", r.ExploreRulesApplied)
+	return b.String()
+}
+
+// FormatBenchmarkResults formats the given results with one line per query, as
+// described by BenchmarkResult.String.
+func FormatBenchmarkResults(results []BenchmarkResult) string {
+	var b strings.Builder
+	for i := range results {
+		b.WriteString(results[i].String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestPlanningBenchmark tests that a planning benchmark measures the time,
+// memo size, allocations and applied rules of each query.
+func TestPlanningBenchmark(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t,
+		abcDDL,
+		xyzDDL,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	b := xform.PlanningBenchmark{
+		Catalog: catalog,
+		EvalCtx: &evalCtx,
+		Build:   testutils.BuildInitializedQuery,
+		Queries: []xform.BenchmarkQuery{
+			{Name: "scan", SQL: "SELECT * FROM abc WHERE c = 'foo'"},
+			{Name: "join", SQL: "SELECT * FROM abc JOIN xyz ON a = y WHERE b > 1 + 1"},
+		},
+		Iterations: 3,
+	}
+	results, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(b.Queries) {
+		t.Fatalf("expected %d results, got %d", len(b.Queries), len(results))
+	}
+	for i, res := range results {
+		if res.Name != b.Queries[i].Name || res.Iterations != 3 {
+			t.Errorf("unexpected result for query %s: %+v", b.Queries[i].Name, res)
+		}
+		if res.Time <= 0 || res.Groups == 0 || res.Exprs < res.Groups || res.Allocs == 0 {
+			t.Errorf("expected non-zero measurements for query %s: %+v", res.Name, res)
+		}
+		if res.ExploreRulesApplied == 0 {
+			t.Errorf("expected exploration rules to be applied for query %s", res.Name)
+		}
+	}
+	if results[1].NormRulesApplied == 0 {
+		t.Errorf("expected normalization rules to be applied for the join")
+	}
+
+	out := xform.FormatBenchmarkResults(results)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "BenchmarkPlanning/scan 3 ") ||
+		!strings.Contains(lines[1], " allocs/op ") || !strings.HasSuffix(lines[1], " explore-rules/op") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	b.Queries = append(b.Queries, xform.BenchmarkQuery{Name: "bad", SQL: "SELECT * FROM missing"})
+	if _, err := b.Run(); err == nil || !strings.Contains(err.Error(), "building query bad") {
+		t.Errorf("expected an error building the bad query, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import "github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+
+// CardinalityEstimator estimates the number of rows returned by relational
+// expressions. The default coster consults it for every row count on which a
+// cost depends, so that alternative estimators, such as ones based on sketches
+// or learned models, can be evaluated without changing the cost model or the
+// statistics that are derived for the memo.
+type CardinalityEstimator interface {
+	// EstimateRowCount returns the estimated number of rows returned by the
+	// given expression. The row count is a logical property, so the estimate
+	// should be the same for every expression in a memo group. It must not be
+	// negative.
+	EstimateRowCount(e memo.RelExpr) float64
+}
+
+// DefaultCardinalityEstimator is the CardinalityEstimator used by the default
+// coster unless it is overridden with a call to SetCardinalityEstimator. It
+// returns the row count derived from table statistics by the memo's
+// statistics builder.
+var DefaultCardinalityEstimator CardinalityEstimator = statsCardinalityEstimator{}
+
+type statsCardinalityEstimator struct{}
+
+// EstimateRowCount is part of the CardinalityEstimator interface.
+func (statsCardinalityEstimator) EstimateRowCount(e memo.RelExpr) float64 {
+	return e.Relational().Stats.RowCount
+}
+
+// CardinalityEstimator returns the estimator consulted by the default coster.
+func (o *Optimizer) CardinalityEstimator() CardinalityEstimator {
+	return o.defaultCoster.estimator
+}
+
+// SetCardinalityEstimator overrides the estimator consulted by the default
+// coster. If estimator is nil, DefaultCardinalityEstimator is restored. Costers
+// set via SetCoster are not affected, although they may wrap the default
+// coster. SetCardinalityEstimator must be called before Optimize.
+func (o *Optimizer) SetCardinalityEstimator(estimator CardinalityEstimator) {
+	if estimator == nil {
+		estimator = DefaultCardinalityEstimator
+	}
+	o.defaultCoster.estimator = estimator
+	o.defaultCoster.uncertainties = nil
+}
+
+// rowCount returns the estimated number of rows returned by the given
+// expression, according to the coster's CardinalityEstimator. The row count of
+// the group whose members are costed by ComputeCosts is only estimated once.
+func (c *coster) rowCount(e memo.RelExpr) float64 {
+	if c.batch.group != nil && e.FirstExpr() == c.batch.group {
+		return c.batch.rowCount
+	}
+	return c.estimator.EstimateRowCount(e)
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// MaxPlanCostSetting is the default cost ceiling of the optimizer, or zero if
+// there is none. See SetCostCeiling.
+var MaxPlanCostSetting = settings.RegisterFloatSetting(
+	settings.TenantWritable,
+	"sql.optimizer.max_plan_cost",
+	"if positive, statements whose lowest cost plan has a higher estimated cost are "+
+		"rejected with a \"query too expensive\" error before they are executed",
+	0,
+	settings.NonNegativeFloat,
+)
+
+// SetCostCeiling causes Optimize to fail with a CostCeilingExceededError if the
+// estimated cost of the lowest cost plan is higher than the given ceiling,
+// rather than returning a plan that is too expensive to execute. It overrides
+// the ceiling taken from the sql.optimizer.max_plan_cost cluster setting. A
+// ceiling of zero removes the ceiling. SetCostCeiling must be called before
+// Optimize.
+//
+// While the memo is optimized, a candidate is abandoned as soon as the cost of
+// its children exceeds the ceiling, since no plan that contains it can be
+// executed, so that work is not wasted costing the rest of a hopeless plan.
+// The ceiling is not enforced for a plan that violates a hint or a plan
+// baseline, which is given a huge cost rather than an estimated one.
+func (o *Optimizer) SetCostCeiling(ceiling float64) {
+	if ceiling < 0 {
+		panic(errors.AssertionFailedf("negative cost ceiling: %v", ceiling))
+	}
+	o.costCeiling = memo.Cost(ceiling)
+}
+
+// exceedsCostCeiling returns true if there is a cost ceiling, and the given
+// partial cost of a candidate is higher than the ceiling. Candidates are only
+// abandoned if the group state already has a best expression, so that the
+// group can still be costed, and if the optimizer does not retain the top K
+// candidates of each group.
+func (o *Optimizer) exceedsCostCeiling(state *groupState, cost memo.Cost) bool {
+	if o.costCeiling == 0 || o.topK > 0 {
+		return false
+	}
+	return state.best != nil && o.costCeiling.Less(cost)
+}
+
+// checkCostCeiling returns a CostCeilingExceededError if there is a cost
+// ceiling, and the cost of the lowest cost plan for the given root exceeds it.
+func (o *Optimizer) checkCostCeiling(root memo.RelExpr, cost memo.Cost) error {
+	if o.costCeiling == 0 {
+		return nil
+	}
+	return CheckPlanCost(root.Op(), cost, float64(o.costCeiling))
+}
+
+// CheckPlanCost returns a CostCeilingExceededError if the given ceiling is
+// positive, and the given estimated cost of a plan with the given root
+// operator exceeds it. It is used to enforce the ceiling for plans that were
+// optimized before the ceiling was set, e.g. plans in the query cache.
+func CheckPlanCost(op opt.Operator, cost memo.Cost, ceiling float64) error {
+	if ceiling <= 0 || cost >= hugeCost || !memo.Cost(ceiling).Less(cost) {
+		return nil
+	}
+	return NewOptimizationError(CostCeilingExceededError, op, opt.InvalidRuleName,
+		pgerror.Newf(pgcode.ProgramLimitExceeded,
+			"query too expensive: estimated cost %.2f exceeds the maximum plan cost %.2f",
+			float64(cost), ceiling,
+		),
+	)
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// EnableCostDistribution causes Optimize to record the cost of every complete
+// alternative that is costed for the root group with the required properties
+// of the root, including enforcers such as a Sort that provides the required
+// ordering. The distribution of the costs can be retrieved via
+// CostDistribution once optimization is complete. It shows whether the
+// optimizer chose among meaningfully different plans, or whether exploration
+// only produced alternatives with nearly identical costs.
+func (o *Optimizer) EnableCostDistribution() {
+	o.costDistribution = &costDistributionRecorder{}
+}
+
+// CostDistribution returns the costs of the alternatives recorded for the root
+// group, or nil if EnableCostDistribution was not called. It must be called
+// after Optimize.
+func (o *Optimizer) CostDistribution() *CostDistribution {
+	r := o.costDistribution
+	if r == nil || r.root == nil {
+		return nil
+	}
+	d := &CostDistribution{Chosen: r.root.cost}
+	for i := range r.candidates {
+		if r.candidates[i].cost < hugeCost {
+			d.Costs = append(d.Costs, r.candidates[i].cost)
+		}
+	}
+	sort.Slice(d.Costs, func(i, j int) bool { return d.Costs[i] < d.Costs[j] })
+	return d
+}
+
+// costDistributionRecorder records the candidates that are costed for the root
+// group. It reuses topKCandidate, since it must also replace the cost of a
+// candidate each time it is costed again.
+type costDistributionRecorder struct {
+	// root is the state of the root group with the required properties of the
+	// root.
+	root *groupState
+
+	// candidates contains the latest cost of each candidate for the root.
+	candidates []topKCandidate
+}
+
+// recordCost records the cost of a candidate for the given group state, if it
+// is the state of the root.
+func (r *costDistributionRecorder) recordCost(
+	state *groupState, candidate memo.RelExpr, cost memo.Cost,
+) {
+	if state != r.root {
+		return
+	}
+	for i := range r.candidates {
+		if sameCandidate(r.candidates[i].expr, candidate) {
+			r.candidates[i] = topKCandidate{expr: candidate, cost: cost}
+			return
+		}
+	}
+	r.candidates = append(r.candidates, topKCandidate{expr: candidate, cost: cost})
+}
+
+// CostDistribution describes the costs of the complete alternatives that were
+// considered for the root of a query. Alternatives that were prevented by a
+// hint or plan baseline are excluded.
+type CostDistribution struct {
+	// Costs contains the cost of each alternative, in increasing order.
+	Costs []memo.Cost
+
+	// Chosen is the cost of the chosen plan.
+	Chosen memo.Cost
+}
+
+// Min returns the lowest cost of any alternative, or zero if there are none.
+func (d *CostDistribution) Min() memo.Cost {
+	if len(d.Costs) == 0 {
+		return 0
+	}
+	return d.Costs[0]
+}
+
+// Max returns the highest cost of any alternative, or zero if there are none.
+func (d *CostDistribution) Max() memo.Cost {
+	if len(d.Costs) == 0 {
+		return 0
+	}
+	return d.Costs[len(d.Costs)-1]
+}
+
+// ChosenPercentile returns the percentage of alternatives whose cost is lower
+// than the cost of the chosen plan. It is zero when the cheapest alternative
+// was chosen, and is only higher when the optimizer deliberately chose a more
+// expensive plan, e.g. to keep a previous plan or to avoid a risky one.
+func (d *CostDistribution) ChosenPercentile() float64 {
+	if len(d.Costs) == 0 {
+		return 0
+	}
+	lower := 0
+	for _, c := range d.Costs {
+		if c.Less(d.Chosen) {
+			lower++
+		}
+	}
+	return 100 * float64(lower) / float64(len(d.Costs))
+}
+
+// WithinFactor returns the number of alternatives whose cost is no more than
+// the given factor of the lowest cost. For example, a factor of 1.01 counts
+// the alternatives that are within 1% of the cheapest, which are effectively
+// indistinguishable to the coster.
+func (d *CostDistribution) WithinFactor(factor float64) int {
+	limit := float64(d.Min()) * factor
+	n := 0
+	for _, c := range d.Costs {
+		if float64(c) <= limit {
+			n++
+		}
+	}
+	return n
+}
+
+// Histogram divides the range between the lowest and highest cost into the
+// given number of buckets of equal width, and returns the number of
+// alternatives in each bucket. If all alternatives have the same cost, they
+// are all counted in the first bucket.
+func (d *CostDistribution) Histogram(buckets int) []int {
+	if buckets < 1 {
+		return nil
+	}
+	counts := make([]int, buckets)
+	min, width := float64(d.Min()), float64(d.Max()-d.Min())/float64(buckets)
+	for _, c := range d.Costs {
+		b := 0
+		if width > 0 {
+			b = int((float64(c) - min) / width)
+		}
+		if b >= buckets {
+			b = buckets - 1
+		}
+		counts[b]++
+	}
+	return counts
+}
+
+// String returns a summary of the distribution, with a histogram of ten
+// buckets.
+func (d *CostDistribution) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "alternatives: %d\n", len(d.Costs))
+	if len(d.Costs) == 0 {
+		return buf.String()
+	}
+	fmt.Fprintf(&buf, "min: %.2f\n", d.Min())
+	fmt.Fprintf(&buf, "max: %.2f\n", d.Max())
+	fmt.Fprintf(&buf, "chosen: %.2f (p%.0f)\n", d.Chosen, d.ChosenPercentile())
+	fmt.Fprintf(&buf, "within 1%% of min: %d\n", d.WithinFactor(1.01))
+	const buckets = 10
+	width := float64(d.Max()-d.Min()) / buckets
+	for i, count := range d.Histogram(buckets) {
+		if count == 0 {
+			continue
+		}
+		lo := float64(d.Min()) + float64(i)*width
+		fmt.Fprintf(&buf, "  [%.2f, %.2f]: %d\n", lo, lo+width, count)
+	}
+	return buf.String()
+}
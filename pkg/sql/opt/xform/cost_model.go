@@ -0,0 +1,231 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/errors"
+)
+
+// CostModelVersion identifies a version of the formulas used by the default
+// coster. A change to the cost model that is expected to change plans is
+// introduced as a new version, rather than by changing the formulas of an
+// existing version, so that it can be evaluated against the current version
+// in production before it is enabled (see Optimizer.SetShadowCostModel).
+type CostModelVersion int
+
+const (
+	// CostModelV1 is the cost model as it was originally tuned.
+	CostModelV1 CostModelVersion = 1 + iota
+
+	// CostModelV2 also estimates the memory footprint of the rows buffered by
+	// operators such as sorts and hash joins, and charges for the rows that
+	// spill to disk beyond the work mem limit, as if the
+	// optimizer_use_workmem_costing session setting were always true.
+	CostModelV2
+
+	// CostModelV3 also charges Insert, Update, Upsert, and Delete operators for
+	// the KV writes of each index entry that they touch, taking the estimated
+	// conflict rate of an Upsert into account (see coster.computeMutationCost).
+	CostModelV3
+
+	// CostModelV4 also charges locking scans for each row that they lock, and
+	// more for rows locked in reverse index order (see coster.computeScanCost).
+	CostModelV4
+
+	// LatestCostModelVersion is the most recent version of the cost model.
+	LatestCostModelVersion = CostModelV4
+)
+
+// CostModelSettings contains the base cost factors used by the default coster.
+// All other costs are derived from them, so the cost model can be calibrated
+// for the hardware of a particular cluster by changing only these values. For
+// example, a cluster on fast NVMe drives may lower RandIOCostFactor towards
+// SeqIOCostFactor, and a cluster with a slow network may raise
+// NetworkCostFactor.
+//
+// The settings are usually taken from the cluster settings (see
+// MakeCostModelSettings), but they can also be populated from a calibration
+// run and passed to Optimizer.SetCostModelSettings.
+type CostModelSettings struct {
+	// CPUCostFactor is the cost of processing a single row or column value in
+	// memory.
+	CPUCostFactor float64
+
+	// SeqIOCostFactor is the cost of reading a single row sequentially from
+	// storage.
+	SeqIOCostFactor float64
+
+	// RandIOCostFactor is the cost of seeking to a new key in storage.
+	RandIOCostFactor float64
+
+	// NetworkCostFactor scales the costs of operations that require network
+	// round trips or transfers, such as contacting remote leaseholders or
+	// exchanging rows between parallel streams.
+	NetworkCostFactor float64
+
+	// VectorizedCostFactor scales the cost of operators that are expected to
+	// run natively in the vectorized execution engine, relative to the cost of
+	// running them row by row. A value of 1 means that vectorized execution is
+	// not taken into account. See coster.vectorizedCostMultiplier.
+	VectorizedCostFactor float64
+
+	// RemoteLatencyCostFactor is the cost of a round trip to a node in a
+	// different locality than the gateway. It is charged to scans and lookup
+	// joins of indexes whose zone constraints and lease preferences do not
+	// match the gateway's locality, so that indexes that are likely to be local,
+	// such as duplicate indexes pinned to the gateway's region, are preferred.
+	// A value of 0 means that the latency of round trips is not modeled.
+	RemoteLatencyCostFactor float64
+
+	// Version is the version of the formulas that combine the cost factors.
+	// The zero value is equivalent to CostModelV1.
+	Version CostModelVersion
+}
+
+// DefaultCostModelSettings returns the settings that the cost model was
+// originally tuned with.
+func DefaultCostModelSettings() CostModelSettings {
+	return CostModelSettings{
+		CPUCostFactor:        defaultCPUCostFactor,
+		SeqIOCostFactor:      defaultSeqIOCostFactor,
+		RandIOCostFactor:     defaultRandIOCostFactor,
+		NetworkCostFactor:    defaultNetworkCostFactor,
+		VectorizedCostFactor: defaultVectorizedCostFactor,
+		Version:              CostModelV1,
+	}
+}
+
+// Validate returns an error if any of the cost factors are not positive.
+func (s CostModelSettings) Validate() error {
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{
+		{"cpu", s.CPUCostFactor},
+		{"sequential I/O", s.SeqIOCostFactor},
+		{"random I/O", s.RandIOCostFactor},
+		{"network", s.NetworkCostFactor},
+		{"vectorized", s.VectorizedCostFactor},
+	} {
+		if !(f.value > 0) {
+			return errors.Newf("%s cost factor must be positive: %v", f.name, f.value)
+		}
+	}
+	if !(s.RemoteLatencyCostFactor >= 0) {
+		return errors.Newf("remote latency cost factor must be non-negative: %v", s.RemoteLatencyCostFactor)
+	}
+	if s.Version < 0 || s.Version > LatestCostModelVersion {
+		return errors.Newf("unknown cost model version: %d", s.Version)
+	}
+	return nil
+}
+
+var (
+	cpuCostFactorSetting = settings.RegisterFloatSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.cpu_cost_factor",
+		"cost used by the optimizer for processing a row in memory",
+		defaultCPUCostFactor,
+		settings.PositiveFloat,
+	)
+
+	seqIOCostFactorSetting = settings.RegisterFloatSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.seq_io_cost_factor",
+		"cost used by the optimizer for reading a row sequentially from storage",
+		defaultSeqIOCostFactor,
+		settings.PositiveFloat,
+	)
+
+	randIOCostFactorSetting = settings.RegisterFloatSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.rand_io_cost_factor",
+		"cost used by the optimizer for seeking to a new key in storage",
+		defaultRandIOCostFactor,
+		settings.PositiveFloat,
+	)
+
+	networkCostFactorSetting = settings.RegisterFloatSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.network_cost_factor",
+		"multiplier used by the optimizer for the cost of network round trips and transfers",
+		defaultNetworkCostFactor,
+		settings.PositiveFloat,
+	)
+
+	vectorizedCostFactorSetting = settings.RegisterFloatSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.vectorized_cost_factor",
+		"multiplier used by the optimizer for the cost of operators that run natively in the vectorized engine",
+		defaultVectorizedCostFactor,
+		settings.PositiveFloat,
+	)
+
+	remoteLatencyCostFactorSetting = settings.RegisterFloatSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.remote_latency_cost_factor",
+		"cost used by the optimizer for a round trip to a node in a different locality than the gateway",
+		0,
+		settings.NonNegativeFloat,
+	)
+
+	versionSetting = settings.RegisterIntSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.version",
+		"version of the cost model used by the optimizer to choose plans",
+		int64(CostModelV1),
+		validateCostModelVersion,
+	)
+
+	// shadowVersionSetting is the version of the shadow cost model of the
+	// optimizer. See Optimizer.SetShadowCostModel.
+	shadowVersionSetting = settings.RegisterIntSetting(
+		settings.TenantWritable,
+		"sql.optimizer.cost_model.shadow_version",
+		"if non-zero, the optimizer also costs plans with this version of the cost model, "+
+			"and counts the statements for which it would have chosen a different plan",
+		0,
+		func(v int64) error {
+			if v == 0 {
+				return nil
+			}
+			return validateCostModelVersion(v)
+		},
+	)
+)
+
+// validateCostModelVersion returns an error if the given value of a cluster
+// setting is not a known cost model version.
+func validateCostModelVersion(v int64) error {
+	if v < int64(CostModelV1) || v > int64(LatestCostModelVersion) {
+		return errors.Newf("cost model version must be between %d and %d: %d",
+			CostModelV1, LatestCostModelVersion, v)
+	}
+	return nil
+}
+
+// MakeCostModelSettings returns the cost model settings configured in the
+// given cluster settings. If sv is nil, the defaults are returned.
+func MakeCostModelSettings(sv *settings.Values) CostModelSettings {
+	if sv == nil {
+		return DefaultCostModelSettings()
+	}
+	return CostModelSettings{
+		CPUCostFactor:           cpuCostFactorSetting.Get(sv),
+		SeqIOCostFactor:         seqIOCostFactorSetting.Get(sv),
+		RandIOCostFactor:        randIOCostFactorSetting.Get(sv),
+		NetworkCostFactor:       networkCostFactorSetting.Get(sv),
+		VectorizedCostFactor:    vectorizedCostFactorSetting.Get(sv),
+		RemoteLatencyCostFactor: remoteLatencyCostFactorSetting.Get(sv),
+		Version:                 CostModelVersion(versionSetting.Get(sv)),
+	}
+}
@@ -13,15 +13,19 @@ package xform
 import (
 	"math"
 	"math/rand"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/ordering"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/sql/rowinfra"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/errors"
@@ -58,6 +62,115 @@ type Coster interface {
 	// real-world metric, but does expect costs to be comparable to one another,
 	// as well as summable.
 	ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost
+
+	// ComputeCostBreakdown returns the cost of the candidate expression that
+	// ComputeCost would return, divided between the resources that contribute
+	// to it. It is only used to explain the cost of the final plan, so it need
+	// not be efficient.
+	ComputeCostBreakdown(candidate memo.RelExpr, required *physical.Required) memo.CostBreakdown
+
+	// ComputeCostInterval returns the range within which the cost of the
+	// candidate expression, excluding the costs of its children, is expected to
+	// fall, given the estimated cost returned by ComputeCost. It is used by a
+	// risk-averse optimizer to prefer plans with a lower worst-case cost (see
+	// Optimizer.SetRiskAversion).
+	ComputeCostInterval(
+		candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+	) memo.CostInterval
+}
+
+// BatchCoster is a Coster that can compute the costs of several candidates with
+// a single call. If the coster of the optimizer implements BatchCoster, the
+// optimizer costs all the members of a group that can provide the required
+// properties with one call to ComputeCosts, so that the coster can share the
+// work that only depends on the logical properties of the group. Otherwise,
+// each member is costed with ComputeCost.
+type BatchCoster interface {
+	Coster
+
+	// ComputeCosts computes the cost of each candidate expression and stores it
+	// at the same position in costs, which must be as long as candidates. Each
+	// cost must be the cost that ComputeCost would return for the candidate.
+	// The candidates usually belong to the same memo group.
+	ComputeCosts(candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost)
+}
+
+// ComputeCosts computes the cost of each candidate expression with the given
+// coster, and stores it at the same position in costs. It uses a single call
+// to ComputeCosts if the coster implements BatchCoster, and otherwise calls
+// ComputeCost for each candidate. It allows a BatchCoster that wraps another
+// Coster to delegate to it, whether or not it implements BatchCoster.
+func ComputeCosts(
+	coster Coster, candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	if batch, ok := coster.(BatchCoster); ok {
+		batch.ComputeCosts(candidates, required, costs)
+		return
+	}
+	for i, candidate := range candidates {
+		costs[i] = coster.ComputeCost(candidate, required)
+	}
+}
+
+// CostPerturbationMode determines how the default coster perturbs the cost of
+// each expression. See CostPerturbation.
+type CostPerturbationMode int8
+
+const (
+	// MultiplicativePerturbation multiplies the cost of each expression by a
+	// random factor in the range [1 - Amount, 1 + Amount), with a minimum cost
+	// of zero. This is the perturbation applied by the
+	// OptimizerCostPerturbation testing knob.
+	MultiplicativePerturbation CostPerturbationMode = iota
+
+	// AbsolutePerturbation adds a random amount in the range [-Amount, Amount)
+	// to the cost of each expression, with a minimum cost of zero. Unlike
+	// MultiplicativePerturbation, it has a larger relative effect on cheap
+	// expressions than on expensive ones.
+	AbsolutePerturbation
+
+	// SwapTiesPerturbation lowers the cost of each expression by a slightly
+	// larger fraction than the expression costed before it, so that when
+	// candidates have the same cost, the candidate costed last is chosen rather
+	// than the candidate costed first. It is deterministic, so Amount and Seed
+	// are ignored.
+	SwapTiesPerturbation
+)
+
+// swapTiesFactor is the fraction by which SwapTiesPerturbation lowers the cost
+// of each successive expression. It is large enough that the costs of
+// successive candidates are not treated as equal by memo.Cost.Less, but small
+// enough that the costs of candidates that were not tied are rarely reordered.
+const swapTiesFactor = 1e-9
+
+// CostPerturbation describes how the default coster perturbs the cost of each
+// expression, in order to generate alternate plans for testing the robustness
+// of plans. It can be set via Optimizer.SetCostPerturbation.
+type CostPerturbation struct {
+	// Mode determines how costs are perturbed.
+	Mode CostPerturbationMode
+
+	// Amount is the fraction of its cost by which the cost of an expression is
+	// perturbed by MultiplicativePerturbation, or the amount of cost by which
+	// it is perturbed by AbsolutePerturbation. The perturbation is disabled if
+	// Amount is zero, unless Mode is SwapTiesPerturbation.
+	Amount float64
+
+	// Ops, if not empty, restricts the perturbation to expressions whose
+	// operator is in the set, e.g. only join operators. The set contains
+	// opt.Operator values.
+	Ops util.FastIntSet
+
+	// Seed seeds the random number generator used to perturb costs, so that
+	// the same costs are perturbed in the same way each time the same
+	// expressions are costed in the same order. If zero, the global random
+	// number generator is used.
+	Seed int64
+}
+
+// enabled returns true if the perturbation has any effect.
+func (p *CostPerturbation) enabled() bool {
+	return p.Amount != 0 || p.Mode == SwapTiesPerturbation
 }
 
 // coster encapsulates the default cost model for the optimizer. The coster
@@ -78,45 +191,66 @@ type coster struct {
 	//
 	locality roachpb.Locality
 
-	// perturbation indicates how much to randomly perturb the cost. It is used
-	// to generate alternative plans for testing. For example, if perturbation is
-	// 0.5, and the estimated cost of an expression is c, the cost returned by
-	// ComputeCost will be in the range [c - 0.5 * c, c + 0.5 * c).
-	perturbation float64
-}
-
-var _ Coster = &coster{}
-
-// MakeDefaultCoster creates an instance of the default coster.
-func MakeDefaultCoster(mem *memo.Memo) Coster {
-	return &coster{mem: mem}
-}
-
-const (
-	// These costs have been copied from the Postgres optimizer:
-	// https://github.com/postgres/postgres/blob/master/src/include/optimizer/cost.h
-	// TODO(rytaft): "How Good are Query Optimizers, Really?" says that the
-	// PostgreSQL ratio between CPU and I/O is probably unrealistic in modern
-	// systems since much of the data can be cached in memory. Consider
-	// increasing the cpuCostFactor to account for this.
-	cpuCostFactor    = 0.01
-	seqIOCostFactor  = 1
-	randIOCostFactor = 4
+	// estimator estimates the row counts on which costs depend. See
+	// CardinalityEstimator.
+	estimator CardinalityEstimator
+
+	// perturbation indicates how to perturb the cost. It is used to generate
+	// alternative plans for testing. For example, if it is a
+	// MultiplicativePerturbation with an Amount of 0.5, and the estimated cost
+	// of an expression is c, the cost returned by ComputeCost will be in the
+	// range [c - 0.5 * c, c + 0.5 * c).
+	perturbation CostPerturbation
+
+	// rng is used to perturb costs if perturbation has a seed. Otherwise, the
+	// global random number generator is used.
+	rng *rand.Rand
+
+	// costed is the number of expressions that have been costed, which is used
+	// by SwapTiesPerturbation.
+	costed int
+
+	// breakdown, if non-nil, accumulates the costs that are attributed to IO,
+	// network and memory while computing the cost of an expression. It is only
+	// set by ComputeCostBreakdown.
+	breakdown *memo.CostBreakdown
+
+	// batch caches the values that only depend on the logical properties of
+	// the group whose members are costed by ComputeCosts. See costBatch.
+	batch costBatch
+
+	// uncertainties caches the result of rowCountUncertainty for each memo
+	// group, keyed by the first expression in the group.
+	uncertainties map[memo.RelExpr]float64
+
+	// statsPenalty is the penalty applied to expressions whose inputs have
+	// untrustworthy row counts, and statsPenaltyTime is the time at which it
+	// was set, against which the age of statistics is measured. untrusted
+	// caches the result of untrustedRowCount for each memo group, keyed by the
+	// first expression in the group. See StatsUncertaintyPenalty.
+	statsPenalty     StatsUncertaintyPenalty
+	statsPenaltyTime time.Time
+	untrusted        map[memo.RelExpr]bool
+
+	// cpuCostFactor, seqIOCostFactor and randIOCostFactor are the costs of
+	// processing a row, reading a row sequentially and seeking to a new key,
+	// respectively. They are taken from the CostModelSettings that the coster
+	// was initialized with, and the remaining cost factors are derived from
+	// them.
+	cpuCostFactor    memo.Cost
+	seqIOCostFactor  memo.Cost
+	randIOCostFactor memo.Cost
 
 	// TODO(justin): make this more sophisticated.
 	// lookupJoinRetrieveRowCost is the cost to retrieve a single row during a
 	// lookup join.
 	// See https://github.com/cockroachdb/cockroach/pull/35561 for the initial
 	// justification for this constant.
-	lookupJoinRetrieveRowCost = 2 * seqIOCostFactor
+	lookupJoinRetrieveRowCost memo.Cost
 
 	// virtualScanTableDescriptorFetchCost is the cost to retrieve the table
 	// descriptors when performing a virtual table scan.
-	virtualScanTableDescriptorFetchCost = 25 * randIOCostFactor
-
-	// Input rows to a join are processed in batches of this size.
-	// See joinreader.go.
-	joinReaderBatchSize = 100.0
+	virtualScanTableDescriptorFetchCost memo.Cost
 
 	// latencyCostFactor represents the throughput impact of doing scans on an
 	// index that may be remotely located in a different locality. If latencies
@@ -128,7 +262,137 @@ const (
 	// the same cost to access.
 	// TODO(andyk): Need to do analysis to figure out right value and/or to come
 	// up with better way to incorporate latency into the coster.
-	latencyCostFactor = cpuCostFactor
+	latencyCostFactor memo.Cost
+
+	// remoteRoundTripCostFactor is the cost of a round trip to a node in a
+	// different locality than the gateway. Unlike latencyCostFactor, which
+	// reflects the throughput impact of remote rows, it reflects the latency of
+	// each KV request that is sent to a remote node. It is zero unless it is
+	// set in the CostModelSettings. See remoteLatencyCost.
+	remoteRoundTripCostFactor memo.Cost
+
+	// spillCostFactor is the cost of spilling to disk. We use seqIOCostFactor to
+	// model the cost of spilling to disk, because although there will be some
+	// random I/O required to insert rows into a sorted structure, the inherent
+	// batching in the LSM tree should amortize the cost.
+	spillCostFactor memo.Cost
+
+	// rangeVisitCostFactor is the cost of crossing a range boundary during a
+	// scan. Each new range requires a separate KV request, which is similar in
+	// cost to seeking to the start of a new span.
+	rangeVisitCostFactor memo.Cost
+
+	// leaseholderFanoutCostFactor is the cost of contacting each additional
+	// leaseholder node during a scan. This reflects the extra network round
+	// trips and coordination required when a scan touches ranges on many
+	// different nodes.
+	leaseholderFanoutCostFactor memo.Cost
+
+	// parallelismWaveCostFactor is the cost of each additional round of
+	// leaseholder requests that is required when the number of nodes touched by
+	// a scan exceeds the MaxParallelism physical property.
+	parallelismWaveCostFactor memo.Cost
+
+	// exchangeRowCostFactor is the cost of sending a row from one stream to
+	// another, which is required to gather parallel streams into one, or to
+	// repartition the inputs of a parallel hash join.
+	exchangeRowCostFactor memo.Cost
+
+	// exchangeStreamCostFactor is the cost of setting up each stream of a
+	// parallel plan, which requires planning and starting a separate flow.
+	exchangeStreamCostFactor memo.Cost
+
+	// kvWriteCostFactor is the cost of writing a single KV entry, which is
+	// required for each index entry that is inserted, updated, or deleted by a
+	// mutation.
+	kvWriteCostFactor memo.Cost
+
+	// lockedRowCostFactor is the cost of locking each row read by a locking
+	// scan, such as a scan with a FOR UPDATE clause or the input scan of an
+	// UPDATE or DELETE with implicit row-level locking. Locks are held until the
+	// transaction commits and block concurrent writers, so this biases the
+	// optimizer toward locking plans that read fewer rows, even if they are
+	// otherwise slightly more expensive.
+	lockedRowCostFactor memo.Cost
+
+	// applyJoinReplanCost is the cost of re-planning the right input of an
+	// apply join for each row of its left input, which requires the right input
+	// to be copied, normalized and optimized with the outer columns replaced by
+	// constants.
+	applyJoinReplanCost memo.Cost
+
+	// vectorized is true if the vectorized execution engine is enabled for the
+	// session, in which case the costs of operators that run natively in the
+	// vectorized engine are scaled by vectorizedCostFactor.
+	vectorized bool
+
+	// vectorizedCostFactor is taken from the CostModelSettings that the coster
+	// was initialized with. See vectorizedCostMultiplier.
+	vectorizedCostFactor float64
+
+	// workMemLimit is the number of bytes that an operator can use to buffer
+	// rows before it spills to disk. If it is zero, the memory footprint of
+	// buffered rows is not estimated, and rowBufferCost is used instead. It is
+	// only set if the optimizer_use_workmem_costing session setting is true,
+	// or if the version of the cost model is at least CostModelV2.
+	workMemLimit float64
+
+	// version is the version of the cost model that the coster was initialized
+	// with. See CostModelVersion.
+	version CostModelVersion
+}
+
+var _ BatchCoster = &coster{}
+
+// costBatch caches the values that only depend on the logical properties of a
+// memo group, which are shared by all of its members, while ComputeCosts costs
+// the members of the group. The values are only used for expressions in the
+// group, so a batch of candidates from different groups is costed correctly,
+// if less efficiently.
+type costBatch struct {
+	// group is the first expression in the group, or nil outside of
+	// ComputeCosts.
+	group memo.RelExpr
+
+	// rowCount is the row count of the group estimated by the coster's
+	// CardinalityEstimator.
+	rowCount float64
+
+	// datumVecCols is true if any of the output columns of the group is
+	// represented by a datum-backed vector in the vectorized engine. See
+	// vectorizedCostMultiplier.
+	datumVecCols bool
+}
+
+// MakeDefaultCoster creates an instance of the default coster.
+func MakeDefaultCoster(mem *memo.Memo) Coster {
+	c := &coster{mem: mem}
+	c.initCostFactors(DefaultCostModelSettings())
+	return c
+}
+
+const (
+	// These costs have been copied from the Postgres optimizer:
+	// https://github.com/postgres/postgres/blob/master/src/include/optimizer/cost.h
+	// TODO(rytaft): "How Good are Query Optimizers, Really?" says that the
+	// PostgreSQL ratio between CPU and I/O is probably unrealistic in modern
+	// systems since much of the data can be cached in memory. Consider
+	// increasing the cpuCostFactor to account for this.
+	// They are the defaults for the corresponding CostModelSettings, which can
+	// be calibrated for a particular cluster.
+	defaultCPUCostFactor     = 0.01
+	defaultSeqIOCostFactor   = 1
+	defaultRandIOCostFactor  = 4
+	defaultNetworkCostFactor = 1
+
+	// defaultVectorizedCostFactor does not discount vectorized operators, so
+	// that the default cost model is the same whether or not the vectorized
+	// engine is used.
+	defaultVectorizedCostFactor = 1
+
+	// Input rows to a join are processed in batches of this size.
+	// See joinreader.go.
+	joinReaderBatchSize = 100.0
 
 	// hugeCost is used with expressions we want to avoid; these are expressions
 	// that "violate" a hint like forcing a specific index or join algorithm.
@@ -157,6 +421,12 @@ const (
 	// we have a hint for preferring a lookup join.
 	preferLookupJoinFactor = 1e-6
 
+	// reverseLockingScanPenalty is the fraction of the cost of locking a row that
+	// is added for each row read by a locking scan in reverse index order.
+	// Transactions that lock the same rows in opposite orders are likely to
+	// deadlock, and most locking scans read in forward index order.
+	reverseLockingScanPenalty = 1
+
 	// noSpillRowCount represents the maximum number of rows that should have no
 	// buffering cost because we expect they will never need to be spilled to
 	// disk. Since 64MB is the default work mem limit, 64 rows will not cause a
@@ -169,11 +439,36 @@ const (
 	// a disk spill.
 	spillRowCount = 6400000
 
-	// spillCostFactor is the cost of spilling to disk. We use seqIOCostFactor to
-	// model the cost of spilling to disk, because although there will be some
-	// random I/O required to insert rows into a sorted structure, the inherent
-	// batching in the LSM tree should amortize the cost.
-	spillCostFactor = seqIOCostFactor
+	// statsSelectivityUncertainty is the factor by which the estimated row count
+	// of an expression that filters or combines rows may be wrong, if
+	// statistics are available. defaultSelectivityUncertainty is used if they
+	// are not, since the estimate is then based on default selectivities.
+	statsSelectivityUncertainty   = 2
+	defaultSelectivityUncertainty = 10
+
+	// maxRowCountUncertainty bounds the factor by which the estimated row count
+	// of any expression may be wrong, so that the worst-case costs of large
+	// plans do not grow without bound.
+	maxRowCountUncertainty = 1000
+
+	// defaultWorkMemLimit is the number of bytes that an operator can use
+	// before it spills to disk, if the session does not specify a limit. It is
+	// the same as execinfra.DefaultMemoryLimit.
+	defaultWorkMemLimit = 64 << 20
+
+	// defaultBufferedColSize is the number of bytes assumed for a buffered
+	// column if its average size is not known. It is the same as the default
+	// column size used by the statistics builder.
+	defaultBufferedColSize = 4
+
+	// bufferedRowOverhead is the number of bytes, in addition to the size of
+	// its columns, that are used to buffer a row in memory, e.g. for the
+	// pointers and hash values in a hash table.
+	bufferedRowOverhead = 32
+
+	// spillPassCount is the number of times that a row which is spilled to
+	// disk must be processed: it is written once and read back once.
+	spillPassCount = 2
 )
 
 // fnCost maps some functions to an execution cost. Currently this list
@@ -185,271 +480,327 @@ const (
 // TODO(mjibson): Add costs directly to overloads. When that is done, we should
 // also add a test that ensures those costs match postgres.
 var fnCost = map[string]memo.Cost{
-	"st_3dclosestpoint":           1000 * cpuCostFactor,
-	"st_3ddfullywithin":           10000 * cpuCostFactor,
-	"st_3ddistance":               1000 * cpuCostFactor,
-	"st_3ddwithin":                10000 * cpuCostFactor,
-	"st_3dintersects":             10000 * cpuCostFactor,
-	"st_3dlength":                 100 * cpuCostFactor,
-	"st_3dlongestline":            1000 * cpuCostFactor,
-	"st_3dmakebox":                100 * cpuCostFactor,
-	"st_3dmaxdistance":            1000 * cpuCostFactor,
-	"st_3dperimeter":              100 * cpuCostFactor,
-	"st_3dshortestline":           1000 * cpuCostFactor,
-	"st_addmeasure":               1000 * cpuCostFactor,
-	"st_addpoint":                 100 * cpuCostFactor,
-	"st_affine":                   100 * cpuCostFactor,
-	"st_angle":                    100 * cpuCostFactor,
-	"st_area":                     100 * cpuCostFactor,
-	"st_area2d":                   100 * cpuCostFactor,
-	"st_asbinary":                 100 * cpuCostFactor,
-	"st_asencodedpolyline":        100 * cpuCostFactor,
-	"st_asewkb":                   100 * cpuCostFactor,
-	"st_asewkt":                   100 * cpuCostFactor,
-	"st_asgeojson":                100 * cpuCostFactor,
-	"st_asgml":                    100 * cpuCostFactor,
-	"st_ashexewkb":                100 * cpuCostFactor,
-	"st_askml":                    100 * cpuCostFactor,
-	"st_aslatlontext":             100 * cpuCostFactor,
-	"st_assvg":                    100 * cpuCostFactor,
-	"st_astext":                   100 * cpuCostFactor,
-	"st_astwkb":                   1000 * cpuCostFactor,
-	"st_asx3d":                    100 * cpuCostFactor,
-	"st_azimuth":                  100 * cpuCostFactor,
-	"st_bdmpolyfromtext":          100 * cpuCostFactor,
-	"st_bdpolyfromtext":           100 * cpuCostFactor,
-	"st_boundary":                 1000 * cpuCostFactor,
-	"st_boundingdiagonal":         100 * cpuCostFactor,
-	"st_box2dfromgeohash":         1000 * cpuCostFactor,
-	"st_buffer":                   100 * cpuCostFactor,
-	"st_buildarea":                10000 * cpuCostFactor,
-	"st_centroid":                 100 * cpuCostFactor,
-	"st_chaikinsmoothing":         10000 * cpuCostFactor,
-	"st_cleangeometry":            10000 * cpuCostFactor,
-	"st_clipbybox2d":              10000 * cpuCostFactor,
-	"st_closestpoint":             1000 * cpuCostFactor,
-	"st_closestpointofapproach":   10000 * cpuCostFactor,
-	"st_clusterdbscan":            10000 * cpuCostFactor,
-	"st_clusterintersecting":      10000 * cpuCostFactor,
-	"st_clusterkmeans":            10000 * cpuCostFactor,
-	"st_clusterwithin":            10000 * cpuCostFactor,
-	"st_collectionextract":        100 * cpuCostFactor,
-	"st_collectionhomogenize":     100 * cpuCostFactor,
-	"st_concavehull":              10000 * cpuCostFactor,
-	"st_contains":                 10000 * cpuCostFactor,
-	"st_containsproperly":         10000 * cpuCostFactor,
-	"st_convexhull":               10000 * cpuCostFactor,
-	"st_coorddim":                 100 * cpuCostFactor,
-	"st_coveredby":                100 * cpuCostFactor,
-	"st_covers":                   100 * cpuCostFactor,
-	"st_cpawithin":                10000 * cpuCostFactor,
-	"st_createtopogeo":            100 * cpuCostFactor,
-	"st_crosses":                  10000 * cpuCostFactor,
-	"st_curvetoline":              10000 * cpuCostFactor,
-	"st_delaunaytriangles":        10000 * cpuCostFactor,
-	"st_dfullywithin":             10000 * cpuCostFactor,
-	"st_difference":               10000 * cpuCostFactor,
-	"st_dimension":                100 * cpuCostFactor,
-	"st_disjoint":                 10000 * cpuCostFactor,
-	"st_distance":                 100 * cpuCostFactor,
-	"st_distancecpa":              10000 * cpuCostFactor,
-	"st_distancesphere":           100 * cpuCostFactor,
-	"st_distancespheroid":         1000 * cpuCostFactor,
-	"st_dump":                     1000 * cpuCostFactor,
-	"st_dumppoints":               100 * cpuCostFactor,
-	"st_dumprings":                1000 * cpuCostFactor,
-	"st_dwithin":                  100 * cpuCostFactor,
-	"st_endpoint":                 100 * cpuCostFactor,
-	"st_envelope":                 100 * cpuCostFactor,
-	"st_equals":                   10000 * cpuCostFactor,
-	"st_expand":                   100 * cpuCostFactor,
-	"st_exteriorring":             100 * cpuCostFactor,
-	"st_filterbym":                1000 * cpuCostFactor,
-	"st_findextent":               100 * cpuCostFactor,
-	"st_flipcoordinates":          1000 * cpuCostFactor,
-	"st_force2d":                  100 * cpuCostFactor,
-	"st_force3d":                  100 * cpuCostFactor,
-	"st_force3dm":                 100 * cpuCostFactor,
-	"st_force3dz":                 100 * cpuCostFactor,
-	"st_force4d":                  100 * cpuCostFactor,
-	"st_forcecollection":          100 * cpuCostFactor,
-	"st_forcecurve":               1000 * cpuCostFactor,
-	"st_forcepolygonccw":          100 * cpuCostFactor,
-	"st_forcepolygoncw":           1000 * cpuCostFactor,
-	"st_forcerhr":                 1000 * cpuCostFactor,
-	"st_forcesfs":                 1000 * cpuCostFactor,
-	"st_frechetdistance":          10000 * cpuCostFactor,
-	"st_generatepoints":           10000 * cpuCostFactor,
-	"st_geogfromtext":             100 * cpuCostFactor,
-	"st_geogfromwkb":              100 * cpuCostFactor,
-	"st_geographyfromtext":        100 * cpuCostFactor,
-	"st_geohash":                  1000 * cpuCostFactor,
-	"st_geomcollfromtext":         100 * cpuCostFactor,
-	"st_geomcollfromwkb":          100 * cpuCostFactor,
-	"st_geometricmedian":          10000 * cpuCostFactor,
-	"st_geometryfromtext":         1000 * cpuCostFactor,
-	"st_geometryn":                100 * cpuCostFactor,
-	"st_geometrytype":             100 * cpuCostFactor,
-	"st_geomfromewkb":             100 * cpuCostFactor,
-	"st_geomfromewkt":             100 * cpuCostFactor,
-	"st_geomfromgeohash":          1000 * cpuCostFactor,
-	"st_geomfromgeojson":          1000 * cpuCostFactor,
-	"st_geomfromgml":              100 * cpuCostFactor,
-	"st_geomfromkml":              1000 * cpuCostFactor,
-	"st_geomfromtext":             1000 * cpuCostFactor,
-	"st_geomfromtwkb":             100 * cpuCostFactor,
-	"st_geomfromwkb":              100 * cpuCostFactor,
-	"st_gmltosql":                 100 * cpuCostFactor,
-	"st_hasarc":                   100 * cpuCostFactor,
-	"st_hausdorffdistance":        10000 * cpuCostFactor,
-	"st_inittopogeo":              100 * cpuCostFactor,
-	"st_interiorringn":            100 * cpuCostFactor,
-	"st_interpolatepoint":         1000 * cpuCostFactor,
-	"st_intersection":             100 * cpuCostFactor,
-	"st_intersects":               100 * cpuCostFactor,
-	"st_isclosed":                 100 * cpuCostFactor,
-	"st_iscollection":             1000 * cpuCostFactor,
-	"st_isempty":                  100 * cpuCostFactor,
-	"st_ispolygonccw":             100 * cpuCostFactor,
-	"st_ispolygoncw":              100 * cpuCostFactor,
-	"st_isring":                   1000 * cpuCostFactor,
-	"st_issimple":                 1000 * cpuCostFactor,
-	"st_isvalid":                  100 * cpuCostFactor,
-	"st_isvaliddetail":            10000 * cpuCostFactor,
-	"st_isvalidreason":            100 * cpuCostFactor,
-	"st_isvalidtrajectory":        10000 * cpuCostFactor,
-	"st_length":                   100 * cpuCostFactor,
-	"st_length2d":                 100 * cpuCostFactor,
-	"st_length2dspheroid":         1000 * cpuCostFactor,
-	"st_lengthspheroid":           1000 * cpuCostFactor,
-	"st_linecrossingdirection":    10000 * cpuCostFactor,
-	"st_linefromencodedpolyline":  1000 * cpuCostFactor,
-	"st_linefrommultipoint":       100 * cpuCostFactor,
-	"st_linefromtext":             100 * cpuCostFactor,
-	"st_linefromwkb":              100 * cpuCostFactor,
-	"st_lineinterpolatepoint":     1000 * cpuCostFactor,
-	"st_lineinterpolatepoints":    1000 * cpuCostFactor,
-	"st_linelocatepoint":          1000 * cpuCostFactor,
-	"st_linemerge":                10000 * cpuCostFactor,
-	"st_linestringfromwkb":        100 * cpuCostFactor,
-	"st_linesubstring":            1000 * cpuCostFactor,
-	"st_linetocurve":              10000 * cpuCostFactor,
-	"st_locatealong":              1000 * cpuCostFactor,
-	"st_locatebetween":            1000 * cpuCostFactor,
-	"st_locatebetweenelevations":  1000 * cpuCostFactor,
-	"st_longestline":              100 * cpuCostFactor,
-	"st_makeenvelope":             100 * cpuCostFactor,
-	"st_makeline":                 100 * cpuCostFactor,
-	"st_makepoint":                100 * cpuCostFactor,
-	"st_makepointm":               100 * cpuCostFactor,
-	"st_makepolygon":              100 * cpuCostFactor,
-	"st_makevalid":                10000 * cpuCostFactor,
-	"st_maxdistance":              100 * cpuCostFactor,
-	"st_memsize":                  100 * cpuCostFactor,
-	"st_minimumboundingcircle":    10000 * cpuCostFactor,
-	"st_minimumboundingradius":    10000 * cpuCostFactor,
-	"st_minimumclearance":         10000 * cpuCostFactor,
-	"st_minimumclearanceline":     10000 * cpuCostFactor,
-	"st_mlinefromtext":            100 * cpuCostFactor,
-	"st_mlinefromwkb":             100 * cpuCostFactor,
-	"st_mpointfromtext":           100 * cpuCostFactor,
-	"st_mpointfromwkb":            100 * cpuCostFactor,
-	"st_mpolyfromtext":            100 * cpuCostFactor,
-	"st_mpolyfromwkb":             100 * cpuCostFactor,
-	"st_multi":                    100 * cpuCostFactor,
-	"st_multilinefromwkb":         100 * cpuCostFactor,
-	"st_multilinestringfromtext":  100 * cpuCostFactor,
-	"st_multipointfromtext":       100 * cpuCostFactor,
-	"st_multipointfromwkb":        100 * cpuCostFactor,
-	"st_multipolyfromwkb":         100 * cpuCostFactor,
-	"st_multipolygonfromtext":     100 * cpuCostFactor,
-	"st_node":                     10000 * cpuCostFactor,
-	"st_normalize":                100 * cpuCostFactor,
-	"st_npoints":                  100 * cpuCostFactor,
-	"st_nrings":                   100 * cpuCostFactor,
-	"st_numgeometries":            100 * cpuCostFactor,
-	"st_numinteriorring":          100 * cpuCostFactor,
-	"st_numinteriorrings":         100 * cpuCostFactor,
-	"st_numpatches":               100 * cpuCostFactor,
-	"st_numpoints":                100 * cpuCostFactor,
-	"st_offsetcurve":              10000 * cpuCostFactor,
-	"st_orderingequals":           10000 * cpuCostFactor,
-	"st_orientedenvelope":         10000 * cpuCostFactor,
-	"st_overlaps":                 10000 * cpuCostFactor,
-	"st_patchn":                   100 * cpuCostFactor,
-	"st_perimeter":                100 * cpuCostFactor,
-	"st_perimeter2d":              100 * cpuCostFactor,
-	"st_point":                    100 * cpuCostFactor,
-	"st_pointfromgeohash":         1000 * cpuCostFactor,
-	"st_pointfromtext":            100 * cpuCostFactor,
-	"st_pointfromwkb":             100 * cpuCostFactor,
-	"st_pointinsidecircle":        1000 * cpuCostFactor,
-	"st_pointn":                   100 * cpuCostFactor,
-	"st_pointonsurface":           1000 * cpuCostFactor,
-	"st_points":                   1000 * cpuCostFactor,
-	"st_polyfromtext":             100 * cpuCostFactor,
-	"st_polyfromwkb":              100 * cpuCostFactor,
-	"st_polygon":                  100 * cpuCostFactor,
-	"st_polygonfromtext":          100 * cpuCostFactor,
-	"st_polygonfromwkb":           100 * cpuCostFactor,
-	"st_polygonize":               10000 * cpuCostFactor,
-	"st_project":                  1000 * cpuCostFactor,
-	"st_quantizecoordinates":      1000 * cpuCostFactor,
-	"st_relate":                   10000 * cpuCostFactor,
-	"st_relatematch":              1000 * cpuCostFactor,
-	"st_removepoint":              100 * cpuCostFactor,
-	"st_removerepeatedpoints":     1000 * cpuCostFactor,
-	"st_reverse":                  1000 * cpuCostFactor,
-	"st_rotate":                   100 * cpuCostFactor,
-	"st_rotatex":                  100 * cpuCostFactor,
-	"st_rotatey":                  100 * cpuCostFactor,
-	"st_rotatez":                  100 * cpuCostFactor,
-	"st_scale":                    100 * cpuCostFactor,
-	"st_segmentize":               1000 * cpuCostFactor,
-	"st_seteffectivearea":         1000 * cpuCostFactor,
-	"st_setpoint":                 100 * cpuCostFactor,
-	"st_setsrid":                  100 * cpuCostFactor,
-	"st_sharedpaths":              10000 * cpuCostFactor,
-	"st_shortestline":             1000 * cpuCostFactor,
-	"st_simplify":                 100 * cpuCostFactor,
-	"st_simplifypreservetopology": 10000 * cpuCostFactor,
-	"st_simplifyvw":               10000 * cpuCostFactor,
-	"st_snap":                     10000 * cpuCostFactor,
-	"st_snaptogrid":               100 * cpuCostFactor,
-	"st_split":                    10000 * cpuCostFactor,
-	"st_srid":                     100 * cpuCostFactor,
-	"st_startpoint":               100 * cpuCostFactor,
-	"st_subdivide":                10000 * cpuCostFactor,
-	"st_summary":                  100 * cpuCostFactor,
-	"st_swapordinates":            100 * cpuCostFactor,
-	"st_symdifference":            10000 * cpuCostFactor,
-	"st_symmetricdifference":      10000 * cpuCostFactor,
-	"st_tileenvelope":             100 * cpuCostFactor,
-	"st_touches":                  10000 * cpuCostFactor,
-	"st_transform":                100 * cpuCostFactor,
-	"st_translate":                100 * cpuCostFactor,
-	"st_transscale":               100 * cpuCostFactor,
-	"st_unaryunion":               10000 * cpuCostFactor,
-	"st_union":                    10000 * cpuCostFactor,
-	"st_voronoilines":             100 * cpuCostFactor,
-	"st_voronoipolygons":          100 * cpuCostFactor,
-	"st_within":                   10000 * cpuCostFactor,
-	"st_wkbtosql":                 100 * cpuCostFactor,
-	"st_wkttosql":                 1000 * cpuCostFactor,
-}
-
-// Init initializes a new coster structure with the given memo.
-func (c *coster) Init(evalCtx *tree.EvalContext, mem *memo.Memo, perturbation float64) {
+	"st_3dclosestpoint":           1000 * defaultCPUCostFactor,
+	"st_3ddfullywithin":           10000 * defaultCPUCostFactor,
+	"st_3ddistance":               1000 * defaultCPUCostFactor,
+	"st_3ddwithin":                10000 * defaultCPUCostFactor,
+	"st_3dintersects":             10000 * defaultCPUCostFactor,
+	"st_3dlength":                 100 * defaultCPUCostFactor,
+	"st_3dlongestline":            1000 * defaultCPUCostFactor,
+	"st_3dmakebox":                100 * defaultCPUCostFactor,
+	"st_3dmaxdistance":            1000 * defaultCPUCostFactor,
+	"st_3dperimeter":              100 * defaultCPUCostFactor,
+	"st_3dshortestline":           1000 * defaultCPUCostFactor,
+	"st_addmeasure":               1000 * defaultCPUCostFactor,
+	"st_addpoint":                 100 * defaultCPUCostFactor,
+	"st_affine":                   100 * defaultCPUCostFactor,
+	"st_angle":                    100 * defaultCPUCostFactor,
+	"st_area":                     100 * defaultCPUCostFactor,
+	"st_area2d":                   100 * defaultCPUCostFactor,
+	"st_asbinary":                 100 * defaultCPUCostFactor,
+	"st_asencodedpolyline":        100 * defaultCPUCostFactor,
+	"st_asewkb":                   100 * defaultCPUCostFactor,
+	"st_asewkt":                   100 * defaultCPUCostFactor,
+	"st_asgeojson":                100 * defaultCPUCostFactor,
+	"st_asgml":                    100 * defaultCPUCostFactor,
+	"st_ashexewkb":                100 * defaultCPUCostFactor,
+	"st_askml":                    100 * defaultCPUCostFactor,
+	"st_aslatlontext":             100 * defaultCPUCostFactor,
+	"st_assvg":                    100 * defaultCPUCostFactor,
+	"st_astext":                   100 * defaultCPUCostFactor,
+	"st_astwkb":                   1000 * defaultCPUCostFactor,
+	"st_asx3d":                    100 * defaultCPUCostFactor,
+	"st_azimuth":                  100 * defaultCPUCostFactor,
+	"st_bdmpolyfromtext":          100 * defaultCPUCostFactor,
+	"st_bdpolyfromtext":           100 * defaultCPUCostFactor,
+	"st_boundary":                 1000 * defaultCPUCostFactor,
+	"st_boundingdiagonal":         100 * defaultCPUCostFactor,
+	"st_box2dfromgeohash":         1000 * defaultCPUCostFactor,
+	"st_buffer":                   100 * defaultCPUCostFactor,
+	"st_buildarea":                10000 * defaultCPUCostFactor,
+	"st_centroid":                 100 * defaultCPUCostFactor,
+	"st_chaikinsmoothing":         10000 * defaultCPUCostFactor,
+	"st_cleangeometry":            10000 * defaultCPUCostFactor,
+	"st_clipbybox2d":              10000 * defaultCPUCostFactor,
+	"st_closestpoint":             1000 * defaultCPUCostFactor,
+	"st_closestpointofapproach":   10000 * defaultCPUCostFactor,
+	"st_clusterdbscan":            10000 * defaultCPUCostFactor,
+	"st_clusterintersecting":      10000 * defaultCPUCostFactor,
+	"st_clusterkmeans":            10000 * defaultCPUCostFactor,
+	"st_clusterwithin":            10000 * defaultCPUCostFactor,
+	"st_collectionextract":        100 * defaultCPUCostFactor,
+	"st_collectionhomogenize":     100 * defaultCPUCostFactor,
+	"st_concavehull":              10000 * defaultCPUCostFactor,
+	"st_contains":                 10000 * defaultCPUCostFactor,
+	"st_containsproperly":         10000 * defaultCPUCostFactor,
+	"st_convexhull":               10000 * defaultCPUCostFactor,
+	"st_coorddim":                 100 * defaultCPUCostFactor,
+	"st_coveredby":                100 * defaultCPUCostFactor,
+	"st_covers":                   100 * defaultCPUCostFactor,
+	"st_cpawithin":                10000 * defaultCPUCostFactor,
+	"st_createtopogeo":            100 * defaultCPUCostFactor,
+	"st_crosses":                  10000 * defaultCPUCostFactor,
+	"st_curvetoline":              10000 * defaultCPUCostFactor,
+	"st_delaunaytriangles":        10000 * defaultCPUCostFactor,
+	"st_dfullywithin":             10000 * defaultCPUCostFactor,
+	"st_difference":               10000 * defaultCPUCostFactor,
+	"st_dimension":                100 * defaultCPUCostFactor,
+	"st_disjoint":                 10000 * defaultCPUCostFactor,
+	"st_distance":                 100 * defaultCPUCostFactor,
+	"st_distancecpa":              10000 * defaultCPUCostFactor,
+	"st_distancesphere":           100 * defaultCPUCostFactor,
+	"st_distancespheroid":         1000 * defaultCPUCostFactor,
+	"st_dump":                     1000 * defaultCPUCostFactor,
+	"st_dumppoints":               100 * defaultCPUCostFactor,
+	"st_dumprings":                1000 * defaultCPUCostFactor,
+	"st_dwithin":                  100 * defaultCPUCostFactor,
+	"st_endpoint":                 100 * defaultCPUCostFactor,
+	"st_envelope":                 100 * defaultCPUCostFactor,
+	"st_equals":                   10000 * defaultCPUCostFactor,
+	"st_expand":                   100 * defaultCPUCostFactor,
+	"st_exteriorring":             100 * defaultCPUCostFactor,
+	"st_filterbym":                1000 * defaultCPUCostFactor,
+	"st_findextent":               100 * defaultCPUCostFactor,
+	"st_flipcoordinates":          1000 * defaultCPUCostFactor,
+	"st_force2d":                  100 * defaultCPUCostFactor,
+	"st_force3d":                  100 * defaultCPUCostFactor,
+	"st_force3dm":                 100 * defaultCPUCostFactor,
+	"st_force3dz":                 100 * defaultCPUCostFactor,
+	"st_force4d":                  100 * defaultCPUCostFactor,
+	"st_forcecollection":          100 * defaultCPUCostFactor,
+	"st_forcecurve":               1000 * defaultCPUCostFactor,
+	"st_forcepolygonccw":          100 * defaultCPUCostFactor,
+	"st_forcepolygoncw":           1000 * defaultCPUCostFactor,
+	"st_forcerhr":                 1000 * defaultCPUCostFactor,
+	"st_forcesfs":                 1000 * defaultCPUCostFactor,
+	"st_frechetdistance":          10000 * defaultCPUCostFactor,
+	"st_generatepoints":           10000 * defaultCPUCostFactor,
+	"st_geogfromtext":             100 * defaultCPUCostFactor,
+	"st_geogfromwkb":              100 * defaultCPUCostFactor,
+	"st_geographyfromtext":        100 * defaultCPUCostFactor,
+	"st_geohash":                  1000 * defaultCPUCostFactor,
+	"st_geomcollfromtext":         100 * defaultCPUCostFactor,
+	"st_geomcollfromwkb":          100 * defaultCPUCostFactor,
+	"st_geometricmedian":          10000 * defaultCPUCostFactor,
+	"st_geometryfromtext":         1000 * defaultCPUCostFactor,
+	"st_geometryn":                100 * defaultCPUCostFactor,
+	"st_geometrytype":             100 * defaultCPUCostFactor,
+	"st_geomfromewkb":             100 * defaultCPUCostFactor,
+	"st_geomfromewkt":             100 * defaultCPUCostFactor,
+	"st_geomfromgeohash":          1000 * defaultCPUCostFactor,
+	"st_geomfromgeojson":          1000 * defaultCPUCostFactor,
+	"st_geomfromgml":              100 * defaultCPUCostFactor,
+	"st_geomfromkml":              1000 * defaultCPUCostFactor,
+	"st_geomfromtext":             1000 * defaultCPUCostFactor,
+	"st_geomfromtwkb":             100 * defaultCPUCostFactor,
+	"st_geomfromwkb":              100 * defaultCPUCostFactor,
+	"st_gmltosql":                 100 * defaultCPUCostFactor,
+	"st_hasarc":                   100 * defaultCPUCostFactor,
+	"st_hausdorffdistance":        10000 * defaultCPUCostFactor,
+	"st_inittopogeo":              100 * defaultCPUCostFactor,
+	"st_interiorringn":            100 * defaultCPUCostFactor,
+	"st_interpolatepoint":         1000 * defaultCPUCostFactor,
+	"st_intersection":             100 * defaultCPUCostFactor,
+	"st_intersects":               100 * defaultCPUCostFactor,
+	"st_isclosed":                 100 * defaultCPUCostFactor,
+	"st_iscollection":             1000 * defaultCPUCostFactor,
+	"st_isempty":                  100 * defaultCPUCostFactor,
+	"st_ispolygonccw":             100 * defaultCPUCostFactor,
+	"st_ispolygoncw":              100 * defaultCPUCostFactor,
+	"st_isring":                   1000 * defaultCPUCostFactor,
+	"st_issimple":                 1000 * defaultCPUCostFactor,
+	"st_isvalid":                  100 * defaultCPUCostFactor,
+	"st_isvaliddetail":            10000 * defaultCPUCostFactor,
+	"st_isvalidreason":            100 * defaultCPUCostFactor,
+	"st_isvalidtrajectory":        10000 * defaultCPUCostFactor,
+	"st_length":                   100 * defaultCPUCostFactor,
+	"st_length2d":                 100 * defaultCPUCostFactor,
+	"st_length2dspheroid":         1000 * defaultCPUCostFactor,
+	"st_lengthspheroid":           1000 * defaultCPUCostFactor,
+	"st_linecrossingdirection":    10000 * defaultCPUCostFactor,
+	"st_linefromencodedpolyline":  1000 * defaultCPUCostFactor,
+	"st_linefrommultipoint":       100 * defaultCPUCostFactor,
+	"st_linefromtext":             100 * defaultCPUCostFactor,
+	"st_linefromwkb":              100 * defaultCPUCostFactor,
+	"st_lineinterpolatepoint":     1000 * defaultCPUCostFactor,
+	"st_lineinterpolatepoints":    1000 * defaultCPUCostFactor,
+	"st_linelocatepoint":          1000 * defaultCPUCostFactor,
+	"st_linemerge":                10000 * defaultCPUCostFactor,
+	"st_linestringfromwkb":        100 * defaultCPUCostFactor,
+	"st_linesubstring":            1000 * defaultCPUCostFactor,
+	"st_linetocurve":              10000 * defaultCPUCostFactor,
+	"st_locatealong":              1000 * defaultCPUCostFactor,
+	"st_locatebetween":            1000 * defaultCPUCostFactor,
+	"st_locatebetweenelevations":  1000 * defaultCPUCostFactor,
+	"st_longestline":              100 * defaultCPUCostFactor,
+	"st_makeenvelope":             100 * defaultCPUCostFactor,
+	"st_makeline":                 100 * defaultCPUCostFactor,
+	"st_makepoint":                100 * defaultCPUCostFactor,
+	"st_makepointm":               100 * defaultCPUCostFactor,
+	"st_makepolygon":              100 * defaultCPUCostFactor,
+	"st_makevalid":                10000 * defaultCPUCostFactor,
+	"st_maxdistance":              100 * defaultCPUCostFactor,
+	"st_memsize":                  100 * defaultCPUCostFactor,
+	"st_minimumboundingcircle":    10000 * defaultCPUCostFactor,
+	"st_minimumboundingradius":    10000 * defaultCPUCostFactor,
+	"st_minimumclearance":         10000 * defaultCPUCostFactor,
+	"st_minimumclearanceline":     10000 * defaultCPUCostFactor,
+	"st_mlinefromtext":            100 * defaultCPUCostFactor,
+	"st_mlinefromwkb":             100 * defaultCPUCostFactor,
+	"st_mpointfromtext":           100 * defaultCPUCostFactor,
+	"st_mpointfromwkb":            100 * defaultCPUCostFactor,
+	"st_mpolyfromtext":            100 * defaultCPUCostFactor,
+	"st_mpolyfromwkb":             100 * defaultCPUCostFactor,
+	"st_multi":                    100 * defaultCPUCostFactor,
+	"st_multilinefromwkb":         100 * defaultCPUCostFactor,
+	"st_multilinestringfromtext":  100 * defaultCPUCostFactor,
+	"st_multipointfromtext":       100 * defaultCPUCostFactor,
+	"st_multipointfromwkb":        100 * defaultCPUCostFactor,
+	"st_multipolyfromwkb":         100 * defaultCPUCostFactor,
+	"st_multipolygonfromtext":     100 * defaultCPUCostFactor,
+	"st_node":                     10000 * defaultCPUCostFactor,
+	"st_normalize":                100 * defaultCPUCostFactor,
+	"st_npoints":                  100 * defaultCPUCostFactor,
+	"st_nrings":                   100 * defaultCPUCostFactor,
+	"st_numgeometries":            100 * defaultCPUCostFactor,
+	"st_numinteriorring":          100 * defaultCPUCostFactor,
+	"st_numinteriorrings":         100 * defaultCPUCostFactor,
+	"st_numpatches":               100 * defaultCPUCostFactor,
+	"st_numpoints":                100 * defaultCPUCostFactor,
+	"st_offsetcurve":              10000 * defaultCPUCostFactor,
+	"st_orderingequals":           10000 * defaultCPUCostFactor,
+	"st_orientedenvelope":         10000 * defaultCPUCostFactor,
+	"st_overlaps":                 10000 * defaultCPUCostFactor,
+	"st_patchn":                   100 * defaultCPUCostFactor,
+	"st_perimeter":                100 * defaultCPUCostFactor,
+	"st_perimeter2d":              100 * defaultCPUCostFactor,
+	"st_point":                    100 * defaultCPUCostFactor,
+	"st_pointfromgeohash":         1000 * defaultCPUCostFactor,
+	"st_pointfromtext":            100 * defaultCPUCostFactor,
+	"st_pointfromwkb":             100 * defaultCPUCostFactor,
+	"st_pointinsidecircle":        1000 * defaultCPUCostFactor,
+	"st_pointn":                   100 * defaultCPUCostFactor,
+	"st_pointonsurface":           1000 * defaultCPUCostFactor,
+	"st_points":                   1000 * defaultCPUCostFactor,
+	"st_polyfromtext":             100 * defaultCPUCostFactor,
+	"st_polyfromwkb":              100 * defaultCPUCostFactor,
+	"st_polygon":                  100 * defaultCPUCostFactor,
+	"st_polygonfromtext":          100 * defaultCPUCostFactor,
+	"st_polygonfromwkb":           100 * defaultCPUCostFactor,
+	"st_polygonize":               10000 * defaultCPUCostFactor,
+	"st_project":                  1000 * defaultCPUCostFactor,
+	"st_quantizecoordinates":      1000 * defaultCPUCostFactor,
+	"st_relate":                   10000 * defaultCPUCostFactor,
+	"st_relatematch":              1000 * defaultCPUCostFactor,
+	"st_removepoint":              100 * defaultCPUCostFactor,
+	"st_removerepeatedpoints":     1000 * defaultCPUCostFactor,
+	"st_reverse":                  1000 * defaultCPUCostFactor,
+	"st_rotate":                   100 * defaultCPUCostFactor,
+	"st_rotatex":                  100 * defaultCPUCostFactor,
+	"st_rotatey":                  100 * defaultCPUCostFactor,
+	"st_rotatez":                  100 * defaultCPUCostFactor,
+	"st_scale":                    100 * defaultCPUCostFactor,
+	"st_segmentize":               1000 * defaultCPUCostFactor,
+	"st_seteffectivearea":         1000 * defaultCPUCostFactor,
+	"st_setpoint":                 100 * defaultCPUCostFactor,
+	"st_setsrid":                  100 * defaultCPUCostFactor,
+	"st_sharedpaths":              10000 * defaultCPUCostFactor,
+	"st_shortestline":             1000 * defaultCPUCostFactor,
+	"st_simplify":                 100 * defaultCPUCostFactor,
+	"st_simplifypreservetopology": 10000 * defaultCPUCostFactor,
+	"st_simplifyvw":               10000 * defaultCPUCostFactor,
+	"st_snap":                     10000 * defaultCPUCostFactor,
+	"st_snaptogrid":               100 * defaultCPUCostFactor,
+	"st_split":                    10000 * defaultCPUCostFactor,
+	"st_srid":                     100 * defaultCPUCostFactor,
+	"st_startpoint":               100 * defaultCPUCostFactor,
+	"st_subdivide":                10000 * defaultCPUCostFactor,
+	"st_summary":                  100 * defaultCPUCostFactor,
+	"st_swapordinates":            100 * defaultCPUCostFactor,
+	"st_symdifference":            10000 * defaultCPUCostFactor,
+	"st_symmetricdifference":      10000 * defaultCPUCostFactor,
+	"st_tileenvelope":             100 * defaultCPUCostFactor,
+	"st_touches":                  10000 * defaultCPUCostFactor,
+	"st_transform":                100 * defaultCPUCostFactor,
+	"st_translate":                100 * defaultCPUCostFactor,
+	"st_transscale":               100 * defaultCPUCostFactor,
+	"st_unaryunion":               10000 * defaultCPUCostFactor,
+	"st_union":                    10000 * defaultCPUCostFactor,
+	"st_voronoilines":             100 * defaultCPUCostFactor,
+	"st_voronoipolygons":          100 * defaultCPUCostFactor,
+	"st_within":                   10000 * defaultCPUCostFactor,
+	"st_wkbtosql":                 100 * defaultCPUCostFactor,
+	"st_wkttosql":                 1000 * defaultCPUCostFactor,
+}
+
+// Init initializes a new coster structure with the given memo. The cost
+// factors are derived from the given cost model settings.
+func (c *coster) Init(
+	evalCtx *tree.EvalContext, mem *memo.Memo, perturbation float64, settings CostModelSettings,
+) {
 	// This initialization pattern ensures that fields are not unwittingly
 	// reused. Field reuse must be explicit.
 	*c = coster{
-		evalCtx:      evalCtx,
-		mem:          mem,
-		locality:     evalCtx.Locality,
-		perturbation: perturbation,
+		evalCtx:   evalCtx,
+		mem:       mem,
+		locality:  evalCtx.Locality,
+		estimator: DefaultCardinalityEstimator,
+	}
+	c.setPerturbation(CostPerturbation{Mode: MultiplicativePerturbation, Amount: perturbation})
+	c.initCostFactors(settings)
+	c.version = settings.Version
+	if c.version == 0 {
+		c.version = CostModelV1
+	}
+	if sd := evalCtx.SessionData(); sd != nil {
+		c.vectorized = sd.VectorizeMode != sessiondatapb.VectorizeOff
+	}
+	if sd := evalCtx.SessionData(); sd != nil && (sd.OptimizerUseWorkMemCosting || c.version >= CostModelV2) {
+		c.workMemLimit = defaultWorkMemLimit
+		if sd.WorkMemLimit > 0 {
+			c.workMemLimit = float64(sd.WorkMemLimit)
+		}
 	}
 }
 
+// setPerturbation sets the perturbation applied by the coster, replacing any
+// previous perturbation.
+func (c *coster) setPerturbation(perturbation CostPerturbation) {
+	c.perturbation = perturbation
+	c.rng = nil
+	if perturbation.Seed != 0 {
+		c.rng = rand.New(rand.NewSource(perturbation.Seed))
+	}
+	c.costed = 0
+}
+
+// initCostFactors sets the cost factors used by the coster from the given
+// cost model settings.
+func (c *coster) initCostFactors(settings CostModelSettings) {
+	cpu := memo.Cost(settings.CPUCostFactor)
+	seqIO := memo.Cost(settings.SeqIOCostFactor)
+	randIO := memo.Cost(settings.RandIOCostFactor)
+	network := memo.Cost(settings.NetworkCostFactor)
+
+	c.cpuCostFactor = cpu
+	c.seqIOCostFactor = seqIO
+	c.randIOCostFactor = randIO
+	c.lookupJoinRetrieveRowCost = 2 * seqIO
+	c.virtualScanTableDescriptorFetchCost = 25 * randIO
+	c.latencyCostFactor = cpu * network
+	c.spillCostFactor = seqIO
+	c.rangeVisitCostFactor = randIO * network
+	c.leaseholderFanoutCostFactor = 2 * randIO * network
+	c.parallelismWaveCostFactor = 10 * randIO * network
+	c.exchangeRowCostFactor = 2 * cpu * network
+	c.exchangeStreamCostFactor = 5 * randIO * network
+	c.kvWriteCostFactor = seqIO
+	c.lockedRowCostFactor = seqIO
+	c.applyJoinReplanCost = 10000 * cpu
+	c.vectorizedCostFactor = settings.VectorizedCostFactor
+	c.remoteRoundTripCostFactor = memo.Cost(settings.RemoteLatencyCostFactor)
+}
+
 // ComputeCost calculates the estimated cost of the top-level operator in a
 // candidate best expression, based on its logical properties and those of its
 // children.
@@ -466,9 +817,15 @@ func (c *coster) ComputeCost(candidate memo.RelExpr, required *physical.Required
 	case opt.SortOp:
 		cost = c.computeSortCost(candidate.(*memo.SortExpr), required)
 
+	case opt.TopKSortOp:
+		cost = c.computeTopKSortCost(candidate.(*memo.TopKSortExpr), required)
+
 	case opt.DistributeOp:
 		cost = c.computeDistributeCost(candidate.(*memo.DistributeExpr), required)
 
+	case opt.GatherOp:
+		cost = c.computeGatherCost(candidate.(*memo.GatherExpr))
+
 	case opt.ScanOp:
 		cost = c.computeScanCost(candidate.(*memo.ScanExpr), required)
 
@@ -485,13 +842,20 @@ func (c *coster) ComputeCost(candidate memo.RelExpr, required *physical.Required
 		cost = c.computeValuesCost(candidate.(*memo.ValuesExpr))
 
 	case opt.InnerJoinOp, opt.LeftJoinOp, opt.RightJoinOp, opt.FullJoinOp,
-		opt.SemiJoinOp, opt.AntiJoinOp, opt.InnerJoinApplyOp, opt.LeftJoinApplyOp,
-		opt.SemiJoinApplyOp, opt.AntiJoinApplyOp:
+		opt.SemiJoinOp, opt.AntiJoinOp:
 		// All join ops use hash join by default.
-		cost = c.computeHashJoinCost(candidate)
+		cost = c.computeHashJoinCost(candidate, required)
+
+	case opt.InnerJoinApplyOp, opt.LeftJoinApplyOp, opt.SemiJoinApplyOp, opt.AntiJoinApplyOp:
+		if c.mem.ExploreApplyJoins() {
+			cost = c.computeApplyJoinCost(candidate)
+		} else {
+			// Otherwise, apply joins are costed like hash joins.
+			cost = c.computeHashJoinCost(candidate, required)
+		}
 
 	case opt.MergeJoinOp:
-		cost = c.computeMergeJoinCost(candidate.(*memo.MergeJoinExpr))
+		cost = c.computeMergeJoinCost(candidate.(*memo.MergeJoinExpr), required)
 
 	case opt.IndexJoinOp:
 		cost = c.computeIndexJoinCost(candidate.(*memo.IndexJoinExpr), required)
@@ -525,6 +889,14 @@ func (c *coster) ComputeCost(candidate memo.RelExpr, required *physical.Required
 	case opt.ProjectSetOp:
 		cost = c.computeProjectSetCost(candidate.(*memo.ProjectSetExpr))
 
+	case opt.InsertOp, opt.UpdateOp, opt.UpsertOp, opt.DeleteOp:
+		cost = c.computeMutationCost(candidate)
+
+	case opt.BarrierOp:
+		// A Barrier only restricts the transformations that the optimizer can
+		// apply, and returns the rows of its input unchanged. It only has the
+		// one-time cost of any operator, which is added below.
+
 	case opt.ExplainOp:
 		// Technically, the cost of an Explain operation is independent of the cost
 		// of the underlying plan. However, we want to explain the plan we would get
@@ -532,16 +904,36 @@ func (c *coster) ComputeCost(candidate memo.RelExpr, required *physical.Required
 		// default behavior.
 	}
 
+	if required.Streaming && cost < hugeCost {
+		cost += c.recordIO(c.streamingPenalty(candidate, required))
+	}
+
+	if cost < hugeCost {
+		if m := c.vectorizedCostMultiplier(candidate); m != 1 {
+			c.scaleBreakdown(m)
+			cost *= memo.Cost(m)
+		}
+		if m := c.statsPenaltyMultiplier(candidate); m != 1 {
+			c.scaleBreakdown(m)
+			cost *= memo.Cost(m)
+		}
+	}
+
+	if required.Parallelism > 1 && cost < hugeCost {
+		c.scaleBreakdown(1 / float64(required.Parallelism))
+		cost = c.computeParallelCost(candidate, required, cost)
+	}
+
 	// Add a one-time cost for any operator, meant to reflect the cost of setting
 	// up execution for the operator. This makes plans with fewer operators
 	// preferable, all else being equal.
-	cost += cpuCostFactor
+	cost += c.cpuCostFactor
 
 	// Add a one-time cost for any operator with unbounded cardinality. This
 	// ensures we prefer plans that push limits as far down the tree as possible,
 	// all else being equal.
 	if candidate.Relational().Cardinality.IsUnbounded() {
-		cost += cpuCostFactor
+		cost += c.cpuCostFactor
 	}
 
 	if !cost.Less(memo.MaxCost) {
@@ -551,31 +943,226 @@ func (c *coster) ComputeCost(candidate memo.RelExpr, required *physical.Required
 		panic(errors.AssertionFailedf("node %s with MaxCost added to the memo", log.Safe(candidate.Op())))
 	}
 
-	if c.perturbation != 0 {
+	if c.perturbation.enabled() {
 		// Don't perturb the cost if we are forcing an index.
 		if cost < hugeCost {
-			// Get a random value in the range [-1.0, 1.0)
-			multiplier := 2*rand.Float64() - 1
-
-			// If perturbation is p, and the estimated cost of an expression is c,
-			// the new cost is in the range [max(0, c - pc), c + pc). For example,
-			// if p=1.5, the new cost is in the range [0, c + 1.5 * c).
-			cost += cost * memo.Cost(c.perturbation*multiplier)
-			// The cost must always be >= 0.
-			if cost < 0 {
-				cost = 0
+			cost = c.perturb(candidate, cost)
+		}
+	}
+
+	return cost
+}
+
+// perturb returns the given cost of the candidate, perturbed according to the
+// coster's perturbation.
+func (c *coster) perturb(candidate memo.RelExpr, cost memo.Cost) memo.Cost {
+	p := &c.perturbation
+	if !p.Ops.Empty() && !p.Ops.Contains(int(candidate.Op())) {
+		return cost
+	}
+
+	switch p.Mode {
+	case SwapTiesPerturbation:
+		c.costed++
+		return cost - cost*memo.Cost(swapTiesFactor*float64(c.costed))
+
+	case AbsolutePerturbation:
+		cost += memo.Cost(p.Amount * c.randomMultiplier())
+
+	default:
+		// If the amount is p, and the estimated cost of an expression is c, the
+		// new cost is in the range [max(0, c - pc), c + pc). For example, if
+		// p=1.5, the new cost is in the range [0, c + 1.5 * c).
+		cost += cost * memo.Cost(p.Amount*c.randomMultiplier())
+	}
+
+	// The cost must always be >= 0.
+	if cost < 0 {
+		cost = 0
+	}
+	return cost
+}
+
+// randomMultiplier returns a random value in the range [-1.0, 1.0).
+func (c *coster) randomMultiplier() float64 {
+	if c.rng != nil {
+		return 2*c.rng.Float64() - 1
+	}
+	return 2*rand.Float64() - 1
+}
+
+// ComputeCosts is part of the BatchCoster interface. The row count of the group of
+// the first candidate, and the types of its output columns, are only derived
+// once for the batch. Candidates are costed in order, so a perturbation of
+// their costs is the same as if ComputeCost were called for each of them.
+func (c *coster) ComputeCosts(
+	candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	if len(candidates) == 0 {
+		return
+	}
+	group := candidates[0].FirstExpr()
+	c.batch = costBatch{group: group, rowCount: c.estimator.EstimateRowCount(group)}
+	if c.vectorized && c.vectorizedCostFactor != 1 {
+		c.batch.datumVecCols = c.hasDatumVecCols(group.Relational().OutputCols)
+	}
+	for i, candidate := range candidates {
+		costs[i] = c.ComputeCost(candidate, required)
+	}
+	c.batch = costBatch{}
+}
+
+// ComputeCostBreakdown is part of the Coster interface. The cost of each
+// resource is recorded as the cost of the expression is computed, and any cost
+// that is not attributed to IO, network or memory is attributed to CPU. The
+// cost is not perturbed.
+func (c *coster) ComputeCostBreakdown(
+	candidate memo.RelExpr, required *physical.Required,
+) memo.CostBreakdown {
+	var breakdown memo.CostBreakdown
+	perturbation := c.perturbation
+	c.breakdown, c.perturbation = &breakdown, CostPerturbation{}
+	cost := c.ComputeCost(candidate, required)
+	c.breakdown, c.perturbation = nil, perturbation
+
+	breakdown.CPU = cost - breakdown.IO - breakdown.Network - breakdown.Memory
+	if breakdown.CPU < 0 {
+		breakdown.CPU = 0
+	}
+	return breakdown
+}
+
+// ComputeCostInterval is part of the Coster interface. The cost of an
+// expression is roughly proportional to the number of rows that it processes,
+// so the interval is derived from the factor by which the row counts of its
+// inputs may be wrong.
+func (c *coster) ComputeCostInterval(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.CostInterval {
+	if cost >= hugeCost {
+		return memo.CostInterval{Low: cost, Estimate: cost, High: cost}
+	}
+	uncertainty := 1.0
+	found := false
+	for i, n := 0, candidate.ChildCount(); i < n; i++ {
+		if child, ok := candidate.Child(i).(memo.RelExpr); ok {
+			found = true
+			uncertainty = math.Max(uncertainty, c.rowCountUncertainty(child))
+		}
+	}
+	if !found {
+		// The cost of an expression without inputs, such as a scan, is
+		// proportional to the number of rows that it returns.
+		uncertainty = c.rowCountUncertainty(candidate)
+	}
+	return memo.CostInterval{
+		Low:      cost / memo.Cost(uncertainty),
+		Estimate: cost,
+		High:     cost * memo.Cost(uncertainty),
+	}
+}
+
+// rowCountUncertainty returns the factor by which the estimated row count of
+// the given expression may be wrong, in either direction. Each expression that
+// filters or combines rows, such as a constrained scan, a select or a join,
+// compounds the uncertainty of its inputs. The uncertainty is a logical
+// property, so it is the same for every expression in a memo group.
+func (c *coster) rowCountUncertainty(e memo.RelExpr) float64 {
+	e = e.FirstExpr()
+	if uncertainty, ok := c.uncertainties[e]; ok {
+		return uncertainty
+	}
+
+	rel := e.Relational()
+	selectivityUncertainty := float64(statsSelectivityUncertainty)
+	if !rel.Stats.Available {
+		selectivityUncertainty = defaultSelectivityUncertainty
+	}
+
+	uncertainty := 1.0
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		if !rel.Stats.Available {
+			// The size of the table is unknown.
+			uncertainty = defaultSelectivityUncertainty
+		}
+		if !t.IsUnfiltered(c.mem.Metadata()) {
+			uncertainty *= selectivityUncertainty
+		}
+
+	default:
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if child, ok := e.Child(i).(memo.RelExpr); ok {
+				uncertainty *= c.rowCountUncertainty(child)
 			}
 		}
+		switch e.Op() {
+		case opt.SelectOp, opt.GroupByOp, opt.DistinctOnOp, opt.EnsureDistinctOnOp,
+			opt.UpsertDistinctOnOp, opt.EnsureUpsertDistinctOnOp, opt.ProjectSetOp,
+			opt.UnionOp, opt.IntersectOp, opt.IntersectAllOp, opt.ExceptOp, opt.ExceptAllOp:
+			uncertainty *= selectivityUncertainty
+
+		default:
+			if opt.IsJoinOp(e) {
+				uncertainty *= selectivityUncertainty
+			}
+		}
+	}
+
+	// The row count cannot exceed the maximum cardinality of the expression.
+	if rowCount := c.rowCount(e); !rel.Cardinality.IsUnbounded() && rowCount > 0 {
+		uncertainty = math.Min(uncertainty, math.Max(1, float64(rel.Cardinality.Max)/rowCount))
+	}
+	uncertainty = math.Min(uncertainty, maxRowCountUncertainty)
+
+	if c.uncertainties == nil {
+		c.uncertainties = make(map[memo.RelExpr]float64)
+	}
+	c.uncertainties[e] = uncertainty
+	return uncertainty
+}
+
+// recordIO attributes the given cost to IO if a breakdown is being computed,
+// and returns the cost.
+func (c *coster) recordIO(cost memo.Cost) memo.Cost {
+	if c.breakdown != nil {
+		c.breakdown.IO += cost
 	}
+	return cost
+}
 
+// recordNetwork attributes the given cost to the network if a breakdown is
+// being computed, and returns the cost.
+func (c *coster) recordNetwork(cost memo.Cost) memo.Cost {
+	if c.breakdown != nil {
+		c.breakdown.Network += cost
+	}
+	return cost
+}
+
+// recordMemory attributes the given cost to memory if a breakdown is being
+// computed, and returns the cost.
+func (c *coster) recordMemory(cost memo.Cost) memo.Cost {
+	if c.breakdown != nil {
+		c.breakdown.Memory += cost
+	}
 	return cost
 }
 
+// scaleBreakdown scales the costs recorded so far if a breakdown is being
+// computed. It must be called whenever the cost of an expression is scaled
+// after costs have been recorded.
+func (c *coster) scaleBreakdown(factor float64) {
+	if c.breakdown != nil {
+		c.breakdown.Scale(factor)
+	}
+}
+
 func (c *coster) computeTopKCost(topk *memo.TopKExpr, required *physical.Required) memo.Cost {
 	rel := topk.Relational()
-	outputRowCount := rel.Stats.RowCount
+	outputRowCount := c.rowCount(topk)
 
-	inputRowCount := topk.Input.Relational().Stats.RowCount
+	inputRowCount := c.rowCount(topk.Input)
 	if !required.Ordering.Any() {
 		// When there is a partial ordering of the input rows' sort columns, we may
 		// be able to reduce the number of input rows needed to find the top K rows.
@@ -584,10 +1171,10 @@ func (c *coster) computeTopKCost(topk *memo.TopKExpr, required *physical.Require
 	// Add the cost of sorting.
 	// Start with a cost of storing each row; TopK sort only stores K rows in a
 	// max heap.
-	cost := memo.Cost(cpuCostFactor * float64(rel.OutputCols.Len()) * outputRowCount)
+	cost := c.cpuCostFactor * memo.Cost(rel.OutputCols.Len()) * memo.Cost(outputRowCount)
 
 	// Add buffering cost for the output rows.
-	cost += c.rowBufferCost(outputRowCount)
+	cost += c.recordMemory(c.bufferCost(topk.Input, rel.OutputCols, outputRowCount))
 
 	// In the worst case, there are O(N*log(K)) comparisons to compare each row in
 	// the input to the top of the max heap and sift the max heap if each row
@@ -600,6 +1187,28 @@ func (c *coster) computeTopKCost(topk *memo.TopKExpr, required *physical.Require
 	return cost
 }
 
+// computeTopKSortCost is similar to computeTopKCost, except that the
+// enforcer has the same logical properties as its input, so the number of
+// output rows is bounded by K rather than by the row count of the group.
+func (c *coster) computeTopKSortCost(
+	topk *memo.TopKSortExpr, required *physical.Required,
+) memo.Cost {
+	rel := topk.Relational()
+	inputRowCount := c.rowCount(topk)
+	outputRowCount := math.Min(inputRowCount, float64(topk.K))
+
+	// Start with a cost of storing each row in the max heap.
+	cost := c.cpuCostFactor * memo.Cost(rel.OutputCols.Len()) * memo.Cost(outputRowCount)
+
+	// Add buffering cost for the output rows.
+	cost += c.recordMemory(c.bufferCost(topk.Input, rel.OutputCols, outputRowCount))
+
+	// In the worst case, there are O(N*log(K)) comparisons.
+	cost += c.rowCmpCost(len(required.Ordering.Columns)) * memo.Cost((1+math.Log2(math.Max(outputRowCount, 1)))*inputRowCount)
+
+	return cost
+}
+
 func (c *coster) computeSortCost(sort *memo.SortExpr, required *physical.Required) memo.Cost {
 	// We calculate the cost of a (potentially) segmented sort.
 	//
@@ -613,33 +1222,45 @@ func (c *coster) computeSortCost(sort *memo.SortExpr, required *physical.Require
 	numPreorderedCols := len(sort.InputOrdering.Columns)
 
 	rel := sort.Relational()
-	stats := rel.Stats
-	numSegments := c.countSegments(sort)
+	rowCount := c.rowCount(sort)
+	numSegments := countSegments(c.mem, sort)
+	segmentSize := rowCount / numSegments
+
+	if !sort.InputOrdering.Any() && required.LimitHint != 0 {
+		// A segmented sort returns the rows of each segment as soon as it has
+		// been sorted, so if only LimitHint rows are needed, only the segments
+		// that contain them are read and sorted. A full sort, on the other hand,
+		// must read and sort all rows before returning the first one.
+		rowCount = segmentedSortInputLimitHint(rowCount, numSegments, required.LimitHint)
+		numSegments = math.Max(1, math.Ceil(rowCount/math.Max(segmentSize, 1)))
+	}
 
 	// Start with a cost of storing each row; this takes the total number of
 	// columns into account so that a sort on fewer columns is preferred (e.g.
 	// sort before projecting a new column).
-	cost := memo.Cost(cpuCostFactor * float64(rel.OutputCols.Len()) * stats.RowCount)
+	cost := c.cpuCostFactor * memo.Cost(rel.OutputCols.Len()) * memo.Cost(rowCount)
 
 	if !sort.InputOrdering.Any() {
 		// Add the cost for finding the segments: each row is compared to the
 		// previous row on the preordered columns. Most of these comparisons will
 		// yield equality, so we don't use rowCmpCost(): we expect to have to
 		// compare all preordered columns.
-		cost += cpuCostFactor * memo.Cost(numPreorderedCols) * memo.Cost(stats.RowCount)
+		cost += c.cpuCostFactor * memo.Cost(numPreorderedCols) * memo.Cost(rowCount)
 	}
 
 	// Add the cost to sort the segments. On average, each row is involved in
 	// O(log(segmentSize)) comparisons.
 	numCmpOpsPerRow := float64(1)
-	if segmentSize := stats.RowCount / numSegments; segmentSize > 1 {
+	if segmentSize > 1 {
 		numCmpOpsPerRow += math.Log2(segmentSize)
 
 		// Add a cost for buffering rows that takes into account increased memory
-		// pressure and the possibility of spilling to disk.
-		cost += memo.Cost(numSegments) * c.rowBufferCost(segmentSize)
+		// pressure and the possibility of spilling to disk. Only one segment is
+		// buffered at a time.
+		segmentCost := c.bufferCost(sort.Input, rel.OutputCols, segmentSize)
+		cost += c.recordMemory(memo.Cost(numSegments) * segmentCost)
 	}
-	cost += c.rowCmpCost(numKeyCols-numPreorderedCols) * memo.Cost(numCmpOpsPerRow*stats.RowCount)
+	cost += c.rowCmpCost(numKeyCols-numPreorderedCols) * memo.Cost(numCmpOpsPerRow*rowCount)
 	// TODO(harding): Add the CPU cost of emitting the output rows. This should be
 	// done in conjunction with computeTopKCost.
 	return cost
@@ -650,7 +1271,34 @@ func (c *coster) computeDistributeCost(
 ) memo.Cost {
 	// TODO(rytaft): Compute a real cost here. Currently we just add a tiny cost
 	// as a placeholder.
-	return cpuCostFactor
+	return c.recordNetwork(c.cpuCostFactor)
+}
+
+func (c *coster) computeGatherCost(gather *memo.GatherExpr) memo.Cost {
+	// Each row must be sent from the stream that produced it to the gathering
+	// stream, and each stream must be set up.
+	rowCount := c.rowCount(gather)
+	cost := memo.Cost(rowCount) * c.exchangeRowCostFactor
+	cost += memo.Cost(gather.InputParallelism) * c.exchangeStreamCostFactor
+	return c.recordNetwork(cost)
+}
+
+// computeParallelCost returns the cost of executing the given candidate in the
+// number of parallel streams required by the Parallelism property, given the
+// cost of executing it serially. The work is divided evenly between the
+// streams, although a parallel hash join must also repartition its inputs so
+// that rows with the same equality column values are sent to the same stream.
+func (c *coster) computeParallelCost(
+	candidate memo.RelExpr, required *physical.Required, serialCost memo.Cost,
+) memo.Cost {
+	cost := serialCost / memo.Cost(required.Parallelism)
+	switch candidate.Op() {
+	case opt.InnerJoinOp, opt.LeftJoinOp, opt.SemiJoinOp, opt.AntiJoinOp:
+		leftRowCount := c.rowCount(candidate.Child(0).(memo.RelExpr))
+		rightRowCount := c.rowCount(candidate.Child(1).(memo.RelExpr))
+		cost += c.recordNetwork(memo.Cost(leftRowCount+rightRowCount) * c.exchangeRowCostFactor)
+	}
+	return cost
 }
 
 func (c *coster) computeScanCost(scan *memo.ScanExpr, required *physical.Required) memo.Cost {
@@ -672,7 +1320,7 @@ func (c *coster) computeScanCost(scan *memo.ScanExpr, required *physical.Require
 	}
 
 	stats := scan.Relational().Stats
-	rowCount := stats.RowCount
+	rowCount := c.rowCount(scan)
 	if isUnfiltered && c.evalCtx != nil && c.evalCtx.SessionData().DisallowFullTableScans {
 		isLarge := !stats.Available || rowCount > c.evalCtx.SessionData().LargeFullScanRows
 		if isLarge {
@@ -690,11 +1338,19 @@ func (c *coster) computeScanCost(scan *memo.ScanExpr, required *physical.Require
 	} else if scan.InvertedConstraint != nil {
 		numSpans = len(scan.InvertedConstraint)
 	}
-	baseCost := memo.Cost(numSpans * randIOCostFactor)
+	// A scan with a limit hint is expected to stop once it has fetched the first
+	// LimitHint rows, so it only visits the spans that contain them. Like the
+	// round trips below, this is only taken into account if join limit hints are
+	// enabled.
+	if c.mem.UseJoinLimitHints() && required.LimitHint != 0 && numSpans > 1 &&
+		rowCount > required.LimitHint {
+		numSpans = int(math.Max(1, math.Ceil(float64(numSpans)*required.LimitHint/rowCount)))
+	}
+	baseCost := c.recordIO(memo.Cost(numSpans) * c.randIOCostFactor)
 
 	// If this is a virtual scan, add the cost of fetching table descriptors.
 	if c.mem.Metadata().Table(scan.Table).IsVirtualTable() {
-		baseCost += virtualScanTableDescriptorFetchCost
+		baseCost += c.recordIO(c.virtualScanTableDescriptorFetchCost)
 	}
 
 	// Performing a reverse scan is more expensive than a forward scan, but it's
@@ -702,10 +1358,11 @@ func (c *coster) computeScanCost(scan *memo.ScanExpr, required *physical.Require
 	// choose a reverse scan over a sort, add the reverse scan cost before we
 	// alter the row count for unbounded scan penalties below. This cost must also
 	// be added before adjusting the row count for the limit hint.
-	if ordering.ScanIsReverse(scan, &required.Ordering) {
+	isReverse := ordering.ScanIsReverse(scan, &required.Ordering)
+	if isReverse {
 		if rowCount > 1 {
 			// Need to do binary search to seek to the previous row.
-			perRowCost += memo.Cost(math.Log2(rowCount)) * cpuCostFactor
+			perRowCost += memo.Cost(math.Log2(rowCount)) * c.cpuCostFactor
 		}
 	}
 
@@ -722,10 +1379,30 @@ func (c *coster) computeScanCost(scan *memo.ScanExpr, required *physical.Require
 		if partitionCount := index.PartitionCount(); partitionCount > 1 {
 			// Subtract 1 since we already accounted for the first partition when
 			// counting spans.
-			baseCost += memo.Cost(partitionCount-1) * randIOCostFactor
+			baseCost += c.recordIO(memo.Cost(partitionCount-1) * c.randIOCostFactor)
 		}
 	}
 
+	// Add the cost of visiting each range and leaseholder node that the scan is
+	// expected to touch. This allows the coster to distinguish between a scan
+	// of a single range and a scan of the same number of rows spread across
+	// hundreds of ranges.
+	baseCost += c.recordNetwork(c.rangeDistributionCost(scan, numSpans, required))
+
+	// Add the latency of the round trips to the index if it is likely to be
+	// remote. The spans are sent in a single batch, but the rows are returned
+	// in batches of at most ProductionKVBatchSize keys. Scans that only target
+	// partitions located in the gateway region, such as the local scan of a
+	// locality optimized search, do not incur any remote round trips.
+	if !c.scanTargetsLocalPartitions(scan) {
+		fetchedRowCount := rowCount
+		if c.mem.UseJoinLimitHints() && required.LimitHint != 0 {
+			fetchedRowCount = math.Min(rowCount, required.LimitHint)
+		}
+		roundTrips := 1 + math.Floor(fetchedRowCount/float64(rowinfra.ProductionKVBatchSize))
+		baseCost += c.recordNetwork(c.remoteLatencyCost(scan.Table, scan.Index, roundTrips))
+	}
+
 	// Add a penalty if the cardinality exceeds the row count estimate. Adding a
 	// few rows worth of cost helps prevent surprising plans for very small tables
 	// or for when stats are stale.
@@ -739,22 +1416,40 @@ func (c *coster) computeScanCost(scan *memo.ScanExpr, required *physical.Require
 		rowCount = math.Min(rowCount, required.LimitHint)
 	}
 
-	cost := baseCost + memo.Cost(rowCount)*(seqIOCostFactor+perRowCost)
+	cost := baseCost + memo.Cost(rowCount)*(c.seqIOCostFactor+perRowCost)
+	c.recordIO(memo.Cost(rowCount) * c.seqIOCostFactor)
+
+	// Add the cost of locking the rows. A locking scan locks every row that it
+	// reads, including those that are later discarded by a filter, so a
+	// narrower constrained scan locks fewer rows than a wider one. Locked rows
+	// are only charged as of CostModelV4.
+	if scan.IsLocking() && c.version >= CostModelV4 {
+		lockCost := memo.Cost(rowCount) * c.lockedRowCostFactor
+		if isReverse {
+			lockCost *= 1 + reverseLockingScanPenalty
+		}
+		cost += lockCost
+	}
 
 	// If this scan is locality optimized, divide the cost by 3 in order to make
 	// the total cost of the two scans in the locality optimized plan less than
-	// the cost of the single scan in the non-locality optimized plan.
+	// the cost of the single scan in the non-locality optimized plan. If the
+	// remote round trip cost is set, the remote scan is additionally charged
+	// for its round trips above, while the local scan is not, so the discount
+	// also reflects that the remote scan is only executed if the local scan
+	// returns no rows.
 	// TODO(rytaft): This is hacky. We should really be making this determination
 	// based on the latency between regions.
 	if scan.LocalityOptimized {
 		cost /= 3
+		c.scaleBreakdown(1.0 / 3)
 	}
 	return cost
 }
 
 func (c *coster) computeSelectCost(sel *memo.SelectExpr, required *physical.Required) memo.Cost {
 	// Typically the filter has to be evaluated on each input row.
-	inputRowCount := sel.Input.Relational().Stats.RowCount
+	inputRowCount := c.rowCount(sel.Input)
 
 	// If there is a LimitHint, n, it is expected that the filter will only be
 	// evaluated on the number of rows required to produce n rows.
@@ -771,32 +1466,53 @@ func (c *coster) computeSelectCost(sel *memo.SelectExpr, required *physical.Requ
 
 func (c *coster) computeProjectCost(prj *memo.ProjectExpr) memo.Cost {
 	// Each synthesized column causes an expression to be evaluated on each row.
-	rowCount := prj.Relational().Stats.RowCount
+	rowCount := c.rowCount(prj)
 	synthesizedColCount := len(prj.Projections)
-	cost := memo.Cost(rowCount) * memo.Cost(synthesizedColCount) * cpuCostFactor
+	cost := memo.Cost(rowCount) * memo.Cost(synthesizedColCount) * c.cpuCostFactor
 
 	// Add the CPU cost of emitting the rows.
-	cost += memo.Cost(rowCount) * cpuCostFactor
+	cost += memo.Cost(rowCount) * c.cpuCostFactor
 	return cost
 }
 
 func (c *coster) computeInvertedFilterCost(invFilter *memo.InvertedFilterExpr) memo.Cost {
-	// The filter has to be evaluated on each input row.
-	inputRowCount := invFilter.Input.Relational().Stats.RowCount
-	cost := memo.Cost(inputRowCount) * cpuCostFactor
+	// The filter has to be evaluated on each input row. Each row is added to
+	// the set of rows of every span of the expression that contains it, and the
+	// sets are then combined by each union or intersection in the expression,
+	// so the cost per row grows with the number of set operations.
+	inputRowCount := c.rowCount(invFilter.Input)
+	setOps := countSetOperations(invFilter.InvertedExpression)
+	cost := memo.Cost(inputRowCount) * c.cpuCostFactor * memo.Cost(1+setOps)
 	return cost
 }
 
+// countSetOperations returns the number of union and intersection operations
+// in the given span expression.
+func countSetOperations(e *inverted.SpanExpression) int {
+	if e == nil || e.Operator == inverted.None {
+		return 0
+	}
+	count := 1
+	if left, ok := e.Left.(*inverted.SpanExpression); ok {
+		count += countSetOperations(left)
+	}
+	if right, ok := e.Right.(*inverted.SpanExpression); ok {
+		count += countSetOperations(right)
+	}
+	return count
+}
+
 func (c *coster) computeValuesCost(values *memo.ValuesExpr) memo.Cost {
-	return memo.Cost(values.Relational().Stats.RowCount) * cpuCostFactor
+	return memo.Cost(c.rowCount(values)) * c.cpuCostFactor
 }
 
-func (c *coster) computeHashJoinCost(join memo.RelExpr) memo.Cost {
+func (c *coster) computeHashJoinCost(join memo.RelExpr, required *physical.Required) memo.Cost {
 	if join.Private().(*memo.JoinPrivate).Flags.Has(memo.DisallowHashJoinStoreRight) {
 		return hugeCost
 	}
-	leftRowCount := join.Child(0).(memo.RelExpr).Relational().Stats.RowCount
-	rightRowCount := join.Child(1).(memo.RelExpr).Relational().Stats.RowCount
+	leftRowCount := c.rowCount(join.Child(0).(memo.RelExpr))
+	rightRowCount := c.rowCount(join.Child(1).(memo.RelExpr))
+	buffered := join.Child(1).(memo.RelExpr)
 	if (join.Op() == opt.SemiJoinOp || join.Op() == opt.AntiJoinOp) && leftRowCount < rightRowCount {
 		// If we have a semi or an anti join, during the execbuilding we choose
 		// the relation with smaller cardinality to be on the right side, so we
@@ -804,6 +1520,22 @@ func (c *coster) computeHashJoinCost(join memo.RelExpr) memo.Cost {
 		// TODO(raduberinde): we might also need to look at memo.JoinFlags when
 		// choosing a side.
 		leftRowCount, rightRowCount = rightRowCount, leftRowCount
+		buffered = join.Child(0).(memo.RelExpr)
+	}
+
+	// The left input of an inner or left hash join is streamed after the hash
+	// table has been built, so if only LimitHint rows are needed, the join can
+	// stop before it has processed every left row. The right input must still
+	// be read in its entirety. This only applies if join limit hints are
+	// enabled.
+	processedFraction := 1.0
+	switch join.Op() {
+	case opt.InnerJoinOp, opt.LeftJoinOp:
+		limitHint := joinInputLimitHint(join, 0, required.LimitHint)
+		if c.mem.UseJoinLimitHints() && limitHint != 0 && limitHint < leftRowCount {
+			processedFraction = limitHint / leftRowCount
+			leftRowCount = limitHint
+		}
 	}
 
 	// A hash join must process every row from both tables once.
@@ -812,11 +1544,11 @@ func (c *coster) computeHashJoinCost(join memo.RelExpr) memo.Cost {
 	// right side is the one stored in the hashtable, so we use a larger factor
 	// for that side. This ensures that a join with the smaller right side is
 	// preferred to the symmetric join.
-	cost := memo.Cost(1.25*leftRowCount+1.75*rightRowCount) * cpuCostFactor
+	cost := memo.Cost(1.25*leftRowCount+1.75*rightRowCount) * c.cpuCostFactor
 
 	// Add a cost for buffering rows that takes into account increased memory
 	// pressure and the possibility of spilling to disk.
-	cost += c.rowBufferCost(rightRowCount)
+	cost += c.recordMemory(c.bufferCost(buffered, buffered.Relational().OutputCols, rightRowCount))
 
 	// Compute filter cost. Fetch the equality columns so they can be
 	// ignored later.
@@ -844,19 +1576,63 @@ func (c *coster) computeHashJoinCost(join memo.RelExpr) memo.Cost {
 	if !ok {
 		// This can happen as part of testing. In this case just return the number
 		// of rows.
-		rowsProcessed = join.Relational().Stats.RowCount
+		rowsProcessed = c.rowCount(join)
 	}
-	cost += memo.Cost(rowsProcessed) * filterPerRow
+	cost += memo.Cost(rowsProcessed*processedFraction) * filterPerRow
+
+	return cost
+}
 
+// computeApplyJoinCost returns the cost of an apply join. An apply join
+// re-plans and executes its right input for each row of its left input, with
+// the outer columns replaced by constants. The cost of the right input in the
+// memo is the cost of executing it once with unbound outer columns, which
+// ignores the index constraints that the outer columns become once they are
+// replaced, so it is not added to the cost of the join (see
+// isApplyJoinRightInput). Instead, each execution of the right input is
+// assumed to retrieve its rows as a lookup would, and the number of rows per
+// execution is estimated by the statistics of the right input, which treat
+// the outer columns as constants. It is only used if apply joins are explored
+// (see memo.Memo.ExploreApplyJoins).
+func (c *coster) computeApplyJoinCost(join memo.RelExpr) memo.Cost {
+	leftRowCount := c.rowCount(join.Child(0).(memo.RelExpr))
+	rightRowCount := c.rowCount(join.Child(1).(memo.RelExpr))
+
+	// Each left row requires the right input to be re-planned, and at least one
+	// random I/O to execute it.
+	cost := memo.Cost(leftRowCount) * c.applyJoinReplanCost
+	cost += c.recordIO(memo.Cost(leftRowCount) * c.randIOCostFactor)
+
+	// Add the cost of retrieving the rows of each execution of the right input.
+	rightRows := memo.Cost(leftRowCount * rightRowCount)
+	cost += c.recordIO(rightRows * c.lookupJoinRetrieveRowCost)
+	cost += rightRows * c.cpuCostFactor
+
+	// Add the cost of the remaining filters, and the CPU cost of emitting the
+	// rows.
+	on := join.Child(2).(*memo.FiltersExpr)
+	filterSetup, filterPerRow := c.computeFiltersCost(*on, util.FastIntMap{})
+	cost += filterSetup + rightRows*filterPerRow
 	return cost
 }
 
-func (c *coster) computeMergeJoinCost(join *memo.MergeJoinExpr) memo.Cost {
+// isApplyJoinRightInput returns true if the nth child of the given expression
+// is the right input of an apply join, and apply joins are costed by
+// computeApplyJoinCost (see memo.Memo.ExploreApplyJoins). The cost of the right
+// input of such an apply join is accounted for by the coster, so it is not
+// added to the cost of the join.
+func isApplyJoinRightInput(mem *memo.Memo, e opt.Expr, nth int) bool {
+	return nth == 1 && opt.IsJoinApplyOp(e) && mem.ExploreApplyJoins()
+}
+
+func (c *coster) computeMergeJoinCost(
+	join *memo.MergeJoinExpr, required *physical.Required,
+) memo.Cost {
 	if join.MergeJoinPrivate.Flags.Has(memo.DisallowMergeJoin) {
 		return hugeCost
 	}
-	leftRowCount := join.Left.Relational().Stats.RowCount
-	rightRowCount := join.Right.Relational().Stats.RowCount
+	leftRowCount := c.rowCount(join.Left)
+	rightRowCount := c.rowCount(join.Right)
 
 	if (join.Op() == opt.SemiJoinOp || join.Op() == opt.AntiJoinOp) && leftRowCount < rightRowCount {
 		// If we have a semi or an anti join, during the execbuilding we choose
@@ -867,11 +1643,21 @@ func (c *coster) computeMergeJoinCost(join *memo.MergeJoinExpr) memo.Cost {
 		leftRowCount, rightRowCount = rightRowCount, leftRowCount
 	}
 
+	// A merge join streams both of its inputs, so if only LimitHint rows are
+	// needed, it only processes a fraction of the rows of each input. This only
+	// applies if join limit hints are enabled.
+	processedFraction := 1.0
+	if limitHint := joinInputLimitHint(join, 0, required.LimitHint); c.mem.UseJoinLimitHints() && limitHint != 0 {
+		processedFraction = math.Min(1, limitHint/c.rowCount(join.Left))
+		leftRowCount *= processedFraction
+		rightRowCount *= processedFraction
+	}
+
 	// The vectorized merge join in some cases buffers rows from the right side
 	// whereas the left side is processed in a streaming fashion. To account for
 	// this difference, we multiply both row counts so that a join with the
 	// smaller right side is preferred to the symmetric join.
-	cost := memo.Cost(0.9*leftRowCount+1.1*rightRowCount) * cpuCostFactor
+	cost := memo.Cost(0.9*leftRowCount+1.1*rightRowCount) * c.cpuCostFactor
 
 	filterSetup, filterPerRow := c.computeFiltersCost(join.On, util.FastIntMap{})
 	cost += filterSetup
@@ -884,7 +1670,7 @@ func (c *coster) computeMergeJoinCost(join *memo.MergeJoinExpr) memo.Cost {
 		// logPropsBuilder.clear() is called.
 		panic(errors.AssertionFailedf("could not get rows processed for merge join"))
 	}
-	cost += memo.Cost(rowsProcessed) * filterPerRow
+	cost += memo.Cost(rowsProcessed*processedFraction) * filterPerRow
 	return cost
 }
 
@@ -935,7 +1721,7 @@ func (c *coster) computeIndexLookupJoinCost(
 	localityOptimized bool,
 ) memo.Cost {
 	input := join.Child(0).(memo.RelExpr)
-	lookupCount := input.Relational().Stats.RowCount
+	lookupCount := c.rowCount(input)
 
 	// Take into account that the "internal" row count is higher, according to
 	// the selectivities of the conditions. In particular, we need to ignore
@@ -958,7 +1744,7 @@ func (c *coster) computeIndexLookupJoinCost(
 	// expensive lookup join might have a lower cost if its limit hint estimates
 	// that most rows will not be needed.
 	if required.LimitHint != 0 && lookupCount > 0 {
-		outputRows := join.Relational().Stats.RowCount
+		outputRows := c.rowCount(join)
 		unlimitedLookupCount := lookupCount
 		lookupCount = lookupJoinInputLimitHint(unlimitedLookupCount, outputRows, required.LimitHint)
 		// We scale the number of rows processed by the same factor (we are
@@ -970,7 +1756,7 @@ func (c *coster) computeIndexLookupJoinCost(
 	// The rows in the (left) input are used to probe into the (right) table.
 	// Since the matching rows in the table may not all be in the same range, this
 	// counts as random I/O.
-	perLookupCost := memo.Cost(randIOCostFactor)
+	perLookupCost := c.randIOCostFactor
 	if !lookupColsAreTableKey {
 		// If the lookup columns don't form a key, execution will have to limit
 		// KV batches which prevents running requests to multiple nodes in parallel.
@@ -982,10 +1768,10 @@ func (c *coster) computeIndexLookupJoinCost(
 	if c.mem.Metadata().Table(table).IsVirtualTable() {
 		// It's expensive to perform a lookup join into a virtual table because
 		// we need to fetch the table descriptors on each lookup.
-		perLookupCost += virtualScanTableDescriptorFetchCost
+		perLookupCost += c.virtualScanTableDescriptorFetchCost
 	}
-	perLookupCost += lookupExprCost(join)
-	cost := memo.Cost(lookupCount) * perLookupCost
+	perLookupCost += c.lookupExprCost(join)
+	cost := c.recordIO(memo.Cost(lookupCount) * perLookupCost)
 
 	filterSetup, filterPerRow := c.computeFiltersCost(on, util.FastIntMap{})
 	cost += filterSetup
@@ -996,14 +1782,25 @@ func (c *coster) computeIndexLookupJoinCost(
 	// TODO(harding): Add the cost of reading all columns in the lookup table when
 	// we cost rows by column size.
 	lookupCols := cols.Difference(input.Relational().OutputCols)
-	perRowCost := lookupJoinRetrieveRowCost + filterPerRow +
+	perRowCost := c.lookupJoinRetrieveRowCost + filterPerRow +
 		c.rowScanCost(join, table, index, lookupCols, join.Relational().Stats)
 
 	cost += memo.Cost(rowsProcessed) * perRowCost
+	c.recordIO(memo.Cost(rowsProcessed) * c.lookupJoinRetrieveRowCost)
+
+	// Add the latency of the round trips to the index if it is likely to be
+	// remote. The lookups are performed in batches. A locality optimized lookup
+	// join only sends its lookups to remote nodes if they cannot be satisfied
+	// locally, so it is not charged.
+	if !localityOptimized && lookupCount > 0 {
+		roundTrips := math.Ceil(lookupCount / joinReaderBatchSize)
+		cost += c.recordNetwork(c.remoteLatencyCost(table, index, roundTrips))
+	}
 
 	if flags.Has(memo.PreferLookupJoinIntoRight) {
 		// If we prefer a lookup join, make the cost much smaller.
 		cost *= preferLookupJoinFactor
+		c.scaleBreakdown(preferLookupJoinFactor)
 	}
 
 	// If this lookup join is locality optimized, divide the cost by 2.5 in order to make
@@ -1013,6 +1810,7 @@ func (c *coster) computeIndexLookupJoinCost(
 	// based on the latency between regions.
 	if localityOptimized {
 		cost /= 2.5
+		c.scaleBreakdown(1 / 2.5)
 	}
 	return cost
 }
@@ -1023,7 +1821,7 @@ func (c *coster) computeInvertedJoinCost(
 	if join.InvertedJoinPrivate.Flags.Has(memo.DisallowInvertedJoinIntoRight) {
 		return hugeCost
 	}
-	lookupCount := join.Input.Relational().Stats.RowCount
+	lookupCount := c.rowCount(join.Input)
 
 	// Take into account that the "internal" row count is higher, according to
 	// the selectivities of the conditions. In particular, we need to ignore
@@ -1045,7 +1843,7 @@ func (c *coster) computeInvertedJoinCost(
 	// expensive lookup join might have a lower cost if its limit hint estimates
 	// that most rows will not be needed.
 	if required.LimitHint != 0 && lookupCount > 0 {
-		outputRows := join.Relational().Stats.RowCount
+		outputRows := c.rowCount(join)
 		unlimitedLookupCount := lookupCount
 		lookupCount = lookupJoinInputLimitHint(unlimitedLookupCount, outputRows, required.LimitHint)
 		// We scale the number of rows processed by the same factor (we are
@@ -1057,14 +1855,14 @@ func (c *coster) computeInvertedJoinCost(
 	// The rows in the (left) input are used to probe into the (right) table.
 	// Since the matching rows in the table may not all be in the same range, this
 	// counts as random I/O.
-	perLookupCost := memo.Cost(randIOCostFactor)
+	perLookupCost := c.randIOCostFactor
 	// Since inverted indexes can't form a key, execution will have to
 	// limit KV batches which prevents running requests to multiple nodes
 	// in parallel.  An experiment on a 4 node cluster with a table with
 	// 100k rows split into 100 ranges showed that a "non-parallel" lookup
 	// join is about 5 times slower.
 	perLookupCost *= 5
-	cost := memo.Cost(lookupCount) * perLookupCost
+	cost := c.recordIO(memo.Cost(lookupCount) * perLookupCost)
 
 	filterSetup, filterPerRow := c.computeFiltersCost(join.On, util.FastIntMap{})
 	cost += filterSetup
@@ -1073,10 +1871,11 @@ func (c *coster) computeInvertedJoinCost(
 	// rows (relevant when we expect many resulting rows per lookup) and the CPU
 	// cost of emitting the rows.
 	lookupCols := join.Cols.Difference(join.Input.Relational().OutputCols)
-	perRowCost := lookupJoinRetrieveRowCost + filterPerRow +
+	perRowCost := c.lookupJoinRetrieveRowCost + filterPerRow +
 		c.rowScanCost(join, join.Table, join.Index, lookupCols, join.Relational().Stats)
 
 	cost += memo.Cost(rowsProcessed) * perRowCost
+	c.recordIO(memo.Cost(rowsProcessed) * c.lookupJoinRetrieveRowCost)
 	return cost
 }
 
@@ -1088,7 +1887,7 @@ func (c *coster) computeFiltersCost(
 ) (setupCost, perRowCost memo.Cost) {
 	// Add a base perRowCost so that callers do not need to have their own
 	// base per-row cost.
-	perRowCost += cpuCostFactor
+	perRowCost += c.cpuCostFactor
 	for i := range filters {
 		f := &filters[i]
 		switch f.Condition.Op() {
@@ -1111,19 +1910,19 @@ func (c *coster) computeFiltersCost(
 		case opt.FunctionOp:
 			function := f.Condition.(*memo.FunctionExpr)
 			// We are ok with the zero value here for functions not in the map.
-			perRowCost += fnCost[function.Name]
+			perRowCost += fnCost[function.Name] * (c.cpuCostFactor / defaultCPUCostFactor)
 		}
 
 		// Add a constant "setup" cost per ON condition to account for the fact that
 		// the rowsProcessed estimate alone cannot effectively discriminate between
 		// plans when RowCount is too small.
-		setupCost += cpuCostFactor
+		setupCost += c.cpuCostFactor
 	}
 	return setupCost, perRowCost
 }
 
 func (c *coster) computeZigzagJoinCost(join *memo.ZigzagJoinExpr) memo.Cost {
-	rowCount := join.Relational().Stats.RowCount
+	rowCount := c.rowCount(join)
 
 	// Assume the upper bound on scan cost to be the sum of the cost of scanning
 	// the two constituent indexes. To determine which columns are returned from
@@ -1143,7 +1942,8 @@ func (c *coster) computeZigzagJoinCost(join *memo.ZigzagJoinExpr) memo.Cost {
 
 	// Double the cost of emitting rows as well as the cost of seeking rows,
 	// given two indexes will be accessed.
-	cost := memo.Cost(rowCount) * (2*(cpuCostFactor+seqIOCostFactor) + scanCost + filterPerRow)
+	cost := memo.Cost(rowCount) * (2*(c.cpuCostFactor+c.seqIOCostFactor) + scanCost + filterPerRow)
+	c.recordIO(memo.Cost(rowCount) * 2 * c.seqIOCostFactor)
 	cost += filterSetup
 
 	// Add a penalty if the cardinality exceeds the row count estimate. Adding a
@@ -1161,8 +1961,8 @@ func (c *coster) computeZigzagJoinCost(join *memo.ZigzagJoinExpr) memo.Cost {
 
 func (c *coster) computeSetCost(set memo.RelExpr) memo.Cost {
 	// Add the CPU cost of emitting the rows.
-	outputRowCount := set.Relational().Stats.RowCount
-	cost := memo.Cost(outputRowCount) * cpuCostFactor
+	outputRowCount := c.rowCount(set)
+	cost := memo.Cost(outputRowCount) * c.cpuCostFactor
 
 	// A set operation must process every row from both tables once. UnionAll and
 	// LocalityOptimizedSearch can avoid any extra computation, but all other set
@@ -1173,27 +1973,34 @@ func (c *coster) computeSetCost(set memo.RelExpr) memo.Cost {
 	// operation by checking whether the ordering is defined in the set private.
 	if set.Op() != opt.UnionAllOp && set.Op() != opt.LocalityOptimizedSearchOp &&
 		set.Private().(*memo.SetPrivate).Ordering.Any() {
-		leftRowCount := set.Child(0).(memo.RelExpr).Relational().Stats.RowCount
-		rightRowCount := set.Child(1).(memo.RelExpr).Relational().Stats.RowCount
-		cost += memo.Cost(leftRowCount+rightRowCount) * cpuCostFactor
+		left := set.Child(0).(memo.RelExpr)
+		right := set.Child(1).(memo.RelExpr)
+		leftRowCount := c.rowCount(left)
+		rightRowCount := c.rowCount(right)
+		cost += memo.Cost(leftRowCount+rightRowCount) * c.cpuCostFactor
 
 		// Add a cost for buffering rows that takes into account increased memory
 		// pressure and the possibility of spilling to disk.
+		private := set.Private().(*memo.SetPrivate)
+		leftCols := private.LeftCols.ToSet()
+		rightCols := private.RightCols.ToSet()
 		switch set.Op() {
 		case opt.UnionOp:
-			// Hash Union is implemented as UnionAll followed by Hash Distinct.
-			cost += c.rowBufferCost(outputRowCount)
+			// Hash Union is implemented as UnionAll followed by Hash Distinct. The
+			// output columns have the same widths as the left input columns.
+			cost += c.recordMemory(c.bufferCost(left, leftCols, outputRowCount))
 
 		case opt.IntersectOp, opt.ExceptOp:
 			// Hash Intersect and Except are implemented as Hash Distinct on each
 			// input followed by a Hash Join that builds the hash table from the right
 			// input.
-			cost += c.rowBufferCost(leftRowCount) + 2*c.rowBufferCost(rightRowCount)
+			cost += c.recordMemory(c.bufferCost(left, leftCols, leftRowCount) +
+				2*c.bufferCost(right, rightCols, rightRowCount))
 
 		case opt.IntersectAllOp, opt.ExceptAllOp:
 			// Hash IntersectAll and ExceptAll are implemented as a Hash Join that
 			// builds the hash table from the right input.
-			cost += c.rowBufferCost(rightRowCount)
+			cost += c.recordMemory(c.bufferCost(right, rightCols, rightRowCount))
 
 		default:
 			panic(errors.AssertionFailedf("unhandled operator %s", set.Op()))
@@ -1207,18 +2014,18 @@ func (c *coster) computeGroupingCost(grouping memo.RelExpr, required *physical.R
 	// Start with some extra fixed overhead, since the grouping operators have
 	// setup overhead that is greater than other operators like Project. This
 	// can matter for rules like ReplaceMaxWithLimit.
-	cost := memo.Cost(cpuCostFactor)
+	cost := c.cpuCostFactor
 
 	// Add the CPU cost of emitting the rows.
-	outputRowCount := grouping.Relational().Stats.RowCount
-	cost += memo.Cost(outputRowCount) * cpuCostFactor
+	outputRowCount := c.rowCount(grouping)
+	cost += memo.Cost(outputRowCount) * c.cpuCostFactor
 
 	private := grouping.Private().(*memo.GroupingPrivate)
 	groupingColCount := private.GroupingCols.Len()
 	aggsCount := grouping.Child(1).ChildCount()
 
 	// Normally, a grouping expression must process each input row once.
-	inputRowCount := grouping.Child(0).(memo.RelExpr).Relational().Stats.RowCount
+	inputRowCount := c.rowCount(grouping.Child(0).(memo.RelExpr))
 
 	// If this is a streaming GroupBy with a limit hint, l, we only need to
 	// process enough input rows to output l rows.
@@ -1230,7 +2037,7 @@ func (c *coster) computeGroupingCost(grouping memo.RelExpr, required *physical.R
 
 	// Cost per row depends on the number of grouping columns and the number of
 	// aggregates.
-	cost += memo.Cost(inputRowCount) * memo.Cost(aggsCount+groupingColCount) * cpuCostFactor
+	cost += memo.Cost(inputRowCount) * memo.Cost(aggsCount+groupingColCount) * c.cpuCostFactor
 
 	// Add a cost that reflects the use of a hash table - unless we are doing a
 	// streaming aggregation.
@@ -1239,40 +2046,155 @@ func (c *coster) computeGroupingCost(grouping memo.RelExpr, required *physical.R
 	// input.
 	if groupingColCount > 0 && streamingType != memo.Streaming {
 		// Add the cost to build the hash table.
-		cost += memo.Cost(inputRowCount) * cpuCostFactor
+		cost += memo.Cost(inputRowCount) * c.cpuCostFactor
 
 		// Add a cost for buffering rows that takes into account increased memory
 		// pressure and the possibility of spilling to disk.
-		cost += c.rowBufferCost(outputRowCount)
+		cost += c.recordMemory(c.bufferCost(grouping, grouping.Relational().OutputCols, outputRowCount))
 	}
 
+	// Aggregates with a DISTINCT modifier must track the distinct input values
+	// seen in each group, which requires a hash table of their own.
+	cost += c.distinctAggsCost(grouping, inputRowCount)
+
+	return cost
+}
+
+// distinctAggsCost returns the cost of removing duplicate input values for the
+// aggregates with a DISTINCT modifier in the given grouping expression. Each
+// such aggregate must insert every input row into a hash table containing the
+// distinct combinations of the grouping columns and the aggregate's input
+// columns, so the cost grows with the cardinality of those columns.
+func (c *coster) distinctAggsCost(grouping memo.RelExpr, inputRowCount float64) memo.Cost {
+	private := grouping.Private().(*memo.GroupingPrivate)
+	aggs := *grouping.Child(1).(*memo.AggregationsExpr)
+	input := grouping.Child(0).(memo.RelExpr)
+	var cost memo.Cost
+	for i := range aggs {
+		agg := aggs[i].Agg
+		if filter, ok := agg.(*memo.AggFilterExpr); ok {
+			agg = filter.Input
+		}
+		if agg.Op() != opt.AggDistinctOp {
+			continue
+		}
+		cost += memo.Cost(inputRowCount) * c.cpuCostFactor
+
+		// Use the number of distinct values to estimate the size of the hash
+		// table. The stats may be unavailable if the memo has already been
+		// optimized, in which case assume every input row is distinct.
+		distinctCount := inputRowCount
+		cols := private.GroupingCols.Union(memo.ExtractAggInputColumns(aggs[i].Agg))
+		if colStat, ok := c.mem.RequestColStat(input, cols); ok {
+			distinctCount = colStat.DistinctCount
+		}
+		cost += c.recordMemory(c.bufferCost(input, cols, distinctCount))
+	}
 	return cost
 }
 
 func (c *coster) computeLimitCost(limit *memo.LimitExpr) memo.Cost {
 	// Add the CPU cost of emitting the rows.
-	cost := memo.Cost(limit.Relational().Stats.RowCount) * cpuCostFactor
+	cost := memo.Cost(c.rowCount(limit)) * c.cpuCostFactor
 	return cost
 }
 
 func (c *coster) computeOffsetCost(offset *memo.OffsetExpr) memo.Cost {
 	// Add the CPU cost of emitting the rows.
-	cost := memo.Cost(offset.Relational().Stats.RowCount) * cpuCostFactor
+	cost := memo.Cost(c.rowCount(offset)) * c.cpuCostFactor
 	return cost
 }
 
 func (c *coster) computeOrdinalityCost(ord *memo.OrdinalityExpr) memo.Cost {
 	// Add the CPU cost of emitting the rows.
-	cost := memo.Cost(ord.Relational().Stats.RowCount) * cpuCostFactor
+	cost := memo.Cost(c.rowCount(ord)) * c.cpuCostFactor
 	return cost
 }
 
 func (c *coster) computeProjectSetCost(projectSet *memo.ProjectSetExpr) memo.Cost {
 	// Add the CPU cost of emitting the rows.
-	cost := memo.Cost(projectSet.Relational().Stats.RowCount) * cpuCostFactor
+	cost := memo.Cost(c.rowCount(projectSet)) * c.cpuCostFactor
 	return cost
 }
 
+// computeMutationCost returns the cost of writing the rows produced by the
+// input of an Insert, Update, Upsert, or Delete operator. Each row requires one
+// KV write per index entry that it touches.
+//
+// For an Upsert that reads existing rows (i.e. one that has a canary column),
+// the cost depends on the estimated conflict rate. Rows that do not conflict
+// with an existing row are inserted, while rows that conflict must update the
+// existing row, which requires deleting and re-inserting the entries of any
+// secondary index with updated columns. The conflict rate is estimated from
+// the number of NULL values in the canary column. A "blind" Upsert, which has
+// no canary column, simply overwrites the existing row without reading it.
+//
+// Mutations are only charged for their writes as of CostModelV3.
+func (c *coster) computeMutationCost(mutation memo.RelExpr) memo.Cost {
+	if c.version < CostModelV3 {
+		return 0
+	}
+	private := mutation.Private().(*memo.MutationPrivate)
+	input := mutation.Child(0).(memo.RelExpr)
+	rowCount := c.rowCount(input)
+	tab := c.mem.Metadata().Table(private.Table)
+	numIndexes := tab.WritableIndexCount()
+
+	switch mutation.Op() {
+	case opt.InsertOp, opt.DeleteOp:
+		return c.recordIO(memo.Cost(rowCount*float64(numIndexes)) * c.kvWriteCostFactor)
+
+	case opt.UpdateOp:
+		return c.recordIO(memo.Cost(rowCount*c.updatedIndexWrites(private)) * c.kvWriteCostFactor)
+
+	case opt.UpsertOp:
+		if private.CanaryCol == 0 {
+			// Blind upsert.
+			return c.recordIO(memo.Cost(rowCount*float64(numIndexes)) * c.kvWriteCostFactor)
+		}
+		conflictRate := c.upsertConflictRate(input, private.CanaryCol)
+		insertWrites := (1 - conflictRate) * float64(numIndexes)
+		updateWrites := conflictRate * c.updatedIndexWrites(private)
+		return c.recordIO(memo.Cost(rowCount*(insertWrites+updateWrites)) * c.kvWriteCostFactor)
+	}
+	panic(errors.AssertionFailedf("unexpected mutation operator %s", log.Safe(mutation.Op())))
+}
+
+// updatedIndexWrites returns the number of KV writes needed to update a single
+// row. The primary index is always overwritten with a single write. Each
+// secondary index containing an updated column requires two writes: one to
+// delete the old entry and one to insert the new entry.
+func (c *coster) updatedIndexWrites(private *memo.MutationPrivate) float64 {
+	tab := c.mem.Metadata().Table(private.Table)
+	writes := 1.0
+	for i, n := 1, tab.WritableIndexCount(); i < n; i++ {
+		index := tab.Index(i)
+		for j, m := 0, index.ColumnCount(); j < m; j++ {
+			if ord := index.Column(j).Ordinal(); ord < len(private.UpdateCols) && private.UpdateCols[ord] != 0 {
+				writes += 2
+				break
+			}
+		}
+	}
+	return writes
+}
+
+// upsertConflictRate returns the estimated fraction of rows that conflict with
+// an existing row during an Upsert. A row conflicts if its canary column is
+// not NULL.
+func (c *coster) upsertConflictRate(input memo.RelExpr, canaryCol opt.ColumnID) float64 {
+	rowCount := c.rowCount(input)
+	if rowCount == 0 {
+		return 0
+	}
+	colStat, ok := c.mem.RequestColStat(input, opt.MakeColSet(canaryCol))
+	if !ok {
+		// Assume that every row conflicts, which is the most expensive case.
+		return 1
+	}
+	return math.Max(0, math.Min(1, 1-colStat.NullCount/rowCount))
+}
+
 // getOrderingColStats returns the column statistic for the columns in the
 // OrderingChoice oc. The OrderingChoice should be a member of expr. We include
 // the Memo as an argument so that functions that call this function can be used
@@ -1299,13 +2221,15 @@ func getOrderingColStats(
 }
 
 // countSegments calculates the number of segments that will be used to execute
-// the sort. If no input ordering is provided, there's only one segment.
-func (c *coster) countSegments(sort *memo.SortExpr) float64 {
-	orderedStats := getOrderingColStats(c.mem, sort, sort.InputOrdering)
+// the sort, which is the number of distinct values of the columns in its input
+// ordering. If no input ordering is provided, there's only one segment. The
+// result is always at least 1, and at most the number of rows to sort.
+func countSegments(mem *memo.Memo, sort *memo.SortExpr) float64 {
+	orderedStats := getOrderingColStats(mem, sort, sort.InputOrdering)
 	if orderedStats == nil {
 		return 1
 	}
-	return orderedStats.DistinctCount
+	return math.Max(1, math.Min(orderedStats.DistinctCount, sort.Relational().Stats.RowCount))
 }
 
 // rowCmpCost is the CPU cost to compare a pair of rows, which depends on the
@@ -1320,10 +2244,10 @@ func (c *coster) rowCmpCost(numKeyCols int) memo.Cost {
 	//   cpuCostFactor * [ 1 + Sum eqProb^(i-1) with i=1 to numKeyCols ]
 	//
 	const eqProb = 0.1
-	cost := cpuCostFactor
-	for i, c := 0, cpuCostFactor; i < numKeyCols; i, c = i+1, c*eqProb {
-		// c is cpuCostFactor * eqProb^i.
-		cost += c
+	cost := c.cpuCostFactor
+	for i, f := 0, c.cpuCostFactor; i < numKeyCols; i, f = i+1, f*eqProb {
+		// f is cpuCostFactor * eqProb^i.
+		cost += f
 	}
 
 	// There is a fixed "non-comparison" cost and a comparison cost proportional
@@ -1351,14 +2275,14 @@ func (c *coster) rowScanCost(
 
 	// Adjust cost based on how well the current locality matches the index's
 	// zone constraints.
-	var costFactor memo.Cost = cpuCostFactor
+	var costFactor memo.Cost = c.cpuCostFactor
 	if !tab.IsVirtualTable() && len(c.locality.Tiers) != 0 {
 		// If 0% of locality tiers have matching constraints, then add additional
 		// cost. If 100% of locality tiers have matching constraints, then add no
 		// additional cost. Anything in between is proportional to the number of
 		// matches.
 		adjustment := 1.0 - localityMatchScore(idx.Zone(), c.locality)
-		costFactor += latencyCostFactor * memo.Cost(adjustment)
+		costFactor += c.latencyCostFactor * memo.Cost(adjustment)
 	}
 
 	// The number of the columns in the index matter because more columns means
@@ -1428,7 +2352,206 @@ func (c *coster) rowBufferCost(rowCount float64) memo.Cost {
 		fraction = memo.Cost(rowCount-noSpillRowCount) / (spillRowCount - noSpillRowCount)
 	}
 
-	return memo.Cost(rowCount) * spillCostFactor * fraction
+	return memo.Cost(rowCount) * c.spillCostFactor * fraction
+}
+
+// bufferCost returns the cost of buffering the given number of rows, which
+// consist of the given columns of the given expression. If work mem costing is
+// disabled, it is the same as rowBufferCost. Otherwise, the memory footprint of
+// the rows is estimated from the average sizes of their columns, and the cost
+// models the memory pressure while the footprint is within the work mem limit,
+// and the cost of writing the excess rows to disk and reading them back once it
+// exceeds the limit:
+//
+//                  cost
+//                    |              /
+//                    |             /  spilling
+//                    |            /
+//     rowCount * cpu_|          _/
+//                    |      __--
+//                    |  __--  memory pressure
+//                0  _|--________|____________________  footprint
+//                    |        workmem
+//
+// This makes operators that would spill, such as hash joins with large inputs,
+// more expensive than alternatives that do not buffer their inputs, such as
+// merge joins of ordered index scans.
+func (c *coster) bufferCost(e memo.RelExpr, cols opt.ColSet, rowCount float64) memo.Cost {
+	if c.workMemLimit == 0 {
+		return c.rowBufferCost(rowCount)
+	}
+	if rowCount <= 0 {
+		return 0
+	}
+	footprint := rowCount * (c.bufferedRowWidth(e, cols) + bufferedRowOverhead)
+	cost := memo.Cost(rowCount) * c.cpuCostFactor * memo.Cost(math.Min(footprint/c.workMemLimit, 1))
+	if footprint > c.workMemLimit {
+		// Rows are spilled in proportion to the excess footprint.
+		spilledRowCount := rowCount * (footprint - c.workMemLimit) / footprint
+		cost += memo.Cost(spilledRowCount) * spillPassCount * c.spillCostFactor
+	}
+	return cost
+}
+
+// streamingPenalty returns the cost that is added to an expression that
+// buffers rows from its inputs before producing its own rows, when it is
+// required to stream them (see physical.Required.Streaming). The buffered rows
+// are charged as though they are spilled to disk, so that alternatives that
+// stream their rows, such as a merge join, a streaming aggregation, or a
+// TopKSort enforcer rather than a Sort, are preferred when there are any.
+func (c *coster) streamingPenalty(e memo.RelExpr, required *physical.Required) memo.Cost {
+	var bufferedRowCount float64
+	switch t := e.(type) {
+	case *memo.SortExpr:
+		// A segmented sort only buffers the rows of one segment at a time.
+		if !t.InputOrdering.Any() {
+			return 0
+		}
+		bufferedRowCount = c.rowCount(t.Input)
+
+	case *memo.InnerJoinExpr, *memo.LeftJoinExpr, *memo.RightJoinExpr, *memo.FullJoinExpr,
+		*memo.SemiJoinExpr, *memo.AntiJoinExpr:
+		// Hash joins build a hash table from their right input.
+		bufferedRowCount = c.rowCount(e.Child(1).(memo.RelExpr))
+
+	case *memo.GroupByExpr, *memo.DistinctOnExpr, *memo.EnsureDistinctOnExpr,
+		*memo.UpsertDistinctOnExpr, *memo.EnsureUpsertDistinctOnExpr:
+		// Hash aggregations buffer a row for each group.
+		private := e.Private().(*memo.GroupingPrivate)
+		if private.GroupingCols.Empty() ||
+			private.GroupingOrderType(&required.Ordering) != memo.NoStreaming {
+			return 0
+		}
+		bufferedRowCount = c.rowCount(e)
+
+	case *memo.UnionExpr, *memo.IntersectExpr, *memo.ExceptExpr,
+		*memo.IntersectAllExpr, *memo.ExceptAllExpr:
+		// Set operations that are not streaming use hash tables.
+		if !e.Private().(*memo.SetPrivate).Ordering.Any() {
+			return 0
+		}
+		bufferedRowCount = c.rowCount(e.Child(0).(memo.RelExpr)) +
+			c.rowCount(e.Child(1).(memo.RelExpr))
+
+	case *memo.WindowExpr:
+		// Window functions buffer the rows of each partition.
+		bufferedRowCount = c.rowCount(t.Input)
+	}
+	return memo.Cost(bufferedRowCount) * c.spillCostFactor
+}
+
+// bufferedRowWidth returns the estimated number of bytes in the given columns
+// of a row returned by the given expression, based on the average sizes of the
+// columns. The stats may be unavailable if the memo has already been
+// optimized, in which case the default column size is used.
+func (c *coster) bufferedRowWidth(e memo.RelExpr, cols opt.ColSet) float64 {
+	var width float64
+	for col, ok := cols.Next(0); ok; col, ok = cols.Next(col + 1) {
+		if colStat, ok := c.mem.RequestColStat(e, opt.MakeColSet(col)); ok {
+			width += colStat.AvgSize
+		} else {
+			width += defaultBufferedColSize
+		}
+	}
+	return width
+}
+
+// remoteLatencyCost returns the latency cost of the given number of round
+// trips to the given index. It is proportional to the likelihood that the
+// leaseholders of the index are in a different locality than the gateway,
+// which is estimated by how well the zone constraints and lease preferences of
+// the index match the gateway's locality (see localityMatchScore). An index
+// that is constrained to the gateway's region, such as a duplicate index in a
+// multi-region database, costs nothing, while an index that is constrained to
+// other regions costs remoteRoundTripCostFactor per round trip. The cost is
+// zero if the gateway's locality is unknown.
+func (c *coster) remoteLatencyCost(
+	tabID opt.TableID, idxOrd cat.IndexOrdinal, roundTrips float64,
+) memo.Cost {
+	if c.remoteRoundTripCostFactor == 0 || len(c.locality.Tiers) == 0 {
+		return 0
+	}
+	tab := c.mem.Metadata().Table(tabID)
+	if tab.IsVirtualTable() {
+		return 0
+	}
+	remoteness := 1 - localityMatchScore(tab.Index(idxOrd).Zone(), c.locality)
+	return memo.Cost(roundTrips*remoteness) * c.remoteRoundTripCostFactor
+}
+
+// scanTargetsLocalPartitions returns true if the given scan is constrained to
+// spans that all target partitions of the scanned index that are located in
+// the gateway region. It always returns false if the remote round trip cost is
+// not set, since the result is only used to determine remote latency.
+func (c *coster) scanTargetsLocalPartitions(scan *memo.ScanExpr) bool {
+	if c.remoteRoundTripCostFactor == 0 || scan.Constraint == nil {
+		return false
+	}
+	localRegion, ok := c.locality.Find(regionKey)
+	if !ok {
+		return false
+	}
+	index := c.mem.Metadata().Table(scan.Table).Index(scan.Index)
+	if index.PartitionCount() == 0 {
+		return false
+	}
+	localPartitions := getLocalPartitions(index, localRegion)
+	if localPartitions.Empty() {
+		return false
+	}
+	localSpans := getLocalSpans(c.evalCtx, index, localPartitions, scan.Constraint)
+	return localSpans.Len() == scan.Constraint.Spans.Count()
+}
+
+// rangeDistributionCost returns the cost of visiting the ranges and leaseholder
+// nodes that the given scan is expected to touch, based on the range
+// distribution of the scanned index. Rows are assumed to be uniformly
+// distributed across ranges, so the number of ranges touched is proportional
+// to the selectivity of the scan. The first range of each span is already
+// accounted for by the per-span cost, so only additional ranges are costed
+// here. If the parallelism of the plan is bounded, leaseholders beyond the
+// bound are costed as additional serial round trips. If the range distribution
+// of the index is unknown, which is always the case outside of the test
+// catalog, the cost is zero.
+func (c *coster) rangeDistributionCost(
+	scan *memo.ScanExpr, numSpans int, required *physical.Required,
+) memo.Cost {
+	dist := c.mem.Metadata().Table(scan.Table).Index(scan.Index).RangeDistribution()
+	if dist.RangeCount <= 1 {
+		return 0
+	}
+	rangeCount := float64(dist.RangeCount)
+
+	stats := scan.Relational().Stats
+	fraction := stats.Selectivity.AsFloat()
+	rowCount := c.rowCount(scan)
+	if limitHint := required.LimitHint; limitHint != 0 && rowCount > limitHint {
+		// The scan is expected to stop early, so it will only touch a fraction of
+		// the ranges spanned by its constraint.
+		fraction *= limitHint / rowCount
+	}
+
+	// Each span touches at least one range, and the scan can touch no more than
+	// the total number of ranges in the index.
+	spanCount := math.Min(float64(numSpans), rangeCount)
+	rangesTouched := math.Max(spanCount, math.Ceil(fraction*rangeCount))
+	rangesTouched = math.Min(rangesTouched, rangeCount)
+	cost := memo.Cost(rangesTouched-spanCount) * c.rangeVisitCostFactor
+
+	if dist.LeaseholderCount > 1 {
+		nodesTouched := math.Min(rangesTouched, float64(dist.LeaseholderCount))
+		cost += memo.Cost(nodesTouched-1) * c.leaseholderFanoutCostFactor
+
+		// If the parallelism of the plan is bounded, the leaseholders must be
+		// visited in successive waves of no more than MaxParallelism nodes. Each
+		// additional wave adds the latency of a round trip.
+		if maxParallelism := float64(required.MaxParallelism); maxParallelism != 0 &&
+			nodesTouched > maxParallelism {
+			waves := math.Ceil(nodesTouched / maxParallelism)
+			cost += memo.Cost(waves-1) * c.parallelismWaveCostFactor
+		}
+	}
+	return cost
 }
 
 // largeCardinalityCostPenalty returns a penalty that should be added to the
@@ -1664,14 +2787,14 @@ func topKInputLimitHint(
 }
 
 // lookupExprCost accounts for the extra CPU cost of the lookupExpr.
-func lookupExprCost(join memo.RelExpr) memo.Cost {
+func (c *coster) lookupExprCost(join memo.RelExpr) memo.Cost {
 	lookupExpr, ok := join.(*memo.LookupJoinExpr)
 	if ok {
 		// 1.1 is a fudge factor that pushes some plans over the edge when choosing
 		// between a partial index vs full index plus lookup expr in the
 		// regional_by_row.
 		// TODO(treilly): do some empirical analysis and model this better
-		return cpuCostFactor * memo.Cost(len(lookupExpr.LookupExpr)) * 1.1
+		return c.cpuCostFactor * memo.Cost(len(lookupExpr.LookupExpr)) * 1.1
 	}
 	return 0
 }
@@ -0,0 +1,88 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/errorutil"
+	"github.com/cockroachdb/errors"
+)
+
+// CrossCheckPlans contains two plans for the same statement: one that is only
+// normalized, and one that is fully optimized. Exploration rules must preserve
+// the semantics of the statement, so executing both plans must produce the
+// same results. A test harness can execute each plan and compare the results
+// to check that invariant for every statement that it runs.
+type CrossCheckPlans struct {
+	// Normalized is the optimizer that optimized a copy of the normalized
+	// expression with exploration disabled. Its memo is independent of the
+	// memo of the optimizer that returned the plans, so the two plans can be
+	// built into execution plans in any order.
+	Normalized *Optimizer
+
+	// NormalizedRoot is the root of the normalized plan, in the memo of
+	// Normalized.
+	NormalizedRoot opt.Expr
+
+	// OptimizedRoot is the root of the fully optimized plan, as returned by
+	// Optimize.
+	OptimizedRoot opt.Expr
+}
+
+// OptimizeForCrossCheck is like Optimize, but also returns a plan for the
+// normalized expression tree, which is costed and has the enforcers that it
+// requires, but to which no exploration rules were applied (see
+// DisableExplorations). It is intended for testing: it roughly doubles the
+// cost of optimization. It must be called instead of Optimize, once the
+// normalized expression has been built.
+func (o *Optimizer) OptimizeForCrossCheck() (_ CrossCheckPlans, err error) {
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return CrossCheckPlans{}, errors.AssertionFailedf(
+			"cannot cross-check a memo without a relational root",
+		)
+	}
+	var plans CrossCheckPlans
+	plans.Normalized = &Optimizer{}
+	if err := plans.Normalized.copyNormalized(o, root); err != nil {
+		return CrossCheckPlans{}, err
+	}
+	if plans.NormalizedRoot, err = plans.Normalized.Optimize(); err != nil {
+		return CrossCheckPlans{}, errors.Wrap(err, "while optimizing the normalized plan")
+	}
+	if plans.OptimizedRoot, err = o.Optimize(); err != nil {
+		return CrossCheckPlans{}, err
+	}
+	return plans, nil
+}
+
+// copyNormalized initializes the optimizer with a copy of the normalized
+// expression rooted at the given root of the memo of from, and disables
+// exploration.
+func (o *Optimizer) copyNormalized(from *Optimizer, root memo.RelExpr) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Copying the expression can panic with an internal error, which is
+			// propagated in the same way as by Optimize.
+			if ok, e := errorutil.ShouldCatch(r); ok {
+				err = e
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	o.Init(from.evalCtx, from.catalog)
+	f := o.Factory()
+	f.CopyAndReplace(root, from.mem.RootProps(), f.CopyWithoutAssigningPlaceholders)
+	o.DisableExplorations()
+	return nil
+}
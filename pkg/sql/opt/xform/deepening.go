@@ -0,0 +1,182 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/errors"
+)
+
+// SetIterativeDeepening changes the exploration strategy of the optimizer so
+// that the memo is explored in passes of increasing depth. In the first pass,
+// each group is explored only once, which applies the exploration rules to
+// its members a single time, and the resulting memo is costed. In each
+// subsequent pass, only the groups that participate in a plan whose cost is
+// within the given slack of the cost of the best plan are explored once more,
+// and the memo is re-costed. For example, a slack of 0.1 deepens the groups of
+// every plan that costs no more than 10% more than the best plan. Passes are
+// made until none of those groups can be explored further, or until a budget
+// set via SetExplorationBudgetFunc or SetBudget stops exploration.
+//
+// This focuses exploration on the parts of the memo that are most likely to
+// improve the plan, at the risk of missing a plan that would only have become
+// cheap after deeper exploration of a group that was not in focus. It is most
+// useful together with an exploration budget. It must be called before
+// Optimize.
+func (o *Optimizer) SetIterativeDeepening(slack float64) {
+	if slack < 0 {
+		panic(errors.AssertionFailedf("negative iterative deepening slack: %v", slack))
+	}
+	o.deepening = &iterativeDeepening{slack: slack, pass: 1}
+}
+
+// iterativeDeepening is the state of the exploration strategy set via
+// SetIterativeDeepening.
+type iterativeDeepening struct {
+	// slack is the fraction by which the cost of a plan can exceed the cost of
+	// the best plan for its groups to be explored in the next pass.
+	slack float64
+
+	// pass is the number of the current pass, starting at 1.
+	pass int
+
+	// focus is the set of groups that can be explored again in the current
+	// pass, identified by their first expression. It is nil in the first pass.
+	focus map[memo.RelExpr]struct{}
+}
+
+// refresh makes the given group state eligible to be optimized again in the
+// current pass. The states are refreshed lazily, as they are reached from the
+// root, so that a state which is not reached retains the lowest cost
+// expression found in a previous pass, and remains fully optimized.
+func (d *iterativeDeepening) refresh(state *groupState) {
+	if state.deepeningPass == d.pass {
+		return
+	}
+	state.deepeningPass = d.pass
+	state.fullyOptimized = false
+	state.fullyOptimizedExprs = util.FastIntSet{}
+	state.budgetPrunedExprs = util.FastIntSet{}
+	state.tieBreakExpr = nil
+}
+
+// canExplore returns true if the given group, which has the given explore
+// state, can be explored in the current pass. A group is explored at most once
+// per pass. It is always explored in the first pass in which it is reached,
+// including groups that were added to the memo by a previous pass, and
+// afterwards only if it is in focus.
+func (d *iterativeDeepening) canExplore(grp memo.RelExpr, state *exploreState) bool {
+	if state.fullyExplored || state.deepeningPass == d.pass {
+		return false
+	}
+	if state.deepeningPass == 0 {
+		return true
+	}
+	_, ok := d.focus[grp.FirstExpr()]
+	return ok
+}
+
+// deepen makes the passes after the first pass of iterative deepening, once
+// the root group has been optimized. Each pass refreshes the states of the
+// groups that are reached from the root, and so may notify the callback set
+// via NotifyOnGroupOptimized of the same group again.
+func (o *Optimizer) deepen(root memo.RelExpr, rootProps *physical.Required) {
+	d := o.deepening
+	for !o.explorationStopped {
+		d.focus = o.deepeningFocus(root, rootProps)
+		if !o.canDeepen() {
+			return
+		}
+		explorations := o.explorations
+		d.pass++
+		o.groupsOptimized = 0
+		o.optimizeGroup(root, rootProps, memo.MaxCost)
+		if o.explorations == explorations {
+			// None of the groups in focus were reached, so another pass would make
+			// no progress.
+			return
+		}
+	}
+}
+
+// canDeepen returns true if any of the groups in focus can be explored further.
+func (o *Optimizer) canDeepen() bool {
+	for grp := range o.deepening.focus {
+		if !o.explorer.ensureExploreState(grp).fullyExplored {
+			return true
+		}
+	}
+	return false
+}
+
+// deepeningFocus returns the set of groups that participate in a plan whose
+// cost is within the slack of the cost of the best plan, including the groups
+// of the subqueries in those plans.
+func (o *Optimizer) deepeningFocus(
+	root memo.RelExpr, rootProps *physical.Required,
+) map[memo.RelExpr]struct{} {
+	focus := make(map[memo.RelExpr]struct{})
+	f := deepeningFocusBuilder{e: planEnumerator{o: o}, slack: o.deepening.slack, focus: focus}
+	f.addGroup(root, rootProps)
+	return focus
+}
+
+// deepeningFocusBuilder accumulates the groups of the plans that are within
+// the slack of the best plan.
+type deepeningFocusBuilder struct {
+	e     planEnumerator
+	slack float64
+	focus map[memo.RelExpr]struct{}
+}
+
+// addGroup adds the groups of the plans for the given group and required
+// properties that are within the slack of its lowest cost plan.
+func (f *deepeningFocusBuilder) addGroup(grp memo.RelExpr, required *physical.Required) {
+	state := f.e.o.lookupOptState(grp.FirstExpr(), required)
+	if state == nil || state.best == nil {
+		return
+	}
+	budget := state.cost * memo.Cost(1+f.slack)
+	for _, n := range f.e.enumerateGroup(grp, required, budget) {
+		f.addPlan(n)
+	}
+}
+
+// addPlan adds the groups of the given plan node and its descendants.
+func (f *deepeningFocusBuilder) addPlan(n *PlanNode) {
+	if !opt.IsEnforcerOp(n.Expr) {
+		f.focus[n.Expr.FirstExpr()] = struct{}{}
+		for i, cnt := 0, n.Expr.ChildCount(); i < cnt; i++ {
+			if scalar, ok := n.Expr.Child(i).(opt.ScalarExpr); ok {
+				f.addSubqueries(scalar)
+			}
+		}
+	}
+	for _, child := range n.Children {
+		f.addPlan(child)
+	}
+}
+
+// addSubqueries adds the groups of the plans for the subqueries within the
+// given scalar expression, which are not part of the plan nodes.
+func (f *deepeningFocusBuilder) addSubqueries(scalar opt.Expr) {
+	for i, n := 0, scalar.ChildCount(); i < n; i++ {
+		switch t := scalar.Child(i).(type) {
+		case memo.RelExpr:
+			f.addGroup(t, BuildChildPhysicalPropsScalar(f.e.o.mem, scalar, i))
+		default:
+			f.addSubqueries(t)
+		}
+	}
+}
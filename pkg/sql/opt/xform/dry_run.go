@@ -0,0 +1,195 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/errors"
+)
+
+// DryRunStatement is a statement of the workload of a DryRun.
+type DryRunStatement struct {
+	// Fingerprint identifies the statement in the result of the dry run.
+	Fingerprint string
+
+	// SQL is the statement to plan. It must not contain placeholders.
+	SQL string
+
+	// Catalog is the catalog, including table statistics, against which the
+	// statement is built. If it is nil, the catalog of the dry run is used.
+	Catalog cat.Catalog
+}
+
+// DryRunConfig is a named optimizer configuration under which a DryRun plans
+// its workload.
+type DryRunConfig struct {
+	// Name identifies the configuration in the result of the dry run.
+	Name string
+
+	// Configure is called after the optimizer is initialized and before each
+	// statement is built, e.g. to disable a rule with DisableRulesByName, or to
+	// change the cost constants with SetCostModelSettings. It may be nil.
+	Configure func(o *Optimizer) error
+}
+
+// DryRun plans each statement of a workload under two optimizer
+// configurations, and reports the statements whose plans change, along with
+// the change in their estimated cost. It is intended to assess the impact of
+// a change to the rules or the cost model on a captured workload before the
+// change is rolled out.
+type DryRun struct {
+	// Catalog is the catalog against which statements without a catalog of
+	// their own are built.
+	Catalog cat.Catalog
+
+	// EvalCtx is the eval context with which the optimizer is initialized.
+	EvalCtx *tree.EvalContext
+
+	// Build builds each statement into the memo of the optimizer. See
+	// BenchmarkBuildFunc.
+	Build BenchmarkBuildFunc
+
+	// Statements is the workload to plan.
+	Statements []DryRunStatement
+
+	// Before is the current configuration of the optimizer, and After is the
+	// configuration that is evaluated.
+	Before, After DryRunConfig
+}
+
+// DryRunResult is the outcome of a DryRun.
+type DryRunResult struct {
+	// Before and After are the names of the configurations of the dry run.
+	Before, After string
+
+	// Statements contains the plans chosen for each statement, in the order of
+	// the statements of the dry run.
+	Statements []DryRunStatementResult
+
+	// Changed is the number of statements whose plan changed.
+	Changed int
+}
+
+// DryRunStatementResult describes the plans chosen for a single statement of
+// a DryRun under each configuration.
+type DryRunStatementResult struct {
+	// Fingerprint is the fingerprint of the statement.
+	Fingerprint string
+
+	// Before and After describe the lowest cost trees chosen under each
+	// configuration.
+	Before, After *PlanBaseline
+
+	// BeforeCost and AfterCost are the estimated costs of the plans. Costs are
+	// only comparable if the configurations use the same cost constants.
+	BeforeCost, AfterCost memo.Cost
+
+	// Changed is true if the plans are different.
+	Changed bool
+}
+
+// CostRatio returns the ratio of the cost of the plan chosen under the After
+// configuration to the cost of the plan chosen under the Before configuration.
+// It returns 1 if both costs are zero, and +Inf if only the cost of the Before
+// plan is zero.
+func (r *DryRunStatementResult) CostRatio() float64 {
+	if r.BeforeCost == 0 {
+		if r.AfterCost == 0 {
+			return 1
+		}
+		return math.Inf(1)
+	}
+	return float64(r.AfterCost / r.BeforeCost)
+}
+
+// String formats the result with one line per statement whose plan changed,
+// followed by a summary line. For example:
+//
+//	q12: plan changed, cost 1078.03 -> 125049.71 (x116.00)
+//	1 of 20 statements changed plans (rule-disabled vs baseline)
+func (r *DryRunResult) String() string {
+	var b strings.Builder
+	for i := range r.Statements {
+		s := &r.Statements[i]
+		if !s.Changed {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: plan changed, cost %.2f -> %.2f (x%.2f)\n",
+			s.Fingerprint, s.BeforeCost, s.AfterCost, s.CostRatio())
+	}
+	fmt.Fprintf(&b, "%d of %d statements changed plans (%s vs %s)\n",
+		r.Changed, len(r.Statements), r.After, r.Before)
+	return b.String()
+}
+
+// Run plans each statement of the workload under both configurations, and
+// compares the plans. It returns an error if a statement fails to build or
+// optimize under either configuration.
+func (d *DryRun) Run() (*DryRunResult, error) {
+	res := &DryRunResult{
+		Before:     d.Before.Name,
+		After:      d.After.Name,
+		Statements: make([]DryRunStatementResult, len(d.Statements)),
+	}
+	var o Optimizer
+	for i := range d.Statements {
+		stmt := &d.Statements[i]
+		r := &res.Statements[i]
+		r.Fingerprint = stmt.Fingerprint
+		var err error
+		if r.Before, r.BeforeCost, err = d.plan(&o, stmt, &d.Before); err != nil {
+			return nil, err
+		}
+		if r.After, r.AfterCost, err = d.plan(&o, stmt, &d.After); err != nil {
+			return nil, err
+		}
+		if !sameBaselineNode(&r.Before.Root, &r.After.Root) {
+			r.Changed = true
+			res.Changed++
+		}
+	}
+	return res, nil
+}
+
+// plan builds and optimizes the given statement under the given configuration,
+// and returns the lowest cost tree and its cost.
+func (d *DryRun) plan(
+	o *Optimizer, stmt *DryRunStatement, config *DryRunConfig,
+) (*PlanBaseline, memo.Cost, error) {
+	catalog := stmt.Catalog
+	if catalog == nil {
+		catalog = d.Catalog
+	}
+	o.Init(d.EvalCtx, catalog)
+	if config.Configure != nil {
+		if err := config.Configure(o); err != nil {
+			return nil, 0, errors.Wrapf(err, "configuring %s", config.Name)
+		}
+	}
+	if err := d.Build(o, catalog, stmt.SQL); err != nil {
+		return nil, 0, errors.Wrapf(err, "building statement %s under %s", stmt.Fingerprint, config.Name)
+	}
+	root, err := o.Optimize()
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "optimizing statement %s under %s", stmt.Fingerprint, config.Name)
+	}
+	plan, err := o.CapturePlanBaseline()
+	if err != nil {
+		return nil, 0, err
+	}
+	return plan, root.(memo.RelExpr).Cost(), nil
+}
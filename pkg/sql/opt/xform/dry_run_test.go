@@ -0,0 +1,79 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestDryRun tests that a dry run reports the statements whose plans change
+// between two optimizer configurations, and how their costs change.
+func TestDryRun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	d := xform.DryRun{
+		Catalog: catalog,
+		EvalCtx: &evalCtx,
+		Build:   testutils.BuildInitializedQuery,
+		Statements: []xform.DryRunStatement{
+			{Fingerprint: "scan", SQL: "SELECT a FROM abc"},
+			{Fingerprint: "filter", SQL: "SELECT * FROM abc WHERE c = 'foo'"},
+		},
+		Before: xform.DryRunConfig{Name: "baseline"},
+		After: xform.DryRunConfig{
+			Name: "no-constrained-scans",
+			Configure: func(o *xform.Optimizer) error {
+				return o.DisableRulesByName([]string{"GenerateConstrainedScans"})
+			},
+		},
+	}
+	res, err := d.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Statements) != len(d.Statements) {
+		t.Fatalf("expected %d statements, got %d", len(d.Statements), len(res.Statements))
+	}
+
+	// Only the plan of the statement with a filter on the indexed column
+	// changes, from a constrained scan of the index to a full scan, which is
+	// more expensive.
+	scan, filter := res.Statements[0], res.Statements[1]
+	if res.Changed != 1 || scan.Changed || !filter.Changed {
+		t.Fatalf("expected only the filter to change plans:\n%s", res)
+	}
+	if scan.CostRatio() != 1 || filter.CostRatio() <= 1 {
+		t.Errorf("unexpected costs:\n%s", res)
+	}
+	if !strings.Contains(res.String(), "1 of 2 statements changed plans") {
+		t.Errorf("unexpected result:\n%s", res)
+	}
+
+	// An invalid configuration is reported.
+	d.After.Configure = func(o *xform.Optimizer) error {
+		return o.DisableRulesByName([]string{"NoSuchRule"})
+	}
+	if _, err := d.Run(); err == nil {
+		t.Error("expected an error for an invalid configuration")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+)
+
+// enforceableProperty is implemented for each physical property that can be
+// provided by an enforcer. The optimizer does not otherwise need to know which
+// properties can be enforced, so a new enforceable property only requires a
+// new implementation and an entry in enforceableProperties.
+type enforceableProperty interface {
+	// canEnforce returns true if an enforcer should be tried to provide the
+	// property for an expression that is optimized with the given required
+	// properties. If it returns true, the group is optimized recursively with
+	// properties that are derived from the required properties by the enforcer
+	// (usually by stripping the property).
+	canEnforce(o *Optimizer, required *physical.Required) bool
+
+	// newEnforcer returns the basic enforcer that provides the property on top
+	// of the given member. It must only be called if canEnforce returned true.
+	newEnforcer(o *Optimizer, member memo.RelExpr, required *physical.Required) memo.RelExpr
+
+	// enforce optimizes and costs each enforcer of the property on top of the
+	// given member, and returns true if all of them were fully optimized. Most
+	// properties only have the enforcer returned by newEnforcer, but a property
+	// can have variants, such as a Sort that requires a partial ordering from
+	// its input.
+	enforce(
+		o *Optimizer, state *groupState, member memo.RelExpr, required *physical.Required,
+	) (fullyOptimized bool)
+
+	// preventsExploration returns true if a group that is optimized with the
+	// given required properties is optimized by a recursive call from
+	// enforceProps, and so will be explored by the call for the properties
+	// from which the given properties were derived. See shouldExplore.
+	preventsExploration(required *physical.Required) bool
+}
+
+// enforceableProperties lists the properties that can be provided by an
+// enforcer, in the order in which enforceProps strips them. The properties
+// are stripped off in a heuristic order, from least likely to be expensive to
+// enforce to most likely.
+var enforceableProperties = []enforceableProperty{
+	distributionProperty{},
+	orderingProperty{},
+	parallelismProperty{},
+}
+
+// enforcerFor returns the first enforceable property that should be enforced
+// for an expression that is optimized with the given required properties, or
+// nil if there is none.
+func (o *Optimizer) enforcerFor(required *physical.Required) enforceableProperty {
+	for _, p := range enforceableProperties {
+		if p.canEnforce(o, required) {
+			return p
+		}
+	}
+	return nil
+}
+
+// optimizeBasicEnforcer optimizes and costs the enforcer returned by
+// newEnforcer for the given property.
+func (o *Optimizer) optimizeBasicEnforcer(
+	p enforceableProperty, state *groupState, member memo.RelExpr, required *physical.Required,
+) (fullyOptimized bool) {
+	enforcer := p.newEnforcer(o, member, required)
+	memberProps := BuildChildPhysicalProps(o.mem, enforcer, 0, required)
+	return o.optimizeEnforcer(state, enforcer, required, member, memberProps, false /* speculative */)
+}
+
+// distributionProperty is the physical.Required.Distribution property, which
+// is provided by a Distribute enforcer.
+type distributionProperty struct{}
+
+func (distributionProperty) canEnforce(_ *Optimizer, required *physical.Required) bool {
+	return !required.Distribution.Any()
+}
+
+func (distributionProperty) newEnforcer(
+	o *Optimizer, member memo.RelExpr, _ *physical.Required,
+) memo.RelExpr {
+	return o.arena.newDistribute(member)
+}
+
+func (p distributionProperty) enforce(
+	o *Optimizer, state *groupState, member memo.RelExpr, required *physical.Required,
+) bool {
+	return o.optimizeBasicEnforcer(p, state, member, required)
+}
+
+func (distributionProperty) preventsExploration(required *physical.Required) bool {
+	return !required.Distribution.Any()
+}
+
+// orderingProperty is the physical.Required.Ordering property, which is
+// provided by a Sort enforcer, or by a TopKSort enforcer when HardLimit is set.
+type orderingProperty struct{}
+
+func (orderingProperty) canEnforce(_ *Optimizer, required *physical.Required) bool {
+	return !required.Ordering.Any()
+}
+
+func (orderingProperty) newEnforcer(
+	o *Optimizer, member memo.RelExpr, _ *physical.Required,
+) memo.RelExpr {
+	return o.arena.newSort(member)
+}
+
+func (p orderingProperty) enforce(
+	o *Optimizer, state *groupState, member memo.RelExpr, required *physical.Required,
+) (fullyOptimized bool) {
+	// Ordering enforcers are not tried for a speculative state, since a Sort
+	// below the partial Sort that requested the state would only duplicate the
+	// work of the Sort that requires no ordering from its input. They are tried
+	// if a parent expression later requires the same ordering of the group.
+	if state.speculative {
+		state.deferredEnforcers = true
+		return true
+	}
+
+	// Try Sort enforcer that requires no ordering from its input.
+	fullyOptimized = o.optimizeBasicEnforcer(p, state, member, required)
+
+	// Try Sort enforcer that requires a partial ordering from its input. Choose
+	// the interesting ordering that forms the longest common prefix with the
+	// required ordering. We do not need to add the enforcer if the required
+	// ordering is implied by the input ordering (in which case the returned
+	// prefix is nil).
+	if longestCommonPrefix := state.sortPrefixFor(member); longestCommonPrefix != nil {
+		// No parent may require the input ordering, so the input is optimized
+		// speculatively (see optimizeSpeculativeGroup).
+		enforcer := o.arena.newSort(state.best)
+		enforcer.InputOrdering = *longestCommonPrefix
+		memberProps := BuildChildPhysicalProps(o.mem, enforcer, 0, required)
+		if o.optimizeEnforcer(state, enforcer, required, member, memberProps, true /* speculative */) {
+			fullyOptimized = true
+		}
+	}
+
+	// Try TopKSort enforcer if no more than HardLimit rows will be consumed.
+	// It requires no ordering from its input.
+	if required.HardLimit > 0 {
+		enforcer := o.arena.newTopKSort(member, required.HardLimit)
+		memberProps := BuildChildPhysicalProps(o.mem, enforcer, 0, required)
+		if o.optimizeEnforcer(state, enforcer, required, member, memberProps, false /* speculative */) {
+			fullyOptimized = true
+		}
+	}
+
+	return fullyOptimized
+}
+
+func (orderingProperty) preventsExploration(required *physical.Required) bool {
+	return !required.Ordering.Any()
+}
+
+// parallelismProperty is the physical.Required.Parallelism property. Unlike
+// the other properties, it is not stripped: a Gather enforcer adds it to the
+// properties required of its input, so that the group is optimized both
+// serially and in parallel.
+type parallelismProperty struct{}
+
+func (parallelismProperty) canEnforce(o *Optimizer, required *physical.Required) bool {
+	return o.gatherParallelism(required) >= 2
+}
+
+func (parallelismProperty) newEnforcer(
+	o *Optimizer, member memo.RelExpr, required *physical.Required,
+) memo.RelExpr {
+	enforcer := o.arena.newGather()
+	enforcer.Input = member
+	enforcer.InputParallelism = o.gatherParallelism(required)
+	return enforcer
+}
+
+func (p parallelismProperty) enforce(
+	o *Optimizer, state *groupState, member memo.RelExpr, required *physical.Required,
+) bool {
+	return o.optimizeBasicEnforcer(p, state, member, required)
+}
+
+func (parallelismProperty) preventsExploration(required *physical.Required) bool {
+	return required.Parallelism != 0
+}
+
+// gatherParallelism returns the number of parallel streams that the input of
+// a Gather enforcer is optimized for, given the required properties of the
+// Gather, or zero if a parallel input should not be considered. Parallelism is
+// only considered once every other enforceable property has been stripped,
+// since the Gather enforcer does not preserve them.
+func (o *Optimizer) gatherParallelism(required *physical.Required) int {
+	parallelism := o.parallelism
+	if required.MaxParallelism != 0 && parallelism > required.MaxParallelism {
+		parallelism = required.MaxParallelism
+	}
+	if parallelism < 2 || required.Parallelism != 0 ||
+		!required.Ordering.Any() || !required.Distribution.Any() {
+		return 0
+	}
+	return parallelism
+}
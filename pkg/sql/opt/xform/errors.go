@@ -0,0 +1,221 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/errorspb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// OptimizationErrorKind categorizes the errors that can occur while planning a
+// query, so that callers can decide how to handle them. For example, a caller
+// might retry a query that exceeded its budget with optimizations disabled,
+// but should never retry one that violated an internal invariant.
+type OptimizationErrorKind uint8
+
+const (
+	// InternalError indicates that an internal invariant of the optimizer was
+	// violated. It is always the result of a bug.
+	InternalError OptimizationErrorKind = iota
+
+	// BudgetExceededError indicates that optimization was aborted because it
+	// exceeded the budget allotted to it. See SetExplorationBudgetFunc.
+	BudgetExceededError
+
+	// UnsatisfiablePropsError indicates that no expression in the memo could
+	// provide the physical properties required of it.
+	UnsatisfiablePropsError
+
+	// HintConflictError indicates that no plan could be produced which conforms
+	// to the hints in the query, such as index or join hints.
+	HintConflictError
+
+	// CostCeilingExceededError indicates that the estimated cost of the lowest
+	// cost plan exceeds the maximum plan cost. See SetCostCeiling.
+	CostCeilingExceededError
+)
+
+// String implements the fmt.Stringer interface.
+func (k OptimizationErrorKind) String() string {
+	switch k {
+	case InternalError:
+		return "internal error"
+	case BudgetExceededError:
+		return "budget exceeded"
+	case UnsatisfiablePropsError:
+		return "unsatisfiable physical properties"
+	case HintConflictError:
+		return "hint conflict"
+	case CostCeilingExceededError:
+		return "cost ceiling exceeded"
+	default:
+		return fmt.Sprintf("OptimizationErrorKind(%d)", k)
+	}
+}
+
+// hint returns a user-facing hint that describes how the error can be
+// resolved, or the empty string if there is no such hint.
+func (k OptimizationErrorKind) hint() string {
+	switch k {
+	case BudgetExceededError:
+		return "the statement can be retried once the node is less loaded"
+	case HintConflictError:
+		return "remove or change the hint, or add an index that allows the hint to be satisfied"
+	case CostCeilingExceededError:
+		return "add a more selective filter or an index that reduces the cost of the query, " +
+			"or raise the sql.optimizer.max_plan_cost cluster setting"
+	default:
+		return ""
+	}
+}
+
+// OptimizationError is an error that occurred while planning a query. It wraps
+// the underlying error with its category and the context in which it occurred.
+// The message of an OptimizationError is the message of the underlying error.
+type OptimizationError struct {
+	// Kind is the category of the error.
+	Kind OptimizationErrorKind
+
+	// Op is the operator of the memo group that was being optimized when the
+	// error occurred, or opt.UnknownOp if it is not known.
+	Op opt.Operator
+
+	// Rule is the rule that was being applied when the error occurred, or
+	// opt.InvalidRuleName if it is not known.
+	Rule opt.RuleName
+
+	cause error
+}
+
+var _ error = (*OptimizationError)(nil)
+
+// NewOptimizationError wraps the given error in an OptimizationError of the
+// given kind. The user-facing hint for the kind, if any, is attached to the
+// error.
+func NewOptimizationError(
+	kind OptimizationErrorKind, op opt.Operator, rule opt.RuleName, cause error,
+) error {
+	if hint := kind.hint(); hint != "" {
+		cause = errors.WithHint(cause, hint)
+	}
+	return &OptimizationError{Kind: kind, Op: op, Rule: rule, cause: cause}
+}
+
+// GetOptimizationError returns the OptimizationError in the causal chain of
+// the given error, if there is one.
+func GetOptimizationError(err error) (_ *OptimizationError, ok bool) {
+	var e *OptimizationError
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// Error implements the error interface.
+func (e *OptimizationError) Error() string { return e.cause.Error() }
+
+// Cause implements the causer interface.
+func (e *OptimizationError) Cause() error { return e.cause }
+
+// Unwrap implements the wrapper interface.
+func (e *OptimizationError) Unwrap() error { return e.cause }
+
+// Format implements the fmt.Formatter interface.
+func (e *OptimizationError) Format(s fmt.State, verb rune) { errors.FormatError(e, s, verb) }
+
+// FormatError implements the errors.Formatter interface.
+func (e *OptimizationError) FormatError(p errors.Printer) (next error) {
+	if p.Detail() {
+		p.Printf("optimization %s", e.Kind)
+		if e.Op != opt.UnknownOp {
+			p.Printf(" while optimizing %s", e.Op)
+		}
+		if e.Rule != opt.InvalidRuleName {
+			p.Printf(" in rule %s", e.Rule)
+		}
+	}
+	return e.cause
+}
+
+// encodeOptimizationError serializes an OptimizationError, so that its kind
+// and context survive being sent between nodes. The operator and rule are
+// encoded by name, since their numeric values can differ between versions.
+func encodeOptimizationError(
+	_ context.Context, err error,
+) (msgPrefix string, safe []string, details proto.Message) {
+	e := err.(*OptimizationError)
+	details = &errorspb.StringsPayload{
+		Details: []string{strconv.Itoa(int(e.Kind)), e.Op.String(), e.Rule.String()},
+	}
+	return "", nil, details
+}
+
+// decodeOptimizationError is the inverse of encodeOptimizationError. An
+// operator or rule that is unknown to this version is decoded as
+// opt.UnknownOp or opt.InvalidRuleName.
+func decodeOptimizationError(
+	_ context.Context, cause error, _ string, _ []string, payload proto.Message,
+) error {
+	m, ok := payload.(*errorspb.StringsPayload)
+	if !ok || len(m.Details) < 3 {
+		// If this ever happens, this means some version of the library
+		// (presumably future) changed the payload type, and we're
+		// receiving this here. In this case, give up and let
+		// DecodeError use the opaque type.
+		return nil
+	}
+	kind, err := strconv.Atoi(m.Details[0])
+	if err != nil {
+		// Not encoded by our encode function. Bail out.
+		return nil //nolint:returnerrcheck
+	}
+	e := &OptimizationError{Kind: OptimizationErrorKind(kind), cause: cause}
+	for op := opt.Operator(1); op < opt.NumOperators; op++ {
+		if op.String() == m.Details[1] {
+			e.Op = op
+			break
+		}
+	}
+	e.Rule, _ = opt.ParseRuleName(m.Details[2])
+	return e
+}
+
+func init() {
+	key := errors.GetTypeKey((*OptimizationError)(nil))
+	errors.RegisterWrapperEncoder(key, encodeOptimizationError)
+	errors.RegisterWrapperDecoder(key, decodeOptimizationError)
+}
+
+// DisableForRetry prepares the optimizer to re-optimize a statement whose
+// optimization failed with the given internal error, so that the statement can
+// still be planned while the bug is reported. If the error occurred while an
+// exploration rule was being applied, that rule is disabled. Otherwise, or if
+// the rule is essential, exploration is disabled, and the plan is the
+// normalized expression tree. It returns a description of what was disabled.
+// DisableForRetry must be called after Init and before Optimize, and has the
+// same restrictions as DisableRules.
+func (o *Optimizer) DisableForRetry(err error) string {
+	if e, ok := GetOptimizationError(err); ok && e.Rule != opt.InvalidRuleName &&
+		!essentialRules.Contains(int(e.Rule)) {
+		var rules RuleSet
+		rules.Add(int(e.Rule))
+		o.DisableRules(rules)
+		return fmt.Sprintf("rule %s", e.Rule)
+	}
+	o.DisableExplorations()
+	return "exploration"
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// TestOptimizationErrorEncoding tests that an OptimizationError survives an
+// encode/decode cycle.
+func TestOptimizationErrorEncoding(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	for _, tc := range []struct {
+		kind xform.OptimizationErrorKind
+		op   opt.Operator
+		rule opt.RuleName
+	}{
+		{xform.InternalError, opt.InnerJoinOp, opt.GenerateConstrainedScans},
+		{xform.BudgetExceededError, opt.ScanOp, opt.InvalidRuleName},
+		{xform.CostCeilingExceededError, opt.UnknownOp, opt.InvalidRuleName},
+	} {
+		t.Run(tc.kind.String(), func(t *testing.T) {
+			err := xform.NewOptimizationError(tc.kind, tc.op, tc.rule, errors.New("boom"))
+			enc := errors.EncodeError(context.Background(), err)
+			decoded := errors.DecodeError(context.Background(), enc)
+			e, ok := xform.GetOptimizationError(decoded)
+			if !ok {
+				t.Fatalf("expected an OptimizationError, got %T: %v", decoded, decoded)
+			}
+			if e.Kind != tc.kind || e.Op != tc.op || e.Rule != tc.rule {
+				t.Errorf("expected (%s, %s, %s), got (%s, %s, %s)",
+					tc.kind, tc.op, tc.rule, e.Kind, e.Op, e.Rule)
+			}
+			if decoded.Error() != err.Error() {
+				t.Errorf("expected message %q, got %q", err.Error(), decoded.Error())
+			}
+		})
+	}
+}
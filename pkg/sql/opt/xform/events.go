@@ -0,0 +1,198 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/optpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// EventSink receives the structured events that the optimizer emits while it
+// constructs and optimizes a memo. See Optimizer.SetEventSink.
+type EventSink interface {
+	// Emit is called with each event, in the order in which the events occur.
+	// It is called synchronously by the optimizer, so it should not block. The
+	// event is not modified by the optimizer after Emit returns.
+	Emit(ev *optpb.Event)
+}
+
+// SetEventSink causes the optimizer to emit an event to the given sink each
+// time a rule is matched or applied, an enforcer is costed, a new lowest cost
+// expression is found for a group, and a group is fully optimized. Expressions
+// are identified by the number of their memo group and their position in it,
+// rather than by internal types, so that the events can be consumed by
+// external tools. Normalization rules are only reported if SetEventSink is
+// called before the expression is built. SetEventSink should be called after
+// any calls to NotifyOnMatchedRule and NotifyOnAppliedRule, which would
+// otherwise replace the callbacks that emit the rule events.
+func (o *Optimizer) SetEventSink(sink EventSink) {
+	o.events = &eventEmitter{
+		sink:   sink,
+		start:  timeutil.Now(),
+		groups: make(map[memo.RelExpr]int32),
+	}
+
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			allowed := matchedRule == nil || matchedRule(ruleName)
+			o.events.ruleMatched(ruleName, o.explorer.exploring, allowed)
+			return allowed
+		}
+	}
+	wrapApplied := func(appliedRule AppliedRuleFunc) AppliedRuleFunc {
+		return func(ruleName opt.RuleName, source, target opt.Expr) {
+			if appliedRule != nil {
+				appliedRule(ruleName, source, target)
+			}
+			o.events.ruleApplied(ruleName, source, target)
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.appliedRule = wrapApplied(o.appliedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+	o.f.NotifyOnAppliedRule(wrapApplied(o.f.AppliedRule()))
+}
+
+// eventEmitter converts the events of an optimization into optpb.Events, and
+// emits them to an EventSink.
+type eventEmitter struct {
+	sink  EventSink
+	start time.Time
+	seq   uint64
+
+	// groups maps the first expression of each memo group that has appeared in
+	// an event to the ID of the group.
+	groups map[memo.RelExpr]int32
+}
+
+// emit assigns the next sequence number to the event, and emits it.
+func (e *eventEmitter) emit(ev *optpb.Event) {
+	e.seq++
+	ev.Seq = e.seq
+	ev.Elapsed = timeutil.Since(e.start)
+	e.sink.Emit(ev)
+}
+
+// expr returns the identifier of the given expression.
+func (e *eventEmitter) expr(expr opt.Expr) optpb.Expr {
+	res := optpb.Expr{Op: expr.Op().String()}
+	rel, ok := expr.(memo.RelExpr)
+	if !ok {
+		return res
+	}
+	first := rel.FirstExpr()
+	group, ok := e.groups[first]
+	if !ok {
+		group = int32(len(e.groups) + 1)
+		e.groups[first] = group
+	}
+	res.Group = group
+	for member := first; member != rel; member = member.NextExpr() {
+		res.Member++
+	}
+	return res
+}
+
+// exprOrNil returns the identifier of the given expression, or nil if it is
+// nil.
+func (e *eventEmitter) exprOrNil(expr opt.Expr) *optpb.Expr {
+	if expr == nil {
+		return nil
+	}
+	res := e.expr(expr)
+	return &res
+}
+
+// best returns the identifier of the given lowest cost expression of a group.
+// Enforcers are not members of the group, so only the name of their operator
+// is returned.
+func (e *eventEmitter) best(best memo.RelExpr) (_ *optpb.Expr, enforcer string) {
+	if best == nil {
+		return nil, ""
+	}
+	if opt.IsEnforcerOp(best) {
+		return nil, best.Op().String()
+	}
+	return e.exprOrNil(best), ""
+}
+
+func (e *eventEmitter) ruleMatched(ruleName opt.RuleName, exploring memo.RelExpr, allowed bool) {
+	ev := &optpb.RuleMatched{
+		Rule:    ruleName.String(),
+		Explore: ruleName.IsExplore(),
+		Allowed: allowed,
+	}
+	if ev.Explore && exploring != nil {
+		ev.Source = e.exprOrNil(exploring)
+	}
+	e.emit(&optpb.Event{Value: &optpb.Event_RuleMatched{RuleMatched: ev}})
+}
+
+func (e *eventEmitter) ruleApplied(ruleName opt.RuleName, source, target opt.Expr) {
+	ev := &optpb.RuleApplied{
+		Rule:    ruleName.String(),
+		Explore: ruleName.IsExplore(),
+		Source:  e.exprOrNil(source),
+	}
+	if rel, ok := target.(memo.RelExpr); ok && source != nil {
+		// The expressions added by an exploration rule are at the end of the
+		// group, starting with the target.
+		for ; rel != nil; rel = rel.NextExpr() {
+			ev.Added = append(ev.Added, e.expr(rel))
+		}
+	} else if target != nil {
+		ev.Added = []optpb.Expr{e.expr(target)}
+	}
+	e.emit(&optpb.Event{Value: &optpb.Event_RuleApplied{RuleApplied: ev}})
+}
+
+func (e *eventEmitter) enforcerAdded(
+	enforcer, input memo.RelExpr,
+	required, inputRequired *physical.Required,
+	cost memo.Cost,
+) {
+	ev := &optpb.EnforcerAdded{
+		Op:            enforcer.Op().String(),
+		Input:         e.expr(input),
+		Required:      required.String(),
+		InputRequired: inputRequired.String(),
+		Cost:          float64(cost),
+	}
+	e.emit(&optpb.Event{Value: &optpb.Event_EnforcerAdded{EnforcerAdded: ev}})
+}
+
+func (e *eventEmitter) bestChanged(
+	grp memo.RelExpr, state *groupState, previousCost memo.Cost,
+) {
+	ev := &optpb.BestChanged{
+		Group:        e.expr(grp),
+		Required:     state.required.String(),
+		Cost:         float64(state.cost),
+		PreviousCost: float64(previousCost),
+	}
+	ev.Best, ev.Enforcer = e.best(state.best)
+	e.emit(&optpb.Event{Value: &optpb.Event_BestChanged{BestChanged: ev}})
+}
+
+func (e *eventEmitter) groupOptimized(grp memo.RelExpr, state *groupState) {
+	ev := &optpb.GroupOptimized{
+		Group:    e.expr(grp),
+		Required: state.required.String(),
+		Cost:     float64(state.cost),
+	}
+	ev.Best, ev.Enforcer = e.best(state.best)
+	e.emit(&optpb.Event{Value: &optpb.Event_GroupOptimized{GroupOptimized: ev}})
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/optpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+type eventCollector struct {
+	events []*optpb.Event
+}
+
+func (c *eventCollector) Emit(ev *optpb.Event) {
+	c.events = append(c.events, ev)
+}
+
+// TestEventSink tests that an event sink receives the rule, enforcer and
+// lowest cost expression events of an optimization, in sequence.
+func TestEventSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	var sink eventCollector
+	o.SetEventSink(&sink)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+
+	var matched, applied, enforced, changed, optimized bool
+	for i, ev := range sink.events {
+		if ev.Seq != uint64(i+1) {
+			t.Fatalf("expected event %d to have sequence number %d, got %d", i, i+1, ev.Seq)
+		}
+		switch v := ev.Value.(type) {
+		case *optpb.Event_RuleMatched:
+			if v.RuleMatched.Rule == "GenerateConstrainedScans" {
+				matched = true
+				if v.RuleMatched.Source == nil || v.RuleMatched.Source.Op != "select" {
+					t.Errorf("expected the rule to match a select, got %v", v.RuleMatched.Source)
+				}
+			}
+		case *optpb.Event_RuleApplied:
+			if v.RuleApplied.Rule == "GenerateConstrainedScans" {
+				applied = true
+				if len(v.RuleApplied.Added) == 0 {
+					t.Errorf("expected the rule to add expressions")
+				}
+			}
+		case *optpb.Event_EnforcerAdded:
+			if v.EnforcerAdded.Op == "sort" {
+				enforced = true
+			}
+		case *optpb.Event_BestChanged:
+			changed = true
+			if v.BestChanged.Best == nil && v.BestChanged.Enforcer == "" {
+				t.Errorf("expected the new best expression to be identified")
+			}
+		case *optpb.Event_GroupOptimized:
+			optimized = true
+			if v.GroupOptimized.Group.Group == 0 {
+				t.Errorf("expected the optimized group to have an ID")
+			}
+		}
+	}
+	if !matched || !applied || !enforced || !changed || !optimized {
+		t.Errorf("expected all kinds of events, got matched=%t applied=%t enforced=%t changed=%t optimized=%t",
+			matched, applied, enforced, changed, optimized)
+	}
+}
@@ -11,6 +11,7 @@
 package xform
 
 import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
@@ -90,6 +91,13 @@ type explorer struct {
 	// it provides a clean interface for calling functions from both the xform
 	// and norm packages using the same prefix.
 	funcs CustomFuncs
+
+	// exploring is the group member that is currently being explored, and
+	// required is the set of physical properties required of its group. They
+	// are nil when no group is being explored. They are passed to the callback
+	// set via NotifyOnMatchedRuleContext.
+	exploring memo.RelExpr
+	required  *physical.Required
 }
 
 // init initializes the explorer for use (or reuse).
@@ -154,7 +162,12 @@ func (e *explorer) init(o *Optimizer) {
 //         if ordinal(e3) >= state.start:
 //           ... explore (e1, e2, e3) combo ...
 //
-func (e *explorer) exploreGroup(grp memo.RelExpr) *exploreState {
+//
+// The required physical properties are those required of the group by the
+// optimizer when it called exploreGroup. They do not affect which expressions
+// are generated, but are reported to the callback set via
+// NotifyOnMatchedRuleContext.
+func (e *explorer) exploreGroup(grp memo.RelExpr, required *physical.Required) *exploreState {
 	// Do nothing if this group has already been fully explored.
 	state := e.ensureExploreState(grp)
 	if state.fullyExplored {
@@ -168,18 +181,45 @@ func (e *explorer) exploreGroup(grp memo.RelExpr) *exploreState {
 	for member := grp; member != nil; member = member.NextExpr() {
 		state.end++
 	}
+	if e.o.schedule != nil {
+		e.o.schedule.startExploration(state)
+	}
+	if l := e.o.timeLimits; l != nil {
+		l.startGroup(grp)
+		defer l.finishGroup()
+	}
 
 	var member memo.RelExpr
 	var i int
 	fullyExplored := true
 	for i, member = 0, grp; i < state.end; i, member = i+1, member.NextExpr() {
+		e.o.checkCancellation()
+
 		// If member was fully explored in previous passes, then nothing further
 		// to do.
 		if state.isMemberFullyExplored(i) {
 			continue
 		}
 
-		if memberExplored := e.exploreGroupMember(state, member, i); memberExplored {
+		// Stop generating alternatives once the memo has reached its size limit.
+		// The members that have not been explored remain in the group, and are
+		// still costed.
+		if e.o.memoExprLimitExceeded() {
+			fullyExplored = false
+			break
+		}
+
+		e.exploring, e.required = member, required
+		memberExplored := e.exploreGroupMemberWithinTimeLimits(state, member, i)
+		e.o.applyingRule = opt.InvalidRuleName
+
+		// Apply the external rules after the Optgen rules. Any members that they
+		// add are explored in the next pass.
+		for _, rule := range e.o.externalRules {
+			rule.Explore(&e.funcs, member)
+		}
+		e.exploring, e.required = nil, nil
+		if memberExplored {
 			// No more rules can ever match this expression, so skip it in
 			// future passes.
 			state.markMemberAsFullyExplored(i)
@@ -188,11 +228,29 @@ func (e *explorer) exploreGroup(grp memo.RelExpr) *exploreState {
 			// fully explored.
 			fullyExplored = false
 		}
+
+		// Stop exploring the group once it has exceeded its time limit.
+		if e.o.timeLimits != nil && e.o.timeLimits.exhaustedGroup(grp) {
+			break
+		}
 	}
 
+	// Account for the groups and expressions added by the explorer.
+	e.o.accountMemory()
+
 	// If new group members were added by the explorer, then the group has not
 	// yet been fully explored.
-	if fullyExplored && member == nil {
+	fullyExplored = fullyExplored && member == nil
+	if e.o.schedule != nil {
+		// Rules of lower priority may still need to be applied.
+		fullyExplored = e.o.schedule.finishExploration(state, fullyExplored)
+	}
+	if fullyExplored {
+		state.fullyExplored = true
+	}
+	if e.o.timeLimits != nil && e.o.timeLimits.exhaustedGroup(grp) {
+		// The group is not explored further, even though it is not fully
+		// explored. Its existing members are still costed.
 		state.fullyExplored = true
 	}
 	return state
@@ -237,6 +295,16 @@ type exploreState struct {
 	// memo group. Once a member expression has been fully explored, its ordinal
 	// is added to this set.
 	fullyExploredMembers util.FastIntSet
+
+	// level is the index of the lowest rule priority that is applied when
+	// exploring the group, if an ExplorationScheduler is in use. See
+	// explorationSchedule.levels.
+	level int
+
+	// deepeningPass is the pass of iterative deepening in which the group was
+	// last explored, or zero if it has not been explored. See
+	// SetIterativeDeepening.
+	deepeningPass int
 }
 
 // isMemberFullyExplored is true if the member at the given ordinal position
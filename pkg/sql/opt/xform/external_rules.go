@@ -0,0 +1,92 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// ExternalRule is an exploration rule that is implemented in Go rather than
+// in Optgen, and is registered with RegisterExternalRule. It allows new
+// transformations to be prototyped without regenerating the explorer. An
+// external rule is only applied if it is enabled via the
+// optimizer_external_rules session setting.
+//
+// External rules are applied after the Optgen rules, to each group member
+// that is explored. A member may be explored in more than one pass, so the
+// rule may be applied to the same member repeatedly, and must therefore add
+// its alternatives with the memo's Add<Op>ToGroup methods, which ignore
+// expressions that are already in the group. The alternatives it adds must
+// depend only on the member and the logical properties of its inputs.
+// External rules are not reported to the callbacks set via
+// NotifyOnMatchedRule and NotifyOnAppliedRule, and are not affected by
+// DisableRules.
+type ExternalRule interface {
+	// Name returns the name with which the rule is enabled. It must not be the
+	// name of an Optgen rule.
+	Name() string
+
+	// Explore adds the alternatives of the given group member to its group.
+	// The memo and factory of the optimizer are available via c.
+	Explore(c *CustomFuncs, member memo.RelExpr)
+}
+
+// externalRules contains the registered external rules, by name. It is only
+// modified during package initialization, so it can be read without locking.
+var externalRules = make(map[string]ExternalRule)
+
+// RegisterExternalRule registers an external exploration rule so that it can
+// be enabled by name. It must be called from an init function. It panics if a
+// rule with the same name is already registered, or if the name is the name
+// of an Optgen rule.
+func RegisterExternalRule(rule ExternalRule) {
+	name := rule.Name()
+	if _, ok := externalRules[name]; ok {
+		panic(errors.AssertionFailedf("external rule %s is already registered", name))
+	}
+	if _, ok := opt.ParseRuleName(name); ok {
+		panic(errors.AssertionFailedf("external rule %s has the name of an optgen rule", name))
+	}
+	externalRules[name] = rule
+}
+
+// ParseExternalRules returns the registered external rules with the given
+// names. It returns an error if any of the names is not the name of a
+// registered rule.
+func ParseExternalRules(names []string) ([]ExternalRule, error) {
+	rules := make([]ExternalRule, 0, len(names))
+	for _, name := range names {
+		rule, ok := externalRules[name]
+		if !ok {
+			return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+				"unknown external exploration rule %q", name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Memo returns the memo being explored. It is intended for use by external
+// rules.
+func (c *CustomFuncs) Memo() *memo.Memo {
+	return c.e.mem
+}
+
+// Factory returns the factory with which new expressions are constructed. It
+// is intended for use by external rules.
+func (c *CustomFuncs) Factory() *norm.Factory {
+	return c.e.f
+}
@@ -0,0 +1,261 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// ExprFingerprint identifies a logical expression, independent of the memo
+// that contains it. Two optimizations of the same query produce the same
+// fingerprints for the same expressions, so that feedback recorded after
+// executing a plan can be applied when the query is optimized again.
+type ExprFingerprint uint64
+
+// fingerprintFmtFlags determines which parts of an expression contribute to
+// its fingerprint. Only the logical structure of the expression is included;
+// its estimated statistics and costs are not, since they change as feedback
+// is applied.
+const fingerprintFmtFlags = memo.ExprFmtHideAll &^ memo.ExprFmtHideColumns
+
+// FingerprintExpr returns the fingerprint of the logical expression that the
+// given expression belongs to. All expressions in the same memo group have the
+// same fingerprint.
+func FingerprintExpr(mem *memo.Memo, e memo.RelExpr) ExprFingerprint {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(memo.FormatExpr(e.FirstExpr(), fingerprintFmtFlags, mem, nil /* catalog */)))
+	return ExprFingerprint(h.Sum64())
+}
+
+// ExecutionFeedback describes the actual behavior of an expression when the
+// plan containing it was executed.
+type ExecutionFeedback struct {
+	// RowCount is the average number of rows returned by the expression.
+	RowCount float64
+
+	// ExecTime is the average time spent executing the expression, including
+	// its inputs. It is zero if it was not measured.
+	ExecTime time.Duration
+
+	// Executions is the number of executions that the feedback was aggregated
+	// from.
+	Executions int64
+}
+
+// Merge aggregates other into f, weighting each by its number of executions.
+func (f *ExecutionFeedback) Merge(other ExecutionFeedback) {
+	total := f.Executions + other.Executions
+	if total == 0 {
+		return
+	}
+	weight := float64(other.Executions) / float64(total)
+	f.RowCount += (other.RowCount - f.RowCount) * weight
+	f.ExecTime += time.Duration(float64(other.ExecTime-f.ExecTime) * weight)
+	f.Executions = total
+}
+
+// ExecutionFeedbackStore persists the feedback recorded for executed plans
+// across many optimizations. It allows the coster to correct the cardinality
+// estimates of expressions whose actual row counts are known.
+//
+// Implementations must be safe for concurrent use, since they are shared by
+// all optimizer instances.
+type ExecutionFeedbackStore interface {
+	// RecordFeedback merges feedback about the expression with the given
+	// fingerprint into the store.
+	RecordFeedback(fp ExprFingerprint, feedback ExecutionFeedback)
+
+	// Feedback returns the aggregate feedback that has been recorded for the
+	// expression with the given fingerprint, or ok=false if there is none.
+	Feedback(fp ExprFingerprint) (_ ExecutionFeedback, ok bool)
+}
+
+// InMemoryExecutionFeedbackStore is an ExecutionFeedbackStore that aggregates
+// feedback in memory. It holds feedback for at most MaxEntries expressions;
+// once it is full, feedback for new expressions is dropped.
+type InMemoryExecutionFeedbackStore struct {
+	// MaxEntries is the maximum number of expressions for which feedback is
+	// held. If it is zero, defaultMaxFeedbackEntries is used.
+	MaxEntries int
+
+	mu struct {
+		syncutil.Mutex
+		feedback map[ExprFingerprint]ExecutionFeedback
+	}
+}
+
+var _ ExecutionFeedbackStore = &InMemoryExecutionFeedbackStore{}
+
+// defaultMaxFeedbackEntries is the default value of
+// InMemoryExecutionFeedbackStore.MaxEntries.
+const defaultMaxFeedbackEntries = 10000
+
+// RecordFeedback is part of the ExecutionFeedbackStore interface.
+func (s *InMemoryExecutionFeedbackStore) RecordFeedback(
+	fp ExprFingerprint, feedback ExecutionFeedback,
+) {
+	if feedback.Executions <= 0 {
+		feedback.Executions = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.feedback == nil {
+		s.mu.feedback = make(map[ExprFingerprint]ExecutionFeedback)
+	}
+	existing, ok := s.mu.feedback[fp]
+	if !ok {
+		maxEntries := s.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = defaultMaxFeedbackEntries
+		}
+		if len(s.mu.feedback) >= maxEntries {
+			return
+		}
+	}
+	existing.Merge(feedback)
+	s.mu.feedback[fp] = existing
+}
+
+// Feedback is part of the ExecutionFeedbackStore interface.
+func (s *InMemoryExecutionFeedbackStore) Feedback(fp ExprFingerprint) (ExecutionFeedback, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	feedback, ok := s.mu.feedback[fp]
+	return feedback, ok
+}
+
+// Fingerprint returns the fingerprint of the given expression, which must be
+// part of the optimizer's memo. It can be used to record feedback for the
+// expressions in the lowest cost tree once it has been executed.
+func (o *Optimizer) Fingerprint(e memo.RelExpr) ExprFingerprint {
+	return FingerprintExpr(o.mem, e)
+}
+
+// SetExecutionFeedbackStore causes the optimizer to consult the given store
+// each time it costs a candidate expression. If the actual row counts of the
+// candidate or its inputs have been recorded, the cost of the candidate is
+// scaled by the ratio between the actual and estimated numbers of rows that it
+// processes. SetExecutionFeedbackStore must be called after SetCoster, since
+// it wraps the current coster.
+func (o *Optimizer) SetExecutionFeedbackStore(store ExecutionFeedbackStore) {
+	o.coster = &feedbackCoster{
+		analytic:     o.coster,
+		mem:          o.mem,
+		store:        store,
+		fingerprints: make(map[memo.RelExpr]ExprFingerprint),
+	}
+}
+
+// maxFeedbackCorrection bounds the factor by which execution feedback can
+// scale the cost of an expression, so that a single unusual execution cannot
+// make an expression effectively impossible or free to choose.
+const maxFeedbackCorrection = 1000
+
+// feedbackCoster is a Coster that corrects the cost computed by an analytic
+// coster using the actual row counts recorded in an ExecutionFeedbackStore.
+type feedbackCoster struct {
+	analytic Coster
+	mem      *memo.Memo
+	store    ExecutionFeedbackStore
+
+	// fingerprints caches the fingerprint of each memo group, keyed by the
+	// first expression in the group.
+	fingerprints map[memo.RelExpr]ExprFingerprint
+}
+
+var _ BatchCoster = &feedbackCoster{}
+
+// ComputeCost is part of the Coster interface.
+func (c *feedbackCoster) ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost {
+	return c.correctCost(candidate, c.analytic.ComputeCost(candidate, required))
+}
+
+// ComputeCosts is part of the BatchCoster interface.
+func (c *feedbackCoster) ComputeCosts(
+	candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	ComputeCosts(c.analytic, candidates, required, costs)
+	for i, candidate := range candidates {
+		costs[i] = c.correctCost(candidate, costs[i])
+	}
+}
+
+// correctCost scales the given cost of the candidate, computed by the analytic
+// coster, by the correction derived from execution feedback.
+func (c *feedbackCoster) correctCost(candidate memo.RelExpr, cost memo.Cost) memo.Cost {
+	if !cost.Less(memo.MaxCost) {
+		// Never override a cost that prevents an expression from being chosen.
+		return cost
+	}
+	return cost * memo.Cost(c.correction(candidate))
+}
+
+// ComputeCostBreakdown is part of the Coster interface.
+func (c *feedbackCoster) ComputeCostBreakdown(
+	candidate memo.RelExpr, required *physical.Required,
+) memo.CostBreakdown {
+	breakdown := c.analytic.ComputeCostBreakdown(candidate, required)
+	if breakdown.Total().Less(memo.MaxCost) {
+		breakdown.Scale(c.correction(candidate))
+	}
+	return breakdown
+}
+
+// ComputeCostInterval is part of the Coster interface.
+func (c *feedbackCoster) ComputeCostInterval(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.CostInterval {
+	return c.analytic.ComputeCostInterval(candidate, required, cost)
+}
+
+// correction returns the factor by which the cost of the candidate should be
+// scaled, which is the ratio between the actual and estimated numbers of rows
+// returned by the candidate and its relational inputs. Expressions without
+// feedback are assumed to have been estimated correctly.
+func (c *feedbackCoster) correction(candidate memo.RelExpr) float64 {
+	var estimated, actual float64
+	add := func(e memo.RelExpr) {
+		rowCount := e.Relational().Stats.RowCount
+		estimated += rowCount
+		if feedback, ok := c.store.Feedback(c.fingerprint(e)); ok {
+			rowCount = feedback.RowCount
+		}
+		actual += rowCount
+	}
+	add(candidate)
+	for i, n := 0, candidate.ChildCount(); i < n; i++ {
+		if input, ok := candidate.Child(i).(memo.RelExpr); ok {
+			add(input)
+		}
+	}
+	if estimated == actual || estimated <= 0 {
+		return 1
+	}
+	return math.Max(1.0/maxFeedbackCorrection, math.Min(actual/estimated, maxFeedbackCorrection))
+}
+
+// fingerprint returns the fingerprint of the group that the given expression
+// belongs to.
+func (c *feedbackCoster) fingerprint(e memo.RelExpr) ExprFingerprint {
+	first := e.FirstExpr()
+	if fp, ok := c.fingerprints[first]; ok {
+		return fp
+	}
+	fp := FingerprintExpr(c.mem, first)
+	c.fingerprints[first] = fp
+	return fp
+}
@@ -192,6 +192,10 @@ func (c *CustomFuncs) initIdxConstraintForIndex(
 		columns, notNullCols, tabMeta.ComputedCols,
 		true /* consolidate */, c.e.evalCtx, c.e.f,
 	)
+
+	// Building the constraint can be expensive for complex filters, so give the
+	// rule a chance to be abandoned if it has exceeded its time limit.
+	c.e.o.checkRuleTimeLimit()
 	return ic
 }
 
@@ -462,6 +466,68 @@ func (ps prefixSorter) Swap(i, j int) {
 	ps[i], ps[j] = ps[j], ps[i]
 }
 
+// getLocalPartitions returns the ordinals of the partitions of the given index
+// whose zone configs indicate that their replicas will be primarily located in
+// the localRegion.
+func getLocalPartitions(index cat.Index, localRegion string) util.FastIntSet {
+	var localPartitions util.FastIntSet
+	for i, n := 0, index.PartitionCount(); i < n; i++ {
+		part := index.Partition(i)
+		if isZoneLocal(part.Zone(), localRegion) {
+			localPartitions.Add(i)
+		}
+	}
+	return localPartitions
+}
+
+// getLocalSpans returns the indexes of the spans from the given constraint that
+// target local partitions.
+func getLocalSpans(
+	evalCtx *tree.EvalContext,
+	index cat.Index,
+	localPartitions util.FastIntSet,
+	constraint *constraint.Constraint,
+) util.FastIntSet {
+	// Collect all the prefixes from all the different partitions (remembering
+	// which ones came from local partitions), and sort them so that longer
+	// prefixes come before shorter prefixes. For each span in the constraint, we
+	// will iterate through the list of prefixes until we find a match, so
+	// ordering them with longer prefixes first ensures that the correct match is
+	// found.
+	allPrefixes := getSortedPrefixes(index, localPartitions)
+
+	// Now iterate through the spans and determine whether each one matches
+	// with a prefix from a local partition.
+	// TODO(rytaft): Sort the prefixes by key in addition to length, and use
+	// binary search here.
+	var localSpans util.FastIntSet
+	for i, n := 0, constraint.Spans.Count(); i < n; i++ {
+		span := constraint.Spans.Get(i)
+		spanPrefix := span.Prefix(evalCtx)
+		for j := range allPrefixes {
+			prefix := allPrefixes[j].prefix
+			isLocal := allPrefixes[j].isLocal
+			if len(prefix) > spanPrefix {
+				continue
+			}
+			matches := true
+			for k, datum := range prefix {
+				if span.StartKey().Value(k).Compare(evalCtx, datum) != 0 {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				if isLocal {
+					localSpans.Add(i)
+				}
+				break
+			}
+		}
+	}
+	return localSpans
+}
+
 // getSortedPrefixes collects all the prefixes from all the different partitions
 // in the index (remembering which ones came from local partitions), and sorts
 // them so that longer prefixes come before shorter prefixes.
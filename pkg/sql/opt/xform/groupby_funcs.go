@@ -366,6 +366,197 @@ func (c *CustomFuncs) MakeGroupingPrivate(
 	}
 }
 
+// HasDistinctAggs returns true if any of the given aggregates has a DISTINCT
+// modifier.
+func (c *CustomFuncs) HasDistinctAggs(aggs memo.AggregationsExpr) bool {
+	for i := range aggs {
+		if aggs[i].Agg.Op() == opt.AggDistinctOp {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitDistinctAggs generates a variant of the given GroupBy or ScalarGroupBy
+// expression in which the duplicate inputs to its DISTINCT aggregates are
+// removed by an inner GroupBy, which also pre-aggregates the remaining
+// aggregates. See the SplitGroupByWithDistinctAggs rule for details.
+func (c *CustomFuncs) SplitDistinctAggs(
+	grp memo.RelExpr,
+	op opt.Operator,
+	input memo.RelExpr,
+	aggs memo.AggregationsExpr,
+	private *memo.GroupingPrivate,
+) {
+	// All the DISTINCT aggregates must have the same single input column, which
+	// becomes an additional grouping column of the inner GroupBy.
+	var distinctCol opt.ColumnID
+	for i := range aggs {
+		distinct, ok := aggs[i].Agg.(*memo.AggDistinctExpr)
+		if !ok {
+			continue
+		}
+		if distinct.Input.ChildCount() != 1 {
+			return
+		}
+		v, ok := distinct.Input.Child(0).(*memo.VariableExpr)
+		if !ok || (distinctCol != 0 && v.Col != distinctCol) {
+			return
+		}
+		distinctCol = v.Col
+	}
+	if distinctCol == 0 || private.GroupingCols.Contains(distinctCol) {
+		return
+	}
+
+	// The remaining aggregates must be decomposable into an inner aggregate and
+	// an outer aggregate that merges the partial results. Count and CountRows
+	// are merged with SumInt, which returns NULL rather than zero when there are
+	// no input rows, so they are only supported when the outer operator produces
+	// no rows for an empty input.
+	mergeOps := make([]opt.Operator, len(aggs))
+	for i := range aggs {
+		agg := aggs[i].Agg
+		if agg.Op() == opt.AggDistinctOp {
+			continue
+		}
+		if !opt.IsAggregateOp(agg) {
+			// AggFilter is not supported.
+			return
+		}
+		mergeOps[i] = agg.Op()
+		if agg.Op() == opt.CountOp || agg.Op() == opt.CountRowsOp {
+			if op == opt.ScalarGroupByOp {
+				return
+			}
+			mergeOps[i] = opt.SumIntOp
+		}
+		if !opt.AggregatesCanMerge(agg.Op(), mergeOps[i]) {
+			return
+		}
+	}
+
+	md := c.e.mem.Metadata()
+	var innerAggs memo.AggregationsExpr
+	outerAggs := make(memo.AggregationsExpr, len(aggs))
+	for i := range aggs {
+		agg := aggs[i].Agg
+		if distinct, ok := agg.(*memo.AggDistinctExpr); ok {
+			// The DISTINCT aggregate is evaluated directly on the inner grouping
+			// column, which is already free of duplicates within each group.
+			outerAggs[i] = c.e.f.ConstructAggregationsItem(distinct.Input, aggs[i].Col)
+			continue
+		}
+		partialCol := md.AddColumn("partial", md.ColumnMeta(aggs[i].Col).Type)
+		innerAggs = append(innerAggs, c.e.f.ConstructAggregationsItem(agg, partialCol))
+		mergeAgg := c.e.f.DynamicConstruct(mergeOps[i], c.e.f.ConstructVariable(partialCol))
+		outerAggs[i] = c.e.f.ConstructAggregationsItem(mergeAgg.(opt.ScalarExpr), aggs[i].Col)
+	}
+
+	inner := c.e.f.ConstructGroupBy(
+		input,
+		innerAggs,
+		c.MakeGroupingPrivate(
+			c.AddColToSet(private.GroupingCols, distinctCol), props.OrderingChoice{}, false, "",
+		),
+	)
+	switch op {
+	case opt.GroupByOp:
+		newExpr := memo.GroupByExpr{
+			Input:           inner,
+			Aggregations:    outerAggs,
+			GroupingPrivate: *private,
+		}
+		c.e.mem.AddGroupByToGroup(&newExpr, grp)
+
+	case opt.ScalarGroupByOp:
+		newExpr := memo.ScalarGroupByExpr{
+			Input:           inner,
+			Aggregations:    outerAggs,
+			GroupingPrivate: *private,
+		}
+		c.e.mem.AddScalarGroupByToGroup(&newExpr, grp)
+	}
+}
+
+// PushPartialAggregationIntoJoinLeft generates a variant of a GroupBy over an
+// InnerJoin in which the aggregates are partially computed by a GroupBy on the
+// left input of the join, and merged by a GroupBy above the join. See the
+// PushPartialAggregationIntoJoinLeft rule for details.
+func (c *CustomFuncs) PushPartialAggregationIntoJoinLeft(
+	grp memo.RelExpr,
+	left, right memo.RelExpr,
+	on memo.FiltersExpr,
+	joinPrivate *memo.JoinPrivate,
+	aggs memo.AggregationsExpr,
+	private *memo.GroupingPrivate,
+) {
+	leftCols := left.Relational().OutputCols
+	leftOnCols := on.OuterCols().Intersection(leftCols)
+	if leftOnCols.Empty() {
+		return
+	}
+
+	// The left grouping columns must be determined by the left join columns, so
+	// that the inner GroupBy has a single group per join key.
+	leftFDs := &left.Relational().FuncDeps
+	leftGroupingCols := private.GroupingCols.Intersection(leftCols)
+	if !leftFDs.InClosureOf(leftGroupingCols, leftOnCols) {
+		return
+	}
+	innerGroupingCols := leftOnCols.Union(leftGroupingCols)
+	if leftFDs.ColsAreStrictKey(innerGroupingCols) {
+		// The inner GroupBy would not reduce the number of rows.
+		return
+	}
+
+	// The aggregates must only reference left columns, and must be
+	// decomposable into an inner aggregate and an outer aggregate that merges
+	// the partial results. Count and CountRows are merged with SumInt. The outer
+	// operator is a GroupBy, so there is never an empty group for which SumInt
+	// would return NULL rather than zero.
+	mergeOps := make([]opt.Operator, len(aggs))
+	for i := range aggs {
+		agg := aggs[i].Agg
+		if !opt.IsAggregateOp(agg) {
+			// AggDistinct and AggFilter are not supported.
+			return
+		}
+		if !aggs[i].ScalarProps().OuterCols.SubsetOf(leftCols) {
+			return
+		}
+		mergeOps[i] = agg.Op()
+		if agg.Op() == opt.CountOp || agg.Op() == opt.CountRowsOp {
+			mergeOps[i] = opt.SumIntOp
+		}
+		if !opt.AggregatesCanMerge(agg.Op(), mergeOps[i]) {
+			return
+		}
+	}
+
+	md := c.e.mem.Metadata()
+	innerAggs := make(memo.AggregationsExpr, len(aggs))
+	outerAggs := make(memo.AggregationsExpr, len(aggs))
+	for i := range aggs {
+		partialCol := md.AddColumn("partial", md.ColumnMeta(aggs[i].Col).Type)
+		innerAggs[i] = c.e.f.ConstructAggregationsItem(aggs[i].Agg, partialCol)
+		mergeAgg := c.e.f.DynamicConstruct(mergeOps[i], c.e.f.ConstructVariable(partialCol))
+		outerAggs[i] = c.e.f.ConstructAggregationsItem(mergeAgg.(opt.ScalarExpr), aggs[i].Col)
+	}
+
+	inner := c.e.f.ConstructGroupBy(
+		left,
+		innerAggs,
+		c.MakeGroupingPrivate(innerGroupingCols, props.OrderingChoice{}, false, ""),
+	)
+	newExpr := memo.GroupByExpr{
+		Input:           c.e.f.ConstructInnerJoin(inner, right, on, joinPrivate),
+		Aggregations:    outerAggs,
+		GroupingPrivate: *private,
+	}
+	c.e.mem.AddGroupByToGroup(&newExpr, grp)
+}
+
 // GenerateLimitedGroupByScans enumerates all non-inverted secondary indexes on
 // the given Scan operator's table and generates an alternate Scan operator for
 // each index that includes a partial set of needed columns specified in the
@@ -0,0 +1,176 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgnotice"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
+	"github.com/cockroachdb/errors"
+)
+
+// GuardrailKind identifies the kind of expression flagged by the plan
+// guardrail. See Optimizer.SetPlanGuardrail.
+type GuardrailKind uint8
+
+const (
+	// CrossJoinGuardrail flags an inner, left or full join without any join
+	// conditions, which returns the cartesian product of its inputs.
+	CrossJoinGuardrail GuardrailKind = iota
+
+	// FullScanGuardrail flags a scan which returns every row of a table or
+	// index.
+	FullScanGuardrail
+)
+
+func (k GuardrailKind) String() string {
+	switch k {
+	case CrossJoinGuardrail:
+		return "cross join"
+	case FullScanGuardrail:
+		return "full scan"
+	default:
+		return fmt.Sprintf("GuardrailKind(%d)", k)
+	}
+}
+
+// GuardrailViolation describes a large cross join or full scan in the lowest
+// cost tree.
+type GuardrailViolation struct {
+	// Kind is the kind of expression that was flagged.
+	Kind GuardrailKind
+
+	// Expr is the cross join or scan in the lowest cost tree.
+	Expr memo.RelExpr
+
+	// Path is the sequence of child ordinals that leads from the root of the
+	// plan to Expr. It is empty if Expr is the root.
+	Path []int
+
+	// RowCount is the estimated number of rows returned by Expr. It is only
+	// meaningful if StatsAvailable is true.
+	RowCount float64
+
+	// StatsAvailable is false if there were no table statistics from which to
+	// estimate the number of rows returned by Expr, in which case Expr is
+	// always flagged.
+	StatsAvailable bool
+
+	// Message identifies the expression, e.g. the table and index that are
+	// scanned.
+	Message string
+}
+
+func (v GuardrailViolation) String() string {
+	if !v.StatsAvailable {
+		return fmt.Sprintf("%s %s at %v: no statistics available", v.Kind, v.Message, v.Path)
+	}
+	return fmt.Sprintf("%s %s at %v: estimated %.0f rows", v.Kind, v.Message, v.Path, v.RowCount)
+}
+
+// GuardrailViolations returns the large cross joins and full scans that were
+// found in the lowest cost tree by the plan guardrail. It is empty if the
+// guardrail is off. See SetPlanGuardrail.
+func (o *Optimizer) GuardrailViolations() []GuardrailViolation {
+	return o.guardrailViolations
+}
+
+// checkPlanGuardrail looks for cross joins and full scans in the given lowest
+// cost tree which are estimated to return more than guardrailRows rows, or
+// for which there are no statistics. Scans of virtual tables are ignored. If
+// any are found, it either returns an error or buffers a warning for each of
+// them, depending on the mode of the guardrail.
+func (o *Optimizer) checkPlanGuardrail(root memo.RelExpr) error {
+	if o.planGuardrail == sessiondatapb.PlanGuardrailOff {
+		return nil
+	}
+	o.guardrailViolations = nil
+	var path []int
+	var walk func(e memo.RelExpr)
+	walk = func(e memo.RelExpr) {
+		o.checkGuardrailExpr(e, path)
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if child, ok := e.Child(i).(memo.RelExpr); ok {
+				path = append(path, i)
+				walk(child)
+				path = path[:len(path)-1]
+			}
+		}
+	}
+	walk(root)
+	if len(o.guardrailViolations) == 0 {
+		return nil
+	}
+
+	if o.planGuardrail == sessiondatapb.PlanGuardrailError {
+		err := pgerror.Newf(pgcode.TooManyRows,
+			"plan contains a %s which is disallowed by optimizer_plan_guardrail",
+			o.guardrailViolations[0].String(),
+		)
+		for i := 1; i < len(o.guardrailViolations); i++ {
+			err = errors.WithDetail(err, o.guardrailViolations[i].String())
+		}
+		return errors.WithHint(err,
+			"try setting optimizer_plan_guardrail to warn, or increasing the `large_full_scan_rows` cluster/session setting",
+		)
+	}
+	if o.evalCtx.ClientNoticeSender != nil {
+		for _, v := range o.guardrailViolations {
+			o.evalCtx.ClientNoticeSender.BufferClientNotice(o.ctx(), pgnotice.NewWithSeverityf(
+				"WARNING", "plan contains a %s", v.String(),
+			))
+		}
+	}
+	return nil
+}
+
+// checkGuardrailExpr records a guardrail violation if the given expression is
+// a large cross join or full scan.
+func (o *Optimizer) checkGuardrailExpr(e memo.RelExpr, path []int) {
+	var kind GuardrailKind
+	var message string
+	switch t := e.(type) {
+	case *memo.InnerJoinExpr, *memo.LeftJoinExpr, *memo.FullJoinExpr:
+		if len(*e.Child(2).(*memo.FiltersExpr)) != 0 {
+			return
+		}
+		kind, message = CrossJoinGuardrail, fmt.Sprintf("(%s)", e.Op())
+
+	case *memo.ScanExpr:
+		md := o.mem.Metadata()
+		tab := md.Table(t.Table)
+		if tab.IsVirtualTable() || !t.IsUnfiltered(md) {
+			return
+		}
+		kind = FullScanGuardrail
+		message = fmt.Sprintf("of %s@%s", tab.Name(), tab.Index(t.Index).Name())
+
+	default:
+		return
+	}
+
+	stats := e.Relational().Stats
+	if stats.Available && stats.RowCount <= o.guardrailRows {
+		return
+	}
+	o.guardrailViolations = append(o.guardrailViolations, GuardrailViolation{
+		Kind:           kind,
+		Expr:           e,
+		Path:           append([]int(nil), path...),
+		RowCount:       stats.RowCount,
+		StatsAvailable: stats.Available,
+		Message:        message,
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/indexrec"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/errors"
+)
+
+// WhatIfReport describes how the plan of a query changes when a set of
+// hypothetical indexes is added to its tables. See
+// OptimizeWithHypotheticalIndexes.
+type WhatIfReport struct {
+	// Used contains the hypothetical indexes that are accessed by the lowest
+	// cost plan found with the hypothetical indexes, in the order in which
+	// they appear in the plan. Existing indexes are never included.
+	Used []cat.Index
+
+	// Recommendations contains the index recommendations derived from the
+	// hypothetical indexes in Used, with their stored columns pruned to the
+	// columns that are scanned by the plan.
+	Recommendations indexrec.IndexRecommendationSet
+
+	// Cost is the estimated cost of the lowest cost plan found with the
+	// hypothetical indexes.
+	Cost memo.Cost
+
+	// CurrentCost is the estimated cost of the lowest cost plan found with
+	// the existing indexes only.
+	CurrentCost memo.Cost
+}
+
+// CostDelta returns the difference between the estimated cost of the plan with
+// the hypothetical indexes and the cost of the current plan. It is negative if
+// the hypothetical indexes are expected to make the query cheaper.
+func (r *WhatIfReport) CostDelta() memo.Cost {
+	return r.Cost - r.CurrentCost
+}
+
+// OptimizeWithHypotheticalIndexes is like Optimize, but also optimizes a copy
+// of the expression as if the given indexes existed, and reports which of
+// them are used by the resulting plan and how much they change its cost. The
+// indexes map is in the format returned by indexrec.FindIndexCandidateSet.
+//
+// The tables are replaced by indexrec.HypotheticalTable wrappers in the
+// metadata of the copy only, so the returned expression is the plan that
+// Optimize would have produced, and can be executed. The copy is optimized
+// by a separate optimizer that uses the same cost model settings and disabled
+// rules, but the default coster, so costs are only comparable if SetCoster
+// has not been called.
+//
+// OptimizeWithHypotheticalIndexes must be called instead of Optimize, after
+// the expression has been built and before it has been optimized.
+func (o *Optimizer) OptimizeWithHypotheticalIndexes(
+	indexes map[cat.Table][][]cat.IndexColumn,
+) (_ opt.Expr, _ WhatIfReport, err error) {
+	if o.mem.IsOptimized() {
+		return nil, WhatIfReport{}, errors.AssertionFailedf("cannot optimize a memo multiple times")
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, WhatIfReport{}, errors.AssertionFailedf(
+			"can only optimize relational root expressions with hypothetical indexes",
+		)
+	}
+
+	// Optimize the copy first, since the original expression is replaced by
+	// its lowest cost tree once it has been optimized.
+	report, err := o.optimizeWhatIf(root, indexes)
+	if err != nil {
+		return nil, WhatIfReport{}, err
+	}
+
+	expr, err := o.Optimize()
+	if err != nil {
+		return nil, WhatIfReport{}, err
+	}
+	report.CurrentCost = expr.(memo.RelExpr).Cost()
+	return expr, report, nil
+}
+
+// usedHypotheticalIndexes returns the hypothetical indexes that are accessed by
+// the given lowest cost tree, without duplicates.
+func usedHypotheticalIndexes(root opt.Expr, md *opt.Metadata) []cat.Index {
+	var used []cat.Index
+	add := func(tabID opt.TableID, ord cat.IndexOrdinal) {
+		tab, ok := md.Table(tabID).(*indexrec.HypotheticalTable)
+		if !ok || ord < tab.Table.IndexCount() {
+			return
+		}
+		index := tab.Index(ord)
+		for i := range used {
+			if used[i] == index {
+				return
+			}
+		}
+		used = append(used, index)
+	}
+	var walk func(e opt.Expr)
+	walk = func(e opt.Expr) {
+		switch t := e.(type) {
+		case *memo.ScanExpr:
+			add(t.Table, t.Index)
+		case *memo.LookupJoinExpr:
+			add(t.Table, t.Index)
+		case *memo.InvertedJoinExpr:
+			add(t.Table, t.Index)
+		case *memo.ZigzagJoinExpr:
+			add(t.LeftTable, t.LeftIndex)
+			add(t.RightTable, t.RightIndex)
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			walk(e.Child(i))
+		}
+	}
+	walk(root)
+	return used
+}
+
+// optimizeWhatIf optimizes a copy of the given unoptimized root expression
+// with the given hypothetical indexes added to its tables, and returns a report
+// in which all fields but CurrentCost are set. The index columns are copied, so
+// the indexes map is not modified.
+func (o *Optimizer) optimizeWhatIf(
+	root memo.RelExpr, indexes map[cat.Table][][]cat.IndexColumn,
+) (WhatIfReport, error) {
+	// BuildOptAndHypTableMaps replaces the last column of inverted indexes in
+	// place, so pass it a copy of the index columns.
+	indexesCopy := make(map[cat.Table][][]cat.IndexColumn, len(indexes))
+	for tab, tabIndexes := range indexes {
+		tabIndexesCopy := make([][]cat.IndexColumn, len(tabIndexes))
+		for i := range tabIndexes {
+			tabIndexesCopy[i] = append([]cat.IndexColumn(nil), tabIndexes[i]...)
+		}
+		indexesCopy[tab] = tabIndexesCopy
+	}
+
+	var hyp Optimizer
+	hyp.Init(o.evalCtx, o.catalog)
+	hyp.SetCostModelSettings(o.costModel)
+	hyp.DisableRules(o.DisabledRules())
+	f := hyp.Factory()
+	f.CopyAndReplace(root, o.mem.RootProps(), f.CopyWithoutAssigningPlaceholders)
+	_, hypTables := indexrec.BuildOptAndHypTableMaps(indexesCopy)
+	hyp.Memo().Metadata().UpdateTableMeta(hypTables)
+	hypRoot, err := hyp.Optimize()
+	if err != nil {
+		return WhatIfReport{}, err
+	}
+
+	var report WhatIfReport
+	md := hyp.Memo().Metadata()
+	report.Used = usedHypotheticalIndexes(hypRoot, md)
+	report.Recommendations = indexrec.FindIndexRecommendationSet(hypRoot, md)
+	report.Cost = hypRoot.(memo.RelExpr).Cost()
+	return report, nil
+}
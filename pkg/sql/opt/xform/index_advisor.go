@@ -0,0 +1,131 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/indexrec"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/errors"
+)
+
+// IndexRecommendation is a candidate index that is expected to make a query
+// cheaper. See RecommendIndexes.
+type IndexRecommendation struct {
+	// Table is the table on which the index would be created.
+	Table cat.Table
+
+	// Columns are the key columns of the candidate index.
+	Columns []cat.IndexColumn
+
+	// WhatIfReport describes the plan that was found when the candidate index
+	// was added to Table. Its Recommendations field contains the statement to
+	// create the index, with the columns that the plan needs it to store.
+	WhatIfReport
+}
+
+// Improvement returns the estimated reduction in the cost of the query if the
+// index is created.
+func (r *IndexRecommendation) Improvement() memo.Cost {
+	return -r.CostDelta()
+}
+
+// RecommendIndexes is like Optimize, but also recommends indexes that would
+// make the query cheaper. The candidate indexes are synthesized from the
+// columns of the normalized expression which are constrained by filters, used
+// in join conditions, grouped or ordered, using indexrec.FindIndexCandidateSet.
+// A copy of the expression is optimized with each candidate index added to its
+// table, as by OptimizeWithHypotheticalIndexes, and the candidates that are
+// used by the resulting plan and reduce its cost are returned, ordered from the
+// largest estimated improvement to the smallest.
+//
+// Each candidate requires a full optimization of the query, so this is much
+// more expensive than Optimize, and is intended to be used by an index advisor
+// rather than when planning queries for execution. RecommendIndexes must be
+// called instead of Optimize, after the expression has been built and before
+// it has been optimized.
+func (o *Optimizer) RecommendIndexes() (_ opt.Expr, _ []IndexRecommendation, err error) {
+	if o.mem.IsOptimized() {
+		return nil, nil, errors.AssertionFailedf("cannot optimize a memo multiple times")
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, nil, errors.AssertionFailedf(
+			"can only recommend indexes for relational root expressions",
+		)
+	}
+
+	// Evaluate every candidate before optimizing the original expression,
+	// since it is replaced by its lowest cost tree once it has been optimized.
+	var recs []IndexRecommendation
+	candidates := indexrec.FindIndexCandidateSet(root, o.mem.Metadata())
+	for tab, indexes := range candidates {
+		for _, cols := range indexes {
+			report, err := o.optimizeWhatIf(root, map[cat.Table][][]cat.IndexColumn{tab: {cols}})
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(report.Used) > 0 {
+				recs = append(recs, IndexRecommendation{Table: tab, Columns: cols, WhatIfReport: report})
+			}
+		}
+	}
+
+	expr, err := o.Optimize()
+	if err != nil {
+		return nil, nil, err
+	}
+	currentCost := expr.(memo.RelExpr).Cost()
+
+	// Only keep the candidates which make the query cheaper, and rank them.
+	n := 0
+	for i := range recs {
+		recs[i].CurrentCost = currentCost
+		if recs[i].Cost.Less(currentCost) {
+			recs[n] = recs[i]
+			n++
+		}
+	}
+	recs = recs[:n]
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Cost.Less(recs[j].Cost) {
+			return true
+		}
+		if recs[j].Cost.Less(recs[i].Cost) {
+			return false
+		}
+		// Break ties deterministically, since candidates are found by iterating
+		// over a map.
+		if recs[i].Table.Name() != recs[j].Table.Name() {
+			return recs[i].Table.Name() < recs[j].Table.Name()
+		}
+		return indexColumnsLess(recs[i].Columns, recs[j].Columns)
+	})
+	return expr, recs, nil
+}
+
+// indexColumnsLess returns true if the given index columns sort before the
+// other index columns, comparing the ordinals of the columns in order, then
+// their directions, then the number of columns.
+func indexColumnsLess(cols, other []cat.IndexColumn) bool {
+	for i := 0; i < len(cols) && i < len(other); i++ {
+		if cols[i].Ordinal() != other[i].Ordinal() {
+			return cols[i].Ordinal() < other[i].Ordinal()
+		}
+		if cols[i].Descending != other[i].Descending {
+			return !cols[i].Descending
+		}
+	}
+	return len(cols) < len(other)
+}
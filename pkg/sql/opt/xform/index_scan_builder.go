@@ -233,6 +233,10 @@ func (b *indexScanBuilder) BuildNewExpr() (output memo.RelExpr) {
 // Build constructs the final memo expression by composing together the various
 // expressions that were specified by previous calls to various add methods.
 func (b *indexScanBuilder) Build(grp memo.RelExpr) {
+	// Abandon the rule before adding to the group if it has exceeded its time
+	// limit.
+	b.c.e.o.checkRuleTimeLimit()
+
 	// 1. Only scan.
 	if !b.hasConstProjections() && !b.hasInnerFilters() && !b.hasInvertedFilter() && !b.hasIndexJoin() {
 		b.mem.AddScanToGroup(&memo.ScanExpr{ScanPrivate: b.scanPrivate}, grp)
@@ -1280,6 +1280,97 @@ func (c *CustomFuncs) constructJoinWithConstants(
 	return join, constColID
 }
 
+// maxApplyJoinLeftRows is the maximum estimated row count of the left input
+// of a join for which GenerateApplyJoin adds an apply join. An apply join
+// re-plans its right input for each left row, so it is only worth considering
+// when the left input is tiny. The limit also bounds the number of correlated
+// groups that are added to the memo.
+const maxApplyJoinLeftRows = 100
+
+// GenerateApplyJoin adds an apply join to the given group that is equivalent
+// to the given decorrelated join, by pushing the ON filters into the right
+// input:
+//
+//        Join                  JoinApply
+//       /  |  \               /    |    \
+//      /   |   \     ->      /     |     \
+//   Left Right  On       Left   Select    []
+//                                /   \
+//                               /     \
+//                            Right     On
+//
+// This is correct for inner, left, semi and anti joins, since each left row is
+// matched with the rows of the right input for which the ON filters are true
+// in both cases. The apply join is costed by computeApplyJoinCost, which
+// accounts for the right input being re-planned for each left row with the
+// outer columns replaced by constants.
+//
+// No apply join is added if:
+//
+//   1. Apply joins are not explored (see memo.Memo.ExploreApplyJoins).
+//   2. The left input is estimated to have more than maxApplyJoinLeftRows rows.
+//   3. The right input is a Scan, or a Select on a Scan. Lookup joins are
+//      already generated for those, and are cheaper than an apply join.
+//   4. The ON filters contain a subquery.
+//   5. The ON filters do not reference columns from both inputs, in which case
+//      the right input would not be correlated with the left input.
+//
+func (c *CustomFuncs) GenerateApplyJoin(
+	grp memo.RelExpr,
+	joinType opt.Operator,
+	left, right memo.RelExpr,
+	on memo.FiltersExpr,
+	joinPrivate *memo.JoinPrivate,
+) {
+	if !c.e.mem.ExploreApplyJoins() || left.Relational().Stats.RowCount > maxApplyJoinLeftRows {
+		return
+	}
+	switch right.Op() {
+	case opt.ScanOp:
+		return
+	case opt.SelectOp:
+		if right.Child(0).Op() == opt.ScanOp {
+			return
+		}
+	}
+
+	var filterCols opt.ColSet
+	for i := range on {
+		if on[i].ScalarProps().HasSubquery {
+			return
+		}
+		filterCols.UnionWith(on[i].ScalarProps().OuterCols)
+	}
+	if !filterCols.Intersects(left.Relational().OutputCols) ||
+		!filterCols.Intersects(right.Relational().OutputCols) {
+		return
+	}
+
+	// The Select is normalized, which may push the correlated filters further
+	// down into the right input, e.g. below a GroupBy.
+	newRight := c.e.f.ConstructSelect(right, on)
+	switch joinType {
+	case opt.InnerJoinOp:
+		c.e.mem.AddInnerJoinApplyToGroup(&memo.InnerJoinApplyExpr{
+			Left: left, Right: newRight, On: memo.TrueFilter, JoinPrivate: *joinPrivate,
+		}, grp)
+	case opt.LeftJoinOp:
+		c.e.mem.AddLeftJoinApplyToGroup(&memo.LeftJoinApplyExpr{
+			Left: left, Right: newRight, On: memo.TrueFilter, JoinPrivate: *joinPrivate,
+		}, grp)
+	case opt.SemiJoinOp:
+		c.e.mem.AddSemiJoinApplyToGroup(&memo.SemiJoinApplyExpr{
+			Left: left, Right: newRight, On: memo.TrueFilter, JoinPrivate: *joinPrivate,
+		}, grp)
+	case opt.AntiJoinOp:
+		c.e.mem.AddAntiJoinApplyToGroup(&memo.AntiJoinApplyExpr{
+			Left: left, Right: newRight, On: memo.TrueFilter, JoinPrivate: *joinPrivate,
+		}, grp)
+	default:
+		panic(errors.AssertionFailedf("unexpected join type: %v", joinType))
+	}
+}
+
 // ShouldReorderJoins returns whether the optimizer should attempt to find
 // a better ordering of inner joins. This is the case if the given expression is
 // the first expression of its group, and the join tree rooted at the expression
@@ -1303,10 +1394,20 @@ func (c *CustomFuncs) ShouldReorderJoins(root memo.RelExpr) bool {
 
 // ReorderJoins adds alternate orderings of the given join tree to the memo. The
 // first expression of the memo group is used for construction of the join
-// graph. For more information, see the comment in join_order_builder.go.
+// graph. For more information, see the comment in join_order_builder.go. When
+// the optimizer is planning heuristically, only a single greedy ordering is
+// added, along with a single bushy ordering if the reorder_joins_shape session
+// setting is bushy. Orderings that violate the join order hint, if any, are not
+// added.
 func (c *CustomFuncs) ReorderJoins(grp memo.RelExpr) memo.RelExpr {
 	c.e.o.JoinOrderBuilder().Init(c.e.f, c.e.evalCtx)
-	c.e.o.JoinOrderBuilder().Reorder(grp.FirstExpr())
+	c.e.o.JoinOrderBuilder().hint = c.e.o.joinHint
+	c.e.o.JoinOrderBuilder().cache = c.e.o.joinOrderCache
+	if c.e.o.heuristic {
+		c.e.o.JoinOrderBuilder().ReorderGreedy(grp.FirstExpr())
+	} else {
+		c.e.o.JoinOrderBuilder().Reorder(grp.FirstExpr())
+	}
 	return grp
 }
 
@@ -1521,13 +1622,7 @@ func (c *CustomFuncs) GetLocalityOptimizedLookupJoinExprs(
 	}
 
 	// Determine whether the index has both local and remote partitions.
-	var localPartitions util.FastIntSet
-	for i, n := 0, index.PartitionCount(); i < n; i++ {
-		part := index.Partition(i)
-		if isZoneLocal(part.Zone(), localRegion) {
-			localPartitions.Add(i)
-		}
-	}
+	localPartitions := getLocalPartitions(index, localRegion)
 	if localPartitions.Len() == 0 || localPartitions.Len() == index.PartitionCount() {
 		// The partitions are either all local or all remote.
 		return nil, nil, false
@@ -0,0 +1,194 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util"
+)
+
+// joinOrderHint is a LEADING hint, which fixes a prefix of the join order: the
+// tables that it names must be joined before any other relation, in the given
+// order, with each table joined as the right input of a join whose left input
+// contains the tables before it. If the hint names every table in the query,
+// it fixes the entire join order. For example, the hint "c,a,b" requires the
+// joins ((c JOIN a) JOIN b) JOIN ..., in that order and orientation.
+//
+// The hint is honored in two ways. The JoinOrderBuilder does not add joins to
+// the memo that violate it, and the optimizer gives any other join that
+// violates it, such as a join from the original query or one created by
+// commuting or associating joins, a huge cost. As with index and join
+// algorithm hints, if no plan satisfies the hint, the cheapest plan that does
+// not is chosen.
+type joinOrderHint struct {
+	md *opt.Metadata
+
+	// positions maps the alias of each table named by the hint to its position
+	// in the hint.
+	positions map[tree.Name]int
+
+	// relations caches the result of hintedRelationsOf for each memo group,
+	// keyed by the first expression in the group.
+	relations map[memo.RelExpr]hintedRelations
+}
+
+// hintedRelations describes the base relations of an expression with respect
+// to a joinOrderHint.
+type hintedRelations struct {
+	// hinted contains the positions in the hint of the hinted tables in the
+	// expression.
+	hinted util.FastIntSet
+
+	// other is true if the expression has any base relation that is not named
+	// by the hint.
+	other bool
+}
+
+// makeJoinOrderHint returns a joinOrderHint for the given table names, which
+// are resolved against the tables in the given metadata. Each name must be the
+// alias of exactly one table in the query; if any is not, the hint cannot be
+// applied and nil is returned.
+func makeJoinOrderHint(md *opt.Metadata, names []string) *joinOrderHint {
+	if len(names) == 0 {
+		return nil
+	}
+	h := &joinOrderHint{
+		md:        md,
+		positions: make(map[tree.Name]int, len(names)),
+		relations: make(map[memo.RelExpr]hintedRelations),
+	}
+	for i, name := range names {
+		if _, ok := h.positions[tree.Name(name)]; ok {
+			return nil
+		}
+		h.positions[tree.Name(name)] = i
+	}
+	matches := make([]int, len(names))
+	for _, tab := range md.AllTables() {
+		if i, ok := h.positions[tab.Alias.ObjectName]; ok {
+			matches[i]++
+		}
+	}
+	for i := range matches {
+		if matches[i] != 1 {
+			return nil
+		}
+	}
+	return h
+}
+
+// position returns the position in the hint of the given table, if the hint
+// names it.
+func (h *joinOrderHint) position(tabID opt.TableID) (int, bool) {
+	i, ok := h.positions[h.md.TableMeta(tabID).Alias.ObjectName]
+	return i, ok
+}
+
+// tableRelations returns the hintedRelations of a scan of the given table.
+func (h *joinOrderHint) tableRelations(tabID opt.TableID) hintedRelations {
+	if i, ok := h.position(tabID); ok {
+		return hintedRelations{hinted: util.MakeFastIntSet(i)}
+	}
+	return hintedRelations{other: true}
+}
+
+// hintedRelationsOf returns the hintedRelations of the given expression, which
+// are the same for every expression in its memo group.
+func (h *joinOrderHint) hintedRelationsOf(e memo.RelExpr) hintedRelations {
+	e = e.FirstExpr()
+	if rels, ok := h.relations[e]; ok {
+		return rels
+	}
+
+	var rels hintedRelations
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		rels = h.tableRelations(t.Table)
+
+	case *memo.ZigzagJoinExpr:
+		rels = h.tableRelations(t.LeftTable)
+
+	default:
+		var found bool
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if child, ok := e.Child(i).(memo.RelExpr); ok {
+				found = true
+				childRels := h.hintedRelationsOf(child)
+				rels.hinted.UnionWith(childRels.hinted)
+				rels.other = rels.other || childRels.other
+			}
+		}
+		if !found {
+			// Treat leaf expressions other than scans, such as Values, as base
+			// relations that are not named by the hint.
+			rels.other = true
+		}
+	}
+	h.relations[e] = rels
+	return rels
+}
+
+// allows returns true if a join with inputs that have the given relations
+// satisfies the hint.
+func (h *joinOrderHint) allows(left, right hintedRelations) bool {
+	all := left.hinted.Union(right.hinted)
+	if all.Empty() {
+		// The join does not involve any hinted tables.
+		return true
+	}
+
+	// The hinted tables must be joined in order, so the join must contain a
+	// prefix of them.
+	n := all.Len()
+	for i := 0; i < n; i++ {
+		if !all.Contains(i) {
+			return false
+		}
+	}
+
+	// No other relation can be joined until every hinted table has been.
+	if n < len(h.positions) && (left.other || right.other) {
+		return false
+	}
+
+	if right.hinted.Empty() {
+		// This is a join of the hinted tables with other relations.
+		return true
+	}
+
+	// Otherwise, this must be the join of the next hinted table to the hinted
+	// tables before it.
+	return n > 1 && !left.other && !right.other &&
+		right.hinted.Len() == 1 && right.hinted.Contains(n-1)
+}
+
+// allowsExpr returns true if the given expression satisfies the hint. Only
+// joins can violate the hint.
+func (h *joinOrderHint) allowsExpr(e memo.RelExpr) bool {
+	var left, right hintedRelations
+	switch t := e.(type) {
+	case *memo.LookupJoinExpr:
+		left, right = h.hintedRelationsOf(t.Input), h.tableRelations(t.Table)
+
+	case *memo.InvertedJoinExpr:
+		left, right = h.hintedRelationsOf(t.Input), h.tableRelations(t.Table)
+
+	default:
+		if !opt.IsJoinOp(e) && e.Op() != opt.MergeJoinOp {
+			return true
+		}
+		left = h.hintedRelationsOf(e.Child(0).(memo.RelExpr))
+		right = h.hintedRelationsOf(e.Child(1).(memo.RelExpr))
+	}
+	return h.allows(left, right)
+}
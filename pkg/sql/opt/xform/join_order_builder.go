@@ -19,6 +19,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/errors"
 )
@@ -311,14 +312,35 @@ type JoinOrderBuilder struct {
 	// once does not exceed the session limit.
 	joinCount int
 
+	// joinLimit, if non-zero, overrides the reorder_joins_limit session setting
+	// as the maximum number of joins that are added to the join graph. It is set
+	// when the join graph is searched rather than fully enumerated.
+	joinLimit int
+
+	// hint, if non-nil, is the join order hint. Joins that violate it are not
+	// added to the memo.
+	hint *joinOrderHint
+
+	// cache, if non-nil, stores the best join order found for each join graph.
+	// See SetJoinOrderCache.
+	cache *JoinOrderCache
+
+	// cacheKey is the key of the join graph in the cache. It is only set if
+	// cache is non-nil.
+	cacheKey string
+
 	onReorderFunc OnReorderFunc
 
 	onAddJoinFunc OnAddJoinFunc
+
+	// stats accumulates the size of the search space over all join trees that
+	// are reordered. See Stats.
+	stats JoinReorderStats
 }
 
 // Init initializes a new JoinOrderBuilder with the given factory. The join
-// graph is reset, so a JoinOrderBuilder can be reused. Callback functions are
-// not reset.
+// graph is reset, so a JoinOrderBuilder can be reused. Callback functions and
+// stats are not reset.
 func (jb *JoinOrderBuilder) Init(f *norm.Factory, evalCtx *tree.EvalContext) {
 	// This initialization pattern ensures that fields are not unwittingly
 	// reused. Field reuse must be explicit.
@@ -328,11 +350,66 @@ func (jb *JoinOrderBuilder) Init(f *norm.Factory, evalCtx *tree.EvalContext) {
 		plans:         make(map[vertexSet]memo.RelExpr),
 		onReorderFunc: jb.onReorderFunc,
 		onAddJoinFunc: jb.onAddJoinFunc,
+		stats:         jb.stats,
 	}
 }
 
-// Reorder adds all valid orderings of the given join to the memo.
+// Reorder adds all valid orderings of the given join to the memo. If the join
+// tree has more joins than the reorder_joins_limit session setting, and the
+// reorder_joins_search_budget session setting is non-zero, the entire join tree
+// is instead searched for good orderings for up to that amount of time, and
+// only the best orderings that are found are added to the memo. See
+// randomizedSearch. The reorder_joins_shape session setting controls whether
+// bushy orderings are added as well; see sessiondatapb.JoinShapeMode.
 func (jb *JoinOrderBuilder) Reorder(join memo.RelExpr) {
+	budget := jb.evalCtx.SessionData().ReorderJoinsSearchBudget
+	if budget > 0 && countReorderableJoins(join) > int(jb.evalCtx.SessionData().ReorderJoinsLimit) {
+		// The number of base relations cannot exceed MaxReorderJoinsLimit.
+		jb.joinLimit = opt.MaxReorderJoinsLimit - 1
+		jb.reorder(join, func() {
+			jb.randomizedSearch(budget)
+			jb.maybeBushyGreedy()
+		})
+		return
+	}
+	jb.reorder(join, jb.dpSube)
+}
+
+// countReorderableJoins returns the number of joins in the given join tree
+// that can be reordered, which is the number of joins that populateGraph would
+// add to the join graph if it were not limited.
+func countReorderableJoins(rel memo.RelExpr) int {
+	switch t := rel.(type) {
+	case *memo.InnerJoinExpr, *memo.SemiJoinExpr, *memo.AntiJoinExpr,
+		*memo.LeftJoinExpr, *memo.FullJoinExpr:
+		if !t.Private().(*memo.JoinPrivate).Flags.Empty() {
+			return 0
+		}
+		left := t.Child(0).(memo.RelExpr)
+		right := t.Child(1).(memo.RelExpr)
+		return 1 + countReorderableJoins(left) + countReorderableJoins(right)
+	}
+	return 0
+}
+
+// ReorderGreedy adds a single left-deep ordering of the given join to the
+// memo, which is chosen greedily: starting with the base relation with the
+// fewest rows, the relation that results in the join with the fewest rows is
+// joined next. Unlike Reorder, the number of joins that are added to the memo
+// is quadratic rather than exponential in the number of base relations, so it
+// is suitable for queries with many joins. See greedy. If the
+// reorder_joins_shape session setting is bushy, a single bushy ordering is
+// added as well. See bushyGreedy.
+func (jb *JoinOrderBuilder) ReorderGreedy(join memo.RelExpr) {
+	jb.reorder(join, func() {
+		jb.greedy()
+		jb.maybeBushyGreedy()
+	})
+}
+
+// reorder builds the join graph for the given join, and then calls enumerate
+// to add orderings of the join to the memo.
+func (jb *JoinOrderBuilder) reorder(join memo.RelExpr, enumerate func()) {
 	switch t := join.(type) {
 	case *memo.InnerJoinExpr, *memo.SemiJoinExpr, *memo.AntiJoinExpr,
 		*memo.LeftJoinExpr, *memo.FullJoinExpr:
@@ -348,14 +425,28 @@ func (jb *JoinOrderBuilder) Reorder(join memo.RelExpr) {
 		// the best plan.
 		jb.ensureClosure(join)
 
+		jb.stats.Reorders++
+		jb.stats.Joins += countReorderableJoins(join)
+		jb.stats.Edges += len(jb.edges)
+
 		if jb.onReorderFunc != nil {
 			// Hook for testing purposes.
 			jb.callOnReorderFunc(join)
 		}
 
-		// Execute the DPSube algorithm. Enumerate all join orderings and add any
-		// valid ones to the memo.
-		jb.dpSube()
+		// Add the order that was cached for a join graph with the same structure
+		// before any other orderings, so that it is in the memo even if the
+		// enumeration is cut short.
+		if jb.cache != nil {
+			jb.cacheKey = jb.joinGraphKey()
+			if order := jb.cachedOrder(); order != nil {
+				jb.stats.CachedOrders++
+				jb.addLeftDeepOrder(order)
+			}
+		}
+
+		// Enumerate join orderings and add any valid ones to the memo.
+		enumerate()
 
 	default:
 		panic(errors.AssertionFailedf("%v cannot be reordered", t.Op()))
@@ -378,13 +469,21 @@ func (jb *JoinOrderBuilder) populateGraph(rel memo.RelExpr) (vertexSet, edgeSet)
 		*memo.LeftJoinExpr, *memo.FullJoinExpr:
 		jb.joinCount++
 
+		limit := int(jb.evalCtx.SessionData().ReorderJoinsLimit)
+		if jb.joinLimit != 0 {
+			limit = jb.joinLimit
+		}
 		flags := t.Private().(*memo.JoinPrivate).Flags
-		if !flags.Empty() || jb.joinCount > int(jb.evalCtx.SessionData().ReorderJoinsLimit) {
+		if !flags.Empty() || jb.joinCount > limit {
 			// If the join has flags or the join limit has been reached, we can't
 			// reorder. Simply treat the join as a base relation.
+			if flags.Empty() {
+				jb.stats.ReorderLimitReached = true
+			}
 			jb.addBaseRelation(t)
 			break
 		}
+		jb.stats.ReorderedJoins++
 
 		left := t.Child(0).(memo.RelExpr)
 		right := t.Child(1).(memo.RelExpr)
@@ -464,8 +563,12 @@ func (jb *JoinOrderBuilder) ensureClosure(join memo.RelExpr) {
 // disjoint pairs of subsets of base relations are enumerated and checked for
 // validity. If valid, the pair of subsets is used along with the edges
 // connecting them to create a new join operator, which is added to the memo.
+// If the reorder_joins_shape session setting is left_deep, only pairs in which
+// at least one subset is a single base relation are joined, so that only
+// linear join trees are added to the memo.
 // TODO(drewk): implement DPHyp (or a similar algorithm).
 func (jb *JoinOrderBuilder) dpSube() {
+	linearOnly := jb.evalCtx.SessionData().ReorderJoinsShape == sessiondatapb.JoinShapeLeftDeep
 	subsets := jb.allVertexes()
 	for subset := vertexSet(1); subset <= subsets; subset++ {
 		if subset.isSingleton() {
@@ -486,11 +589,132 @@ func (jb *JoinOrderBuilder) dpSube() {
 				continue
 			}
 			s2 := subset.difference(s1)
+			if linearOnly && !s1.isSingleton() && !s2.isSingleton() {
+				continue
+			}
 			jb.addJoins(s1, s2)
 		}
 	}
 }
 
+// greedy builds a left-deep join tree one base relation at a time. It starts
+// with the base relation with the fewest rows. At each step, it tries to join
+// every remaining base relation to the tree built so far, and keeps the join
+// that results in the fewest rows. Joins that are valid but not chosen are
+// still added to the memo, so that the optimizer can cost them. If no
+// remaining relation can be joined without a cross join or an invalid plan,
+// greedy stops; the original join tree is always present in the memo, so a
+// valid plan still exists.
+func (jb *JoinOrderBuilder) greedy() {
+	all := jb.allVertexes()
+	var current vertexSet
+	for i, ok := all.next(0); ok; i, ok = all.next(i + 1) {
+		v := vertexSet(0).add(i)
+		if current == 0 || rowCount(jb.plans[v]) < rowCount(jb.plans[current]) {
+			current = v
+		}
+	}
+	for current != all {
+		var best vertexSet
+		remaining := all.difference(current)
+		for i, ok := remaining.next(0); ok; i, ok = remaining.next(i + 1) {
+			candidate := current.add(i)
+			jb.addJoins(current, vertexSet(0).add(i))
+			if jb.plans[candidate] == nil {
+				continue
+			}
+			if best == 0 || rowCount(jb.plans[candidate]) < rowCount(jb.plans[best]) {
+				best = candidate
+			}
+		}
+		if best == 0 {
+			return
+		}
+		current = best
+	}
+}
+
+// maybeBushyGreedy calls bushyGreedy if the reorder_joins_shape session
+// setting is bushy.
+func (jb *JoinOrderBuilder) maybeBushyGreedy() {
+	if jb.evalCtx.SessionData().ReorderJoinsShape == sessiondatapb.JoinShapeBushy {
+		jb.bushyGreedy()
+	}
+}
+
+// bushyGreedy builds a bushy join tree using greedy operator ordering. It
+// starts with one component for each base relation. At each step, it tries to
+// join every pair of components, and replaces the pair whose join results in
+// the fewest rows with their join. Unlike greedy, both inputs of a join can be
+// joins, so two independent joins that each filter out most of their rows are
+// both evaluated before they are joined together, e.g. (A ⋈ B) ⋈ (C ⋈ D).
+// Joins that are valid but not chosen are still added to the memo, so that
+// the optimizer costs the bushy tree against the left-deep ones. If no pair of
+// components can be joined without a cross join or an invalid plan,
+// bushyGreedy stops.
+func (jb *JoinOrderBuilder) bushyGreedy() {
+	all := jb.allVertexes()
+	components := make([]vertexSet, 0, all.len())
+	for i, ok := all.next(0); ok; i, ok = all.next(i + 1) {
+		components = append(components, vertexSet(0).add(i))
+	}
+
+	// joined is the index of the component that was formed by the last step,
+	// or -1 before the first step. Only pairs that include it need to be added
+	// to the memo, since the joins of the other pairs were added by previous
+	// steps.
+	joined := -1
+	for len(components) > 1 {
+		left, right := -1, -1
+		for i := range components {
+			for j := i + 1; j < len(components); j++ {
+				if joined == -1 || i == joined || j == joined {
+					jb.addJoins(components[i], components[j])
+				}
+				candidate := jb.plans[components[i].union(components[j])]
+				if candidate == nil {
+					continue
+				}
+				if left == -1 ||
+					rowCount(candidate) < rowCount(jb.plans[components[left].union(components[right])]) {
+					left, right = i, j
+				}
+			}
+		}
+		if left == -1 {
+			return
+		}
+		components[left] = components[left].union(components[right])
+		components = append(components[:right], components[right+1:]...)
+		joined = left
+	}
+}
+
+// rowCount returns the estimated number of rows returned by the given
+// expression.
+func rowCount(e memo.RelExpr) float64 {
+	return e.Relational().Stats.RowCount
+}
+
+// canJoin returns true if there is an edge that allows the memo groups for the
+// two given sets of base relations to be joined, without creating an invalid
+// plan or introducing a cross join. It mirrors the checks made by addJoins,
+// but does not add anything to the memo.
+func (jb *JoinOrderBuilder) canJoin(s1, s2 vertexSet) bool {
+	for i, ok := jb.nonInnerEdges.Next(0); ok; i, ok = jb.nonInnerEdges.Next(i + 1) {
+		e := &jb.edges[i]
+		if e.checkNonInnerJoin(s1, s2) || e.checkNonInnerJoin(s2, s1) {
+			return true
+		}
+	}
+	for i, ok := jb.innerEdges.Next(0); ok; i, ok = jb.innerEdges.Next(i + 1) {
+		if jb.edges[i].checkInnerJoin(s1, s2) {
+			return true
+		}
+	}
+	return false
+}
+
 // addJoins iterates through the edges of the join graph and checks whether any
 // joins can be constructed between the memo groups for the two given sets of
 // base relations without creating an invalid plan or introducing cross joins.
@@ -500,6 +724,7 @@ func (jb *JoinOrderBuilder) addJoins(s1, s2 vertexSet) {
 		// Both inputs must have plans.
 		return
 	}
+	jb.stats.JoinsConsidered++
 
 	var fds props.FuncDepSet
 	fds.AddEquivFrom(&jb.plans[s1].Relational().FuncDeps)
@@ -695,7 +920,8 @@ func (jb *JoinOrderBuilder) addJoin(
 	left := jb.plans[s1]
 	right := jb.plans[s2]
 	union := s1.union(s2)
-	if !joinIsRedundant {
+	if !joinIsRedundant && jb.allowedByHint(left, right) {
+		jb.stats.JoinsAdded++
 		if jb.plans[union] != nil {
 			jb.addToGroup(op, left, right, joinFilters, selectFilters, jb.plans[union])
 		} else {
@@ -703,15 +929,21 @@ func (jb *JoinOrderBuilder) addJoin(
 		}
 	}
 
-	if commute(op) {
+	if commute(op) && jb.allowedByHint(right, left) {
 		// Also add the commuted version of the join to the memo. Note that if the
 		// join is redundant (a join between base relation sets s1 and s2 existed in
 		// the matched join tree) then jb.plans[union] will already have the
 		// original join group.
+		jb.stats.JoinsAdded++
 		if jb.plans[union] == nil {
-			panic(errors.AssertionFailedf("expected existing join plan"))
+			if joinIsRedundant {
+				panic(errors.AssertionFailedf("expected existing join plan"))
+			}
+			// The join order hint only allows the commuted version of the join.
+			jb.plans[union] = jb.memoize(op, right, left, joinFilters, selectFilters)
+		} else {
+			jb.addToGroup(op, right, left, joinFilters, selectFilters, jb.plans[union])
 		}
-		jb.addToGroup(op, right, left, joinFilters, selectFilters, jb.plans[union])
 
 		if jb.onAddJoinFunc != nil {
 			// Hook for testing purposes.
@@ -720,6 +952,15 @@ func (jb *JoinOrderBuilder) addJoin(
 	}
 }
 
+// allowedByHint returns true if a join with the given inputs satisfies the
+// join order hint, or if there is no hint.
+func (jb *JoinOrderBuilder) allowedByHint(left, right memo.RelExpr) bool {
+	if jb.hint == nil {
+		return true
+	}
+	return jb.hint.allows(jb.hint.hintedRelationsOf(left), jb.hint.hintedRelationsOf(right))
+}
+
 // areFiltersRedundant returns true if the given FiltersExpr contains a single
 // equality filter that is already represented by the given FuncDepSet.
 func areFiltersRedundant(fds *props.FuncDepSet, filters memo.FiltersExpr) bool {
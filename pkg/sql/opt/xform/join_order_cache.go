@@ -0,0 +1,177 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// JoinOrderCache stores the best join order found for each join graph, keyed
+// by the structure of the graph: the tables that form its vertexes, and the
+// operators and shapes of the predicates that form its edges. Constants are
+// not part of the key, so repeated instances of a query template that differ
+// only in their constants share an entry. It is safe for concurrent use, so a
+// single cache can be shared by all optimizer instances. See
+// SetJoinOrderCache.
+//
+// The cache holds orders for at most MaxEntries join graphs; once it is full,
+// orders for new graphs are dropped.
+type JoinOrderCache struct {
+	// MaxEntries is the maximum number of join graphs for which an order is
+	// held. If it is zero, defaultMaxJoinOrderEntries is used.
+	MaxEntries int
+
+	mu struct {
+		syncutil.Mutex
+		orders map[string][]vertexIndex
+	}
+}
+
+// defaultMaxJoinOrderEntries is the default value of
+// JoinOrderCache.MaxEntries.
+const defaultMaxJoinOrderEntries = 1000
+
+// Len returns the number of join graphs for which an order is cached.
+func (c *JoinOrderCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mu.orders)
+}
+
+// lookup returns the order cached for the join graph with the given key, or
+// nil if there is none.
+func (c *JoinOrderCache) lookup(key string) []vertexIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.orders[key]
+}
+
+// store caches the given left-deep order for the join graph with the given
+// key, replacing any order that was cached previously.
+func (c *JoinOrderCache) store(key string, order []vertexIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.orders == nil {
+		c.mu.orders = make(map[string][]vertexIndex)
+	}
+	if _, ok := c.mu.orders[key]; !ok {
+		maxEntries := c.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = defaultMaxJoinOrderEntries
+		}
+		if len(c.mu.orders) >= maxEntries {
+			return
+		}
+	}
+	c.mu.orders[key] = append([]vertexIndex(nil), order...)
+}
+
+// SetJoinOrderCache causes the join orders found by the randomized join order
+// search to be stored in the given cache, and the order cached for a join
+// graph to be added to the memo before any other ordering of the graph is
+// enumerated. The cached order is also the starting point of the randomized
+// search, so that repeated optimizations of a query template with more joins
+// than the reorder_joins_limit session setting converge quickly on a good
+// order. SetJoinOrderCache must be called before Optimize.
+func (o *Optimizer) SetJoinOrderCache(cache *JoinOrderCache) {
+	o.joinOrderCache = cache
+}
+
+// joinGraphKey returns the key of the join graph in a JoinOrderCache. Vertexes
+// are described by the shapes of their expressions and the tables that they
+// scan, and edges by their operators, the vertexes that they reference and the
+// shapes of their filters. Vertex indexes depend only on the structure of the
+// join tree, so an order for a graph with the same key can be reused as-is.
+func (jb *JoinOrderBuilder) joinGraphKey() string {
+	var buf strings.Builder
+	for i := range jb.vertexes {
+		buf.WriteString("v:")
+		jb.writeShape(&buf, jb.vertexes[i])
+		buf.WriteByte(';')
+	}
+	for i := range jb.edges {
+		e := &jb.edges[i]
+		fmt.Fprintf(&buf, "e:%s %d %d:", e.op.joinType, e.ses, e.tes)
+		for j := range e.filters {
+			jb.writeShape(&buf, e.filters[j].Condition)
+			buf.WriteByte(',')
+		}
+		buf.WriteByte(';')
+	}
+	return buf.String()
+}
+
+// writeShape writes the shape of the given expression to buf. Scans are
+// described by the stable ID of their table, and variables by the vertexes
+// that produce them. Other expressions are described by their operator and the
+// shapes of their children, so that constants do not contribute to the shape.
+func (jb *JoinOrderBuilder) writeShape(buf *strings.Builder, e opt.Expr) {
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		fmt.Fprintf(buf, "scan(%d)", jb.f.Metadata().Table(t.Table).ID())
+		return
+
+	case *memo.VariableExpr:
+		fmt.Fprintf(buf, "var(%d)", jb.getRelations(opt.MakeColSet(t.Col)))
+		return
+	}
+	buf.WriteString(e.Op().String())
+	if n := e.ChildCount(); n > 0 {
+		buf.WriteByte('(')
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			jb.writeShape(buf, e.Child(i))
+		}
+		buf.WriteByte(')')
+	}
+}
+
+// cachedOrder returns the order cached for the join graph, or nil if there is
+// no cache or no order is cached. An order that does not contain every vertex
+// of the graph exactly once is ignored.
+func (jb *JoinOrderBuilder) cachedOrder() []vertexIndex {
+	if jb.cache == nil {
+		return nil
+	}
+	order := jb.cache.lookup(jb.cacheKey)
+	if len(order) != len(jb.vertexes) {
+		return nil
+	}
+	var seen vertexSet
+	for _, v := range order {
+		if int(v) >= len(jb.vertexes) || seen.intersects(vertexSet(0).add(v)) {
+			return nil
+		}
+		seen = seen.add(v)
+	}
+	return order
+}
+
+// addLeftDeepOrder adds the joins for the given left-deep order to the memo,
+// stopping at the first join that is not valid.
+func (jb *JoinOrderBuilder) addLeftDeepOrder(order []vertexIndex) {
+	joined := vertexSet(0).add(order[0])
+	for _, v := range order[1:] {
+		next := joined.add(v)
+		jb.addJoins(joined, vertexSet(0).add(v))
+		if jb.plans[next] == nil {
+			return
+		}
+		joined = next
+	}
+}
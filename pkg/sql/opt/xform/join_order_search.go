@@ -0,0 +1,291 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+const (
+	// joinSearchSeed seeds the random number generator used by the randomized
+	// join order search, so that the same query always gets the same plan
+	// unless the search runs out of time.
+	joinSearchSeed = 1
+
+	// joinSearchMaxIterations bounds the number of join orders that the
+	// randomized search considers, regardless of its time budget.
+	joinSearchMaxIterations = 20000
+
+	// joinSearchResults is the number of join orders found by the randomized
+	// search that are added to the memo.
+	joinSearchResults = 3
+
+	// joinSearchUnknownSelectivity is the selectivity used for a pair of base
+	// relations whose join could not be estimated.
+	joinSearchUnknownSelectivity = 1.0 / 3.0
+)
+
+// joinSearch implements a randomized search for good left-deep join orders,
+// which is used instead of DPSube when a join tree has too many joins to
+// enumerate every ordering (see the reorder_joins_limit session setting). The
+// search uses simulated annealing: starting with a greedy ordering, it
+// repeatedly swaps two relations in the order, and keeps the new order if it
+// is cheaper, or with a probability that decreases over time if it is more
+// expensive. The cheapest few orders that are found are added to the memo,
+// where they are costed by the optimizer alongside the original join tree.
+//
+// The cost of an order is the sum of the estimated row counts of its
+// intermediate joins. Row counts are estimated from the row count of each base
+// relation and the selectivity of the join between each pair of base
+// relations, which is derived from the memo group for that pair. This is much
+// cheaper than adding every intermediate join to the memo.
+type joinSearch struct {
+	jb  *JoinOrderBuilder
+	rng *rand.Rand
+
+	// rows is the estimated row count of each base relation.
+	rows []float64
+
+	// selectivity is the selectivity of the join between each pair of base
+	// relations, indexed by vertex. It is 1 if the pair is not connected by an
+	// edge.
+	selectivity [][]float64
+
+	// best contains the cheapest valid orders found so far, in increasing order
+	// of cost.
+	best []joinSearchOrder
+}
+
+// joinSearchOrder is a left-deep join order, along with its cost. The first
+// relation in the order is the leftmost base relation.
+type joinSearchOrder struct {
+	order []vertexIndex
+	cost  float64
+}
+
+// randomizedSearch searches for good join orders for the join graph for up to
+// the given amount of time, and adds the best orders that it finds to the
+// memo.
+func (jb *JoinOrderBuilder) randomizedSearch(budget time.Duration) {
+	s := joinSearch{jb: jb, rng: rand.New(rand.NewSource(joinSearchSeed))}
+	s.init()
+
+	// Start with the order found by a previous search of a graph with the same
+	// structure if it is cheaper than the greedy order, so that the search
+	// converges quickly when the same query template is optimized repeatedly.
+	current := s.greedyOrder()
+	currentCost := s.cost(current)
+	s.record(current, currentCost)
+	if cached := s.jb.cachedOrder(); cached != nil {
+		if cachedCost := s.cost(cached); cachedCost < currentCost {
+			current, currentCost = append([]vertexIndex(nil), cached...), cachedCost
+			s.record(current, currentCost)
+		}
+	}
+
+	n := len(current)
+	deadline := timeutil.Now().Add(budget)
+	temperature := 1.0
+	next := make([]vertexIndex, n)
+	for i := 0; i < joinSearchMaxIterations && n > 2; i++ {
+		if i%64 == 0 && timeutil.Now().After(deadline) {
+			break
+		}
+
+		// Swap two relations to get a neighboring order.
+		copy(next, current)
+		a, b := s.rng.Intn(n), s.rng.Intn(n)
+		next[a], next[b] = next[b], next[a]
+		nextCost := s.cost(next)
+		if !math.IsInf(nextCost, 1) {
+			s.record(next, nextCost)
+		}
+
+		// Always move to a cheaper order, and move to a more expensive order with
+		// a probability that decreases with the relative increase in cost and as
+		// the search cools down. Costs are compared in log space, since they can
+		// differ by many orders of magnitude.
+		accept := nextCost < currentCost
+		if !accept && !math.IsInf(nextCost, 1) && !math.IsInf(currentCost, 1) {
+			delta := math.Log(nextCost) - math.Log(currentCost)
+			accept = s.rng.Float64() < math.Exp(-delta/temperature)
+		}
+		if accept {
+			current, next = next, current
+			currentCost = nextCost
+		}
+		if i%n == n-1 {
+			temperature *= 0.95
+		}
+	}
+
+	for i := range s.best {
+		s.jb.addLeftDeepOrder(s.best[i].order)
+	}
+	if s.jb.cache != nil && len(s.best) > 0 {
+		s.jb.cache.store(s.jb.cacheKey, s.best[0].order)
+	}
+}
+
+// init estimates the row counts of the base relations, and the selectivity of
+// the join between each pair of base relations that are connected by an edge.
+// The joins between connected pairs are added to the memo in the process.
+func (s *joinSearch) init() {
+	n := len(s.jb.vertexes)
+	s.rows = make([]float64, n)
+	for i := range s.rows {
+		s.rows[i] = math.Max(rowCount(s.jb.vertexes[i]), 1)
+	}
+	s.selectivity = make([][]float64, n)
+	for i := range s.selectivity {
+		s.selectivity[i] = make([]float64, n)
+		for j := range s.selectivity[i] {
+			s.selectivity[i][j] = 1
+		}
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			s1, s2 := vertexSet(0).add(vertexIndex(i)), vertexSet(0).add(vertexIndex(j))
+			if !s.jb.canJoin(s1, s2) {
+				continue
+			}
+			sel := joinSearchUnknownSelectivity
+			s.jb.addJoins(s1, s2)
+			if plan := s.jb.plans[s1.union(s2)]; plan != nil {
+				sel = math.Min(math.Max(rowCount(plan), 1)/(s.rows[i]*s.rows[j]), 1)
+			}
+			s.selectivity[i][j], s.selectivity[j][i] = sel, sel
+		}
+	}
+}
+
+// greedyOrder returns an order that starts with the base relation with the
+// fewest rows, and then repeatedly adds the relation that can be joined with
+// the fewest resulting rows. If the order gets stuck because no remaining
+// relation can be joined, the remaining relations are appended in their
+// original order, and the order is invalid.
+func (s *joinSearch) greedyOrder() []vertexIndex {
+	n := len(s.jb.vertexes)
+	order := make([]vertexIndex, 0, n)
+	var joined vertexSet
+	first := 0
+	for i := range s.rows {
+		if s.rows[i] < s.rows[first] {
+			first = i
+		}
+	}
+	order = append(order, vertexIndex(first))
+	joined = joined.add(vertexIndex(first))
+	rows := s.rows[first]
+
+	for len(order) < n {
+		best, bestRows := -1, math.Inf(1)
+		for i := 0; i < n; i++ {
+			v := vertexIndex(i)
+			if joined.intersects(vertexSet(0).add(v)) || !s.jb.canJoin(joined, vertexSet(0).add(v)) {
+				continue
+			}
+			if r := s.joinRows(joined, rows, v); r < bestRows {
+				best, bestRows = i, r
+			}
+		}
+		if best == -1 {
+			break
+		}
+		order = append(order, vertexIndex(best))
+		joined = joined.add(vertexIndex(best))
+		rows = bestRows
+	}
+	for i := 0; i < n; i++ {
+		if !joined.intersects(vertexSet(0).add(vertexIndex(i))) {
+			order = append(order, vertexIndex(i))
+		}
+	}
+	return order
+}
+
+// joinRows estimates the number of rows returned by joining the given base
+// relation to the given set of base relations, which returns the given number
+// of rows.
+func (s *joinSearch) joinRows(joined vertexSet, rows float64, v vertexIndex) float64 {
+	rows *= s.rows[v]
+	for i, ok := joined.next(0); ok; i, ok = joined.next(i + 1) {
+		rows *= s.selectivity[i][v]
+	}
+	return math.Max(rows, 1)
+}
+
+// cost returns the sum of the estimated row counts of the intermediate joins
+// of the given order, or +Inf if the order is not valid.
+func (s *joinSearch) cost(order []vertexIndex) float64 {
+	joined := vertexSet(0).add(order[0])
+	rows := s.rows[order[0]]
+	var cost float64
+	for _, v := range order[1:] {
+		if !s.jb.canJoin(joined, vertexSet(0).add(v)) {
+			return math.Inf(1)
+		}
+		rows = s.joinRows(joined, rows, v)
+		cost += rows
+		joined = joined.add(v)
+	}
+	return cost
+}
+
+// record adds the given order to the best orders if it is one of the cheapest
+// found so far. Orders that only differ in the order of their first two
+// relations are considered to be the same, since the memo contains both
+// orderings of every join.
+func (s *joinSearch) record(order []vertexIndex, cost float64) {
+	if math.IsInf(cost, 1) {
+		return
+	}
+	if len(s.best) == joinSearchResults && cost >= s.best[len(s.best)-1].cost {
+		return
+	}
+	for i := range s.best {
+		if sameJoinOrder(s.best[i].order, order) {
+			return
+		}
+	}
+	o := joinSearchOrder{order: append([]vertexIndex(nil), order...), cost: cost}
+	i := len(s.best)
+	for i > 0 && s.best[i-1].cost > cost {
+		i--
+	}
+	s.best = append(s.best, joinSearchOrder{})
+	copy(s.best[i+1:], s.best[i:])
+	s.best[i] = o
+	if len(s.best) > joinSearchResults {
+		s.best = s.best[:joinSearchResults]
+	}
+}
+
+// sameJoinOrder returns true if the given orders are the same, ignoring the
+// order of their first two relations.
+func sameJoinOrder(a, b []vertexIndex) bool {
+	if len(a) != len(b) || len(a) < 2 {
+		return false
+	}
+	if !(a[0] == b[0] && a[1] == b[1]) && !(a[0] == b[1] && a[1] == b[0]) {
+		return false
+	}
+	for i := 2; i < len(a); i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// JoinReorderStats describes the join search space that was explored by the
+// JoinOrderBuilder, summed over all of the join trees that it reordered since
+// the optimizer was initialized. It can be used to tell whether a join tree
+// was fully reordered: if a join tree has more joins than the
+// reorder_joins_limit session setting, the joins beyond the limit are treated
+// as base relations, and are not reordered with the rest of the tree.
+type JoinReorderStats struct {
+	// Reorders is the number of join trees that were reordered.
+	Reorders int
+
+	// Joins is the number of joins in the reordered join trees that could have
+	// been reordered, ignoring the limit. Joins with hints are not counted.
+	Joins int
+
+	// ReorderedJoins is the number of joins that were added to the join graph.
+	// It is less than Joins if the reorder limit was reached.
+	ReorderedJoins int
+
+	// Edges is the number of edges in the join graphs, including the edges that
+	// were added to ensure the transitive closure of equalities.
+	Edges int
+
+	// JoinsConsidered is the number of pairs of sets of base relations that
+	// were considered as the inputs of a join.
+	JoinsConsidered int
+
+	// JoinsAdded is the number of joins that were added to the memo, including
+	// their commuted versions.
+	JoinsAdded int
+
+	// CachedOrders is the number of join trees for which an order stored in
+	// the JoinOrderCache was added to the memo.
+	CachedOrders int
+
+	// ReorderLimitReached is true if any join tree had more joins than the
+	// reorder limit, so that it was not fully reordered.
+	ReorderLimitReached bool
+}
+
+// String returns a one-line summary of the stats, which is shown in the output
+// of EXPLAIN.
+func (s JoinReorderStats) String() string {
+	var buf strings.Builder
+	if s.ReorderLimitReached {
+		buf.WriteString("reorder limit reached; ")
+	}
+	fmt.Fprintf(&buf, "%d of %d joins reordered, %d edges, %d joins considered, %d added to memo",
+		s.ReorderedJoins, s.Joins, s.Edges, s.JoinsConsidered, s.JoinsAdded)
+	return buf.String()
+}
+
+// Stats returns the stats describing the join trees that were reordered since
+// the optimizer was initialized. Unlike the join graph, the stats are not reset
+// by Init.
+func (jb *JoinOrderBuilder) Stats() JoinReorderStats {
+	return jb.stats
+}
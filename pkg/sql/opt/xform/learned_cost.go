@@ -0,0 +1,213 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/errors"
+)
+
+// CostFeature identifies a single feature in a CostFeatures vector. The values
+// of the constants are part of the feature vector format, so new features must
+// only ever be added at the end, before NumCostFeatures.
+type CostFeature int
+
+const (
+	// FeatureOp is the numeric value of the candidate's operator. Operator
+	// values are stable within a given release, but may change across releases.
+	FeatureOp CostFeature = iota
+
+	// FeatureRowCount is the estimated number of rows returned by the candidate.
+	FeatureRowCount
+
+	// FeatureStatsAvailable is 1 if the row count estimate is based on table
+	// statistics, and 0 otherwise.
+	FeatureStatsAvailable
+
+	// FeatureOutputCols is the number of columns returned by the candidate.
+	FeatureOutputCols
+
+	// FeatureInputCount is the number of relational inputs of the candidate.
+	FeatureInputCount
+
+	// FeatureLeftRowCount and FeatureRightRowCount are the estimated numbers of
+	// rows returned by the first and second relational inputs of the candidate,
+	// or 0 if it has fewer inputs.
+	FeatureLeftRowCount
+	FeatureRightRowCount
+
+	// FeatureFilterCount is the number of conjuncts in the filters of the
+	// candidate, such as the filters of a Select or the ON condition of a join.
+	FeatureFilterCount
+
+	// FeatureSpanCount is the number of spans in the constraint of a scan, or 0
+	// if the candidate is not a constrained scan.
+	FeatureSpanCount
+
+	// FeatureOrderingCols is the number of columns in the ordering required of
+	// the candidate.
+	FeatureOrderingCols
+
+	// FeatureLimitHint is the limit hint required of the candidate, or 0 if
+	// there is none.
+	FeatureLimitHint
+
+	// FeatureParallelism is the number of parallel streams required of the
+	// candidate, or 0 if it is not required to be parallel.
+	FeatureParallelism
+
+	// NumCostFeatures is the number of features in a CostFeatures vector.
+	NumCostFeatures
+)
+
+// CostFeatures is a numeric description of a candidate expression and the
+// physical properties required of it, which can be used as the input to a
+// learned cost model. It is indexed by CostFeature.
+type CostFeatures [NumCostFeatures]float64
+
+// ExtractCostFeatures returns the features of the given candidate expression.
+// Like the cost of the candidate, they only describe the candidate itself and
+// the logical properties of its inputs, since the best expressions in its input
+// groups are not known when it is costed.
+func ExtractCostFeatures(candidate memo.RelExpr, required *physical.Required) CostFeatures {
+	var f CostFeatures
+	rel := candidate.Relational()
+	f[FeatureOp] = float64(candidate.Op())
+	f[FeatureRowCount] = rel.Stats.RowCount
+	if rel.Stats.Available {
+		f[FeatureStatsAvailable] = 1
+	}
+	f[FeatureOutputCols] = float64(rel.OutputCols.Len())
+
+	for i, n := 0, candidate.ChildCount(); i < n; i++ {
+		switch t := candidate.Child(i).(type) {
+		case memo.RelExpr:
+			switch f[FeatureInputCount] {
+			case 0:
+				f[FeatureLeftRowCount] = t.Relational().Stats.RowCount
+			case 1:
+				f[FeatureRightRowCount] = t.Relational().Stats.RowCount
+			}
+			f[FeatureInputCount]++
+
+		case *memo.FiltersExpr:
+			f[FeatureFilterCount] += float64(len(*t))
+		}
+	}
+	switch t := candidate.(type) {
+	case *memo.ScanExpr:
+		if t.Constraint != nil {
+			f[FeatureSpanCount] = float64(t.Constraint.Spans.Count())
+		}
+
+	case *memo.LookupJoinExpr:
+		f[FeatureFilterCount] += float64(len(t.LookupExpr) + len(t.RemoteLookupExpr))
+	}
+
+	if required != nil {
+		f[FeatureOrderingCols] = float64(len(required.Ordering.Columns))
+		f[FeatureLimitHint] = required.LimitHint
+		f[FeatureParallelism] = float64(required.Parallelism)
+	}
+	return f
+}
+
+// CostModel is a learned model that predicts the cost of a candidate
+// expression from its features. See SetCostModel.
+type CostModel interface {
+	// PredictCost returns the predicted cost of the candidate described by the
+	// given features, excluding the cost of its children. analyticCost is the
+	// cost computed by the analytic coster, which the model may use as an
+	// additional feature. It returns ok=false if the model declines to predict
+	// the cost, for example because the candidate's operator was not part of
+	// its training data, in which case the analytic cost is used.
+	PredictCost(features *CostFeatures, analyticCost float64) (cost float64, ok bool)
+}
+
+// SetCostModel causes the optimizer to consult the given learned cost model
+// each time it costs a candidate expression, and to blend its prediction with
+// the cost computed by the current coster. The blended cost is:
+//
+//   (1 - weight) * analytic cost + weight * predicted cost
+//
+// The analytic cost is used unchanged if the model declines to predict, or if
+// its prediction is negative or not finite. SetCostModel must be called after
+// SetCoster, since it wraps the current coster.
+func (o *Optimizer) SetCostModel(model CostModel, weight float64) {
+	if weight < 0 || weight > 1 {
+		panic(errors.AssertionFailedf("cost model weight must be between 0 and 1: %v", weight))
+	}
+	o.ChainCoster(func(inner Coster) Coster {
+		return &learnedCoster{analytic: inner, model: model, weight: weight}
+	})
+}
+
+// learnedCoster is a Coster that blends the cost computed by an analytic
+// coster with the cost predicted by a learned CostModel.
+type learnedCoster struct {
+	analytic Coster
+	model    CostModel
+	weight   float64
+}
+
+var _ BatchCoster = &learnedCoster{}
+
+// ComputeCost is part of the Coster interface.
+func (c *learnedCoster) ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost {
+	return c.blendCost(candidate, required, c.analytic.ComputeCost(candidate, required))
+}
+
+// ComputeCosts is part of the BatchCoster interface.
+func (c *learnedCoster) ComputeCosts(
+	candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	ComputeCosts(c.analytic, candidates, required, costs)
+	for i, candidate := range candidates {
+		costs[i] = c.blendCost(candidate, required, costs[i])
+	}
+}
+
+// blendCost blends the given cost of the candidate, computed by the analytic
+// coster, with the cost predicted by the model.
+func (c *learnedCoster) blendCost(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.Cost {
+	if !cost.Less(memo.MaxCost) {
+		// Never override a cost that prevents an expression from being chosen.
+		return cost
+	}
+
+	features := ExtractCostFeatures(candidate, required)
+	predicted, ok := c.model.PredictCost(&features, float64(cost))
+	if !ok || predicted < 0 || math.IsNaN(predicted) || math.IsInf(predicted, 0) {
+		return cost
+	}
+	return memo.Cost((1-c.weight)*float64(cost) + c.weight*predicted)
+}
+
+// ComputeCostBreakdown is part of the Coster interface. The breakdown is
+// computed by the analytic coster, since the prediction is not divided between
+// resources.
+func (c *learnedCoster) ComputeCostBreakdown(
+	candidate memo.RelExpr, required *physical.Required,
+) memo.CostBreakdown {
+	return c.analytic.ComputeCostBreakdown(candidate, required)
+}
+
+// ComputeCostInterval is part of the Coster interface.
+func (c *learnedCoster) ComputeCostInterval(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.CostInterval {
+	return c.analytic.ComputeCostInterval(candidate, required, cost)
+}
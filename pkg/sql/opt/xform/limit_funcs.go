@@ -168,6 +168,15 @@ func (c *CustomFuncs) ScanIsInverted(sp *memo.ScanPrivate) bool {
 	return idx.IsInverted()
 }
 
+// LookupJoinPreservesInputRows returns true if the lookup join with the given
+// private is guaranteed to output every input row at least once. This is the
+// case for left lookup joins that are not part of a paired joiner. The joins of
+// a pair are excluded since only the pair as a whole has left join semantics.
+func (c *CustomFuncs) LookupJoinPreservesInputRows(private *memo.LookupJoinPrivate) bool {
+	return private.JoinType == opt.LeftJoinOp &&
+		!private.IsFirstJoinInPairedJoiner && !private.IsSecondJoinInPairedJoiner
+}
+
 // SplitLimitedScanIntoUnionScans returns a UnionAll tree of Scan operators with
 // hard limits that each scan over a single key from the original Scan's
 // constraints. If no such UnionAll of Scans can be found, ok=false is returned.
@@ -371,3 +380,117 @@ func (c *CustomFuncs) GeneratePartialOrderTopK(
 		grp.Memo().AddTopKToGroup(&memo.TopKExpr{Input: input, TopKPrivate: newPrivate}, grp)
 	}
 }
+
+// randomSampleCols returns the set of columns synthesized by the given
+// projections, if every projection is a call to random(). Otherwise, it
+// returns ok=false.
+func randomSampleCols(projections memo.ProjectionsExpr) (randomCols opt.ColSet, ok bool) {
+	if len(projections) == 0 {
+		return opt.ColSet{}, false
+	}
+	for i := range projections {
+		fn, ok := projections[i].Element.(*memo.FunctionExpr)
+		if !ok || fn.Name != "random" || len(fn.Args) != 0 {
+			return opt.ColSet{}, false
+		}
+		randomCols.Add(projections[i].Col)
+	}
+	return randomCols, true
+}
+
+// CanGenerateRandomSampleScans returns true if the given Limit ordering sorts
+// only on columns produced by calls to random() in innerProjections, and if
+// none of those columns are referenced by the outer projections or
+// passthrough columns. See the GenerateRandomSampleScans rule for details.
+func (c *CustomFuncs) CanGenerateRandomSampleScans(
+	scanPrivate *memo.ScanPrivate,
+	innerProjections memo.ProjectionsExpr,
+	ordering props.OrderingChoice,
+	projections memo.ProjectionsExpr,
+	passthrough opt.ColSet,
+) bool {
+	if scanPrivate.Flags.NoIndexJoin || ordering.Any() {
+		return false
+	}
+	randomCols, ok := randomSampleCols(innerProjections)
+	if !ok || !ordering.ColSet().SubsetOf(randomCols) {
+		return false
+	}
+	if passthrough.Intersects(randomCols) {
+		return false
+	}
+	for i := range projections {
+		if projections[i].ScalarProps().OuterCols.Intersects(randomCols) {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateRandomSampleScans generates alternatives to a Limit over a full
+// table scan that is ordered by random(), in which the random sample of
+// primary keys is taken from a narrow secondary index, and the remaining
+// columns are fetched for only the sampled rows using an IndexJoin. See the
+// GenerateRandomSampleScans rule for details.
+func (c *CustomFuncs) GenerateRandomSampleScans(
+	grp memo.RelExpr,
+	scanPrivate *memo.ScanPrivate,
+	innerProjections memo.ProjectionsExpr,
+	innerPassthrough opt.ColSet,
+	limit opt.ScalarExpr,
+	ordering props.OrderingChoice,
+	projections memo.ProjectionsExpr,
+	passthrough opt.ColSet,
+) {
+	randomCols, _ := randomSampleCols(innerProjections)
+	pkCols := c.PrimaryKeyCols(scanPrivate.Table)
+
+	// The sample only needs to include the primary key columns, which are
+	// needed by the IndexJoin, and the random columns, which are needed to order
+	// the sample.
+	sampleOrdering := ordering.Copy()
+	sampleOrdering.RestrictToCols(randomCols.Union(pkCols))
+
+	var iter scanIndexIter
+	iter.Init(c.e.evalCtx, c.e.f, c.e.mem, &c.im, scanPrivate, nil /* filters */, rejectPrimaryIndex|rejectInvertedIndexes|rejectPartialIndexes)
+	iter.ForEach(func(index cat.Index, filters memo.FiltersExpr, indexCols opt.ColSet, isCovering bool, constProj memo.ProjectionsExpr) {
+		// Covering indexes are already considered by GenerateIndexScans, since
+		// they don't require an IndexJoin.
+		if isCovering {
+			return
+		}
+
+		// The iterator rejects partial indexes, so constProj should always be
+		// empty. If it is not, we panic to avoid performing a logically incorrect
+		// transformation.
+		if len(constProj) != 0 {
+			panic(errors.AssertionFailedf("expected constProj to be empty"))
+		}
+
+		newScanPrivate := *scanPrivate
+		newScanPrivate.Index = index.Ordinal()
+		newScanPrivate.Cols = pkCols
+
+		sample := c.e.f.ConstructLimit(
+			c.e.f.ConstructProject(
+				c.e.f.ConstructScan(&newScanPrivate),
+				innerProjections,
+				pkCols,
+			),
+			limit,
+			sampleOrdering,
+		)
+		indexJoin := c.e.f.ConstructIndexJoin(
+			sample,
+			&memo.IndexJoinPrivate{Table: scanPrivate.Table, Cols: innerPassthrough},
+		)
+
+		// Add the outer Project to the same group as the original Project.
+		project := memo.ProjectExpr{
+			Input:       indexJoin,
+			Projections: projections,
+			Passthrough: passthrough,
+		}
+		c.e.mem.AddProjectToGroup(&project, grp)
+	})
+}
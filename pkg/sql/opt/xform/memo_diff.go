@@ -0,0 +1,418 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
+)
+
+// MemoDiff is a structured diff between two memos, produced by DiffMemos.
+type MemoDiff struct {
+	// Groups contains an entry for each relational group that differs between
+	// the two memos, ordered by group number.
+	Groups []GroupDiff
+}
+
+// GroupDiff describes the differences in a single relational group between
+// two memos.
+//
+// Groups are numbered in the order in which they are found by a breadth-first
+// search of the first memo, followed by the groups that only exist in the
+// second memo. This matches the numbering of Optimizer.FormatMemo for the first
+// memo. A group exists in both memos if its normalized expression has
+// the same operator and private, and its children are the same groups.
+type GroupDiff struct {
+	// Group is the number of the group, as it appears in the member
+	// expressions of the diff.
+	Group int
+
+	// Expr is the normalized expression of the group, which is its first
+	// member.
+	Expr string
+
+	// InA and InB are true if the group exists in the first and second memo,
+	// respectively.
+	InA, InB bool
+
+	// Removed contains the members that are only in the first memo, and Added
+	// contains the members that are only in the second memo.
+	Removed, Added []string
+
+	// Best contains an entry for each set of required properties for which the
+	// lowest cost expression of the group, or its cost, differs.
+	Best []BestDiff
+}
+
+// BestDiff describes a difference in the lowest cost expression for a group
+// and set of required properties.
+type BestDiff struct {
+	// Required is the set of required properties.
+	Required string
+
+	// BestA and BestB are the lowest cost expressions in the first and second
+	// memo, respectively. They are empty if the group is not part of the lowest
+	// cost tree of the memo with the required properties.
+	BestA, BestB string
+
+	// CostA and CostB are the costs of BestA and BestB.
+	CostA, CostB memo.Cost
+}
+
+// Empty returns true if there are no differences between the memos.
+func (d *MemoDiff) Empty() bool {
+	return len(d.Groups) == 0
+}
+
+// String formats the diff as a tree, with lines prefixed by "-" for the first
+// memo and "+" for the second memo, e.g.:
+//
+//   memo diff
+//    └── G2: (select G3 G4)
+//         ├── + (index-join G5 t,cols=(1-3))
+//         └── best ()
+//              ├── - (select G3 G4) cost=1074.54
+//              └── + (index-join G5 t,cols=(1-3)) cost=24.83
+//
+func (d *MemoDiff) String() string {
+	tp := treeprinter.New()
+	root := tp.Child("memo diff")
+	if d.Empty() {
+		root.Child("no differences")
+	}
+	for i := range d.Groups {
+		g := &d.Groups[i]
+		var c treeprinter.Node
+		switch {
+		case !g.InB:
+			c = root.Childf("- G%d: %s", g.Group, g.Expr)
+		case !g.InA:
+			c = root.Childf("+ G%d: %s", g.Group, g.Expr)
+		default:
+			c = root.Childf("G%d: %s", g.Group, g.Expr)
+		}
+		// Only list the members of groups that exist in both memos.
+		if g.InA && g.InB {
+			for _, e := range g.Removed {
+				c.Childf("- %s", e)
+			}
+			for _, e := range g.Added {
+				c.Childf("+ %s", e)
+			}
+		}
+		for _, b := range g.Best {
+			bc := c.Childf("best %s", b.Required)
+			if b.BestA != "" {
+				bc.Childf("- %s cost=%.2f", b.BestA, b.CostA)
+			}
+			if b.BestB != "" {
+				bc.Childf("+ %s cost=%.2f", b.BestB, b.CostB)
+			}
+		}
+	}
+	return tp.String()
+}
+
+// DiffMemos compares the groups, member expressions, lowest cost expressions
+// and costs of two memos, such as the memos for the same query before and
+// after a statistics change. The memos do not need to be optimized; if one is
+// not, its lowest cost expressions are not compared.
+//
+// Groups are matched by structure rather than by identity, so the memos can
+// come from different optimizer instances. Expressions that reference columns
+// are only matched if both memos assigned the same column IDs, which is the
+// case when the same query is built against the same catalog.
+func DiffMemos(a, b *memo.Memo) *MemoDiff {
+	d := memoDiffer{
+		sigIDs:  make(map[string]int),
+		numbers: make(map[int]int),
+	}
+	d.a = d.summarize(a)
+	d.b = d.summarize(b)
+
+	// Number the groups in the order they are found in the first memo, then
+	// the second memo.
+	var sigs []int
+	for _, m := range []*memoSummary{d.a, d.b} {
+		for _, sig := range m.order {
+			if _, ok := d.numbers[sig]; !ok {
+				d.numbers[sig] = len(d.numbers) + 1
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+
+	res := &MemoDiff{}
+	for _, sig := range sigs {
+		// Scalar groups have a single member, so any difference in them results
+		// in different relational groups.
+		if !d.isRelational(sig) {
+			continue
+		}
+		if g, ok := d.diffGroup(sig); ok {
+			res.Groups = append(res.Groups, g)
+		}
+	}
+	return res
+}
+
+// memoSummary contains the information about a memo that is compared by
+// DiffMemos. Groups are identified by their signature ID, which is the same
+// for equivalent groups in both memos.
+type memoSummary struct {
+	mf memoFormatter
+
+	// sigs is the signature ID of each group, indexed by memoFormatter group
+	// index.
+	sigs []int
+
+	// order contains the signature IDs of the groups, in breadth-first order.
+	order []int
+
+	// groups maps from signature ID to memoFormatter group index.
+	groups map[int]int
+
+	// best maps from signature ID to the lowest cost expression chosen for each
+	// set of required properties.
+	best map[int]map[string]memoBest
+}
+
+// memoBest is an expression in the lowest cost tree of a memo, along with its
+// required properties.
+type memoBest struct {
+	expr     memo.RelExpr
+	required *physical.Required
+}
+
+// memoDiffer computes a MemoDiff.
+type memoDiffer struct {
+	a, b *memoSummary
+
+	// sigIDs interns group signatures. A signature is the normalized
+	// expression of a group, formatted with the signature IDs of its children,
+	// so two groups have the same signature ID if they have the same structure.
+	sigIDs map[string]int
+
+	// numbers maps from signature ID to the group number shown in the diff.
+	numbers map[int]int
+}
+
+// summarize numbers the groups in the given memo, computes their signatures,
+// and collects the expressions in its lowest cost tree.
+func (d *memoDiffer) summarize(m *memo.Memo) *memoSummary {
+	s := &memoSummary{
+		mf:     makeMemoFormatter(&Optimizer{mem: m}, FmtPretty),
+		groups: make(map[int]int),
+		best:   make(map[int]map[string]memoBest),
+	}
+	s.mf.groupIdx = make(map[opt.Expr]int)
+	s.mf.numberMemo(m.RootExpr())
+
+	s.sigs = make([]int, len(s.mf.groups))
+	for i := range s.sigs {
+		s.sigs[i] = -1
+	}
+	for i := range s.mf.groups {
+		sig := d.signature(s, i)
+		if _, ok := s.groups[sig]; !ok {
+			s.groups[sig] = i
+			s.order = append(s.order, sig)
+		}
+	}
+
+	if m.IsOptimized() {
+		d.collectBest(s, m.RootExpr())
+	}
+	return s
+}
+
+// signature returns the signature ID of the group with the given index.
+func (d *memoDiffer) signature(s *memoSummary, groupIdx int) int {
+	if s.sigs[groupIdx] != -1 {
+		return s.sigs[groupIdx]
+	}
+	e := s.mf.groups[groupIdx].first
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "(%s", e.Op())
+	for i := 0; i < e.ChildCount(); i++ {
+		fmt.Fprintf(&buf, " %d", d.signature(s, s.mf.group(skipListItem(e.Child(i)))))
+	}
+	s.mf.buf.Reset()
+	s.mf.formatPrivate(e, &physical.Required{})
+	buf.Write(s.mf.buf.Bytes())
+	buf.WriteByte(')')
+
+	id, ok := d.sigIDs[buf.String()]
+	if !ok {
+		id = len(d.sigIDs)
+		d.sigIDs[buf.String()] = id
+	}
+	s.sigs[groupIdx] = id
+	return id
+}
+
+// collectBest records the expressions in the lowest cost tree rooted at the
+// given expression.
+func (d *memoDiffer) collectBest(s *memoSummary, e opt.Expr) {
+	if rel, ok := e.(memo.RelExpr); ok {
+		sig := s.sigs[d.groupOf(s, rel)]
+		required := rel.RequiredPhysical()
+		if required == nil {
+			return
+		}
+		if s.best[sig] == nil {
+			s.best[sig] = make(map[string]memoBest)
+		}
+		if _, ok := s.best[sig][required.String()]; ok {
+			// This subtree has already been collected.
+			return
+		}
+		s.best[sig][required.String()] = memoBest{expr: rel, required: required}
+	}
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		d.collectBest(s, skipListItem(e.Child(i)))
+	}
+}
+
+// groupOf returns the memoFormatter group index of the given expression in the
+// lowest cost tree. Enforcers are not members of the memo, so they belong to
+// the group of their input.
+func (d *memoDiffer) groupOf(s *memoSummary, e memo.RelExpr) int {
+	for {
+		if idx, ok := s.mf.groupIdx[e.FirstExpr()]; ok {
+			return idx
+		}
+		e = e.Child(0).(memo.RelExpr)
+	}
+}
+
+// isRelational returns true if the group with the given signature ID is a
+// relational group.
+func (d *memoDiffer) isRelational(sig int) bool {
+	s := d.a
+	idx, ok := s.groups[sig]
+	if !ok {
+		s = d.b
+		idx = s.groups[sig]
+	}
+	_, ok = s.mf.groups[idx].first.(memo.RelExpr)
+	return ok
+}
+
+// diffGroup returns the differences in the group with the given signature ID,
+// and false if there are none.
+func (d *memoDiffer) diffGroup(sig int) (GroupDiff, bool) {
+	res := GroupDiff{Group: d.numbers[sig]}
+	idxA, inA := d.a.groups[sig]
+	idxB, inB := d.b.groups[sig]
+	res.InA, res.InB = inA, inB
+	if inA {
+		res.Expr = d.formatExpr(d.a, d.a.mf.groups[idxA].first, &physical.Required{})
+	} else {
+		res.Expr = d.formatExpr(d.b, d.b.mf.groups[idxB].first, &physical.Required{})
+	}
+
+	if inA && inB {
+		membersA := d.members(d.a, idxA)
+		membersB := d.members(d.b, idxB)
+		res.Removed = diffStrings(membersA, membersB)
+		res.Added = diffStrings(membersB, membersA)
+	}
+
+	var required []string
+	for r := range d.a.best[sig] {
+		required = append(required, r)
+	}
+	for r := range d.b.best[sig] {
+		if _, ok := d.a.best[sig][r]; !ok {
+			required = append(required, r)
+		}
+	}
+	sort.Strings(required)
+	for _, r := range required {
+		bd := BestDiff{Required: r}
+		if best, ok := d.a.best[sig][r]; ok {
+			bd.BestA = d.formatExpr(d.a, best.expr, best.required)
+			bd.CostA = best.expr.Cost()
+		}
+		if best, ok := d.b.best[sig][r]; ok {
+			bd.BestB = d.formatExpr(d.b, best.expr, best.required)
+			bd.CostB = best.expr.Cost()
+		}
+		if bd.BestA != bd.BestB || bd.CostA.Less(bd.CostB) || bd.CostB.Less(bd.CostA) {
+			res.Best = append(res.Best, bd)
+		}
+	}
+
+	differs := !inA || !inB || len(res.Removed) > 0 || len(res.Added) > 0 || len(res.Best) > 0
+	return res, differs
+}
+
+// members returns the formatted members of the group with the given index.
+func (d *memoDiffer) members(s *memoSummary, groupIdx int) []string {
+	var res []string
+	for e := s.mf.groups[groupIdx].first; e != nil; e = nextExpr(e) {
+		res = append(res, d.formatExpr(s, e, &physical.Required{}))
+	}
+	return res
+}
+
+// formatExpr formats the given expression, referring to its children by their
+// group number in the diff; e.g.:
+//    (inner-join G2 G3 G4)
+func (d *memoDiffer) formatExpr(s *memoSummary, e opt.Expr, required *physical.Required) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "(%s", e.Op())
+	for i := 0; i < e.ChildCount(); i++ {
+		var idx int
+		if rel, ok := e.Child(i).(memo.RelExpr); ok {
+			idx = d.groupOf(s, rel)
+		} else {
+			idx = s.mf.group(skipListItem(e.Child(i)))
+		}
+		fmt.Fprintf(&buf, " G%d", d.numbers[s.sigs[idx]])
+	}
+	s.mf.buf.Reset()
+	s.mf.formatPrivate(e, required)
+	buf.Write(s.mf.buf.Bytes())
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// skipListItem returns the input of the given expression if it is a list item,
+// and the expression itself otherwise.
+func skipListItem(e opt.Expr) opt.Expr {
+	if opt.IsListItemOp(e) {
+		return e.Child(0)
+	}
+	return e
+}
+
+// diffStrings returns the strings in a that are not in b.
+func diffStrings(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+	}
+	var res []string
+	for _, s := range a {
+		if !inB[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -13,7 +13,9 @@ package xform
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"sort"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
@@ -29,6 +31,12 @@ const (
 	// FmtPretty performs a breadth-first topological sort on the memo groups,
 	// and shows the root group at the top of the memo.
 	FmtPretty FmtFlags = iota
+
+	// FmtHTML renders the memo as a self-contained HTML page for debugging
+	// large memos in a browser. Groups are numbered and ordered as they are by
+	// FmtPretty, but can be collapsed, and each reference to a child group links
+	// to that group.
+	FmtHTML
 )
 
 type group struct {
@@ -97,6 +105,293 @@ func (mf *memoFormatter) format() string {
 	return tp.String()
 }
 
+// formatDOT renders the memo as a Graphviz graph. Each group is drawn as a
+// cluster containing its member expressions, and each member has an edge to
+// the cluster of each of its child groups. If the memo has been optimized, the
+// lowest cost tree is highlighted, including any enforcers that it contains.
+func (mf *memoFormatter) formatDOT() string {
+	m := mf.o.mem
+
+	// Assign group numbers to every expression in the memo.
+	mf.groupIdx = make(map[opt.Expr]int)
+	mf.numberMemo(m.RootExpr())
+
+	// Determine which expressions are part of the lowest cost tree.
+	d := dotFormatter{
+		mf:        mf,
+		best:      make(map[string]bool),
+		enforcers: make(map[int][]string),
+	}
+	if m.IsOptimized() {
+		if root, ok := m.RootExpr().(memo.RelExpr); ok {
+			d.markBest(root, m.RootProps())
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph memo {\n")
+	buf.WriteString("  compound=true;\n")
+	buf.WriteString("  node [shape=box, fontname=\"Courier\"];\n")
+
+	for i, g := range mf.groups {
+		fmt.Fprintf(&buf, "  subgraph cluster_G%d {\n", i+1)
+		fmt.Fprintf(&buf, "    label=\"G%d\";\n", i+1)
+		ord := 0
+		for e := g.first; e != nil; e = nextExpr(e) {
+			name := dotNodeName(i, ord)
+			mf.buf.Reset()
+			mf.formatExpr(e)
+			fmt.Fprintf(&buf, "    %s [label=%s", name, dotQuote(mf.buf.String()))
+			if d.best[name] {
+				buf.WriteString(", color=red, penwidth=2")
+			}
+			buf.WriteString("];\n")
+			ord++
+		}
+		for _, enforcer := range d.enforcers[i] {
+			buf.WriteString(enforcer)
+		}
+		buf.WriteString("  }\n")
+	}
+
+	for i, g := range mf.groups {
+		ord := 0
+		for e := g.first; e != nil; e = nextExpr(e) {
+			for j := 0; j < e.ChildCount(); j++ {
+				child := e.Child(j)
+				if opt.IsListItemOp(child) {
+					child = child.Child(0)
+				}
+				childIdx := mf.group(child)
+				fmt.Fprintf(&buf, "  %s -> %s [lhead=cluster_G%d, color=gray];\n",
+					dotNodeName(i, ord), dotNodeName(childIdx, 0), childIdx+1)
+			}
+			ord++
+		}
+	}
+	for _, edge := range d.bestEdges {
+		buf.WriteString(edge)
+	}
+
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// dotFormatter determines which nodes and edges of the graph rendered by
+// formatDOT are part of the lowest cost tree.
+type dotFormatter struct {
+	mf *memoFormatter
+
+	// best contains the names of the member nodes in the lowest cost tree.
+	best map[string]bool
+
+	// enforcers contains the node definitions of the enforcers in the lowest
+	// cost tree, indexed by group. Enforcers are not members of the memo, so
+	// they are only drawn if they are part of the lowest cost tree.
+	enforcers map[int][]string
+
+	// bestEdges contains the definitions of the edges in the lowest cost tree.
+	bestEdges []string
+
+	numEnforcers int
+}
+
+// markBest marks the expression chosen for the given group and required
+// properties, and its descendants, as part of the lowest cost tree. It returns
+// the name of the node for the chosen expression, or the empty string if no
+// expression was chosen.
+func (d *dotFormatter) markBest(grp memo.RelExpr, required *physical.Required) string {
+	grp = grp.FirstExpr()
+	state := d.mf.o.lookupOptState(grp, required)
+	if state == nil || state.best == nil {
+		return ""
+	}
+	groupIdx := d.mf.group(grp)
+
+	// Find the ordinal of the best expression within its group. If it is not a
+	// member of the group, it is an enforcer.
+	var name string
+	ord := 0
+	for member := grp; member != nil; member = member.NextExpr() {
+		if member == state.best {
+			name = dotNodeName(groupIdx, ord)
+			break
+		}
+		ord++
+	}
+	if name == "" {
+		name = fmt.Sprintf("G%d_enforcer%d", groupIdx+1, d.numEnforcers)
+		d.numEnforcers++
+		label := fmt.Sprintf("(%s) %s", state.best.Op(), required)
+		d.enforcers[groupIdx] = append(d.enforcers[groupIdx], fmt.Sprintf(
+			"    %s [label=%s, style=dashed, color=red, penwidth=2];\n", name, dotQuote(label),
+		))
+	} else if d.best[name] {
+		return name
+	}
+	d.best[name] = true
+
+	for i, n := 0, state.best.ChildCount(); i < n; i++ {
+		childProps := BuildChildPhysicalProps(d.mf.o.mem, state.best, i, required)
+		d.markBestChild(name, state.best.Child(i), childProps)
+	}
+	return name
+}
+
+// markBestChild marks the given child of the node with the given name, and its
+// descendants, as part of the lowest cost tree.
+func (d *dotFormatter) markBestChild(parent string, child opt.Expr, required *physical.Required) {
+	if opt.IsListItemOp(child) {
+		child = child.Child(0)
+	}
+	var name string
+	if rel, ok := child.(memo.RelExpr); ok {
+		name = d.markBest(rel, required)
+	} else {
+		// Scalar groups have a single member. Subqueries nested within them can
+		// have a lowest cost tree of their own.
+		name = dotNodeName(d.mf.group(child), 0)
+		if !d.best[name] {
+			d.best[name] = true
+			for i, n := 0, child.ChildCount(); i < n; i++ {
+				childProps := BuildChildPhysicalPropsScalar(d.mf.o.mem, child, i)
+				d.markBestChild(name, child.Child(i), childProps)
+			}
+		}
+	}
+	if name != "" {
+		d.bestEdges = append(d.bestEdges, fmt.Sprintf(
+			"  %s -> %s [color=red, penwidth=2];\n", parent, name,
+		))
+	}
+}
+
+// dotNodeName returns the name of the node for the member with the given
+// ordinal in the group with the given index.
+func dotNodeName(groupIdx, ord int) string {
+	return fmt.Sprintf("G%d_%d", groupIdx+1, ord)
+}
+
+// dotQuote returns the given string as a quoted Graphviz ID.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// formatHTML renders the memo as a self-contained HTML page. Each group is a
+// collapsible section listing its members, followed by a table of the best
+// expression and cost for each set of required properties with which it was
+// optimized. References to child groups link to their sections, and the
+// expressions in the lowest cost tree show their cost when hovered over.
+func (mf *memoFormatter) formatHTML() string {
+	m := mf.o.mem
+
+	// Assign group numbers to every expression in the memo.
+	mf.groupIdx = make(map[opt.Expr]int)
+	mf.numberMemo(m.RootExpr())
+
+	// Populate the group states.
+	mf.populateStates()
+
+	// Map the members that were chosen as the best expression for some set of
+	// required properties to their lowest cost, so that it can be shown when
+	// the member is hovered over.
+	bestCost := make(map[opt.Expr]memo.Cost)
+	for _, g := range mf.groups {
+		for _, s := range g.states {
+			if s.best == nil {
+				continue
+			}
+			if c, ok := bestCost[s.best]; !ok || s.cost < c {
+				bestCost[s.best] = s.cost
+			}
+		}
+	}
+
+	desc := "not optimized"
+	if m.IsOptimized() {
+		desc = "optimized"
+	}
+	title := html.EscapeString(fmt.Sprintf(
+		"memo (%s, ~%dKB, required=%s)", desc, m.MemoryEstimate()/1024, m.RootProps(),
+	))
+
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&buf, "<title>%s</title>\n", title)
+	buf.WriteString("<style>\n")
+	buf.WriteString("body { font-family: monospace; }\n")
+	buf.WriteString("details { margin: 4px 0; padding-left: 8px; border-left: 2px solid #ccc; }\n")
+	buf.WriteString("summary { cursor: pointer; font-weight: bold; }\n")
+	buf.WriteString("ul { margin: 2px 0; }\n")
+	buf.WriteString("table { border-collapse: collapse; margin: 2px 0 2px 24px; }\n")
+	buf.WriteString("td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }\n")
+	buf.WriteString(".best { color: #c00; }\n")
+	buf.WriteString(":target > summary { background: #ffc; }\n")
+	buf.WriteString("</style>\n</head>\n<body>\n")
+	fmt.Fprintf(&buf, "<h1>%s</h1>\n", title)
+
+	for i, g := range mf.groups {
+		fmt.Fprintf(&buf, "<details id=\"G%d\" open>\n<summary>G%d</summary>\n<ul>\n", i+1, i+1)
+		for e := g.first; e != nil; e = nextExpr(e) {
+			if c, ok := bestCost[e]; ok {
+				fmt.Fprintf(&buf, "<li class=\"best\" title=\"cost: %.2f\">", c)
+			} else {
+				buf.WriteString("<li>")
+			}
+			mf.formatExprHTML(&buf, e, nil /* required */)
+			buf.WriteString("</li>\n")
+		}
+		buf.WriteString("</ul>\n")
+
+		if len(g.states) > 0 {
+			buf.WriteString("<table>\n<tr><th>required</th><th>best</th><th>cost</th></tr>\n")
+			for _, s := range g.states {
+				fmt.Fprintf(&buf, "<tr><td>%s</td><td title=\"cost: %.2f\">",
+					html.EscapeString(s.required.String()), s.cost)
+				mf.formatExprHTML(&buf, s.best, s.required)
+				fmt.Fprintf(&buf, "</td><td>%.2f</td></tr>\n", s.cost)
+			}
+			buf.WriteString("</table>\n")
+		}
+		buf.WriteString("</details>\n")
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.String()
+}
+
+// formatExprHTML writes the given expression to buf in the same form as
+// formatExpr, with each child group linked to its section of the page. If
+// required is not nil, the expression is formatted as the best expression for
+// those properties, in the same form as formatBest.
+func (mf *memoFormatter) formatExprHTML(buf *bytes.Buffer, e opt.Expr, required *physical.Required) {
+	fmt.Fprintf(buf, "(%s", html.EscapeString(e.Op().String()))
+	for i := 0; i < e.ChildCount(); i++ {
+		child := e.Child(i)
+		if opt.IsListItemOp(child) {
+			child = child.Child(0)
+		}
+		childIdx := mf.group(child) + 1
+		fmt.Fprintf(buf, " <a href=\"#G%d\">G%d</a>", childIdx, childIdx)
+		if required != nil {
+			// Print properties required of the child if they are interesting.
+			childReq := BuildChildPhysicalProps(mf.o.mem, e.(memo.RelExpr), i, required)
+			if childReq.Defined() {
+				fmt.Fprintf(buf, "=&quot;%s&quot;", html.EscapeString(childReq.String()))
+			}
+		}
+	}
+	physProps := required
+	if physProps == nil {
+		physProps = &physical.Required{}
+	}
+	mf.buf.Reset()
+	mf.formatPrivate(e, physProps)
+	buf.WriteString(html.EscapeString(mf.buf.String()))
+	buf.WriteString(")")
+}
+
 func (mf *memoFormatter) group(expr opt.Expr) int {
 	res, ok := mf.groupIdx[firstExpr(expr)]
 	if !ok {
@@ -113,16 +408,7 @@ func (mf *memoFormatter) numberMemo(root opt.Expr) {
 
 	// Do a breadth-first search (groups acts as our queue).
 	for i := 0; i < len(mf.groups); i++ {
-		// next returns the next expression in the group.
-		next := func(e opt.Expr) opt.Expr {
-			rel, ok := e.(memo.RelExpr)
-			if !ok {
-				return nil
-			}
-			return rel.NextExpr()
-		}
-
-		for e := mf.groups[i].first; e != nil; e = next(e) {
+		for e := mf.groups[i].first; e != nil; e = nextExpr(e) {
 			for i := 0; i < e.ChildCount(); i++ {
 				mf.numberExpr(e.Child(i))
 			}
@@ -173,17 +459,34 @@ func (mf *memoFormatter) numberExpr(expr opt.Expr) {
 }
 
 func (mf *memoFormatter) populateStates() {
-	for groupStateKey, groupState := range mf.o.stateMap {
-		if !groupState.fullyOptimized {
-			continue
-		}
-		groupIdx, ok := mf.groupIdx[groupStateKey.group]
+	addState := func(grp opt.Expr, groupState *groupState) {
+		groupIdx, ok := mf.groupIdx[grp]
 		if !ok {
 			// This group was not reachable from the root; ignore.
-			continue
+			return
 		}
 		mf.groups[groupIdx].states = append(mf.groups[groupIdx].states, groupState)
 	}
+	if mf.o.stateTable.len() == 0 {
+		// The optimizer state is not available, e.g. because the memo was
+		// detached, so use the lowest cost expressions retained in the memo.
+		for _, b := range mf.o.mem.GroupBests() {
+			addState(b.Group, &groupState{
+				required:       b.Required,
+				best:           b.Best,
+				cost:           b.Cost,
+				fullyOptimized: true,
+			})
+		}
+	}
+	mf.o.stateTable.forEach(func(groupStateKey groupStateKey, groupState *groupState) {
+		// A speculative state has no best expression if no member can provide
+		// its properties.
+		if !groupState.fullyOptimized || groupState.best == nil {
+			return
+		}
+		addState(groupStateKey.group, groupState)
+	})
 
 	// Sort the states to get deterministic results.
 	for groupIdx := range mf.groups {
@@ -317,3 +620,15 @@ func firstExpr(expr opt.Expr) opt.Expr {
 	}
 	return expr
 }
+
+// nextExpr returns the next expression in the group of the given expression,
+// or nil if there is none. Scalar expressions are the only member of their
+// group.
+func nextExpr(expr opt.Expr) opt.Expr {
+	if rel, ok := expr.(memo.RelExpr); ok {
+		if next := rel.NextExpr(); next != nil {
+			return next
+		}
+	}
+	return nil
+}
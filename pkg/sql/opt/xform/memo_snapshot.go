@@ -0,0 +1,159 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/errors"
+)
+
+// MemoSnapshot captures the state of the memo after a given number of rules
+// have been applied while building and optimizing a query. The memo itself is
+// not copied, since its expressions and the optimizer's state reference each
+// other and are arena allocated. Instead, the snapshot records the decision
+// made for each rule that was matched up to that point, which reproduces the
+// same memo when the same query is built and optimized with the same catalog
+// (see RuleDecisions).
+//
+// Snapshots are intended for bisecting exploration bugs. When a bug appears
+// after thousands of rule applications, SnapshotAfter can be used to binary
+// search for the first application after which the bug appears, and
+// RestoreSnapshot can be used to continue from an earlier snapshot, e.g. with
+// different rules disabled, without recording the decisions again.
+type MemoSnapshot struct {
+	// Applied is the number of rules that were applied before the snapshot was
+	// taken.
+	Applied int
+
+	decisions RuleDecisions
+}
+
+// String encodes the snapshot as a compact, printable string, so that it can
+// be printed by a failing test and parsed again with ParseMemoSnapshot.
+func (s *MemoSnapshot) String() string {
+	return fmt.Sprintf("%d.%s", s.Applied, s.decisions.String())
+}
+
+// ParseMemoSnapshot parses a string that was produced by MemoSnapshot.String.
+func ParseMemoSnapshot(str string) (*MemoSnapshot, error) {
+	i := strings.IndexByte(str, '.')
+	if i < 0 {
+		return nil, errors.Newf("invalid memo snapshot %q", str)
+	}
+	applied, err := strconv.Atoi(str[:i])
+	if err != nil || applied < 0 {
+		return nil, errors.Newf("invalid number of applied rules in memo snapshot %q", str)
+	}
+	decisions, err := ParseRuleDecisions(str[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	return &MemoSnapshot{Applied: applied, decisions: *decisions}, nil
+}
+
+// memoSnapshotter records the rule decisions made by the optimizer until a
+// given number of rules have been applied, and then takes a snapshot.
+type memoSnapshotter struct {
+	limit     int
+	applied   int
+	decisions RuleDecisions
+	snapshot  *MemoSnapshot
+}
+
+// take records the snapshot of the decisions made so far.
+func (s *memoSnapshotter) take() {
+	s.snapshot = &MemoSnapshot{Applied: s.limit}
+	s.snapshot.decisions.rules = append([]opt.RuleName(nil), s.decisions.rules...)
+	s.snapshot.decisions.allowed = append([]bool(nil), s.decisions.allowed...)
+}
+
+// SnapshotAfter causes the optimizer to take a snapshot of the memo once n
+// rules have been applied, which can be retrieved via MemoSnapshot. Once the
+// snapshot has been taken, all rules other than the essential rules are
+// rejected when they are matched, so that the memo that is optimized is the
+// memo in the snapshot. Rules are only counted if SnapshotAfter is called
+// before the expression is built. SnapshotAfter should be called after any
+// calls to NotifyOnMatchedRule, DisableRules and RestoreSnapshot, whose
+// decisions would otherwise not be reflected in the snapshot.
+func (o *Optimizer) SnapshotAfter(n int) {
+	o.snapshotter = &memoSnapshotter{limit: n}
+	if n <= 0 {
+		o.snapshotter.take()
+	}
+
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			s := o.snapshotter
+			if s.snapshot != nil && !essentialRules.Contains(int(ruleName)) {
+				return false
+			}
+			allowed := matchedRule == nil || matchedRule(ruleName)
+			if s.snapshot == nil {
+				s.decisions.record(ruleName, allowed)
+				if allowed {
+					s.applied++
+					if s.applied == s.limit {
+						s.take()
+					}
+				}
+			}
+			return allowed
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+}
+
+// MemoSnapshot returns the snapshot taken since SnapshotAfter was called, or
+// nil if fewer rules were applied than requested, or if SnapshotAfter was not
+// called.
+func (o *Optimizer) MemoSnapshot() *MemoSnapshot {
+	if o.snapshotter == nil {
+		return nil
+	}
+	return o.snapshotter.snapshot
+}
+
+// RestoreSnapshot causes the optimizer to reproduce the memo in the given
+// snapshot by answering the matched rule callbacks of the optimizer and its
+// factory from the decisions in the snapshot, in order. Once the decisions
+// have been replayed, the callbacks that were set before RestoreSnapshot was
+// called decide whether rules are applied, so that optimization continues
+// from the snapshot. RestoreSnapshot must be called at the same point as
+// SnapshotAfter was when the snapshot was taken. If the optimizer matches a
+// rule other than the next one in the snapshot, the replay has diverged from
+// the snapshot, and building or optimizing the expression fails with an error.
+func (o *Optimizer) RestoreSnapshot(snapshot *MemoSnapshot) {
+	decisions := &snapshot.decisions
+	next := 0
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			if next >= decisions.Len() {
+				return matchedRule == nil || matchedRule(ruleName)
+			}
+			if recorded := decisions.rules[next]; recorded != ruleName {
+				panic(errors.AssertionFailedf(
+					"memo snapshot diverged at decision %d: recorded %s, matched %s",
+					next, recorded, ruleName,
+				))
+			}
+			allowed := decisions.allowed[next]
+			next++
+			return allowed
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+}
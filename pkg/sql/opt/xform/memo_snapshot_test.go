@@ -0,0 +1,100 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestMemoSnapshot tests that a memo snapshot taken after a number of rule
+// applications stops further exploration, and still produces a valid plan.
+func TestMemoSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+		"CREATE TABLE xy (x INT PRIMARY KEY, y INT)",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc JOIN xy ON b = x WHERE c = 'foo'"
+
+	// optimize builds and optimizes the query, after calling setup with the
+	// initialized optimizer. It returns the formatted memo, and the number of
+	// rules that were applied.
+	optimize := func(setup func(o *xform.Optimizer)) (_ *xform.Optimizer, _ string, applied int) {
+		var o xform.Optimizer
+		o.Init(&evalCtx, catalog)
+		o.NotifyOnAppliedRule(func(opt.RuleName, opt.Expr, opt.Expr) { applied++ })
+		setup(&o)
+		if err := testutils.BuildInitializedQuery(&o, catalog, query); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return &o, o.FormatMemo(xform.FmtPretty), applied
+	}
+
+	_, full, total := optimize(func(o *xform.Optimizer) {})
+	const n = 10
+	if total <= 2*n {
+		t.Fatalf("expected more than %d rules to be applied, got %d", 2*n, total)
+	}
+
+	// Take a snapshot after n rule applications. Only essential rules are
+	// applied after the snapshot.
+	o, partial, applied := optimize(func(o *xform.Optimizer) { o.SnapshotAfter(n) })
+	snapshot := o.MemoSnapshot()
+	if snapshot == nil || snapshot.Applied != n {
+		t.Fatalf("expected a snapshot after %d rules, got %v", n, snapshot)
+	}
+	if applied >= total || partial == full {
+		t.Fatalf("expected rules to stop being applied after the snapshot, got %d of %d", applied, total)
+	}
+
+	parsed, err := xform.ParseMemoSnapshot(snapshot.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != snapshot.String() {
+		t.Fatalf("expected %s, got %s", snapshot, parsed)
+	}
+
+	// Restoring the snapshot and continuing reproduces the full optimization.
+	_, restored, _ := optimize(func(o *xform.Optimizer) { o.RestoreSnapshot(parsed) })
+	if restored != full {
+		t.Errorf("expected restoring the snapshot to reproduce the memo:\n%s\ngot:\n%s", full, restored)
+	}
+
+	// A later snapshot taken after restoring an earlier one is the same as a
+	// snapshot taken from scratch.
+	later, _, _ := optimize(func(o *xform.Optimizer) { o.SnapshotAfter(2 * n) })
+	continued, _, _ := optimize(func(o *xform.Optimizer) {
+		o.RestoreSnapshot(parsed)
+		o.SnapshotAfter(2 * n)
+	})
+	if later.MemoSnapshot().String() != continued.MemoSnapshot().String() {
+		t.Errorf("expected snapshot %s, got %s", later.MemoSnapshot(), continued.MemoSnapshot())
+	}
+
+	if _, err := xform.ParseMemoSnapshot("10"); err == nil {
+		t.Errorf("expected an error parsing a snapshot without decisions")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/errors"
+)
+
+// VerifyMemo checks the invariants of the memo and of the optimizer state
+// after exploration, and returns an assertion failure describing the
+// violations that it finds, if any. It can be called once the groups have been
+// optimized, including after Optimize has returned, and before the memo is
+// detached. The checks are:
+//
+//   1. Every member of a group has logical properties that are consistent
+//      with the properties of the group. This check is only run in test
+//      builds.
+//   2. Every relational child of a group member is non-nil, and is a member
+//      of its own group.
+//   3. The lowest cost expression of each group can provide the physical
+//      properties required of the group, and is a member of the group or an
+//      enforcer.
+//   4. The cost of each lowest cost expression is finite and non-negative,
+//      and no less than the cost of the lowest cost expressions of its
+//      relational children, except for the right input of an apply join,
+//      which is costed by the coster.
+//
+// VerifyMemo is run by Optimize in test builds, after the groups have been
+// optimized and before the lowest cost tree is extracted, so that corruption
+// of the memo is caught at plan time rather than at execution time.
+func (o *Optimizer) VerifyMemo() error {
+	var v memoVerifier
+	v.o = o
+	if root, ok := o.mem.RootExpr().(memo.RelExpr); ok {
+		v.verifyGroup(root)
+	}
+	o.stateTable.forEach(func(key groupStateKey, state *groupState) {
+		v.verifyState(key, state)
+	})
+	if len(v.violations) == 0 {
+		return nil
+	}
+	err := errors.AssertionFailedf("memo verification failed: %s", errors.Safe(v.violations[0]))
+	for i := 1; i < len(v.violations); i++ {
+		err = errors.WithDetail(err, v.violations[i])
+	}
+	return err
+}
+
+// memoVerifier walks the memo groups reachable from the root, and the group
+// states of the optimizer, and accumulates violations.
+type memoVerifier struct {
+	o          *Optimizer
+	visited    map[memo.RelExpr]struct{}
+	violations []string
+}
+
+func (v *memoVerifier) addViolation(e opt.Expr, format string, args ...interface{}) {
+	v.violations = append(v.violations, fmt.Sprintf("%s: %s", e.Op(), fmt.Sprintf(format, args...)))
+}
+
+// verifyGroup verifies each member of the group of the given expression, and
+// recursively the groups of their children.
+func (v *memoVerifier) verifyGroup(grp memo.RelExpr) {
+	first := grp.FirstExpr()
+	if v.visited == nil {
+		v.visited = make(map[memo.RelExpr]struct{})
+	}
+	if _, ok := v.visited[first]; ok {
+		return
+	}
+	v.visited[first] = struct{}{}
+
+	for member := first; member != nil; member = member.NextExpr() {
+		if err := catchAssertionFailure(func() { v.o.mem.VerifyMemberProps(member) }); err != nil {
+			v.addViolation(member, "logical props are inconsistent with the group: %v", err)
+		}
+		v.verifyChildren(member)
+	}
+}
+
+// verifyChildren verifies that the children of the given expression are not
+// dangling, and then verifies the groups of its relational children. Scalar
+// children are traversed in order to find subqueries.
+func (v *memoVerifier) verifyChildren(e opt.Expr) {
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		child := e.Child(i)
+		if child == nil {
+			v.addViolation(e, "child %d is nil", i)
+			continue
+		}
+		if rel, ok := child.(memo.RelExpr); ok {
+			if opt.IsEnforcerOp(rel) {
+				// Once the lowest cost tree has been extracted, a child can be an
+				// enforcer on top of a group member.
+				v.verifyChildren(rel)
+				continue
+			}
+			if !isGroupMember(rel) {
+				v.addViolation(e, "child %d (%s) is not a member of its group", i, rel.Op())
+				continue
+			}
+			v.verifyGroup(rel)
+			continue
+		}
+		v.verifyChildren(child)
+	}
+}
+
+// verifyState verifies the lowest cost expression of the given group state.
+// The input of an enforcer is optimized with respect to properties derived by
+// enforceProps rather than BuildChildPhysicalProps, so only the cost of an
+// enforcer itself is verified.
+func (v *memoVerifier) verifyState(key groupStateKey, state *groupState) {
+	best := state.best
+	if best == nil {
+		return
+	}
+	cost := float64(state.cost)
+	if math.IsNaN(cost) || math.IsInf(cost, 0) || cost < 0 {
+		v.addViolation(best, "invalid cost %v for required props %s", cost, key.required)
+		return
+	}
+	if opt.IsEnforcerOp(best) {
+		return
+	}
+
+	if best.FirstExpr() != key.group || !isGroupMember(best) {
+		v.addViolation(best, "best expression for %s is not a member of group %s",
+			key.required, key.group.Op())
+		return
+	}
+	if !CanProvidePhysicalProps(v.o.evalCtx, best, key.required) {
+		v.addViolation(best, "best expression cannot provide required props %s", key.required)
+	}
+	for i, n := 0, best.ChildCount(); i < n; i++ {
+		child, ok := best.Child(i).(memo.RelExpr)
+		if !ok {
+			continue
+		}
+		for opt.IsEnforcerOp(child) {
+			child = child.Child(0).(memo.RelExpr)
+		}
+		childRequired := BuildChildPhysicalProps(v.o.mem, best, i, key.required)
+		childState := v.o.lookupOptState(child.FirstExpr(), childRequired)
+		if childState == nil || childState.best == nil {
+			v.addViolation(best, "input %d has not been optimized for required props %s", i, childRequired)
+			continue
+		}
+		if childState.cost > state.cost && !isApplyJoinRightInput(v.o.mem, best, i) {
+			v.addViolation(best, "cost %v is less than the cost %v of input %d",
+				state.cost, childState.cost, i)
+		}
+	}
+}
+
+// isGroupMember returns true if the given expression is in the list of members
+// of its group.
+func isGroupMember(e memo.RelExpr) bool {
+	for member := e.FirstExpr(); member != nil; member = member.NextExpr() {
+		if member == e {
+			return true
+		}
+	}
+	return false
+}
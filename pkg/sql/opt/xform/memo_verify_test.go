@@ -0,0 +1,75 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestVerifyMemo tests that VerifyMemo accepts the memos of optimized queries,
+// and rejects a memo with a negative cost.
+func TestVerifyMemo(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t,
+		abcDDL,
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z INT, INDEX (y))",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	for _, query := range []string{
+		"SELECT a, c FROM abc WHERE c = 'foo'",
+		"SELECT * FROM abc ORDER BY c LIMIT 10",
+		"SELECT * FROM abc INNER JOIN xyz ON a = y WHERE z > 5 ORDER BY b",
+		"SELECT c, count(*) FROM abc GROUP BY c ORDER BY c",
+		"SELECT * FROM abc WHERE EXISTS (SELECT * FROM xyz WHERE y = b)",
+	} {
+		t.Run(query, func(t *testing.T) {
+			var o xform.Optimizer
+			testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+			if _, err := o.Optimize(); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.VerifyMemo(); err != nil {
+				t.Errorf("expected the memo to be valid, got %v", err)
+			}
+		})
+	}
+
+	t.Run("negative cost", func(t *testing.T) {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE b > 1")
+		o.OverrideOperatorCost(opt.ScanOp, func(memo.RelExpr, *physical.Required, memo.Cost) memo.Cost {
+			return -100
+		})
+		// Optimize verifies the memo itself in test builds.
+		_, err := o.Optimize()
+		if err == nil {
+			err = o.VerifyMemo()
+		}
+		if err == nil || !strings.Contains(err.Error(), "memo verification failed") ||
+			!strings.Contains(err.Error(), "invalid cost") {
+			t.Errorf("expected an invalid cost to be reported, got %v", err)
+		}
+	})
+}
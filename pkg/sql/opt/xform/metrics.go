@@ -0,0 +1,122 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// Metrics describes the size of the memo and the work done by the optimizer to
+// plan a query. It is intended to be used to detect planning regressions, e.g.
+// by exposing it in crdb_internal or recording it in time-series metrics.
+type Metrics struct {
+	// Groups is the number of relational memo groups reachable from the root.
+	Groups int
+
+	// Exprs is the total number of member expressions in those groups.
+	Exprs int
+
+	// Enforcers is the number of enforcers, such as Sort or Distribute, that
+	// were costed on top of a group member in order to provide the required
+	// physical properties.
+	Enforcers int
+
+	// GroupStates is the number of (group, required properties) pairs for which
+	// the lowest cost expression was searched.
+	GroupStates int
+
+	// Passes is the number of passes made over the members of a group by
+	// optimizeGroup, summed over all groups and required properties.
+	Passes int
+
+	// SpeculativeStates is the number of (group, required properties) pairs
+	// that were first optimized speculatively, for the input of a partial Sort
+	// enforcer, without trying ordering enforcers.
+	SpeculativeStates int
+
+	// PromotedStates is the number of speculative states that a parent
+	// expression later required, so that their ordering enforcers were tried.
+	PromotedStates int
+
+	// RulesApplied is the number of times an exploration rule was applied and
+	// added at least one expression to the memo.
+	RulesApplied int
+
+	// Ties is the number of times a candidate had the same estimated cost as
+	// the best expression of its group, and the tie had to be broken.
+	Ties int
+
+	// NormalizeTime is the wall time from Init until Optimize was called,
+	// during which the expression was built and normalized.
+	NormalizeTime time.Duration
+
+	// ExploreTime is the wall time spent exploring groups, i.e. applying
+	// exploration rules.
+	ExploreTime time.Duration
+
+	// CostTime is the wall time spent optimizing groups, other than exploring
+	// them, which consists mostly of costing their members.
+	CostTime time.Duration
+
+	// SetLowestCostTreeTime is the wall time spent updating the memo so that
+	// the root points to the lowest cost tree.
+	SetLowestCostTreeTime time.Duration
+
+	// JoinReorder describes the join orderings that were considered by the
+	// JoinOrderBuilder, and whether any join tree was too large to be fully
+	// reordered.
+	JoinReorder JoinReorderStats
+}
+
+// Metrics returns metrics describing the last call to Optimize. The timings
+// are zero if Optimize has not been called.
+func (o *Optimizer) Metrics() Metrics {
+	metrics := o.metrics
+	metrics.GroupStates = o.stateTable.len()
+	metrics.JoinReorder = o.jb.Stats()
+	if root, ok := o.mem.RootExpr().(memo.RelExpr); ok {
+		metrics.Groups, metrics.Exprs = countGroups(root)
+	}
+	return metrics
+}
+
+// countGroups returns the number of relational groups reachable from the
+// given expression, including its own group, and the total number of members
+// in those groups.
+func countGroups(root memo.RelExpr) (groups, exprs int) {
+	visited := make(map[memo.RelExpr]struct{})
+	var visit func(e opt.Expr)
+	visit = func(e opt.Expr) {
+		if rel, ok := e.(memo.RelExpr); ok {
+			first := rel.FirstExpr()
+			if _, ok := visited[first]; ok {
+				return
+			}
+			visited[first] = struct{}{}
+			groups++
+			for member := first; member != nil; member = member.NextExpr() {
+				exprs++
+				for i, n := 0, member.ChildCount(); i < n; i++ {
+					visit(member.Child(i))
+				}
+			}
+			return
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			visit(e.Child(i))
+		}
+	}
+	visit(root)
+	return groups, exprs
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/errors"
+)
+
+// OperatorCostFunc computes the cost of a candidate expression in place of the
+// coster that it overrides. defaultCost is the cost computed by that coster,
+// which the function may adjust rather than replace. Like the cost returned by
+// Coster.ComputeCost, the cost excludes the costs of the candidate's children.
+type OperatorCostFunc func(
+	candidate memo.RelExpr, required *physical.Required, defaultCost memo.Cost,
+) memo.Cost
+
+// OverrideOperatorCost causes the optimizer to cost candidates with the given
+// operator using the given function, while candidates with other operators
+// continue to be costed by the current coster. This allows the cost model of a
+// single operator, such as lookup joins, to be adjusted for an experiment or
+// as a mitigation without replacing the whole coster. Calling it again for the
+// same operator replaces the previous function.
+//
+// OverrideOperatorCost must be called after SetCoster, since it wraps the
+// current coster. The first call wraps the coster, and subsequent calls add to
+// the same set of overrides.
+func (o *Optimizer) OverrideOperatorCost(op opt.Operator, fn OperatorCostFunc) {
+	if op == opt.UnknownOp || op >= opt.NumOperators {
+		panic(errors.AssertionFailedf("invalid operator: %d", op))
+	}
+	if o.costOverrides == nil {
+		o.costOverrides = &overrideCoster{wrapped: o.coster}
+		o.coster = o.costOverrides
+	}
+	o.costOverrides.funcs[op] = fn
+}
+
+// overrideCoster is a Coster that computes the cost of candidates with some
+// operators using an OperatorCostFunc, and defers to the wrapped coster for
+// all other operators.
+type overrideCoster struct {
+	wrapped Coster
+
+	// funcs contains the cost function for each operator, or nil if the cost
+	// of the operator is not overridden.
+	funcs [opt.NumOperators]OperatorCostFunc
+}
+
+var _ BatchCoster = &overrideCoster{}
+
+// ComputeCost is part of the Coster interface.
+func (c *overrideCoster) ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost {
+	return c.overrideCost(candidate, required, c.wrapped.ComputeCost(candidate, required))
+}
+
+// ComputeCosts is part of the BatchCoster interface.
+func (c *overrideCoster) ComputeCosts(
+	candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	ComputeCosts(c.wrapped, candidates, required, costs)
+	for i, candidate := range candidates {
+		costs[i] = c.overrideCost(candidate, required, costs[i])
+	}
+}
+
+// overrideCost returns the cost of the candidate computed by the cost function
+// for its operator, given the cost computed by the wrapped coster, or the
+// given cost if the operator has no cost function.
+func (c *overrideCoster) overrideCost(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.Cost {
+	fn := c.funcs[candidate.Op()]
+	if fn == nil || !cost.Less(memo.MaxCost) {
+		// Never override a cost that prevents an expression from being chosen.
+		return cost
+	}
+	if override := fn(candidate, required, cost); override >= 0 {
+		return override
+	}
+	return 0
+}
+
+// ComputeCostBreakdown is part of the Coster interface. The breakdown is
+// computed by the wrapped coster, since an overridden cost is not divided
+// between resources.
+func (c *overrideCoster) ComputeCostBreakdown(
+	candidate memo.RelExpr, required *physical.Required,
+) memo.CostBreakdown {
+	return c.wrapped.ComputeCostBreakdown(candidate, required)
+}
+
+// ComputeCostInterval is part of the Coster interface.
+func (c *overrideCoster) ComputeCostInterval(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.CostInterval {
+	return c.wrapped.ComputeCostInterval(candidate, required, cost)
+}
@@ -11,20 +11,37 @@
 package xform
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"math/rand"
+	"strings"
+	"time"
+	"unsafe"
 
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/distribution"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/ordering"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
+	"github.com/cockroachdb/cockroach/pkg/util/cancelchecker"
 	"github.com/cockroachdb/cockroach/pkg/util/errorutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // MatchedRuleFunc defines the callback function for the NotifyOnMatchedRule
@@ -32,11 +49,28 @@ import (
 // details.
 type MatchedRuleFunc = norm.MatchedRuleFunc
 
+// RuleMatch describes the match of an optimization rule. See the comment in
+// factory.go for more details.
+type RuleMatch = norm.RuleMatch
+
+// MatchedRuleContextFunc defines the callback function for the
+// NotifyOnMatchedRuleContext event supported by the optimizer. See the comment
+// in factory.go for more details.
+type MatchedRuleContextFunc = norm.MatchedRuleContextFunc
+
 // AppliedRuleFunc defines the callback function for the NotifyOnAppliedRule
 // event supported by the optimizer. See the comment in factory.go for more
 // details.
 type AppliedRuleFunc = norm.AppliedRuleFunc
 
+// ExplorationBudgetFunc defines the callback function for the
+// SetExplorationBudgetFunc event supported by the optimizer. It is passed the
+// number of group explorations performed so far, and returns the maximum number
+// of group explorations that are allowed for the statement. The returned value
+// may change between calls, for example to shrink the budget when the node is
+// overloaded. A negative budget aborts optimization with a BudgetExceededError.
+type ExplorationBudgetFunc func(explorations int) (budget int)
+
 // RuleSet efficiently stores an unordered set of RuleNames.
 type RuleSet = util.FastIntSet
 
@@ -76,10 +110,29 @@ type Optimizer struct {
 	// by calling SetCoster.
 	coster Coster
 
-	// stateMap allocates temporary storage that's used to speed up optimization.
-	// This state could be discarded once optimization is complete.
-	stateMap   map[groupStateKey]*groupState
-	stateAlloc groupStateAlloc
+	// costOverrides is the coster that applies the operator cost functions set
+	// by OverrideOperatorCost. It wraps the coster that was current when
+	// OverrideOperatorCost was first called, or is nil if it was never called.
+	costOverrides *overrideCoster
+
+	// costBatch and costBatchOrds are reused by computeMemberCosts to pass the
+	// members of a group to BatchCoster.ComputeCosts, and to record the ordinal
+	// positions of the members, respectively. costBatchCosts receives their
+	// costs.
+	costBatch      []memo.RelExpr
+	costBatchOrds  []int
+	costBatchCosts []memo.Cost
+
+	// stateTable allocates temporary storage that's used to speed up
+	// optimization. This state could be discarded once optimization is
+	// complete. The table is cleared and reused when the optimizer is
+	// re-initialized.
+	stateTable groupStateTable
+
+	// arena allocates the group states in the stateTable and the enforcers
+	// that are considered during optimization. It is reset and reused when the
+	// optimizer is re-initialized.
+	arena optimizerArena
 
 	// matchedRule is the callback function that is invoked each time an
 	// optimization rule (Normalize or Explore) has been matched by the optimizer.
@@ -95,8 +148,313 @@ type Optimizer struct {
 	// testing.
 	disabledRules RuleSet
 
+	// disabledRulesSeed is the seed used to choose the rules that were disabled
+	// at random by the DisableOptimizerRuleProbability testing knob, or zero if
+	// no rules were disabled at random.
+	disabledRulesSeed int64
+
+	// failingRules is the set of exploration rules that fail with an internal
+	// error when they are matched, set by the OptimizerFailingRules testing
+	// knob. See injectRuleFailures.
+	failingRules RuleSet
+
+	// groupOptimized is the callback function which is invoked each time a
+	// memo group is fully optimized with respect to a set of required physical
+	// properties. It can be set via a call to the NotifyOnGroupOptimized method.
+	groupOptimized GroupOptimizedFunc
+
+	// costTie is the callback function which is invoked each time a tie
+	// between the costs of two expressions is broken. It can be set via a call
+	// to the NotifyOnCostTie method.
+	costTie CostTieFunc
+
+	// groupsOptimized counts the number of (group, required properties) pairs
+	// that have been fully optimized so far. It is only maintained if
+	// groupOptimized is set.
+	groupsOptimized int
+
 	// JoinOrderBuilder adds new join orderings to the memo.
 	jb JoinOrderBuilder
+
+	// ruleOutcomes tracks which exploration rules generated the expressions in
+	// the lowest cost plan. It is nil unless SetRuleOutcomeStore is called.
+	ruleOutcomes *ruleOutcomeTracker
+
+	// planRules tracks the exploration rule application that generated each
+	// memo expression. It is nil unless RecordPlanRules is called.
+	planRules *planRuleTracker
+
+	// explorationBudget is polled each time a group is about to be explored, to
+	// determine whether exploration can continue. If it is nil, exploration is
+	// not bounded. It can be set via a call to SetExplorationBudgetFunc.
+	explorationBudget ExplorationBudgetFunc
+
+	// schedule applies the rule and group priorities of an
+	// ExplorationScheduler. It is nil unless SetExplorationScheduler is called.
+	schedule *explorationSchedule
+
+	// explorations counts the number of group explorations performed so far.
+	explorations int
+
+	// deepening is the state of the iterative-deepening exploration strategy.
+	// It is nil unless SetIterativeDeepening is called.
+	deepening *iterativeDeepening
+
+	// retainGroupBests is true if the lowest cost expression of each group for
+	// each set of required properties is recorded in the memo once
+	// optimization is complete. It is set by RetainGroupBests.
+	retainGroupBests bool
+
+	// recosting is true if the optimizer is re-costing a previously optimized
+	// memo, in which case no exploration is performed. It is set by
+	// InitForRecosting.
+	recosting bool
+
+	// explorationDisabled is true if no exploration rules are applied, and
+	// enforcers are only used where they are required. It is set by
+	// DisableExplorations.
+	explorationDisabled bool
+
+	// explorationStopped is true if a budget has stopped exploration, so that
+	// groups that have not been fully explored never will be.
+	explorationStopped bool
+
+	// timeBudget is the maximum amount of time that Optimize can spend
+	// exploring. It can be set via a call to SetBudget. If it is zero,
+	// exploration is not bounded in time.
+	timeBudget time.Duration
+
+	// deadline is the time after which no further exploration is performed. It
+	// is set when Optimize starts if timeBudget is non-zero.
+	deadline time.Time
+
+	// cancelChecker is used to periodically check whether the statement has
+	// been canceled, so that optimization can stop promptly.
+	cancelChecker cancelchecker.CancelChecker
+
+	// memAcc, if non-nil, is grown to account for the memory used by the memo
+	// and by the optimizer's temporary state. It can be set via a call to
+	// SetMemoryAccount.
+	memAcc *mon.BoundAccount
+
+	// memAccounted is the number of bytes that have been accounted for in
+	// memAcc so far.
+	memAccounted int64
+
+	// degradeOnMemoryLimit is true if exploration should stop, rather than
+	// optimization fail, when memAcc cannot be grown.
+	degradeOnMemoryLimit bool
+
+	// memoryExhausted is true if memAcc could not be grown, and exploration was
+	// stopped as a result.
+	memoryExhausted bool
+
+	// maxMemoExprs is the maximum number of expressions that exploration can
+	// add to the memo. If it is zero, the number is not limited. It is set from
+	// the optimizer_max_memo_exprs session setting.
+	maxMemoExprs int
+
+	// initialMemoExprs is the number of expressions that the memo contained
+	// when Optimize was called.
+	initialMemoExprs int
+
+	// memoExprLimitReached is true if exploration was stopped because it added
+	// maxMemoExprs expressions to the memo.
+	memoExprLimitReached bool
+
+	// cappedRules is the set of exploration rules that were not applied because
+	// they had already been applied the number of times allowed by
+	// SetRuleCaps.
+	cappedRules RuleSet
+
+	// warnings are the warnings about the plan that have been registered during
+	// optimization. See Warnings.
+	warnings []Warning
+
+	// statsWarnings is true if Optimize warns about tables that have missing
+	// statistics, and about those whose statistics are older than
+	// staleStatsAge, if it is positive. See EnableStatisticsWarnings.
+	statsWarnings bool
+	staleStatsAge time.Duration
+
+	// applyingRule is the exploration rule that is being applied to the group
+	// member that is being explored, or InvalidRuleName if no rule is being
+	// applied. It is attributed to internal errors that occur during
+	// exploration. See DisableForRetry.
+	applyingRule opt.RuleName
+
+	// heuristicThreshold is the number of expressions in the normalized memo at
+	// or above which the optimizer plans heuristically rather than fully
+	// exploring the memo. If it is zero, the optimizer always fully explores
+	// the memo. It is set from the optimizer_heuristic_planning_threshold
+	// session setting.
+	heuristicThreshold int
+
+	// heuristic is true if the optimizer is planning heuristically. See
+	// planHeuristically.
+	heuristic bool
+
+	// leadingTables are the names of the tables that must be joined first, in
+	// order, before any other relation. It is set from the
+	// optimizer_leading_tables session setting.
+	leadingTables []string
+
+	// externalRules are the external exploration rules that are applied in
+	// addition to the Optgen rules. They are set from the
+	// optimizer_external_rules session setting.
+	externalRules []ExternalRule
+
+	// joinHint is the join order hint created from leadingTables when Optimize
+	// is called. It is nil if there is no hint, or if the hint does not apply
+	// to the query.
+	joinHint *joinOrderHint
+
+	// baseline determines which expressions can be part of the plan described
+	// by the baseline passed to SetPlanBaseline. It is nil if there is none.
+	baseline *planBaselineMatcher
+
+	// previousPlan determines which expressions are part of the plan passed to
+	// SetPreviousPlan. It is nil if there is none.
+	previousPlan *planBaselineMatcher
+
+	// stabilityTolerance is the fraction of the cost of the best expression
+	// of a group by which an expression that reproduces the previous plan may
+	// be more expensive and still be preferred. It is set by SetPreviousPlan.
+	stabilityTolerance float64
+
+	// nearTieEpsilon is the relative difference between the estimated costs of
+	// two candidates within which the optimizer chooses between them randomly,
+	// using nearTieRng. If it is zero, the lower cost candidate is always
+	// chosen. It is set by SetNearTieRandomization.
+	nearTieEpsilon float64
+	nearTieRng     *rand.Rand
+
+	// nearTieChoices is the number of times that a candidate replaced the best
+	// expression of a group because it was chosen randomly among near ties,
+	// rather than because it was cheaper.
+	nearTieChoices int
+
+	// riskAversion is the relative difference between the estimated costs of
+	// two candidates within which the candidate with the lower worst-case cost
+	// is preferred. If it is zero, worst-case costs are not computed. It is set
+	// from the optimizer_risk_aversion session setting.
+	riskAversion float64
+
+	// planGuardrail determines whether large cross joins and full scans in the
+	// lowest cost tree are ignored, reported as warnings, or rejected. It is
+	// set from the optimizer_plan_guardrail session setting.
+	planGuardrail sessiondatapb.PlanGuardrailMode
+
+	// guardrailRows is the estimated number of rows above which a cross join
+	// or full scan is flagged by the plan guardrail. It is set from the
+	// large_full_scan_rows session setting.
+	guardrailRows float64
+
+	// guardrailViolations contains the large cross joins and full scans that
+	// were found in the lowest cost tree by the plan guardrail.
+	guardrailViolations []GuardrailViolation
+
+	// costModel contains the base cost factors used by the default coster. It
+	// is taken from the cluster settings, unless overridden by
+	// SetCostModelSettings.
+	costModel CostModelSettings
+
+	// shadow is the shadow cost model under which candidates are also costed,
+	// or nil if there is none. See SetShadowCostModel.
+	shadow *shadowCostModel
+
+	// parallelism is the number of parallel streams in which expressions can
+	// be executed below a Gather enforcer. If it is less than two, only serial
+	// plans are considered. It can be set via a call to SetParallelism.
+	parallelism int
+
+	// topK is the number of lowest cost candidates that are retained for each
+	// group and set of required properties. It is set by OptimizeTopK. If it is
+	// zero, only the lowest cost candidate is retained.
+	topK int
+
+	// costBoundPruning is true if the optimizer abandons candidates whose
+	// accumulated cost already exceeds the cost of the best expression found so
+	// far. It is set via a call to SetCostBoundPruning.
+	costBoundPruning bool
+
+	// costCeiling is the maximum estimated cost of the lowest cost plan, or
+	// zero if there is no maximum. It is taken from the
+	// sql.optimizer.max_plan_cost cluster setting, unless overridden by
+	// SetCostCeiling.
+	costCeiling memo.Cost
+
+	// tracer records the rules applied during optimization. It is nil unless
+	// EnableTracing is called.
+	tracer *tracer
+
+	// planningProfiles are the profiles that are applied to queries of each
+	// shape. They are nil unless SetPlanningProfiles is called.
+	planningProfiles PlanningProfiles
+
+	// queryShape is the shape of the query, as classified by Optimize when
+	// planningProfiles is set.
+	queryShape QueryShape
+
+	// joinOrderCache, if non-nil, stores the best join order found for each
+	// join graph. See SetJoinOrderCache.
+	joinOrderCache *JoinOrderCache
+
+	// hints are the hints given in the hint comment of the statement, which
+	// are taken from the EvalContext by Init.
+	hints StatementHints
+
+	// costDistribution records the costs of the alternatives for the root
+	// group. It is nil unless EnableCostDistribution is called.
+	costDistribution *costDistributionRecorder
+
+	// ruleReporter counts the rules matched and applied for each memo group.
+	// It is nil unless EnableRuleReport is called.
+	ruleReporter *ruleReporter
+
+	// timeLimits abandons exploration rules and groups that exceed their time
+	// limits. It is nil unless SetRuleTimeLimits is called.
+	timeLimits *ruleTimeLimits
+
+	// events emits structured events to an external sink. It is nil unless
+	// SetEventSink is called.
+	events *eventEmitter
+
+	// ruleStats accumulates statistics about the rules that are matched and
+	// applied. It is nil unless EnableRuleStats is called.
+	ruleStats *ruleStatsCollector
+
+	// ruleCoverage, if non-nil, aggregates the rule statistics of this
+	// optimization along with those of other optimizations. It is set by
+	// SetRuleCoverage.
+	ruleCoverage *RuleCoverage
+
+	// ruleDecisions records the decisions made by the matched rule callbacks.
+	// It is nil unless RecordRuleDecisions is called.
+	ruleDecisions *RuleDecisions
+
+	// snapshotter takes a snapshot of the memo once a number of rules have
+	// been applied. It is nil unless SnapshotAfter is called.
+	snapshotter *memoSnapshotter
+
+	// optimizing is the first expression in the group that is currently being
+	// optimized. It is used to provide context for errors.
+	optimizing memo.RelExpr
+
+	// initTime is the time at which Init was called. It is used to compute
+	// Metrics.NormalizeTime.
+	initTime time.Time
+
+	// span is the tracing span of the current phase of Optimize. It is nil if
+	// the statement being optimized is not traced. See startSpan.
+	span *tracing.Span
+
+	// metrics accumulates the counters and timings returned by Metrics.
+	metrics Metrics
+
+	// report summarizes the last call to Optimize. It is returned by
+	// PlanningReport.
+	report PlanningReport
 }
 
 // Init initializes the Optimizer with a new, blank memo structure inside. This
@@ -105,30 +463,122 @@ func (o *Optimizer) Init(evalCtx *tree.EvalContext, catalog cat.Catalog) {
 	// This initialization pattern ensures that fields are not unwittingly
 	// reused. Field reuse must be explicit.
 	*o = Optimizer{
-		evalCtx:  evalCtx,
-		catalog:  catalog,
-		f:        o.f,
-		stateMap: make(map[groupStateKey]*groupState),
+		evalCtx:    evalCtx,
+		catalog:    catalog,
+		f:          o.f,
+		stateTable: o.stateTable,
+		arena:      o.arena,
+		initTime:   timeutil.Now(),
 	}
+	o.stateTable.reset(maxRetainedGroupStates)
+	o.arena.reset()
 	o.f.Init(evalCtx, catalog)
 	o.mem = o.f.Memo()
 	o.explorer.init(o)
-	o.defaultCoster.Init(evalCtx, o.mem, evalCtx.TestingKnobs.OptimizerCostPerturbation)
+	o.costModel = DefaultCostModelSettings()
+	if evalCtx.Settings != nil {
+		o.costModel = MakeCostModelSettings(&evalCtx.Settings.SV)
+		o.costCeiling = memo.Cost(MaxPlanCostSetting.Get(&evalCtx.Settings.SV))
+		if v := CostModelVersion(shadowVersionSetting.Get(&evalCtx.Settings.SV)); v != 0 {
+			shadow := o.costModel
+			shadow.Version = v
+			o.SetShadowCostModel(shadow)
+		}
+	}
+	o.defaultCoster.Init(evalCtx, o.mem, evalCtx.TestingKnobs.OptimizerCostPerturbation, o.costModel)
 	o.coster = &o.defaultCoster
+	o.maxMemoExprs = int(evalCtx.SessionData().OptimizerMaxMemoExprs)
+	o.heuristicThreshold = int(evalCtx.SessionData().OptimizerHeuristicPlanningThreshold)
+	o.riskAversion = evalCtx.SessionData().OptimizerRiskAversion
+	o.planGuardrail = evalCtx.SessionData().OptimizerPlanGuardrail
+	o.guardrailRows = evalCtx.SessionData().LargeFullScanRows
+	if names := evalCtx.SessionData().OptimizerLeadingTables; names != "" {
+		o.leadingTables = strings.Split(names, ",")
+	}
+	if names := evalCtx.SessionData().OptimizerDisableRules; names != "" {
+		// The setting is validated when it is set, so the error can be ignored.
+		if rules, err := ParseRuleSet(strings.Split(names, ",")); err == nil {
+			o.DisableRules(rules)
+		}
+	}
+	if evalCtx.Settings != nil {
+		// The setting is validated when it is set, so the error can be ignored.
+		names := opt.DisabledRulesClusterSetting.Get(&evalCtx.Settings.SV)
+		if rules, err := opt.ParseRuleNames(names); err == nil && len(rules) > 0 {
+			var disabled RuleSet
+			for _, r := range rules {
+				disabled.Add(int(r))
+			}
+			o.DisableRules(disabled)
+		}
+	}
+	if names := evalCtx.SessionData().OptimizerExternalRules; names != "" {
+		// The setting is validated when it is set, so the error can be ignored.
+		if rules, err := ParseExternalRules(strings.Split(names, ",")); err == nil {
+			o.externalRules = rules
+		}
+	}
+	if evalCtx.OptimizerHints != "" {
+		// The hints are validated before the statement is planned, so the error
+		// can be ignored.
+		if hints, err := ParseStatementHints(evalCtx.OptimizerHints); err == nil {
+			o.applyStatementHints(hints)
+		}
+	}
+	for _, name := range evalCtx.TestingKnobs.OptimizerFailingRules {
+		// Unknown rule names are ignored.
+		if r, ok := opt.ParseRuleName(strings.TrimSpace(name)); ok {
+			o.failingRules.Add(int(r))
+		}
+	}
 	if evalCtx.TestingKnobs.DisableOptimizerRuleProbability > 0 {
-		o.disableRules(evalCtx.TestingKnobs.DisableOptimizerRuleProbability)
+		o.disableRules(
+			evalCtx.TestingKnobs.DisableOptimizerRuleProbability,
+			evalCtx.TestingKnobs.DisableOptimizerRuleSeed,
+			protectedRules(&evalCtx.TestingKnobs),
+		)
 	}
 }
 
 // DetachMemo extracts the memo from the optimizer, and then re-initializes the
 // optimizer so that its reuse will not impact the detached memo. This method is
-// used to extract a read-only memo during the PREPARE phase.
+// used to extract a read-only memo during the PREPARE phase. The planning
+// report of the last call to Optimize is retained.
 func (o *Optimizer) DetachMemo() *memo.Memo {
 	detach := o.f.DetachMemo()
+	report := o.report
 	o.Init(o.evalCtx, o.catalog)
+	o.report = report
 	return detach
 }
 
+// InitForRecosting initializes the optimizer to optimize a memo that was
+// previously optimized and detached, after the table statistics have changed.
+// The expressions that were added to the memo by exploration are retained;
+// Optimize only re-derives their statistics, re-computes their costs, and
+// chooses a new lowest cost tree, which is much cheaper than optimizing the
+// query from scratch. New expressions are not added to the memo, so an
+// alternative that would only have been generated by exploration under the new
+// statistics will not be considered.
+//
+// InitForRecosting must be called after Init, and before any other methods
+// that configure the optimizer. It returns false if the memo cannot be
+// re-costed, in which case the memo has been modified and must be discarded.
+// See memo.Memo.ResetForRecosting.
+func (o *Optimizer) InitForRecosting(mem *memo.Memo) bool {
+	if !mem.ResetForRecosting(o.evalCtx) {
+		return false
+	}
+	o.mem = mem
+	o.recosting = true
+	o.explorationStopped = true
+	o.explorer.init(o)
+	o.defaultCoster.Init(
+		o.evalCtx, o.mem, o.evalCtx.TestingKnobs.OptimizerCostPerturbation, o.costModel,
+	)
+	return true
+}
+
 // Factory returns a factory interface that the caller uses to construct an
 // input expression tree. The root of the resulting tree can be passed to the
 // Optimize method in order to find the lowest cost plan.
@@ -148,6 +598,19 @@ func (o *Optimizer) Coster() Coster {
 // coster to estimate the cost of expression execution.
 func (o *Optimizer) SetCoster(coster Coster) {
 	o.coster = coster
+	o.costOverrides = nil
+}
+
+// ChainCoster wraps the current coster with the coster returned by outer,
+// which is passed the current coster so that it can delegate to it. This
+// allows costers that adjust costs, such as for logging or capping, to be
+// layered on top of one another instead of replacing the coster as SetCoster
+// does. A wrapping coster can embed the inner Coster to delegate the methods
+// that it does not override. Each call adds a layer, so the coster added by
+// the last call is consulted first.
+func (o *Optimizer) ChainCoster(outer func(inner Coster) Coster) {
+	o.coster = outer(o.coster)
+	o.costOverrides = nil
 }
 
 // JoinOrderBuilder returns the JoinOrderBuilder instance that the optimizer is
@@ -161,6 +624,246 @@ func (o *Optimizer) JoinOrderBuilder() *JoinOrderBuilder {
 // expression tree (because no transforms are applied).
 func (o *Optimizer) DisableOptimizations() {
 	o.NotifyOnMatchedRule(func(opt.RuleName) bool { return false })
+	o.externalRules = nil
+}
+
+// DisableExplorations disables the exploration phase of the optimizer, while
+// normalization rules continue to be applied as the input expression tree is
+// built. No exploration rules are applied, and an enforcer is only added to an
+// expression that cannot provide the required physical properties itself. The
+// output expression tree is therefore the normalized input expression tree,
+// costed and with the enforcers that it requires. It must be called before
+// Optimize.
+func (o *Optimizer) DisableExplorations() {
+	o.explorationDisabled = true
+	o.explorationStopped = true
+}
+
+// SetMaxParallelism bounds the number of nodes that may concurrently execute
+// the plan by adding the MaxParallelism property to the root's required
+// physical properties. The bound is passed through to every expression in the
+// plan, so that the coster can prefer serial alternatives, or alternatives
+// that fan out to fewer nodes. A value of 0 removes any existing bound. It must
+// be called after the memo has been built and before Optimize.
+func (o *Optimizer) SetMaxParallelism(maxParallelism int) {
+	if maxParallelism < 0 {
+		panic(errors.AssertionFailedf("negative max parallelism: %d", maxParallelism))
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok || o.mem.RootProps().MaxParallelism == maxParallelism {
+		return
+	}
+	rootProps := *o.mem.RootProps()
+	rootProps.MaxParallelism = maxParallelism
+	o.mem.SetRoot(root, &rootProps)
+}
+
+// SetParallelism allows the optimizer to consider plans in which expressions
+// are executed in the given number of parallel streams, which are combined by a
+// Gather enforcer. The optimizer chooses parallel plans when their per-stream
+// cost savings outweigh the cost of exchanging rows between streams. The
+// number of streams is capped by the MaxParallelism physical property. A value
+// of 0 or 1 only allows serial plans. It must be called before Optimize.
+func (o *Optimizer) SetParallelism(parallelism int) {
+	if parallelism < 0 {
+		panic(errors.AssertionFailedf("negative parallelism: %d", parallelism))
+	}
+	o.parallelism = parallelism
+}
+
+// SetRiskAversion makes the optimizer prefer the expression with the lower
+// worst-case cost (see Coster.ComputeCostInterval) over the expression with the
+// lower estimated cost, when their estimated costs differ by no more than the
+// given fraction of the lower cost. A value of 0 always prefers the lower
+// estimated cost. It overrides the optimizer_risk_aversion session setting, and
+// must be called before Optimize.
+func (o *Optimizer) SetRiskAversion(riskAversion float64) {
+	if riskAversion < 0 {
+		panic(errors.AssertionFailedf("negative risk aversion: %v", riskAversion))
+	}
+	o.riskAversion = riskAversion
+}
+
+// SetNearTieRandomization makes the optimizer choose randomly, using a random
+// number generator with the given seed, between candidates whose estimated
+// costs differ by no more than the given fraction of the lower cost. Each
+// group chooses uniformly among the candidates that tie with its best
+// expression as they are costed. This allows near-equivalent plans to be
+// compared by executing them, e.g. in test clusters or to collect execution
+// feedback for plans that would otherwise never be chosen. A value of 0
+// always chooses the lower estimated cost. It must be called before Optimize.
+func (o *Optimizer) SetNearTieRandomization(epsilon float64, seed int64) {
+	if epsilon < 0 {
+		panic(errors.AssertionFailedf("negative near tie epsilon: %v", epsilon))
+	}
+	o.nearTieEpsilon = epsilon
+	o.nearTieRng = rand.New(rand.NewSource(seed))
+}
+
+// NearTieChoices returns the number of times that the optimizer chose a more
+// expensive candidate over the best expression of a group because their costs
+// were nearly tied. It is always zero unless SetNearTieRandomization was
+// called. It must be called after Optimize.
+func (o *Optimizer) NearTieChoices() int {
+	return o.nearTieChoices
+}
+
+// SetPlanGuardrail determines what the optimizer does when the lowest cost
+// tree contains a cross join or full scan which is estimated to return more
+// than the given number of rows, or for which there are no statistics. In
+// PlanGuardrailWarn mode a warning is sent to the client for each of them, and
+// in PlanGuardrailError mode Optimize returns an error. In either mode they
+// are returned by GuardrailViolations. It overrides the
+// optimizer_plan_guardrail and large_full_scan_rows session settings, and must
+// be called before Optimize.
+//
+// The plan is only checked when it is optimized, so no warning is sent when a
+// cached plan is reused.
+func (o *Optimizer) SetPlanGuardrail(mode sessiondatapb.PlanGuardrailMode, rows float64) {
+	o.planGuardrail = mode
+	o.guardrailRows = rows
+}
+
+// SetCostBoundPruning causes the optimizer to abandon a group member as soon
+// as the cost of its fully optimized children already exceeds the cost of the
+// best expression found for the same group and required properties. Since
+// costs are never negative, such a member can never become the best
+// expression, so its remaining children need not be optimized and the member
+// itself need not be costed. The remaining cost is also passed down as a
+// budget to the child groups, whose members are abandoned in the same way once
+// they exceed it (see optimizeGroup). Pruning is not performed when the
+// optimizer retains the top K candidates, is risk-averse, randomizes near
+// ties, prefers the previous plan, or has a shadow cost model, since a
+// candidate with a higher estimated cost may still be retained in those cases.
+// It must be called before Optimize.
+func (o *Optimizer) SetCostBoundPruning(prune bool) {
+	o.costBoundPruning = prune
+}
+
+// SetCostModelSettings overrides the cost model settings taken from the
+// cluster settings, e.g. with the results of a calibration run. It
+// reinitializes the default coster, so it must be called before Optimize and
+// before SetCoster.
+func (o *Optimizer) SetCostModelSettings(settings CostModelSettings) {
+	if err := settings.Validate(); err != nil {
+		panic(errors.NewAssertionErrorWithWrappedErrf(err, "invalid cost model settings"))
+	}
+	o.costModel = settings
+	perturbation := o.defaultCoster.perturbation
+	estimator := o.defaultCoster.estimator
+	statsPenalty := o.defaultCoster.statsPenalty
+	o.defaultCoster.Init(o.evalCtx, o.mem, 0 /* perturbation */, settings)
+	o.defaultCoster.setPerturbation(perturbation)
+	o.defaultCoster.estimator = estimator
+	o.defaultCoster.setStatsPenalty(statsPenalty)
+}
+
+// SetCostPerturbation replaces the perturbation applied by the default coster,
+// which is otherwise taken from the OptimizerCostPerturbation testing knob. It
+// is used to test the robustness of plans, e.g. by perturbing only the costs of
+// joins. It must be called before Optimize.
+func (o *Optimizer) SetCostPerturbation(perturbation CostPerturbation) {
+	if perturbation.Amount < 0 {
+		panic(errors.AssertionFailedf("negative cost perturbation: %v", perturbation.Amount))
+	}
+	o.defaultCoster.setPerturbation(perturbation)
+}
+
+// placeholderExplorationRules is the set of exploration rules that can run
+// after placeholders have been assigned in a memo that was prepared with
+// placeholders. These are the rules which select indexes, push limits into
+// scans, and generate lookup joins, since they are the most likely to benefit
+// from filters and limits that have become constant. Joins are reordered so
+// that a lookup join can be generated into either input of a join, since a
+// constant filter can make either input the smaller one.
+var placeholderExplorationRules = util.MakeFastIntSet(
+	int(opt.GenerateIndexScans),
+	int(opt.GeneratePartialIndexScans),
+	int(opt.GenerateConstrainedScans),
+	int(opt.GenerateInvertedIndexScans),
+	int(opt.GenerateLimitedScans),
+	int(opt.PushLimitIntoFilteredScan),
+	int(opt.PushLimitIntoIndexJoin),
+	int(opt.ReorderJoins),
+	int(opt.CommuteLeftJoin),
+	int(opt.CommuteSemiJoin),
+	int(opt.GenerateLookupJoins),
+	int(opt.GenerateLookupJoinsWithFilter),
+	int(opt.GenerateLookupJoinsWithVirtualCols),
+	int(opt.GenerateLookupJoinsWithVirtualColsAndFilter),
+)
+
+// placeholderExplorationBudget is the maximum number of exploration rules that
+// can be applied when exploration is restricted by
+// RestrictExplorationForPlaceholders.
+const placeholderExplorationBudget = 100
+
+// RestrictExplorationForPlaceholders restricts exploration to a narrow set of
+// rules that re-derive scan constraints, select indexes, push down limits, and
+// generate lookup joins, and bounds the number of those rules that can be
+// applied. It should be called after Factory.AssignPlaceholders and before
+// Optimize, so that a memo which was prepared with placeholders can take
+// advantage of the now-constant values without paying the cost of full
+// exploration. Normalization rules are not affected.
+func (o *Optimizer) RestrictExplorationForPlaceholders() {
+	budget := placeholderExplorationBudget
+	matchedRule := o.matchedRule
+
+	// Only set the callback on the optimizer, not the factory, since
+	// normalization rules should run as usual.
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		if ruleName.IsExplore() {
+			if budget <= 0 || !placeholderExplorationRules.Contains(int(ruleName)) {
+				return false
+			}
+		}
+		if matchedRule != nil && !matchedRule(ruleName) {
+			return false
+		}
+		if ruleName.IsExplore() {
+			budget--
+		}
+		return true
+	}
+}
+
+// SetRuleCaps limits the number of times that each of the given exploration
+// rules can be applied, so that a rule which generates a large number of
+// expressions, such as a join reordering rule over many tables, cannot blow up
+// the memo on its own. Once a rule has been applied the number of times given
+// by its cap, it is no longer applied, as though it had been disabled, and a
+// notice is sent to the client when optimization completes. Rules without a
+// cap, normalization rules and essential rules are not limited. SetRuleCaps
+// must be called after NotifyOnMatchedRule, since it chains onto any existing
+// callback.
+func (o *Optimizer) SetRuleCaps(caps map[opt.RuleName]int) {
+	applied := make(map[opt.RuleName]int, len(caps))
+	matchedRule := o.matchedRule
+
+	// Only set the callback on the optimizer, not the factory, since
+	// normalization rules are not limited.
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		if matchedRule != nil && !matchedRule(ruleName) {
+			return false
+		}
+		limit, ok := caps[ruleName]
+		if !ok || !ruleName.IsExplore() || essentialRules.Contains(int(ruleName)) {
+			return true
+		}
+		if applied[ruleName] >= limit {
+			o.cappedRules.Add(int(ruleName))
+			return false
+		}
+		applied[ruleName]++
+		return true
+	}
+}
+
+// CappedRules returns the set of exploration rules that were not applied
+// during the last call to Optimize because they reached the cap set by
+// SetRuleCaps.
+func (o *Optimizer) CappedRules() RuleSet {
+	return o.cappedRules.Copy()
 }
 
 // NotifyOnMatchedRule sets a callback function which is invoked each time an
@@ -176,6 +879,28 @@ func (o *Optimizer) NotifyOnMatchedRule(matchedRule MatchedRuleFunc) {
 	o.f.NotifyOnMatchedRule(matchedRule)
 }
 
+// NotifyOnMatchedRuleContext is like NotifyOnMatchedRule, but the callback is
+// passed a description of the match. For an exploration rule, this includes
+// the group member that was matched and the physical properties required of
+// its group when it was explored. For a normalization rule, only the name of
+// the rule is set. The callback replaces any callback set via
+// NotifyOnMatchedRule, and methods such as DisableRules and SetRuleCaps chain
+// onto it in the same way.
+func (o *Optimizer) NotifyOnMatchedRuleContext(matchedRule MatchedRuleContextFunc) {
+	if matchedRule == nil {
+		o.NotifyOnMatchedRule(nil)
+		return
+	}
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		return matchedRule(RuleMatch{
+			Rule:     ruleName,
+			Source:   o.explorer.exploring,
+			Required: o.explorer.required,
+		})
+	}
+	o.f.NotifyOnMatchedRuleContext(matchedRule)
+}
+
 // NotifyOnAppliedRule sets a callback function which is invoked each time an
 // optimization rule (Normalize or Explore) has been applied by the optimizer.
 // If appliedRule is nil, then no further notifications are sent.
@@ -187,6 +912,290 @@ func (o *Optimizer) NotifyOnAppliedRule(appliedRule AppliedRuleFunc) {
 	o.f.NotifyOnAppliedRule(appliedRule)
 }
 
+// GroupOptimizedFunc defines the callback function for the
+// NotifyOnGroupOptimized event supported by the optimizer. It is passed the
+// group that was fully optimized, along with the progress of optimization so
+// far.
+type GroupOptimizedFunc func(state GroupState, progress OptimizationProgress)
+
+// OptimizationProgress describes how far optimization has progressed. It is
+// passed to the callback of NotifyOnGroupOptimized.
+type OptimizationProgress struct {
+	// Optimized is the number of (group, required properties) pairs that have
+	// been fully optimized so far.
+	Optimized int
+
+	// Remaining is the number of (group, required properties) pairs that have
+	// been visited, but not yet fully optimized. It can grow as optimization
+	// proceeds, since optimizing a group visits the groups of its children with
+	// new required properties, and exploration adds new groups to the memo.
+	Remaining int
+}
+
+// NotifyOnGroupOptimized sets a callback function which is invoked each time a
+// memo group is fully optimized with respect to a set of required physical
+// properties, so that the progress of a long optimization can be reported, or
+// an optimization that is not making progress can be detected. The callback
+// must not modify the optimizer state. If groupOptimized is nil, then no
+// further notifications are sent.
+func (o *Optimizer) NotifyOnGroupOptimized(groupOptimized GroupOptimizedFunc) {
+	o.groupOptimized = groupOptimized
+}
+
+// SetRuleOutcomeStore causes the optimizer to record, for each exploration
+// rule, how many expressions the rule generated and how many of those ended up
+// in the lowest cost plan. The outcomes are recorded in the given store once
+// optimization is complete. SetRuleOutcomeStore must be called after
+// NotifyOnAppliedRule, since it chains onto any existing callback.
+func (o *Optimizer) SetRuleOutcomeStore(store RuleOutcomeStore) {
+	o.ruleOutcomes = &ruleOutcomeTracker{}
+	o.ruleOutcomes.init(store)
+
+	// Only set the callback on the optimizer, not the factory, since only the
+	// outcomes of exploration rules are tracked.
+	appliedRule := o.appliedRule
+	o.appliedRule = func(ruleName opt.RuleName, source, target opt.Expr) {
+		if appliedRule != nil {
+			appliedRule(ruleName, source, target)
+		}
+		o.ruleOutcomes.recordApplied(ruleName, target)
+	}
+}
+
+// EnableTracing causes the optimizer to record each rule that is applied, along
+// with the expressions it added, their cost, and the rule's effect on the cost
+// of the group being optimized. The trace can be retrieved via Trace once Optimize completes.
+// Normalization rules are only recorded if EnableTracing is called before the
+// expression is built. EnableTracing should be called after any calls to
+// NotifyOnAppliedRule, which would otherwise replace the tracing callback.
+//
+// The trace also records each enforcer that is costed, whether or not it is
+// chosen, so that the decision between a Sort and a plan that provides the
+// ordering natively can be diagnosed (see EnforcerDecision).
+func (o *Optimizer) EnableTracing() {
+	o.tracer = &tracer{}
+	o.tracer.trace.Start = timeutil.Now()
+
+	appliedRule := o.appliedRule
+	o.appliedRule = func(ruleName opt.RuleName, source, target opt.Expr) {
+		if appliedRule != nil {
+			appliedRule(ruleName, source, target)
+		}
+		o.tracer.recordApplied(ruleName, source, target)
+	}
+
+	factoryRule := o.f.AppliedRule()
+	o.f.NotifyOnAppliedRule(func(ruleName opt.RuleName, source, target opt.Expr) {
+		if factoryRule != nil {
+			factoryRule(ruleName, source, target)
+		}
+		o.tracer.recordApplied(ruleName, source, target)
+	})
+}
+
+// Trace returns the rules that have been recorded since EnableTracing was
+// called, or nil if tracing is not enabled.
+func (o *Optimizer) Trace() *OptimizerTrace {
+	if o.tracer == nil {
+		return nil
+	}
+	return &o.tracer.trace
+}
+
+// DisableRules prevents the given rules from being applied, whether they are
+// normalization or exploration rules. Essential rules, without which the
+// optimizer may fail to produce a plan, are never disabled. Normalization rules
+// are only disabled if DisableRules is called before the expression is built.
+// DisableRules should be called after any calls to NotifyOnMatchedRule, which
+// would otherwise replace the callback that disables the rules.
+func (o *Optimizer) DisableRules(rules RuleSet) {
+	rules = rules.Difference(essentialRules)
+	if rules.Empty() {
+		return
+	}
+	if o.disabledRules.Empty() {
+		wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+			return func(ruleName opt.RuleName) bool {
+				if o.disabledRules.Contains(int(ruleName)) {
+					return false
+				}
+				return matchedRule == nil || matchedRule(ruleName)
+			}
+		}
+		o.matchedRule = wrapMatched(o.matchedRule)
+		o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+	}
+	o.disabledRules.UnionWith(rules)
+}
+
+// DisabledRules returns the set of rules that have been disabled, either by
+// DisableRules or at random by the DisableOptimizerRuleProbability testing
+// knob. Essential rules are never included, unless they are named by the
+// DisableOptimizerRuleUnprotect testing knob.
+func (o *Optimizer) DisabledRules() RuleSet {
+	return o.disabledRules.Copy()
+}
+
+// DisableRulesByName is like DisableRules, but takes the names of the rules to
+// disable. It returns an error if any of the names is not the name of a rule
+// that can be disabled, in which case no rules are disabled.
+func (o *Optimizer) DisableRulesByName(names []string) error {
+	rules, err := ParseRuleSet(names)
+	if err != nil {
+		return err
+	}
+	o.DisableRules(rules)
+	return nil
+}
+
+// OnlyApplyRules disables every rule except the given rules and the essential
+// rules, without which the optimizer may fail to produce a plan. This is useful
+// when debugging, to bisect which rule is responsible for an incorrect result
+// or a regression. It has the same restrictions as DisableRules.
+func (o *Optimizer) OnlyApplyRules(rules RuleSet) {
+	var disabled RuleSet
+	for r := opt.RuleName(1); r < opt.NumRuleNames; r++ {
+		if !rules.Contains(int(r)) {
+			disabled.Add(int(r))
+		}
+	}
+	o.DisableRules(disabled)
+}
+
+// ParseRuleSet returns the set of rules with the given names. It returns an
+// error if any of the names is not the name of a rule, or is the name of an
+// essential rule that cannot be disabled.
+func ParseRuleSet(names []string) (RuleSet, error) {
+	var rules RuleSet
+	for _, name := range names {
+		r, ok := opt.ParseRuleName(strings.TrimSpace(name))
+		if !ok {
+			return RuleSet{}, pgerror.Newf(pgcode.InvalidParameterValue, "unknown optimizer rule %q", name)
+		}
+		if essentialRules.Contains(int(r)) {
+			return RuleSet{}, pgerror.Newf(pgcode.InvalidParameterValue,
+				"optimizer rule %s cannot be disabled", r)
+		}
+		rules.Add(int(r))
+	}
+	return rules, nil
+}
+
+// EnableRuleStats causes the optimizer to count the number of times each rule is
+// matched and applied, the number of expressions it generates, and the time
+// spent applying it. The statistics can be retrieved via RuleStats.
+// Normalization rules are only counted if EnableRuleStats is called before the
+// expression is built. EnableRuleStats should be called after any calls to
+// NotifyOnMatchedRule and NotifyOnAppliedRule, which would otherwise replace
+// the callbacks that collect the statistics.
+func (o *Optimizer) EnableRuleStats() {
+	o.ruleStats = &ruleStatsCollector{}
+	o.ruleStats.init()
+
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			allowed := matchedRule == nil || matchedRule(ruleName)
+			o.ruleStats.recordMatched(ruleName, allowed)
+			return allowed
+		}
+	}
+	wrapApplied := func(appliedRule AppliedRuleFunc) AppliedRuleFunc {
+		return func(ruleName opt.RuleName, source, target opt.Expr) {
+			if appliedRule != nil {
+				appliedRule(ruleName, source, target)
+			}
+			o.ruleStats.recordApplied(ruleName, source, target)
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.appliedRule = wrapApplied(o.appliedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+	o.f.NotifyOnAppliedRule(wrapApplied(o.f.AppliedRule()))
+}
+
+// RuleStats returns the statistics collected since EnableRuleStats was called,
+// or nil if statistics are not enabled.
+func (o *Optimizer) RuleStats() RuleStats {
+	if o.ruleStats == nil {
+		return nil
+	}
+	return o.ruleStats.stats
+}
+
+// SetRuleCoverage causes the optimizer to record the rules that it matched and
+// applied in the given RuleCoverage once optimization is complete, so that the
+// rules exercised by many optimizations can be reported. It enables rule stats
+// if they are not already enabled, and has the same restrictions as
+// EnableRuleStats.
+func (o *Optimizer) SetRuleCoverage(coverage *RuleCoverage) {
+	if o.ruleStats == nil {
+		o.EnableRuleStats()
+	}
+	o.ruleCoverage = coverage
+}
+
+// SetExplorationBudgetFunc sets a callback function which is polled by the
+// optimizer before each group exploration. Once the number of explorations
+// reaches the budget returned by the callback, no further exploration is
+// performed, and the optimizer completes by costing the expressions already in
+// the memo. This allows an external controller (e.g. admission control) to
+// adjust the planning cost of a statement as it is being optimized. Since the
+// normalized expression is always present in the memo, a valid plan is
+// produced even if the budget is zero. If the callback returns a negative
+// budget, optimization is aborted with a BudgetExceededError. If budget is nil,
+// exploration is not bounded.
+func (o *Optimizer) SetExplorationBudgetFunc(budget ExplorationBudgetFunc) {
+	o.explorationBudget = budget
+}
+
+// SetExplorationScheduler sets the scheduler that determines the order in
+// which exploration rules are applied and groups are explored. See
+// ExplorationScheduler. Like DisableRules, it must be called after any calls
+// to NotifyOnMatchedRule, and before Optimize.
+func (o *Optimizer) SetExplorationScheduler(scheduler ExplorationScheduler) {
+	if o.schedule == nil {
+		matchedRule := o.matchedRule
+		o.matchedRule = func(ruleName opt.RuleName) bool {
+			// Disabled rules are never applied, so there is no need to defer
+			// them.
+			if o.disabledRules.Contains(int(ruleName)) || !o.schedule.allowed(ruleName) {
+				return false
+			}
+			return matchedRule == nil || matchedRule(ruleName)
+		}
+		o.schedule = &explorationSchedule{}
+	}
+	o.schedule.init(scheduler)
+}
+
+// SetBudget bounds the amount of time that Optimize spends exploring alternate
+// plans. Once the budget is exhausted, no further exploration is performed,
+// and the optimizer completes by costing the expressions that are already in
+// the memo, so that the lowest cost plan found so far is returned rather than
+// an error. Every group is still fully costed, so the result is always a
+// coherent plan. A budget of zero removes any existing bound. SetBudget must be
+// called before Optimize.
+func (o *Optimizer) SetBudget(budget time.Duration) {
+	o.timeBudget = budget
+}
+
+// SetMemoryAccount causes the optimizer to account for the memory used by the
+// memo and by its own temporary state in the given account, including the
+// memory used to build the normalized expression before Optimize is called.
+// The account is grown each time new groups or expressions are added to the
+// memo, and each time new state is allocated for a group. If the account
+// cannot be grown (e.g. because the limit of its monitor has been reached),
+// optimization is aborted with a BudgetExceededError. If degrade is true,
+// exploration is stopped instead, and the optimizer completes by costing the
+// expressions already in the memo, as if optimizations were disabled; memory
+// that is allocated after that point is bounded by the size of the memo, and is
+// not accounted for. The caller is responsible for closing the account once the
+// memo is no longer needed. SetMemoryAccount must be called before Optimize.
+func (o *Optimizer) SetMemoryAccount(acc *mon.BoundAccount, degrade bool) {
+	o.memAcc = acc
+	o.degradeOnMemoryLimit = degrade
+}
+
 // Memo returns the memo structure that the optimizer is using to optimize.
 func (o *Optimizer) Memo() *memo.Memo {
 	return o.mem
@@ -204,32 +1213,123 @@ func (o *Optimizer) Optimize() (_ opt.Expr, err error) {
 			// because the code does not update shared state and does not manipulate
 			// locks.
 			if ok, e := errorutil.ShouldCatch(r); ok {
-				err = e
+				err = o.categorizeError(e)
 			} else {
 				// Other panic objects can't be considered "safe" and thus are
 				// propagated as crashes that terminate the session.
 				panic(r)
 			}
 		}
+		if err != nil && o.disabledRulesSeed != 0 && o.evalCtx.TestingKnobs.LogDisabledOptimizerRules {
+			log.Infof(o.ctx(), "optimization failed with rules disabled by seed %d: %s",
+				o.disabledRulesSeed, formatRuleSet(o.disabledRules))
+		}
 	}()
 
 	if o.mem.IsOptimized() {
 		return nil, errors.AssertionFailedf("cannot optimize a memo multiple times")
 	}
 
+	// Select the planning profile before the time budget takes effect, since
+	// the profile may change it.
+	if o.planningProfiles != nil && !o.recosting {
+		o.applyPlanningProfile()
+	}
+
+	start := timeutil.Now()
+	o.metrics.NormalizeTime = start.Sub(o.initTime)
+	if o.timeBudget > 0 {
+		o.deadline = start.Add(o.timeBudget)
+	}
+	o.cancelChecker.Reset(o.ctx())
+	o.initialMemoExprs = o.mem.ExprCount()
+
+	// Open a span for each phase of the optimization, so that the phase that is
+	// slow can be identified in statement traces.
+	ctx, sp := tracing.ChildSpan(o.ctx(), optimizeSpanName)
+	sp.SetTag("memo-exprs-normalized", attribute.IntValue(o.initialMemoExprs))
+	defer func() {
+		o.finishSpan()
+		TagMemoSize(sp, o.mem)
+		sp.Finish()
+	}()
+	o.joinHint = makeJoinOrderHint(o.mem.Metadata(), o.leadingTables)
+	if o.heuristicThreshold > 0 && o.initialMemoExprs >= o.heuristicThreshold {
+		o.planHeuristically()
+	}
+	o.countAppliedRules()
+	o.injectRuleFailures()
+
+	// Account for the memory used to build the normalized expression.
+	o.accountMemory()
+
 	// Optimize the root expression according to the properties required of it.
-	o.optimizeRootWithProps()
+	// A memo that is being re-costed was already optimized in this way.
+	o.startSpan(ctx, costSpanName)
+	if o.shadow != nil {
+		o.initShadowCoster()
+	}
+	if !o.recosting {
+		o.requireOptimizerGoal()
+		o.requireNoFullScan()
+		o.optimizeRootWithProps()
+	}
 
 	// Now optimize the entire expression tree.
 	root := o.mem.RootExpr().(memo.RelExpr)
 	rootProps := o.mem.RootProps()
-	o.optimizeGroup(root, rootProps)
+	if o.costDistribution != nil {
+		o.costDistribution.root = o.ensureOptState(root, rootProps)
+	}
+	rootState := o.optimizeGroup(root, rootProps, memo.MaxCost)
+	if o.deepening != nil {
+		o.deepen(root, rootProps)
+	}
+	if o.tracer != nil {
+		o.tracer.finish()
+	}
+
+	// Reject the plan before it is executed if it is too expensive.
+	if err := o.checkCostCeiling(root, o.lookupOptState(root.FirstExpr(), rootProps).cost); err != nil {
+		return nil, err
+	}
+
+	// In test builds, verify the memo before the lowest cost tree is extracted
+	// from it. A re-costed memo already points to its lowest cost tree.
+	if buildutil.CrdbTestBuild && !o.recosting {
+		if err := o.VerifyMemo(); err != nil {
+			return nil, err
+		}
+	}
+
+	costed := timeutil.Now()
+	o.metrics.CostTime = costed.Sub(start) - o.metrics.ExploreTime
 
 	// Walk the tree from the root, updating child pointers so that the memo
 	// root points to the lowest cost tree by default (rather than the normalized
 	// tree by default.
+	o.startSpan(ctx, setLowestCostTreeSpanName)
 	root = o.setLowestCostTree(root, rootProps).(memo.RelExpr)
 	o.mem.SetRoot(root, rootProps)
+	o.metrics.SetLowestCostTreeTime = timeutil.Since(costed)
+	o.finishSpan()
+
+	if o.shadow != nil {
+		o.compareShadowCostModel(rootState, root, rootProps)
+	}
+
+	if o.retainGroupBests || isExplainMemo(root) {
+		o.recordGroupBests()
+	}
+
+	// Record which exploration rules generated the lowest cost tree.
+	if o.ruleOutcomes != nil {
+		o.ruleOutcomes.recordChosen(root)
+		o.ruleOutcomes.flush()
+	}
+	if o.ruleCoverage != nil {
+		o.ruleCoverage.Record(o.ruleStats.stats)
+	}
 
 	// Validate there are no dangling references.
 	if !root.Relational().OuterCols.Empty() {
@@ -243,17 +1343,159 @@ func (o *Optimizer) Optimize() (_ opt.Expr, err error) {
 	// have been applied.
 	o.f.CheckConstructorStackDepth()
 
+	if o.evalCtx.TestingKnobs.OptimizerValidatePlans {
+		if err := o.validatePlan(root); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := o.checkPlanGuardrail(root); err != nil {
+		return nil, err
+	}
+
+	if o.memoExprLimitReached {
+		o.addWarning(BudgetExceededWarning,
+			"exploration stopped after adding %d expressions (optimizer_max_memo_exprs)",
+			o.maxMemoExprs,
+		)
+	}
+	if !o.cappedRules.Empty() {
+		var names []string
+		o.cappedRules.ForEach(func(r int) {
+			names = append(names, opt.RuleName(r).String())
+		})
+		o.addWarning(BudgetExceededWarning,
+			"rules reached their application cap: %s", strings.Join(names, ", "),
+		)
+	}
+	if o.timeLimits != nil {
+		o.timeLimits.addWarnings(o)
+	}
+	if o.joinHint != nil && root.Cost() >= hugeCost {
+		o.addWarning(HintNotHonoredWarning,
+			"no plan joins the tables in the order required by optimizer_leading_tables (%s)",
+			strings.Join(o.leadingTables, ","),
+		)
+	}
+	o.checkStatistics()
+	o.sendWarnings()
+	o.report = o.makePlanningReport()
+
 	return root, nil
 }
 
+// countAppliedRules wraps the matched and applied rule callbacks so that the
+// telemetry counter of each exploration rule is incremented when the rule is
+// applied, i.e. when it is allowed by every matched rule callback and adds at
+// least one expression to the memo. Rules that match but do not generate any
+// expressions are not counted. It also records the rule that is being
+// applied, so that an internal error can be attributed to it. It is called by
+// Optimize, after any callbacks have been set, so that rules disabled by them
+// are not counted.
+func (o *Optimizer) countAppliedRules() {
+	matchedRule := o.matchedRule
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		if matchedRule != nil && !matchedRule(ruleName) {
+			return false
+		}
+		o.applyingRule = ruleName
+		return true
+	}
+	appliedRule := o.appliedRule
+	o.appliedRule = func(ruleName opt.RuleName, source, target opt.Expr) {
+		if appliedRule != nil {
+			appliedRule(ruleName, source, target)
+		}
+		if target == nil {
+			// The rule did not add any expressions to the memo.
+			return
+		}
+		if c := opt.RuleTelemetryCounters[ruleName]; c != nil {
+			telemetry.Inc(c)
+		}
+		o.metrics.RulesApplied++
+	}
+}
+
+// injectRuleFailures wraps the matched rule callback so that a rule named by
+// the OptimizerFailingRules testing knob fails with an internal error when it
+// is matched and allowed by every other callback. It does nothing if the knob
+// is not set.
+func (o *Optimizer) injectRuleFailures() {
+	if o.failingRules.Empty() {
+		return
+	}
+	matchedRule := o.matchedRule
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		if matchedRule != nil && !matchedRule(ruleName) {
+			return false
+		}
+		if o.failingRules.Contains(int(ruleName)) {
+			panic(errors.AssertionFailedf("injected failure in rule %s", ruleName))
+		}
+		return true
+	}
+}
+
+// PlannedHeuristically returns true if the last call to Optimize planned the
+// query heuristically, because the normalized memo was at least as large as
+// the optimizer_heuristic_planning_threshold session setting.
+func (o *Optimizer) PlannedHeuristically() bool {
+	return o.heuristic
+}
+
+// heuristicRules are the exploration rules that are applied when planning
+// heuristically. They generate the access paths and join orderings that have
+// the largest effect on the cost of a plan, and the number of expressions that
+// they add to the memo grows at most quadratically with the size of the query.
+var heuristicRules = util.MakeFastIntSet(
+	int(opt.ReorderJoins),
+	int(opt.GenerateIndexScans),
+	int(opt.GenerateConstrainedScans),
+	int(opt.GeneratePartialIndexScans),
+	int(opt.GenerateLimitedScans),
+	int(opt.GenerateLookupJoins),
+	int(opt.GenerateLookupJoinsWithFilter),
+	int(opt.GenerateTopK),
+)
+
+// planHeuristically switches the optimizer to a cheap planning mode for queries
+// that are too large to explore fully. Only heuristicRules are applied,
+// ReorderJoins adds a single greedy join ordering to the memo rather than all
+// orderings (see JoinOrderBuilder.ReorderGreedy), and enforcers are only
+// considered for expressions that cannot provide the required physical
+// properties themselves.
+func (o *Optimizer) planHeuristically() {
+	o.heuristic = true
+	var disabled RuleSet
+	for r := opt.RuleName(1); r < opt.NumRuleNames; r++ {
+		if r.IsExplore() && !heuristicRules.Contains(int(r)) {
+			disabled.Add(int(r))
+		}
+	}
+	o.DisableRules(disabled)
+}
+
+// MemoExprLimitReached returns true if exploration was stopped during the last
+// call to Optimize because the number of expressions that it added to the memo
+// reached the optimizer_max_memo_exprs session setting. The plan is still
+// valid, but may not be the lowest cost plan.
+func (o *Optimizer) MemoExprLimitReached() bool {
+	return o.memoExprLimitReached
+}
+
 // optimizeExpr calls either optimizeGroup or optimizeScalarExpr depending on
-// the type of the expression (relational or scalar).
+// the type of the expression (relational or scalar). The returned cost is
+// memo.MaxCost if no expression costs less than the given budget.
 func (o *Optimizer) optimizeExpr(
-	e opt.Expr, required *physical.Required,
+	e opt.Expr, required *physical.Required, budget memo.Cost,
 ) (cost memo.Cost, fullyOptimized bool) {
 	switch t := e.(type) {
 	case memo.RelExpr:
-		state := o.optimizeGroup(t, required)
+		state := o.optimizeGroup(t, required, budget)
+		if state.best == nil {
+			return memo.MaxCost, state.fullyOptimized
+		}
 		return state.cost, state.fullyOptimized
 
 	case memo.ScalarPropsExpr:
@@ -262,10 +1504,10 @@ func (o *Optimizer) optimizeExpr(
 		if !t.ScalarProps().HasSubquery {
 			return 0, true
 		}
-		return o.optimizeScalarExpr(t)
+		return o.optimizeScalarExpr(t, budget)
 
 	case opt.ScalarExpr:
-		return o.optimizeScalarExpr(t)
+		return o.optimizeScalarExpr(t, budget)
 
 	default:
 		panic(errors.AssertionFailedf("unhandled child: %+v", e))
@@ -430,21 +1672,111 @@ func (o *Optimizer) optimizeExpr(
 //              ├── variable: a.x [type=int]
 //              └── const: 1 [type=int]
 //
-func (o *Optimizer) optimizeGroup(grp memo.RelExpr, required *physical.Required) *groupState {
+// Groups are optimized one at a time, even when they are independent, such as
+// the two inputs of a join. Exploring a group adds expressions and groups to
+// the memo through the shared factory and interner, and lazily populates
+// logical properties such as interesting orderings, none of which are safe for
+// concurrent use. The coster, the rule outcome tracker and the exploration
+// budget are also shared. Optimizing groups in parallel would require all of
+// these to be made concurrency safe, not just stateTable.
+//
+// The search is a recursive descent rather than a stack of explicit tasks, as
+// in Cascades. Since the memo is acyclic, the depth of the recursion is bounded
+// by the depth of the expression tree plus the enforcers placed on top of each
+// group, not by the size of the memo, and Go stacks grow as needed. The
+// progress of the search is kept in groupState rather than on the stack: the
+// members that are fully optimized are skipped by later passes, so exploration
+// can be stopped by a budget without discarding the work that was done.
+//
+// When cost bound pruning is enabled (see SetCostBoundPruning), the group is
+// optimized within the given budget, which is the cost that a plan for the
+// group must not exceed in order to be of use to the parent expression. Members
+// whose children already cost more than the budget are abandoned without
+// optimizing their remaining children or costing the member itself, and the
+// best expression is nil if no member costs less than the budget. The state of
+// a group is shared by all of its parents, so the abandoned members are
+// optimized again if a parent later requires the group within a larger budget.
+// The budget is memo.MaxCost if there is none.
+func (o *Optimizer) optimizeGroup(
+	grp memo.RelExpr, required *physical.Required, budget memo.Cost,
+) *groupState {
 	// Always start with the first expression in the group.
 	grp = grp.FirstExpr()
+	state := o.ensureOptState(grp, required)
+	if state.speculative {
+		o.promoteOptState(state)
+	}
+	return o.optimizeGroupState(grp, state, required, budget)
+}
+
+// optimizeSpeculativeGroup is like optimizeGroup, but is called for the input
+// of an enforcer that only benefits from plans that provide the required
+// properties natively, such as the partial Sort enforcer (see
+// orderingProperty.enforce). If no parent expression has required the same
+// properties of the group, the state is speculative: its ordering enforcers
+// are deferred until a parent requires the properties (see promoteOptState).
+// This avoids optimizing chains of ever shorter ordering prefixes that no
+// parent consumes. The best expression of a speculative state is nil if no
+// member can provide the properties.
+func (o *Optimizer) optimizeSpeculativeGroup(
+	grp memo.RelExpr, required *physical.Required, budget memo.Cost,
+) *groupState {
+	grp = grp.FirstExpr()
+	state := o.lookupOptState(grp, required)
+	if state == nil {
+		state = o.ensureOptState(grp, required)
+		state.speculative = true
+		o.metrics.SpeculativeStates++
+	}
+	return o.optimizeGroupState(grp, state, required, budget)
+}
+
+// promoteOptState is called when a parent expression requires the properties
+// of a speculative state. Enforcers that were deferred while the state was
+// speculative may now provide the lowest cost expression, so the members of
+// the group are optimized again.
+func (o *Optimizer) promoteOptState(state *groupState) {
+	state.speculative = false
+	o.metrics.PromotedStates++
+	if state.deferredEnforcers {
+		state.deferredEnforcers = false
+		state.fullyOptimized = false
+		state.fullyOptimizedExprs = util.FastIntSet{}
+		state.budgetPrunedExprs = util.FastIntSet{}
+		state.tieBreakExpr = nil
+	}
+}
 
+// optimizeGroupState optimizes the group with respect to the required
+// properties, until the given state of the group is fully optimized within the
+// given budget.
+func (o *Optimizer) optimizeGroupState(
+	grp memo.RelExpr, state *groupState, required *physical.Required, budget memo.Cost,
+) *groupState {
 	// If this group is already fully optimized, then return the already prepared
 	// best expression (won't ever get better than this).
-	state := o.ensureOptState(grp, required)
+	if o.deepening != nil {
+		o.deepening.refresh(state)
+	}
+	state.setBudget(budget)
 	if state.fullyOptimized {
 		return state
 	}
+	parent := o.optimizing
+	o.optimizing = grp
 
 	// Iterate until the group has been fully optimized.
 	for {
+		o.checkCancellation()
+		o.metrics.Passes++
 		fullyOptimized := true
 
+		// Cost the members that can provide the required properties together,
+		// so that a BatchCoster can share work between them.
+		if batch, ok := o.coster.(BatchCoster); ok {
+			o.computeMemberCosts(batch, grp, state, required)
+		}
+
 		for i, member := 0, grp; member != nil; i, member = i+1, member.NextExpr() {
 			// If this group member has already been fully optimized for the given
 			// required properties, then skip it, since it won't get better.
@@ -453,12 +1785,17 @@ func (o *Optimizer) optimizeGroup(grp memo.RelExpr, required *physical.Required)
 			}
 
 			// Optimize the group member with respect to the required properties.
-			memberOptimized := o.optimizeGroupMember(state, member, required)
+			state.exceededBudget = false
+			memberOptimized := o.optimizeGroupMember(state, i, member, required)
 
 			// If any of the group members have not yet been fully optimized, then
-			// the group is not yet fully optimized.
+			// the group is not yet fully optimized. A member that was abandoned
+			// because it exceeded the budget is only done for the current budget.
 			if memberOptimized {
 				state.markMemberAsFullyOptimized(i)
+				if state.exceededBudget {
+					state.budgetPrunedExprs.Add(i)
+				}
 			} else {
 				fullyOptimized = false
 			}
@@ -466,8 +1803,28 @@ func (o *Optimizer) optimizeGroup(grp memo.RelExpr, required *physical.Required)
 
 		// Now try to generate new expressions that are logically equivalent to
 		// other expressions in this group.
-		if o.shouldExplore(required) && !o.explorer.exploreGroup(grp).fullyExplored {
-			fullyOptimized = false
+		if o.shouldExplore(required) && o.withinDeepeningPass(grp) &&
+			o.withinExplorationBudget(grp) {
+			if o.tracer != nil {
+				o.tracer.exploring = state
+			}
+			exploreStart := timeutil.Now()
+			if !o.exploreGroup(grp, required).fullyExplored {
+				fullyOptimized = false
+			}
+			o.metrics.ExploreTime += timeutil.Since(exploreStart)
+		}
+
+		if required.Parallelism != 0 {
+			// A group is not explored when it is optimized with a parallelism
+			// requirement (see shouldExplore). Instead, it is explored when it is
+			// optimized serially, which repeats this optimization until it is
+			// complete. Therefore, make a single pass over the current members, and
+			// only consider the group fully optimized once it cannot gain any more.
+			if fullyOptimized && !o.canExploreFurther(grp) {
+				state.fullyOptimized = true
+			}
+			break
 		}
 
 		if fullyOptimized {
@@ -476,6 +1833,24 @@ func (o *Optimizer) optimizeGroup(grp memo.RelExpr, required *physical.Required)
 		}
 	}
 
+	if state.fullyOptimized && o.events != nil {
+		o.events.groupOptimized(grp, state)
+	}
+	if state.fullyOptimized && o.groupOptimized != nil {
+		o.groupsOptimized++
+		o.groupOptimized(GroupState{
+			Group:          grp,
+			Required:       required,
+			Best:           state.best,
+			Cost:           state.cost,
+			FullyOptimized: true,
+		}, OptimizationProgress{
+			Optimized: o.groupsOptimized,
+			Remaining: o.stateTable.len() - o.groupsOptimized,
+		})
+	}
+
+	o.optimizing = parent
 	return state
 }
 
@@ -486,59 +1861,190 @@ func (o *Optimizer) optimizeGroup(grp memo.RelExpr, required *physical.Required)
 // can provide the required properties at a lower cost. The lowest cost
 // expression is saved to groupState.
 func (o *Optimizer) optimizeGroupMember(
-	state *groupState, member memo.RelExpr, required *physical.Required,
+	state *groupState, ord int, member memo.RelExpr, required *physical.Required,
 ) (fullyOptimized bool) {
+	// The properties derived for the member do not change between passes over
+	// the group, so they are cached in the group state.
+	props := state.memberProps(ord)
+
 	// Compute the cost for enforcers to provide the required properties. This
 	// may be lower than the expression providing the properties itself. For
 	// example, it might be better to sort the results of a hash join than to
 	// use the results of a merge join that are already sorted, but at the cost
 	// of requiring one of the merge join children to be sorted.
-	fullyOptimized = o.enforceProps(state, member, required)
+	//
+	// When planning heuristically, or when exploration is disabled, enforcers
+	// are only used if the expression cannot provide the properties.
+	fullyOptimized = true
+	onlyRequiredEnforcers := o.heuristic || o.explorationDisabled
+	if !onlyRequiredEnforcers || !props.canProvide(o.evalCtx, member, required) {
+		fullyOptimized = o.enforceProps(state, member, required)
+	}
 
 	// If the expression cannot provide the required properties, then don't
 	// continue. But what if the expression is able to provide a subset of the
 	// properties? That case is taken care of by enforceProps, which will
 	// recursively optimize the group with property subsets and then add
 	// enforcers to provide the remainder.
-	if CanProvidePhysicalProps(o.evalCtx, member, required) {
-		var cost memo.Cost
-		for i, n := 0, member.ChildCount(); i < n; i++ {
-			// Given required parent properties, get the properties required from
-			// the nth child.
-			childRequired := BuildChildPhysicalProps(o.mem, member, i, required)
-
-			// Optimize the child with respect to those properties.
-			childCost, childOptimized := o.optimizeExpr(member.Child(i), childRequired)
-
-			// Accumulate cost of children.
-			cost += childCost
+	if props.canProvide(o.evalCtx, member, required) {
+		// Prune large full scans if they are forbidden. A full scan is only
+		// costed if the group has no other plan yet, so that the group always
+		// has a plan, but any alternative replaces it.
+		if required.NoFullScan && o.isLargeFullScan(member) {
+			if o.shadow != nil && state.shadowBest == nil {
+				o.ratchetShadowCost(state, member, hugeCost)
+			}
+			if state.best == nil {
+				o.ratchetCost(state, member, hugeCost)
+			}
+			return fullyOptimized
+		}
+
+		// If exploration is bounded, the scheduler can choose which children to
+		// optimize, and therefore explore, first.
+		var order []int
+		if o.schedule != nil && o.explorationBounded() {
+			order = o.schedule.childOrder(member)
+		}
+
+		var cost, shadowCost memo.Cost
+		for j, n := 0, member.ChildCount(); j < n; j++ {
+			i := j
+			if order != nil {
+				i = order[j]
+			}
+
+			// Given required parent properties, get the properties required from
+			// the nth child.
+			childRequired := props.childProps(o.mem, member, i, required)
+
+			// Optimize the child with respect to those properties, within the
+			// budget that remains once the children optimized so far are paid for.
+			// The right input of an apply join is re-planned for each left row, so
+			// its cost is not bounded.
+			childBudget := memo.MaxCost
+			if !isApplyJoinRightInput(o.mem, member, i) {
+				childBudget = o.remainingBudget(state, cost)
+			}
+			childCost, childOptimized := o.optimizeExpr(member.Child(i), childRequired, childBudget)
+
+			// Accumulate cost of children. The right input of an apply join is
+			// costed by the coster, since it is re-planned for each left row.
+			if !isApplyJoinRightInput(o.mem, member, i) {
+				cost += childCost
+				if o.shadow != nil {
+					shadowCost += o.shadowChildCost(member.Child(i), childRequired, childCost)
+				}
+			}
 
 			// If any child expression is not fully optimized, then the parent
 			// expression is also not fully optimized.
 			if !childOptimized {
 				fullyOptimized = false
 			}
+
+			// Abandon the member if the children that have been optimized so far
+			// already cost more than the best expression, than the budget, or than
+			// the cost ceiling (see SetCostCeiling). This is only done while every
+			// child has been fully optimized, since a child that is not might still
+			// get cheaper on a later pass. Otherwise, a member that exceeds the
+			// budget is not costed in this pass, but is optimized again in the
+			// next one.
+			if fullyOptimized && (o.exceedsBudget(state, cost) ||
+				o.exceedsCostBound(state, cost) || o.exceedsCostCeiling(state, cost)) {
+				return true
+			}
+			if !fullyOptimized && o.exceedsBudget(state, cost) {
+				return false
+			}
 		}
 
 		// Check whether this is the new lowest cost expression.
-		cost += o.coster.ComputeCost(member, required)
+		memberCost := props.memberCost(o.coster, member, required)
+		if buildutil.CrdbTestBuild {
+			checkComputedCost(member, cost, memberCost, false /* enforcer */)
+		}
+		cost += memberCost
+		if o.shadow != nil {
+			shadowCost += o.shadow.coster.ComputeCost(member, required)
+		}
+		if o.joinHint != nil && !o.joinHint.allowsExpr(member) {
+			// Avoid joins that violate the join order hint.
+			cost += hugeCost
+			shadowCost += hugeCost
+		}
+		if o.baseline != nil && !o.baseline.allowsExpr(member) {
+			// Avoid expressions that are not part of the pinned plan.
+			cost += hugeCost
+			shadowCost += hugeCost
+		}
 		o.ratchetCost(state, member, cost)
+		if o.shadow != nil {
+			o.ratchetShadowCost(state, member, shadowCost)
+		}
 	}
 
 	return fullyOptimized
 }
 
+// computeMemberCosts computes the cost of each member of the group that can
+// provide the required properties, and that has not yet been costed for the
+// given state, with a single call to the given coster's ComputeCosts. The cost
+// of a member does not depend on the plans chosen for its children, so it is
+// cached along with the other properties derived for the member, and
+// optimizeGroupMember uses the cached cost on each pass. Members that are
+// added to the group by exploration are costed on the next pass.
+func (o *Optimizer) computeMemberCosts(
+	batch BatchCoster, grp memo.RelExpr, state *groupState, required *physical.Required,
+) {
+	candidates, ords := o.costBatch[:0], o.costBatchOrds[:0]
+	for i, member := 0, grp; member != nil; i, member = i+1, member.NextExpr() {
+		if state.isMemberFullyOptimized(i) {
+			continue
+		}
+		props := state.memberProps(i)
+		if props.costed || !props.canProvide(o.evalCtx, member, required) {
+			continue
+		}
+		if required.NoFullScan && o.isLargeFullScan(member) {
+			// Large full scans are not costed (see optimizeGroupMember).
+			continue
+		}
+		candidates = append(candidates, member)
+		ords = append(ords, i)
+	}
+	o.costBatch, o.costBatchOrds = candidates, ords
+	if len(candidates) == 0 {
+		return
+	}
+
+	if cap(o.costBatchCosts) < len(candidates) {
+		o.costBatchCosts = make([]memo.Cost, len(candidates))
+	}
+	costs := o.costBatchCosts[:len(candidates)]
+	batch.ComputeCosts(candidates, required, costs)
+	for i, ord := range ords {
+		props := state.memberProps(ord)
+		props.cost, props.costed = costs[i], true
+	}
+}
+
 // optimizeScalarExpr recursively optimizes the children of a scalar expression.
 // This is only necessary when the scalar expression contains a subquery, since
 // scalar expressions otherwise always have zero cost and only one possible
-// plan.
+// plan. The children are optimized within the given budget, less the cost of
+// the children optimized before them.
 func (o *Optimizer) optimizeScalarExpr(
-	scalar opt.ScalarExpr,
+	scalar opt.ScalarExpr, budget memo.Cost,
 ) (cost memo.Cost, fullyOptimized bool) {
 	fullyOptimized = true
 	for i, n := 0, scalar.ChildCount(); i < n; i++ {
 		childProps := BuildChildPhysicalPropsScalar(o.mem, scalar, i)
-		childCost, childOptimized := o.optimizeExpr(scalar.Child(i), childProps)
+		childBudget := budget
+		if budget < memo.MaxCost {
+			childBudget = budget - cost
+		}
+		childCost, childOptimized := o.optimizeExpr(scalar.Child(i), childProps, childBudget)
 
 		// Accumulate cost of children.
 		cost += childCost
@@ -569,68 +2075,84 @@ func (o *Optimizer) optimizeScalarExpr(
 // off, and so on. Afterwards, the group will have computed a lowest cost
 // expression for each sublist of physical properties, from all down to none.
 //
-// Right now, the only physical property that can be provided by an enforcer is
-// physical.Required.Ordering. When adding another enforceable property, also
-// update shouldExplore, which should return true if enforceProps will explore
-// the group by recursively calling optimizeGroup (by way of optimizeEnforcer).
+// The physical properties that can be provided by an enforcer are listed in
+// enforceableProperties, which determines the order in which they are
+// stripped. The Streaming property cannot be enforced; instead, the coster
+// penalizes the expressions that buffer rows, including Sort enforcers. See
+// enforceableProperty for how to add another enforceable property.
 func (o *Optimizer) enforceProps(
 	state *groupState, member memo.RelExpr, required *physical.Required,
 ) (fullyOptimized bool) {
 	// Strip off one property that can be enforced. Other properties will be
 	// stripped by recursively optimizing the group with successively fewer
-	// properties. The properties are stripped off in a heuristic order, from
-	// least likely to be expensive to enforce to most likely.
-	if !required.Distribution.Any() {
-		enforcer := &memo.DistributeExpr{Input: member}
-		memberProps := BuildChildPhysicalProps(o.mem, enforcer, 0, required)
-		return o.optimizeEnforcer(state, enforcer, required, member, memberProps)
-	}
-
-	if !required.Ordering.Any() {
-		// Try Sort enforcer that requires no ordering from its input.
-		enforcer := &memo.SortExpr{Input: member}
-		memberProps := BuildChildPhysicalProps(o.mem, enforcer, 0, required)
-		fullyOptimized = o.optimizeEnforcer(state, enforcer, required, member, memberProps)
-
-		// Try Sort enforcer that requires a partial ordering from its input. Choose
-		// the interesting ordering that forms the longest common prefix with the
-		// required ordering. We do not need to add the enforcer if the required
-		// ordering is implied by the input ordering (in which case the returned
-		// prefix is nil).
-		interestingOrderings := ordering.DeriveInterestingOrderings(member)
-		longestCommonPrefix := interestingOrderings.LongestCommonPrefix(&required.Ordering)
-		if longestCommonPrefix != nil {
-			enforcer := &memo.SortExpr{Input: state.best}
-			enforcer.InputOrdering = *longestCommonPrefix
-			memberProps := BuildChildPhysicalProps(o.mem, enforcer, 0, required)
-			if o.optimizeEnforcer(state, enforcer, required, member, memberProps) {
-				fullyOptimized = true
-			}
-		}
-
-		return fullyOptimized
+	// properties.
+	if p := o.enforcerFor(required); p != nil {
+		return p.enforce(o, state, member, required)
 	}
-
 	return true
 }
 
-// optimizeEnforcer optimizes and costs the enforcer.
+// optimizeEnforcer optimizes and costs the enforcer. If speculative is true,
+// or the state of the enforcer is itself speculative, the member's group is
+// optimized with memberProps speculatively (see optimizeSpeculativeGroup).
 func (o *Optimizer) optimizeEnforcer(
 	state *groupState,
 	enforcer memo.RelExpr,
 	enforcerProps *physical.Required,
 	member memo.RelExpr,
 	memberProps *physical.Required,
+	speculative bool,
 ) (fullyOptimized bool) {
 	// Recursively optimize the member group with respect to a subset of the
-	// enforcer properties.
-	innerState := o.optimizeGroup(member, memberProps)
+	// enforcer properties. The enforcers of a speculative state only consume
+	// speculative states themselves.
+	o.metrics.Enforcers++
+	var innerState *groupState
+	budget := o.remainingBudget(state, 0 /* cost */)
+	if speculative || state.speculative {
+		innerState = o.optimizeSpeculativeGroup(member, memberProps, budget)
+	} else {
+		innerState = o.optimizeGroup(member, memberProps, budget)
+	}
 	fullyOptimized = innerState.fullyOptimized
 
+	// A speculative state has no best expression if no member can provide its
+	// properties, and a state optimized within a budget has none if no member
+	// costs less than the budget. In either case the enforcer cannot be used.
+	if innerState.best == nil {
+		if fullyOptimized && !innerState.budgetPrunedExprs.Empty() {
+			o.exceedsBudget(state, memo.MaxCost)
+		}
+		return fullyOptimized
+	}
+
+	// The enforcer cannot be the new lowest cost expression if its input
+	// already costs more, cannot be of use to the parent if its input costs
+	// more than the budget, and cannot be part of a plan that is executed if
+	// its input costs more than the cost ceiling.
+	if fullyOptimized && (o.exceedsBudget(state, innerState.cost) ||
+		o.exceedsCostBound(state, innerState.cost) || o.exceedsCostCeiling(state, innerState.cost)) {
+		return true
+	}
+
 	// Check whether this is the new lowest cost expression with the enforcer
 	// added.
-	cost := innerState.cost + o.coster.ComputeCost(enforcer, enforcerProps)
+	enforcerCost := o.coster.ComputeCost(enforcer, enforcerProps)
+	if buildutil.CrdbTestBuild {
+		checkComputedCost(enforcer, innerState.cost, enforcerCost, true /* enforcer */)
+	}
+	cost := innerState.cost + enforcerCost
+	if o.events != nil {
+		o.events.enforcerAdded(enforcer, member, enforcerProps, memberProps, cost)
+	}
+	if o.tracer != nil {
+		o.tracer.recordEnforcer(state, member, enforcer)
+	}
 	o.ratchetCost(state, enforcer, cost)
+	if o.shadow != nil && innerState.shadowBest != nil {
+		shadowCost := innerState.shadowCost + o.shadow.coster.ComputeCost(enforcer, enforcerProps)
+		o.ratchetShadowCost(state, enforcer, shadowCost)
+	}
 
 	// Enforcer expression is fully optimized if its input expression is fully
 	// optimized.
@@ -640,7 +2162,154 @@ func (o *Optimizer) optimizeEnforcer(
 // shouldExplore ensures that exploration is only triggered for optimizeGroup
 // calls that will not recurse via a call from enforceProps.
 func (o *Optimizer) shouldExplore(required *physical.Required) bool {
-	return required.Ordering.Any() && required.Distribution.Any()
+	if o.recosting || o.explorationDisabled {
+		return false
+	}
+	for _, p := range enforceableProperties {
+		if p.preventsExploration(required) {
+			return false
+		}
+	}
+	return true
+}
+
+// withinDeepeningPass returns true if the given group can be explored in the
+// current pass of iterative deepening, or if iterative deepening is not in
+// use. See SetIterativeDeepening.
+func (o *Optimizer) withinDeepeningPass(grp memo.RelExpr) bool {
+	if o.deepening == nil {
+		return true
+	}
+	state := o.explorer.ensureExploreState(grp)
+	if !o.deepening.canExplore(grp, state) {
+		return false
+	}
+	state.deepeningPass = o.deepening.pass
+	return true
+}
+
+// canExploreFurther returns true if the given group may be explored again
+// before optimization completes, or before the current pass of iterative
+// deepening completes.
+func (o *Optimizer) canExploreFurther(grp memo.RelExpr) bool {
+	state := o.explorer.ensureExploreState(grp)
+	if state.fullyExplored || o.explorationStopped {
+		return false
+	}
+	return o.deepening == nil || o.deepening.canExplore(grp, state)
+}
+
+// explorationBounded returns true if a budget set via SetExplorationBudgetFunc
+// or SetBudget may stop exploration before the memo is fully explored.
+func (o *Optimizer) explorationBounded() bool {
+	return o.explorationBudget != nil || !o.deadline.IsZero()
+}
+
+// withinExplorationBudget returns true if another exploration of the given
+// group is allowed by the budgets set via SetExplorationBudgetFunc and
+// SetBudget, and counts the exploration if so.
+func (o *Optimizer) withinExplorationBudget(grp memo.RelExpr) bool {
+	if o.memoryExhausted || o.memoExprLimitExceeded() {
+		o.explorationStopped = true
+		return false
+	}
+	if !o.deadline.IsZero() && timeutil.Now().After(o.deadline) {
+		o.explorationStopped = true
+		o.addWarning(BudgetExceededWarning, "exploration stopped after exceeding its time budget")
+		return false
+	}
+	if o.explorationBudget != nil {
+		budget := o.explorationBudget(o.explorations)
+		if budget < 0 {
+			panic(NewOptimizationError(BudgetExceededError, grp.Op(), opt.InvalidRuleName,
+				pgerror.Newf(pgcode.ProgramLimitExceeded,
+					"query planning aborted after %d explorations", o.explorations)))
+		}
+		if o.explorations >= budget {
+			o.explorationStopped = true
+			o.addWarning(BudgetExceededWarning,
+				"exploration stopped after %d explorations", o.explorations)
+			return false
+		}
+	}
+	o.explorations++
+	return true
+}
+
+// memoExprLimitExceeded returns true if exploration has added the maximum
+// number of expressions allowed by maxMemoExprs to the memo, and records that
+// the limit was reached if so.
+func (o *Optimizer) memoExprLimitExceeded() bool {
+	if o.maxMemoExprs > 0 && o.mem.ExprCount()-o.initialMemoExprs >= o.maxMemoExprs {
+		o.memoExprLimitReached = true
+	}
+	return o.memoExprLimitReached
+}
+
+// checkCancellation panics with a cancellation error if the statement being
+// optimized has been canceled. The context is only consulted periodically, so
+// it is cheap enough to call in the inner optimization loops.
+func (o *Optimizer) checkCancellation() {
+	if err := o.cancelChecker.Check(); err != nil {
+		panic(err)
+	}
+}
+
+// groupStateMemSize is the approximate number of bytes used by each groupState
+// allocated by the optimizer, including its entry in the stateTable.
+const groupStateMemSize = int64(unsafe.Sizeof(groupState{}) +
+	unsafe.Sizeof(groupStateKey{}) + unsafe.Sizeof(&groupState{}))
+
+// accountMemory grows the account set via SetMemoryAccount by the memory that
+// has been used by the memo and the optimizer's temporary state since the last
+// call. If the account cannot be grown, it either stops further exploration or
+// panics with a BudgetExceededError, depending on the arguments that were
+// passed to SetMemoryAccount.
+func (o *Optimizer) accountMemory() {
+	if o.memAcc == nil || o.memoryExhausted {
+		return
+	}
+	used := o.mem.MemoryEstimate() + int64(o.stateTable.len())*groupStateMemSize
+	if used <= o.memAccounted {
+		return
+	}
+	if err := o.memAcc.Grow(o.ctx(), used-o.memAccounted); err != nil {
+		if o.degradeOnMemoryLimit {
+			o.memoryExhausted = true
+			o.addWarning(BudgetExceededWarning, "exploration stopped after reaching the memory limit")
+			return
+		}
+		op := opt.UnknownOp
+		if o.optimizing != nil {
+			op = o.optimizing.Op()
+		}
+		panic(NewOptimizationError(BudgetExceededError, op, opt.InvalidRuleName,
+			errors.Wrap(err, "query planning")))
+	}
+	o.memAccounted = used
+}
+
+// ctx returns the context of the statement being optimized.
+func (o *Optimizer) ctx() context.Context {
+	if o.evalCtx.Context == nil {
+		return context.Background()
+	}
+	return o.evalCtx.Context
+}
+
+// categorizeError wraps an error that was raised during optimization in an
+// InternalError if it is an assertion failure that has not already been
+// categorized, annotating it with the group that was being optimized. Other
+// errors are returned unchanged.
+func (o *Optimizer) categorizeError(err error) error {
+	if _, ok := GetOptimizationError(err); ok || !errors.HasAssertionFailure(err) {
+		return err
+	}
+	op := opt.UnknownOp
+	if o.optimizing != nil {
+		op = o.optimizing.Op()
+	}
+	return NewOptimizationError(InternalError, op, o.applyingRule, err)
 }
 
 // setLowestCostTree traverses the memo and recursively updates child pointers
@@ -680,6 +2349,10 @@ func (o *Optimizer) setLowestCostTree(parent opt.Expr, parentProps *physical.Req
 	switch t := parent.(type) {
 	case memo.RelExpr:
 		state := o.lookupOptState(t.FirstExpr(), parentProps)
+		if state == nil || state.best == nil {
+			panic(NewOptimizationError(UnsatisfiablePropsError, t.Op(), opt.InvalidRuleName,
+				errors.AssertionFailedf("no plan provides required properties %s", parentProps)))
+		}
 		relParent, relCost = state.best, state.cost
 		parent = relParent
 
@@ -695,6 +2368,8 @@ func (o *Optimizer) setLowestCostTree(parent opt.Expr, parentProps *physical.Req
 	// cost alternative.
 	var mutable opt.MutableExpr
 	var childProps *physical.Required
+	var childCost memo.Cost
+	var childBreakdown memo.CostBreakdown
 	for i, n := 0, parent.ChildCount(); i < n; i++ {
 		before := parent.Child(i)
 
@@ -711,6 +2386,11 @@ func (o *Optimizer) setLowestCostTree(parent opt.Expr, parentProps *physical.Req
 			}
 			mutable.SetChild(i, after)
 		}
+		if relParent != nil && !isApplyJoinRightInput(o.mem, relParent, i) {
+			cost, breakdown := o.treeCost(after)
+			childCost += cost
+			childBreakdown.Add(breakdown)
+		}
 	}
 
 	if relParent != nil {
@@ -719,26 +2399,280 @@ func (o *Optimizer) setLowestCostTree(parent opt.Expr, parentProps *physical.Req
 		// it must run after the recursive calls on the children.
 		provided.Ordering = ordering.BuildProvided(relParent, &parentProps.Ordering)
 		provided.Distribution = distribution.BuildProvided(o.evalCtx, relParent, &parentProps.Distribution)
-		o.mem.SetBestProps(relParent, parentProps, &provided, relCost)
+		selfBreakdown := o.coster.ComputeCostBreakdown(relParent, parentProps)
+		breakdown := selfBreakdown
+		breakdown.Add(childBreakdown)
+		o.mem.SetBestProps(relParent, parentProps, &provided, relCost, breakdown)
+		o.mem.SetSelfCost(relParent, relCost-childCost, selfBreakdown)
 	}
 
 	return parent
 }
 
+// treeCost returns the cost of the given expression tree, which has already
+// been passed to setLowestCostTree, along with its breakdown by resource. The
+// cost of a scalar expression is the sum of the costs of any subqueries that
+// it contains.
+func (o *Optimizer) treeCost(e opt.Expr) (memo.Cost, memo.CostBreakdown) {
+	switch t := e.(type) {
+	case memo.RelExpr:
+		return t.Cost(), o.mem.CostBreakdown(t)
+
+	case memo.ScalarPropsExpr:
+		if !t.ScalarProps().HasSubquery {
+			return 0, memo.CostBreakdown{}
+		}
+	}
+
+	var cost memo.Cost
+	var breakdown memo.CostBreakdown
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		childCost, childBreakdown := o.treeCost(e.Child(i))
+		cost += childCost
+		breakdown.Add(childBreakdown)
+	}
+	return cost, breakdown
+}
+
 // ratchetCost computes the cost of the candidate expression, and then checks
 // whether it's lower than the cost of the existing best expression in the
 // group. If so, then the candidate becomes the new lowest cost expression.
+//
+// If a previous plan was passed to SetPreviousPlan, a candidate that
+// reproduces part of it becomes the lowest cost expression if its cost is
+// within the stability tolerance of the existing best expression's cost, and a
+// candidate that does not only replaces such an expression if it is cheaper by
+// more than the tolerance.
+//
+// If the optimizer is risk-averse (see SetRiskAversion), the candidate also
+// becomes the lowest cost expression if its cost is within the risk aversion
+// of the existing best expression's cost and its worst-case cost is lower, and
+// it does not if the reverse is true.
+//
+// Otherwise, if near-tie randomization is enabled (see
+// SetNearTieRandomization), a candidate with a lower cost than any candidate
+// seen so far always becomes the lowest cost expression, and a candidate whose
+// cost is within epsilon of that minimum becomes the lowest cost expression
+// with a probability that makes each of the tied candidates equally likely to
+// be chosen (see chooseNearTie).
+//
+// Otherwise, if deterministic tie-breaking is enabled (see
+// memo.Memo.DeterministicTieBreaking) and the candidate's cost is equal to the
+// cost of the existing best expression, the tie is broken deterministically;
+// see breakTie.
 func (o *Optimizer) ratchetCost(state *groupState, candidate memo.RelExpr, cost memo.Cost) {
-	if state.best == nil || cost.Less(state.cost) {
+	if o.topK > 0 {
+		o.recordTopK(state, candidate, cost)
+	}
+	if o.tracer != nil {
+		o.tracer.recordCost(state, candidate, cost)
+	}
+	if o.costDistribution != nil {
+		o.costDistribution.recordCost(state, candidate, cost)
+	}
+	var high memo.Cost
+	if o.riskAversion > 0 {
+		high = o.worstCaseCost(state, candidate, cost)
+	}
+	var previous bool
+	if o.previousPlan != nil {
+		previous = o.reproducesPreviousPlan(state, candidate)
+	}
+	if state.best == nil || o.isLowerCost(candidate, cost, high, previous, state) {
+		previousCost := state.cost
 		state.best = candidate
 		state.cost = cost
+		state.high = high
+		state.previous = previous
+		if o.events != nil {
+			o.events.bestChanged(o.optimizing, state, previousCost)
+		}
+	}
+}
+
+// chooseNearTie returns true if the given candidate, with the given estimated
+// cost, should replace the best expression of the given group state when
+// near-tie randomization is enabled. The candidates are compared with the
+// lowest cost of any candidate seen for the state, rather than with the cost
+// of the best expression, which may itself have been chosen randomly. A
+// candidate with a lower cost is always chosen, and starts a new set of ties.
+// Each candidate within epsilon of the lowest cost is counted once, even if
+// it is costed again on a later pass over the group, and replaces the best
+// expression with probability 1/n, where n is the number of tied candidates
+// so far (reservoir sampling).
+func (o *Optimizer) chooseNearTie(
+	candidate memo.RelExpr, cost memo.Cost, state *groupState,
+) bool {
+	if state.nearTies == nil {
+		state.minCost = state.cost
+		state.nearTieBest = o.nearTieKeyOf(state.best, state.required)
+		state.nearTies = map[nearTieKey]struct{}{state.nearTieBest: {}}
+	}
+	key := o.nearTieKeyOf(candidate, state.required)
+	if cost.Less(state.minCost) {
+		state.minCost = cost
+		state.nearTieBest = key
+		state.nearTies = map[nearTieKey]struct{}{key: {}}
+		return true
+	}
+	if float64(cost-state.minCost) > o.nearTieEpsilon*float64(state.minCost) {
+		return false
 	}
+	if _, ok := state.nearTies[key]; ok {
+		// The candidate was already counted on an earlier pass. Its cost is only
+		// updated if it is the best expression.
+		return key == state.nearTieBest
+	}
+	state.nearTies[key] = struct{}{}
+	if o.nearTieRng.Intn(len(state.nearTies)) != 0 {
+		return false
+	}
+	if state.minCost.Less(cost) {
+		o.nearTieChoices++
+	}
+	state.nearTieBest = key
+	return true
+}
+
+// canPruneByCost returns true if cost bound pruning is enabled (see
+// SetCostBoundPruning), and the optimizer never retains a candidate with a
+// higher estimated cost than the best expression of its group.
+func (o *Optimizer) canPruneByCost() bool {
+	return o.costBoundPruning && o.topK == 0 && o.riskAversion == 0 && o.nearTieEpsilon == 0 &&
+		o.shadow == nil && o.previousPlan == nil
+}
+
+// exceedsCostBound returns true if cost bound pruning is enabled and the given
+// partial cost of a candidate is already higher than the cost of the best
+// expression of the given group state. Since the best expression only gets
+// cheaper, the candidate can never become the best expression.
+func (o *Optimizer) exceedsCostBound(state *groupState, cost memo.Cost) bool {
+	return o.canPruneByCost() && state.best != nil && state.cost.Less(cost)
+}
+
+// exceedsBudget returns true if the given partial cost of a candidate is
+// already higher than the budget within which the given group state is being
+// optimized (see optimizeGroup). If the budget is lower than the cost of the
+// best expression, the children of the candidate were optimized within it
+// (see remainingBudget), and the candidate may still become the best
+// expression if the state is required within a larger budget, so the state
+// records that it was abandoned for the current budget only.
+func (o *Optimizer) exceedsBudget(state *groupState, cost memo.Cost) bool {
+	if state.budget >= memo.MaxCost || !state.budget.Less(cost) {
+		return false
+	}
+	if state.best == nil || state.budget < state.cost {
+		state.exceededBudget = true
+	}
+	return true
+}
+
+// remainingBudget returns the budget within which a child of a member of the
+// given group state is optimized, given the cost of the children of the member
+// that were already optimized. A plan for the child is only of use if the
+// member costs less than both the budget of the state and its best expression.
+func (o *Optimizer) remainingBudget(state *groupState, cost memo.Cost) memo.Cost {
+	if !o.canPruneByCost() {
+		return memo.MaxCost
+	}
+	bound := state.budget
+	if state.best != nil && state.cost < bound {
+		bound = state.cost
+	}
+	if bound >= memo.MaxCost {
+		return memo.MaxCost
+	}
+	return bound - cost
+}
+
+// isLowerCost returns true if the given candidate, with the given estimated
+// and worst-case costs, should replace the best expression of the given group
+// state. previous is true if the candidate reproduces part of the plan passed
+// to SetPreviousPlan.
+func (o *Optimizer) isLowerCost(
+	candidate memo.RelExpr, cost, high memo.Cost, previous bool, state *groupState,
+) bool {
+	if o.previousPlan != nil && previous != state.previous && cost < hugeCost && state.cost < hugeCost {
+		if previous {
+			return float64(cost) <= float64(state.cost)*(1+o.stabilityTolerance)
+		}
+		return float64(cost)*(1+o.stabilityTolerance) < float64(state.cost)
+	}
+	if o.riskAversion > 0 && cost < hugeCost && state.cost < hugeCost {
+		diff := math.Abs(float64(cost - state.cost))
+		if diff <= o.riskAversion*math.Min(float64(cost), float64(state.cost)) &&
+			(high.Less(state.high) || state.high.Less(high)) {
+			return high.Less(state.high)
+		}
+	}
+	if o.nearTieEpsilon > 0 && cost < hugeCost && state.cost < hugeCost {
+		return o.chooseNearTie(candidate, cost, state)
+	}
+	if cost.Less(state.cost) {
+		return true
+	}
+	if o.mem.DeterministicTieBreaking() && candidate != state.best &&
+		!state.cost.Less(cost) && cost < hugeCost {
+		return o.breakTie(state, candidate)
+	}
+	return false
+}
+
+// worstCaseCost returns the worst-case cost of the given candidate for the
+// given group state, which has the given estimated cost. It is the sum of the
+// worst-case cost of the candidate itself, computed by the coster, and the
+// worst-case costs of the best expressions of its relational children.
+func (o *Optimizer) worstCaseCost(
+	state *groupState, candidate memo.RelExpr, cost memo.Cost,
+) memo.Cost {
+	if cost >= hugeCost {
+		return cost
+	}
+	ownCost := cost
+	var childSpread memo.Cost
+	for i, n := 0, candidate.ChildCount(); i < n; i++ {
+		child, ok := candidate.Child(i).(memo.RelExpr)
+		if !ok {
+			continue
+		}
+		childProps := BuildChildPhysicalProps(o.mem, candidate, i, state.required)
+		childState := o.lookupOptState(child.FirstExpr(), childProps)
+		if childState == nil || childState.best == nil {
+			continue
+		}
+		ownCost -= childState.cost
+		childSpread += childState.high - childState.cost
+	}
+	interval := o.coster.ComputeCostInterval(candidate, state.required, ownCost)
+	return cost + childSpread + (interval.High - interval.Estimate)
+}
+
+// reproducesPreviousPlan returns true if the given candidate for the given
+// group state matches a node of the plan passed to SetPreviousPlan, and the
+// best expressions of its relational children reproduce the corresponding
+// parts of that plan.
+func (o *Optimizer) reproducesPreviousPlan(state *groupState, candidate memo.RelExpr) bool {
+	if !o.previousPlan.allowsExpr(candidate) {
+		return false
+	}
+	for i, n := 0, candidate.ChildCount(); i < n; i++ {
+		child, ok := candidate.Child(i).(memo.RelExpr)
+		if !ok {
+			continue
+		}
+		childProps := BuildChildPhysicalProps(o.mem, candidate, i, state.required)
+		childState := o.lookupOptState(child.FirstExpr(), childProps)
+		if childState == nil || !childState.previous {
+			return false
+		}
+	}
+	return true
 }
 
 // lookupOptState looks up the state associated with the given group and
 // properties. If no state exists yet, then lookupOptState returns nil.
 func (o *Optimizer) lookupOptState(grp memo.RelExpr, required *physical.Required) *groupState {
-	return o.stateMap[groupStateKey{group: grp, required: required}]
+	return o.stateTable.lookup(groupStateKey{group: grp, required: required})
 }
 
 // ensureOptState looks up the state associated with the given group and
@@ -746,15 +2680,159 @@ func (o *Optimizer) lookupOptState(grp memo.RelExpr, required *physical.Required
 // state and returns it.
 func (o *Optimizer) ensureOptState(grp memo.RelExpr, required *physical.Required) *groupState {
 	key := groupStateKey{group: grp, required: required}
-	state, ok := o.stateMap[key]
-	if !ok {
-		state = o.stateAlloc.allocate()
+	state := o.stateTable.lookup(key)
+	if state == nil {
+		if buildutil.CrdbTestBuild && !o.mem.IsOptimized() && !o.mem.IsInternedPhysicalProps(required) {
+			panic(errors.AssertionFailedf("physical properties %s are not interned", required))
+		}
+		state = o.arena.allocateState()
 		state.required = required
-		o.stateMap[key] = state
+		o.stateTable.insert(key, state)
+		o.accountMemory()
 	}
 	return state
 }
 
+// GroupState describes the outcome of optimizing a memo group with respect to
+// a set of required physical properties. It is passed to the callback of
+// ForEachGroupState.
+type GroupState struct {
+	// Group is the first expression in the memo group.
+	Group memo.RelExpr
+
+	// Required is the set of physical properties that were required of the
+	// group.
+	Required *physical.Required
+
+	// Best is the lowest cost expression found for the group with respect to
+	// the required properties. It is nil if no expression could provide the
+	// required properties.
+	Best memo.RelExpr
+
+	// Cost is the estimated cost of Best, including the cost of its inputs.
+	Cost memo.Cost
+
+	// FullyOptimized is true if a lower cost expression will never be found
+	// for the group with respect to the required properties.
+	FullyOptimized bool
+}
+
+// ForEachGroupState calls the given function once for each memo group and set
+// of required properties that the optimizer has visited. The order of the
+// calls is unspecified. It is intended for tooling and tests that need to
+// inspect the outcome of optimization, and must only be called after Optimize
+// has returned and before the memo is detached. The optimizer state must not
+// be modified by the callback.
+func (o *Optimizer) ForEachGroupState(fn func(state GroupState)) {
+	o.stateTable.forEach(func(key groupStateKey, state *groupState) {
+		fn(GroupState{
+			Group:          key.group,
+			Required:       key.required,
+			Best:           state.best,
+			Cost:           state.cost,
+			FullyOptimized: state.fullyOptimized,
+		})
+	})
+}
+
+// RetainGroupBests causes Optimize to record the lowest cost expression of
+// each group for each set of required properties in the memo, rather than
+// only the expressions in the lowest cost tree. See memo.Memo.GroupBests. They
+// remain available after the memo is detached from the optimizer, for example
+// to be shown by EXPLAIN (OPT, MEMO), which retains them regardless of this
+// setting. It must be called before Optimize.
+func (o *Optimizer) RetainGroupBests() {
+	o.retainGroupBests = true
+}
+
+// isExplainMemo returns true if the given root expression is an EXPLAIN (OPT,
+// MEMO) statement, which shows the lowest cost expression of each group.
+func isExplainMemo(root memo.RelExpr) bool {
+	explain, ok := root.(*memo.ExplainExpr)
+	return ok && explain.Options.Mode == tree.ExplainOpt &&
+		explain.Options.Flags[tree.ExplainFlagMemo]
+}
+
+// recordGroupBests records the lowest cost expression of each fully optimized
+// group state in the memo.
+func (o *Optimizer) recordGroupBests() {
+	bests := make([]memo.GroupBest, 0, o.stateTable.len())
+	o.stateTable.forEach(func(key groupStateKey, state *groupState) {
+		if !state.fullyOptimized || state.best == nil {
+			return
+		}
+		bests = append(bests, memo.GroupBest{
+			Group:    key.group,
+			Required: key.required,
+			Best:     state.best,
+			Cost:     state.cost,
+		})
+	})
+	o.mem.SetGroupBests(bests)
+}
+
+// requireOptimizerGoal adds the physical properties that correspond to the
+// optimizer goal to the properties required of the root. When optimizing for
+// the first row, the root requires a limit hint of one row, so that the cost
+// of each expression reflects the work needed to produce its first row, and
+// requires its rows to be streamed, so that operators that must buffer their
+// input before producing any rows, such as a Sort or a hash join, are
+// penalized. This favors plans that use index orderings and streaming
+// operators.
+func (o *Optimizer) requireOptimizerGoal() {
+	if o.mem.OptimizerGoal() != sessiondatapb.OptimizerGoalFirstRow {
+		return
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return
+	}
+	rootProps := *o.mem.RootProps()
+	if rootProps.LimitHint == 1 && rootProps.Streaming {
+		return
+	}
+	rootProps.LimitHint = 1
+	rootProps.Streaming = true
+	o.mem.SetRoot(root, &rootProps)
+}
+
+// requireNoFullScan adds the NoFullScan property to the properties required of
+// the root if the disallow_full_table_scans session setting is enabled. The
+// property is passed through to every expression in the plan, so that large
+// full scans are pruned during the search and the best plan without one is
+// chosen. If every plan for a group requires a large full scan, the group still
+// has a plan, which is rejected by the execution engine once it is built.
+func (o *Optimizer) requireNoFullScan() {
+	if !o.evalCtx.SessionData().DisallowFullTableScans {
+		return
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok || o.mem.RootProps().NoFullScan {
+		return
+	}
+	rootProps := *o.mem.RootProps()
+	rootProps.NoFullScan = true
+	o.mem.SetRoot(root, &rootProps)
+}
+
+// isLargeFullScan returns true if the given expression is an unconstrained scan
+// of a table that is not virtual, and which is estimated to return more rows
+// than the large_full_scan_rows session setting, or has no statistics. This is
+// the same condition under which the execution engine rejects a plan when the
+// disallow_full_table_scans session setting is enabled.
+func (o *Optimizer) isLargeFullScan(e memo.RelExpr) bool {
+	scan, ok := e.(*memo.ScanExpr)
+	if !ok {
+		return false
+	}
+	md := o.mem.Metadata()
+	if md.Table(scan.Table).IsVirtualTable() || !scan.IsUnfiltered(md) {
+		return false
+	}
+	stats := scan.Relational().Stats
+	return !stats.Available || stats.RowCount > o.evalCtx.SessionData().LargeFullScanRows
+}
+
 // optimizeRootWithProps tries to simplify the root operator based on the
 // properties required of it. This may trigger the creation of a new root and
 // new properties.
@@ -786,11 +2864,12 @@ func (o *Optimizer) optimizeRootWithProps() {
 	// or presentation properties.
 	neededCols := rootProps.ColSet()
 	if !neededCols.SubsetOf(root.Relational().OutputCols) {
-		panic(errors.AssertionFailedf(
-			"columns required of root %s must be subset of output columns %s",
-			neededCols,
-			root.Relational().OutputCols,
-		))
+		panic(NewOptimizationError(UnsatisfiablePropsError, root.Op(), opt.InvalidRuleName,
+			errors.AssertionFailedf(
+				"columns required of root %s must be subset of output columns %s",
+				neededCols,
+				root.Relational().OutputCols,
+			)))
 	}
 	if o.f.CustomFuncs().CanPruneCols(root, neededCols) {
 		if o.matchedRule == nil || o.matchedRule(opt.PruneRootCols) {
@@ -815,7 +2894,10 @@ func (o *Optimizer) optimizeRootWithProps() {
 }
 
 // groupStateKey associates groupState with a group that is being optimized with
-// respect to a set of physical properties.
+// respect to a set of physical properties. The properties are compared by
+// pointer, so they must be interned by the memo; otherwise equal properties
+// that are constructed by different code paths would map to different states,
+// and the group would be optimized more than once with respect to them.
 type groupStateKey struct {
 	group    memo.RelExpr
 	required *physical.Required
@@ -841,10 +2923,35 @@ type groupState struct {
 	// expression with the lowest cost.
 	cost memo.Cost
 
+	// high is the worst-case execution cost for this expression. It is only
+	// computed if the optimizer is risk-averse (see Optimizer.riskAversion).
+	high memo.Cost
+
+	// previous is true if this expression and its best descendants reproduce
+	// part of the plan passed to SetPreviousPlan.
+	previous bool
+
+	// nearTies contains the candidates that were found to be nearly tied with
+	// minCost, the lowest cost of any candidate, when near-tie randomization is
+	// enabled, and nearTieBest identifies the one that was chosen as the best
+	// expression. They are reset when a cheaper candidate is found. See
+	// chooseNearTie.
+	nearTies    map[nearTieKey]struct{}
+	nearTieBest nearTieKey
+	minCost     memo.Cost
+
+	// tieBreakExpr and tieBreakKey memoize the tie-break key of the best
+	// expression, so that it is not recomputed for every candidate that ties
+	// with it. tieBreakKey is only valid if tieBreakExpr is the best expression.
+	// See breakTie.
+	tieBreakExpr memo.RelExpr
+	tieBreakKey  string
+
 	// fullyOptimized is set to true once the lowest cost expression has been
 	// found for a memo group, with respect to the required properties. A lower
 	// cost expression will never be found, no matter how many additional
-	// optimization passes are made.
+	// optimization passes are made, unless members were abandoned because they
+	// exceeded the budget (see budgetPrunedExprs).
 	fullyOptimized bool
 
 	// fullyOptimizedExprs contains the set of ordinal positions of each member
@@ -853,9 +2960,148 @@ type groupState struct {
 	// optimization passes are made.
 	fullyOptimizedExprs util.FastIntSet
 
+	// budget is the cost that a plan for the group must not exceed in order to
+	// be of use to the parent expressions that required it so far, or
+	// memo.MaxCost if there is no such limit. See optimizeGroup.
+	budget memo.Cost
+
+	// budgetPrunedExprs contains the ordinal positions of the members in
+	// fullyOptimizedExprs that were abandoned because they exceeded the budget.
+	// They are optimized again if the state is required within a larger budget.
+	// exceededBudget is set while a member is optimized if it, or one of its
+	// enforcers, is abandoned for that reason.
+	budgetPrunedExprs util.FastIntSet
+	exceededBudget    bool
+
 	// explore is used by the explorer to store intermediate state so that
 	// redundant work is minimized.
 	explore exploreState
+
+	// topK contains the lowest cost candidates for the group, sorted by
+	// increasing cost. It is only populated when OptimizeTopK is used.
+	topK []topKCandidate
+
+	// deepeningPass is the pass of iterative deepening in which the state was
+	// last refreshed. See iterativeDeepening.refresh.
+	deepeningPass int
+
+	// members caches the physical properties derived for each group member,
+	// indexed by its ordinal position, with respect to the required properties.
+	// optimizeGroup makes multiple passes over the members of large groups, and
+	// would otherwise derive the same properties on each pass.
+	members []derivedMemberProps
+
+	// sortPrefix caches the longest common prefix of the interesting orderings
+	// of the group and the required ordering, which is the input ordering of the
+	// partial Sort enforcer tried by enforceProps. It is only valid once
+	// sortPrefixDerived is true. See sortPrefixFor.
+	sortPrefixDerived bool
+	sortPrefix        *props.OrderingChoice
+
+	// speculative is true if the state was only optimized for the input of a
+	// partial Sort enforcer, or of an enforcer of another speculative state,
+	// and no parent expression has required its properties yet. See
+	// optimizeSpeculativeGroup.
+	speculative bool
+
+	// deferredEnforcers is true if ordering enforcers were not tried for the
+	// members of the state because it was speculative. They are tried once the
+	// state is promoted.
+	deferredEnforcers bool
+
+	// tracedEnforcers contains the enforcers that were costed for the state,
+	// including those that were not chosen. It is only populated if tracing is
+	// enabled. See EnforcerDecision.
+	tracedEnforcers []memo.RelExpr
+
+	// shadowBest and shadowCost are the lowest cost expression of the group
+	// under the shadow cost model, and its cost under that model. They are
+	// only set if the optimizer has a shadow cost model. See
+	// SetShadowCostModel.
+	shadowBest memo.RelExpr
+	shadowCost memo.Cost
+}
+
+// sortPrefixFor returns the longest common prefix of the interesting orderings
+// of the given member's group and the required ordering, or nil if the required
+// ordering is implied by one of the interesting orderings. enforceProps visits
+// each member of the group with the same required properties, and the
+// interesting orderings are a logical property of the group, so the prefix is
+// computed only once per group state rather than once per member.
+func (os *groupState) sortPrefixFor(member memo.RelExpr) *props.OrderingChoice {
+	if !os.sortPrefixDerived {
+		interestingOrderings := ordering.DeriveInterestingOrderings(member)
+		os.sortPrefix = interestingOrderings.LongestCommonPrefix(&os.required.Ordering)
+		os.sortPrefixDerived = true
+	}
+	return os.sortPrefix
+}
+
+// memberProps returns the cached properties of the group member at the given
+// ordinal position.
+func (os *groupState) memberProps(ord int) *derivedMemberProps {
+	for len(os.members) <= ord {
+		os.members = append(os.members, derivedMemberProps{})
+	}
+	return &os.members[ord]
+}
+
+// derivedMemberProps caches the results of CanProvidePhysicalProps and
+// BuildChildPhysicalProps for a group member and the required properties of a
+// groupState. Both are pure functions of the member and the interned required
+// properties, so they can be computed once and reused. It also caches the cost
+// of the member, excluding its children, which is computed once per state.
+type derivedMemberProps struct {
+	// canProvideDerived is true once canProvideProps has been computed.
+	canProvideDerived bool
+	canProvideProps   bool
+
+	// costed is true once cost has been computed, usually by
+	// computeMemberCosts.
+	costed bool
+	cost   memo.Cost
+
+	// children contains the properties required of each child of the member,
+	// or nil for the children whose properties have not been built yet.
+	children []*physical.Required
+}
+
+// canProvide returns the cached result of CanProvidePhysicalProps for the
+// member, computing it on first use.
+func (p *derivedMemberProps) canProvide(
+	evalCtx *tree.EvalContext, member memo.RelExpr, required *physical.Required,
+) bool {
+	if !p.canProvideDerived {
+		p.canProvideProps = CanProvidePhysicalProps(evalCtx, member, required)
+		p.canProvideDerived = true
+	}
+	return p.canProvideProps
+}
+
+// memberCost returns the cached cost of the member, computing it with the given
+// coster if it was not costed by computeMemberCosts.
+func (p *derivedMemberProps) memberCost(
+	coster Coster, member memo.RelExpr, required *physical.Required,
+) memo.Cost {
+	if !p.costed {
+		p.cost = coster.ComputeCost(member, required)
+		p.costed = true
+	}
+	return p.cost
+}
+
+// childProps returns the cached result of BuildChildPhysicalProps for the nth
+// child of the member, building it on first use.
+func (p *derivedMemberProps) childProps(
+	mem *memo.Memo, member memo.RelExpr, nth int, required *physical.Required,
+) *physical.Required {
+	if p.children == nil {
+		p.children = make([]*physical.Required, member.ChildCount())
+	}
+	if p.children[nth] == nil {
+		p.children[nth] = BuildChildPhysicalProps(mem, member, nth, required)
+	}
+	return p.children[nth]
 }
 
 // isMemberFullyOptimized returns true if the group member at the given ordinal
@@ -866,6 +3112,22 @@ func (os *groupState) isMemberFullyOptimized(ord int) bool {
 	return os.fullyOptimizedExprs.Contains(ord)
 }
 
+// setBudget sets the budget within which the state is optimized. If members
+// were abandoned because they exceeded a smaller budget, the state is no longer
+// fully optimized, and those members are optimized again. The budget of a state
+// that is already fully optimized is not lowered, since its members were
+// optimized within the larger one.
+func (os *groupState) setBudget(budget memo.Cost) {
+	if !os.budgetPrunedExprs.Empty() && os.budget.Less(budget) {
+		os.fullyOptimized = false
+		os.fullyOptimizedExprs.DifferenceWith(os.budgetPrunedExprs)
+		os.budgetPrunedExprs = util.FastIntSet{}
+	}
+	if !os.fullyOptimized {
+		os.budget = budget
+	}
+}
+
 // markMemberAsFullyOptimized marks the group member at the given ordinal
 // position as fully optimized for the required properties. The expression never
 // needs to be recosted, no matter how many additional optimization passes are
@@ -880,47 +3142,62 @@ func (os *groupState) markMemberAsFullyOptimized(ord int) {
 	os.fullyOptimizedExprs.Add(ord)
 }
 
-// groupStateAlloc allocates pages of groupState structs. This is preferable to
-// a slice of groupState structs because pointers are not invalidated when a
-// resize occurs, and because there's no need to retain a stable index.
-type groupStateAlloc struct {
-	page []groupState
-}
+// essentialRules are rules that cannot be disabled, since the optimizer may
+// fail to produce a plan without them.
+var essentialRules = util.MakeFastIntSet(
+	// Needed to prevent constraint building from failing.
+	int(opt.NormalizeInConst),
+	// Needed when an index is forced.
+	int(opt.GenerateIndexScans),
+	// Needed to prevent "same fingerprint cannot map to different groups."
+	int(opt.PruneJoinLeftCols),
+	int(opt.PruneJoinRightCols),
+	// Needed to prevent stack overflow.
+	int(opt.PushFilterIntoJoinLeftAndRight),
+	int(opt.PruneSelectCols),
+	// Needed to prevent execbuilder error.
+	// TODO(radu): the DistinctOn execution path should be fixed up so it
+	// supports distinct on an empty column set.
+	int(opt.EliminateDistinctNoColumns),
+	int(opt.EliminateEnsureDistinctNoColumns),
+)
 
-// allocate returns a pointer to a new, empty groupState struct. The pointer is
-// stable, meaning that its location won't change as other groupState structs
-// are allocated.
-func (a *groupStateAlloc) allocate() *groupState {
-	if len(a.page) == 0 {
-		a.page = make([]groupState, 8)
+// protectedRules returns the rules that are never disabled at random by the
+// DisableOptimizerRuleProbability testing knob. These are the essential rules,
+// plus the rules named by the DisableOptimizerRuleProtect knob, minus the rules
+// named by the DisableOptimizerRuleUnprotect knob. Unknown rule names are
+// ignored.
+func protectedRules(knobs *tree.EvalContextTestingKnobs) RuleSet {
+	protected := essentialRules
+	if len(knobs.DisableOptimizerRuleProtect) == 0 && len(knobs.DisableOptimizerRuleUnprotect) == 0 {
+		return protected
 	}
-	state := &a.page[0]
-	a.page = a.page[1:]
-	return state
+	protected = protected.Copy()
+	for _, name := range knobs.DisableOptimizerRuleProtect {
+		if r, ok := opt.ParseRuleName(strings.TrimSpace(name)); ok {
+			protected.Add(int(r))
+		}
+	}
+	for _, name := range knobs.DisableOptimizerRuleUnprotect {
+		if r, ok := opt.ParseRuleName(strings.TrimSpace(name)); ok {
+			protected.Remove(int(r))
+		}
+	}
+	return protected
 }
 
-// disableRules disables rules with the given probability for testing.
-func (o *Optimizer) disableRules(probability float64) {
-	essentialRules := util.MakeFastIntSet(
-		// Needed to prevent constraint building from failing.
-		int(opt.NormalizeInConst),
-		// Needed when an index is forced.
-		int(opt.GenerateIndexScans),
-		// Needed to prevent "same fingerprint cannot map to different groups."
-		int(opt.PruneJoinLeftCols),
-		int(opt.PruneJoinRightCols),
-		// Needed to prevent stack overflow.
-		int(opt.PushFilterIntoJoinLeftAndRight),
-		int(opt.PruneSelectCols),
-		// Needed to prevent execbuilder error.
-		// TODO(radu): the DistinctOn execution path should be fixed up so it
-		// supports distinct on an empty column set.
-		int(opt.EliminateDistinctNoColumns),
-		int(opt.EliminateEnsureDistinctNoColumns),
-	)
-
+// disableRules disables rules with the given probability for testing. The
+// rules are chosen by a random number generator with the given seed, so that
+// the same rules are disabled each time the same seed is given. If the seed is
+// zero, a seed is chosen at random. The protected rules are never disabled.
+func (o *Optimizer) disableRules(probability float64, seed int64, protected RuleSet) {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	o.disabledRulesSeed = seed
+	rng := rand.New(rand.NewSource(seed))
 	for i := opt.RuleName(1); i < opt.NumRuleNames; i++ {
-		if rand.Float64() < probability && !essentialRules.Contains(int(i)) {
+		if rng.Float64() < probability && !protected.Contains(int(i)) {
 			o.disabledRules.Add(int(i))
 		}
 	}
@@ -934,33 +3211,142 @@ func (o *Optimizer) disableRules(probability float64) {
 	})
 }
 
+// formatRuleSet returns the names of the given rules, separated by commas.
+func formatRuleSet(rules RuleSet) string {
+	var sb strings.Builder
+	rules.ForEach(func(i int) {
+		if sb.Len() > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(opt.RuleName(i).String())
+	})
+	return sb.String()
+}
+
 func (o *Optimizer) String() string {
 	return o.FormatMemo(FmtPretty)
 }
 
 // FormatMemo returns a string representation of the memo for testing
-// and debugging. The given flags control which properties are shown.
+// and debugging. The given flags control which properties are shown. If FmtHTML
+// is given, the memo is rendered as an HTML page rather than as text.
 func (o *Optimizer) FormatMemo(flags FmtFlags) string {
 	mf := makeMemoFormatter(o, flags)
+	if flags == FmtHTML {
+		return mf.formatHTML()
+	}
 	return mf.format()
 }
 
+// FormatOptimizedMemo is like Optimizer.FormatMemo, but formats the given
+// memo, which need not belong to an optimizer. The lowest cost expression of
+// each group is only shown if it was retained in the memo; see
+// RetainGroupBests.
+func FormatOptimizedMemo(mem *memo.Memo, flags FmtFlags) string {
+	o := Optimizer{mem: mem}
+	return o.FormatMemo(flags)
+}
+
+// FormatMemoDOT returns a representation of the memo in the Graphviz DOT
+// language for debugging. Each group is rendered as a cluster of its member
+// expressions, with edges to the groups of their children. If the memo has
+// been optimized, the lowest cost tree is highlighted.
+func (o *Optimizer) FormatMemoDOT() string {
+	mf := makeMemoFormatter(o, FmtPretty)
+	return mf.formatDOT()
+}
+
 // RecomputeCost recomputes the cost of each expression in the lowest cost
 // tree. It should be used in combination with the perturb-cost OptTester flag
 // in order to update the query plan tree after optimization is complete with
 // the real computed cost, not the perturbed cost.
 func (o *Optimizer) RecomputeCost() {
 	var c coster
-	c.Init(o.evalCtx, o.mem, 0 /* perturbation */)
+	c.Init(o.evalCtx, o.mem, 0 /* perturbation */, o.costModel)
+	c.estimator = o.defaultCoster.estimator
+
+	root := o.mem.RootExpr()
+	rootProps := o.mem.RootProps()
+	o.recomputeCostImpl(root, rootProps, &c, nil /* report */, 0 /* depth */)
+}
+
+// RecomputedCost describes how the cost of an expression in the lowest cost
+// tree changed when it was recomputed by RecomputeCostWithReport.
+type RecomputedCost struct {
+	// Expr is the relational expression whose cost was recomputed.
+	Expr memo.RelExpr
+
+	// Depth is the number of relational ancestors of Expr in the lowest cost
+	// tree.
+	Depth int
+
+	// SelfCost is the recomputed cost of Expr, excluding the costs of its
+	// children.
+	SelfCost memo.Cost
+
+	// Cost is the recomputed cost of Expr, including the costs of its
+	// children.
+	Cost memo.Cost
+
+	// PreviousCost is the cost of Expr, including the costs of its children,
+	// before it was recomputed.
+	PreviousCost memo.Cost
+}
+
+// CostReport lists the expressions in the lowest cost tree in depth-first
+// order, parents before their children, along with their recomputed costs.
+type CostReport []RecomputedCost
+
+// String formats the report as an indented tree, with one line per
+// expression.
+func (r CostReport) String() string {
+	var buf strings.Builder
+	for i := range r {
+		e := &r[i]
+		fmt.Fprintf(&buf, "%s%s: self=%.2f cost=%.2f",
+			strings.Repeat("  ", e.Depth), e.Expr.Op(), e.SelfCost, e.Cost)
+		if e.Cost != e.PreviousCost {
+			fmt.Fprintf(&buf, " (was %.2f)", e.PreviousCost)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// RecomputeCostWithReport is like RecomputeCost, but also returns a report of
+// the recomputed cost of each expression in the lowest cost tree, along with
+// its cost before it was recomputed. This shows where the cost of the plan
+// moved once the perturbation was removed.
+func (o *Optimizer) RecomputeCostWithReport() CostReport {
+	var c coster
+	c.Init(o.evalCtx, o.mem, 0 /* perturbation */, o.costModel)
+	c.estimator = o.defaultCoster.estimator
 
+	var report CostReport
 	root := o.mem.RootExpr()
 	rootProps := o.mem.RootProps()
-	o.recomputeCostImpl(root, rootProps, &c)
+	o.recomputeCostImpl(root, rootProps, &c, &report, 0 /* depth */)
+	return report
 }
 
+// recomputeCostImpl recomputes the cost of the given expression and its
+// descendants, and returns the cost of the expression. If report is not nil,
+// an entry is added to it for each relational expression that is recomputed.
 func (o *Optimizer) recomputeCostImpl(
-	parent opt.Expr, parentProps *physical.Required, c Coster,
+	parent opt.Expr, parentProps *physical.Required, c Coster, report *CostReport, depth int,
 ) memo.Cost {
+	// Reserve the entry for a relational expression before recursing, so that
+	// parents are listed before their children.
+	entry := -1
+	childDepth := depth
+	if rel, ok := parent.(memo.RelExpr); ok && report != nil {
+		entry = len(*report)
+		*report = append(*report, RecomputedCost{
+			Expr: rel, Depth: depth, PreviousCost: rel.Cost(),
+		})
+		childDepth++
+	}
+
 	cost := memo.Cost(0)
 	for i, n := 0, parent.ChildCount(); i < n; i++ {
 		child := parent.Child(i)
@@ -969,13 +3355,22 @@ func (o *Optimizer) recomputeCostImpl(
 		case memo.RelExpr:
 			childProps = t.RequiredPhysical()
 		}
-		cost += o.recomputeCostImpl(child, childProps, c)
+		childCost := o.recomputeCostImpl(child, childProps, c, report, childDepth)
+		if !isApplyJoinRightInput(o.mem, parent, i) {
+			cost += childCost
+		}
 	}
 
 	switch t := parent.(type) {
 	case memo.RelExpr:
-		cost += c.ComputeCost(t, parentProps)
+		selfCost := c.ComputeCost(t, parentProps)
+		cost += selfCost
 		o.mem.ResetCost(t, cost)
+		o.mem.SetSelfCost(t, selfCost, c.ComputeCostBreakdown(t, parentProps))
+		if entry >= 0 {
+			(*report)[entry].SelfCost = selfCost
+			(*report)[entry].Cost = cost
+		}
 	}
 
 	return cost
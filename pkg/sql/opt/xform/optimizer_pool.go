@@ -0,0 +1,54 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import "sync"
+
+// OptimizerPool is a pool of optimizers that can be shared by goroutines that
+// plan many short statements, so that each statement reuses the scratch memory
+// of a previous optimizer rather than allocating its own. Init reuses the
+// group state table, the group state pages, and the maps of the memo's
+// interner of the optimizer, so that optimizing a point lookup with a pooled
+// optimizer allocates little besides the expressions of its memo. The zero
+// value is ready to use.
+type OptimizerPool struct {
+	pool sync.Pool
+}
+
+// Get returns an optimizer from the pool, or a new optimizer if the pool is
+// empty. Init must be called on the optimizer before it is used.
+func (p *OptimizerPool) Get() *Optimizer {
+	if o, ok := p.pool.Get().(*Optimizer); ok {
+		return o
+	}
+	return &Optimizer{}
+}
+
+// Put returns the given optimizer to the pool. The caller must no longer use
+// the optimizer or its memo, unless the memo was detached with DetachMemo.
+func (p *OptimizerPool) Put(o *Optimizer) {
+	o.release()
+	p.pool.Put(o)
+}
+
+// release drops the references of the optimizer to the state of the last
+// statement that it optimized, except for its factory and memo, which are
+// reset by the next call to Init. The scratch memory that Init reuses is
+// retained.
+func (o *Optimizer) release() {
+	o.stateTable.reset(maxRetainedGroupStates)
+	o.arena.reset()
+	*o = Optimizer{
+		f:          o.f,
+		stateTable: o.stateTable,
+		arena:      o.arena,
+	}
+}
@@ -11,25 +11,45 @@
 package xform_test
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"math"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/optbuilder"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/opttester"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils/testcat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgnotice"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	tu "github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
+	"github.com/cockroachdb/cockroach/pkg/util/cancelchecker"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/cockroachdb/datadriven"
+	"github.com/cockroachdb/errors"
 )
 
 func TestDetachMemo(t *testing.T) {
@@ -78,6 +98,101 @@ func TestDetachMemo(t *testing.T) {
 	}
 }
 
+// TestCompactMemo tests that compacting an optimized, detached memo removes the
+// alternatives to the lowest cost tree without changing the tree.
+func TestCompactMemo(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+		xyzDDL,
+	)
+
+	var o xform.Optimizer
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	testutils.BuildQuery(t, &o, catalog, &evalCtx,
+		"SELECT * FROM abc JOIN xyz ON b = y WHERE c = 'foo' ORDER BY a")
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	mem := o.DetachMemo()
+	plan := mem.RootExpr().String()
+	exprCount, memSize := mem.ExprCount(), mem.MemoryEstimate()
+
+	mem.Compact()
+	if mem.ExprCount() >= exprCount || mem.MemoryEstimate() >= memSize {
+		t.Errorf("expected compaction to reduce the memo from %d expressions and %d bytes, got %d and %d",
+			exprCount, memSize, mem.ExprCount(), mem.MemoryEstimate())
+	}
+	if after := mem.RootExpr().String(); after != plan {
+		t.Errorf("expected compaction to retain the plan\n%s\ngot\n%s", plan, after)
+	}
+	if !mem.IsOptimized() {
+		t.Errorf("expected the compacted memo to remain optimized")
+	}
+
+	// The alternatives to the lowest cost tree are gone, so the compacted memo
+	// cannot be re-costed.
+	var recoster xform.Optimizer
+	recoster.Init(&evalCtx, catalog)
+	if recoster.InitForRecosting(mem) {
+		t.Errorf("expected a compacted memo not to be re-costed")
+	}
+}
+
+// TestPooledOptimizer tests that optimizers taken from the pool produce the
+// same plans as new optimizers, and that reusing their state does not modify a
+// memo that was detached from one of them.
+func TestPooledOptimizer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	format := func(mem *memo.Memo) string {
+		return memo.FormatExpr(mem.RootExpr(), memo.ExprFmtHideAll, mem, catalog)
+	}
+	optimize := func(o *xform.Optimizer, query string) string {
+		testutils.BuildQuery(t, o, catalog, &evalCtx, query)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return format(o.Memo())
+	}
+
+	queries := []string{
+		"SELECT * FROM abc ORDER BY b",
+		"SELECT * FROM abc WHERE c = 'foo' ORDER BY c DESC, b LIMIT 10",
+		"SELECT * FROM abc AS x JOIN abc AS y ON x.b = y.b ORDER BY x.c",
+	}
+	expected := make([]string, len(queries))
+	for i, query := range queries {
+		var o xform.Optimizer
+		expected[i] = optimize(&o, query)
+	}
+
+	o := xform.NewPooledOptimizer(&evalCtx, catalog)
+	if plan := optimize(o, queries[0]); plan != expected[0] {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected[0], plan)
+	}
+	detached := o.DetachMemo()
+	o.Release()
+
+	for i := 0; i < 3; i++ {
+		for j, query := range queries {
+			o := xform.NewPooledOptimizer(&evalCtx, catalog)
+			if plan := optimize(o, query); plan != expected[j] {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected[j], plan)
+			}
+			o.Release()
+		}
+	}
+
+	if plan := format(detached); plan != expected[0] {
+		t.Errorf("expected the detached memo to be unchanged:\n%s\ngot:\n%s", expected[0], plan)
+	}
+}
+
 // TestDetachMemoRace reproduces the condition in #34904: a detached memo still
 // aliases table annotations in the metadata. The problematic annotation is a
 // statistics object. Construction of new expression can trigger calculation of
@@ -247,3 +362,3989 @@ func runDataDrivenTest(t *testing.T, path string, fmtFlags memo.ExprFmtFlags) {
 		})
 	})
 }
+
+// abcDDL creates the table used by most of the tests of the optimizer APIs
+// below.
+const abcDDL = "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (c))"
+
+// xyzDDL creates the table that the tests below join with abc.
+const xyzDDL = "CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z STRING, INDEX (y))"
+
+// newTestCatalog returns a test catalog in which the given DDL statements have
+// been executed.
+func newTestCatalog(t testing.TB, ddls ...string) *testcat.Catalog {
+	catalog := testcat.New()
+	for _, ddl := range ddls {
+		if _, err := catalog.ExecuteDDL(ddl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return catalog
+}
+
+// joinTableDDLs returns the DDL statements that create the tables t1 through
+// tn, which are joined by the tests of join reordering below.
+func joinTableDDLs(n int) []string {
+	ddls := make([]string, n)
+	for i := range ddls {
+		ddls[i] = fmt.Sprintf("CREATE TABLE t%d (a INT PRIMARY KEY, b INT, INDEX (b))", i+1)
+	}
+	return ddls
+}
+
+// TestExplorationBudget tests that the budget returned by the callback set via
+// SetExplorationBudgetFunc bounds exploration, that it is polled as
+// optimization proceeds, and that a negative budget aborts optimization.
+func TestExplorationBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(budget int) (polls, explored int) {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+			if ruleName.IsExplore() {
+				explored++
+			}
+			return true
+		})
+		o.SetExplorationBudgetFunc(func(explorations int) int {
+			polls++
+			return budget
+		})
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return polls, explored
+	}
+
+	if polls, explored := optimize(0); polls == 0 || explored != 0 {
+		t.Errorf("expected no exploration with zero budget, got %d polls and %d rules", polls, explored)
+	}
+	if polls, explored := optimize(1000); polls == 0 || explored == 0 {
+		t.Errorf("expected exploration with large budget, got %d polls and %d rules", polls, explored)
+	}
+
+	// A negative budget aborts optimization.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	o.SetExplorationBudgetFunc(func(int) int { return -1 })
+	_, err := o.Optimize()
+	if e, ok := xform.GetOptimizationError(err); !ok || e.Kind != xform.BudgetExceededError {
+		t.Errorf("expected budget exceeded error, got %v", err)
+	}
+
+	// An exhausted time budget stops exploration, but still produces a plan.
+	o = xform.Optimizer{}
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	o.SetBudget(time.Nanosecond)
+	if root, err := o.Optimize(); err != nil || root == nil {
+		t.Errorf("expected a plan with an exhausted time budget, got %v", err)
+	}
+}
+
+// TestDisableForRetry tests that a statement whose optimization fails with an
+// internal error can be re-optimized with the implicated rule disabled.
+func TestDisableForRetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.NotifyOnAppliedRule(func(ruleName opt.RuleName, source, target opt.Expr) {
+		if ruleName == opt.GenerateConstrainedScans {
+			panic(errors.AssertionFailedf("test error"))
+		}
+	})
+	_, err := o.Optimize()
+	e, ok := xform.GetOptimizationError(err)
+	if !ok || e.Kind != xform.InternalError || e.Rule != opt.GenerateConstrainedScans {
+		t.Fatalf("expected internal error in rule, got %+v", err)
+	}
+
+	// The retry disables the rule, and produces the unconstrained plan.
+	o.Init(&evalCtx, catalog)
+	if disabled := o.DisableForRetry(err); disabled != "rule GenerateConstrainedScans" {
+		t.Errorf("unexpected disabled description: %s", disabled)
+	}
+	if err := testutils.BuildInitializedQuery(&o, catalog, query); err != nil {
+		t.Fatal(err)
+	}
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected select, got %s", root.Op())
+	}
+
+	// An error that is not attributed to a rule disables exploration.
+	o.Init(&evalCtx, catalog)
+	if disabled := o.DisableForRetry(errors.AssertionFailedf("test error")); disabled != "exploration" {
+		t.Errorf("unexpected disabled description: %s", disabled)
+	}
+}
+
+type constPlanScorer struct {
+	score float64
+	calls int
+}
+
+func (s *constPlanScorer) ScorePlan(serialized []byte) (float64, bool) {
+	var candidate xform.ScoredCandidate
+	if err := json.Unmarshal(serialized, &candidate); err != nil || candidate.Op == "" {
+		return 0, false
+	}
+	s.calls++
+	return s.score, true
+}
+
+// TestPlanScorer tests that a scorer set via SetPlanScorer is consulted for
+// each candidate, and that its score is blended with the analytic cost.
+func TestPlanScorer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(scorer xform.PlanScorer, weight float64) memo.Cost {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		if scorer != nil {
+			o.SetPlanScorer(scorer, weight)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+
+	analytic := optimize(nil, 0)
+	scorer := &constPlanScorer{score: 1}
+	if cost := optimize(scorer, 0); cost != analytic || scorer.calls == 0 {
+		t.Errorf("expected analytic cost %v with zero weight, got %v after %d calls", analytic, cost, scorer.calls)
+	}
+	if cost := optimize(&constPlanScorer{score: 1}, 1); cost >= analytic {
+		t.Errorf("expected scored cost to be lower than analytic cost %v, got %v", analytic, cost)
+	}
+}
+
+// scanCostModel is a CostModel that predicts a constant cost for scans, and
+// declines to predict the cost of any other operator.
+type scanCostModel struct {
+	cost        float64
+	predictions int
+}
+
+func (m *scanCostModel) PredictCost(features *xform.CostFeatures, _ float64) (float64, bool) {
+	if opt.Operator(features[xform.FeatureOp]) != opt.ScanOp {
+		return 0, false
+	}
+	if features[xform.FeatureOutputCols] == 0 || features[xform.FeatureInputCount] != 0 {
+		return 0, false
+	}
+	m.predictions++
+	return m.cost, true
+}
+
+// TestCostPerturbation tests that the perturbation set via SetCostPerturbation
+// is reproducible when seeded, and only applies to the given operators.
+func TestCostPerturbation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(perturbation *xform.CostPerturbation) memo.Cost {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		if perturbation != nil {
+			o.SetCostPerturbation(*perturbation)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+	unperturbed := optimize(nil)
+
+	for _, mode := range []xform.CostPerturbationMode{
+		xform.MultiplicativePerturbation, xform.AbsolutePerturbation, xform.SwapTiesPerturbation,
+	} {
+		p := xform.CostPerturbation{Mode: mode, Amount: 0.5, Seed: 1}
+		if first, second := optimize(&p), optimize(&p); first != second {
+			t.Errorf("mode %d: expected seeded perturbation to be reproducible, got %.2f and %.2f",
+				mode, first, second)
+		}
+	}
+
+	// Only joins are perturbed, so the cost of a query without joins is not.
+	p := xform.CostPerturbation{
+		Amount: 0.5,
+		Ops:    util.MakeFastIntSet(int(opt.InnerJoinOp), int(opt.LookupJoinOp), int(opt.MergeJoinOp)),
+		Seed:   1,
+	}
+	if cost := optimize(&p); cost != unperturbed {
+		t.Errorf("expected unperturbed cost %.2f, got %.2f", unperturbed, cost)
+	}
+}
+
+// TestRecomputeCostWithReport tests that RecomputeCostWithReport reports the
+// recomputed cost of each expression in the lowest cost tree.
+func TestRecomputeCostWithReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	o.SetCostPerturbation(xform.CostPerturbation{Amount: 0.9, Seed: 1})
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootExpr := root.(memo.RelExpr)
+	perturbed := rootExpr.Cost()
+
+	report := o.RecomputeCostWithReport()
+	if len(report) < 2 {
+		t.Fatalf("expected an entry for each expression, got:\n%s", report)
+	}
+	if report[0].Expr != rootExpr || report[0].Depth != 0 {
+		t.Errorf("expected root expression first, got:\n%s", report)
+	}
+	if report[0].PreviousCost != perturbed {
+		t.Errorf("expected previous cost %.2f, got %.2f", perturbed, report[0].PreviousCost)
+	}
+	if report[0].Cost != rootExpr.Cost() {
+		t.Errorf("expected recomputed cost %.2f, got %.2f", rootExpr.Cost(), report[0].Cost)
+	}
+	var total memo.Cost
+	for _, e := range report {
+		total += e.SelfCost
+		if e.Expr.Cost() != e.Cost {
+			t.Errorf("expected %s to have recomputed cost %.2f, got %.2f", e.Expr.Op(), e.Cost, e.Expr.Cost())
+		}
+	}
+	if math.Abs(float64(total-report[0].Cost)) > 1e-9*float64(report[0].Cost) {
+		t.Errorf("expected self costs to sum to %.2f, got %.2f", report[0].Cost, total)
+	}
+}
+
+// TestOverrideOperatorCost tests that the cost function set via
+// OverrideOperatorCost is only used for its operator.
+func TestOverrideOperatorCost(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	calls := 0
+	o.OverrideOperatorCost(opt.IndexJoinOp, func(
+		candidate memo.RelExpr, required *physical.Required, defaultCost memo.Cost,
+	) memo.Cost {
+		if candidate.Op() != opt.IndexJoinOp {
+			t.Errorf("expected index join, got %s", candidate.Op())
+		}
+		calls++
+		return defaultCost * 1e6
+	})
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 {
+		t.Error("expected cost function to be called")
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected %s when index joins are expensive, got %s", opt.SelectOp, root.Op())
+	}
+}
+
+// layeredCoster is a Coster used by TestChainCoster that records each call to
+// ComputeCost and multiplies the cost of one operator computed by the coster
+// that it wraps.
+type layeredCoster struct {
+	xform.Coster
+	name   string
+	op     opt.Operator
+	factor memo.Cost
+	calls  *[]string
+}
+
+func (c *layeredCoster) ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost {
+	*c.calls = append(*c.calls, c.name)
+	cost := c.Coster.ComputeCost(candidate, required)
+	if candidate.Op() == c.op {
+		cost *= c.factor
+	}
+	return cost
+}
+
+// TestChainCoster tests that costers added by ChainCoster are layered on top of
+// the current coster, with the last one consulted first.
+func TestChainCoster(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	var calls []string
+	o.ChainCoster(func(inner xform.Coster) xform.Coster {
+		return &layeredCoster{Coster: inner, name: "inner", op: opt.IndexJoinOp, factor: 1e6, calls: &calls}
+	})
+	o.ChainCoster(func(inner xform.Coster) xform.Coster {
+		return &layeredCoster{Coster: inner, name: "outer", op: opt.UnknownOp, factor: 1, calls: &calls}
+	})
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) < 2 || calls[0] != "outer" || calls[1] != "inner" {
+		t.Errorf("expected the outer coster to delegate to the inner coster, got calls %v", calls)
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected %s when index joins are expensive, got %s", opt.SelectOp, root.Op())
+	}
+}
+
+// TestComputedCostCheck tests that a coster that returns a negative cost causes
+// Optimize to fail in test builds.
+func TestComputedCostCheck(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	if !buildutil.CrdbTestBuild {
+		skip.IgnoreLint(t, "computed costs are only checked in test builds")
+	}
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	testCases := []struct {
+		query string
+		op    opt.Operator
+		err   string
+	}{
+		{query: "SELECT * FROM abc WHERE c = 'foo'", op: opt.IndexJoinOp, err: "coster returned invalid cost"},
+		{query: "SELECT * FROM abc ORDER BY b", op: opt.SortOp, err: "enforcer sort has invalid cost"},
+	}
+	for _, tc := range testCases {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, tc.query)
+		var calls []string
+		o.ChainCoster(func(inner xform.Coster) xform.Coster {
+			return &layeredCoster{Coster: inner, op: tc.op, factor: -1, calls: &calls}
+		})
+		if _, err := o.Optimize(); !tu.IsError(err, tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.query, tc.err, err)
+		}
+	}
+}
+
+// TestComputeCosts tests that the ComputeCosts method of the default coster
+// computes the same cost for each member of a group as ComputeCost.
+func TestComputeCosts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abcd (a INT PRIMARY KEY, b INT, c INT, d STRING, INDEX (b), INDEX (c), INDEX (d), INDEX (b, c))",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a FROM abcd")
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each index covers the scanned column, so the root group contains a scan
+	// of each index.
+	var candidates []memo.RelExpr
+	for e := o.Memo().RootExpr().(memo.RelExpr).FirstExpr(); e != nil; e = e.NextExpr() {
+		candidates = append(candidates, e)
+	}
+	if len(candidates) != 5 {
+		t.Fatalf("expected a scan of each index, got %d members", len(candidates))
+	}
+	required := o.Memo().RootProps()
+	costs := make([]memo.Cost, len(candidates))
+	o.Coster().(xform.BatchCoster).ComputeCosts(candidates, required, costs)
+	for i, e := range candidates {
+		if expected := o.Coster().ComputeCost(e, required); costs[i] != expected {
+			t.Errorf("member %d: expected cost %.2f, got %.2f", i, expected, costs[i])
+		}
+	}
+}
+
+// unitCoster is a Coster that assigns the same cost to every expression, so
+// that the cost of a plan is the number of its operators.
+type unitCoster struct {
+	xform.Coster
+}
+
+func (unitCoster) ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost {
+	return 1
+}
+
+// TestCostTies tests that, with deterministic tie-breaking, ties between
+// expressions with equal costs are broken independently of the order in which
+// they were added to their group, and that the callback set by NotifyOnCostTie
+// is invoked for each tie.
+func TestCostTies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	// The Select of the full scan is the first member of the root group, and
+	// ties with the IndexJoin of the constrained scan that is added after it.
+	optimize := func(deterministic bool) (memo.RelExpr, []xform.CostTie) {
+		evalCtx.SessionData().OptimizerDeterministicTieBreaking = deterministic
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		o.ChainCoster(func(inner xform.Coster) xform.Coster {
+			return unitCoster{Coster: inner}
+		})
+		var ties []xform.CostTie
+		o.NotifyOnCostTie(func(tie xform.CostTie) {
+			ties = append(ties, tie)
+		})
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr), ties
+	}
+
+	// Without deterministic tie-breaking, the first expression is kept and no
+	// ties are reported.
+	root, ties := optimize(false /* deterministic */)
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected %s to be kept, got %s", opt.SelectOp, root.Op())
+	}
+	if len(ties) != 0 {
+		t.Errorf("expected no ties to be reported, got %d", len(ties))
+	}
+
+	root, ties = optimize(true /* deterministic */)
+	if root.Op() != opt.IndexJoinOp {
+		t.Errorf("expected %s to win the tie, got %s", opt.IndexJoinOp, root.Op())
+	}
+	var found bool
+	for _, tie := range ties {
+		if tie.Winner == tie.Loser {
+			t.Errorf("expected different expressions in tie, got %s", tie.Winner.Op())
+		}
+		if tie.Winner.Op() == opt.IndexJoinOp && tie.Loser.Op() == opt.SelectOp {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected tie between %s and %s to be reported", opt.IndexJoinOp, opt.SelectOp)
+	}
+}
+
+// TestNotifyOnGroupOptimized tests that the callback set by
+// NotifyOnGroupOptimized is invoked once for each fully optimized group, with
+// the running total of optimized groups.
+func TestNotifyOnGroupOptimized(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c INT, INDEX (b))",
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z INT, INDEX (y))",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc JOIN xyz ON b = y ORDER BY c")
+	calls := 0
+	var last xform.GroupState
+	o.NotifyOnGroupOptimized(func(state xform.GroupState, progress xform.OptimizationProgress) {
+		calls++
+		if progress.Optimized != calls {
+			t.Errorf("expected %d optimized groups, got %d", calls, progress.Optimized)
+		}
+		if progress.Remaining < 0 {
+			t.Errorf("expected a non-negative number of remaining groups, got %d", progress.Remaining)
+		}
+		if !state.FullyOptimized {
+			t.Errorf("expected group to be fully optimized")
+		}
+		last = state
+	})
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullyOptimized := 0
+	o.ForEachGroupState(func(state xform.GroupState) {
+		if state.FullyOptimized {
+			fullyOptimized++
+		}
+	})
+	if calls != fullyOptimized {
+		t.Errorf("expected %d notifications, got %d", fullyOptimized, calls)
+	}
+	if last.Cost != root.(memo.RelExpr).Cost() {
+		t.Errorf("expected the root group to be optimized last, with cost %v, got %v",
+			root.(memo.RelExpr).Cost(), last.Cost)
+	}
+}
+
+// countingCoster is a Coster used by TestCostBoundPruning that counts the
+// expressions that it costs.
+type countingCoster struct {
+	xform.Coster
+	calls *int
+}
+
+func (c countingCoster) ComputeCost(
+	candidate memo.RelExpr, required *physical.Required,
+) memo.Cost {
+	*c.calls++
+	return c.Coster.ComputeCost(candidate, required)
+}
+
+// TestCostBoundPruning tests that pruning candidates that exceed the cost of the
+// best expression finds a plan with the same cost, while costing no more
+// (group, required properties) pairs than an exhaustive search, and fewer
+// expressions, since the members of child groups that exceed the budget passed
+// down by their parent are not costed.
+func TestCostBoundPruning(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c INT, INDEX (b), INDEX (c))",
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z INT, INDEX (y))",
+		"CREATE TABLE uvw (u INT PRIMARY KEY, v INT, w INT, INDEX (v))",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc JOIN xyz ON b = y JOIN uvw ON c = v WHERE a > 10 ORDER BY z"
+
+	optimize := func(prune bool) (cost memo.Cost, states, costed int) {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		o.SetCostBoundPruning(prune)
+		o.ChainCoster(func(inner xform.Coster) xform.Coster {
+			return countingCoster{Coster: inner, calls: &costed}
+		})
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.ForEachGroupState(func(xform.GroupState) { states++ })
+		return root.(memo.RelExpr).Cost(), states, costed
+	}
+
+	cost, states, costed := optimize(false /* prune */)
+	prunedCost, prunedStates, prunedCosted := optimize(true /* prune */)
+	if cost.Less(prunedCost) || prunedCost.Less(cost) {
+		t.Errorf("expected cost %v with pruning, got %v", cost, prunedCost)
+	}
+	if prunedStates > states {
+		t.Errorf("expected no more than %d group states with pruning, got %d", states, prunedStates)
+	}
+	if prunedCosted >= costed {
+		t.Errorf("expected fewer than %d expressions to be costed with pruning, got %d",
+			costed, prunedCosted)
+	}
+}
+
+// TestOptimizeWithHypotheticalIndexes tests that a hypothetical index that
+// makes a query cheaper is reported as used, and that the returned plan only
+// uses existing indexes.
+func TestOptimizeWithHypotheticalIndexes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c INT)")
+	tab := catalog.Table(tree.NewTableNameWithSchema("t", tree.PublicSchemaName, "abc"))
+	indexes := map[cat.Table][][]cat.IndexColumn{
+		tab: {{{Column: tab.Column(1)}}},
+	}
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a FROM abc WHERE b = 1")
+	root, report, err := o.OptimizeWithHypotheticalIndexes(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Used) != 1 || report.Used[0].Ordinal() != tab.IndexCount() {
+		t.Fatalf("expected the hypothetical index to be used, got %v", report.Used)
+	}
+	if report.CostDelta() >= 0 {
+		t.Errorf("expected a negative cost delta, got %v", report.CostDelta())
+	}
+	if cost := root.(memo.RelExpr).Cost(); cost != report.CurrentCost {
+		t.Errorf("expected current cost %v, got %v", cost, report.CurrentCost)
+	}
+	if len(report.Recommendations.Output()) == 0 {
+		t.Errorf("expected an index recommendation")
+	}
+	var scan *memo.ScanExpr
+	for e := opt.Expr(root); scan == nil; e = e.Child(0) {
+		scan, _ = e.(*memo.ScanExpr)
+	}
+	if scan.Index != cat.PrimaryIndex {
+		t.Errorf("expected the plan to scan the primary index, got index %d", scan.Index)
+	}
+}
+
+// TestRecommendIndexes tests that RecommendIndexes returns the candidate
+// indexes that make a query cheaper, ranked by their estimated improvement.
+func TestRecommendIndexes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c INT)")
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a FROM abc WHERE b = 1 AND c > 5")
+	root, recs, err := o.RecommendIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) == 0 {
+		t.Fatal("expected at least one index recommendation")
+	}
+	for i := range recs {
+		if recs[i].CurrentCost != root.(memo.RelExpr).Cost() {
+			t.Errorf("expected current cost %v, got %v", root.(memo.RelExpr).Cost(), recs[i].CurrentCost)
+		}
+		if recs[i].Improvement() <= 0 {
+			t.Errorf("expected a positive improvement for %v, got %v", recs[i].Columns, recs[i].Improvement())
+		}
+		if i > 0 && recs[i-1].Improvement().Less(recs[i].Improvement()) {
+			t.Errorf("expected recommendations to be ranked by improvement")
+		}
+	}
+	if cols := recs[0].Columns; cols[0].ColName() != "b" {
+		t.Errorf("expected the best index to begin with column b, got %v", cols)
+	}
+}
+
+// TestCostModel tests that a learned model set via SetCostModel is consulted
+// for each candidate, and that the analytic cost is used when it declines to
+// predict.
+func TestCostModel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(model xform.CostModel, weight float64) memo.Cost {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		if model != nil {
+			o.SetCostModel(model, weight)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+
+	analytic := optimize(nil, 0)
+	model := &scanCostModel{cost: 0}
+	if cost := optimize(model, 0); cost != analytic || model.predictions == 0 {
+		t.Errorf("expected analytic cost %v with zero weight, got %v after %d predictions",
+			analytic, cost, model.predictions)
+	}
+	if cost := optimize(&scanCostModel{cost: 0}, 1); cost >= analytic {
+		t.Errorf("expected predicted cost to be lower than analytic cost %v, got %v", analytic, cost)
+	}
+	if cost := optimize(&scanCostModel{cost: math.NaN()}, 1); cost != analytic {
+		t.Errorf("expected analytic cost %v for invalid predictions, got %v", analytic, cost)
+	}
+}
+
+// TestExecutionFeedback tests that expressions have stable fingerprints across
+// optimizations, and that the row counts recorded in an ExecutionFeedbackStore
+// are used to correct the costs of subsequent optimizations.
+func TestExecutionFeedback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimizeQuery := func(
+		query string, store xform.ExecutionFeedbackStore,
+	) (*xform.Optimizer, memo.RelExpr) {
+		o := &xform.Optimizer{}
+		testutils.BuildQuery(t, o, catalog, &evalCtx, query)
+		if store != nil {
+			o.SetExecutionFeedbackStore(store)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o, root.(memo.RelExpr)
+	}
+	optimize := func(store xform.ExecutionFeedbackStore) (*xform.Optimizer, memo.RelExpr) {
+		return optimizeQuery("SELECT * FROM abc WHERE c = 'foo'", store)
+	}
+
+	o1, root1 := optimize(nil)
+	o2, root2 := optimize(nil)
+	fp := o1.Fingerprint(root1)
+	if fp2 := o2.Fingerprint(root2); fp != fp2 {
+		t.Fatalf("expected stable fingerprint %d, got %d", fp, fp2)
+	}
+	estimated := root1.Relational().Stats.RowCount
+
+	// Feedback that matches the estimate does not change the cost.
+	var store xform.InMemoryExecutionFeedbackStore
+	store.RecordFeedback(fp, xform.ExecutionFeedback{RowCount: estimated})
+	if _, root := optimize(&store); root.Cost() != root1.Cost() {
+		t.Errorf("expected cost %v, got %v", root1.Cost(), root.Cost())
+	}
+
+	// Feedback showing that many more rows were returned than estimated
+	// increases the cost.
+	store.RecordFeedback(fp, xform.ExecutionFeedback{RowCount: estimated * 1001, Executions: 1})
+	if feedback, ok := store.Feedback(fp); !ok || feedback.Executions != 2 ||
+		feedback.RowCount != estimated*501 {
+		t.Errorf("expected merged feedback, got %+v", feedback)
+	}
+	if _, root := optimize(&store); !root1.Cost().Less(root.Cost()) {
+		t.Errorf("expected cost higher than %v, got %v", root1.Cost(), root.Cost())
+	}
+
+	// Feedback showing that no rows were returned lowers the cost of a scan by
+	// at most maxFeedbackCorrection, so the scan does not become free.
+	scanOpt, scan := optimizeQuery("SELECT * FROM abc", nil)
+	var empty xform.InMemoryExecutionFeedbackStore
+	empty.RecordFeedback(scanOpt.Fingerprint(scan), xform.ExecutionFeedback{RowCount: 0})
+	if _, root := optimizeQuery("SELECT * FROM abc", &empty); root.Cost() <= 0 ||
+		!root.Cost().Less(scan.Cost()) {
+		t.Errorf("expected cost between 0 and %v, got %v", scan.Cost(), root.Cost())
+	}
+
+	// Feedback is dropped once the store is full.
+	full := xform.InMemoryExecutionFeedbackStore{MaxEntries: 1}
+	full.RecordFeedback(fp, xform.ExecutionFeedback{RowCount: 1})
+	full.RecordFeedback(fp+1, xform.ExecutionFeedback{RowCount: 1})
+	if _, ok := full.Feedback(fp + 1); ok {
+		t.Errorf("expected feedback to be dropped when the store is full")
+	}
+}
+
+// TestPlanBaseline tests that a plan captured with CapturePlanBaseline can be
+// serialized and used to make the optimizer reproduce the same plan.
+func TestPlanBaseline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX c_idx (c))")
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(query string, baseline *xform.PlanBaseline) *xform.Optimizer {
+		o := &xform.Optimizer{}
+		testutils.BuildQuery(t, o, catalog, &evalCtx, query)
+		if baseline != nil {
+			if err := o.SetPlanBaseline(baseline); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	capture := func(o *xform.Optimizer) *xform.PlanBaseline {
+		baseline, err := o.CapturePlanBaseline()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return baseline
+	}
+
+	// Capture the plan that the index hint produces, and round-trip it through
+	// its serialized form.
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+	hinted := capture(optimize("SELECT * FROM abc@abc_pkey WHERE c = 'foo'", nil))
+	data, err := hinted.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := xform.UnmarshalPlanBaseline(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unpinned := optimize(query, nil)
+	if before, _ := json.Marshal(capture(unpinned)); string(before) == string(data) {
+		t.Fatalf("expected the unhinted query to use a different plan than %s", data)
+	}
+
+	// The baseline reproduces the hinted plan without the hint.
+	pinned := optimize(query, baseline)
+	if !pinned.PlanBaselineReproduced() {
+		after, _ := json.Marshal(capture(pinned))
+		t.Errorf("expected plan %s, got %s", data, after)
+	}
+
+	// A baseline that refers to a dropped index is rejected.
+	scan := &baseline.Root
+	for scan.TableID == 0 && len(scan.Children) > 0 {
+		scan = &scan.Children[0]
+	}
+	invalid := *baseline
+	invalid.Root = xform.BaselineNode{Op: scan.Op, TableID: scan.TableID, IndexIDs: []cat.StableID{9999}}
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	if err := o.SetPlanBaseline(&invalid); err == nil {
+		t.Errorf("expected error for baseline with unknown index")
+	}
+
+	if _, err := xform.UnmarshalPlanBaseline([]byte(`{"version":0}`)); err == nil {
+		t.Errorf("expected error for unsupported baseline version")
+	}
+}
+
+// TestPreviousPlan tests that the optimizer keeps the previous plan of a query
+// unless a new plan is cheaper by more than the stability tolerance.
+func TestPreviousPlan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX c_idx (c))")
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	// Use the plan that the index hint produces as the previous plan. It is
+	// much more expensive than the plan that is chosen without the hint.
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+	var hinted xform.Optimizer
+	testutils.BuildQuery(t, &hinted, catalog, &evalCtx, "SELECT * FROM abc@abc_pkey WHERE c = 'foo'")
+	if _, err := hinted.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := hinted.CapturePlanBaseline()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		tolerance  float64
+		reproduced bool
+	}{
+		{tolerance: 0, reproduced: false},
+		{tolerance: 0.01, reproduced: false},
+		{tolerance: 1000, reproduced: true},
+	} {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if err := o.SetPreviousPlan(previous, tc.tolerance); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		if o.PreviousPlanReproduced() != tc.reproduced {
+			t.Errorf("tolerance %v: expected reproduced to be %t", tc.tolerance, tc.reproduced)
+		}
+	}
+}
+
+// TestPlanFingerprint tests that the fingerprint of a plan depends on its
+// shape, and not on the constants in the query.
+func TestPlanFingerprint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX c_idx (c))")
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	fingerprint := func(query string) uint64 {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		fp, err := o.PlanFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseline, err := o.CapturePlanBaseline()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fp != baseline.Fingerprint() {
+			t.Errorf("expected the fingerprint of the plan to match that of its baseline")
+		}
+		return fp
+	}
+
+	foo := fingerprint("SELECT * FROM abc WHERE c = 'foo'")
+	if bar := fingerprint("SELECT * FROM abc WHERE c = 'bar'"); foo != bar {
+		t.Errorf("expected the same fingerprint for different constants, got %d and %d", foo, bar)
+	}
+	if hinted := fingerprint("SELECT * FROM abc@abc_pkey WHERE c = 'foo'"); foo == hinted {
+		t.Errorf("expected a different fingerprint for a different index")
+	}
+	if sorted := fingerprint("SELECT * FROM abc WHERE c = 'foo' ORDER BY b"); foo == sorted {
+		t.Errorf("expected a different fingerprint for a plan with a sort")
+	}
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc")
+	if _, err := o.PlanFingerprint(); err == nil {
+		t.Errorf("expected an error before optimization")
+	}
+}
+
+// TestPlanExport tests that an exported plan can be serialized, and replayed
+// against a catalog in order to re-cost it.
+func TestPlanExport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX c_idx (c))")
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	// Export the plan that the index hint produces, as the plan of the query
+	// without the hint, and round-trip it through its serialized form.
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc@abc_pkey WHERE c = 'foo'")
+	if _, err := o.ExportPlan(query); err == nil {
+		t.Errorf("expected an error before optimization")
+	}
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := o.ExportPlan(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := exported.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := xform.UnmarshalPlanExport(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.SQL != query || imported.Root.Cost != exported.Root.Cost {
+		t.Errorf("expected the plan to round-trip, got %s", data)
+	}
+
+	// Replaying the plan reproduces it without the hint, with the same costs.
+	o = xform.Optimizer{}
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, imported.SQL)
+	replay, err := o.ReplayPlan(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replay.Reproduced || replay.Replayed.Root.Cost != exported.Root.Cost {
+		t.Errorf("expected the plan to be reproduced with the same cost:\n%s", replay)
+	}
+	if !strings.Contains(replay.String(), "scan abc@abc_pkey") {
+		t.Errorf("expected the replay to show the scan of the primary index:\n%s", replay)
+	}
+
+	// A plan that uses an index that does not exist in the catalog is rejected.
+	o = xform.Optimizer{}
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if exported, err = o.ExportPlan(query); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING)")
+	o = xform.Optimizer{}
+	testutils.BuildQuery(t, &o, other, &evalCtx, query)
+	if _, err := o.ReplayPlan(exported); err == nil {
+		t.Errorf("expected an error replaying a plan that uses a missing index")
+	}
+
+	if _, err := xform.UnmarshalPlanExport([]byte(`{"version":0}`)); err == nil {
+		t.Errorf("expected error for unsupported plan export version")
+	}
+}
+
+// TestRetainGroupBests tests that the lowest cost expressions retained in the
+// memo by RetainGroupBests are shown when formatting the memo after it has been
+// detached from the optimizer.
+func TestRetainGroupBests(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc WHERE c = 'foo' ORDER BY b"
+
+	for _, retain := range []bool{false, true} {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if retain {
+			o.RetainGroupBests()
+		}
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		expected := o.FormatMemo(xform.FmtPretty)
+		mem := o.DetachMemo()
+		actual := xform.FormatOptimizedMemo(mem, xform.FmtPretty)
+		if !retain {
+			if mem.GroupBests() != nil || strings.Contains(actual, "best:") {
+				t.Errorf("expected no lowest cost expressions without RetainGroupBests, got:\n%s", actual)
+			}
+			continue
+		}
+		if len(mem.GroupBests()) == 0 {
+			t.Fatal("expected lowest cost expressions to be retained")
+		}
+		if actual != expected {
+			t.Errorf("expected detached memo:\n%s\ngot:\n%s", expected, actual)
+		}
+	}
+}
+
+// TestRecosting tests that a detached memo can be re-optimized with fresh
+// statistics, producing the same plan as optimizing from scratch without
+// adding any expressions to the memo.
+func TestRecosting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	for _, query := range []string{
+		"SELECT * FROM abc WHERE b = 1",
+		// The plan has a Sort enforcer, which shares the statistics of its input.
+		"SELECT * FROM abc WHERE b = 1 ORDER BY c",
+	} {
+		t.Run(query, func(t *testing.T) {
+			catalog := newTestCatalog(t, "CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX b_idx (b))")
+			optimize := func() (*memo.Memo, string) {
+				var o xform.Optimizer
+				testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+				root, err := o.Optimize()
+				if err != nil {
+					t.Fatal(err)
+				}
+				plan := memo.FormatExpr(root, memo.ExprFmtHideQualifications, o.Memo(), catalog)
+				return o.DetachMemo(), plan
+			}
+			recost := func(mem *memo.Memo) string {
+				var o xform.Optimizer
+				o.Init(&evalCtx, catalog)
+				exprCount := mem.ExprCount()
+				if !o.InitForRecosting(mem) {
+					t.Fatal("expected memo to be re-costed")
+				}
+				root, err := o.Optimize()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mem.ExprCount() != exprCount {
+					t.Errorf("expected %d expressions, got %d", exprCount, mem.ExprCount())
+				}
+				return memo.FormatExpr(root, memo.ExprFmtHideQualifications, mem, catalog)
+			}
+
+			// With unchanged statistics, re-costing reproduces the original plan.
+			mem, plan := optimize()
+			if recosted := recost(mem); recosted != plan {
+				t.Errorf("expected:\n%s\ngot:\n%s", plan, recosted)
+			}
+
+			// After the statistics change, re-costing produces the same plan as
+			// optimizing from scratch.
+			if _, err := catalog.ExecuteDDL(`ALTER TABLE abc INJECT STATISTICS '[
+				{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000},
+				{"columns": ["b"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 1}
+			]'`); err != nil {
+				t.Fatal(err)
+			}
+			recosted := recost(mem)
+			if _, expected := optimize(); recosted != expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected, recosted)
+			}
+			if recosted == plan {
+				t.Errorf("expected the plan to change after the statistics changed:\n%s", plan)
+			}
+		})
+	}
+}
+
+// TestOptimizeCanceled tests that Optimize stops and returns an error if the
+// statement's context has been canceled.
+func TestOptimizeCanceled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	evalCtx.Context = ctx
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	if _, err := o.Optimize(); !errors.Is(err, cancelchecker.QueryCanceledError) {
+		t.Errorf("expected query canceled error, got %v", err)
+	}
+}
+
+// TestMemoryAccount tests that Optimize either fails or stops exploring once
+// the memory account set via SetMemoryAccount cannot be grown.
+func TestMemoryAccount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := tree.MakeTestingEvalContext(st)
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+
+	optimize := func(limit int64, degrade bool) (memo.RelExpr, error) {
+		ctx := context.Background()
+		monitor := mon.NewMonitorWithLimit(
+			"test", mon.MemoryResource, limit, nil /* curCount */, nil, /* maxHist */
+			1 /* increment */, 0 /* noteworthy */, st,
+		)
+		monitor.Start(ctx, nil /* pool */, mon.MakeStandaloneBudget(limit))
+		defer monitor.Stop(ctx)
+		acc := monitor.MakeBoundAccount()
+		defer acc.Close(ctx)
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		o.SetMemoryAccount(&acc, degrade)
+		root, err := o.Optimize()
+		if err != nil {
+			return nil, err
+		}
+		return root.(memo.RelExpr), nil
+	}
+
+	// With a generous limit, the constrained index scan is found.
+	root, err := optimize(1<<30, false /* degrade */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.IndexJoinOp {
+		t.Errorf("expected index join, got %s", root.Op())
+	}
+
+	// With a tiny limit, optimization fails.
+	_, err = optimize(1, false /* degrade */)
+	if e, ok := xform.GetOptimizationError(err); !ok || e.Kind != xform.BudgetExceededError {
+		t.Errorf("expected budget exceeded error, got %v", err)
+	}
+
+	// With a tiny limit and degradation, the normalized plan is returned.
+	root, err = optimize(1, true /* degrade */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected select, got %s", root.Op())
+	}
+}
+
+// TestFormatMemoDOT tests that FormatMemoDOT renders each group as a cluster
+// and highlights the lowest cost tree, including enforcers.
+func TestFormatMemoDOT(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	dot := o.FormatMemoDOT()
+	for _, expected := range []string{
+		"digraph memo {",
+		"subgraph cluster_G1 {",
+		`[label="(index-join G`,
+		`[label="(sort) `,
+		"style=dashed, color=red, penwidth=2]",
+		`[label="(scan abc@abc_c_idx,cols=(1,3),constrained)", color=red, penwidth=2]`,
+	} {
+		if !strings.Contains(dot, expected) {
+			t.Errorf("expected %q in:\n%s", expected, dot)
+		}
+	}
+}
+
+// TestFormatMemoHTML tests that FormatMemo with FmtHTML renders each group as
+// a collapsible section, with links to child groups and the best expression
+// and cost for each set of required properties.
+func TestFormatMemoHTML(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	page := o.FormatMemo(xform.FmtHTML)
+	for _, expected := range []string{
+		"<!DOCTYPE html>",
+		"<title>memo (optimized, ",
+		`<details id="G1" open>`,
+		`<a href="#G2">G2</a>`,
+		"<tr><th>required</th><th>best</th><th>cost</th></tr>",
+		`<li class="best" title="cost: `,
+		"(scan abc@abc_c_idx,cols=(1,3),constrained)",
+		"</html>",
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected %q in:\n%s", expected, page)
+		}
+	}
+}
+
+// TestTrace tests that EnableTracing records the exploration rules applied
+// during optimization, along with their effect on cost.
+func TestTrace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	if o.Trace() != nil {
+		t.Fatal("expected no trace before tracing is enabled")
+	}
+	o.EnableTracing()
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+
+	trace := o.Trace()
+	var found bool
+	for _, ev := range trace.Events {
+		if ev.Rule != opt.GenerateConstrainedScans {
+			continue
+		}
+		found = true
+		if ev.Source == nil || ev.Source.Op() != opt.SelectOp {
+			t.Errorf("expected select source, got %v", ev.Source)
+		}
+		if len(ev.Added) == 0 {
+			t.Errorf("expected added expressions")
+		}
+		if ev.CostAfter >= ev.CostBefore {
+			t.Errorf("expected cost to decrease, got %.2f -> %.2f", ev.CostBefore, ev.CostAfter)
+		}
+		// The constrained scan added by the rule is the lowest cost expression in
+		// the group.
+		if ev.AddedCost != ev.CostAfter {
+			t.Errorf("expected added cost %.2f to equal cost %.2f", ev.AddedCost, ev.CostAfter)
+		}
+		if ev.Time.Before(trace.Start) {
+			t.Errorf("expected event after trace start")
+		}
+	}
+	if !found {
+		t.Fatalf("expected GenerateConstrainedScans in trace:\n%s", trace)
+	}
+	if s := trace.String(); !strings.Contains(s, "GenerateConstrainedScans: select -> [") {
+		t.Errorf("unexpected trace report:\n%s", s)
+	}
+}
+
+// TestTraceEnforcers tests that the trace records the enforcers that were
+// costed for each group, including those that were not chosen.
+func TestTraceEnforcers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	// The index on c provides the ordering natively, so the Sort of the primary
+	// index is rejected.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc ORDER BY c")
+	o.EnableTracing()
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	trace := o.Trace()
+	if len(trace.Enforcers) == 0 {
+		t.Fatalf("expected an enforcer decision:\n%s", trace)
+	}
+	d := trace.Enforcers[0]
+	if d.Required.Ordering.Any() || d.NativeCost == 0 || !d.NativeChosen() {
+		t.Errorf("expected the native ordering to be chosen:\n%s", trace)
+	}
+	if len(d.Candidates) == 0 || d.Candidates[0].Enforcer.Op() != opt.SortOp ||
+		d.Candidates[0].Chosen || d.Candidates[0].Cost <= d.NativeCost {
+		t.Errorf("expected a more expensive sort to be rejected:\n%s", trace)
+	}
+
+	// The index on c provides a prefix of the ordering, so a partial Sort is
+	// chosen over a Sort of the primary index.
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc ORDER BY c, b")
+	o.EnableTracing()
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	trace = o.Trace()
+	var chosen, rejected int
+	for _, d := range trace.Enforcers {
+		for _, c := range d.Candidates {
+			if c.Chosen {
+				chosen++
+			} else {
+				rejected++
+			}
+		}
+	}
+	if chosen != 1 || rejected == 0 {
+		t.Errorf("expected one chosen and a rejected enforcer:\n%s", trace)
+	}
+	if s := trace.String(); !strings.Contains(s, "enforce scan [ordering: +3,+2]") || !strings.Contains(s, "(chosen)") {
+		t.Errorf("unexpected trace report:\n%s", s)
+	}
+}
+
+// TestDisableRules tests that rules disabled by name, either directly or via
+// the session setting, are not applied.
+func TestDisableRules(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	if err := o.DisableRulesByName([]string{"NotARule"}); err == nil {
+		t.Error("expected error for unknown rule")
+	}
+	if err := o.DisableRulesByName([]string{"GenerateIndexScans"}); err == nil {
+		t.Error("expected error for essential rule")
+	}
+	if err := o.DisableRulesByName([]string{"GenerateConstrainedScans"}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected select when constrained scans are disabled, got %s", root.Op())
+	}
+
+	// Normalization rules can be disabled via the session setting.
+	evalCtx.SessionData().OptimizerDisableRules = "EliminateProject,GenerateConstrainedScans"
+	defer func() { evalCtx.SessionData().OptimizerDisableRules = "" }()
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a, b, c FROM abc WHERE c = 'foo'")
+	root, err = o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.ProjectOp {
+		t.Errorf("expected project when EliminateProject is disabled, got %s", root.Op())
+	}
+
+	// Rules can be disabled for all sessions via the cluster setting. Essential
+	// rules are ignored.
+	evalCtx.SessionData().OptimizerDisableRules = ""
+	ctx := context.Background()
+	sv := &evalCtx.Settings.SV
+	opt.DisabledRulesClusterSetting.Override(ctx, sv, "GenerateConstrainedScans, GenerateIndexScans")
+	defer opt.DisabledRulesClusterSetting.Override(ctx, sv, "")
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	root, err = o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected select when constrained scans are disabled by the cluster setting, got %s", root.Op())
+	}
+	if disabled := o.DisabledRules(); disabled.Contains(int(opt.GenerateIndexScans)) {
+		t.Errorf("expected essential rule to be ignored, got %s", disabled)
+	}
+	if _, err := opt.ParseRuleNames("GenerateConstrainedScans,NotARule"); err == nil {
+		t.Error("expected error for unknown rule")
+	}
+}
+
+// testCommuteInnerJoin is an external rule that commutes the inputs of an
+// inner join.
+type testCommuteInnerJoin struct{}
+
+func init() {
+	xform.RegisterExternalRule(testCommuteInnerJoin{})
+}
+
+func (testCommuteInnerJoin) Name() string {
+	return "TestCommuteInnerJoin"
+}
+
+func (testCommuteInnerJoin) Explore(c *xform.CustomFuncs, member memo.RelExpr) {
+	if join, ok := member.(*memo.InnerJoinExpr); ok {
+		c.Memo().AddInnerJoinToGroup(&memo.InnerJoinExpr{
+			Left:        join.Right,
+			Right:       join.Left,
+			On:          join.On,
+			JoinPrivate: join.JoinPrivate,
+		}, member)
+	}
+}
+
+// TestExternalRules tests that external rules enabled via the session setting
+// are applied during exploration.
+func TestExternalRules(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING)",
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z STRING)",
+	)
+	if _, err := xform.ParseExternalRules([]string{"NotARule"}); err == nil {
+		t.Error("expected error for unknown external rule")
+	}
+
+	// Disable ReorderJoins, so that the join is only commuted by the external
+	// rule.
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	evalCtx.SessionData().OptimizerDisableRules = "ReorderJoins"
+
+	innerJoins := func(externalRules string) int {
+		evalCtx.SessionData().OptimizerExternalRules = externalRules
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc INNER JOIN xyz ON b = y")
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for e := root.(memo.RelExpr).FirstExpr(); e != nil; e = e.NextExpr() {
+			if e.Op() == opt.InnerJoinOp {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := innerJoins(""); n != 1 {
+		t.Errorf("expected 1 inner join without external rules, got %d", n)
+	}
+	if n := innerJoins("TestCommuteInnerJoin"); n != 2 {
+		t.Errorf("expected 2 inner joins with external rule, got %d", n)
+	}
+}
+
+// TestDisableRulesSeed tests that the rules disabled at random by the
+// DisableOptimizerRuleProbability testing knob are determined by the seed.
+func TestDisableRulesSeed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	evalCtx.TestingKnobs.DisableOptimizerRuleProbability = 0.5
+
+	disabled := func(seed int64) xform.RuleSet {
+		evalCtx.TestingKnobs.DisableOptimizerRuleSeed = seed
+		var o xform.Optimizer
+		o.Init(&evalCtx, testcat.New())
+		return o.DisabledRules()
+	}
+	first := disabled(42)
+	if first.Empty() {
+		t.Fatal("expected rules to be disabled")
+	}
+	if second := disabled(42); !first.Equals(second) {
+		t.Errorf("expected the same seed to disable the same rules, got %s and %s", first, second)
+	}
+	if other := disabled(43); first.Equals(other) {
+		t.Errorf("expected different seeds to disable different rules, got %s", other)
+	}
+	if first.Contains(int(opt.GenerateIndexScans)) {
+		t.Error("expected essential rule not to be disabled")
+	}
+
+	// The set of rules that are never disabled can be changed by testing knobs.
+	evalCtx.TestingKnobs.DisableOptimizerRuleProbability = 1
+	evalCtx.TestingKnobs.DisableOptimizerRuleProtect = []string{"GenerateConstrainedScans"}
+	evalCtx.TestingKnobs.DisableOptimizerRuleUnprotect = []string{"GenerateIndexScans"}
+	all := disabled(42)
+	if all.Contains(int(opt.GenerateConstrainedScans)) {
+		t.Error("expected protected rule not to be disabled")
+	}
+	if !all.Contains(int(opt.GenerateIndexScans)) {
+		t.Error("expected unprotected essential rule to be disabled")
+	}
+	if !all.Contains(int(opt.GenerateLookupJoins)) {
+		t.Error("expected all other rules to be disabled")
+	}
+}
+
+// TestStatementHints tests that the hint comment of a statement is extracted
+// and parsed, and that the hints change how that statement is optimized.
+func TestStatementHints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	for _, tc := range []struct {
+		sql      string
+		expected string
+	}{
+		{sql: "SELECT 1", expected: ""},
+		{sql: "/*+ disable_rules(A) */ SELECT 1", expected: ""},
+		{sql: "  SELECT /*+ exploration_budget(1s) */ 1", expected: "exploration_budget(1s)"},
+		{sql: "SELECT /* not a hint */ 1", expected: ""},
+		{sql: "SELECT * FROM t WHERE s = '/*+ x(y) */'", expected: ""},
+	} {
+		if actual := xform.ExtractHintComment(tc.sql); actual != tc.expected {
+			t.Errorf("%s: expected hint comment %q, got %q", tc.sql, tc.expected, actual)
+		}
+	}
+
+	for _, hints := range []string{
+		"disable_rules(NotARule)",
+		"disable_rules(GenerateIndexScans)",
+		"enable_rules(NotARule)",
+		"exploration_budget(1s, 2s)",
+		"exploration_budget(-1s)",
+		"no_such_hint(x)",
+		"disable_rules(GenerateConstrainedScans",
+		"barrier()",
+	} {
+		if _, err := xform.ParseStatementHints(hints); err == nil {
+			t.Errorf("%s: expected error", hints)
+		}
+	}
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+	optimize := func(hints string) opt.Operator {
+		evalCtx.OptimizerHints = hints
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.Op()
+	}
+	if op := optimize(""); op != opt.IndexJoinOp {
+		t.Errorf("expected index join without hints, got %s", op)
+	}
+	if op := optimize("DISABLE_RULES(GenerateConstrainedScans)"); op != opt.SelectOp {
+		t.Errorf("expected select when the hint disables constrained scans, got %s", op)
+	}
+
+	// A rule disabled by the session can be enabled for a single statement.
+	evalCtx.SessionData().OptimizerDisableRules = "GenerateConstrainedScans"
+	defer func() { evalCtx.SessionData().OptimizerDisableRules = "" }()
+	if op := optimize(""); op != opt.SelectOp {
+		t.Errorf("expected select when the session disables constrained scans, got %s", op)
+	}
+	if op := optimize("enable_rules(GenerateConstrainedScans) exploration_budget(1h)"); op != opt.IndexJoinOp {
+		t.Errorf("expected index join when the hint enables constrained scans, got %s", op)
+	}
+}
+
+// TestOnlyApplyRules tests that only the allowed rules and the essential rules
+// are applied when OnlyApplyRules is used.
+func TestOnlyApplyRules(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	for _, tc := range []struct {
+		rules    []opt.RuleName
+		expected opt.Operator
+	}{
+		{rules: nil, expected: opt.SelectOp},
+		{rules: []opt.RuleName{opt.GenerateConstrainedScans}, expected: opt.IndexJoinOp},
+	} {
+		var rules xform.RuleSet
+		for _, r := range tc.rules {
+			rules.Add(int(r))
+		}
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		o.OnlyApplyRules(rules)
+		var applied xform.RuleSet
+		o.NotifyOnAppliedRule(func(ruleName opt.RuleName, source, target opt.Expr) {
+			applied.Add(int(ruleName))
+		})
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Op() != tc.expected {
+			t.Errorf("rules %v: expected %s, got %s", tc.rules, tc.expected, root.Op())
+		}
+		applied.ForEach(func(i int) {
+			if r := opt.RuleName(i); r.IsExplore() && !rules.Contains(i) && r != opt.GenerateIndexScans {
+				t.Errorf("rules %v: unexpected rule %s applied", tc.rules, r)
+			}
+		})
+	}
+}
+
+// TestDisableExplorations tests that DisableExplorations returns the costed,
+// normalized input expression tree, with only the enforcers that it requires.
+func TestDisableExplorations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' AND true ORDER BY b")
+	o.DisableExplorations()
+	var explored bool
+	o.NotifyOnAppliedRule(func(ruleName opt.RuleName, source, target opt.Expr) {
+		if ruleName.IsExplore() {
+			explored = true
+		}
+	})
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explored {
+		t.Error("expected no exploration rules to be applied")
+	}
+
+	// The ordering can only be provided by a Sort enforcer, and the filter is
+	// not turned into a constrained scan of the index on c. It is still
+	// normalized, however, so that the true condition is removed.
+	if root.Op() != opt.SortOp {
+		t.Fatalf("expected sort, got %s", root.Op())
+	}
+	sel, ok := root.Child(0).(*memo.SelectExpr)
+	if !ok || sel.Input.Op() != opt.ScanOp {
+		t.Fatalf("expected select of a scan, got:\n%s", root)
+	}
+	if len(sel.Filters) != 1 {
+		t.Errorf("expected the filters to be normalized, got %d filters", len(sel.Filters))
+	}
+	if scan := sel.Input.(*memo.ScanExpr); scan.Index != cat.PrimaryIndex {
+		t.Errorf("expected scan of the primary index, got index %d", scan.Index)
+	}
+	if root.(memo.RelExpr).Cost() <= 0 {
+		t.Errorf("expected the expression tree to be costed")
+	}
+}
+
+// TestMatchedRuleContext tests that the callback set via
+// NotifyOnMatchedRuleContext is passed the expressions matched by exploration
+// rules, and can prevent a rule from being applied to them.
+func TestMatchedRuleContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+	var matched bool
+	o.NotifyOnMatchedRuleContext(func(match xform.RuleMatch) bool {
+		if !match.Rule.IsExplore() {
+			return true
+		}
+		if match.Source == nil || match.Required == nil {
+			t.Fatalf("%s: expected the match to have a source and required properties", match.Rule)
+		}
+		if match.Rule != opt.GenerateConstrainedScans {
+			return true
+		}
+		matched = true
+		if match.Source.Op() != opt.SelectOp {
+			t.Errorf("expected %s to match a select, got %s", match.Rule, match.Source.Op())
+		}
+		// Only allow constrained scans of tables other than abc.
+		scan := match.Source.Child(0).(*memo.ScanExpr)
+		return o.Memo().Metadata().Table(scan.Table).Name() != "abc"
+	})
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matched {
+		t.Errorf("expected GenerateConstrainedScans to be matched")
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected select when constrained scans of abc are rejected, got %s", root.Op())
+	}
+}
+
+// TestEnumeratePlansWithin tests that EnumeratePlansWithin returns distinct
+// plans for a multi-way join in order of increasing cost, starting with the
+// plan chosen by the optimizer, and that it only returns the plans within the
+// given factor of its cost. The groups of the join are reached from many
+// combinations of alternatives, so their plans are enumerated within many
+// different budgets.
+func TestEnumeratePlansWithin(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, joinTableDDLs(4)...)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	const query = `SELECT * FROM t1
+JOIN t2 ON t1.b = t2.a
+JOIN t3 ON t2.b = t3.a
+JOIN t4 ON t3.b = t4.a`
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	cost := o.Memo().RootExpr().(memo.RelExpr).Cost()
+
+	const factor = 1.5
+	plans, err := o.EnumeratePlansWithin(factor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) < 2 {
+		t.Fatalf("expected at least 2 plans, got %d", len(plans))
+	}
+	if plans[0].Cost.Less(cost) || cost.Less(plans[0].Cost) {
+		t.Errorf("expected first plan to cost %.2f, got %.2f", cost, plans[0].Cost)
+	}
+	seen := make(map[string]bool)
+	for i, p := range plans {
+		if i > 0 && p.Cost.Less(plans[i-1].Cost) {
+			t.Errorf("plan %d is cheaper than plan %d", i, i-1)
+		}
+		if (cost * factor).Less(p.Cost) {
+			t.Errorf("plan %d costs %.2f, more than %v times %.2f", i, p.Cost, factor, cost)
+		}
+		if seen[p.Fingerprint] {
+			t.Errorf("duplicate plan %s", p.Fingerprint)
+		}
+		seen[p.Fingerprint] = true
+	}
+
+	// A smaller factor returns a subset of the plans.
+	fewer, err := o.EnumeratePlansWithin(1.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fewer) == 0 || len(fewer) > len(plans) {
+		t.Fatalf("expected between 1 and %d plans, got %d", len(plans), len(fewer))
+	}
+	for i, p := range fewer {
+		if !seen[p.Fingerprint] {
+			t.Errorf("plan %d was not returned for factor %v: %s", i, factor, p.Fingerprint)
+		}
+	}
+
+	if _, err := o.EnumeratePlansWithin(0.5); err == nil {
+		t.Error("expected error for factor < 1")
+	}
+}
+
+// TestOptimizeTopK tests that OptimizeTopK returns distinct plans in order of
+// increasing cost, starting with the plan chosen by the optimizer.
+func TestOptimizeTopK(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY a")
+	plans, err := o.OptimizeTopK(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) < 2 || len(plans) > 3 {
+		t.Fatalf("expected 2 or 3 plans, got %d", len(plans))
+	}
+	if root := o.Memo().RootExpr(); plans[0].Root.Expr != root {
+		t.Errorf("expected first plan to be the chosen plan %s, got %s", root.Op(), plans[0].Root.Expr.Op())
+	}
+	if cost := o.Memo().RootExpr().(memo.RelExpr).Cost(); plans[0].Cost.Less(cost) || cost.Less(plans[0].Cost) {
+		t.Errorf("expected first plan to cost %.2f, got %.2f", cost, plans[0].Cost)
+	}
+	seen := make(map[string]bool)
+	for i, p := range plans {
+		if i > 0 && p.Cost.Less(plans[i-1].Cost) {
+			t.Errorf("plan %d is cheaper than plan %d", i, i-1)
+		}
+		if seen[p.Fingerprint] {
+			t.Errorf("duplicate plan %s", p.Fingerprint)
+		}
+		seen[p.Fingerprint] = true
+	}
+
+	if _, err := o.OptimizeTopK(0); err == nil {
+		t.Error("expected error for k=0")
+	}
+}
+
+// TestPlanBaselineFor tests that the baseline of a plan returned by
+// OptimizeTopK forces the optimizer to choose that plan.
+func TestPlanBaselineFor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	const query = "SELECT * FROM abc WHERE c = 'foo' ORDER BY a"
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	plans, err := o.OptimizeTopK(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) < 2 {
+		t.Fatalf("expected at least 2 plans, got %d", len(plans))
+	}
+
+	for i := range plans {
+		baseline := o.PlanBaselineFor(&plans[i])
+		if i == 0 {
+			chosen, err := o.CapturePlanBaseline()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if baseline.Fingerprint() != chosen.Fingerprint() {
+				t.Errorf("expected the first plan to be the chosen plan")
+			}
+		}
+
+		var pinned xform.Optimizer
+		testutils.BuildQuery(t, &pinned, catalog, &evalCtx, query)
+		if err := pinned.SetPlanBaseline(baseline); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pinned.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		if !pinned.PlanBaselineReproduced() {
+			t.Errorf("expected plan %d to be reproduced", i)
+		}
+	}
+}
+
+// TestCostDistribution tests that the costs of the alternatives for the root
+// group are recorded when EnableCostDistribution is called.
+func TestCostDistribution(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY a")
+	if o.CostDistribution() != nil {
+		t.Fatal("expected no cost distribution before it is enabled")
+	}
+	o.EnableCostDistribution()
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := o.CostDistribution()
+	if len(d.Costs) < 2 {
+		t.Fatalf("expected at least 2 alternatives, got %d", len(d.Costs))
+	}
+	if cost := root.(memo.RelExpr).Cost(); d.Chosen.Less(cost) || cost.Less(d.Chosen) {
+		t.Errorf("expected chosen cost %.2f, got %.2f", cost, d.Chosen)
+	}
+	if d.Min().Less(d.Chosen) || d.ChosenPercentile() != 0 {
+		t.Errorf("expected the cheapest alternative to be chosen:\n%s", d)
+	}
+	if d.Max() == d.Min() {
+		t.Errorf("expected alternatives with different costs:\n%s", d)
+	}
+	total := 0
+	for _, n := range d.Histogram(4) {
+		total += n
+	}
+	if total != len(d.Costs) {
+		t.Errorf("expected histogram to count %d alternatives, got %d", len(d.Costs), total)
+	}
+	if n := d.WithinFactor(1); n < 1 {
+		t.Errorf("expected at least one alternative with the lowest cost, got %d", n)
+	}
+}
+
+// TestPlanningProfiles tests that queries are classified by their shape, and
+// that the planning profile for the shape is applied.
+func TestPlanningProfiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		"CREATE TABLE fact (id INT PRIMARY KEY, d1 INT, d2 INT, v INT)",
+		`ALTER TABLE fact INJECT STATISTICS '[
+			{"columns": ["id"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000}
+		]'`,
+		"CREATE TABLE dim1 (id INT PRIMARY KEY, name STRING)",
+		`ALTER TABLE dim1 INJECT STATISTICS '[
+			{"columns": ["id"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100, "distinct_count": 100}
+		]'`,
+		"CREATE TABLE dim2 (id INT PRIMARY KEY, name STRING)",
+		`ALTER TABLE dim2 INJECT STATISTICS '[
+			{"columns": ["id"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 1000, "distinct_count": 1000}
+		]'`,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	testCases := []struct {
+		query string
+		shape xform.QueryShape
+	}{
+		{query: "SELECT * FROM abc WHERE a = 1", shape: xform.PointLookupQuery},
+		{query: "UPDATE abc SET b = 1 WHERE a = 1", shape: xform.PointLookupQuery},
+		{query: "SELECT * FROM abc WHERE b = 1", shape: xform.GeneralQuery},
+		{query: "SELECT c, count(*) FROM abc GROUP BY c", shape: xform.AnalyticalQuery},
+		{
+			query: "SELECT * FROM fact JOIN dim1 ON fact.d1 = dim1.id JOIN dim2 ON fact.d2 = dim2.id",
+			shape: xform.StarJoinQuery,
+		},
+		{query: "SELECT * FROM dim1 JOIN dim2 ON dim1.id = dim2.id", shape: xform.GeneralQuery},
+	}
+	for _, tc := range testCases {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, tc.query)
+		o.SetPlanningProfiles(xform.DefaultPlanningProfiles())
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		if shape := o.QueryShape(); shape != tc.shape {
+			t.Errorf("%s: expected %s, got %s", tc.query, tc.shape, shape)
+		}
+
+		// Only point lookups are restricted by the default profiles.
+		restricted := o.DisabledRules().Contains(int(opt.GenerateMergeJoins))
+		if expected := tc.shape == xform.PointLookupQuery; restricted != expected {
+			t.Errorf("%s: expected restricted=%t, got %t", tc.query, expected, restricted)
+		}
+	}
+}
+
+// TestCostCeiling tests that Optimize fails when the cost of the lowest cost
+// plan exceeds the cost ceiling.
+func TestCostCeiling(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc WHERE b = 1"
+
+	optimize := func(ceiling float64) (memo.Cost, error) {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if ceiling >= 0 {
+			o.SetCostCeiling(ceiling)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			return 0, err
+		}
+		return root.(memo.RelExpr).Cost(), nil
+	}
+	cost, err := optimize(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A ceiling above the cost of the plan has no effect.
+	if c, err := optimize(float64(cost) * 2); err != nil {
+		t.Fatal(err)
+	} else if cost.Less(c) || c.Less(cost) {
+		t.Errorf("expected cost %.2f, got %.2f", cost, c)
+	}
+
+	// A ceiling below the cost of the plan causes an error.
+	checkError := func(err error) {
+		t.Helper()
+		if e, ok := xform.GetOptimizationError(err); !ok || e.Kind != xform.CostCeilingExceededError {
+			t.Errorf("expected cost ceiling exceeded error, got %v", err)
+		}
+		if code := pgerror.GetPGCode(err); code != pgcode.ProgramLimitExceeded {
+			t.Errorf("expected code %s, got %s", pgcode.ProgramLimitExceeded, code)
+		}
+	}
+	_, err = optimize(float64(cost) / 2)
+	checkError(err)
+
+	// The ceiling is taken from the cluster setting by default.
+	ctx := context.Background()
+	sv := &evalCtx.Settings.SV
+	xform.MaxPlanCostSetting.Override(ctx, sv, float64(cost)/2)
+	defer xform.MaxPlanCostSetting.Override(ctx, sv, 0)
+	_, err = optimize(-1)
+	checkError(err)
+	if err := xform.CheckPlanCost(opt.SelectOp, cost, xform.MaxPlanCostSetting.Get(sv)); err == nil {
+		t.Error("expected CheckPlanCost to fail")
+	}
+}
+
+// TestOptimizerPool tests that an optimizer that is returned to the pool can
+// be reused to optimize a different statement.
+func TestOptimizerPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var pool xform.OptimizerPool
+	for i, tc := range []struct {
+		query    string
+		expected opt.Operator
+	}{
+		{query: "SELECT * FROM abc WHERE c = 'foo'", expected: opt.IndexJoinOp},
+		{query: "SELECT a FROM abc WHERE a = 1", expected: opt.ScanOp},
+		{query: "SELECT * FROM abc WHERE c = 'foo'", expected: opt.IndexJoinOp},
+	} {
+		o := pool.Get()
+		testutils.BuildQuery(t, o, catalog, &evalCtx, tc.query)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Op() != tc.expected {
+			t.Errorf("%d: expected %s, got %s", i, tc.expected, root.Op())
+		}
+		pool.Put(o)
+	}
+}
+
+// TestOptimizeForCrossCheck tests that the normalized plan returned for cross
+// checking is not explored, while the optimized plan is.
+func TestOptimizeForCrossCheck(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	plans, err := o.OptimizeForCrossCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized := plans.NormalizedRoot.(memo.RelExpr)
+	optimized := plans.OptimizedRoot.(memo.RelExpr)
+	if normalized.Memo() == optimized.Memo() {
+		t.Fatal("expected the plans to be in different memos")
+	}
+
+	// The normalized plan sorts a filtered full scan, while the optimized plan
+	// sorts an index join over a constrained scan of the secondary index.
+	if normalized.Op() != opt.SortOp || normalized.Child(0).Op() != opt.SelectOp {
+		t.Errorf("expected sort over select in the normalized plan, got %s over %s",
+			normalized.Op(), normalized.Child(0).Op())
+	}
+	if optimized.Op() != opt.SortOp || optimized.Child(0).Op() != opt.IndexJoinOp {
+		t.Errorf("expected sort over index join in the optimized plan, got %s over %s",
+			optimized.Op(), optimized.Child(0).Op())
+	}
+	if !normalized.Relational().OutputCols.Equals(optimized.Relational().OutputCols) {
+		t.Errorf("expected the plans to have the same output columns, got %s and %s",
+			normalized.Relational().OutputCols, optimized.Relational().OutputCols)
+	}
+	if !plans.Normalized.Memo().IsOptimized() || !o.Memo().IsOptimized() {
+		t.Error("expected both memos to be optimized")
+	}
+}
+
+// TestNoFullScan tests that the disallow_full_table_scans session setting
+// makes the optimizer avoid full table scans when there is an alternative, and
+// still plan one when there is not.
+func TestNoFullScan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	evalCtx.SessionData().DisallowFullTableScans = true
+
+	// hasFullScan returns true if the plan contains an unconstrained scan.
+	var hasFullScan func(md *opt.Metadata, e opt.Expr) bool
+	hasFullScan = func(md *opt.Metadata, e opt.Expr) bool {
+		if scan, ok := e.(*memo.ScanExpr); ok && scan.IsUnfiltered(md) {
+			return true
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if hasFullScan(md, e.Child(i)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The table has no statistics, so every full scan of it is large. A full
+	// scan of the table is the cheapest plan for a filter with low selectivity,
+	// but a constrained scan of the secondary index is chosen instead.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c > 'a'")
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.Memo().RootProps().NoFullScan {
+		t.Error("expected the root to require no full scan")
+	}
+	if hasFullScan(o.Memo().Metadata(), root) {
+		t.Errorf("expected a plan without a full scan, got %s", root.Op())
+	}
+
+	// A full scan is still planned if there is no alternative.
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc")
+	root, err = o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFullScan(o.Memo().Metadata(), root) {
+		t.Errorf("expected a full scan, got %s", root.Op())
+	}
+}
+
+// TestPlanningReport tests that the planning report describes the memo once
+// the query has been optimized, including after the memo is detached, and that
+// it counts the times the memo expression budget was hit.
+func TestPlanningReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+
+	for _, tc := range []struct {
+		maxExprs   int64
+		budgetHits int
+	}{
+		{maxExprs: 0, budgetHits: 0},
+		{maxExprs: 1, budgetHits: 1},
+	} {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().OptimizerMaxMemoExprs = tc.maxExprs
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		if o.PlanningReport().Optimized {
+			t.Errorf("max %d: expected no report before Optimize", tc.maxExprs)
+		}
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The report remains available once the memo is detached.
+		o.DetachMemo()
+		report := o.PlanningReport()
+		if !report.Optimized || report.MemoExprs == 0 || report.GroupStates == 0 {
+			t.Errorf("max %d: expected the memo to be described, got %s", tc.maxExprs, report)
+		}
+		if report.BudgetHits != tc.budgetHits {
+			t.Errorf("max %d: expected %d budget hits, got %s", tc.maxExprs, tc.budgetHits, report)
+		}
+		if tc.maxExprs == 0 && report.RulesApplied == 0 {
+			t.Errorf("expected rules to be applied, got %s", report)
+		}
+	}
+}
+
+// TestSpeculativeEnforcers tests that the input of a partial Sort is optimized
+// speculatively, without trying ordering enforcers, and that a speculative
+// group state is promoted when another expression requires the same ordering.
+func TestSpeculativeEnforcers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	// The index on c provides a prefix of the required ordering, so the input
+	// of the partial Sort is optimized speculatively with an ordering on c.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc ORDER BY c, b")
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Op() != opt.SortOp {
+		t.Errorf("expected a sort, got %s", root.Op())
+	}
+	if o.Metrics().SpeculativeStates == 0 {
+		t.Error("expected a speculative group state")
+	}
+
+	// The ordering enforcers of the speculative state were deferred, so the
+	// state that requires only the prefix is not provided by another Sort.
+	o.ForEachGroupState(func(state xform.GroupState) {
+		if len(state.Required.Ordering.Columns) != 1 || state.Best == nil {
+			return
+		}
+		if state.Best.Op() == opt.SortOp {
+			t.Errorf("expected the prefix ordering to be provided natively, got %s", state.Best.Op())
+		}
+	})
+	if o.Metrics().PromotedStates != 0 {
+		t.Errorf("expected no promoted states, got %d", o.Metrics().PromotedStates)
+	}
+
+	// The streaming group-by with ordering +w requires the same ordering of its
+	// input as the partial Sort that provides +w,+u, so the speculative state
+	// is promoted and its Sort enforcer is tried.
+	catalog = newTestCatalog(t,
+		"CREATE TABLE kuvw (k INT PRIMARY KEY, u INT, v INT, w INT, "+
+			"INDEX uvw(u,v,w), INDEX wvu(w,v,u), INDEX vw(v,w) STORING (u), INDEX w(w) STORING (u,v))",
+	)
+	testutils.BuildQuery(t, &o, catalog, &evalCtx,
+		"SELECT sum(k) FROM (SELECT * FROM kuvw WHERE u=v) GROUP BY u,w",
+	)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if o.Metrics().PromotedStates == 0 {
+		t.Error("expected a promoted group state")
+	}
+	var promotedSort bool
+	o.ForEachGroupState(func(state xform.GroupState) {
+		if len(state.Required.Ordering.Columns) == 1 && state.Best != nil && state.Best.Op() == opt.SortOp {
+			promotedSort = true
+		}
+	})
+	if !promotedSort {
+		t.Error("expected the promoted state to be provided by a sort")
+	}
+}
+
+// TestForEachGroupState tests that ForEachGroupState visits the state of every
+// optimized group, including the root group with its lowest cost expression.
+func TestForEachGroupState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY a")
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootExpr := root.(memo.RelExpr)
+
+	count := 0
+	foundRoot := false
+	o.ForEachGroupState(func(state xform.GroupState) {
+		count++
+		if state.Group != state.Group.FirstExpr() {
+			t.Errorf("expected first expression of group, got %s", state.Group.Op())
+		}
+		if state.Group != rootExpr.FirstExpr() || state.Required != o.Memo().RootProps() {
+			return
+		}
+		foundRoot = true
+		if state.Best != rootExpr {
+			t.Errorf("expected best expression %s, got %s", rootExpr.Op(), state.Best.Op())
+		}
+		if state.Cost != rootExpr.Cost() {
+			t.Errorf("expected cost %.2f, got %.2f", rootExpr.Cost(), state.Cost)
+		}
+		if !state.FullyOptimized {
+			t.Error("expected root group to be fully optimized")
+		}
+	})
+	if !foundRoot {
+		t.Error("expected state for root group")
+	}
+	if count < 2 {
+		t.Errorf("expected states for multiple groups, got %d", count)
+	}
+}
+
+// TestMetrics tests that the optimizer metrics count the groups, expressions,
+// enforcers and group states of the memo, and record the time spent.
+func TestMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := o.Metrics()
+	if metrics.Groups < 2 {
+		t.Errorf("expected multiple groups, got %d", metrics.Groups)
+	}
+	if metrics.Exprs <= metrics.Groups {
+		t.Errorf("expected more than %d expressions, got %d", metrics.Groups, metrics.Exprs)
+	}
+	if metrics.Enforcers == 0 {
+		t.Error("expected a sort enforcer to be costed")
+	}
+	states := 0
+	o.ForEachGroupState(func(xform.GroupState) { states++ })
+	if metrics.GroupStates != states {
+		t.Errorf("expected %d group states, got %d", states, metrics.GroupStates)
+	}
+	if metrics.Passes < metrics.GroupStates {
+		t.Errorf("expected at least one pass per group state, got %d", metrics.Passes)
+	}
+	if metrics.ExploreTime <= 0 || metrics.CostTime < 0 {
+		t.Errorf("expected explore and cost times to be recorded, got %s and %s",
+			metrics.ExploreTime, metrics.CostTime)
+	}
+}
+
+// TestWhyNot tests that WhyNot reports the cost of a plan shape that was not
+// chosen, or the rules that would generate it if it was never generated.
+func TestWhyNot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+
+	// The optimizer chooses a constrained scan of the secondary index, so a
+	// full scan of the primary index is more expensive.
+	report, err := o.WhyNot(xform.PlanShape{
+		Op:       opt.SelectOp,
+		Children: []xform.PlanShape{{Op: opt.ScanOp, Table: "abc", Index: "abc_pkey"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Generated || report.Forced == nil {
+		t.Fatalf("expected forced plan, got:\n%s", report)
+	}
+	if report.Forced.Expr.Op() != opt.SelectOp || report.Forced.Children[0].Expr.Op() != opt.ScanOp {
+		t.Errorf("unexpected forced plan:\n%s", report)
+	}
+	if !report.Chosen.Cost.Less(report.Forced.Cost) {
+		t.Errorf("expected forced plan to be more expensive:\n%s", report)
+	}
+
+	// A merge join is never generated for a single table query.
+	report, err = o.WhyNot(xform.PlanShape{Op: opt.MergeJoinOp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Generated || report.Forced != nil {
+		t.Fatalf("expected merge join not to be generated, got:\n%s", report)
+	}
+	if len(report.Rules) != 1 || report.Rules[0] != opt.GenerateMergeJoins {
+		t.Errorf("expected GenerateMergeJoins, got %v", report.Rules)
+	}
+}
+
+// TestDiffMemos tests that DiffMemos reports the groups that differ between
+// the memos of two optimizations of the same query.
+func TestDiffMemos(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(disabled ...opt.RuleName) *memo.Memo {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		var rules xform.RuleSet
+		for _, r := range disabled {
+			rules.Add(int(r))
+		}
+		o.DisableRules(rules)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return o.Memo()
+	}
+
+	a := optimize()
+	if diff := xform.DiffMemos(a, optimize()); !diff.Empty() {
+		t.Errorf("expected no differences, got:\n%s", diff)
+	}
+
+	// Without GenerateConstrainedScans, the index join is never generated, so
+	// the root group has one fewer member and a different lowest cost
+	// expression.
+	diff := xform.DiffMemos(a, optimize(opt.GenerateConstrainedScans))
+	if diff.Empty() {
+		t.Fatal("expected differences")
+	}
+	root := diff.Groups[0]
+	if root.Group != 1 || !root.InA || !root.InB {
+		t.Fatalf("expected root group to differ, got:\n%s", diff)
+	}
+	if len(root.Removed) != 1 || !strings.HasPrefix(root.Removed[0], "(index-join") {
+		t.Errorf("expected index join to be removed, got:\n%s", diff)
+	}
+	if len(root.Best) != 1 || !root.Best[0].CostA.Less(root.Best[0].CostB) {
+		t.Errorf("expected more expensive lowest cost expression, got:\n%s", diff)
+	}
+}
+
+// testScheduler is an ExplorationScheduler that applies GenerateConstrainedScans
+// after every other exploration rule.
+type testScheduler struct{}
+
+func (testScheduler) RulePriority(rule opt.RuleName) int {
+	if rule == opt.GenerateConstrainedScans {
+		return -1
+	}
+	return 0
+}
+
+func (testScheduler) GroupPriority(grp memo.RelExpr) float64 {
+	return 0
+}
+
+// TestExplorationScheduler tests that an exploration scheduler changes the
+// order in which rules are applied, which matters when exploration is bounded
+// by a budget, but not the plan of a fully explored memo.
+func TestExplorationScheduler(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(scheduler xform.ExplorationScheduler, budget int) opt.Operator {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		if budget >= 0 {
+			o.SetExplorationBudgetFunc(func(int) int { return budget })
+		}
+		if scheduler != nil {
+			o.SetExplorationScheduler(scheduler)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.Op()
+	}
+
+	// Schedulers change the order in which rules are applied, but not the plan
+	// once the memo is fully explored.
+	for _, s := range []xform.ExplorationScheduler{xform.DefaultExplorationScheduler, testScheduler{}} {
+		if op := optimize(s, -1 /* budget */); op != opt.IndexJoinOp {
+			t.Errorf("expected %s, got %s", opt.IndexJoinOp, op)
+		}
+	}
+
+	// Find the smallest budget for which the constrained scan is generated,
+	// and check that deferring GenerateConstrainedScans prevents it from being
+	// applied within that budget.
+	budget := 0
+	for optimize(nil /* scheduler */, budget) != opt.IndexJoinOp {
+		budget++
+		if budget > 10 {
+			t.Fatal("index join not generated")
+		}
+	}
+	if op := optimize(testScheduler{}, budget); op != opt.SelectOp {
+		t.Errorf("expected %s with budget %d, got %s", opt.SelectOp, budget, op)
+	}
+}
+
+// TestRandomExplorationScheduler tests that applying the exploration rules in
+// a random order does not change the cost of the lowest cost plan.
+func TestRandomExplorationScheduler(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+		"CREATE TABLE xy (x INT PRIMARY KEY, y INT)",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc JOIN xy ON b = x WHERE c = 'foo' ORDER BY a"
+
+	optimize := func(scheduler xform.ExplorationScheduler) memo.Cost {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if scheduler != nil {
+			o.SetExplorationScheduler(scheduler)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+
+	expected := optimize(nil /* scheduler */)
+	for seed := int64(1); seed <= 5; seed++ {
+		actual := optimize(xform.NewRandomExplorationScheduler(seed))
+		if math.Abs(float64(actual-expected)) > 1e-9*float64(expected) {
+			t.Errorf("seed %d: expected cost %.2f, got %.2f", seed, expected, actual)
+		}
+	}
+}
+
+// testNoticeSender is a tree.ClientNoticeSender that records notices.
+type testNoticeSender struct {
+	notices []pgnotice.Notice
+}
+
+func (s *testNoticeSender) BufferClientNotice(_ context.Context, notice pgnotice.Notice) {
+	s.notices = append(s.notices, notice)
+}
+
+// TestMaxMemoExprs tests that the optimizer_max_memo_exprs session setting
+// stops exploration once the memo has that many expressions, and that a notice
+// is sent when the limit is reached.
+func TestMaxMemoExprs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+
+	for _, tc := range []struct {
+		maxExprs int64
+		expected opt.Operator
+		limited  bool
+	}{
+		{maxExprs: 0, expected: opt.IndexJoinOp, limited: false},
+		{maxExprs: 1, expected: opt.SelectOp, limited: true},
+		{maxExprs: 1000, expected: opt.IndexJoinOp, limited: false},
+	} {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().OptimizerMaxMemoExprs = tc.maxExprs
+		var notices testNoticeSender
+		evalCtx.ClientNoticeSender = &notices
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Op() != tc.expected {
+			t.Errorf("max %d: expected %s, got %s", tc.maxExprs, tc.expected, root.Op())
+		}
+		if o.MemoExprLimitReached() != tc.limited {
+			t.Errorf("max %d: expected limit reached to be %t", tc.maxExprs, tc.limited)
+		}
+		if tc.limited != (len(notices.notices) == 1) {
+			t.Errorf("max %d: unexpected notices %v", tc.maxExprs, notices.notices)
+		}
+	}
+}
+
+// TestRuleCaps tests that a rule stops being applied once it reaches the cap
+// set via SetRuleCaps, and that a notice is sent when a rule is capped.
+func TestRuleCaps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+
+	for _, tc := range []struct {
+		cap      int
+		expected opt.Operator
+		capped   bool
+	}{
+		{cap: 0, expected: opt.SelectOp, capped: true},
+		{cap: 1, expected: opt.IndexJoinOp, capped: false},
+	} {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		var notices testNoticeSender
+		evalCtx.ClientNoticeSender = &notices
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		o.SetRuleCaps(map[opt.RuleName]int{opt.GenerateConstrainedScans: tc.cap})
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root.Op() != tc.expected {
+			t.Errorf("cap %d: expected %s, got %s", tc.cap, tc.expected, root.Op())
+		}
+		if o.CappedRules().Contains(int(opt.GenerateConstrainedScans)) != tc.capped {
+			t.Errorf("cap %d: expected capped to be %t", tc.cap, tc.capped)
+		}
+		if tc.capped != (len(notices.notices) == 1) {
+			t.Errorf("cap %d: unexpected notices %v", tc.cap, notices.notices)
+		}
+	}
+}
+
+// scaledCardinalityEstimator scales the row counts estimated by the default
+// estimator, and counts the number of estimates.
+type scaledCardinalityEstimator struct {
+	scale float64
+	calls int
+}
+
+func (e *scaledCardinalityEstimator) EstimateRowCount(rel memo.RelExpr) float64 {
+	e.calls++
+	return e.scale * xform.DefaultCardinalityEstimator.EstimateRowCount(rel)
+}
+
+// TestCardinalityEstimator tests that the default coster consults the
+// estimator set via SetCardinalityEstimator.
+func TestCardinalityEstimator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(estimator xform.CardinalityEstimator) memo.Cost {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo'")
+		if estimator != nil {
+			o.SetCardinalityEstimator(estimator)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+
+	defaultCost := optimize(nil)
+	same := &scaledCardinalityEstimator{scale: 1}
+	if cost := optimize(same); cost != defaultCost || same.calls == 0 {
+		t.Errorf("expected cost %v with %d calls, got %v", defaultCost, same.calls, cost)
+	}
+	larger := &scaledCardinalityEstimator{scale: 10}
+	if cost := optimize(larger); !defaultCost.Less(cost) {
+		t.Errorf("expected cost higher than %v, got %v", defaultCost, cost)
+	}
+
+	var o xform.Optimizer
+	o.Init(&evalCtx, catalog)
+	o.SetCardinalityEstimator(larger)
+	o.SetCardinalityEstimator(nil)
+	if o.CardinalityEstimator() != xform.DefaultCardinalityEstimator {
+		t.Errorf("expected the default estimator to be restored")
+	}
+}
+
+// TestJoinSelectivityEstimator tests that the statistics builder consults the
+// estimator set via Memo.SetJoinSelectivityEstimator for the selectivity of
+// join equalities, and falls back to its own estimate if the estimator cannot
+// provide one.
+func TestJoinSelectivityEstimator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE xy (x INT PRIMARY KEY, y INT)",
+		`ALTER TABLE xy INJECT STATISTICS '[
+			{"columns": ["x"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 1000, "distinct_count": 1000}
+		]'`,
+		"CREATE TABLE uv (u INT PRIMARY KEY, v INT)",
+		`ALTER TABLE uv INJECT STATISTICS '[
+			{"columns": ["u"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100, "distinct_count": 100}
+		]'`,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	rowCount := func(estimator memo.JoinSelectivityEstimator) float64 {
+		var o xform.Optimizer
+		o.Init(&evalCtx, catalog)
+		if estimator != nil {
+			o.Memo().SetJoinSelectivityEstimator(estimator)
+		}
+		if err := testutils.BuildInitializedQuery(&o, catalog, "SELECT * FROM xy JOIN uv ON x = u"); err != nil {
+			t.Fatal(err)
+		}
+		return o.Memo().RootExpr().(memo.RelExpr).Relational().Stats.RowCount
+	}
+
+	defaultRowCount := rowCount(nil)
+	fixed := &fixedJoinSelectivityEstimator{selectivity: 0.5, ok: true}
+	if count := rowCount(fixed); count <= defaultRowCount {
+		t.Errorf("expected row count higher than %v, got %v", defaultRowCount, count)
+	}
+	if fixed.calls == 0 || len(fixed.leftCols) != 1 || len(fixed.rightCols) != 1 {
+		t.Errorf("expected one equality, got %v = %v", fixed.leftCols, fixed.rightCols)
+	}
+	unknown := &fixedJoinSelectivityEstimator{selectivity: 0.5}
+	if count := rowCount(unknown); count != defaultRowCount || unknown.calls == 0 {
+		t.Errorf("expected row count %v with %d calls, got %v", defaultRowCount, unknown.calls, count)
+	}
+}
+
+// fixedJoinSelectivityEstimator is a memo.JoinSelectivityEstimator that
+// returns the same selectivity for every join, and records the columns of the
+// last call.
+type fixedJoinSelectivityEstimator struct {
+	selectivity         float64
+	ok                  bool
+	calls               int
+	leftCols, rightCols opt.ColList
+}
+
+func (e *fixedJoinSelectivityEstimator) JoinSelectivity(
+	md *opt.Metadata, join memo.RelExpr, leftCols, rightCols opt.ColList,
+) (float64, bool) {
+	e.calls++
+	e.leftCols, e.rightCols = leftCols, rightCols
+	return e.selectivity, e.ok
+}
+
+// TestStatsUncertaintyPenalty tests that the stats uncertainty penalty biases
+// the optimizer away from a hash join whose build side has stale statistics,
+// and toward a lookup join into the same table.
+func TestStatsUncertaintyPenalty(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	fresh := time.Now().UTC().Format("2006-01-02 15:04:05.00000+00:00")
+	catalog := newTestCatalog(t,
+		"CREATE TABLE small (k INT PRIMARY KEY, x INT)",
+		fmt.Sprintf(`ALTER TABLE small INJECT STATISTICS '[
+			{"columns": ["k"], "created_at": "%s", "row_count": 100, "distinct_count": 100}
+		]'`, fresh),
+		"CREATE TABLE large (k INT PRIMARY KEY, y INT, INDEX (y))",
+		`ALTER TABLE large INJECT STATISTICS '[
+			{"columns": ["k"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10, "distinct_count": 10},
+			{"columns": ["y"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10, "distinct_count": 10}
+		]'`,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(penalty xform.StatsUncertaintyPenalty) memo.RelExpr {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM small JOIN large ON x = y")
+		o.SetStatsUncertaintyPenalty(penalty)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr)
+	}
+
+	// The stale statistics make the large table look small, so it is used as
+	// the build side of a hash join.
+	if root := optimize(xform.StatsUncertaintyPenalty{}); root.Op() == opt.LookupJoinOp {
+		t.Errorf("expected hash join without penalty, got:\n%s", root)
+	}
+	// Statistics are only stale if they are older than StaleAge.
+	if root := optimize(xform.StatsUncertaintyPenalty{Penalty: 100, StaleAge: 100000 * time.Hour}); root.Op() == opt.LookupJoinOp {
+		t.Errorf("expected hash join with recent statistics, got:\n%s", root)
+	}
+	if root := optimize(xform.StatsUncertaintyPenalty{Penalty: 100, StaleAge: time.Hour}); root.Op() != opt.LookupJoinOp {
+		t.Errorf("expected lookup join with penalty, got:\n%s", root)
+	}
+}
+
+// TestWarnings tests that warnings registered during optimization can be
+// retrieved, and are sent to the client as notices.
+func TestWarnings(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT)",
+		`ALTER TABLE xyz INJECT STATISTICS '[
+			{"columns": ["x"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10, "distinct_count": 10}
+		]'`,
+	)
+
+	optimize := func(query string, setup func(o *xform.Optimizer)) ([]xform.Warning, []pgnotice.Notice) {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		var notices testNoticeSender
+		evalCtx.ClientNoticeSender = &notices
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		setup(&o)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return o.Warnings(), notices.notices
+	}
+	kinds := func(warnings []xform.Warning) []xform.WarningKind {
+		var res []xform.WarningKind
+		for _, w := range warnings {
+			res = append(res, w.Kind)
+		}
+		return res
+	}
+
+	// Statistics warnings are only raised once they are enabled.
+	const query = "SELECT * FROM abc JOIN xyz ON a = x"
+	if warnings, notices := optimize(query, func(*xform.Optimizer) {}); len(warnings) != 0 || len(notices) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+	warnings, notices := optimize(query, func(o *xform.Optimizer) {
+		o.EnableStatisticsWarnings(0 /* staleAge */)
+	})
+	if k := kinds(warnings); fmt.Sprint(k) != fmt.Sprint([]xform.WarningKind{xform.MissingStatisticsWarning}) {
+		t.Errorf("expected missing statistics warning, got %v", warnings)
+	}
+	if len(notices) != 1 {
+		t.Errorf("expected one notice, got %v", notices)
+	}
+	warnings, _ = optimize(query, func(o *xform.Optimizer) {
+		o.EnableStatisticsWarnings(time.Hour)
+	})
+	expected := []xform.WarningKind{xform.MissingStatisticsWarning, xform.StaleStatisticsWarning}
+	if k := kinds(warnings); fmt.Sprint(k) != fmt.Sprint(expected) {
+		t.Errorf("expected missing and stale statistics warnings, got %v", warnings)
+	}
+
+	// A budget that stops exploration raises a single warning, although it is
+	// reached for each group.
+	warnings, _ = optimize(query, func(o *xform.Optimizer) {
+		o.SetExplorationBudgetFunc(func(int) int { return 0 })
+	})
+	if k := kinds(warnings); fmt.Sprint(k) != fmt.Sprint([]xform.WarningKind{xform.BudgetExceededWarning}) {
+		t.Errorf("expected budget exceeded warning, got %v", warnings)
+	}
+}
+
+// TestNearTieRandomization tests that SetNearTieRandomization chooses among
+// plans whose costs are nearly tied, deterministically for a given seed.
+func TestNearTieRandomization(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+
+	optimize := func(epsilon float64, seed int64) (plan string, choices int) {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		o.SetNearTieRandomization(epsilon, seed)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return memo.FormatExpr(root, memo.ExprFmtHideAll, o.Memo(), catalog), o.NearTieChoices()
+	}
+
+	// With an epsilon of zero, the lowest cost plan is always chosen.
+	best, choices := optimize(0, 1)
+	if choices != 0 {
+		t.Errorf("expected no near tie choices, got %d", choices)
+	}
+
+	// With a huge epsilon, every candidate is a near tie. The same seed always
+	// chooses the same plan, and some seed chooses a more expensive plan.
+	var randomized bool
+	for seed := int64(1); seed <= 20; seed++ {
+		plan, choices := optimize(1e6, seed)
+		if again, _ := optimize(1e6, seed); again != plan {
+			t.Errorf("seed %d: expected the same plan, got:\n%s\nand:\n%s", seed, plan, again)
+		}
+		if plan != best {
+			randomized = true
+			if choices == 0 {
+				t.Errorf("seed %d: expected near tie choices for plan:\n%s", seed, plan)
+			}
+		}
+	}
+	if !randomized {
+		t.Errorf("expected some seed to choose a plan other than:\n%s", best)
+	}
+}
+
+// TestPlanGuardrail tests that the optimizer_plan_guardrail session setting
+// reports large full scans and cross joins in the chosen plan, and either
+// warns about them or rejects the plan.
+func TestPlanGuardrail(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		`ALTER TABLE abc INJECT STATISTICS '[
+			{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000}
+		]'`,
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT)",
+		`ALTER TABLE xyz INJECT STATISTICS '[
+			{"columns": ["x"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10, "distinct_count": 10}
+		]'`,
+	)
+
+	for _, tc := range []struct {
+		query    string
+		expected []xform.GuardrailKind
+	}{
+		{query: "SELECT * FROM abc WHERE a = 1"},
+		{query: "SELECT * FROM xyz"},
+		{query: "SELECT * FROM xyz AS x1, xyz AS x2"},
+		{query: "SELECT * FROM abc", expected: []xform.GuardrailKind{xform.FullScanGuardrail}},
+		{
+			query:    "SELECT * FROM abc, xyz",
+			expected: []xform.GuardrailKind{xform.CrossJoinGuardrail, xform.FullScanGuardrail},
+		},
+	} {
+		for _, mode := range []sessiondatapb.PlanGuardrailMode{
+			sessiondatapb.PlanGuardrailOff,
+			sessiondatapb.PlanGuardrailWarn,
+			sessiondatapb.PlanGuardrailError,
+		} {
+			evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+			evalCtx.SessionData().OptimizerPlanGuardrail = mode
+			evalCtx.SessionData().LargeFullScanRows = 1000
+			var notices testNoticeSender
+			evalCtx.ClientNoticeSender = &notices
+
+			var o xform.Optimizer
+			testutils.BuildQuery(t, &o, catalog, &evalCtx, tc.query)
+			_, err := o.Optimize()
+
+			expected := tc.expected
+			if mode == sessiondatapb.PlanGuardrailOff {
+				expected = nil
+			}
+			var kinds []xform.GuardrailKind
+			for _, v := range o.GuardrailViolations() {
+				kinds = append(kinds, v.Kind)
+			}
+			if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+				t.Errorf("%s (%s): expected violations %v, got %v", tc.query, mode, expected, o.GuardrailViolations())
+			}
+			if rejected := mode == sessiondatapb.PlanGuardrailError && len(expected) > 0; rejected != (err != nil) {
+				t.Errorf("%s (%s): unexpected error %v", tc.query, mode, err)
+			}
+			expectedNotices := 0
+			if mode == sessiondatapb.PlanGuardrailWarn {
+				expectedNotices = len(expected)
+			}
+			if len(notices.notices) != expectedNotices {
+				t.Errorf("%s (%s): unexpected notices %v", tc.query, mode, notices.notices)
+			}
+		}
+	}
+}
+
+// TestHeuristicPlanning tests that queries above the
+// optimizer_heuristic_planning_threshold session setting are planned with only
+// a small set of exploration rules.
+func TestHeuristicPlanning(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		xyzDDL,
+		"CREATE TABLE uvw (u INT PRIMARY KEY, v INT, w STRING)",
+	)
+	const query = "SELECT * FROM abc JOIN xyz ON b = y JOIN uvw ON x = v WHERE c = 'foo'"
+
+	for _, threshold := range []int64{0, 1, 100000} {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().OptimizerHeuristicPlanningThreshold = threshold
+		heuristic := threshold == 1
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		var applied xform.RuleSet
+		o.NotifyOnAppliedRule(func(ruleName opt.RuleName, source, target opt.Expr) {
+			if ruleName.IsExplore() {
+				applied.Add(int(ruleName))
+			}
+		})
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		if o.PlannedHeuristically() != heuristic {
+			t.Errorf("threshold %d: expected heuristic planning to be %t", threshold, heuristic)
+		}
+		if !applied.Contains(int(opt.ReorderJoins)) {
+			t.Errorf("threshold %d: expected joins to be reordered", threshold)
+		}
+		if heuristic {
+			applied.ForEach(func(i int) {
+				switch opt.RuleName(i) {
+				case opt.ReorderJoins, opt.GenerateIndexScans, opt.GenerateConstrainedScans,
+					opt.GeneratePartialIndexScans, opt.GenerateLimitedScans, opt.GenerateLookupJoins,
+					opt.GenerateLookupJoinsWithFilter, opt.GenerateTopK:
+				default:
+					t.Errorf("unexpected rule %s applied during heuristic planning", opt.RuleName(i))
+				}
+			})
+		}
+	}
+}
+
+// TestReorderJoinsShape tests that the reorder_joins_shape session setting
+// controls whether bushy join trees are added to the memo.
+func TestReorderJoinsShape(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, joinTableDDLs(4)...)
+	// The joins of t1 with t2 and of t3 with t4 are both selective, but the
+	// join between the two pairs is not, so the best plan is bushy.
+	const query = `
+		SELECT * FROM t1
+		JOIN t2 ON t1.a = t2.a
+		JOIN t3 ON t2.b = t3.b
+		JOIN t4 ON t3.a = t4.a
+		WHERE t1.b = 1 AND t4.b = 1`
+
+	testCases := []struct {
+		shape       sessiondatapb.JoinShapeMode
+		heuristic   bool
+		expectBushy bool
+	}{
+		{shape: sessiondatapb.JoinShapeAuto, heuristic: false, expectBushy: true},
+		{shape: sessiondatapb.JoinShapeLeftDeep, heuristic: false, expectBushy: false},
+		{shape: sessiondatapb.JoinShapeBushy, heuristic: false, expectBushy: true},
+		{shape: sessiondatapb.JoinShapeAuto, heuristic: true, expectBushy: false},
+		{shape: sessiondatapb.JoinShapeLeftDeep, heuristic: true, expectBushy: false},
+		{shape: sessiondatapb.JoinShapeBushy, heuristic: true, expectBushy: true},
+	}
+	for _, tc := range testCases {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().ReorderJoinsShape = tc.shape
+		if tc.heuristic {
+			evalCtx.SessionData().OptimizerHeuristicPlanningThreshold = 1
+		}
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		bushy := false
+		o.JoinOrderBuilder().NotifyOnAddJoin(func(left, right, all, refs []memo.RelExpr, op opt.Operator) {
+			if len(left) > 1 && len(right) > 1 {
+				bushy = true
+			}
+		})
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		if bushy != tc.expectBushy {
+			t.Errorf("shape %s, heuristic %t: expected bushy joins to be added: %t",
+				tc.shape, tc.heuristic, tc.expectBushy)
+		}
+	}
+}
+
+// TestJoinOrderCache tests that the join order found by the randomized join
+// order search is cached, and reused for queries with the same join graph.
+func TestJoinOrderCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, joinTableDDLs(6)...)
+	const template = `
+		SELECT * FROM t1
+		JOIN t2 ON t1.b = t2.a
+		JOIN t3 ON t2.b = t3.a
+		JOIN t4 ON t3.b = t4.a
+		JOIN t5 ON t4.b = t5.a
+		JOIN %s ON t5.b = t6.a
+		WHERE t1.b > %d`
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	evalCtx.SessionData().ReorderJoinsLimit = 2
+	evalCtx.SessionData().ReorderJoinsSearchBudget = time.Second
+
+	var cache xform.JoinOrderCache
+	optimize := func(query string) xform.JoinReorderStats {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		o.SetJoinOrderCache(&cache)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return o.JoinOrderBuilder().Stats()
+	}
+
+	if stats := optimize(fmt.Sprintf(template, "t6", 5)); stats.CachedOrders != 0 {
+		t.Errorf("expected no cached order for the first query, got %d", stats.CachedOrders)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("expected 1 cached order, got %d", cache.Len())
+	}
+
+	// A query that only differs in its constants has the same join graph.
+	if stats := optimize(fmt.Sprintf(template, "t6", 10)); stats.CachedOrders != 1 {
+		t.Errorf("expected the cached order to be reused, got %d", stats.CachedOrders)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("expected 1 cached order, got %d", cache.Len())
+	}
+
+	// A query that joins a different table has a different join graph.
+	if stats := optimize(fmt.Sprintf(template, "t1 AS t6", 5)); stats.CachedOrders != 0 {
+		t.Errorf("expected no cached order for a different join graph, got %d", stats.CachedOrders)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 cached orders, got %d", cache.Len())
+	}
+}
+
+// TestPlanRules tests that restricting exploration to the rules that generated
+// a plan reproduces the plan.
+func TestPlanRules(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+		xyzDDL,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc JOIN xyz ON b = y WHERE c = 'foo'"
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.RecordPlanRules()
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := root.String()
+	rules := o.PlanRules()
+	if !rules.Contains(int(opt.GenerateConstrainedScans)) {
+		t.Fatalf("expected GenerateConstrainedScans to generate the plan, got %v:\n%s", rules, plan)
+	}
+
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.RestrictExplorationToRules(rules)
+	root, err = o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restricted := root.String(); restricted != plan {
+		t.Errorf("expected the restricted plan\n%s\nto equal\n%s", restricted, plan)
+	}
+}
+
+// TestJoinReorderStats tests that the join reorder stats report whether a join
+// tree was too large to be fully reordered.
+func TestJoinReorderStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, joinTableDDLs(5)...)
+	const query = `
+		SELECT * FROM t1
+		JOIN t2 ON t1.b = t2.a
+		JOIN t3 ON t2.b = t3.a
+		JOIN t4 ON t3.b = t4.a
+		JOIN t5 ON t4.b = t5.a`
+
+	for _, limit := range []int64{2, 8} {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().ReorderJoinsLimit = limit
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		stats := o.Metrics().JoinReorder
+		if stats != o.JoinOrderBuilder().Stats() {
+			t.Errorf("limit %d: expected metrics to match the join order builder", limit)
+		}
+		if stats.Reorders == 0 || stats.Edges == 0 || stats.JoinsConsidered == 0 || stats.JoinsAdded == 0 {
+			t.Errorf("limit %d: expected joins to be reordered, got %+v", limit, stats)
+		}
+		reachedLimit := limit < 4
+		if stats.ReorderLimitReached != reachedLimit || (stats.ReorderedJoins < stats.Joins) != reachedLimit {
+			t.Errorf("limit %d: expected limit reached to be %t, got %+v", limit, reachedLimit, stats)
+		}
+	}
+}
+
+// TestJoinOrderHint tests that the optimizer_leading_tables session setting
+// fixes the tables at the start of the join order.
+func TestJoinOrderHint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		xyzDDL,
+		"CREATE TABLE uvw (u INT PRIMARY KEY, v INT, w STRING)",
+	)
+	const query = "SELECT * FROM abc JOIN xyz ON b = y JOIN uvw ON x = v WHERE c = 'foo'"
+
+	// joinOrder returns the tables of the given plan in the order in which they
+	// are joined.
+	var joinOrder func(md *opt.Metadata, e opt.Expr, order []string) []string
+	joinOrder = func(md *opt.Metadata, e opt.Expr, order []string) []string {
+		add := func(tabID opt.TableID) {
+			name := string(md.TableMeta(tabID).Alias.ObjectName)
+			for i := range order {
+				if order[i] == name {
+					return
+				}
+			}
+			order = append(order, name)
+		}
+		switch t := e.(type) {
+		case *memo.ScanExpr:
+			add(t.Table)
+			return order
+		case *memo.LookupJoinExpr:
+			order = joinOrder(md, t.Input, order)
+			add(t.Table)
+			return order
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if child, ok := e.Child(i).(memo.RelExpr); ok {
+				order = joinOrder(md, child, order)
+			}
+		}
+		return order
+	}
+
+	for _, tc := range []struct {
+		hint     string
+		expected []string
+	}{
+		{hint: "uvw,xyz,abc", expected: []string{"uvw", "xyz", "abc"}},
+		{hint: "xyz,uvw", expected: []string{"xyz", "uvw", "abc"}},
+		{hint: "uvw", expected: []string{"uvw"}},
+	} {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().OptimizerLeadingTables = tc.hint
+
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		order := joinOrder(o.Memo().Metadata(), root, nil /* order */)
+		if len(order) < len(tc.expected) {
+			t.Fatalf("hint %s: expected join order to start with %v, got %v", tc.hint, tc.expected, order)
+		}
+		for i := range tc.expected {
+			if order[i] != tc.expected[i] {
+				t.Errorf("hint %s: expected join order to start with %v, got %v", tc.hint, tc.expected, order)
+				break
+			}
+		}
+	}
+}
+
+// TestCostBreakdown tests that the cost of each expression in the lowest cost
+// tree is divided between the resources that contribute to it.
+func TestCostBreakdown(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING)",
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z STRING)",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc JOIN xyz ON b = y ORDER BY c")
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(e opt.Expr)
+	check = func(e opt.Expr) {
+		if rel, ok := e.(memo.RelExpr); ok {
+			breakdown := o.Memo().CostBreakdown(rel)
+			if total := breakdown.Total(); math.Abs(float64(total-rel.Cost())) > 1e-9*float64(rel.Cost()) {
+				t.Errorf("%s: expected breakdown %s to add up to cost %v", rel.Op(), breakdown, rel.Cost())
+			}
+			if rel.Op() == opt.ScanOp && breakdown.IO == 0 {
+				t.Errorf("expected scan to have an IO cost, got %s", breakdown)
+			}
+			if rel.Op() == opt.SortOp && breakdown.Memory == 0 {
+				t.Errorf("expected sort to have a memory cost, got %s", breakdown)
+			}
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			check(e.Child(i))
+		}
+	}
+	check(root)
+}
+
+// TestSelfCost tests that the cost of each expression in the lowest cost tree
+// is the sum of its self cost and the costs of its children.
+func TestSelfCost(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING)",
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z STRING)",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc JOIN xyz ON b = y ORDER BY c")
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(e opt.Expr)
+	check = func(e opt.Expr) {
+		if rel, ok := e.(memo.RelExpr); ok {
+			selfCost := o.Memo().SelfCost(rel)
+			if selfCost <= 0 {
+				t.Errorf("%s: expected a positive self cost, got %v", rel.Op(), selfCost)
+			}
+			cost := selfCost
+			for i, n := 0, rel.ChildCount(); i < n; i++ {
+				if child, ok := rel.Child(i).(memo.RelExpr); ok {
+					cost += child.Cost()
+				}
+			}
+			if math.Abs(float64(cost-rel.Cost())) > 1e-9*float64(rel.Cost()) {
+				t.Errorf("%s: expected self cost %v plus children to add up to cost %v", rel.Op(), selfCost, rel.Cost())
+			}
+			selfBreakdown := o.Memo().SelfCostBreakdown(rel)
+			if total := selfBreakdown.Total(); math.Abs(float64(total-selfCost)) > 1e-9*float64(selfCost) {
+				t.Errorf("%s: expected breakdown %s to add up to self cost %v", rel.Op(), selfBreakdown, selfCost)
+			}
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			check(e.Child(i))
+		}
+	}
+	check(root)
+}
+
+// TestRiskAversion tests that a risk-averse optimizer computes cost intervals
+// and never chooses a plan with a lower estimated cost than the default
+// optimizer, which chooses the plan with the lowest estimated cost.
+func TestRiskAversion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b))",
+		xyzDDL,
+	)
+	const query = "SELECT * FROM abc JOIN xyz ON b = y WHERE a > 10 AND z = 'foo'"
+
+	optimize := func(riskAversion float64) (*xform.Optimizer, memo.RelExpr) {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		o := &xform.Optimizer{}
+		testutils.BuildQuery(t, o, catalog, &evalCtx, query)
+		o.SetRiskAversion(riskAversion)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o, root.(memo.RelExpr)
+	}
+
+	_, best := optimize(0)
+	for _, riskAversion := range []float64{0.1, 1, 1000} {
+		o, root := optimize(riskAversion)
+		if root.Cost().Less(best.Cost()) {
+			t.Errorf("risk aversion %v: expected cost of at least %v, got %v",
+				riskAversion, best.Cost(), root.Cost())
+		}
+
+		// The tables have no statistics, so the row counts of the inputs of the
+		// root are uncertain.
+		interval := o.Coster().ComputeCostInterval(root, root.RequiredPhysical(), 100)
+		if !(interval.Low < interval.Estimate && interval.Estimate < interval.High) {
+			t.Errorf("risk aversion %v: expected a non-empty cost interval, got %+v",
+				riskAversion, interval)
+		}
+	}
+}
+
+// TestCostModelSettings tests that the default cost model settings produce the
+// same costs as the cluster settings, that the cost factors change the cost of
+// the plan, and that invalid settings are rejected.
+func TestCostModelSettings(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b))",
+	)
+	const query = "SELECT * FROM abc WHERE b > 10"
+
+	optimize := func(settings *xform.CostModelSettings) memo.RelExpr {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if settings != nil {
+			o.SetCostModelSettings(*settings)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr)
+	}
+
+	// The cluster settings default to the original cost model.
+	defaults := xform.DefaultCostModelSettings()
+	if err := defaults.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	expected := optimize(nil).Cost()
+	if actual := optimize(&defaults).Cost(); actual != expected {
+		t.Errorf("expected default settings to produce cost %v, got %v", expected, actual)
+	}
+
+	// Slower I/O must make the plan more expensive.
+	slowIO := defaults
+	slowIO.SeqIOCostFactor *= 10
+	slowIO.RandIOCostFactor *= 10
+	if actual := optimize(&slowIO).Cost(); !expected.Less(actual) {
+		t.Errorf("expected slower I/O to cost more than %v, got %v", expected, actual)
+	}
+
+	invalid := defaults
+	invalid.NetworkCostFactor = 0
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("expected error for zero network cost factor")
+	}
+}
+
+// TestShadowCostModel tests that a shadow cost model is compared with the cost
+// model of the optimizer without changing the plan, and that the comparison
+// reports whether the two cost models choose different plans.
+func TestShadowCostModel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t, abcDDL)
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+
+	optimize := func(shadow xform.CostModelSettings) (memo.RelExpr, *xform.CostModelComparison) {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		o.SetShadowCostModel(shadow)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr), o.CostModelComparison()
+	}
+
+	// A shadow cost model that is the same as the cost model of the optimizer
+	// agrees with it.
+	defaults := xform.DefaultCostModelSettings()
+	root, c := optimize(defaults)
+	if c == nil {
+		t.Fatal("expected a cost model comparison")
+	}
+	if c.Disagrees || c.Cost != root.Cost() || c.ShadowCost != c.Cost || c.ShadowBestCost != c.Cost {
+		t.Errorf("expected identical cost models to agree: %+v", c)
+	}
+	if c.Version != xform.CostModelV1 || c.ShadowVersion != xform.CostModelV1 {
+		t.Errorf("expected version 1, got %d and %d", c.Version, c.ShadowVersion)
+	}
+
+	// Seeking to a new key is so expensive under the shadow cost model that it
+	// prefers a full scan to the lookups of an index join. The plan is still
+	// chosen by the cost model of the optimizer.
+	slowSeeks := defaults
+	slowSeeks.RandIOCostFactor *= 1000
+	shadowRoot, c := optimize(slowSeeks)
+	if shadowRoot.Op() != root.Op() || shadowRoot.Cost() != root.Cost() {
+		t.Errorf("expected the shadow cost model not to change the plan, got %s", shadowRoot.Op())
+	}
+	if !c.Disagrees || !c.ShadowBestCost.Less(c.ShadowCost) {
+		t.Errorf("expected the cost models to disagree: %+v", c)
+	}
+
+	// A newer version of the cost model can be compared with the current one.
+	v2 := defaults
+	v2.Version = xform.CostModelV2
+	if _, c = optimize(v2); c.ShadowVersion != xform.CostModelV2 {
+		t.Errorf("expected shadow version 2, got %d", c.ShadowVersion)
+	}
+	v2.Version = xform.LatestCostModelVersion + 1
+	if err := v2.Validate(); err == nil {
+		t.Error("expected an error for an unknown cost model version")
+	}
+}
+
+// TestWorkMemCosting tests that a hash join whose input would spill to disk is
+// avoided when work mem costing is enabled.
+func TestWorkMemCosting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b) STORING (c))",
+		`ALTER TABLE abc INJECT STATISTICS '[
+			{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10000000},
+			{"columns": ["b"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10000000}
+		]'`,
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z STRING, INDEX (y) STORING (z))",
+		`ALTER TABLE xyz INJECT STATISTICS '[
+			{"columns": ["x"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10000000},
+			{"columns": ["y"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10000000}
+		]'`,
+	)
+	const query = "SELECT * FROM abc JOIN xyz ON b = y"
+
+	optimize := func(useWorkMemCosting bool, workMemLimit int64) memo.RelExpr {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().OptimizerUseWorkMemCosting = useWorkMemCosting
+		evalCtx.SessionData().WorkMemLimit = workMemLimit
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr)
+	}
+
+	// The work mem limit has no effect unless work mem costing is enabled.
+	expected := optimize(false /* useWorkMemCosting */, 0 /* workMemLimit */).Cost()
+	if actual := optimize(false /* useWorkMemCosting */, 1<<10 /* workMemLimit */).Cost(); actual != expected {
+		t.Errorf("expected work mem limit to be ignored, got cost %v instead of %v", actual, expected)
+	}
+
+	// A lower limit can only make the plan more expensive.
+	large := optimize(true /* useWorkMemCosting */, 1<<40 /* workMemLimit */)
+	small := optimize(true /* useWorkMemCosting */, 1<<10 /* workMemLimit */)
+	if small.Cost().Less(large.Cost()) {
+		t.Errorf("expected a lower work mem limit to cost at least %v, got %v", large.Cost(), small.Cost())
+	}
+
+	// With a small limit, a hash join of the inputs would spill, so the
+	// optimizer prefers a merge join of the ordered index scans.
+	var hasMergeJoin func(e opt.Expr) bool
+	hasMergeJoin = func(e opt.Expr) bool {
+		if e.Op() == opt.MergeJoinOp {
+			return true
+		}
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			if hasMergeJoin(e.Child(i)) {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasMergeJoin(small) {
+		t.Errorf("expected a merge join with a small work mem limit, got:\n%s", small)
+	}
+}
+
+// TestVectorizedCostFactor tests that the VectorizedCostFactor only applies to
+// operators that would run natively in the vectorized engine.
+func TestVectorizedCostFactor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING)",
+		"CREATE TABLE ip (k INT PRIMARY KEY, i INET)",
+	)
+
+	optimize := func(query string, mode sessiondatapb.VectorizeExecMode, factor float64) memo.Cost {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().VectorizeMode = mode
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		settings := xform.DefaultCostModelSettings()
+		settings.VectorizedCostFactor = factor
+		o.SetCostModelSettings(settings)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+
+	// All the operators and types are supported by the vectorized engine, so
+	// the cost is discounted, unless the vectorized engine is disabled.
+	const query = "SELECT b, count(*) FROM abc WHERE c = 'foo' GROUP BY b ORDER BY b"
+	expected := optimize(query, sessiondatapb.VectorizeOn, 1 /* factor */)
+	if actual := optimize(query, sessiondatapb.VectorizeOn, 0.5 /* factor */); !actual.Less(expected) {
+		t.Errorf("expected vectorized plan to cost less than %v, got %v", expected, actual)
+	}
+	if actual := optimize(query, sessiondatapb.VectorizeOff, 0.5 /* factor */); actual != expected {
+		t.Errorf("expected plan with vectorize off to cost %v, got %v", expected, actual)
+	}
+
+	// INET is not natively supported by the vectorized engine.
+	const inetQuery = "SELECT i FROM ip ORDER BY i"
+	expected = optimize(inetQuery, sessiondatapb.VectorizeOn, 1 /* factor */)
+	if actual := optimize(inetQuery, sessiondatapb.VectorizeOn, 0.5 /* factor */); actual != expected {
+		t.Errorf("expected plan with unsupported types to cost %v, got %v", expected, actual)
+	}
+}
+
+// TestRemoteLatencyCostFactor tests that a selective scan of a remote index is
+// avoided in favor of a local index if round trips to remote nodes are
+// expensive enough.
+func TestRemoteLatencyCostFactor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, UNIQUE INDEX bc (b, c))",
+		"ALTER TABLE abc CONFIGURE ZONE USING constraints='[+region=central]'",
+		"ALTER INDEX abc@bc CONFIGURE ZONE USING constraints='[+region=east]'",
+	)
+
+	scannedIndex := func(factor float64) cat.IndexOrdinal {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.Locality = roachpb.Locality{Tiers: []roachpb.Tier{{Key: "region", Value: "central"}}}
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE b = 10")
+		settings := xform.DefaultCostModelSettings()
+		settings.RemoteLatencyCostFactor = factor
+		o.SetCostModelSettings(settings)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var scan *memo.ScanExpr
+		var find func(e opt.Expr)
+		find = func(e opt.Expr) {
+			if s, ok := e.(*memo.ScanExpr); ok {
+				scan = s
+			}
+			for i, n := 0, e.ChildCount(); i < n; i++ {
+				find(e.Child(i))
+			}
+		}
+		find(root)
+		if scan == nil {
+			t.Fatalf("expected a scan in the plan")
+		}
+		return scan.Index
+	}
+
+	// The filter is selective, so by default the remote index is scanned.
+	if idx := scannedIndex(0 /* factor */); idx != 1 {
+		t.Errorf("expected the remote index to be scanned, got index %d", idx)
+	}
+	// If round trips to the remote index are expensive, the local primary index
+	// is scanned instead.
+	if idx := scannedIndex(10000 /* factor */); idx != cat.PrimaryIndex {
+		t.Errorf("expected the local primary index to be scanned, got index %d", idx)
+	}
+
+	invalid := xform.DefaultCostModelSettings()
+	invalid.RemoteLatencyCostFactor = -1
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("expected error for negative remote latency cost factor")
+	}
+}
+
+// TestRemoteLatencyLocalPartitions tests that the remote latency cost factor
+// only applies to scans of partitions whose leaseholders are in a remote
+// region.
+func TestRemoteLatencyLocalPartitions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	ddls := []string{`
+		CREATE TABLE abc (
+			r STRING NOT NULL CHECK (r IN ('east', 'west')),
+			a INT PRIMARY KEY,
+			b INT,
+			UNIQUE INDEX b_idx (r, b) PARTITION BY LIST (r) (
+				PARTITION east VALUES IN (('east')),
+				PARTITION west VALUES IN (('west'))
+			)
+		)`,
+	}
+	for _, region := range []string{"east", "west"} {
+		ddls = append(ddls, fmt.Sprintf(
+			`ALTER PARTITION %[1]s OF INDEX abc@b_idx CONFIGURE ZONE USING
+				num_voters = 5,
+				voter_constraints = '{+region=%[1]s: 2}',
+				lease_preferences = '[[+region=%[1]s]]'`, region,
+		))
+	}
+	catalog := newTestCatalog(t, ddls...)
+
+	cost := func(query string, factor float64) memo.Cost {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.Locality = roachpb.Locality{Tiers: []roachpb.Tier{{Key: "region", Value: "east"}}}
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		settings := xform.DefaultCostModelSettings()
+		settings.RemoteLatencyCostFactor = factor
+		o.SetCostModelSettings(settings)
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Cost()
+	}
+
+	// A scan of the local partition does not incur any remote round trips.
+	const local = "SELECT r, b FROM abc WHERE r = 'east' AND b = 1"
+	if before, after := cost(local, 0 /* factor */), cost(local, 10000 /* factor */); before != after {
+		t.Errorf("expected the cost of the local scan to be unchanged, got %f and %f", before, after)
+	}
+	// A scan of the remote partition does.
+	const remote = "SELECT r, b FROM abc WHERE r = 'west' AND b = 1"
+	if before, after := cost(remote, 0 /* factor */), cost(remote, 10000 /* factor */); after <= before {
+		t.Errorf("expected the cost of the remote scan to increase, got %f and %f", before, after)
+	}
+}
+
+// TestOptimizerGoal tests that optimizing for the first row prefers an index
+// ordering to a sort, which must consume all of its input before producing
+// any rows.
+func TestOptimizerGoal(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		`ALTER TABLE abc INJECT STATISTICS '[
+			{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000},
+			{"columns": ["c"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000}
+		]'`,
+	)
+
+	optimize := func(goal sessiondatapb.OptimizerGoal) (*xform.Optimizer, memo.RelExpr) {
+		evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+		evalCtx.SessionData().OptimizerGoal = goal
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc ORDER BY c")
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &o, root.(memo.RelExpr)
+	}
+
+	// The total cost of sorting the rows of the primary index is lower than the
+	// cost of an index join for every row.
+	_, root := optimize(sessiondatapb.OptimizerGoalTotalCost)
+	if root.Op() != opt.SortOp {
+		t.Errorf("expected a sort at the root, got %s", root.Op())
+	}
+
+	// The first row of the ordered index can be produced without reading every
+	// row.
+	o, root := optimize(sessiondatapb.OptimizerGoalFirstRow)
+	if root.Op() == opt.SortOp {
+		t.Errorf("expected the ordering to be provided by the index")
+	}
+	if props := o.Memo().RootProps(); props.LimitHint != 1 || !props.Streaming {
+		t.Errorf("expected the root to require a limit hint and streaming, got %s", props)
+	}
+}
+
+// TestIterativeDeepening tests that iterative deepening adds no more
+// expressions to the memo than full exploration, that it never finds a lower
+// cost plan, and that every group state is fully optimized once it completes.
+func TestIterativeDeepening(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+		xyzDDL,
+		"CREATE TABLE uvw (u INT PRIMARY KEY, v INT, w STRING, INDEX (v))",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	optimize := func(query string, setup func(o *xform.Optimizer)) *xform.Optimizer {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		setup(&o)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return &o
+	}
+
+	for _, query := range []string{
+		"SELECT * FROM abc WHERE c = 'foo'",
+		"SELECT * FROM abc INNER JOIN xyz ON b = y WHERE c = 'foo'",
+		"SELECT * FROM abc, xyz, uvw WHERE a = y AND x = v AND w = 'foo' ORDER BY b",
+		"SELECT * FROM abc WHERE EXISTS (SELECT * FROM xyz WHERE y = b AND z = c)",
+	} {
+		t.Run(query, func(t *testing.T) {
+			full := optimize(query, func(o *xform.Optimizer) {})
+			fullCost := full.Memo().RootExpr().(memo.RelExpr).Cost()
+			fullExprs := full.Metrics().Exprs
+
+			for _, slack := range []float64{0, 0.5} {
+				o := optimize(query, func(o *xform.Optimizer) {
+					o.SetIterativeDeepening(slack)
+				})
+				if exprs := o.Metrics().Exprs; exprs > fullExprs {
+					t.Errorf("slack %v: expected at most %d expressions, got %d", slack, fullExprs, exprs)
+				}
+				if cost := o.Memo().RootExpr().(memo.RelExpr).Cost(); cost < fullCost {
+					t.Errorf("slack %v: expected cost of at least %.2f, got %.2f", slack, fullCost, cost)
+				}
+				o.ForEachGroupState(func(state xform.GroupState) {
+					if !state.FullyOptimized {
+						t.Errorf("slack %v: expected %s to be fully optimized for %s",
+							slack, state.Group.Op(), state.Required)
+					}
+				})
+			}
+		})
+	}
+
+	// The lowest cost plan of a simple query is found by the first pass.
+	o := optimize("SELECT * FROM abc WHERE c = 'foo'", func(o *xform.Optimizer) {
+		o.SetIterativeDeepening(0)
+	})
+	if op := o.Memo().RootExpr().Op(); op != opt.IndexJoinOp && op != opt.ScanOp {
+		t.Errorf("expected a constrained scan of the secondary index, got %s", op)
+	}
+}
+
+// TestSetTableStatistics tests that statistics set via SetTableStatistics
+// override the statistics of the catalog table for a single optimization,
+// without modifying the catalog.
+func TestSetTableStatistics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	catalog := newTestCatalog(t,
+		abcDDL,
+		"CREATE TABLE whatif (a INT PRIMARY KEY, b INT, c STRING, INDEX (c))",
+		`ALTER TABLE whatif INJECT STATISTICS '[
+			{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10000000},
+			{"columns": ["c"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10}
+		]'`,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	abc := catalog.Table(tree.NewUnqualifiedTableName("abc"))
+	whatif := catalog.Table(tree.NewUnqualifiedTableName("whatif"))
+	var whatifStats []cat.TableStatistic
+	for i, n := 0, whatif.StatisticCount(); i < n; i++ {
+		whatifStats = append(whatifStats, whatif.Statistic(i))
+	}
+
+	// rowCount returns the estimated row count of the query after calling
+	// setup with the initialized optimizer.
+	rowCount := func(query string, setup func(o *xform.Optimizer)) float64 {
+		var o xform.Optimizer
+		o.Init(&evalCtx, catalog)
+		setup(&o)
+		if err := testutils.BuildInitializedQuery(&o, catalog, query); err != nil {
+			t.Fatal(err)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(memo.RelExpr).Relational().Stats.RowCount
+	}
+
+	const query = "SELECT * FROM abc WHERE c = 'foo'"
+	before := rowCount(query, func(o *xform.Optimizer) {})
+	overridden := rowCount(query, func(o *xform.Optimizer) {
+		o.SetTableStatistics(abc, whatifStats)
+	})
+	if overridden != 1000000 {
+		t.Errorf("expected 1000000 rows with overridden statistics, got %v", overridden)
+	}
+
+	// The catalog is not modified, so the next optimization uses the
+	// statistics of the catalog table.
+	if abc.StatisticCount() != 0 {
+		t.Errorf("expected the catalog table to have no statistics, got %d", abc.StatisticCount())
+	}
+	if after := rowCount(query, func(o *xform.Optimizer) {}); after != before {
+		t.Errorf("expected %v rows after the override, got %v", before, after)
+	}
+
+	// An empty override makes a table appear to have no statistics.
+	empty := rowCount("SELECT * FROM whatif WHERE c = 'foo'", func(o *xform.Optimizer) {
+		o.SetTableStatistics(whatif, nil)
+	})
+	if empty != before {
+		t.Errorf("expected %v rows without statistics, got %v", before, empty)
+	}
+}
+
+// BenchmarkOptimizeJoins measures the time to optimize queries that join an
+// increasing number of tables, whose memos contain many groups and group
+// states.
+func BenchmarkOptimizeJoins(b *testing.B) {
+	benchmarkOptimizeJoins(b, "" /* suffix */)
+}
+
+// BenchmarkOptimizeOrderedJoins is like BenchmarkOptimizeJoins, but requires
+// an ordering of the results, so that the large join groups are optimized with
+// respect to several sets of required properties, each of which takes several
+// passes over the members.
+func BenchmarkOptimizeOrderedJoins(b *testing.B) {
+	benchmarkOptimizeJoins(b, " ORDER BY t0.c LIMIT 10")
+}
+
+// BenchmarkOptimizeMultiColumnOrderedJoins is like
+// BenchmarkOptimizeOrderedJoins, but requires an ordering on several columns
+// of different tables, so that Sort enforcers with a partial input ordering
+// are tried for every member of the large join groups.
+func BenchmarkOptimizeMultiColumnOrderedJoins(b *testing.B) {
+	benchmarkOptimizeJoins(b, " ORDER BY t0.b, t0.c, t1.b, t1.c")
+}
+
+// benchmarkOptimizeJoins runs the join benchmarks, appending the given suffix
+// to each query.
+func benchmarkOptimizeJoins(b *testing.B, suffix string) {
+	defer log.Scope(b).Close(b)
+	catalog := testcat.New()
+	const maxTables = 6
+	for i := 0; i < maxTables; i++ {
+		ddl := fmt.Sprintf("CREATE TABLE t%d (a INT PRIMARY KEY, b INT, c INT, INDEX (b))", i)
+		if _, err := catalog.ExecuteDDL(ddl); err != nil {
+			b.Fatal(err)
+		}
+	}
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	ctx := context.Background()
+
+	for _, n := range []int{2, 4, maxTables} {
+		var sb strings.Builder
+		sb.WriteString("SELECT * FROM t0")
+		for i := 1; i < n; i++ {
+			fmt.Fprintf(&sb, " JOIN t%d ON t%d.b = t%d.a", i, i-1, i)
+		}
+		sb.WriteString(suffix)
+		stmt, err := parser.ParseOne(sb.String())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("tables=%d", n), func(b *testing.B) {
+			var o xform.Optimizer
+			for i := 0; i < b.N; i++ {
+				semaCtx := tree.MakeSemaContext()
+				o.Init(&evalCtx, catalog)
+				if err := optbuilder.New(ctx, &semaCtx, &evalCtx, catalog, o.Factory(), stmt.AST).Build(); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := o.Optimize(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkOptimizeIndexScans measures the time to optimize a query on tables
+// with an increasing number of indexes, whose scan groups contain a member for
+// each index that is costed on each pass over the group.
+func BenchmarkOptimizeIndexScans(b *testing.B) {
+	defer log.Scope(b).Close(b)
+	catalog := testcat.New()
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	ctx := context.Background()
+
+	for _, n := range []int{4, 16, 64} {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "CREATE TABLE t%d (a INT PRIMARY KEY", n)
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&sb, ", c%d INT, INDEX (c%d)", i, i)
+		}
+		sb.WriteString(")")
+		if _, err := catalog.ExecuteDDL(sb.String()); err != nil {
+			b.Fatal(err)
+		}
+		stmt, err := parser.ParseOne(fmt.Sprintf("SELECT a FROM t%d ORDER BY a LIMIT 10", n))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("indexes=%d", n), func(b *testing.B) {
+			var o xform.Optimizer
+			for i := 0; i < b.N; i++ {
+				semaCtx := tree.MakeSemaContext()
+				o.Init(&evalCtx, catalog)
+				if err := optbuilder.New(ctx, &semaCtx, &evalCtx, catalog, o.Factory(), stmt.AST).Build(); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := o.Optimize(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/ordering"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/errors"
 )
 
@@ -35,11 +36,47 @@ import (
 func CanProvidePhysicalProps(
 	evalCtx *tree.EvalContext, e memo.RelExpr, required *physical.Required,
 ) bool {
-	// All operators can provide the Presentation and LimitHint properties, so no
-	// need to check for that.
-	canProvideOrdering := e.Op() == opt.SortOp || ordering.CanProvide(e, &required.Ordering)
+	// All operators can provide the Presentation, LimitHint, MaxParallelism,
+	// Streaming and NoFullScan properties, so no need to check for that.
+	// Operators that buffer rows are instead penalized by the coster if
+	// Streaming is required.
+	canProvideOrdering := e.Op() == opt.SortOp || e.Op() == opt.TopKSortOp ||
+		ordering.CanProvide(e, &required.Ordering)
 	canProvideDistribution := e.Op() == opt.DistributeOp || distribution.CanProvide(evalCtx, e, &required.Distribution)
-	return canProvideOrdering && canProvideDistribution
+	return canProvideOrdering && canProvideDistribution && canProvideParallelism(e, required.Parallelism)
+}
+
+// canProvideParallelism returns true if the given expression can produce its
+// rows in the given number of parallel streams. Scans can be split into
+// disjoint sets of spans that are scanned in parallel, and filters,
+// projections and hash joins can be executed on each stream of their inputs.
+// Hash joins repartition their inputs on the equality columns so that
+// matching rows are joined by the same stream (see
+// coster.computeParallelHashJoinCost).
+func canProvideParallelism(e memo.RelExpr, parallelism int) bool {
+	if parallelism == 0 {
+		return true
+	}
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		// A scan with a hard limit must be executed serially to return the
+		// first rows in the scan.
+		return !t.HardLimit.IsSet() && !t.IsLocking()
+
+	case *memo.SelectExpr, *memo.ProjectExpr, *memo.BarrierExpr:
+		return true
+
+	case *memo.InnerJoinExpr, *memo.LeftJoinExpr, *memo.SemiJoinExpr, *memo.AntiJoinExpr:
+		// Rows can only be partitioned between streams by hashing equality
+		// columns.
+		leftEq, _ := memo.ExtractJoinEqualityColumns(
+			t.Child(0).(memo.RelExpr).Relational().OutputCols,
+			t.Child(1).(memo.RelExpr).Relational().OutputCols,
+			*t.Child(2).(*memo.FiltersExpr),
+		)
+		return len(leftEq) > 0
+	}
+	return false
 }
 
 // BuildChildPhysicalProps returns the set of physical properties required of
@@ -87,6 +124,46 @@ func BuildChildPhysicalProps(
 	childProps.Ordering = ordering.BuildChildRequired(parent, &parentProps.Ordering, nth)
 	childProps.Distribution = distribution.BuildChildRequired(parent, &parentProps.Distribution, nth)
 
+	// The parallelism bound and the prohibition of full scans apply to the
+	// entire subtree, so they are always passed through to children.
+	childProps.MaxParallelism = parentProps.MaxParallelism
+	childProps.NoFullScan = parentProps.NoFullScan
+
+	// Parallelism is required of the input of a Gather enforcer, and is passed
+	// through to the inputs of other operators that can provide it (see
+	// canProvideParallelism).
+	switch parent.Op() {
+	case opt.GatherOp:
+		childProps.Parallelism = parent.(*memo.GatherExpr).InputParallelism
+	case opt.SelectOp, opt.ProjectOp, opt.BarrierOp,
+		opt.InnerJoinOp, opt.LeftJoinOp, opt.SemiJoinOp, opt.AntiJoinOp:
+		childProps.Parallelism = parentProps.Parallelism
+	}
+
+	// HardLimit is only required if a TopKSort enforcer can use it. It is set
+	// by a Limit with a constant limit, and passed through by operators that
+	// return exactly one row for each input row and can provide an ordering by
+	// passing it through to their input.
+	if mem.UseTopKEnforcer() {
+		switch parent.Op() {
+		case opt.LimitOp:
+			if constLimit, ok := parent.(*memo.LimitExpr).Limit.(*memo.ConstExpr); ok {
+				if k := int64(*constLimit.Value.(*tree.DInt)); k > 0 {
+					childProps.HardLimit = k
+				}
+			}
+		case opt.ProjectOp, opt.IndexJoinOp, opt.BarrierOp:
+			childProps.HardLimit = parentProps.HardLimit
+		}
+	}
+
+	// When optimizing for the first row, the root requires streaming, which is
+	// passed through to its inputs even if the streaming property is not
+	// otherwise used.
+	if mem.UseStreamingProperty() || mem.OptimizerGoal() == sessiondatapb.OptimizerGoalFirstRow {
+		childProps.Streaming = buildChildStreaming(parent, nth, parentProps.Streaming)
+	}
+
 	switch parent.Op() {
 	case opt.LimitOp:
 		if constLimit, ok := parent.(*memo.LimitExpr).Limit.(*memo.ConstExpr); ok {
@@ -110,6 +187,19 @@ func BuildChildPhysicalProps(
 		// For an index join, every input row results in exactly one output row.
 		childProps.LimitHint = parentProps.LimitHint
 
+	case opt.SortOp:
+		// A segmented sort only needs to read the segments that contain the
+		// first LimitHint rows. A full sort must read its entire input.
+		sort := parent.(*memo.SortExpr)
+		if parentProps.LimitHint == 0 || sort.InputOrdering.Any() {
+			break
+		}
+		inputRows := sort.Relational().Stats.RowCount
+		limitHint := segmentedSortInputLimitHint(inputRows, countSegments(mem, sort), parentProps.LimitHint)
+		if limitHint < inputRows {
+			childProps.LimitHint = limitHint
+		}
+
 	case opt.ExceptOp, opt.ExceptAllOp, opt.IntersectOp, opt.IntersectAllOp,
 		opt.UnionOp, opt.UnionAllOp, opt.LocalityOptimizedSearchOp:
 		// TODO(celine): Set operation limits need further thought; for example,
@@ -150,9 +240,13 @@ func BuildChildPhysicalProps(
 			}
 		}
 
-	case opt.SelectOp, opt.LookupJoinOp:
+	case opt.SelectOp, opt.LookupJoinOp, opt.InvertedJoinOp:
 		// These operations are assumed to produce a constant number of output rows
-		// for each input row, independent of already-processed rows.
+		// for each input row, independent of already-processed rows. Inverted joins
+		// only pass on the limit hint if join limit hints are enabled.
+		if parent.Op() == opt.InvertedJoinOp && (!mem.UseJoinLimitHints() || nth != 0) {
+			break
+		}
 		outputRows := parent.Relational().Stats.RowCount
 		if outputRows == 0 || outputRows < parentProps.LimitHint {
 			break
@@ -165,14 +259,37 @@ func BuildChildPhysicalProps(
 				// for each input row. Reduce the number of required input rows so that
 				// the expected number of output rows is equal to the parent limit hint.
 				childProps.LimitHint = parentProps.LimitHint * inputRows / outputRows
-			case opt.LookupJoinOp:
+			case opt.LookupJoinOp, opt.InvertedJoinOp:
 				childProps.LimitHint = lookupJoinInputLimitHint(inputRows, outputRows, parentProps.LimitHint)
 			}
 		}
 
-	case opt.OrdinalityOp, opt.ProjectOp, opt.ProjectSetOp:
+	case opt.OrdinalityOp, opt.ProjectOp, opt.ProjectSetOp, opt.GatherOp, opt.BarrierOp:
 		childProps.LimitHint = parentProps.LimitHint
 
+	case opt.InnerJoinOp, opt.LeftJoinOp, opt.InnerJoinApplyOp, opt.LeftJoinApplyOp:
+		// A hash join builds a hash table from its right input before it streams
+		// its left input, so only the left input can stop early. An apply join
+		// also streams its left input.
+		if nth == 0 && mem.UseJoinLimitHints() {
+			childProps.LimitHint = joinInputLimitHint(parent, nth, parentProps.LimitHint)
+		}
+
+	case opt.MergeJoinOp:
+		// A merge join streams both of its inputs.
+		if nth < 2 && mem.UseJoinLimitHints() {
+			childProps.LimitHint = joinInputLimitHint(parent, nth, parentProps.LimitHint)
+		}
+
+	case opt.SemiJoinApplyOp, opt.AntiJoinApplyOp:
+		// The right input of a semi or anti apply join is re-executed for each
+		// row of the left input. If there is no ON condition, it only needs to
+		// produce a single row to determine whether the left row matches, so cost
+		// it with an emphasis on producing the first row.
+		if nth == 1 && len(*parent.Child(2).(*memo.FiltersExpr)) == 0 {
+			childProps.LimitHint = 1
+		}
+
 	case opt.TopKOp:
 		if parentProps.Ordering.Any() {
 			break
@@ -204,6 +321,75 @@ func BuildChildPhysicalProps(
 	return mem.InternPhysicalProps(&childProps)
 }
 
+// buildChildStreaming returns true if the nth child of the given parent is
+// required to stream its rows. Streaming is required of the input of a Limit,
+// which only consumes a bounded number of rows, and of the right input of an
+// apply join, which is re-executed for every left row. It is passed through to
+// the inputs that are consumed row by row by operators that do not buffer
+// them, such as the probe side of a hash join. Operators that buffer their
+// input, such as a Sort, do not require it to stream, since their own rows are
+// only produced once the input is exhausted.
+func buildChildStreaming(parent memo.RelExpr, nth int, parentStreaming bool) bool {
+	switch parent.Op() {
+	case opt.LimitOp:
+		return true
+
+	case opt.InnerJoinApplyOp, opt.LeftJoinApplyOp, opt.SemiJoinApplyOp, opt.AntiJoinApplyOp:
+		return nth == 1 || parentStreaming
+
+	case opt.SortOp:
+		// A segmented sort only buffers the rows of one segment at a time.
+		return parentStreaming && !parent.(*memo.SortExpr).InputOrdering.Any()
+
+	case opt.InnerJoinOp, opt.LeftJoinOp, opt.SemiJoinOp, opt.AntiJoinOp:
+		// Hash joins buffer their right input, and stream their left input.
+		return parentStreaming && nth == 0
+
+	case opt.SelectOp, opt.ProjectOp, opt.IndexJoinOp, opt.LookupJoinOp, opt.InvertedJoinOp,
+		opt.MergeJoinOp, opt.OffsetOp, opt.OrdinalityOp, opt.ProjectSetOp, opt.InvertedFilterOp,
+		opt.UnionAllOp, opt.LocalityOptimizedSearchOp, opt.TopKOp, opt.TopKSortOp,
+		opt.ScalarGroupByOp, opt.GroupByOp, opt.DistinctOnOp, opt.EnsureDistinctOnOp,
+		opt.UpsertDistinctOnOp, opt.EnsureUpsertDistinctOnOp, opt.DistributeOp, opt.GatherOp,
+		opt.BarrierOp:
+		// Grouping operators are penalized by the coster if they use a hash
+		// table, but a streaming aggregation consumes its input row by row.
+		return parentStreaming
+	}
+	return false
+}
+
+// joinInputLimitHint returns the limit hint for the nth input of a join that
+// streams the input, given the limit hint of the join. Like a Select, the join
+// is assumed to produce a constant number of output rows for each input row,
+// so the input only needs to produce a proportional fraction of its rows. It
+// returns 0 if there is no limit hint, or if the join is not expected to
+// produce more rows than the limit hint.
+func joinInputLimitHint(join memo.RelExpr, nth int, limitHint float64) float64 {
+	outputRows := join.Relational().Stats.RowCount
+	if limitHint == 0 || outputRows == 0 || outputRows < limitHint {
+		return 0
+	}
+	inputRows := join.Child(nth).(memo.RelExpr).Relational().Stats.RowCount
+	if inputRows == 0 {
+		return 0
+	}
+	return math.Max(1, limitHint*inputRows/outputRows)
+}
+
+// segmentedSortInputLimitHint returns the number of input rows that a
+// segmented sort with the given number of segments must read to produce
+// neededRows rows. Rows are assumed to be evenly distributed between the
+// segments. Every segment that contains one of the needed rows must be read in
+// full, as well as the first row of the following segment, which signals the
+// end of the segment.
+func segmentedSortInputLimitHint(inputRows, numSegments, neededRows float64) float64 {
+	if inputRows <= 0 || numSegments <= 0 {
+		return neededRows
+	}
+	segmentSize := math.Max(inputRows/numSegments, 1)
+	return math.Min(inputRows, math.Ceil(neededRows/segmentSize)*segmentSize+1)
+}
+
 // distinctOnLimitHint returns a limit hint for the distinct operation. Given a
 // table with distinctCount distinct rows, distinctOnLimitHint will return an
 // estimated number of rows to scan that in most cases will yield at least
@@ -268,6 +454,12 @@ func distinctOnLimitHint(distinctCount, neededRows float64) float64 {
 func BuildChildPhysicalPropsScalar(mem *memo.Memo, parent opt.Expr, nth int) *physical.Required {
 	var childProps physical.Required
 	switch parent.Op() {
+	case opt.ExistsOp:
+		// EXISTS only needs to produce a single row from its input. Correlated
+		// EXISTS subqueries are not limited by IntroduceExistsLimit, so the limit
+		// hint ensures that their input is costed with an emphasis on producing
+		// the first row.
+		childProps.LimitHint = 1
 	case opt.ArrayFlattenOp:
 		if nth == 0 {
 			af := parent.(*memo.ArrayFlattenExpr)
@@ -0,0 +1,492 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// planBaselineVersion is the version of the serialized PlanBaseline format. It
+// must be incremented whenever the format changes incompatibly.
+const planBaselineVersion = 1
+
+// PlanBaseline is a portable description of the lowest cost tree chosen for a
+// query. It identifies tables and indexes by their stable IDs rather than by
+// memo-specific IDs, so it can be serialized, stored, and later passed to
+// SetPlanBaseline to make the optimizer reproduce the same physical plan for
+// the same query, even after statistics change or the optimizer is upgraded.
+type PlanBaseline struct {
+	// Version is the version of the format that the baseline was captured with.
+	Version int `json:"version"`
+
+	// Root describes the root of the plan.
+	Root BaselineNode `json:"root"`
+}
+
+// BaselineNode describes a single operator in a PlanBaseline.
+type BaselineNode struct {
+	// Op is the name of the operator.
+	Op string `json:"op"`
+
+	// TableID is the stable ID of the table accessed by the operator, if any.
+	TableID cat.StableID `json:"table_id,omitempty"`
+
+	// IndexIDs are the stable IDs of the indexes accessed by the operator, if
+	// any. Zigzag joins access two indexes.
+	IndexIDs []cat.StableID `json:"index_ids,omitempty"`
+
+	// Table and Indexes are the names of the table and indexes accessed by the
+	// operator, at the time the baseline was captured. They are informational
+	// only, so that renaming a table or index does not invalidate the baseline.
+	Table   string   `json:"table,omitempty"`
+	Indexes []string `json:"indexes,omitempty"`
+
+	// Children describes the relational inputs of the operator, in order.
+	Children []BaselineNode `json:"children,omitempty"`
+}
+
+// Marshal returns the serialized form of the baseline.
+func (b *PlanBaseline) Marshal() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+// UnmarshalPlanBaseline parses a baseline serialized by PlanBaseline.Marshal.
+func UnmarshalPlanBaseline(data []byte) (*PlanBaseline, error) {
+	var b PlanBaseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, pgerror.Wrap(err, pgcode.InvalidParameterValue, "invalid plan baseline")
+	}
+	if b.Version != planBaselineVersion {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"unsupported plan baseline version %d", b.Version)
+	}
+	return &b, nil
+}
+
+// CapturePlanBaseline returns a PlanBaseline that describes the lowest cost
+// tree. It must be called after Optimize.
+func (o *Optimizer) CapturePlanBaseline() (*PlanBaseline, error) {
+	if !o.mem.IsOptimized() {
+		return nil, errors.AssertionFailedf("cannot capture a plan baseline before optimization")
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, errors.AssertionFailedf("can only capture plan baselines for relational root expressions")
+	}
+	return &PlanBaseline{
+		Version: planBaselineVersion,
+		Root:    describeBaselineNode(o.mem.Metadata(), root),
+	}, nil
+}
+
+// PlanBaselineFor returns a PlanBaseline that describes the given plan, which
+// was returned by OptimizeTopK or EnumeratePlansWithin. Passing the baseline to
+// SetPlanBaseline for the same query forces the optimizer to choose that plan,
+// which allows tests and tooling to execute plans other than the lowest cost
+// plan, e.g. to pick one of the k lowest cost plans at random, or to compare
+// the actual performance of runner-up plans with that of the chosen plan.
+func (o *Optimizer) PlanBaselineFor(plan *EnumeratedPlan) *PlanBaseline {
+	return &PlanBaseline{
+		Version: planBaselineVersion,
+		Root:    describePlanNode(o.mem.Metadata(), plan.Root),
+	}
+}
+
+// PlanFingerprint returns a stable hash of the shape of the lowest cost tree.
+// See PlanBaseline.Fingerprint. It must be called after Optimize.
+func (o *Optimizer) PlanFingerprint() (uint64, error) {
+	baseline, err := o.CapturePlanBaseline()
+	if err != nil {
+		return 0, err
+	}
+	return baseline.Fingerprint(), nil
+}
+
+// Fingerprint returns a hash of the shape of the plan described by the
+// baseline: its operators, the tables and indexes that they access, and the
+// order of their inputs, which determines the join order. Constants, column
+// IDs, and the names of tables and indexes are excluded, so the fingerprint is
+// the same each time a query chooses the same plan, even if the query is
+// executed with different placeholder values. Two baselines have the same
+// fingerprint if and only if they describe the same plan, barring hash
+// collisions, so the fingerprint can be used to detect plan changes and plan
+// flapping without storing or comparing the baselines themselves.
+//
+// The fingerprint is stable across executions and across nodes, but it
+// changes if an operator is renamed or if the format of PlanBaseline changes.
+func (b *PlanBaseline) Fingerprint() uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "v%d:", b.Version)
+	writeBaselineFingerprint(h, &b.Root)
+	return h.Sum64()
+}
+
+// writeBaselineFingerprint writes the fields of the given node that are
+// compared by sameBaselineNode, and those of its children, to w.
+func writeBaselineFingerprint(w io.Writer, n *BaselineNode) {
+	fmt.Fprintf(w, "%s[%d", n.Op, n.TableID)
+	for _, id := range n.IndexIDs {
+		fmt.Fprintf(w, ",%d", id)
+	}
+	fmt.Fprint(w, "](")
+	for i := range n.Children {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		writeBaselineFingerprint(w, &n.Children[i])
+	}
+	fmt.Fprint(w, ")")
+}
+
+// describeBaselineNode returns the BaselineNode for the given expression in the
+// lowest cost tree.
+func describeBaselineNode(md *opt.Metadata, e memo.RelExpr) BaselineNode {
+	n := describeBaselineOp(md, e)
+	for i, cnt := 0, e.ChildCount(); i < cnt; i++ {
+		if child, ok := e.Child(i).(memo.RelExpr); ok {
+			n.Children = append(n.Children, describeBaselineNode(md, child))
+		}
+	}
+	return n
+}
+
+// describePlanNode returns the BaselineNode for the given node of an enumerated
+// plan. Unlike describeBaselineNode, it describes the children chosen for the
+// node rather than the lowest cost children of its expression.
+func describePlanNode(md *opt.Metadata, p *PlanNode) BaselineNode {
+	n := describeBaselineOp(md, p.Expr)
+	for _, child := range p.Children {
+		n.Children = append(n.Children, describePlanNode(md, child))
+	}
+	return n
+}
+
+// describeBaselineOp returns the BaselineNode for the given expression, without
+// its children.
+func describeBaselineOp(md *opt.Metadata, e memo.RelExpr) BaselineNode {
+	n := BaselineNode{Op: e.Op().String()}
+	tabID, indexOrds := accessedIndexes(e)
+	if tabID != 0 {
+		tab := md.Table(tabID)
+		n.TableID = tab.ID()
+		n.Table = string(tab.Name())
+		for _, ord := range indexOrds {
+			idx := tab.Index(ord)
+			n.IndexIDs = append(n.IndexIDs, idx.ID())
+			n.Indexes = append(n.Indexes, string(idx.Name()))
+		}
+	}
+	return n
+}
+
+// accessedIndexes returns the table and index ordinals accessed by the given
+// expression, or a zero table ID if it does not access a table directly.
+func accessedIndexes(e memo.RelExpr) (opt.TableID, []cat.IndexOrdinal) {
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		return t.Table, []cat.IndexOrdinal{t.Index}
+
+	case *memo.IndexJoinExpr:
+		return t.Table, nil
+
+	case *memo.LookupJoinExpr:
+		return t.Table, []cat.IndexOrdinal{t.Index}
+
+	case *memo.InvertedJoinExpr:
+		return t.Table, []cat.IndexOrdinal{t.Index}
+
+	case *memo.ZigzagJoinExpr:
+		return t.LeftTable, []cat.IndexOrdinal{t.LeftIndex, t.RightIndex}
+	}
+	return 0, nil
+}
+
+// SetPlanBaseline causes the optimizer to reproduce the plan described by the
+// given baseline, which was captured by CapturePlanBaseline for the same
+// query. It returns an error if the baseline refers to a table or index that
+// is not accessed by the query, e.g. because the index has been dropped since
+// the baseline was captured. SetPlanBaseline must be called after the query
+// is built and before Optimize.
+//
+// As with index and join hints, any expression that is not part of the
+// baseline is given a huge cost. If the baseline cannot be reproduced, e.g.
+// because a rule that generated part of it was removed, the cheapest plan is
+// chosen instead; PlanBaselineReproduced can be used to detect this.
+func (o *Optimizer) SetPlanBaseline(baseline *PlanBaseline) error {
+	m, err := newPlanBaselineMatcher(o.mem.Metadata(), baseline)
+	if err != nil {
+		return err
+	}
+	o.baseline = m
+	return nil
+}
+
+// PlanBaselineReproduced returns true if the lowest cost tree is the plan
+// described by the baseline passed to SetPlanBaseline. It must be called after
+// Optimize.
+func (o *Optimizer) PlanBaselineReproduced() bool {
+	return o.reproducesBaseline(o.baseline)
+}
+
+// SetPreviousPlan makes the optimizer prefer the plan that was previously
+// chosen for the same query, as captured by CapturePlanBaseline, over a new
+// plan whose estimated cost is lower by no more than the given fraction of
+// the new plan's cost. For example, with a tolerance of 0.1 the previous plan
+// is kept unless the new plan is more than 10% cheaper. This prevents the
+// plan from flapping between alternatives with similar costs when statistics
+// fluctuate slightly. A tolerance of 0 always prefers the lower estimated
+// cost. SetPreviousPlan must be called after the query is built and before
+// Optimize.
+//
+// Unlike SetPlanBaseline, expressions that are not part of the previous plan
+// are not penalized, so the previous plan is abandoned once it is no longer
+// competitive, or if it can no longer be produced. The tolerance is applied
+// to each group as it is optimized, by preferring the candidate that
+// reproduces the corresponding part of the previous plan when the costs of
+// the candidates are close; PreviousPlanReproduced can be used to detect
+// whether the whole plan was kept. It returns an error if the previous plan
+// refers to a table or index that is not accessed by the query.
+func (o *Optimizer) SetPreviousPlan(previous *PlanBaseline, tolerance float64) error {
+	if tolerance < 0 {
+		return errors.AssertionFailedf("negative plan stability tolerance: %v", tolerance)
+	}
+	m, err := newPlanBaselineMatcher(o.mem.Metadata(), previous)
+	if err != nil {
+		return err
+	}
+	o.previousPlan = m
+	o.stabilityTolerance = tolerance
+	return nil
+}
+
+// PreviousPlanReproduced returns true if the lowest cost tree is the plan
+// passed to SetPreviousPlan. It must be called after Optimize.
+func (o *Optimizer) PreviousPlanReproduced() bool {
+	return o.reproducesBaseline(o.previousPlan)
+}
+
+// reproducesBaseline returns true if the lowest cost tree is the plan
+// described by the baseline of the given matcher, which may be nil.
+func (o *Optimizer) reproducesBaseline(m *planBaselineMatcher) bool {
+	if m == nil {
+		return false
+	}
+	captured, err := o.CapturePlanBaseline()
+	if err != nil {
+		return false
+	}
+	return sameBaselineNode(&captured.Root, &m.baseline.Root)
+}
+
+// validateBaselineNode returns an error if the given node or its descendants
+// refer to a table or index that is not accessed by the query.
+func validateBaselineNode(md *opt.Metadata, n *BaselineNode) error {
+	if n.TableID != 0 {
+		tab := baselineTable(md, n.TableID)
+		if tab == nil {
+			return pgerror.Newf(pgcode.UndefinedTable,
+				"plan baseline is no longer valid: table %q (%d) is not accessed by the query",
+				n.Table, n.TableID)
+		}
+		for i, id := range n.IndexIDs {
+			if baselineIndexOrdinal(tab, id) < 0 {
+				var name string
+				if i < len(n.Indexes) {
+					name = n.Indexes[i]
+				}
+				return pgerror.Newf(pgcode.UndefinedObject,
+					"plan baseline is no longer valid: index %q (%d) of table %q does not exist",
+					name, id, tab.Name())
+			}
+		}
+	}
+	for i := range n.Children {
+		if err := validateBaselineNode(md, &n.Children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// baselineTable returns the table in the metadata with the given stable ID, or
+// nil if there is none.
+func baselineTable(md *opt.Metadata, id cat.StableID) cat.Table {
+	for _, tab := range md.AllTables() {
+		if tab.Table.ID() == id {
+			return tab.Table
+		}
+	}
+	return nil
+}
+
+// baselineIndexOrdinal returns the ordinal of the index of the given table
+// with the given stable ID, or -1 if there is none.
+func baselineIndexOrdinal(tab cat.Table, id cat.StableID) cat.IndexOrdinal {
+	for i, n := 0, tab.IndexCount(); i < n; i++ {
+		if tab.Index(i).ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameBaselineNode returns true if the given nodes describe the same plan. The
+// names of tables and indexes are ignored.
+func sameBaselineNode(a, b *BaselineNode) bool {
+	if a.Op != b.Op || a.TableID != b.TableID || len(a.IndexIDs) != len(b.IndexIDs) ||
+		len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.IndexIDs {
+		if a.IndexIDs[i] != b.IndexIDs[i] {
+			return false
+		}
+	}
+	for i := range a.Children {
+		if !sameBaselineNode(&a.Children[i], &b.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// planBaselineMatcher determines which memo expressions can be part of the
+// plan described by a PlanBaseline.
+type planBaselineMatcher struct {
+	md       *opt.Metadata
+	baseline *PlanBaseline
+
+	// matches caches the pairs of memo groups and baseline nodes for which the
+	// group contains an expression that matches the node. Only positive results
+	// are cached, since expressions that match may be added to a group after it
+	// is first checked.
+	matches map[baselineMatchKey]struct{}
+}
+
+// newPlanBaselineMatcher returns a matcher for the given baseline, or an error
+// if the baseline refers to a table or index that is not accessed by the query.
+func newPlanBaselineMatcher(md *opt.Metadata, baseline *PlanBaseline) (*planBaselineMatcher, error) {
+	if err := validateBaselineNode(md, &baseline.Root); err != nil {
+		return nil, err
+	}
+	return &planBaselineMatcher{
+		md:       md,
+		baseline: baseline,
+		matches:  make(map[baselineMatchKey]struct{}),
+	}, nil
+}
+
+type baselineMatchKey struct {
+	group memo.RelExpr
+	node  *BaselineNode
+}
+
+// allowsExpr returns true if the given expression matches some node in the
+// baseline. Enforcers are always allowed, since they are not part of the memo
+// and are only added when they are needed to provide the required properties.
+func (m *planBaselineMatcher) allowsExpr(e memo.RelExpr) bool {
+	if isBaselineEnforcer(e.Op().String()) {
+		return true
+	}
+	return m.allowsExprForNode(e, &m.baseline.Root)
+}
+
+func (m *planBaselineMatcher) allowsExprForNode(e memo.RelExpr, n *BaselineNode) bool {
+	if m.matchesExpr(e, n) {
+		return true
+	}
+	for i := range n.Children {
+		if m.allowsExprForNode(e, &n.Children[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExpr returns true if the given memo expression matches the given
+// baseline node, and each of its relational inputs contains an expression
+// that matches the corresponding child of the node.
+func (m *planBaselineMatcher) matchesExpr(e memo.RelExpr, n *BaselineNode) bool {
+	if e.Op().String() != n.Op {
+		return false
+	}
+	tabID, indexOrds := accessedIndexes(e)
+	if tabID == 0 {
+		if n.TableID != 0 {
+			return false
+		}
+	} else {
+		tab := m.md.Table(tabID)
+		if tab.ID() != n.TableID || len(indexOrds) != len(n.IndexIDs) {
+			return false
+		}
+		for i, ord := range indexOrds {
+			if tab.Index(ord).ID() != n.IndexIDs[i] {
+				return false
+			}
+		}
+	}
+
+	child := 0
+	for i, cnt := 0, e.ChildCount(); i < cnt; i++ {
+		input, ok := e.Child(i).(memo.RelExpr)
+		if !ok {
+			continue
+		}
+		if child >= len(n.Children) || !m.groupMatches(input, &n.Children[child]) {
+			return false
+		}
+		child++
+	}
+	return child == len(n.Children)
+}
+
+// groupMatches returns true if the memo group of the given expression contains
+// an expression that matches the given baseline node. Enforcers in the
+// baseline are skipped, since they are not part of the memo.
+func (m *planBaselineMatcher) groupMatches(grp memo.RelExpr, n *BaselineNode) bool {
+	for isBaselineEnforcer(n.Op) && len(n.Children) == 1 {
+		n = &n.Children[0]
+	}
+	grp = grp.FirstExpr()
+	key := baselineMatchKey{group: grp, node: n}
+	if _, ok := m.matches[key]; ok {
+		return true
+	}
+	for member := grp; member != nil; member = member.NextExpr() {
+		if m.matchesExpr(member, n) {
+			m.matches[key] = struct{}{}
+			return true
+		}
+	}
+	return false
+}
+
+// isBaselineEnforcer returns true if the named operator is an enforcer, which
+// the optimizer adds to provide required physical properties.
+func isBaselineEnforcer(op string) bool {
+	switch op {
+	case opt.SortOp.String(), opt.TopKSortOp.String(), opt.DistributeOp.String(),
+		opt.GatherOp.String():
+		return true
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/errors"
+)
+
+// maxEnumeratedPlans is the maximum number of plans returned by
+// EnumeratePlansWithin. It also bounds the number of alternatives that are
+// considered for each group, so that enumeration remains tractable for large
+// memos.
+const maxEnumeratedPlans = 100
+
+// maxCachedPlanLists is the maximum number of (group, required properties)
+// pairs for which EnumeratePlansWithin caches the enumerated plans. Each cached
+// list holds at most maxEnumeratedPlans plans.
+const maxCachedPlanLists = 1000
+
+// PlanNode is a node in a complete plan materialized by EnumeratePlansWithin or
+// OptimizeTopK.
+type PlanNode struct {
+	// Expr is the memo expression chosen for this node. If the node is an
+	// enforcer (e.g. a Sort that provides a required ordering), Expr is a new
+	// expression that is not part of the memo, and its input is an expression
+	// in the memo group of Children[0].
+	Expr memo.RelExpr
+
+	// Required is the set of physical properties required of this node.
+	Required *physical.Required
+
+	// Cost is the estimated cost of this node, including its children.
+	Cost memo.Cost
+
+	// Children contains the plan nodes chosen for each relational child of
+	// Expr, in order.
+	Children []*PlanNode
+}
+
+// EnumeratedPlan is a complete plan materialized by EnumeratePlansWithin or
+// OptimizeTopK.
+type EnumeratedPlan struct {
+	// Root is the root node of the plan.
+	Root *PlanNode
+
+	// Cost is the estimated cost of the entire plan.
+	Cost memo.Cost
+
+	// Fingerprint uniquely identifies the shape of the plan within the memo.
+	Fingerprint string
+}
+
+// EnumeratePlansWithin walks the costed memo and materializes every complete
+// plan whose cost is within the given factor of the cost of the best plan. For
+// example, a factor of 1.1 returns all plans that cost no more than 10% more
+// than the best plan. Plans are returned in order of increasing cost, with
+// duplicate plans removed, and at most maxEnumeratedPlans plans are returned.
+//
+// EnumeratePlansWithin must be called after Optimize. It re-derives the costs
+// of the non-optimal members of each group, so it is relatively expensive and
+// is intended for debugging and tooling that suggests plan hints. Only the
+// expressions that were costed during optimization are considered, so plans
+// which were pruned before costing (e.g. because a rule was disabled) are not
+// returned.
+func (o *Optimizer) EnumeratePlansWithin(factor float64) ([]EnumeratedPlan, error) {
+	if !o.mem.IsOptimized() {
+		return nil, errors.AssertionFailedf("cannot enumerate plans before optimization")
+	}
+	if factor < 1 {
+		return nil, errors.AssertionFailedf("plan enumeration factor must be at least 1: %v", factor)
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, errors.AssertionFailedf("can only enumerate plans for relational root expressions")
+	}
+	rootProps := o.mem.RootProps()
+	state := o.lookupOptState(root.FirstExpr(), rootProps)
+	if state == nil {
+		return nil, errors.AssertionFailedf("root group has not been optimized")
+	}
+
+	e := planEnumerator{o: o}
+	nodes := e.enumerateGroup(root, rootProps, state.cost*memo.Cost(factor))
+
+	plans := make([]EnumeratedPlan, 0, len(nodes))
+	seen := make(map[string]struct{}, len(nodes))
+	for _, n := range nodes {
+		fp := n.fingerprint()
+		if _, ok := seen[fp]; ok {
+			continue
+		}
+		seen[fp] = struct{}{}
+		plans = append(plans, EnumeratedPlan{Root: n, Cost: n.Cost, Fingerprint: fp})
+	}
+	return plans, nil
+}
+
+// planEnumerator enumerates the plans within a cost budget for each group in
+// the memo.
+type planEnumerator struct {
+	o *Optimizer
+
+	// cache contains the plans that were enumerated for each group and set of
+	// required properties, along with the budget within which they were
+	// enumerated. A group is reached from every combination of alternatives for
+	// the groups above it, and would otherwise be enumerated again each time. It
+	// contains at most maxCachedPlanLists entries.
+	cache map[groupStateKey]cachedPlanList
+}
+
+// cachedPlanList is a list of plans enumerated for a group within a budget,
+// sorted by increasing cost.
+type cachedPlanList struct {
+	budget memo.Cost
+	plans  []*PlanNode
+}
+
+// enumerateGroup returns the plans for the given group with the given required
+// properties whose cost does not exceed the budget, sorted by increasing cost.
+// The returned plans may be shared with other callers, and must not be
+// modified.
+func (e *planEnumerator) enumerateGroup(
+	grp memo.RelExpr, required *physical.Required, budget memo.Cost,
+) []*PlanNode {
+	grp = grp.FirstExpr()
+	state := e.o.lookupOptState(grp, required)
+	if state == nil || state.cost > budget {
+		return nil
+	}
+
+	// The plans within a smaller budget than that of a cached list are a prefix
+	// of the list, since it is sorted by cost.
+	key := groupStateKey{group: grp, required: required}
+	if cached, ok := e.cache[key]; ok && budget <= cached.budget {
+		n := sort.Search(len(cached.plans), func(i int) bool {
+			return cached.plans[i].Cost > budget
+		})
+		return cached.plans[:n]
+	}
+
+	var res []*PlanNode
+	for member := grp; member != nil; member = member.NextExpr() {
+		if CanProvidePhysicalProps(e.o.evalCtx, member, required) {
+			res = append(res, e.enumerateMember(member, required, budget)...)
+		}
+	}
+	res = append(res, e.enumerateEnforcers(grp, required, budget)...)
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Cost < res[j].Cost })
+	if len(res) > maxEnumeratedPlans {
+		res = res[:maxEnumeratedPlans]
+	}
+
+	if e.cache == nil {
+		e.cache = make(map[groupStateKey]cachedPlanList)
+	}
+	if _, ok := e.cache[key]; ok || len(e.cache) < maxCachedPlanLists {
+		e.cache[key] = cachedPlanList{budget: budget, plans: res}
+	}
+	return res
+}
+
+// enumerateMember returns the plans rooted at the given member expression
+// whose cost does not exceed the budget.
+func (e *planEnumerator) enumerateMember(
+	member memo.RelExpr, required *physical.Required, budget memo.Cost,
+) []*PlanNode {
+	// Determine the minimum cost of each child, which is the cost of the best
+	// expression in its group.
+	var relChildren []int
+	var childProps []*physical.Required
+	var minChildCosts []memo.Cost
+	cost := e.o.coster.ComputeCost(member, required)
+	for i, n := 0, member.ChildCount(); i < n; i++ {
+		props := BuildChildPhysicalProps(e.o.mem, member, i, required)
+		switch t := member.Child(i).(type) {
+		case memo.RelExpr:
+			state := e.o.lookupOptState(t.FirstExpr(), props)
+			if state == nil {
+				// The child was never optimized with these properties, so the
+				// member was never costed.
+				return nil
+			}
+			relChildren = append(relChildren, i)
+			childProps = append(childProps, props)
+			minChildCosts = append(minChildCosts, state.cost)
+			if !isApplyJoinRightInput(e.o.mem, member, i) {
+				cost += state.cost
+			}
+		case opt.ScalarExpr:
+			cost += e.scalarCost(t)
+		}
+	}
+	if cost > budget {
+		return nil
+	}
+
+	// Enumerate the alternatives for each child. Each child can use the slack
+	// between the budget and the minimum cost of the member.
+	slack := budget - cost
+	childPlans := make([][]*PlanNode, len(relChildren))
+	for i, ord := range relChildren {
+		childPlans[i] = e.enumerateGroup(
+			member.Child(ord).(memo.RelExpr), childProps[i], minChildCosts[i]+slack,
+		)
+		if len(childPlans[i]) == 0 {
+			return nil
+		}
+	}
+
+	// Combine the alternatives for each child, discarding combinations that
+	// exceed the budget.
+	ownCost := cost
+	for i, c := range minChildCosts {
+		if !isApplyJoinRightInput(e.o.mem, member, relChildren[i]) {
+			ownCost -= c
+		}
+	}
+	var res []*PlanNode
+	var combine func(i int, cost memo.Cost, children []*PlanNode)
+	combine = func(i int, cost memo.Cost, children []*PlanNode) {
+		if len(res) >= maxEnumeratedPlans || cost > budget {
+			return
+		}
+		if i == len(childPlans) {
+			res = append(res, &PlanNode{
+				Expr:     member,
+				Required: required,
+				Cost:     cost,
+				Children: append([]*PlanNode(nil), children...),
+			})
+			return
+		}
+		for _, child := range childPlans[i] {
+			childCost := child.Cost
+			if isApplyJoinRightInput(e.o.mem, member, relChildren[i]) {
+				childCost = 0
+			}
+			combine(i+1, cost+childCost, append(children, child))
+		}
+	}
+	combine(0, ownCost, make([]*PlanNode, 0, len(childPlans)))
+	return res
+}
+
+// enforcerFor returns an enforcer expression that provides one of the given
+// required properties, along with the properties that must be required of its
+// input, mirroring Optimizer.enforceProps. It returns nil if no property needs
+// to be enforced.
+func (e *planEnumerator) enforcerFor(
+	grp memo.RelExpr, required *physical.Required,
+) (enforcer memo.RelExpr, inputProps *physical.Required) {
+	p := e.o.enforcerFor(required)
+	if p == nil {
+		return nil, nil
+	}
+	enforcer = p.newEnforcer(e.o, grp, required)
+	return enforcer, BuildChildPhysicalProps(e.o.mem, enforcer, 0, required)
+}
+
+// enumerateEnforcers returns the plans in which an enforcer provides one of
+// the required properties of the given group, and whose cost does not exceed
+// the budget.
+func (e *planEnumerator) enumerateEnforcers(
+	grp memo.RelExpr, required *physical.Required, budget memo.Cost,
+) []*PlanNode {
+	enforcer, inputProps := e.enforcerFor(grp, required)
+	if enforcer == nil {
+		return nil
+	}
+	enforcerCost := e.o.coster.ComputeCost(enforcer, required)
+	if enforcerCost > budget {
+		return nil
+	}
+	inputs := e.enumerateGroup(grp, inputProps, budget-enforcerCost)
+	res := make([]*PlanNode, len(inputs))
+	for i, input := range inputs {
+		res[i] = &PlanNode{
+			Expr:     enforcer,
+			Required: required,
+			Cost:     enforcerCost + input.Cost,
+			Children: []*PlanNode{input},
+		}
+	}
+	return res
+}
+
+// scalarCost returns the cost of the relational expressions nested within the
+// given scalar expression, such as subqueries, mirroring
+// Optimizer.optimizeScalarExpr.
+func (e *planEnumerator) scalarCost(scalar opt.ScalarExpr) memo.Cost {
+	var cost memo.Cost
+	for i, n := 0, scalar.ChildCount(); i < n; i++ {
+		props := BuildChildPhysicalPropsScalar(e.o.mem, scalar, i)
+		switch t := scalar.Child(i).(type) {
+		case memo.RelExpr:
+			if state := e.o.lookupOptState(t.FirstExpr(), props); state != nil {
+				cost += state.cost
+			}
+		case opt.ScalarExpr:
+			cost += e.scalarCost(t)
+		}
+	}
+	return cost
+}
+
+// fingerprint returns a string that uniquely identifies the shape of the plan
+// rooted at this node within the memo.
+func (n *PlanNode) fingerprint() string {
+	var buf bytes.Buffer
+	n.writeFingerprint(&buf)
+	return buf.String()
+}
+
+func (n *PlanNode) writeFingerprint(buf *bytes.Buffer) {
+	switch t := n.Expr.(type) {
+	case *memo.SortExpr:
+		// Enforcers are not part of the memo, so identify them by the ordering
+		// that they provide.
+		fmt.Fprintf(buf, "%s[%s]", t.Op(), n.Required.Ordering.String())
+		if !t.InputOrdering.Any() {
+			fmt.Fprintf(buf, "[input=%s]", t.InputOrdering.String())
+		}
+	case *memo.TopKSortExpr:
+		fmt.Fprintf(buf, "%s[%s][k=%d]", t.Op(), n.Required.Ordering.String(), t.K)
+	case *memo.DistributeExpr:
+		fmt.Fprintf(buf, "%s[%s]", t.Op(), n.Required.Distribution.String())
+	case *memo.GatherExpr:
+		fmt.Fprintf(buf, "%s[%d]", t.Op(), t.InputParallelism)
+	default:
+		fmt.Fprintf(buf, "%s@%p", t.Op(), t)
+	}
+	if len(n.Children) == 0 {
+		return
+	}
+	buf.WriteByte('(')
+	for i, child := range n.Children {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		child.writeFingerprint(buf)
+	}
+	buf.WriteByte(')')
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/build"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
+	"github.com/cockroachdb/errors"
+)
+
+// planExportVersion is the version of the serialized PlanExport format. It
+// must be incremented whenever the format changes incompatibly.
+const planExportVersion = 1
+
+// PlanExport is a portable, self-describing description of the lowest cost
+// tree chosen for a query. In addition to the shape of the plan, as described
+// by a PlanBaseline, it records the query, the version of CockroachDB that
+// chose the plan, and the cost and row count that were estimated for each
+// operator. It can be serialized, and later replayed with ReplayPlan against
+// a catalog with the same schema, possibly by a different version, in order to
+// compare the plans and estimates of the two versions, or to investigate the
+// plan of a customer's query without access to the customer's cluster.
+type PlanExport struct {
+	// Version is the version of the format that the plan was exported with.
+	Version int `json:"version"`
+
+	// BuildVersion is the version of CockroachDB that exported the plan. It is
+	// informational only.
+	BuildVersion string `json:"build_version"`
+
+	// SQL is the query that was planned.
+	SQL string `json:"sql"`
+
+	// Root describes the root of the plan.
+	Root ExportedNode `json:"root"`
+}
+
+// ExportedNode describes a single operator in a PlanExport.
+type ExportedNode struct {
+	// Op, TableID, IndexIDs, Table and Indexes are the same as the fields of a
+	// BaselineNode.
+	Op       string         `json:"op"`
+	TableID  cat.StableID   `json:"table_id,omitempty"`
+	IndexIDs []cat.StableID `json:"index_ids,omitempty"`
+	Table    string         `json:"table,omitempty"`
+	Indexes  []string       `json:"indexes,omitempty"`
+
+	// Cost is the estimated cost of the operator, including its inputs.
+	Cost float64 `json:"cost"`
+
+	// RowCount is the estimated number of rows returned by the operator.
+	RowCount float64 `json:"row_count"`
+
+	// Children describes the relational inputs of the operator, in order.
+	Children []ExportedNode `json:"children,omitempty"`
+}
+
+// Marshal returns the serialized form of the plan.
+func (e *PlanExport) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// UnmarshalPlanExport parses a plan serialized by PlanExport.Marshal.
+func UnmarshalPlanExport(data []byte) (*PlanExport, error) {
+	var e PlanExport
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, pgerror.Wrap(err, pgcode.InvalidParameterValue, "invalid plan export")
+	}
+	if e.Version != planExportVersion {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"unsupported plan export version %d", e.Version)
+	}
+	return &e, nil
+}
+
+// Baseline returns the PlanBaseline that describes the shape of the plan.
+func (e *PlanExport) Baseline() *PlanBaseline {
+	return &PlanBaseline{Version: planBaselineVersion, Root: e.Root.baselineNode()}
+}
+
+// baselineNode returns the BaselineNode that describes the same operator as
+// this node, and the same inputs.
+func (n *ExportedNode) baselineNode() BaselineNode {
+	b := BaselineNode{
+		Op:       n.Op,
+		TableID:  n.TableID,
+		IndexIDs: n.IndexIDs,
+		Table:    n.Table,
+		Indexes:  n.Indexes,
+	}
+	for i := range n.Children {
+		b.Children = append(b.Children, n.Children[i].baselineNode())
+	}
+	return b
+}
+
+// ExportPlan returns a PlanExport that describes the lowest cost tree, which
+// was chosen for the given query. It must be called after Optimize.
+func (o *Optimizer) ExportPlan(sql string) (*PlanExport, error) {
+	if !o.mem.IsOptimized() {
+		return nil, errors.AssertionFailedf("cannot export a plan before optimization")
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, errors.AssertionFailedf("can only export plans for relational root expressions")
+	}
+	return &PlanExport{
+		Version:      planExportVersion,
+		BuildVersion: build.BinaryVersion(),
+		SQL:          sql,
+		Root:         o.exportNode(root),
+	}, nil
+}
+
+// exportNode returns the ExportedNode for the given expression in the lowest
+// cost tree.
+func (o *Optimizer) exportNode(e memo.RelExpr) ExportedNode {
+	b := describeBaselineNode(o.mem.Metadata(), e)
+	n := ExportedNode{
+		Op:       b.Op,
+		TableID:  b.TableID,
+		IndexIDs: b.IndexIDs,
+		Table:    b.Table,
+		Indexes:  b.Indexes,
+		Cost:     float64(e.Cost()),
+		RowCount: e.Relational().Stats.RowCount,
+	}
+	for i, cnt := 0, e.ChildCount(); i < cnt; i++ {
+		if child, ok := e.Child(i).(memo.RelExpr); ok {
+			n.Children = append(n.Children, o.exportNode(child))
+		}
+	}
+	return n
+}
+
+// PlanReplay is the outcome of ReplayPlan.
+type PlanReplay struct {
+	// Exported is the plan that was replayed.
+	Exported *PlanExport
+
+	// Replayed is the plan chosen when the exported plan was replayed, costed
+	// by the current coster.
+	Replayed *PlanExport
+
+	// Reproduced is true if Replayed has the same shape as Exported.
+	Reproduced bool
+}
+
+// ReplayPlan re-validates the given exported plan against the catalog of the
+// optimizer, and reproduces it in order to re-cost it with the current
+// coster. The query of the exported plan must already have been built into
+// the memo. ReplayPlan returns an error if the plan refers to a table or index
+// that is not accessed by the query; see SetPlanBaseline. It optimizes the
+// query itself, so it must be called instead of Optimize.
+//
+// If the plan cannot be reproduced, e.g. because it relies on a rule that no
+// longer exists, the lowest cost plan is returned instead, and
+// PlanReplay.Reproduced is false.
+func (o *Optimizer) ReplayPlan(exported *PlanExport) (*PlanReplay, error) {
+	if err := o.SetPlanBaseline(exported.Baseline()); err != nil {
+		return nil, err
+	}
+	if _, err := o.Optimize(); err != nil {
+		return nil, err
+	}
+	replayed, err := o.ExportPlan(exported.SQL)
+	if err != nil {
+		return nil, err
+	}
+	return &PlanReplay{
+		Exported:   exported,
+		Replayed:   replayed,
+		Reproduced: o.PlanBaselineReproduced(),
+	}, nil
+}
+
+// String formats the replay as a tree of operators. If the plan was
+// reproduced, the estimates of the exported plan are shown next to those of
+// the replayed plan. For example:
+//
+//   replay v21.2.0 -> v22.1.0
+//    └── index-join abc: cost 24.12 -> 25.33, rows 10 -> 10
+//         └── scan abc@c_idx: cost 14.31 -> 14.31, rows 10 -> 10
+//
+// Otherwise, the exported and replayed plans are shown one after the other.
+func (r *PlanReplay) String() string {
+	tp := treeprinter.New()
+	root := tp.Childf("replay %s -> %s", r.Exported.BuildVersion, r.Replayed.BuildVersion)
+	if r.Reproduced {
+		formatReplayedNode(root, &r.Exported.Root, &r.Replayed.Root)
+	} else {
+		formatReplayedNode(root.Child("exported"), &r.Exported.Root, nil)
+		formatReplayedNode(root.Child("replayed (plan not reproduced)"), &r.Replayed.Root, nil)
+	}
+	return tp.String()
+}
+
+// formatReplayedNode adds a child to tp for the given node, along with the
+// estimates of the corresponding replayed node if it is not nil, and then
+// adds its children.
+func formatReplayedNode(tp treeprinter.Node, n, replayed *ExportedNode) {
+	var b strings.Builder
+	b.WriteString(n.Op)
+	if n.Table != "" {
+		fmt.Fprintf(&b, " %s", n.Table)
+		if len(n.Indexes) > 0 {
+			fmt.Fprintf(&b, "@%s", strings.Join(n.Indexes, ","))
+		}
+	}
+	if replayed != nil {
+		fmt.Fprintf(&b, ": cost %.2f -> %.2f, rows %.0f -> %.0f",
+			n.Cost, replayed.Cost, n.RowCount, replayed.RowCount)
+	} else {
+		fmt.Fprintf(&b, ": cost %.2f, rows %.0f", n.Cost, n.RowCount)
+	}
+	c := tp.Child(b.String())
+	for i := range n.Children {
+		var replayedChild *ExportedNode
+		if replayed != nil {
+			replayedChild = &replayed.Children[i]
+		}
+		formatReplayedNode(c, &n.Children[i], replayedChild)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// RecordPlanRules causes Optimize to track the exploration rule that generated
+// each memo expression, so that PlanRules can return the rules that were needed
+// to generate the lowest cost tree. An expression is generated by a rule if the
+// rule added it to an existing group, or if its group was created while the
+// rule was applied.
+//
+// This allows a memo that was prepared with placeholders to be optimized for
+// later executions by only the rules that generated the plan of its first
+// execution (see RestrictExplorationToRules). RecordPlanRules must be called
+// after the memo is built, and after any calls to NotifyOnMatchedRule and
+// NotifyOnAppliedRule, since it chains onto the existing callbacks. It replaces
+// any callback set by Memo.NotifyOnNewGroup.
+func (o *Optimizer) RecordPlanRules() {
+	o.planRules = &planRuleTracker{generatedBy: make(map[memo.RelExpr]ruleApplication)}
+
+	// Only set the callbacks on the optimizer, not the factory, since only
+	// exploration rules are tracked.
+	matchedRule := o.matchedRule
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		if matchedRule != nil && !matchedRule(ruleName) {
+			return false
+		}
+		o.planRules.recordMatched(ruleName)
+		return true
+	}
+	appliedRule := o.appliedRule
+	o.appliedRule = func(ruleName opt.RuleName, source, target opt.Expr) {
+		if appliedRule != nil {
+			appliedRule(ruleName, source, target)
+		}
+		o.planRules.recordApplied(ruleName, source, target)
+	}
+	o.mem.NotifyOnNewGroup(o.planRules.recordNewGroup)
+}
+
+// PlanRules returns the exploration rules that were needed to generate the
+// lowest cost tree found by the last call to Optimize, including the rules
+// that generated the expressions those rules were applied to. It returns the
+// empty set if RecordPlanRules was not called.
+func (o *Optimizer) PlanRules() RuleSet {
+	var rules RuleSet
+	if o.planRules != nil && o.mem.IsOptimized() {
+		o.planRules.collect(o.mem.RootExpr(), &rules, make(map[memo.RelExpr]struct{}))
+	}
+	return rules
+}
+
+// RestrictExplorationToRules restricts exploration to the given exploration
+// rules, plus the rules that re-derive scan constraints and push down limits
+// (see RestrictExplorationForPlaceholders) and the essential rules. It is meant
+// to be called with the rules returned by PlanRules for the first execution of
+// a prepared statement, after Factory.AssignPlaceholders and before Optimize,
+// so that later executions search only the alternatives that produced the
+// first plan, and re-run constraint generation and costing for the new
+// placeholder values. Normalization rules are not affected.
+func (o *Optimizer) RestrictExplorationToRules(rules RuleSet) {
+	allowed := rules.Union(placeholderExplorationRules).Union(essentialRules)
+	matchedRule := o.matchedRule
+
+	// Only set the callback on the optimizer, not the factory, since
+	// normalization rules should run as usual.
+	o.matchedRule = func(ruleName opt.RuleName) bool {
+		if ruleName.IsExplore() && !allowed.Contains(int(ruleName)) {
+			return false
+		}
+		return matchedRule == nil || matchedRule(ruleName)
+	}
+}
+
+// planRuleTracker tracks the exploration rule application that generated each
+// memo expression during a single optimization.
+type planRuleTracker struct {
+	// current is the exploration rule that is being applied, or zero if no
+	// exploration rule is being applied.
+	current opt.RuleName
+
+	// newGroups are the groups that have been created since the current rule
+	// was matched.
+	newGroups []memo.RelExpr
+
+	// generatedBy maps each expression added by an exploration rule, and the
+	// first expression of each group created while applying one, to the rule
+	// application.
+	generatedBy map[memo.RelExpr]ruleApplication
+}
+
+// ruleApplication identifies an application of an exploration rule by the
+// rule and the expression that it matched.
+type ruleApplication struct {
+	rule   opt.RuleName
+	source memo.RelExpr
+}
+
+// recordMatched records that the given rule is about to be applied.
+func (t *planRuleTracker) recordMatched(ruleName opt.RuleName) {
+	if ruleName.IsExplore() {
+		t.current = ruleName
+		t.newGroups = t.newGroups[:0]
+	}
+}
+
+// recordNewGroup records that a group was created with the given expression.
+func (t *planRuleTracker) recordNewGroup(e opt.Expr) {
+	if rel, ok := e.(memo.RelExpr); ok && t.current != 0 {
+		t.newGroups = append(t.newGroups, rel)
+	}
+}
+
+// recordApplied records the expressions that were added to the memo by the
+// given exploration rule. As for ruleOutcomeTracker, target is the first of the
+// expressions that were added to the group of source.
+func (t *planRuleTracker) recordApplied(ruleName opt.RuleName, source, target opt.Expr) {
+	if !ruleName.IsExplore() {
+		return
+	}
+	app := ruleApplication{rule: ruleName}
+	app.source, _ = source.(memo.RelExpr)
+	for _, grp := range t.newGroups {
+		t.generatedBy[grp] = app
+	}
+	if rel, ok := target.(memo.RelExpr); ok {
+		for ; rel != nil; rel = rel.NextExpr() {
+			if _, ok := t.generatedBy[rel]; !ok {
+				t.generatedBy[rel] = app
+			}
+		}
+	}
+	t.current = 0
+	t.newGroups = t.newGroups[:0]
+}
+
+// collect adds to rules the exploration rules that generated the expressions
+// in the tree rooted at the given expression, and the expressions that those
+// rules were applied to.
+func (t *planRuleTracker) collect(
+	e opt.Expr, rules *RuleSet, visited map[memo.RelExpr]struct{},
+) {
+	if rel, ok := e.(memo.RelExpr); ok {
+		t.collectSources(rel, rules, visited)
+		t.collectSources(rel.FirstExpr(), rules, visited)
+	}
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		t.collect(e.Child(i), rules, visited)
+	}
+}
+
+// collectSources adds to rules the rule that generated the given expression,
+// and recursively, the rules that generated the expression it was generated
+// from.
+func (t *planRuleTracker) collectSources(
+	rel memo.RelExpr, rules *RuleSet, visited map[memo.RelExpr]struct{},
+) {
+	for rel != nil {
+		if _, ok := visited[rel]; ok {
+			return
+		}
+		visited[rel] = struct{}{}
+		app, ok := t.generatedBy[rel]
+		if !ok {
+			return
+		}
+		rules.Add(int(app.rule))
+		if app.source != nil {
+			t.collectSources(app.source.FirstExpr(), rules, visited)
+		}
+		rel = app.source
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/errors"
+)
+
+// PlanScorer is an external source of cost estimates, such as a learned cost
+// model, that is consulted alongside the analytic coster. See SetPlanScorer.
+type PlanScorer interface {
+	// ScorePlan returns the estimated cost of the serialized candidate subtree,
+	// which is a JSON-encoded ScoredCandidate. Like the analytic cost, the score
+	// should exclude the cost of the candidate's children. It returns ok=false
+	// if it cannot score the candidate, in which case the analytic cost is used.
+	ScorePlan(serialized []byte) (score float64, ok bool)
+}
+
+// ScoredCandidate describes a candidate expression that is passed to a
+// PlanScorer. Since a candidate is costed before the best expressions in its
+// child groups are known, each child is described by the first (normalized)
+// expression in its group.
+type ScoredCandidate struct {
+	// Op is the name of the candidate's operator.
+	Op string `json:"op"`
+
+	// Required is the set of physical properties required of the candidate, or
+	// the empty string if there are none.
+	Required string `json:"required,omitempty"`
+
+	// RowCount is the estimated number of rows returned by the candidate.
+	RowCount float64 `json:"rows"`
+
+	// AnalyticCost is the cost of the candidate estimated by the analytic
+	// coster, excluding the cost of its children.
+	AnalyticCost float64 `json:"cost,omitempty"`
+
+	// Children describes the relational children of the candidate.
+	Children []ScoredCandidate `json:"children,omitempty"`
+}
+
+// maxScoredCandidateDepth is the maximum depth of the subtree that is
+// serialized for a PlanScorer, including the candidate itself.
+const maxScoredCandidateDepth = 3
+
+// SetPlanScorer causes the optimizer to consult the given scorer each time it
+// costs a candidate expression, and to blend the score with the cost computed
+// by the current coster. The blended cost is:
+//
+//   (1 - weight) * analytic cost + weight * score
+//
+// A weight of 0 ignores the scorer (though it is still consulted, which can be
+// useful to collect training data), and a weight of 1 uses the score in place
+// of the analytic cost whenever the scorer returns one. SetPlanScorer must be
+// called after SetCoster, since it wraps the current coster.
+func (o *Optimizer) SetPlanScorer(scorer PlanScorer, weight float64) {
+	if weight < 0 || weight > 1 {
+		panic(errors.AssertionFailedf("plan scorer weight must be between 0 and 1: %v", weight))
+	}
+	o.coster = &scoringCoster{analytic: o.coster, scorer: scorer, weight: weight}
+}
+
+// scoringCoster is a Coster that blends the cost computed by an analytic
+// coster with the score returned by a PlanScorer.
+type scoringCoster struct {
+	analytic Coster
+	scorer   PlanScorer
+	weight   float64
+}
+
+var _ BatchCoster = &scoringCoster{}
+
+// ComputeCost is part of the Coster interface.
+func (c *scoringCoster) ComputeCost(candidate memo.RelExpr, required *physical.Required) memo.Cost {
+	return c.blendScore(candidate, required, c.analytic.ComputeCost(candidate, required))
+}
+
+// ComputeCosts is part of the BatchCoster interface. Each candidate is scored
+// separately.
+func (c *scoringCoster) ComputeCosts(
+	candidates []memo.RelExpr, required *physical.Required, costs []memo.Cost,
+) {
+	ComputeCosts(c.analytic, candidates, required, costs)
+	for i, candidate := range candidates {
+		costs[i] = c.blendScore(candidate, required, costs[i])
+	}
+}
+
+// blendScore blends the given cost of the candidate, computed by the analytic
+// coster, with the score returned by the scorer.
+func (c *scoringCoster) blendScore(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.Cost {
+	if !cost.Less(memo.MaxCost) {
+		// Never override a cost that prevents an expression from being chosen.
+		return cost
+	}
+
+	summary := describeCandidate(candidate, required, maxScoredCandidateDepth)
+	summary.AnalyticCost = float64(cost)
+	serialized, err := json.Marshal(&summary)
+	if err != nil {
+		return cost
+	}
+	score, ok := c.scorer.ScorePlan(serialized)
+	if !ok || score < 0 || math.IsNaN(score) || math.IsInf(score, 0) {
+		return cost
+	}
+	return memo.Cost((1-c.weight)*float64(cost) + c.weight*score)
+}
+
+// ComputeCostBreakdown is part of the Coster interface. The breakdown is
+// computed by the analytic coster, since the score is not divided between
+// resources.
+func (c *scoringCoster) ComputeCostBreakdown(
+	candidate memo.RelExpr, required *physical.Required,
+) memo.CostBreakdown {
+	return c.analytic.ComputeCostBreakdown(candidate, required)
+}
+
+// ComputeCostInterval is part of the Coster interface.
+func (c *scoringCoster) ComputeCostInterval(
+	candidate memo.RelExpr, required *physical.Required, cost memo.Cost,
+) memo.CostInterval {
+	return c.analytic.ComputeCostInterval(candidate, required, cost)
+}
+
+// describeCandidate returns a ScoredCandidate for the given expression, with
+// its relational children described up to the given depth.
+func describeCandidate(e memo.RelExpr, required *physical.Required, depth int) ScoredCandidate {
+	res := ScoredCandidate{
+		Op:       e.Op().String(),
+		RowCount: e.Relational().Stats.RowCount,
+	}
+	if required != nil && required.Defined() {
+		res.Required = required.String()
+	}
+	if depth <= 1 {
+		return res
+	}
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		if child, ok := e.Child(i).(memo.RelExpr); ok {
+			res.Children = append(res.Children, describeCandidate(child.FirstExpr(), nil, depth-1))
+		}
+	}
+	return res
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// QueryShape is a coarse classification of a normalized query, which is used
+// to select the PlanningProfile that it is optimized with.
+type QueryShape uint8
+
+const (
+	// GeneralQuery is a query that does not match any of the other shapes.
+	GeneralQuery QueryShape = iota
+
+	// PointLookupQuery is a typical OLTP query, which reads at most one row
+	// from each table that it scans, and has no joins, aggregations or window
+	// functions. Mutations of a single row are also point lookups.
+	PointLookupQuery
+
+	// StarJoinQuery is a query that joins a large fact table to two or more
+	// smaller dimension tables, with only inner joins.
+	StarJoinQuery
+
+	// AnalyticalQuery is a query that is not a point lookup, and which
+	// aggregates its input or computes window functions.
+	AnalyticalQuery
+)
+
+func (s QueryShape) String() string {
+	switch s {
+	case GeneralQuery:
+		return "general"
+	case PointLookupQuery:
+		return "point-lookup"
+	case StarJoinQuery:
+		return "star-join"
+	case AnalyticalQuery:
+		return "analytical"
+	default:
+		return fmt.Sprintf("QueryShape(%d)", s)
+	}
+}
+
+// starJoinFactRatio is the minimum ratio between the estimated row count of
+// the fact table of a star join and that of each of its dimension tables.
+const starJoinFactRatio = 10
+
+// ClassifyQueryShape returns the shape of the normalized expression rooted at
+// the given expression. It only inspects the normalized expression, so it must
+// be called before the memo is explored.
+func ClassifyQueryShape(root memo.RelExpr) QueryShape {
+	var s queryShapeSummary
+	s.summarize(root)
+	switch {
+	case s.scans > 0 && !s.maxRowsExceeded && s.joins == 0 && !s.aggregates:
+		return PointLookupQuery
+
+	case s.scans >= 3 && s.joins == s.innerJoins && s.joins == s.scans-1 && s.isStar():
+		return StarJoinQuery
+
+	case s.aggregates:
+		return AnalyticalQuery
+	}
+	return GeneralQuery
+}
+
+// queryShapeSummary counts the operators of a normalized expression that
+// determine its QueryShape.
+type queryShapeSummary struct {
+	scans      int
+	joins      int
+	innerJoins int
+	aggregates bool
+
+	// maxRowsExceeded is true if any scan, together with the filters applied
+	// directly to it, can return more than one row.
+	maxRowsExceeded bool
+
+	// scanRowCounts contains the estimated row count of each scan.
+	scanRowCounts []float64
+}
+
+// summarize adds the operators in the expression rooted at e to the summary.
+func (s *queryShapeSummary) summarize(e opt.Expr) {
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		s.scans++
+		s.scanRowCounts = append(s.scanRowCounts, t.Relational().Stats.RowCount)
+		if t.Relational().Cardinality.Max > 1 {
+			s.maxRowsExceeded = true
+		}
+		return
+
+	case *memo.SelectExpr:
+		// The filters of a Select over a Scan can limit the scan to a single
+		// row, e.g. by constraining its primary key.
+		if scan, ok := t.Input.(*memo.ScanExpr); ok {
+			s.scans++
+			s.scanRowCounts = append(s.scanRowCounts, scan.Relational().Stats.RowCount)
+			if t.Relational().Cardinality.Max > 1 {
+				s.maxRowsExceeded = true
+			}
+			s.summarize(&t.Filters)
+			return
+		}
+
+	case *memo.GroupByExpr, *memo.ScalarGroupByExpr, *memo.DistinctOnExpr, *memo.WindowExpr:
+		s.aggregates = true
+
+	case *memo.InnerJoinExpr:
+		s.innerJoins++
+	}
+	if opt.IsJoinOp(e) {
+		s.joins++
+	}
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		s.summarize(e.Child(i))
+	}
+}
+
+// isStar returns true if the estimated row count of one of the scans is at
+// least starJoinFactRatio times that of each of the other scans.
+func (s *queryShapeSummary) isStar() bool {
+	fact := 0
+	for i := range s.scanRowCounts {
+		if s.scanRowCounts[i] > s.scanRowCounts[fact] {
+			fact = i
+		}
+	}
+	for i := range s.scanRowCounts {
+		if i != fact && s.scanRowCounts[i]*starJoinFactRatio > s.scanRowCounts[fact] {
+			return false
+		}
+	}
+	return true
+}
+
+// PlanningProfile tunes the optimizer for queries of a particular QueryShape.
+// The zero value does not change how queries are optimized.
+type PlanningProfile struct {
+	// DisabledRules are the exploration rules that are not applied. Essential
+	// rules are never disabled; see DisableRules.
+	DisabledRules RuleSet
+
+	// Budget bounds the time spent exploring, as for SetBudget. If it is zero,
+	// the budget is not changed.
+	Budget time.Duration
+
+	// CostModel, if non-nil, replaces the cost model settings, as for
+	// SetCostModelSettings.
+	CostModel *CostModelSettings
+}
+
+// PlanningProfiles maps each query shape to its planning profile. Shapes that
+// are not in the map are optimized as usual.
+type PlanningProfiles map[QueryShape]PlanningProfile
+
+// DefaultPlanningProfiles returns the planning profiles that are used when
+// shape-based planning is enabled. Point lookups are only optimized with the
+// rules that are applied when planning heuristically (see heuristicRules),
+// since these generate the constrained scans and lookup joins that such
+// queries need, and the other shapes are fully optimized.
+func DefaultPlanningProfiles() PlanningProfiles {
+	var disabled RuleSet
+	for r := opt.RuleName(1); r < opt.NumRuleNames; r++ {
+		if r.IsExplore() && !heuristicRules.Contains(int(r)) {
+			disabled.Add(int(r))
+		}
+	}
+	return PlanningProfiles{
+		PointLookupQuery: {DisabledRules: disabled},
+	}
+}
+
+// SetPlanningProfiles causes Optimize to classify the normalized expression
+// with ClassifyQueryShape before it is explored, and to apply the profile for
+// its shape, if any. This lets short OLTP statements be planned with a small
+// subset of the exploration rules, while analytical queries are still fully
+// optimized. Like DisableRules, SetPlanningProfiles must be called after any
+// calls to NotifyOnMatchedRule, and before Optimize. A cost model set by the
+// profile replaces the one set by SetCostModelSettings.
+func (o *Optimizer) SetPlanningProfiles(profiles PlanningProfiles) {
+	o.planningProfiles = profiles
+}
+
+// QueryShape returns the shape of the query that was classified by Optimize
+// when planning profiles are set, or GeneralQuery if they are not.
+func (o *Optimizer) QueryShape() QueryShape {
+	return o.queryShape
+}
+
+// applyPlanningProfile classifies the root expression and applies the profile
+// for its shape.
+func (o *Optimizer) applyPlanningProfile() {
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return
+	}
+	o.queryShape = ClassifyQueryShape(root)
+	profile, ok := o.planningProfiles[o.queryShape]
+	if !ok {
+		return
+	}
+	// Rules enabled and budgets set by the hints of the statement take
+	// precedence over the profile.
+	o.DisableRules(profile.DisabledRules.Difference(o.hints.EnabledRules))
+	if profile.Budget > 0 && o.hints.Budget == 0 {
+		o.timeBudget = profile.Budget
+	}
+	if profile.CostModel != nil {
+		o.SetCostModelSettings(*profile.CostModel)
+	}
+}
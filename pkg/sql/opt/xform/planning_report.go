@@ -0,0 +1,100 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+)
+
+// PlanningReport is a compact summary of the resources used by the optimizer
+// to plan a statement. It is included in statement diagnostics bundles and in
+// the output of EXPLAIN ANALYZE (VERBOSE), so that slow planning can be
+// diagnosed without a custom build.
+type PlanningReport struct {
+	// Optimized is true if the report describes a call to Optimize. It is false
+	// if the statement reused a memo that was optimized for a previous
+	// statement, in which case the other fields are zero.
+	Optimized bool
+
+	// NormalizeTime, ExploreTime, CostTime and SetLowestCostTreeTime are the
+	// wall times spent in each phase of planning. See Metrics.
+	NormalizeTime         time.Duration
+	ExploreTime           time.Duration
+	CostTime              time.Duration
+	SetLowestCostTreeTime time.Duration
+
+	// MemoExprs is the number of expressions in the memo, including scalar
+	// expressions and expressions that are not part of the final plan.
+	MemoExprs int
+
+	// GroupStates is the number of (group, required properties) pairs for which
+	// the lowest cost expression was searched.
+	GroupStates int
+
+	// RulesApplied is the number of times an exploration rule was applied and
+	// added at least one expression to the memo.
+	RulesApplied int
+
+	// BudgetHits is the number of distinct budgets that stopped exploration or
+	// capped the application of rules, such as the time budget or the
+	// optimizer_max_memo_exprs session setting.
+	BudgetHits int
+
+	// Ties is the number of times a candidate had the same estimated cost as
+	// the best expression of its group.
+	Ties int
+}
+
+// PlanningReport returns a report of the resources used by the last call to
+// Optimize. Unlike Metrics, it remains available after the memo is detached.
+// The report is zero if Optimize has not been called since Init.
+func (o *Optimizer) PlanningReport() PlanningReport {
+	return o.report
+}
+
+// makePlanningReport builds the report of the call to Optimize that has just
+// completed.
+func (o *Optimizer) makePlanningReport() PlanningReport {
+	r := PlanningReport{
+		Optimized:             true,
+		NormalizeTime:         o.metrics.NormalizeTime,
+		ExploreTime:           o.metrics.ExploreTime,
+		CostTime:              o.metrics.CostTime,
+		SetLowestCostTreeTime: o.metrics.SetLowestCostTreeTime,
+		MemoExprs:             o.mem.ExprCount(),
+		GroupStates:           o.stateTable.len(),
+		RulesApplied:          o.metrics.RulesApplied,
+		Ties:                  o.metrics.Ties,
+	}
+	for _, w := range o.warnings {
+		if w.Kind == BudgetExceededWarning {
+			r.BudgetHits++
+		}
+	}
+	return r
+}
+
+// String returns a single-line description of the report, e.g.:
+//
+//	normalize: 1ms, explore: 3ms, cost: 2ms, extract: 10µs, memo exprs: 120,
+//	group states: 40, rules applied: 25, budget hits: 0, ties: 2
+func (r PlanningReport) String() string {
+	return fmt.Sprintf(
+		"normalize: %s, explore: %s, cost: %s, extract: %s, memo exprs: %d, "+
+			"group states: %d, rules applied: %d, budget hits: %d, ties: %d",
+		humanizeutil.Duration(r.NormalizeTime), humanizeutil.Duration(r.ExploreTime),
+		humanizeutil.Duration(r.CostTime), humanizeutil.Duration(r.SetLowestCostTreeTime),
+		r.MemoExprs, r.GroupStates, r.RulesApplied, r.BudgetHits, r.Ties,
+	)
+}
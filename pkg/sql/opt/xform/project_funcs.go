@@ -0,0 +1,162 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/errors"
+)
+
+// constrainedConstCols returns the set of columns that are held constant by
+// the constraint of the given scan. Every row produced by the scan falls within
+// one of its spans, so the constraint alone determines these columns, even if
+// the functional dependencies of the scan's group do not, such as when the
+// constant is implied by a check constraint.
+func (c *CustomFuncs) constrainedConstCols(sp *memo.ScanPrivate) opt.ColSet {
+	if sp.Constraint == nil || sp.Constraint.IsContradiction() || sp.Constraint.Spans.Count() == 0 {
+		return opt.ColSet{}
+	}
+	return sp.Constraint.ExtractConstCols(c.e.evalCtx)
+}
+
+// constrainedConstValue returns the constant value of the given column, which
+// must be one of the columns returned by constrainedConstCols.
+func (c *CustomFuncs) constrainedConstValue(sp *memo.ScanPrivate, col opt.ColumnID) tree.Datum {
+	cons := sp.Constraint
+	for i, n := 0, cons.Columns.Count(); i < n; i++ {
+		if cons.Columns.Get(i).ID() == col {
+			// All spans have the same value for a constant column, so the value
+			// can be taken from the first span.
+			return cons.Spans.Get(0).StartKey().Value(i)
+		}
+	}
+	panic(errors.AssertionFailedf("column %d is not constrained", col))
+}
+
+// CanFoldConstrainedScanConstants returns true if any of the given projections
+// reference a column that is held constant by the constraint of the given
+// scan.
+func (c *CustomFuncs) CanFoldConstrainedScanConstants(
+	sp *memo.ScanPrivate, projections memo.ProjectionsExpr,
+) bool {
+	constCols := c.constrainedConstCols(sp)
+	if constCols.Empty() {
+		return false
+	}
+	for i := range projections {
+		if projections[i].ScalarProps().OuterCols.Intersects(constCols) {
+			return true
+		}
+	}
+	return false
+}
+
+// FoldConstrainedScanConstants returns a new list of projections in which each
+// reference to a column that is held constant by the constraint of the given
+// scan is replaced with the constant value of that column. The new projections
+// are constructed with the factory, so they are normalized, and any
+// expressions that become constant are folded.
+func (c *CustomFuncs) FoldConstrainedScanConstants(
+	sp *memo.ScanPrivate, projections memo.ProjectionsExpr,
+) memo.ProjectionsExpr {
+	constCols := c.constrainedConstCols(sp)
+	md := c.e.mem.Metadata()
+
+	var replace norm.ReplaceFunc
+	replace = func(e opt.Expr) opt.Expr {
+		if v, ok := e.(*memo.VariableExpr); ok && constCols.Contains(v.Col) {
+			d := c.constrainedConstValue(sp, v.Col)
+			typ := md.ColumnMeta(v.Col).Type
+			if !d.ResolvedType().Identical(typ) {
+				// Don't substitute the value if its type does not exactly match the
+				// type of the column.
+				return v
+			}
+			return c.e.f.ConstructConstVal(d, typ)
+		}
+		return c.e.f.Replace(e, replace)
+	}
+
+	newProjections := make(memo.ProjectionsExpr, len(projections))
+	for i := range projections {
+		item := &projections[i]
+		newProjections[i] = c.e.f.ConstructProjectionsItem(
+			replace(item.Element).(opt.ScalarExpr), item.Col,
+		)
+	}
+	return newProjections
+}
+
+// GenerateIndexScansWithVirtualCols generates a Scan of each secondary index
+// that contains the virtual columns produced by the given projections, and all
+// the other columns needed by the Project. The virtual columns are produced by
+// the new Scan, so their projections are replaced by passthrough columns. The
+// new Project is added to the same group as the original Project. See the
+// GenerateIndexScansWithVirtualCols rule for more details.
+func (c *CustomFuncs) GenerateIndexScansWithVirtualCols(
+	grp memo.RelExpr,
+	scanPrivate *memo.ScanPrivate,
+	projections memo.ProjectionsExpr,
+	passthrough opt.ColSet,
+	virtualCols opt.ColSet,
+) {
+	// Split the projections into those that produce virtual columns, which are
+	// scanned from the index, and the remaining projections, which must still
+	// be evaluated.
+	var projectedVirtualCols opt.ColSet
+	remaining := make(memo.ProjectionsExpr, 0, len(projections))
+	for i := range projections {
+		if virtualCols.Contains(projections[i].Col) {
+			projectedVirtualCols.Add(projections[i].Col)
+		} else {
+			remaining = append(remaining, projections[i])
+		}
+	}
+
+	// The new Scan must produce the virtual columns, and the columns that are
+	// passed through or referenced by the remaining projections. Columns that
+	// are only referenced by the virtual column expressions are not needed.
+	newScanPrivate := *scanPrivate
+	newScanPrivate.Cols = passthrough.Union(c.ProjectionOuterCols(remaining))
+	newScanPrivate.Cols.IntersectionWith(scanPrivate.Cols)
+	newScanPrivate.Cols.UnionWith(projectedVirtualCols)
+	newPassthrough := passthrough.Union(projectedVirtualCols)
+
+	var iter scanIndexIter
+	iter.Init(c.e.evalCtx, c.e.f, c.e.mem, &c.im, &newScanPrivate, nil /* filters */, rejectPrimaryIndex|rejectInvertedIndexes|rejectPartialIndexes)
+	iter.ForEach(func(index cat.Index, filters memo.FiltersExpr, indexCols opt.ColSet, isCovering bool, constProj memo.ProjectionsExpr) {
+		// An IndexJoin cannot produce virtual columns, so only covering indexes
+		// can be used.
+		if !isCovering {
+			return
+		}
+
+		// The iterator rejects partial indexes, so constProj should always be
+		// empty. If it is not, we panic to avoid performing a logically incorrect
+		// transformation.
+		if len(constProj) != 0 {
+			panic(errors.AssertionFailedf("expected constProj to be empty"))
+		}
+
+		indexScanPrivate := newScanPrivate
+		indexScanPrivate.Index = index.Ordinal()
+		project := memo.ProjectExpr{
+			Input:       c.e.f.ConstructScan(&indexScanPrivate),
+			Projections: remaining,
+			Passthrough: newPassthrough,
+		}
+		c.e.mem.AddProjectToGroup(&project, grp)
+	})
+}
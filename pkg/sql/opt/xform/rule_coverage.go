@@ -0,0 +1,122 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// RuleCoverage aggregates the rules that were matched and applied across many
+// optimizations, in order to find the rules that are never exercised by a
+// workload or a test suite. It is safe for concurrent use, so that it can be
+// shared by all optimizer instances. See Optimizer.SetRuleCoverage.
+type RuleCoverage struct {
+	mu struct {
+		syncutil.Mutex
+		stats         RuleStats
+		optimizations int64
+	}
+}
+
+// Record merges the rule statistics of a single optimization into the
+// coverage.
+func (c *RuleCoverage) Record(stats RuleStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.stats == nil {
+		c.mu.stats = make(RuleStats, len(stats))
+	}
+	c.mu.stats.Merge(stats)
+	c.mu.optimizations++
+}
+
+// Stats returns a copy of the rule statistics that have been recorded, along
+// with the number of optimizations that recorded them.
+func (c *RuleCoverage) Stats() (_ RuleStats, optimizations int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make(RuleStats, len(c.mu.stats))
+	res.Merge(c.mu.stats)
+	return res, c.mu.optimizations
+}
+
+// Report returns a report of the rules defined in Optgen that were never
+// matched, and of the rules that were matched but never applied, such as
+// rules that were always disabled. Normalization rules that are applied while
+// an expression is built are only included if rule stats were enabled before
+// it was built. For example:
+//
+//   optimizations: 20
+//   normalization rules matched: 150/250, applied: 148/250
+//   exploration rules matched: 30/60, applied: 29/60
+//   never matched:
+//     EliminateNot
+//     ...
+//   matched but never applied:
+//     GenerateZigzagJoins
+//
+func (c *RuleCoverage) Report() string {
+	stats, optimizations := c.Stats()
+
+	var normRules, normMatched, normApplied int
+	var exploreRules, exploreMatched, exploreApplied int
+	var neverMatched, neverApplied []opt.RuleName
+	for r := opt.RuleName(1); r < opt.NumRuleNames; r++ {
+		if len(r.MatchedOperators()) == 0 {
+			// Skip manual rules, and the markers between groups of rules.
+			continue
+		}
+		stat := stats[r]
+		matched, applied := 0, 0
+		if stat.Matched > 0 {
+			matched = 1
+		} else {
+			neverMatched = append(neverMatched, r)
+		}
+		if stat.Applied > 0 {
+			applied = 1
+		} else if stat.Matched > 0 {
+			neverApplied = append(neverApplied, r)
+		}
+		if r.IsExplore() {
+			exploreRules++
+			exploreMatched += matched
+			exploreApplied += applied
+		} else {
+			normRules++
+			normMatched += matched
+			normApplied += applied
+		}
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "optimizations: %d\n", optimizations)
+	fmt.Fprintf(&buf, "normalization rules matched: %d/%d, applied: %d/%d\n",
+		normMatched, normRules, normApplied, normRules)
+	fmt.Fprintf(&buf, "exploration rules matched: %d/%d, applied: %d/%d\n",
+		exploreMatched, exploreRules, exploreApplied, exploreRules)
+	formatRules := func(title string, rules []opt.RuleName) {
+		if len(rules) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "%s:\n", title)
+		for _, r := range rules {
+			fmt.Fprintf(&buf, "  %s\n", r)
+		}
+	}
+	formatRules("never matched", neverMatched)
+	formatRules("matched but never applied", neverApplied)
+	return buf.String()
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/errors"
+)
+
+// RuleDecisions is a recording of the sequence of decisions made by the
+// matched rule callbacks of an optimizer and its factory, i.e. whether each
+// matched rule was allowed to be applied. Since the rules that are applied
+// determine the expressions that are added to the memo, replaying the
+// decisions when optimizing the same query with the same catalog reproduces
+// the same memo, even if the decisions were made at random, e.g. by the
+// DisableOptimizerRuleProbability testing knob.
+//
+// RuleDecisions can be encoded as a compact string with String, so that it can
+// be printed by a failing test and parsed again with ParseRuleDecisions. Rules
+// are encoded by number, so the string can only be replayed by a binary with
+// the same set of rules.
+type RuleDecisions struct {
+	rules   []opt.RuleName
+	allowed []bool
+}
+
+// Len returns the number of decisions in the recording.
+func (d *RuleDecisions) Len() int {
+	return len(d.rules)
+}
+
+// String encodes the decisions as a compact, printable string.
+func (d *RuleDecisions) String() string {
+	buf := make([]byte, 0, len(d.rules)*2)
+	var scratch [binary.MaxVarintLen64]byte
+	for i, ruleName := range d.rules {
+		v := uint64(ruleName) << 1
+		if d.allowed[i] {
+			v |= 1
+		}
+		n := binary.PutUvarint(scratch[:], v)
+		buf = append(buf, scratch[:n]...)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseRuleDecisions parses a string that was produced by RuleDecisions.String.
+func ParseRuleDecisions(s string) (*RuleDecisions, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rule decisions")
+	}
+	d := &RuleDecisions{}
+	for len(buf) > 0 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errors.Newf("invalid rule decision %d", len(d.rules))
+		}
+		buf = buf[n:]
+		ruleName := opt.RuleName(v >> 1)
+		if ruleName == opt.InvalidRuleName || ruleName >= opt.NumRuleNames {
+			return nil, errors.Newf("invalid rule number %d", v>>1)
+		}
+		d.record(ruleName, v&1 == 1)
+	}
+	return d, nil
+}
+
+func (d *RuleDecisions) record(ruleName opt.RuleName, allowed bool) {
+	d.rules = append(d.rules, ruleName)
+	d.allowed = append(d.allowed, allowed)
+}
+
+// RecordRuleDecisions causes the optimizer to record the decision made for
+// each rule that is matched, after all other matched rule callbacks have been
+// consulted. The recording can be retrieved via RuleDecisions. Normalization
+// rules are only recorded if RecordRuleDecisions is called before the
+// expression is built. RecordRuleDecisions should be called after any calls to
+// NotifyOnMatchedRule and DisableRules, which would otherwise not be reflected
+// in the recording.
+func (o *Optimizer) RecordRuleDecisions() {
+	o.ruleDecisions = &RuleDecisions{}
+
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			allowed := matchedRule == nil || matchedRule(ruleName)
+			o.ruleDecisions.record(ruleName, allowed)
+			return allowed
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+}
+
+// RuleDecisions returns the decisions recorded since RecordRuleDecisions was
+// called, or nil if recording is not enabled.
+func (o *Optimizer) RuleDecisions() *RuleDecisions {
+	return o.ruleDecisions
+}
+
+// ReplayRuleDecisions replaces the matched rule callbacks of the optimizer and
+// its factory with a callback that answers from the given recording, in order.
+// It must be called at the same point as RecordRuleDecisions was when the
+// recording was made. If the optimizer matches a rule other than the next one
+// in the recording, or matches more rules than were recorded, the replay has
+// diverged from the recording, and building or optimizing the expression fails
+// with an error.
+func (o *Optimizer) ReplayRuleDecisions(decisions *RuleDecisions) {
+	next := 0
+	o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+		if next >= decisions.Len() {
+			panic(errors.AssertionFailedf(
+				"rule decisions diverged: %s matched after all %d decisions were replayed",
+				ruleName, decisions.Len(),
+			))
+		}
+		if recorded := decisions.rules[next]; recorded != ruleName {
+			panic(errors.AssertionFailedf(
+				"rule decisions diverged at decision %d: recorded %s, matched %s",
+				next, recorded, ruleName,
+			))
+		}
+		allowed := decisions.allowed[next]
+		next++
+		return allowed
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestRuleDecisions tests that the recorded rule decisions of an optimization
+// can be encoded, parsed and replayed to reproduce the same memo.
+func TestRuleDecisions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t,
+		"CREATE TABLE abc (a INT PRIMARY KEY, b INT, c STRING, INDEX (b), INDEX (c))",
+		"CREATE TABLE xy (x INT PRIMARY KEY, y INT)",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT * FROM abc JOIN xy ON b = x WHERE c = 'foo'"
+
+	// Record the decisions made when rules are disabled at random.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	rng := rand.New(rand.NewSource(0))
+	o.NotifyOnMatchedRule(func(opt.RuleName) bool {
+		return rng.Intn(2) == 0
+	})
+	if o.RuleDecisions() != nil {
+		t.Fatal("expected no rule decisions before they are recorded")
+	}
+	o.RecordRuleDecisions()
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	recorded := o.RuleDecisions()
+	if recorded.Len() == 0 {
+		t.Fatal("expected rule decisions to be recorded")
+	}
+	expected := o.FormatMemo(xform.FmtPretty)
+
+	// Replaying the encoded decisions reproduces the same memo.
+	decisions, err := xform.ParseRuleDecisions(recorded.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decisions.Len() != recorded.Len() {
+		t.Fatalf("expected %d decisions, got %d", recorded.Len(), decisions.Len())
+	}
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.ReplayRuleDecisions(decisions)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if actual := o.FormatMemo(xform.FmtPretty); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+
+	// Replaying the decisions for a different query diverges.
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE b = 1")
+	o.ReplayRuleDecisions(decisions)
+	if _, err := o.Optimize(); err == nil {
+		t.Error("expected replay to diverge")
+	}
+
+	if _, err := xform.ParseRuleDecisions("not valid!"); err == nil {
+		t.Error("expected error for invalid rule decisions")
+	}
+}
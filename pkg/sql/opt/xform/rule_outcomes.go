@@ -0,0 +1,164 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// RuleOutcome records how often the expressions generated by an exploration
+// rule end up in the lowest cost plan chosen by the optimizer.
+type RuleOutcome struct {
+	// Generated is the number of expressions that the rule added to the memo.
+	Generated int64
+
+	// Chosen is the number of expressions generated by the rule that were part
+	// of the final, lowest cost plan.
+	Chosen int64
+}
+
+// WinRate returns the fraction of expressions generated by the rule that were
+// part of the final plan, or zero if the rule never generated an expression.
+func (r RuleOutcome) WinRate() float64 {
+	if r.Generated == 0 {
+		return 0
+	}
+	return float64(r.Chosen) / float64(r.Generated)
+}
+
+// RuleOutcomes maps exploration rules to their aggregate outcomes.
+type RuleOutcomes map[opt.RuleName]RuleOutcome
+
+// Merge adds the outcomes in other to the outcomes in r.
+func (r RuleOutcomes) Merge(other RuleOutcomes) {
+	for ruleName, outcome := range other {
+		existing := r[ruleName]
+		existing.Generated += outcome.Generated
+		existing.Chosen += outcome.Chosen
+		r[ruleName] = existing
+	}
+}
+
+// RuleOutcomeStore persists aggregate exploration rule outcomes across many
+// optimizations, and potentially across the nodes of a cluster. It allows
+// the exploration of future queries to be prioritized according to which rules
+// tend to produce winning plans, and gives maintainers insight into which
+// rules are most in need of refinement.
+//
+// Implementations must be safe for concurrent use, since they are shared by
+// all optimizer instances.
+type RuleOutcomeStore interface {
+	// RecordRuleOutcomes merges the outcomes of a single optimization into the
+	// store.
+	RecordRuleOutcomes(outcomes RuleOutcomes)
+
+	// RuleOutcomes returns a copy of the aggregate outcomes that have been
+	// recorded in the store.
+	RuleOutcomes() RuleOutcomes
+}
+
+// InMemoryRuleOutcomeStore is a RuleOutcomeStore that aggregates rule outcomes
+// in memory. It is suitable for tests, and as a node-local buffer that is
+// periodically flushed to a persistent store.
+type InMemoryRuleOutcomeStore struct {
+	mu struct {
+		syncutil.Mutex
+		outcomes RuleOutcomes
+	}
+}
+
+var _ RuleOutcomeStore = &InMemoryRuleOutcomeStore{}
+
+// RecordRuleOutcomes is part of the RuleOutcomeStore interface.
+func (s *InMemoryRuleOutcomeStore) RecordRuleOutcomes(outcomes RuleOutcomes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.outcomes == nil {
+		s.mu.outcomes = make(RuleOutcomes, len(outcomes))
+	}
+	s.mu.outcomes.Merge(outcomes)
+}
+
+// RuleOutcomes is part of the RuleOutcomeStore interface.
+func (s *InMemoryRuleOutcomeStore) RuleOutcomes() RuleOutcomes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(RuleOutcomes, len(s.mu.outcomes))
+	res.Merge(s.mu.outcomes)
+	return res
+}
+
+// ruleOutcomeTracker tracks the exploration rule that generated each memo
+// expression during a single optimization, so that the rules which generated
+// the final plan can be determined once optimization is complete.
+type ruleOutcomeTracker struct {
+	store RuleOutcomeStore
+
+	// generatedBy maps each expression added by an exploration rule to the
+	// name of that rule.
+	generatedBy map[memo.RelExpr]opt.RuleName
+
+	// outcomes accumulates the outcomes for the current optimization.
+	outcomes RuleOutcomes
+}
+
+// init initializes the tracker for use.
+func (t *ruleOutcomeTracker) init(store RuleOutcomeStore) {
+	*t = ruleOutcomeTracker{
+		store:       store,
+		generatedBy: make(map[memo.RelExpr]opt.RuleName),
+		outcomes:    make(RuleOutcomes),
+	}
+}
+
+// recordApplied records that the given exploration rule added the target
+// expression to its memo group. Generate-style rules can add several
+// expressions at once, in which case target is the first of them, and the rest
+// follow it in the group.
+func (t *ruleOutcomeTracker) recordApplied(ruleName opt.RuleName, target opt.Expr) {
+	rel, ok := target.(memo.RelExpr)
+	if !ok || !ruleName.IsExplore() {
+		return
+	}
+	outcome := t.outcomes[ruleName]
+	for ; rel != nil; rel = rel.NextExpr() {
+		if _, ok := t.generatedBy[rel]; ok {
+			continue
+		}
+		t.generatedBy[rel] = ruleName
+		outcome.Generated++
+	}
+	t.outcomes[ruleName] = outcome
+}
+
+// recordChosen walks the lowest cost tree rooted at the given expression, and
+// records each expression that was generated by an exploration rule.
+func (t *ruleOutcomeTracker) recordChosen(e opt.Expr) {
+	if rel, ok := e.(memo.RelExpr); ok {
+		if ruleName, ok := t.generatedBy[rel]; ok {
+			outcome := t.outcomes[ruleName]
+			outcome.Chosen++
+			t.outcomes[ruleName] = outcome
+		}
+	}
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		t.recordChosen(e.Child(i))
+	}
+}
+
+// flush records the outcomes of the current optimization in the store.
+func (t *ruleOutcomeTracker) flush() {
+	if len(t.outcomes) != 0 {
+		t.store.RecordRuleOutcomes(t.outcomes)
+	}
+}
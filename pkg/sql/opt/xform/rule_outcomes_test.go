@@ -0,0 +1,54 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestRuleOutcomeStore tests that a rule outcome store accumulates the number
+// of times the expressions generated by each rule are part of the chosen plan.
+func TestRuleOutcomeStore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var store xform.InMemoryRuleOutcomeStore
+	for i := 0; i < 2; i++ {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a, c FROM abc WHERE c = 'foo'")
+		o.SetRuleOutcomeStore(&store)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outcome := store.RuleOutcomes()[opt.GenerateConstrainedScans]
+	if outcome.Chosen != 2 {
+		t.Errorf("expected constrained scan to be chosen twice, got %d", outcome.Chosen)
+	}
+	if outcome.Generated < outcome.Chosen {
+		t.Errorf("expected at least %d generated expressions, got %d", outcome.Chosen, outcome.Generated)
+	}
+	if rate := outcome.WinRate(); rate <= 0 || rate > 1 {
+		t.Errorf("expected win rate in (0, 1], got %f", rate)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
+)
+
+// RuleReport describes the normalization and exploration rules that were
+// matched and applied for a statement, grouped by the memo group that they
+// matched or constructed. See Optimizer.EnableRuleReport.
+type RuleReport struct {
+	// Groups contains an entry for each group for which a rule was matched,
+	// ordered by group number. It is followed by an entry with a zero group
+	// number if any rules were not attributed to a group that is reachable from
+	// the root of the memo.
+	Groups []GroupRuleReport
+}
+
+// GroupRuleReport describes the rules that were matched for a single memo
+// group.
+//
+// Groups are numbered in the order in which they are found by a breadth-first
+// search of the memo, which matches the numbering of Optimizer.FormatMemo and
+// EXPLAIN (OPT, MEMO).
+type GroupRuleReport struct {
+	// Group is the number of the group, or zero for the rules that were not
+	// attributed to a group that is reachable from the root, such as
+	// normalization rules that constructed an expression that was later
+	// replaced, or that were not applied.
+	Group int
+
+	// Expr is the normalized expression of the group, which is its first
+	// member. It is empty if Group is zero.
+	Expr string
+
+	// Rules contains an entry for each rule that was matched for the group,
+	// ordered by rule name.
+	Rules []RuleReportEntry
+}
+
+// RuleReportEntry counts the number of times a rule was matched and applied.
+type RuleReportEntry struct {
+	Rule opt.RuleName
+
+	// Matched is the number of times the rule was matched, including the times
+	// that it was not applied because it was disabled.
+	Matched int
+
+	// Applied is the number of times the rule was applied.
+	Applied int
+}
+
+// Rule returns the number of times the given rule was matched and applied, in
+// all groups.
+func (r *RuleReport) Rule(rule opt.RuleName) (matched, applied int) {
+	for i := range r.Groups {
+		for _, e := range r.Groups[i].Rules {
+			if e.Rule == rule {
+				matched += e.Matched
+				applied += e.Applied
+			}
+		}
+	}
+	return matched, applied
+}
+
+// String formats the report as a tree with one node per group, and one child
+// per rule. For example:
+//
+//   rules
+//    ├── G1: (select G2 G3)
+//    │    └── GenerateConstrainedScans: matched 1, applied 1
+//    └── G2: (scan abc)
+//         └── GenerateIndexScans: matched 1, applied 1
+//
+func (r *RuleReport) String() string {
+	tp := treeprinter.New()
+	root := tp.Child("rules")
+	if len(r.Groups) == 0 {
+		root.Child("no rules matched")
+	}
+	for i := range r.Groups {
+		g := &r.Groups[i]
+		var c treeprinter.Node
+		if g.Group == 0 {
+			c = root.Child("other")
+		} else {
+			c = root.Childf("G%d: %s", g.Group, g.Expr)
+		}
+		for _, e := range g.Rules {
+			c.Childf("%s: matched %d, applied %d", e.Rule, e.Matched, e.Applied)
+		}
+	}
+	return tp.String()
+}
+
+// EnableRuleReport causes the optimizer to count the number of times each rule
+// is matched and applied for each memo group. The report can be retrieved via
+// RuleReport once Optimize completes. Normalization rules are only counted if
+// EnableRuleReport is called before the expression is built. EnableRuleReport
+// should be called after any calls to NotifyOnMatchedRule, NotifyOnAppliedRule
+// and DisableRules, which would otherwise replace the callbacks that count the
+// rules.
+func (o *Optimizer) EnableRuleReport() {
+	r := &ruleReporter{counts: make(map[ruleReportKey]*RuleReportEntry)}
+	o.ruleReporter = r
+
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			allowed := matchedRule == nil || matchedRule(ruleName)
+			r.recordMatched(ruleName, o.explorer.exploring)
+			return allowed
+		}
+	}
+	wrapApplied := func(appliedRule AppliedRuleFunc) AppliedRuleFunc {
+		return func(ruleName opt.RuleName, source, target opt.Expr) {
+			if appliedRule != nil {
+				appliedRule(ruleName, source, target)
+			}
+			r.recordApplied(ruleName, source, target)
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.appliedRule = wrapApplied(o.appliedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+	o.f.NotifyOnAppliedRule(wrapApplied(o.f.AppliedRule()))
+}
+
+// RuleReport returns the rules that have been counted since EnableRuleReport
+// was called, or nil if the report is not enabled.
+func (o *Optimizer) RuleReport() *RuleReport {
+	if o.ruleReporter == nil {
+		return nil
+	}
+	mf := makeMemoFormatter(o, FmtPretty)
+	mf.groupIdx = make(map[opt.Expr]int)
+	mf.numberMemo(o.mem.RootExpr())
+
+	// Merge the counts of the expressions in the same group. The rules that
+	// were not attributed to a reachable group are merged into group -1.
+	byGroup := make(map[int]map[opt.RuleName]*RuleReportEntry)
+	for key, entry := range o.ruleReporter.counts {
+		if entry.Matched == 0 && entry.Applied == 0 {
+			continue
+		}
+		idx := -1
+		if key.group != nil {
+			if i, ok := mf.groupIdx[firstExpr(key.group)]; ok {
+				idx = i
+			}
+		}
+		rules := byGroup[idx]
+		if rules == nil {
+			rules = make(map[opt.RuleName]*RuleReportEntry)
+			byGroup[idx] = rules
+		}
+		merged := rules[key.rule]
+		if merged == nil {
+			merged = &RuleReportEntry{Rule: key.rule}
+			rules[key.rule] = merged
+		}
+		merged.Matched += entry.Matched
+		merged.Applied += entry.Applied
+	}
+
+	idxs := make([]int, 0, len(byGroup))
+	for idx := range byGroup {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool {
+		// Sort the unattributed rules last.
+		if idxs[i] < 0 || idxs[j] < 0 {
+			return idxs[j] < 0 && idxs[i] >= 0
+		}
+		return idxs[i] < idxs[j]
+	})
+
+	report := &RuleReport{Groups: make([]GroupRuleReport, 0, len(idxs))}
+	for _, idx := range idxs {
+		g := GroupRuleReport{}
+		if idx >= 0 {
+			g.Group = idx + 1
+			mf.buf.Reset()
+			mf.formatExpr(mf.groups[idx].first)
+			g.Expr = mf.buf.String()
+		}
+		for _, entry := range byGroup[idx] {
+			g.Rules = append(g.Rules, *entry)
+		}
+		sort.Slice(g.Rules, func(i, j int) bool {
+			return g.Rules[i].Rule.String() < g.Rules[j].Rule.String()
+		})
+		report.Groups = append(report.Groups, g)
+	}
+	return report
+}
+
+// ruleReporter counts the rules matched and applied for a RuleReport.
+type ruleReporter struct {
+	counts map[ruleReportKey]*RuleReportEntry
+}
+
+// ruleReportKey identifies the counts of a rule for an expression. The group
+// of the expression is only determined when the report is produced, since the
+// memo groups are numbered once the memo is complete. The expression is nil
+// for normalization rules that have been matched but not yet applied.
+type ruleReportKey struct {
+	group opt.Expr
+	rule  opt.RuleName
+}
+
+// entry returns the counts of the given rule for the given expression.
+func (r *ruleReporter) entry(group opt.Expr, rule opt.RuleName) *RuleReportEntry {
+	key := ruleReportKey{group: group, rule: rule}
+	entry := r.counts[key]
+	if entry == nil {
+		entry = &RuleReportEntry{Rule: rule}
+		r.counts[key] = entry
+	}
+	return entry
+}
+
+// recordMatched records that a rule was matched. For an exploration rule,
+// exploring is the group member that was matched. A normalization rule
+// matches the operands of an expression before it is constructed, so its
+// group is not known until it is applied.
+func (r *ruleReporter) recordMatched(ruleName opt.RuleName, exploring memo.RelExpr) {
+	var group opt.Expr
+	if ruleName.IsExplore() && exploring != nil {
+		group = exploring.FirstExpr()
+	}
+	r.entry(group, ruleName).Matched++
+}
+
+// recordApplied records that a rule was applied. The source is non-nil only
+// for exploration rules, whose group is the group of the source. The group of
+// a normalization rule is the group of the expression that it constructed, so
+// its match is moved to that group.
+func (r *ruleReporter) recordApplied(ruleName opt.RuleName, source, target opt.Expr) {
+	if source != nil {
+		r.entry(firstExpr(source), ruleName).Applied++
+		return
+	}
+	if target == nil {
+		return
+	}
+	if pending := r.entry(nil, ruleName); pending.Matched > 0 {
+		pending.Matched--
+		r.entry(target, ruleName).Matched++
+	}
+	r.entry(target, ruleName).Applied++
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestRuleReport tests that the rule report counts the rules matched and
+// applied during an optimization, and the groups that they applied to.
+func TestRuleReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT a, b, c FROM abc WHERE c = 'foo'"
+
+	var o xform.Optimizer
+	o.Init(&evalCtx, catalog)
+	if o.RuleReport() != nil {
+		t.Fatal("expected no rule report before it is enabled")
+	}
+	o.EnableRuleReport()
+	if err := testutils.BuildInitializedQuery(&o, catalog, query); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	report := o.RuleReport()
+
+	if matched, applied := report.Rule(opt.GenerateConstrainedScans); matched != 1 || applied != 1 {
+		t.Errorf("expected rule to be matched and applied once, got %d and %d", matched, applied)
+	}
+	if _, applied := report.Rule(opt.EliminateProject); applied == 0 {
+		t.Errorf("expected normalization rule to be applied")
+	}
+	if matched, _ := report.Rule(opt.GenerateLookupJoins); matched != 0 {
+		t.Errorf("expected rule not to be matched, got %d", matched)
+	}
+
+	// The exploration rule is reported for the group of the select that it
+	// matched.
+	var found bool
+	for _, g := range report.Groups {
+		for _, e := range g.Rules {
+			if e.Rule == opt.GenerateConstrainedScans {
+				found = true
+				if g.Group == 0 || !strings.HasPrefix(g.Expr, "(select") {
+					t.Errorf("expected rule to be reported for the select group, got G%d: %s", g.Group, g.Expr)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected rule in report:\n%s", report)
+	}
+	if s := report.String(); !strings.Contains(s, "GenerateConstrainedScans: matched 1, applied 1") {
+		t.Errorf("unexpected report:\n%s", s)
+	}
+
+	// Rules that are disabled are matched, but not applied.
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+		return ruleName != opt.GenerateConstrainedScans
+	})
+	o.EnableRuleReport()
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	matched, applied := o.RuleReport().Rule(opt.GenerateConstrainedScans)
+	if matched != 1 || applied != 0 {
+		t.Errorf("expected rule to be matched but not applied, got %d and %d", matched, applied)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// RuleStat records how often a rule was matched and applied during
+// optimization, and how long it took to apply.
+type RuleStat struct {
+	// Matched is the number of times the rule's match pattern was satisfied.
+	Matched int64
+
+	// Applied is the number of times the rule was applied. It can be less than
+	// Matched if the rule was disabled, e.g. by a MatchedRuleFunc.
+	Applied int64
+
+	// Generated is the number of expressions the rule constructed.
+	Generated int64
+
+	// Time is the total wall time spent applying the rule, from the time its
+	// match pattern was satisfied to the time its replace pattern completed.
+	// Time spent evaluating match patterns that were not satisfied is not
+	// included. The time of a normalization rule includes the time of any
+	// rules that were applied while constructing its replacement.
+	Time time.Duration
+}
+
+// RuleStats maps rules to their statistics.
+type RuleStats map[opt.RuleName]RuleStat
+
+// Merge adds the statistics in other to the statistics in r.
+func (r RuleStats) Merge(other RuleStats) {
+	for ruleName, stat := range other {
+		existing := r[ruleName]
+		existing.Matched += stat.Matched
+		existing.Applied += stat.Applied
+		existing.Generated += stat.Generated
+		existing.Time += stat.Time
+		r[ruleName] = existing
+	}
+}
+
+// ruleStatsCollector accumulates RuleStats from the matched and applied rule
+// callbacks.
+type ruleStatsCollector struct {
+	stats RuleStats
+
+	// started is a stack of the rules that have been matched but have not yet
+	// been applied, along with the time at which they were matched. Rules are
+	// nested when a normalization rule is applied while constructing the
+	// replacement of another rule.
+	started []startedRule
+}
+
+type startedRule struct {
+	ruleName opt.RuleName
+	start    time.Time
+}
+
+func (c *ruleStatsCollector) init() {
+	c.stats = make(RuleStats)
+}
+
+// recordMatched records that the given rule was matched. If allowed is true,
+// the rule is about to be applied.
+func (c *ruleStatsCollector) recordMatched(ruleName opt.RuleName, allowed bool) {
+	stat := c.stats[ruleName]
+	stat.Matched++
+	c.stats[ruleName] = stat
+	if allowed {
+		c.started = append(c.started, startedRule{ruleName: ruleName, start: timeutil.Now()})
+	}
+}
+
+// recordApplied records that the given rule was applied. The source is non-nil
+// only for exploration rules, in which case target is the first of the
+// expressions that the rule added to the memo.
+func (c *ruleStatsCollector) recordApplied(ruleName opt.RuleName, source, target opt.Expr) {
+	stat := c.stats[ruleName]
+	stat.Applied++
+	if rel, ok := target.(memo.RelExpr); ok && source != nil {
+		for ; rel != nil; rel = rel.NextExpr() {
+			stat.Generated++
+		}
+	} else if target != nil {
+		stat.Generated++
+	}
+
+	// Nested rules are applied in the reverse order in which they were
+	// matched, so the rule being applied is at the top of the stack.
+	if n := len(c.started); n > 0 && c.started[n-1].ruleName == ruleName {
+		stat.Time += timeutil.Since(c.started[n-1].start)
+		c.started = c.started[:n-1]
+	}
+	c.stats[ruleName] = stat
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestRuleStats tests that rule statistics count the rules matched and
+// applied during an optimization, and can be merged across optimizations.
+func TestRuleStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	total := make(xform.RuleStats)
+	for i := 0; i < 2; i++ {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a, c FROM abc WHERE c = 'foo'")
+		if o.RuleStats() != nil {
+			t.Fatal("expected no rule stats before they are enabled")
+		}
+		o.EnableRuleStats()
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		total.Merge(o.RuleStats())
+	}
+
+	stat := total[opt.GenerateConstrainedScans]
+	if stat.Matched != 2 || stat.Applied != 2 {
+		t.Errorf("expected rule to be matched and applied twice, got %d and %d", stat.Matched, stat.Applied)
+	}
+	if stat.Generated < 2 {
+		t.Errorf("expected at least 2 generated expressions, got %d", stat.Generated)
+	}
+	if stat.Time < 0 {
+		t.Errorf("expected non-negative time, got %s", stat.Time)
+	}
+
+	// Rules that are disabled are matched, but not applied.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a, c FROM abc WHERE c = 'foo'")
+	o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+		return ruleName != opt.GenerateConstrainedScans
+	})
+	o.EnableRuleStats()
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	stat = o.RuleStats()[opt.GenerateConstrainedScans]
+	if stat.Matched != 1 || stat.Applied != 0 || stat.Generated != 0 {
+		t.Errorf("expected rule to be matched but not applied, got %+v", stat)
+	}
+}
+
+// TestRuleTelemetry tests that the telemetry counter of an exploration rule is
+// incremented when the rule adds an expression to the memo, and not when it is
+// disabled or adds nothing.
+func TestRuleTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	if opt.RuleTelemetryCounters[opt.EliminateSelect] != nil {
+		t.Error("expected no telemetry counter for normalization rule")
+	}
+	counter := opt.RuleTelemetryCounters[opt.GenerateConstrainedScans]
+	optimize := func(query string, matchedRule xform.MatchedRuleFunc) int32 {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+		if matchedRule != nil {
+			o.NotifyOnMatchedRule(matchedRule)
+		}
+		before := telemetry.Read(counter)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+		return telemetry.Read(counter) - before
+	}
+
+	const query = "SELECT a, c FROM abc WHERE c = 'foo'"
+	if n := optimize(query, nil); n != 1 {
+		t.Errorf("expected rule to be counted once, got %d", n)
+	}
+
+	// Rules that are disabled are not counted.
+	if n := optimize(query, func(ruleName opt.RuleName) bool {
+		return ruleName != opt.GenerateConstrainedScans
+	}); n != 0 {
+		t.Errorf("expected disabled rule not to be counted, got %d", n)
+	}
+
+	// Rules that match but do not generate any expressions are not counted.
+	// There is no index on b, so no constrained scan is generated.
+	if n := optimize("SELECT a, c FROM abc WHERE b = 1", nil); n != 0 {
+		t.Errorf("expected rule that generated nothing not to be counted, got %d", n)
+	}
+}
+
+// TestRuleCoverage tests that rule coverage accumulates the rules matched and
+// applied across optimizations, and reports them.
+func TestRuleCoverage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var coverage xform.RuleCoverage
+	for _, disable := range []bool{false, true} {
+		var o xform.Optimizer
+		testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a, c FROM abc WHERE c = 'foo'")
+		if disable {
+			o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+				return ruleName != opt.GenerateConstrainedScans
+			})
+		}
+		o.SetRuleCoverage(&coverage)
+		if _, err := o.Optimize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, optimizations := coverage.Stats()
+	if optimizations != 2 {
+		t.Errorf("expected 2 optimizations, got %d", optimizations)
+	}
+	if stat := stats[opt.GenerateConstrainedScans]; stat.Matched != 2 || stat.Applied != 1 {
+		t.Errorf("expected rule to be matched twice and applied once, got %+v", stat)
+	}
+
+	report := coverage.Report()
+	if !strings.HasPrefix(report, "optimizations: 2\n") {
+		t.Errorf("expected report to begin with the number of optimizations, got:\n%s", report)
+	}
+	if !strings.Contains(report, "never matched:\n") {
+		t.Errorf("expected report to list rules that were never matched, got:\n%s", report)
+	}
+	if strings.Contains(report, "  "+opt.GenerateConstrainedScans.String()+"\n") {
+		t.Errorf("expected %s not to be reported, got:\n%s", opt.GenerateConstrainedScans, report)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// SetRuleTimeLimits bounds the time spent applying a single exploration rule
+// to a single group member, and the total time spent exploring a single group.
+// A rule that exceeds ruleLimit is abandoned, and is not applied to any member
+// of the same group again. A group that exceeds groupLimit is not explored
+// further. In both cases, optimization continues with the expressions that are
+// already in the memo, and a notice is sent to the client to warn that the
+// plan may be suboptimal. A limit of zero disables it.
+//
+// The limits are checked cooperatively, between the steps of a rule, such as
+// the construction of an expression or the building of the constraint for an
+// index. A single step that runs longer than the limit is not interrupted, but
+// the rule is abandoned once it completes. SetRuleTimeLimits must be called
+// after any calls to NotifyOnMatchedRule and DisableRules, which would
+// otherwise replace the callback that enforces the limits, and before Optimize.
+func (o *Optimizer) SetRuleTimeLimits(ruleLimit, groupLimit time.Duration) {
+	if ruleLimit < 0 || groupLimit < 0 {
+		panic(errors.AssertionFailedf("negative rule time limits: %s, %s", ruleLimit, groupLimit))
+	}
+	if ruleLimit == 0 && groupLimit == 0 {
+		return
+	}
+	l := &ruleTimeLimits{
+		ruleLimit:  ruleLimit,
+		groupLimit: groupLimit,
+		abandoned:  make(map[memo.RelExpr]RuleSet),
+		spent:      make(map[memo.RelExpr]time.Duration),
+		exhausted:  make(map[memo.RelExpr]struct{}),
+	}
+	o.timeLimits = l
+
+	wrapMatched := func(matchedRule MatchedRuleFunc) MatchedRuleFunc {
+		return func(ruleName opt.RuleName) bool {
+			if ruleName.IsExplore() && o.explorer.exploring != nil {
+				grp := o.explorer.exploring.FirstExpr()
+				if rules := l.abandoned[grp]; rules.Contains(int(ruleName)) {
+					return false
+				}
+				l.startRule(ruleName)
+			}
+			// Normalization rules are matched while an exploration rule constructs
+			// its replacement, so they provide a checkpoint for its limit.
+			l.check()
+			return matchedRule == nil || matchedRule(ruleName)
+		}
+	}
+	o.matchedRule = wrapMatched(o.matchedRule)
+	o.f.NotifyOnMatchedRule(wrapMatched(o.f.MatchedRule()))
+}
+
+// AbandonedRules returns the set of exploration rules that were abandoned for
+// at least one group during the last call to Optimize because they exceeded
+// the limit set by SetRuleTimeLimits.
+func (o *Optimizer) AbandonedRules() RuleSet {
+	if o.timeLimits == nil {
+		return RuleSet{}
+	}
+	return o.timeLimits.abandonedRules.Copy()
+}
+
+// TimeLimitedGroups returns the number of groups whose exploration was stopped
+// during the last call to Optimize because they exceeded the limit set by
+// SetRuleTimeLimits.
+func (o *Optimizer) TimeLimitedGroups() int {
+	if o.timeLimits == nil {
+		return 0
+	}
+	return len(o.timeLimits.exhausted)
+}
+
+// ruleTimeLimits enforces the limits set by SetRuleTimeLimits.
+type ruleTimeLimits struct {
+	ruleLimit  time.Duration
+	groupLimit time.Duration
+
+	// rule is the exploration rule that is being applied, and ruleDeadline is
+	// the time by which it must complete. rule is InvalidRuleName if no rule is
+	// being applied.
+	rule         opt.RuleName
+	ruleDeadline time.Time
+
+	// group is the group that is being explored, groupStart is the time at
+	// which its exploration started, and groupDeadline is the time by which its
+	// exploration must complete. group is nil if no group is being explored.
+	group         memo.RelExpr
+	groupStart    time.Time
+	groupDeadline time.Time
+
+	// abandoned contains the rules that are no longer applied to each group,
+	// identified by its first expression.
+	abandoned map[memo.RelExpr]RuleSet
+
+	// abandonedRules is the union of the sets of rules in abandoned.
+	abandonedRules RuleSet
+
+	// spent is the total time spent exploring each group in previous passes.
+	spent map[memo.RelExpr]time.Duration
+
+	// exhausted contains the groups that are no longer explored.
+	exhausted map[memo.RelExpr]struct{}
+}
+
+// ruleTimeLimitExceeded is the value with which check panics when a limit is
+// exceeded. It is recovered by exploreGroupMemberWithinTimeLimits.
+type ruleTimeLimitExceeded struct {
+	// rule is the rule that was being applied, or InvalidRuleName if the group
+	// limit was exceeded between rules.
+	rule opt.RuleName
+
+	// group is true if the group limit was exceeded, rather than the rule
+	// limit.
+	group bool
+}
+
+// startGroup starts timing the exploration of the given group.
+func (l *ruleTimeLimits) startGroup(grp memo.RelExpr) {
+	l.group = grp
+	l.groupStart = timeutil.Now()
+	l.groupDeadline = time.Time{}
+	if l.groupLimit > 0 {
+		l.groupDeadline = l.groupStart.Add(l.groupLimit - l.spent[grp])
+	}
+}
+
+// finishGroup stops timing the exploration of the current group.
+func (l *ruleTimeLimits) finishGroup() {
+	l.spent[l.group] += timeutil.Since(l.groupStart)
+	l.group = nil
+	l.rule = opt.InvalidRuleName
+}
+
+// startRule starts timing the application of the given rule.
+func (l *ruleTimeLimits) startRule(ruleName opt.RuleName) {
+	l.rule = ruleName
+	if l.ruleLimit > 0 {
+		l.ruleDeadline = timeutil.Now().Add(l.ruleLimit)
+	}
+}
+
+// check panics with ruleTimeLimitExceeded if the rule that is being applied,
+// or the group that is being explored, has exceeded its limit.
+func (l *ruleTimeLimits) check() {
+	if l.group == nil {
+		return
+	}
+	now := timeutil.Now()
+	if l.rule != opt.InvalidRuleName && l.ruleLimit > 0 && now.After(l.ruleDeadline) {
+		panic(ruleTimeLimitExceeded{rule: l.rule})
+	}
+	if l.groupLimit > 0 && now.After(l.groupDeadline) {
+		panic(ruleTimeLimitExceeded{rule: l.rule, group: true})
+	}
+}
+
+// exhaustedGroup returns true if the given group exceeded its limit, and is
+// no longer explored.
+func (l *ruleTimeLimits) exhaustedGroup(grp memo.RelExpr) bool {
+	_, ok := l.exhausted[grp]
+	return ok
+}
+
+// checkRuleTimeLimit panics if the exploration rule that is being applied, or
+// the group that is being explored, has exceeded the limit set by
+// SetRuleTimeLimits. It is called between the steps of rules that can be
+// expensive, so that they can be abandoned.
+func (o *Optimizer) checkRuleTimeLimit() {
+	if o.timeLimits != nil {
+		o.timeLimits.check()
+	}
+}
+
+// exploreGroupMemberWithinTimeLimits is like exploreGroupMember, but abandons
+// the rule that is being applied if it exceeds the limits set by
+// SetRuleTimeLimits. A member whose exploration was cut short is not fully
+// explored.
+func (e *explorer) exploreGroupMemberWithinTimeLimits(
+	state *exploreState, member memo.RelExpr, ordinal int,
+) (fullyExplored bool) {
+	l := e.o.timeLimits
+	if l == nil {
+		return e.exploreGroupMember(state, member, ordinal)
+	}
+	defer func() {
+		l.rule = opt.InvalidRuleName
+		if r := recover(); r != nil {
+			exceeded, ok := r.(ruleTimeLimitExceeded)
+			if !ok {
+				panic(r)
+			}
+			// The panic may have unwound one or more constructors.
+			e.f.ResetConstructorStackDepth()
+			grp := member.FirstExpr()
+			if exceeded.group {
+				l.exhausted[grp] = struct{}{}
+			} else {
+				rules := l.abandoned[grp]
+				rules.Add(int(exceeded.rule))
+				l.abandoned[grp] = rules
+				l.abandonedRules.Add(int(exceeded.rule))
+			}
+			fullyExplored = false
+		}
+	}()
+	return e.exploreGroupMember(state, member, ordinal)
+}
+
+// addWarnings registers a warning with the given optimizer if rules were
+// abandoned, or if groups were not fully explored.
+func (l *ruleTimeLimits) addWarnings(o *Optimizer) {
+	if !l.abandonedRules.Empty() {
+		var names []string
+		l.abandonedRules.ForEach(func(r int) {
+			names = append(names, opt.RuleName(r).String())
+		})
+		o.addWarning(BudgetExceededWarning,
+			"rules exceeded their time limit: %s", strings.Join(names, ", "))
+	}
+	if len(l.exhausted) > 0 {
+		o.addWarning(BudgetExceededWarning,
+			"exploration of %d groups exceeded its time limit", len(l.exhausted))
+	}
+}
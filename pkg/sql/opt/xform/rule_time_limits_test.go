@@ -0,0 +1,87 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestRuleTimeLimits tests that a rule that exceeds its time limit is
+// abandoned, and that a group that exceeds its time limit is not explored
+// further.
+func TestRuleTimeLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	const query = "SELECT a, b, c FROM abc WHERE c = 'foo'"
+
+	// A rule that exceeds its time limit is abandoned, and optimization
+	// continues without it.
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.NotifyOnMatchedRule(func(ruleName opt.RuleName) bool {
+		if ruleName == opt.GenerateConstrainedScans {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return true
+	})
+	o.SetRuleTimeLimits(time.Millisecond, 0 /* groupLimit */)
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.AbandonedRules().Contains(int(opt.GenerateConstrainedScans)) {
+		t.Errorf("expected rule to be abandoned, got %v", o.AbandonedRules())
+	}
+	if root.Op() != opt.SelectOp {
+		t.Errorf("expected constrained scan not to be generated:\n%s", root)
+	}
+
+	// A group that exceeds its time limit is not explored further.
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.SetRuleTimeLimits(0 /* ruleLimit */, time.Nanosecond)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if o.TimeLimitedGroups() == 0 {
+		t.Errorf("expected at least one group to exceed its time limit")
+	}
+
+	// Without limits, the rule is applied.
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+	o.SetRuleTimeLimits(0 /* ruleLimit */, 0 /* groupLimit */)
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if !o.AbandonedRules().Empty() || o.TimeLimitedGroups() != 0 {
+		t.Errorf("expected no rules or groups to exceed their time limits")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic on negative time limit")
+			}
+		}()
+		o.SetRuleTimeLimits(-time.Second, 0 /* groupLimit */)
+	}()
+}
@@ -15,7 +15,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/constraint"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
 	"github.com/cockroachdb/cockroach/pkg/sql/rowinfra"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/errors"
 )
@@ -158,6 +160,83 @@ func (c *CustomFuncs) GenerateLocalityOptimizedScan(
 		return
 	}
 
+	localScanPrivate, remoteScanPrivate, ok := c.splitScanByLocality(scanPrivate)
+	if !ok {
+		return
+	}
+	localScan := c.e.f.ConstructScan(localScanPrivate)
+	remoteScan := c.e.f.ConstructScan(remoteScanPrivate)
+
+	// Add the LocalityOptimizedSearchExpr to the same group as the original scan.
+	locOptSearch := memo.LocalityOptimizedSearchExpr{
+		Local:  localScan,
+		Remote: remoteScan,
+		SetPrivate: memo.SetPrivate{
+			LeftCols:  localScan.Relational().OutputCols.ToList(),
+			RightCols: remoteScan.Relational().OutputCols.ToList(),
+			OutCols:   grp.Relational().OutputCols.ToList(),
+		},
+	}
+	c.e.mem.AddLocalityOptimizedSearchToGroup(&locOptSearch, grp)
+}
+
+// CanMaybeGenerateLocalityOptimizedLimitedScan returns true if it may be
+// possible to generate a locality optimized scan from the given scan private,
+// which is the input of a Limit operator with the given limit and ordering.
+// See the comment above the GenerateLocalityOptimizedLimitedScan rule for
+// details.
+func (c *CustomFuncs) CanMaybeGenerateLocalityOptimizedLimitedScan(
+	scanPrivate *memo.ScanPrivate, limit tree.Datum, ordering props.OrderingChoice,
+) bool {
+	// LocalityOptimizedSearch only executes the remote scan if the local scan
+	// returns no rows, so it can only be used to find a single, arbitrary row.
+	if int64(*limit.(*tree.DInt)) != 1 || !ordering.Any() {
+		return false
+	}
+	return c.CanMaybeGenerateLocalityOptimizedScan(scanPrivate)
+}
+
+// GenerateLocalityOptimizedLimitedScan generates a locality optimized search
+// over a local and a remote scan, each limited to a single row, and adds it to
+// the given group, which must be a Limit operator with a limit of 1. This
+// function should only be called if
+// CanMaybeGenerateLocalityOptimizedLimitedScan returns true. See the comment
+// above the GenerateLocalityOptimizedLimitedScan rule for more details.
+func (c *CustomFuncs) GenerateLocalityOptimizedLimitedScan(
+	grp memo.RelExpr, scanPrivate *memo.ScanPrivate,
+) {
+	localScanPrivate, remoteScanPrivate, ok := c.splitScanByLocality(scanPrivate)
+	if !ok {
+		return
+	}
+	localScanPrivate.HardLimit = memo.MakeScanLimit(1, false /* reverse */)
+	remoteScanPrivate.HardLimit = memo.MakeScanLimit(1, false /* reverse */)
+	localScan := c.e.f.ConstructScan(localScanPrivate)
+	remoteScan := c.e.f.ConstructScan(remoteScanPrivate)
+
+	// Add the LocalityOptimizedSearchExpr to the same group as the original
+	// limit.
+	locOptSearch := memo.LocalityOptimizedSearchExpr{
+		Local:  localScan,
+		Remote: remoteScan,
+		SetPrivate: memo.SetPrivate{
+			LeftCols:  localScan.Relational().OutputCols.ToList(),
+			RightCols: remoteScan.Relational().OutputCols.ToList(),
+			OutCols:   grp.Relational().OutputCols.ToList(),
+		},
+	}
+	c.e.mem.AddLocalityOptimizedSearchToGroup(&locOptSearch, grp)
+}
+
+// splitScanByLocality splits the spans of the given scan private into a scan
+// private that targets only local partitions (relative to the gateway region)
+// and a scan private that targets only remote partitions. Both of the returned
+// scan privates are marked as LocalityOptimized. It returns ok=false if the
+// spans target only local or only remote partitions. splitScanByLocality should
+// only be called if CanMaybeGenerateLocalityOptimizedScan returns true.
+func (c *CustomFuncs) splitScanByLocality(
+	scanPrivate *memo.ScanPrivate,
+) (localScanPrivate, remoteScanPrivate *memo.ScanPrivate, ok bool) {
 	tabMeta := c.e.mem.Metadata().TableMeta(scanPrivate.Table)
 	index := tabMeta.Table.Index(scanPrivate.Index)
 
@@ -167,97 +246,34 @@ func (c *CustomFuncs) GenerateLocalityOptimizedScan(
 
 	// Determine whether the index has both local and remote partitions, and
 	// if so, which spans target local partitions.
-	var localPartitions util.FastIntSet
-	for i, n := 0, index.PartitionCount(); i < n; i++ {
-		part := index.Partition(i)
-		if isZoneLocal(part.Zone(), localRegion) {
-			localPartitions.Add(i)
-		}
-	}
+	localPartitions := getLocalPartitions(index, localRegion)
 	if localPartitions.Len() == 0 || localPartitions.Len() == index.PartitionCount() {
 		// The partitions are either all local or all remote.
-		return
+		return nil, nil, false
 	}
 
-	localSpans := c.getLocalSpans(index, localPartitions, scanPrivate.Constraint)
+	localSpans := getLocalSpans(c.e.evalCtx, index, localPartitions, scanPrivate.Constraint)
 	if localSpans.Len() == 0 || localSpans.Len() == scanPrivate.Constraint.Spans.Count() {
 		// The spans target all local or all remote partitions.
-		return
+		return nil, nil, false
 	}
 
 	// Split the spans into local and remote sets.
 	localConstraint, remoteConstraint := c.splitSpans(scanPrivate.Constraint, localSpans)
 
 	// Create the local scan.
-	localScanPrivate := c.DuplicateScanPrivate(scanPrivate)
+	localScanPrivate = c.DuplicateScanPrivate(scanPrivate)
 	localScanPrivate.LocalityOptimized = true
 	localConstraint.Columns = localConstraint.Columns.RemapColumns(scanPrivate.Table, localScanPrivate.Table)
 	localScanPrivate.SetConstraint(c.e.evalCtx, &localConstraint)
-	localScan := c.e.f.ConstructScan(localScanPrivate)
 
 	// Create the remote scan.
-	remoteScanPrivate := c.DuplicateScanPrivate(scanPrivate)
+	remoteScanPrivate = c.DuplicateScanPrivate(scanPrivate)
 	remoteScanPrivate.LocalityOptimized = true
 	remoteConstraint.Columns = remoteConstraint.Columns.RemapColumns(scanPrivate.Table, remoteScanPrivate.Table)
 	remoteScanPrivate.SetConstraint(c.e.evalCtx, &remoteConstraint)
-	remoteScan := c.e.f.ConstructScan(remoteScanPrivate)
 
-	// Add the LocalityOptimizedSearchExpr to the same group as the original scan.
-	locOptSearch := memo.LocalityOptimizedSearchExpr{
-		Local:  localScan,
-		Remote: remoteScan,
-		SetPrivate: memo.SetPrivate{
-			LeftCols:  localScan.Relational().OutputCols.ToList(),
-			RightCols: remoteScan.Relational().OutputCols.ToList(),
-			OutCols:   grp.Relational().OutputCols.ToList(),
-		},
-	}
-	c.e.mem.AddLocalityOptimizedSearchToGroup(&locOptSearch, grp)
-}
-
-// getLocalSpans returns the indexes of the spans from the given constraint that
-// target local partitions.
-func (c *CustomFuncs) getLocalSpans(
-	index cat.Index, localPartitions util.FastIntSet, constraint *constraint.Constraint,
-) util.FastIntSet {
-	// Collect all the prefixes from all the different partitions (remembering
-	// which ones came from local partitions), and sort them so that longer
-	// prefixes come before shorter prefixes. For each span in the constraint, we
-	// will iterate through the list of prefixes until we find a match, so
-	// ordering them with longer prefixes first ensures that the correct match is
-	// found.
-	allPrefixes := getSortedPrefixes(index, localPartitions)
-
-	// Now iterate through the spans and determine whether each one matches
-	// with a prefix from a local partition.
-	// TODO(rytaft): Sort the prefixes by key in addition to length, and use
-	// binary search here.
-	var localSpans util.FastIntSet
-	for i, n := 0, constraint.Spans.Count(); i < n; i++ {
-		span := constraint.Spans.Get(i)
-		spanPrefix := span.Prefix(c.e.evalCtx)
-		for j := range allPrefixes {
-			prefix := allPrefixes[j].prefix
-			isLocal := allPrefixes[j].isLocal
-			if len(prefix) > spanPrefix {
-				continue
-			}
-			matches := true
-			for k, datum := range prefix {
-				if span.StartKey().Value(k).Compare(c.e.evalCtx, datum) != 0 {
-					matches = false
-					break
-				}
-			}
-			if matches {
-				if isLocal {
-					localSpans.Add(i)
-				}
-				break
-			}
-		}
-	}
-	return localSpans
+	return localScanPrivate, remoteScanPrivate, true
 }
 
 // splitSpans splits the original constraint into a local and remote constraint
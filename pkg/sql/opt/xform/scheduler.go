@@ -0,0 +1,208 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util"
+)
+
+// ExplorationScheduler controls the order in which the optimizer applies
+// exploration rules and explores groups. It can be set via a call to
+// Optimizer.SetExplorationScheduler.
+//
+// By default, each exploration of a group applies every exploration rule, and
+// child groups are optimized in order. A scheduler allows cheap rules with a
+// high payoff, such as those that generate constrained scans, to be applied
+// to a group before expensive enumerations, such as join reordering. This
+// matters most when an exploration budget is in effect, since the budget may
+// be exhausted before the expensive rules run.
+type ExplorationScheduler interface {
+	// RulePriority returns the priority of the given exploration rule. A group
+	// is first explored using only the rules with the highest priority. Once
+	// those rules can add no further expressions to the group, it is explored
+	// using the rules with the next highest priority as well, and so on. Rules
+	// with the same priority are applied in their usual order.
+	RulePriority(rule opt.RuleName) int
+
+	// GroupPriority returns the priority of the given group. When an
+	// exploration budget is set via SetExplorationBudgetFunc or SetBudget, the
+	// children of each expression are optimized (and therefore explored) in
+	// order of decreasing priority, so that the groups most likely to benefit
+	// from exploration are explored before the budget is exhausted. It is not
+	// called if no budget is in effect.
+	GroupPriority(grp memo.RelExpr) float64
+}
+
+// DefaultExplorationScheduler is an ExplorationScheduler that applies the
+// rules that generate alternate scans before other exploration rules, and
+// applies join reordering rules last. When a budget is in effect, it explores
+// the inputs with the highest estimated row count first, since the choice of
+// plan for a large input usually has the largest effect on the total cost.
+var DefaultExplorationScheduler ExplorationScheduler = defaultExplorationScheduler{}
+
+type defaultExplorationScheduler struct{}
+
+// RulePriority is part of the ExplorationScheduler interface.
+func (defaultExplorationScheduler) RulePriority(rule opt.RuleName) int {
+	switch rule {
+	case opt.GenerateIndexScans, opt.GenerateConstrainedScans, opt.GeneratePartialIndexScans,
+		opt.GenerateInvertedIndexScans, opt.GenerateLimitedScans:
+		return 1
+	case opt.ReorderJoins, opt.CommuteLeftJoin, opt.CommuteSemiJoin:
+		return -1
+	}
+	return 0
+}
+
+// GroupPriority is part of the ExplorationScheduler interface.
+func (defaultExplorationScheduler) GroupPriority(grp memo.RelExpr) float64 {
+	return grp.Relational().Stats.RowCount
+}
+
+// NewRandomExplorationScheduler returns an ExplorationScheduler for testing
+// that applies the exploration rules in a random order determined by the given
+// seed, by giving each rule a distinct random priority. When exploration is
+// not bounded, the memo should contain the same expressions, and the lowest
+// cost plan should have the same cost, no matter the order in which the rules
+// are applied. A difference indicates a rule with a hidden dependency on the
+// rules that were applied before it. Groups are prioritized in the same way as
+// by DefaultExplorationScheduler.
+func NewRandomExplorationScheduler(seed int64) ExplorationScheduler {
+	s := &randomExplorationScheduler{}
+	perm := rand.New(rand.NewSource(seed)).Perm(int(opt.NumRuleNames))
+	for r := range s.rulePriorities {
+		s.rulePriorities[r] = perm[r]
+	}
+	return s
+}
+
+type randomExplorationScheduler struct {
+	rulePriorities [opt.NumRuleNames]int
+}
+
+// RulePriority is part of the ExplorationScheduler interface.
+func (s *randomExplorationScheduler) RulePriority(rule opt.RuleName) int {
+	return s.rulePriorities[rule]
+}
+
+// GroupPriority is part of the ExplorationScheduler interface.
+func (s *randomExplorationScheduler) GroupPriority(grp memo.RelExpr) float64 {
+	return DefaultExplorationScheduler.GroupPriority(grp)
+}
+
+// explorationSchedule is the state needed to apply the rule priorities of an
+// ExplorationScheduler.
+type explorationSchedule struct {
+	scheduler ExplorationScheduler
+
+	// rulePriorities is the priority of each exploration rule, indexed by rule
+	// name.
+	rulePriorities [opt.NumRuleNames]int
+
+	// levels contains the distinct rule priorities, in decreasing order. Each
+	// group is explored with the rules whose priority is at least
+	// levels[exploreState.level].
+	levels []int
+
+	// minPriority is the lowest priority of the rules that can be applied
+	// during the current exploration of a group.
+	minPriority int
+
+	// deferred is set if a rule was matched during the current exploration of
+	// a group, but was not applied because its priority is below minPriority.
+	deferred bool
+}
+
+// init initializes the schedule for the given scheduler.
+func (s *explorationSchedule) init(scheduler ExplorationScheduler) {
+	*s = explorationSchedule{scheduler: scheduler}
+	seen := make(map[int]bool)
+	for r := opt.RuleName(1); r < opt.NumRuleNames; r++ {
+		if !r.IsExplore() {
+			continue
+		}
+		priority := scheduler.RulePriority(r)
+		s.rulePriorities[r] = priority
+		if !seen[priority] {
+			seen[priority] = true
+			s.levels = append(s.levels, priority)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(s.levels)))
+}
+
+// allowed returns true if the given rule can be applied during the current
+// exploration of a group, and records that it was deferred if not.
+func (s *explorationSchedule) allowed(rule opt.RuleName) bool {
+	if !rule.IsExplore() || s.rulePriorities[rule] >= s.minPriority {
+		return true
+	}
+	s.deferred = true
+	return false
+}
+
+// startExploration is called before a group is explored, and limits the rules
+// that can be applied to those allowed by the group's current level.
+func (s *explorationSchedule) startExploration(state *exploreState) {
+	if state.level < len(s.levels) {
+		s.minPriority = s.levels[state.level]
+	}
+	s.deferred = false
+}
+
+// finishExploration is called after a group is explored, with fullyExplored
+// set if no further expressions can be added to the group by the rules of its
+// current level. If rules were deferred, it moves the group to the next level
+// so that the next exploration considers every member of the group again with
+// the additional rules, and returns false. Otherwise, it returns
+// fullyExplored.
+func (s *explorationSchedule) finishExploration(state *exploreState, fullyExplored bool) bool {
+	if !fullyExplored || !s.deferred || state.level >= len(s.levels)-1 {
+		return fullyExplored
+	}
+	state.level++
+	state.end = 0
+	state.fullyExploredMembers = util.FastIntSet{}
+	return false
+}
+
+// childOrder returns the order in which the children of the given expression
+// should be optimized, or nil if they should be optimized in their usual
+// order.
+func (s *explorationSchedule) childOrder(e memo.RelExpr) []int {
+	n := e.ChildCount()
+	if n < 2 {
+		return nil
+	}
+	order := make([]int, n)
+	priorities := make([]float64, n)
+	for i := range order {
+		order[i] = i
+		if child, ok := e.Child(i).(memo.RelExpr); ok {
+			priorities[i] = s.scheduler.GroupPriority(child)
+		}
+	}
+	// Scalar children have the lowest priority.
+	sort.SliceStable(order, func(i, j int) bool {
+		_, iRel := e.Child(order[i]).(memo.RelExpr)
+		_, jRel := e.Child(order[j]).(memo.RelExpr)
+		if iRel != jRel {
+			return iRel
+		}
+		return priorities[order[i]] > priorities[order[j]]
+	})
+	return order
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/constraint"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/invertedexpr"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/invertedidx"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
@@ -737,6 +738,13 @@ func (c *CustomFuncs) partitionValuesFilters(
 // project columns other than the primary key columns. The reason it's pre-
 // constrained is that we cannot treat an inverted index in the same way as a
 // regular index, since it does not actually contain the indexed column.
+//
+// If several conjuncts of the filters constrain the same inverted index, the
+// span expression of the Scan intersects the spans of all of them. In that
+// case, an alternate Scan is also generated for each of the conjuncts alone,
+// with the other conjuncts applied after the IndexJoin. This allows the coster
+// to choose between reading and intersecting the spans of every conjunct, and
+// reading the spans of a single selective conjunct and filtering the rest.
 func (c *CustomFuncs) GenerateInvertedIndexScans(
 	grp memo.RelExpr, scanPrivate *memo.ScanPrivate, filters memo.FiltersExpr,
 ) {
@@ -751,45 +759,21 @@ func (c *CustomFuncs) GenerateInvertedIndexScans(
 	computedColFilters := c.computedColFilters(scanPrivate, filters, optionalFilters)
 	optionalFilters = append(optionalFilters, computedColFilters...)
 
-	// Iterate over all inverted indexes.
-	var iter scanIndexIter
-	iter.Init(c.e.evalCtx, c.e.f, c.e.mem, &c.im, scanPrivate, filters, rejectNonInvertedIndexes)
-	iter.ForEach(func(index cat.Index, filters memo.FiltersExpr, indexCols opt.ColSet, _ bool, _ memo.ProjectionsExpr) {
-		// Check whether the filter can constrain the index.
-		spanExpr, constraint, remainingFilters, pfState, ok := invertedidx.TryFilterInvertedIndex(
-			c.e.evalCtx, c.e.f, filters, optionalFilters, scanPrivate.Table, index, tabMeta.ComputedCols,
-		)
-		if !ok {
-			// A span expression to constrain the inverted index could not be
-			// generated.
-			return
-		}
-		spansToRead := spanExpr.SpansToRead
-		// Override the filters with remainingFilters. If the index is a
-		// multi-column inverted index, the non-inverted prefix columns are
-		// constrained by the constraint. In this case, it may be possible to
-		// reduce the filters if the constraint fully describes some of
-		// sub-expressions. The remainingFilters are the filters that are not
-		// fully expressed by the constraint.
-		//
-		// Consider the example:
-		//
-		//   CREATE TABLE t (a INT, b INT, g GEOMETRY, INVERTED INDEX (b, g))
-		//
-		//   SELECT * FROM t WHERE a = 1 AND b = 2 AND ST_Intersects(.., g)
-		//
-		// The constraint would constrain b to [/2 - /2], guaranteeing that
-		// the inverted index scan would only produce rows where (b = 2).
-		// Reapplying the (b = 2) filter after the scan would be
-		// unnecessary, so the remainingFilters in this case would be
-		// (a = 1 AND ST_Intersects(.., g)).
-		filters = remainingFilters
-
+	// addScan adds a Scan of the given inverted index that is constrained by
+	// the given span expression and prefix constraint to the group, along with
+	// an IndexJoin and the given remaining filters.
+	addScan := func(
+		index cat.Index,
+		spanExpr *inverted.SpanExpression,
+		constraint *constraint.Constraint,
+		filters memo.FiltersExpr,
+		pfState *invertedexpr.PreFiltererStateForInvertedFilterer,
+	) {
 		// Construct new ScanOpDef with the new index and constraint.
 		newScanPrivate := *scanPrivate
 		newScanPrivate.Index = index.Ordinal()
 		newScanPrivate.SetConstraint(c.e.evalCtx, constraint)
-		newScanPrivate.InvertedConstraint = spansToRead
+		newScanPrivate.InvertedConstraint = spanExpr.SpansToRead
 
 		// Calculate the PK columns once.
 		if pkCols.Empty() {
@@ -829,6 +813,62 @@ func (c *CustomFuncs) GenerateInvertedIndexScans(
 		sb.AddSelect(filters)
 
 		sb.Build(grp)
+	}
+
+	// Iterate over all inverted indexes.
+	var iter scanIndexIter
+	iter.Init(c.e.evalCtx, c.e.f, c.e.mem, &c.im, scanPrivate, filters, rejectNonInvertedIndexes)
+	iter.ForEach(func(index cat.Index, filters memo.FiltersExpr, indexCols opt.ColSet, _ bool, _ memo.ProjectionsExpr) {
+		// Check whether the filter can constrain the index.
+		spanExpr, constraint, remainingFilters, pfState, ok := invertedidx.TryFilterInvertedIndex(
+			c.e.evalCtx, c.e.f, filters, optionalFilters, scanPrivate.Table, index, tabMeta.ComputedCols,
+		)
+		if !ok {
+			// A span expression to constrain the inverted index could not be
+			// generated.
+			return
+		}
+		// Replace the filters with remainingFilters. If the index is a
+		// multi-column inverted index, the non-inverted prefix columns are
+		// constrained by the constraint. In this case, it may be possible to
+		// reduce the filters if the constraint fully describes some of
+		// sub-expressions. The remainingFilters are the filters that are not
+		// fully expressed by the constraint.
+		//
+		// Consider the example:
+		//
+		//   CREATE TABLE t (a INT, b INT, g GEOMETRY, INVERTED INDEX (b, g))
+		//
+		//   SELECT * FROM t WHERE a = 1 AND b = 2 AND ST_Intersects(.., g)
+		//
+		// The constraint would constrain b to [/2 - /2], guaranteeing that
+		// the inverted index scan would only produce rows where (b = 2).
+		// Reapplying the (b = 2) filter after the scan would be
+		// unnecessary, so the remainingFilters in this case would be
+		// (a = 1 AND ST_Intersects(.., g)).
+		addScan(index, spanExpr, constraint, remainingFilters, pfState)
+
+		// If the span expression intersects the spans of several conjuncts, also
+		// try each conjunct alone. Multi-column inverted indexes are skipped,
+		// since a single conjunct cannot constrain their prefix columns.
+		if spanExpr.Operator != inverted.SetIntersection || len(filters) < 2 ||
+			index.NonInvertedPrefixColumnCount() > 0 {
+			return
+		}
+		for i := range filters {
+			spanExpr, constraint, remainingFilters, pfState, ok := invertedidx.TryFilterInvertedIndex(
+				c.e.evalCtx, c.e.f, filters[i:i+1], optionalFilters, scanPrivate.Table, index, tabMeta.ComputedCols,
+			)
+			if !ok {
+				continue
+			}
+			for j := range filters {
+				if j != i {
+					remainingFilters = append(remainingFilters, filters[j])
+				}
+			}
+			addScan(index, spanExpr, constraint, remainingFilters, pfState)
+		}
 	})
 }
 
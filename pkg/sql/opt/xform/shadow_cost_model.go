@@ -0,0 +1,187 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqltelemetry"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// shadowDisagreementLogLimiter limits the rate at which statements for which
+// the shadow cost model disagrees with the cost model of the optimizer are
+// logged.
+var shadowDisagreementLogLimiter = log.Every(10 * time.Second)
+
+// CostModelComparison is the outcome of costing a plan under both the cost
+// model of the optimizer and a shadow cost model. See SetShadowCostModel.
+type CostModelComparison struct {
+	// Version is the version of the cost model by which the plan was chosen,
+	// and ShadowVersion is the version of the shadow cost model.
+	Version, ShadowVersion CostModelVersion
+
+	// Cost is the cost of the chosen plan under the cost model of the
+	// optimizer.
+	Cost memo.Cost
+
+	// ShadowCost is the cost of the chosen plan under the shadow cost model.
+	ShadowCost memo.Cost
+
+	// ShadowBestCost is the cost of the plan that the shadow cost model would
+	// have chosen, under the shadow cost model. It is never higher than
+	// ShadowCost.
+	ShadowBestCost memo.Cost
+
+	// ShadowBest is the root of the plan that the shadow cost model would have
+	// chosen. Its children are not necessarily those of the chosen plan.
+	ShadowBest memo.RelExpr
+
+	// Disagrees is true if the shadow cost model would have chosen a different
+	// plan, i.e. if ShadowBestCost is lower than ShadowCost.
+	Disagrees bool
+}
+
+// shadowCostModel is the state of the optimizer that is only used when a
+// shadow cost model is set.
+type shadowCostModel struct {
+	settings   CostModelSettings
+	coster     coster
+	comparison *CostModelComparison
+}
+
+// SetShadowCostModel causes the optimizer to cost every candidate under the
+// given cost model settings, as well as under its own cost model, and to track
+// the lowest cost expression of each group under both. The plan is chosen by
+// the cost model of the optimizer, as usual; once Optimize completes, the
+// comparison of the two cost models is returned by CostModelComparison, and a
+// telemetry counter is incremented if the shadow cost model would have chosen
+// a different plan. This allows a new version of the cost model, or new cost
+// factors, to be evaluated against production workloads before they are used
+// to choose plans. The shadow cost model is also taken from the
+// sql.optimizer.cost_model.shadow_version cluster setting.
+//
+// Subqueries in scalar expressions are costed only under the cost model of the
+// optimizer, and candidates abandoned because of a cost ceiling are not costed
+// under the shadow cost model. SetShadowCostModel disables cost bound pruning
+// (see SetCostBoundPruning), and must be called before Optimize.
+func (o *Optimizer) SetShadowCostModel(settings CostModelSettings) {
+	if err := settings.Validate(); err != nil {
+		panic(errors.NewAssertionErrorWithWrappedErrf(err, "invalid shadow cost model settings"))
+	}
+	if settings.Version == 0 {
+		settings.Version = CostModelV1
+	}
+	o.shadow = &shadowCostModel{settings: settings}
+}
+
+// CostModelComparison returns the comparison of the cost model of the
+// optimizer with the shadow cost model, or nil if no shadow cost model was set
+// or Optimize has not completed.
+func (o *Optimizer) CostModelComparison() *CostModelComparison {
+	if o.shadow == nil {
+		return nil
+	}
+	return o.shadow.comparison
+}
+
+// initShadowCoster initializes the coster of the shadow cost model, which uses
+// the same cardinality estimator and stats uncertainty penalty as the default
+// coster. It is called by Optimize, after the optimizer has been configured.
+func (o *Optimizer) initShadowCoster() {
+	c := &o.shadow.coster
+	c.Init(o.evalCtx, o.mem, 0 /* perturbation */, o.shadow.settings)
+	c.estimator = o.defaultCoster.estimator
+	c.setStatsPenalty(o.defaultCoster.statsPenalty)
+}
+
+// ratchetShadowCost records the given candidate as the lowest cost expression
+// of the group state under the shadow cost model, if its cost under the shadow
+// cost model is lower than that of the existing one.
+func (o *Optimizer) ratchetShadowCost(state *groupState, candidate memo.RelExpr, cost memo.Cost) {
+	if state.shadowBest == nil || cost.Less(state.shadowCost) {
+		state.shadowBest = candidate
+		state.shadowCost = cost
+	}
+}
+
+// shadowChildCost returns the cost of the given child, which was optimized with
+// respect to the given required properties, under the shadow cost model. The
+// cost of a scalar child, or of a relational child whose group state has no
+// lowest cost expression under the shadow cost model, is the given cost under
+// the cost model of the optimizer.
+func (o *Optimizer) shadowChildCost(
+	child opt.Expr, required *physical.Required, cost memo.Cost,
+) memo.Cost {
+	if rel, ok := child.(memo.RelExpr); ok {
+		if state := o.lookupOptState(rel.FirstExpr(), required); state != nil && state.shadowBest != nil {
+			return state.shadowCost
+		}
+	}
+	return cost
+}
+
+// compareShadowCostModel compares the lowest cost tree with the given root,
+// which was chosen for the given group state, with the plan that the shadow
+// cost model would have chosen for the state.
+func (o *Optimizer) compareShadowCostModel(
+	state *groupState, root memo.RelExpr, rootProps *physical.Required,
+) {
+	c := &CostModelComparison{
+		Version:        o.defaultCoster.version,
+		ShadowVersion:  o.shadow.coster.version,
+		Cost:           root.Cost(),
+		ShadowCost:     o.shadowTreeCost(root, rootProps),
+		ShadowBestCost: state.shadowCost,
+		ShadowBest:     state.shadowBest,
+	}
+	c.Disagrees = c.ShadowBest != nil && c.ShadowBestCost.Less(c.ShadowCost)
+	o.shadow.comparison = c
+
+	telemetry.Inc(sqltelemetry.CostModelShadowComparisonCounter)
+	if c.Disagrees {
+		telemetry.Inc(sqltelemetry.CostModelShadowDisagreementCounter)
+		if shadowDisagreementLogLimiter.ShouldLog() {
+			log.Infof(o.ctx(),
+				"cost model version %d would choose a different plan than version %d: "+
+					"cost %.2f instead of %.2f",
+				c.ShadowVersion, c.Version, c.ShadowBestCost, c.ShadowCost,
+			)
+		}
+	}
+}
+
+// shadowTreeCost returns the cost of the lowest cost tree rooted at the given
+// expression under the shadow cost model. Unlike recomputeCostImpl, it does
+// not modify the costs of the expressions in the tree.
+func (o *Optimizer) shadowTreeCost(parent opt.Expr, parentProps *physical.Required) memo.Cost {
+	var cost memo.Cost
+	for i, n := 0, parent.ChildCount(); i < n; i++ {
+		child := parent.Child(i)
+		childProps := physical.MinRequired
+		if rel, ok := child.(memo.RelExpr); ok {
+			childProps = rel.RequiredPhysical()
+		}
+		childCost := o.shadowTreeCost(child, childProps)
+		if !isApplyJoinRightInput(o.mem, parent, i) {
+			cost += childCost
+		}
+	}
+	if rel, ok := parent.(memo.RelExpr); ok {
+		cost += o.shadow.coster.ComputeCost(rel, parentProps)
+	}
+	return cost
+}
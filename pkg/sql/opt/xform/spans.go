@@ -0,0 +1,84 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Names of the spans opened by Optimize, which are children of the span of the
+// statement being optimized (if any). Normalization happens while the
+// expression is built, before Optimize is called, so its span is opened by
+// the caller that builds the expression (see NormalizeSpanName).
+const (
+	// NormalizeSpanName is the name of the span that callers should open
+	// around the construction of the normalized expression.
+	NormalizeSpanName = "optimizer normalize"
+
+	optimizeSpanName          = "optimize"
+	costSpanName              = "optimizer cost"
+	exploreSpanName           = "optimizer explore"
+	setLowestCostTreeSpanName = "optimizer set lowest cost tree"
+)
+
+// TagMemoSize tags the given span with the number of expressions in the memo
+// and its estimated memory usage. It is a no-op if the span is nil.
+func TagMemoSize(sp *tracing.Span, mem *memo.Memo) {
+	if sp == nil {
+		return
+	}
+	sp.SetTag("memo-exprs", attribute.IntValue(mem.ExprCount()))
+	sp.SetTag("memo-bytes", attribute.Int64Value(mem.MemoryEstimate()))
+}
+
+// startSpan finishes the span of the current phase of optimization, if any,
+// and opens a child span of the given context for the next phase. No span is
+// opened if the context has no span, i.e. if the statement is not traced.
+func (o *Optimizer) startSpan(ctx context.Context, phase string) {
+	o.finishSpan()
+	_, o.span = tracing.ChildSpan(ctx, phase)
+}
+
+// finishSpan tags the span of the current phase of optimization with the size
+// of the memo, and finishes it.
+func (o *Optimizer) finishSpan() {
+	if o.span == nil {
+		return
+	}
+	TagMemoSize(o.span, o.mem)
+	o.span.Finish()
+	o.span = nil
+}
+
+// exploreGroup explores the given group with respect to the given required
+// properties. Exploration is interleaved with costing, and a group may be
+// explored many times, so a span is only opened for each exploration if the
+// span of the costing phase is recording, e.g. because the statement is being
+// traced with SET tracing or EXPLAIN ANALYZE (DEBUG).
+func (o *Optimizer) exploreGroup(grp memo.RelExpr, required *physical.Required) *exploreState {
+	if o.span == nil || o.span.RecordingType() == tracing.RecordingOff {
+		return o.explorer.exploreGroup(grp, required)
+	}
+	sp := o.span.Tracer().StartSpan(exploreSpanName, tracing.WithParent(o.span))
+	defer sp.Finish()
+	exprs := o.mem.ExprCount()
+	state := o.explorer.exploreGroup(grp, required)
+	sp.SetTag("op", attribute.StringValue(grp.Op().String()))
+	sp.SetTag("required", attribute.StringValue(required.String()))
+	sp.SetTag("exprs-added", attribute.IntValue(o.mem.ExprCount()-exprs))
+	TagMemoSize(sp, o.mem)
+	return state
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// TestOptimizerSpans tests that optimization records tracing spans for each of
+// its phases, tagged with the size of the memo.
+func TestOptimizerSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	tr := tracing.NewTracer()
+	ctx, getRecording := tracing.ContextWithRecordingSpan(context.Background(), tr, "test")
+	evalCtx.Context = ctx
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT * FROM abc WHERE c = 'foo' ORDER BY b")
+	if _, err := o.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := getRecording()
+	for _, op := range []string{
+		"optimize", "optimizer cost", "optimizer explore", "optimizer set lowest cost tree",
+	} {
+		sp, ok := rec.FindSpan(op)
+		if !ok {
+			t.Fatalf("expected a %q span in the recording:\n%s", op, rec)
+		}
+		if sp.Tags["memo-exprs"] == "" || sp.Tags["memo-bytes"] == "" {
+			t.Errorf("expected the %q span to be tagged with the memo size, got %v", op, sp.Tags)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// minGroupStateTableSize is the number of slots allocated by the first insert
+// into an empty groupStateTable. It must be a power of two.
+const minGroupStateTableSize = 64
+
+// groupStateTable maps a memo group and a set of required physical properties
+// to the groupState that the optimizer keeps for them. It is looked up for
+// every member of every group that is optimized, so rather than a Go map it is
+// an open-addressing hash table with linear probing that is specialized for
+// its key: both the first expression in the group and the interned physical
+// properties are compared and hashed by pointer, and the table stores the key
+// and value of each entry side by side, in a single slice.
+//
+// The groupState structs themselves are not stored inline, since optimizeGroup
+// holds pointers to them while it recursively optimizes other groups, which
+// may insert into the table and cause it to grow. Instead, they are allocated
+// contiguously by the optimizer's arena, and the table stores pointers to
+// them.
+type groupStateTable struct {
+	// slots has a power of two length, or is empty. A slot is empty if its
+	// state is nil.
+	slots []groupStateSlot
+
+	// shift is the number of bits by which a hash is shifted to produce the
+	// index of its preferred slot.
+	shift uint
+
+	// count is the number of entries in the table.
+	count int
+}
+
+type groupStateSlot struct {
+	key   groupStateKey
+	state *groupState
+}
+
+// len returns the number of entries in the table.
+func (t *groupStateTable) len() int {
+	return t.count
+}
+
+// lookup returns the state associated with the given key, or nil if there is
+// none.
+func (t *groupStateTable) lookup(key groupStateKey) *groupState {
+	if t.count == 0 {
+		return nil
+	}
+	mask := len(t.slots) - 1
+	for i := t.index(key); ; i = (i + 1) & mask {
+		slot := &t.slots[i]
+		if slot.state == nil {
+			return nil
+		}
+		if slot.key == key {
+			return slot.state
+		}
+	}
+}
+
+// insert adds the given state to the table. There must not already be an
+// entry with the given key.
+func (t *groupStateTable) insert(key groupStateKey, state *groupState) {
+	// Keep the load factor at or below 3/4, so that probe sequences are short.
+	if (t.count+1)*4 > len(t.slots)*3 {
+		t.grow()
+	}
+	t.insertNoGrow(key, state)
+	t.count++
+}
+
+// forEach calls the given function once for each entry in the table. The
+// order of the calls is unspecified. The table must not be modified by the
+// function.
+func (t *groupStateTable) forEach(fn func(key groupStateKey, state *groupState)) {
+	for i := range t.slots {
+		if slot := &t.slots[i]; slot.state != nil {
+			fn(slot.key, slot.state)
+		}
+	}
+}
+
+// reset removes all entries from the table. The slots are retained for reuse,
+// unless there are more than maxSlots of them.
+func (t *groupStateTable) reset(maxSlots int) {
+	if len(t.slots) > maxSlots {
+		*t = groupStateTable{}
+		return
+	}
+	for i := range t.slots {
+		t.slots[i] = groupStateSlot{}
+	}
+	t.count = 0
+}
+
+// grow doubles the number of slots in the table, and re-inserts its entries.
+func (t *groupStateTable) grow() {
+	size := 2 * len(t.slots)
+	if size == 0 {
+		size = minGroupStateTableSize
+	}
+	old := t.slots
+	t.slots = make([]groupStateSlot, size)
+	t.shift = uint(64 - bits.TrailingZeros(uint(size)))
+	for i := range old {
+		if old[i].state != nil {
+			t.insertNoGrow(old[i].key, old[i].state)
+		}
+	}
+}
+
+func (t *groupStateTable) insertNoGrow(key groupStateKey, state *groupState) {
+	mask := len(t.slots) - 1
+	i := t.index(key)
+	for t.slots[i].state != nil {
+		i = (i + 1) & mask
+	}
+	t.slots[i] = groupStateSlot{key: key, state: state}
+}
+
+// index returns the index of the preferred slot of the given key. It uses
+// Fibonacci hashing of the addresses of the group and the properties, which
+// spreads the addresses of consecutively allocated expressions across the
+// table.
+//
+// Hashing by address relies on the garbage collector not moving heap objects,
+// which is true of the gc toolchain, so that the address of an expression or
+// of a set of properties does not change while it is in the table. If it did,
+// lookups would probe the wrong slots and miss existing entries. Keys are
+// still compared as interface values, so a collision never returns the state
+// of another key.
+func (t *groupStateTable) index(key groupStateKey) int {
+	h := uint64(exprAddr(key.group))
+	h ^= uint64(uintptr(unsafe.Pointer(key.required))) * 0x9e3779b97f4a7c15
+	return int((h * 0x9e3779b97f4a7c15) >> t.shift)
+}
+
+// eface mirrors the layout that the gc toolchain uses for interface values: a
+// type word followed by a data word.
+type eface struct {
+	typ  unsafe.Pointer
+	data unsafe.Pointer
+}
+
+// exprAddr returns the address of the expression that the given interface
+// refers to. The methods of memo.RelExpr have pointer receivers, so the
+// dynamic type of the interface is always a pointer type, which is stored
+// directly in the data word of the interface value. The data word is then the
+// address of the expression. TestExprAddr verifies this, so that a change to
+// the interface layout is caught.
+func exprAddr(e memo.RelExpr) uintptr {
+	return uintptr((*eface)(unsafe.Pointer(&e)).data)
+}
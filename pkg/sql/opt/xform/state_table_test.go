@@ -0,0 +1,170 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// makeGroupStateKeys returns keys for the given number of groups, each with
+// the given number of sets of required properties.
+func makeGroupStateKeys(groups, props int) []groupStateKey {
+	required := make([]*physical.Required, props)
+	for i := range required {
+		required[i] = &physical.Required{LimitHint: float64(i)}
+	}
+	keys := make([]groupStateKey, 0, groups*props)
+	for i := 0; i < groups; i++ {
+		var grp memo.RelExpr
+		if i%2 == 0 {
+			grp = &memo.ScanExpr{}
+		} else {
+			grp = &memo.SelectExpr{}
+		}
+		for j := range required {
+			keys = append(keys, groupStateKey{group: grp, required: required[j]})
+		}
+	}
+	return keys
+}
+
+// TestGroupStateTable tests inserting, looking up and iterating over the
+// group states in a groupStateTable, and reusing the table once it is reset.
+func TestGroupStateTable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	keys := makeGroupStateKeys(1000, 3)
+	states := make([]groupState, len(keys))
+	var table groupStateTable
+	for round := 0; round < 2; round++ {
+		// Insert half of the keys, and check that only those are found.
+		half := len(keys) / 2
+		for i := 0; i < half; i++ {
+			table.insert(keys[i], &states[i])
+		}
+		if table.len() != half {
+			t.Fatalf("expected %d entries, got %d", half, table.len())
+		}
+		for i := range keys {
+			expected := &states[i]
+			if i >= half {
+				expected = nil
+			}
+			if actual := table.lookup(keys[i]); actual != expected {
+				t.Fatalf("key %d: expected %p, got %p", i, expected, actual)
+			}
+		}
+
+		seen := 0
+		table.forEach(func(key groupStateKey, state *groupState) {
+			if table.lookup(key) != state {
+				t.Fatalf("forEach returned an entry that is not in the table")
+			}
+			seen++
+		})
+		if seen != half {
+			t.Fatalf("expected forEach to visit %d entries, got %d", half, seen)
+		}
+
+		// The slots are retained by reset only if there are few enough.
+		retained := len(table.slots)
+		table.reset(retained)
+		if table.len() != 0 || len(table.slots) != retained || table.lookup(keys[0]) != nil {
+			t.Fatalf("expected reset to clear the table and retain its slots")
+		}
+	}
+	table.reset(0)
+	if len(table.slots) != 0 {
+		t.Fatalf("expected reset to release the slots")
+	}
+}
+
+// TestExprAddr tests that exprAddr returns the address of the expression, and
+// that entries can still be found after a garbage collection.
+func TestExprAddr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	scan := &memo.ScanExpr{}
+	sel := &memo.SelectExpr{}
+	join := &memo.InnerJoinExpr{}
+	sort := &memo.SortExpr{}
+	for _, tc := range []struct {
+		expr memo.RelExpr
+		addr uintptr
+	}{
+		{expr: scan, addr: uintptr(unsafe.Pointer(scan))},
+		{expr: sel, addr: uintptr(unsafe.Pointer(sel))},
+		{expr: join, addr: uintptr(unsafe.Pointer(join))},
+		{expr: sort, addr: uintptr(unsafe.Pointer(sort))},
+	} {
+		if actual := exprAddr(tc.expr); actual != tc.addr {
+			t.Errorf("%T: expected address %#x, got %#x", tc.expr, tc.addr, actual)
+		}
+	}
+
+	keys := makeGroupStateKeys(100, 2)
+	states := make([]groupState, len(keys))
+	var table groupStateTable
+	for i := range keys {
+		table.insert(keys[i], &states[i])
+	}
+	runtime.GC()
+	for i := range keys {
+		if actual := table.lookup(keys[i]); actual != &states[i] {
+			t.Fatalf("key %d: expected %p, got %p", i, &states[i], actual)
+		}
+	}
+}
+
+// BenchmarkGroupStateTable compares lookups of group states in a
+// groupStateTable with lookups in a Go map, which the optimizer used before.
+func BenchmarkGroupStateTable(b *testing.B) {
+	for _, groups := range []int{100, 10000} {
+		keys := makeGroupStateKeys(groups, 4)
+		states := make([]groupState, len(keys))
+
+		b.Run(fmt.Sprintf("map/groups=%d", groups), func(b *testing.B) {
+			m := make(map[groupStateKey]*groupState)
+			for i := range keys {
+				m[keys[i]] = &states[i]
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if m[keys[i%len(keys)]] == nil {
+					b.Fatal("missing state")
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("table/groups=%d", groups), func(b *testing.B) {
+			var table groupStateTable
+			for i := range keys {
+				table.insert(keys[i], &states[i])
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if table.lookup(keys[i%len(keys)]) == nil {
+					b.Fatal("missing state")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+)
+
+// hintCommentPrefix is the prefix that distinguishes a hint comment from an
+// ordinary comment.
+const hintCommentPrefix = "/*+"
+
+// StatementHints change how a single statement is optimized, without changing
+// the session or cluster settings that apply to every other statement. They
+// let a user work around a planner issue for one query. Hints are given in a
+// comment that begins with "/*+" directly after the first keyword of the
+// statement, e.g.:
+//
+//	SELECT /*+ disable_rules(GenerateMergeJoins) exploration_budget(50ms) */ ...
+//
+// The following hints are supported, and their names are case-insensitive:
+//
+//	disable_rules(r1, r2, ...): the named rules are not applied, in addition
+//	  to the rules disabled by settings.
+//	enable_rules(r1, r2, ...): the named rules are applied, even if they are
+//	  disabled by the optimizer_disable_rules session variable, the
+//	  sql.optimizer.disabled_rules cluster setting or a planning profile.
+//	exploration_budget(d): exploration is bounded by the duration d, as for
+//	  SetBudget.
+//	barrier(a1, a2, ...): the data sources in the FROM clause with the given
+//	  aliases, such as subqueries or views, are planned on their own. Filters
+//	  are not pushed into them and joins are not reordered through them (see
+//	  the Barrier operator). The aliases must be unquoted.
+type StatementHints struct {
+	// DisabledRules are the rules that are not applied. If a rule is both
+	// enabled and disabled, it is disabled.
+	DisabledRules RuleSet
+
+	// EnabledRules are the rules that are applied even if they are disabled by
+	// a setting or a planning profile.
+	EnabledRules RuleSet
+
+	// Budget bounds the time spent exploring, or is zero if the budget is not
+	// changed.
+	Budget time.Duration
+
+	// Barriers are the aliases of the data sources that are wrapped in a
+	// Barrier operator by the optbuilder. It is an error if an alias does not
+	// name a data source of the statement.
+	Barriers []string
+}
+
+// ExtractHintComment returns the text of the hint comment of the given
+// statement, without the comment delimiters, or the empty string if there is
+// none. The hint comment must directly follow the first keyword of the
+// statement, so that comments within string literals and comments elsewhere in
+// the statement are never mistaken for hints. A comment before the first
+// keyword is not a hint, since the parser does not include it in the text of
+// the statement.
+func ExtractHintComment(sql string) string {
+	s := strings.TrimLeftFunc(sql, unicode.IsSpace)
+	// Skip the first keyword of the statement.
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+	if i <= 0 {
+		return ""
+	}
+	s = strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	if !strings.HasPrefix(s, hintCommentPrefix) {
+		return ""
+	}
+	end := strings.Index(s, "*/")
+	if end < 0 {
+		return ""
+	}
+	return strings.TrimSpace(s[len(hintCommentPrefix):end])
+}
+
+// ParseStatementHints parses the text of a hint comment, as returned by
+// ExtractHintComment. It returns an error if a hint is malformed or unknown,
+// or names a rule that does not exist, so that a mistyped hint is not silently
+// ignored.
+func ParseStatementHints(text string) (StatementHints, error) {
+	var hints StatementHints
+	for s := strings.TrimSpace(text); s != ""; {
+		lparen, rparen := strings.IndexByte(s, '('), strings.IndexByte(s, ')')
+		if lparen <= 0 || rparen < lparen {
+			return StatementHints{}, pgerror.Newf(pgcode.Syntax, "invalid optimizer hint %q", s)
+		}
+		name := strings.TrimSpace(s[:lparen])
+		args := strings.FieldsFunc(s[lparen+1:rparen], func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		s = strings.TrimSpace(s[rparen+1:])
+
+		switch strings.ToLower(name) {
+		case "disable_rules":
+			rules, err := ParseRuleSet(args)
+			if err != nil {
+				return StatementHints{}, err
+			}
+			hints.DisabledRules.UnionWith(rules)
+
+		case "enable_rules":
+			for _, arg := range args {
+				r, ok := opt.ParseRuleName(arg)
+				if !ok {
+					return StatementHints{}, pgerror.Newf(pgcode.InvalidParameterValue,
+						"unknown optimizer rule %q", arg)
+				}
+				hints.EnabledRules.Add(int(r))
+			}
+
+		case "exploration_budget":
+			if len(args) != 1 {
+				return StatementHints{}, pgerror.Newf(pgcode.Syntax,
+					"optimizer hint %s requires a single duration", name)
+			}
+			budget, err := time.ParseDuration(args[0])
+			if err != nil || budget <= 0 {
+				return StatementHints{}, pgerror.Newf(pgcode.InvalidParameterValue,
+					"invalid exploration budget %q", args[0])
+			}
+			hints.Budget = budget
+
+		case "barrier":
+			if len(args) == 0 {
+				return StatementHints{}, pgerror.Newf(pgcode.Syntax,
+					"optimizer hint %s requires at least one alias", name)
+			}
+			for _, arg := range args {
+				hints.Barriers = append(hints.Barriers, strings.ToLower(arg))
+			}
+
+		default:
+			return StatementHints{}, pgerror.Newf(pgcode.Syntax, "unknown optimizer hint %q", name)
+		}
+	}
+	return hints, nil
+}
+
+// applyStatementHints applies the given hints. It must be called after the
+// rules disabled by settings have been disabled.
+func (o *Optimizer) applyStatementHints(hints StatementHints) {
+	o.hints = hints
+	o.disabledRules.DifferenceWith(hints.EnabledRules)
+	o.DisableRules(hints.DisabledRules)
+	if hints.Budget > 0 {
+		o.timeBudget = hints.Budget
+	}
+}
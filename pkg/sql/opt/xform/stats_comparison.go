@@ -0,0 +1,265 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/errors"
+)
+
+// defaultFragilityRatio is the cardinality ratio used by StatsComparison if
+// FragilityRatio is not set.
+const defaultFragilityRatio = 2
+
+// TableStatsOverride is the set of statistics that replaces the statistics of
+// a table in a StatsScenario. See Optimizer.SetTableStatistics.
+type TableStatsOverride struct {
+	// Table is the catalog table whose statistics are overridden.
+	Table cat.Table
+
+	// Stats are the statistics of the table, ordered with the most recent
+	// first. If it is empty, the table appears to have no statistics.
+	Stats []cat.TableStatistic
+}
+
+// StatsScenario is a named set of statistics under which a StatsComparison
+// plans its query. Tables that are not overridden use the statistics of the
+// catalog.
+type StatsScenario struct {
+	// Name identifies the scenario in the comparison.
+	Name string
+
+	// Overrides are the statistics of the tables that are overridden.
+	Overrides []TableStatsOverride
+}
+
+// StatsComparison plans the same query under multiple statistics scenarios,
+// and compares the plans and costs that are chosen under each. A query whose
+// plan flips between scenarios whose table cardinalities differ only slightly
+// is fragile: a small error in the estimates, or a small amount of growth in a
+// table, changes its plan. This is intended for what-if analysis, and for
+// detecting such queries before they cause plan regressions.
+type StatsComparison struct {
+	// Catalog is the catalog against which the query is built.
+	Catalog cat.Catalog
+
+	// EvalCtx is the eval context with which the optimizer is initialized.
+	EvalCtx *tree.EvalContext
+
+	// Build builds the query into the memo of the optimizer. See
+	// BenchmarkBuildFunc.
+	Build BenchmarkBuildFunc
+
+	// SQL is the query to plan.
+	SQL string
+
+	// Scenarios are the statistics under which the query is planned.
+	Scenarios []StatsScenario
+
+	// FragilityRatio is the largest ratio between the row counts of a table in
+	// two scenarios for which a difference in plans is considered fragile. If
+	// it is zero, a ratio of 2 is used.
+	FragilityRatio float64
+}
+
+// StatsComparisonResult is the outcome of a StatsComparison.
+type StatsComparisonResult struct {
+	// Scenarios contains the plan chosen under each scenario, in the order of
+	// the scenarios of the comparison.
+	Scenarios []ScenarioResult
+
+	// Plans is the number of distinct plans that were chosen.
+	Plans int
+
+	// Flips contains each pair of scenarios under which different plans were
+	// chosen.
+	Flips []PlanFlip
+}
+
+// ScenarioResult describes the plan chosen under a single StatsScenario.
+type ScenarioResult struct {
+	// Name is the name of the scenario.
+	Name string
+
+	// Plan describes the lowest cost tree.
+	Plan *PlanBaseline
+
+	// PlanNum identifies the plan among the distinct plans of the comparison.
+	// Scenarios under which the same plan is chosen have the same number, and
+	// plans are numbered from zero in the order in which they are first chosen.
+	PlanNum int
+
+	// Cost is the estimated cost of the plan.
+	Cost memo.Cost
+
+	// RowCount is the estimated number of rows returned by the query.
+	RowCount float64
+}
+
+// PlanFlip describes a pair of scenarios under which different plans were
+// chosen.
+type PlanFlip struct {
+	// A and B are the ordinal positions of the scenarios, with A < B.
+	A, B int
+
+	// CardinalityRatio is the largest ratio between the row counts of any
+	// overridden table in the two scenarios. It is 1 if the row counts of the
+	// overridden tables are the same, or unknown.
+	CardinalityRatio float64
+
+	// Fragile is true if CardinalityRatio does not exceed the fragility ratio of
+	// the comparison.
+	Fragile bool
+}
+
+// Fragile returns true if the plan flipped between any two scenarios whose
+// cardinalities differ by no more than the fragility ratio of the comparison.
+func (r *StatsComparisonResult) Fragile() bool {
+	for i := range r.Flips {
+		if r.Flips[i].Fragile {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the result with one line per scenario, followed by one line
+// per plan flip. For example:
+//
+//   scenario small: plan 0, cost 1078.03, rows 10
+//   scenario large: plan 1, cost 125049.71, rows 100000
+//   flip small -> large: cardinality ratio 10000.00
+//
+func (r *StatsComparisonResult) String() string {
+	var b strings.Builder
+	for i := range r.Scenarios {
+		s := &r.Scenarios[i]
+		fmt.Fprintf(&b, "scenario %s: plan %d, cost %.2f, rows %.0f\n", s.Name, s.PlanNum, s.Cost, s.RowCount)
+	}
+	for i := range r.Flips {
+		f := &r.Flips[i]
+		fmt.Fprintf(&b, "flip %s -> %s: cardinality ratio %.2f",
+			r.Scenarios[f.A].Name, r.Scenarios[f.B].Name, f.CardinalityRatio)
+		if f.Fragile {
+			b.WriteString(" (fragile)")
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Run plans the query under each scenario, and compares the plans. It returns
+// an error if the query fails to build or optimize under any scenario.
+func (c *StatsComparison) Run() (*StatsComparisonResult, error) {
+	res := &StatsComparisonResult{Scenarios: make([]ScenarioResult, len(c.Scenarios))}
+	var o Optimizer
+	for i := range c.Scenarios {
+		s := &c.Scenarios[i]
+		o.Init(c.EvalCtx, c.Catalog)
+		for _, override := range s.Overrides {
+			o.SetTableStatistics(override.Table, override.Stats)
+		}
+		if err := c.Build(&o, c.Catalog, c.SQL); err != nil {
+			return nil, errors.Wrapf(err, "building query under scenario %s", s.Name)
+		}
+		root, err := o.Optimize()
+		if err != nil {
+			return nil, errors.Wrapf(err, "optimizing query under scenario %s", s.Name)
+		}
+		plan, err := o.CapturePlanBaseline()
+		if err != nil {
+			return nil, err
+		}
+		rel := root.(memo.RelExpr)
+		r := &res.Scenarios[i]
+		*r = ScenarioResult{
+			Name:     s.Name,
+			Plan:     plan,
+			PlanNum:  res.Plans,
+			Cost:     rel.Cost(),
+			RowCount: rel.Relational().Stats.RowCount,
+		}
+		for j := 0; j < i; j++ {
+			if sameBaselineNode(&res.Scenarios[j].Plan.Root, &plan.Root) {
+				r.PlanNum = res.Scenarios[j].PlanNum
+				break
+			}
+		}
+		if r.PlanNum == res.Plans {
+			res.Plans++
+		}
+	}
+
+	fragilityRatio := c.FragilityRatio
+	if fragilityRatio == 0 {
+		fragilityRatio = defaultFragilityRatio
+	}
+	for a := range res.Scenarios {
+		for b := a + 1; b < len(res.Scenarios); b++ {
+			if res.Scenarios[a].PlanNum == res.Scenarios[b].PlanNum {
+				continue
+			}
+			ratio := c.cardinalityRatio(&c.Scenarios[a], &c.Scenarios[b])
+			res.Flips = append(res.Flips, PlanFlip{
+				A:                a,
+				B:                b,
+				CardinalityRatio: ratio,
+				Fragile:          ratio <= fragilityRatio,
+			})
+		}
+	}
+	return res, nil
+}
+
+// cardinalityRatio returns the largest ratio between the row counts of any
+// table that is overridden by either of the given scenarios. Tables whose row
+// count is unknown in either scenario are ignored.
+func (c *StatsComparison) cardinalityRatio(a, b *StatsScenario) float64 {
+	ratio := 1.0
+	check := func(tab cat.Table) {
+		rowsA, okA := scenarioRowCount(a, tab)
+		rowsB, okB := scenarioRowCount(b, tab)
+		if okA && okB {
+			ratio = math.Max(ratio, math.Max(rowsA, rowsB)/math.Min(rowsA, rowsB))
+		}
+	}
+	for i := range a.Overrides {
+		check(a.Overrides[i].Table)
+	}
+	for i := range b.Overrides {
+		check(b.Overrides[i].Table)
+	}
+	return ratio
+}
+
+// scenarioRowCount returns the row count of the given table under the given
+// scenario, from its most recent statistic. It returns false if the table has
+// no statistics.
+func scenarioRowCount(s *StatsScenario, tab cat.Table) (rowCount float64, ok bool) {
+	count, stat := tab.StatisticCount(), tab.Statistic
+	for i := range s.Overrides {
+		if s.Overrides[i].Table.ID() == tab.ID() {
+			stats := s.Overrides[i].Stats
+			count, stat = len(stats), func(i int) cat.TableStatistic { return stats[i] }
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	// The statistics builder treats a table as having at least one row.
+	return math.Max(float64(stat(0).RowCount()), 1), true
+}
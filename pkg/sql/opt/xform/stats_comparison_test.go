@@ -0,0 +1,116 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestStatsComparison tests that a stats comparison numbers the distinct plans
+// chosen for a query under different table statistics, and reports where the
+// plan flips from one scenario to the next.
+func TestStatsComparison(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t,
+		abcDDL,
+		xyzDDL,
+		`ALTER TABLE xyz INJECT STATISTICS '[
+			{"columns": ["x"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000},
+			{"columns": ["y"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 100000, "distinct_count": 100000}
+		]'`,
+		// The statistics of these tables are used as the statistics of abc in
+		// each scenario.
+		"CREATE TABLE small (a INT PRIMARY KEY, b INT, c STRING, INDEX (c))",
+		`ALTER TABLE small INJECT STATISTICS '[
+			{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10, "distinct_count": 10},
+			{"columns": ["c"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10, "distinct_count": 10}
+		]'`,
+		"CREATE TABLE large (a INT PRIMARY KEY, b INT, c STRING, INDEX (c))",
+		`ALTER TABLE large INJECT STATISTICS '[
+			{"columns": ["a"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10000000},
+			{"columns": ["c"], "created_at": "2018-01-01 1:00:00.00000+00:00", "row_count": 10000000, "distinct_count": 10}
+		]'`,
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	abc := catalog.Table(tree.NewUnqualifiedTableName("abc"))
+	scenario := func(name, source string) xform.StatsScenario {
+		tab := catalog.Table(tree.NewUnqualifiedTableName(tree.Name(source)))
+		var stats []cat.TableStatistic
+		for i, n := 0, tab.StatisticCount(); i < n; i++ {
+			stats = append(stats, tab.Statistic(i))
+		}
+		return xform.StatsScenario{
+			Name:      name,
+			Overrides: []xform.TableStatsOverride{{Table: abc, Stats: stats}},
+		}
+	}
+
+	c := xform.StatsComparison{
+		Catalog: catalog,
+		EvalCtx: &evalCtx,
+		Build:   testutils.BuildInitializedQuery,
+		SQL:     "SELECT * FROM abc JOIN xyz ON b = y WHERE c = 'foo'",
+		Scenarios: []xform.StatsScenario{
+			scenario("small", "small"),
+			scenario("large", "large"),
+			scenario("small-again", "small"),
+		},
+	}
+	res, err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Scenarios) != len(c.Scenarios) {
+		t.Fatalf("expected %d scenarios, got %d", len(c.Scenarios), len(res.Scenarios))
+	}
+
+	// The same statistics produce the same plan, and a table that is a million
+	// times larger produces a different plan.
+	small, large, again := res.Scenarios[0], res.Scenarios[1], res.Scenarios[2]
+	if res.Plans != 2 || small.PlanNum != 0 || large.PlanNum != 1 || again.PlanNum != 0 {
+		t.Fatalf("expected the large scenario to flip the plan:\n%s", res)
+	}
+	if small.Cost != again.Cost || small.Cost >= large.Cost {
+		t.Errorf("unexpected costs:\n%s", res)
+	}
+	if len(res.Flips) != 2 {
+		t.Fatalf("expected 2 flips, got:\n%s", res)
+	}
+	for _, f := range res.Flips {
+		if f.CardinalityRatio != 1000000 || f.Fragile {
+			t.Errorf("expected a cardinality ratio of 1000000 that is not fragile, got:\n%s", res)
+		}
+	}
+	if res.Fragile() {
+		t.Errorf("expected the query not to be fragile:\n%s", res)
+	}
+
+	// With a large enough fragility ratio, the flips are fragile.
+	c.FragilityRatio = 10000000
+	if res, err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Fragile() || !strings.Contains(res.String(), "(fragile)") {
+		t.Errorf("expected the query to be fragile:\n%s", res)
+	}
+}
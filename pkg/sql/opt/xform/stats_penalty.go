@@ -0,0 +1,184 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// StatsUncertaintyPenalty describes how the default coster penalizes
+// expressions whose inputs have row counts that were estimated from
+// untrustworthy statistics. It can be set via
+// Optimizer.SetStatsUncertaintyPenalty.
+//
+// The row count of an expression is untrustworthy if it is derived from a
+// table that has no statistics, or whose statistics are older than StaleAge,
+// or if it is filtered on a column that has no histogram. The penalty applies
+// to each expression that processes the rows of such an input, rather than to
+// the input itself. For example, a hash join whose build side is a scan of a
+// table with stale statistics is penalized, while a lookup join into the same
+// table is not, since the cost of the lookup join does not depend on the
+// number of rows in the table. This biases the optimizer toward plans whose
+// cost degrades gracefully if the estimates are wrong.
+type StatsUncertaintyPenalty struct {
+	// Penalty is the fraction of its cost by which the cost of an expression is
+	// increased if any of its inputs has an untrustworthy row count. The
+	// penalty is disabled if Penalty is zero.
+	Penalty float64
+
+	// StaleAge is the age beyond which the statistics of a table are no longer
+	// trusted. If it is zero, the age of statistics is not considered.
+	StaleAge time.Duration
+}
+
+// SetStatsUncertaintyPenalty sets the penalty that the default coster applies
+// to expressions whose inputs have untrustworthy row counts, replacing any
+// previous penalty. See StatsUncertaintyPenalty. It must be called before
+// Optimize.
+func (o *Optimizer) SetStatsUncertaintyPenalty(penalty StatsUncertaintyPenalty) {
+	if penalty.Penalty < 0 || penalty.StaleAge < 0 {
+		panic(errors.AssertionFailedf(
+			"negative stats uncertainty penalty: %v, %s", penalty.Penalty, penalty.StaleAge,
+		))
+	}
+	o.defaultCoster.setStatsPenalty(penalty)
+}
+
+// setStatsPenalty sets the stats uncertainty penalty applied by the coster,
+// replacing any previous penalty.
+func (c *coster) setStatsPenalty(penalty StatsUncertaintyPenalty) {
+	c.statsPenalty = penalty
+	c.statsPenaltyTime = timeutil.Now()
+	c.untrusted = nil
+}
+
+// statsPenaltyMultiplier returns the factor by which the cost of the given
+// candidate is multiplied because the row counts of its inputs, or of the
+// candidate itself if it has no inputs, are untrustworthy.
+func (c *coster) statsPenaltyMultiplier(candidate memo.RelExpr) float64 {
+	if c.statsPenalty.Penalty == 0 {
+		return 1
+	}
+	untrusted := false
+	found := false
+	for i, n := 0, candidate.ChildCount(); i < n; i++ {
+		if child, ok := candidate.Child(i).(memo.RelExpr); ok {
+			found = true
+			untrusted = untrusted || c.untrustedRowCount(child)
+		}
+	}
+	if !found {
+		untrusted = c.untrustedRowCount(candidate)
+	}
+	if !untrusted {
+		return 1
+	}
+	return 1 + c.statsPenalty.Penalty
+}
+
+// untrustedRowCount returns true if the estimated row count of the given
+// expression is derived from untrustworthy statistics. Like the row count
+// itself, this is a logical property, so it is the same for every expression
+// in a memo group.
+func (c *coster) untrustedRowCount(e memo.RelExpr) bool {
+	e = e.FirstExpr()
+	if untrusted, ok := c.untrusted[e]; ok {
+		return untrusted
+	}
+
+	var untrusted bool
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		untrusted = !c.trustedTableStats(t.Table)
+		if !untrusted && t.Constraint != nil {
+			for i, n := 0, t.Constraint.Columns.Count(); i < n; i++ {
+				if !c.hasHistogram(t.Constraint.Columns.Get(i).ID()) {
+					untrusted = true
+					break
+				}
+			}
+		}
+
+	case *memo.SelectExpr:
+		untrusted = c.untrustedRowCount(t.Input)
+		if !untrusted {
+			t.Filters.OuterCols().ForEach(func(col opt.ColumnID) {
+				if !c.hasHistogram(col) {
+					untrusted = true
+				}
+			})
+		}
+
+	default:
+		for i, n := 0, e.ChildCount(); i < n && !untrusted; i++ {
+			if child, ok := e.Child(i).(memo.RelExpr); ok {
+				untrusted = c.untrustedRowCount(child)
+			}
+		}
+	}
+
+	if c.untrusted == nil {
+		c.untrusted = make(map[memo.RelExpr]bool)
+	}
+	c.untrusted[e] = untrusted
+	return untrusted
+}
+
+// trustedTableStats returns true if the given table has statistics, and the
+// most recent of them are no older than the StaleAge of the penalty.
+func (c *coster) trustedTableStats(tabID opt.TableID) bool {
+	tab := c.mem.Metadata().Table(tabID)
+	if tab.IsVirtualTable() {
+		// Virtual tables never have statistics, and are usually small.
+		return true
+	}
+	provider := c.mem.StatsProvider()
+	if provider.StatisticCount(tab) == 0 {
+		return false
+	}
+	if c.statsPenalty.StaleAge > 0 {
+		createdAt := provider.Statistic(tab, 0).CreatedAt()
+		if c.statsPenaltyTime.Sub(createdAt) > c.statsPenalty.StaleAge {
+			return false
+		}
+	}
+	return true
+}
+
+// hasHistogram returns true if the given column is a column of a table with a
+// histogram, or is not a table column. The estimated selectivity of a filter on
+// a table column without a histogram is based on its distinct count alone, or
+// on a default selectivity.
+func (c *coster) hasHistogram(col opt.ColumnID) bool {
+	md := c.mem.Metadata()
+	tabID := md.ColumnMeta(col).Table
+	if tabID == 0 {
+		return true
+	}
+	tab := md.Table(tabID)
+	if tab.IsVirtualTable() {
+		return true
+	}
+	ord := tabID.ColumnOrdinal(col)
+	provider := c.mem.StatsProvider()
+	for i, n := 0, provider.StatisticCount(tab); i < n; i++ {
+		stat := provider.Statistic(tab, i)
+		if stat.ColumnCount() == 1 && stat.ColumnOrdinal(0) == ord && len(stat.Histogram()) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import "github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+
+// SetTableStatistics overrides the statistics of the given table with the
+// given statistics, which must be ordered with the most recent first, for the
+// rest of this optimization. The catalog is not modified, and the statistics
+// of other tables are unaffected. This allows tests and tools such as the index
+// advisor to determine which plan would be chosen if the table had a different
+// number of rows or a different distribution of values.
+//
+// Statistics are read as the logical properties of the expressions in the memo
+// are derived, so SetTableStatistics must be called after Init and before the
+// query is built. Since a memo built with overridden statistics does not
+// reflect the catalog, it must not be cached and reused for other executions.
+// An empty slice of statistics makes the table appear to have no statistics.
+func (o *Optimizer) SetTableStatistics(tab cat.Table, stats []cat.TableStatistic) {
+	p, ok := o.mem.StatsProvider().(*overrideStatsProvider)
+	if !ok {
+		p = &overrideStatsProvider{
+			inner:     o.mem.StatsProvider(),
+			overrides: make(map[cat.StableID][]cat.TableStatistic),
+		}
+		o.mem.SetStatsProvider(p)
+	}
+	p.overrides[tab.ID()] = stats
+}
+
+// overrideStatsProvider is a cat.StatsProvider that supplies the statistics
+// set via SetTableStatistics in place of those supplied by the inner provider.
+type overrideStatsProvider struct {
+	inner cat.StatsProvider
+
+	// overrides contains the statistics of each overridden table, indexed by
+	// the table's ID.
+	overrides map[cat.StableID][]cat.TableStatistic
+}
+
+var _ cat.StatsProvider = &overrideStatsProvider{}
+
+// StatisticCount is part of the cat.StatsProvider interface.
+func (p *overrideStatsProvider) StatisticCount(tab cat.Table) int {
+	if stats, ok := p.overrides[tab.ID()]; ok {
+		return len(stats)
+	}
+	return p.inner.StatisticCount(tab)
+}
+
+// Statistic is part of the cat.StatsProvider interface.
+func (p *overrideStatsProvider) Statistic(tab cat.Table, i int) cat.TableStatistic {
+	if stats, ok := p.overrides[tab.ID()]; ok {
+		return stats[i]
+	}
+	return p.inner.Statistic(tab, i)
+}
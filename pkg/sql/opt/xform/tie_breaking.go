@@ -0,0 +1,160 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+)
+
+// CostTie describes a candidate whose estimated cost was equal to the cost of
+// the best expression of its group. It is passed to the callback set via
+// NotifyOnCostTie.
+type CostTie struct {
+	// Group is the group whose best expression was being chosen.
+	Group memo.RelExpr
+
+	// Required is the set of physical properties required of the group.
+	Required *physical.Required
+
+	// Cost is the estimated cost of both expressions.
+	Cost memo.Cost
+
+	// Winner is the expression that became, or remained, the best expression
+	// of the group, and Loser is the expression that did not.
+	Winner, Loser memo.RelExpr
+}
+
+// CostTieFunc defines the callback function for the NotifyOnCostTie event
+// supported by the optimizer.
+type CostTieFunc func(tie CostTie)
+
+// NotifyOnCostTie sets a callback function which is invoked each time a
+// candidate has the same estimated cost as the best expression of its group,
+// and the tie is broken. The callback must not modify the optimizer state. If
+// costTie is nil, then no further notifications are sent.
+func (o *Optimizer) NotifyOnCostTie(costTie CostTieFunc) {
+	o.costTie = costTie
+}
+
+// breakTie returns true if the given candidate, whose estimated cost is equal
+// to the cost of the best expression of the given group state, should replace
+// that expression. Otherwise, the choice between the two would depend on the
+// order in which they were added to the memo, which can vary with the order
+// in which rules are applied and with the iteration order of maps, and so
+// differ between runs and between nodes. Instead, the expression with the
+// lower tie-break key wins. Expressions with the same key are equivalent for
+// the purposes of the plan, so the best expression is kept.
+//
+// The key of the best expression is memoized in the group state. It depends on
+// the best expressions of the children, which only change when the group is
+// optimized again in a later pass, at which point the memoized key is
+// discarded.
+func (o *Optimizer) breakTie(state *groupState, candidate memo.RelExpr) bool {
+	o.metrics.Ties++
+	if state.tieBreakExpr != state.best {
+		state.tieBreakExpr = state.best
+		state.tieBreakKey = o.tieBreakKey(state.best, state.required)
+	}
+	bestKey := state.tieBreakKey
+	candidateKey := o.tieBreakKey(candidate, state.required)
+	if candidateKey == bestKey {
+		return false
+	}
+	wins := candidateKey < bestKey
+	if wins {
+		state.tieBreakExpr = candidate
+		state.tieBreakKey = candidateKey
+	}
+	if o.costTie != nil {
+		tie := CostTie{
+			Group:    o.optimizing,
+			Required: state.required,
+			Cost:     state.cost,
+			Winner:   state.best,
+			Loser:    candidate,
+		}
+		if wins {
+			tie.Winner, tie.Loser = candidate, state.best
+		}
+		o.costTie(tie)
+	}
+	return wins
+}
+
+// tieBreakKey returns a key that describes the given expression, which
+// provides the given required properties, together with the best expressions
+// of its relational children. The key is made up of the operators and
+// formatted private values of the expressions, and so does not depend on the
+// position of the expressions in their groups, or on their addresses.
+func (o *Optimizer) tieBreakKey(e memo.RelExpr, required *physical.Required) string {
+	var buf bytes.Buffer
+	o.writeTieBreakKey(&buf, e, required)
+	return buf.String()
+}
+
+// writeTieBreakKey writes the key of the given expression to buf. See
+// tieBreakKey.
+func (o *Optimizer) writeTieBreakKey(
+	buf *bytes.Buffer, e memo.RelExpr, required *physical.Required,
+) {
+	buf.WriteString(e.Op().String())
+	if private := e.Private(); private != nil {
+		buf.WriteByte('[')
+		f := memo.MakeExprFmtCtxBuffer(buf, memo.ExprFmtHideAll, o.mem, nil /* catalog */)
+		memo.FormatPrivate(&f, private, required)
+		buf.WriteByte(']')
+	}
+	buf.WriteByte('(')
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		child, ok := e.Child(i).(memo.RelExpr)
+		if !ok {
+			continue
+		}
+		buf.WriteByte(' ')
+		childProps := BuildChildPhysicalProps(o.mem, e, i, required)
+		childState := o.lookupOptState(child.FirstExpr(), childProps)
+		if childState == nil || childState.best == nil {
+			buf.WriteString(child.Op().String())
+			continue
+		}
+		o.writeTieBreakKey(buf, childState.best, childProps)
+	}
+	buf.WriteByte(')')
+}
+
+// nearTieKey identifies a candidate for the best expression of a group state
+// across passes over the group, when near-tie randomization is enabled (see
+// chooseNearTie). A member of the group is identified by its address. An
+// enforcer is constructed anew on each pass, so it is identified by its input
+// and its operator and formatted private.
+type nearTieKey struct {
+	expr     memo.RelExpr
+	enforcer string
+}
+
+// nearTieKeyOf returns the nearTieKey of the given candidate, which provides
+// the given required properties.
+func (o *Optimizer) nearTieKeyOf(e memo.RelExpr, required *physical.Required) nearTieKey {
+	if !opt.IsEnforcerOp(e) {
+		return nearTieKey{expr: e}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(e.Op().String())
+	if private := e.Private(); private != nil {
+		f := memo.MakeExprFmtCtxBuffer(&buf, memo.ExprFmtHideAll, o.mem, nil /* catalog */)
+		memo.FormatPrivate(&f, private, required)
+	}
+	return nearTieKey{expr: e.Child(0).(memo.RelExpr), enforcer: buf.String()}
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/errors"
+)
+
+// topKCandidate is one of the lowest cost candidates retained for a group and
+// set of required properties when OptimizeTopK is used.
+type topKCandidate struct {
+	// expr is either a member of the group, or an enforcer whose input is a
+	// member of the group.
+	expr memo.RelExpr
+
+	// cost is the cost of expr, including the cost of the lowest cost
+	// expression for each of its children.
+	cost memo.Cost
+}
+
+// OptimizeTopK optimizes the memo in the same way as Optimize, but also
+// retains the k lowest cost candidates for each group and set of required
+// properties, rather than only the lowest cost candidate. Once optimization is
+// complete, it returns up to k of the lowest cost complete plans, in order of
+// increasing cost. The first plan is the plan chosen by the optimizer.
+//
+// Since the cost of a candidate is only retained once it is one of the k
+// lowest cost candidates in its group, the plans that are returned are not
+// guaranteed to be the k lowest cost plans in the entire search space, but
+// they are the lowest cost plans that can be formed from the retained
+// candidates. This is intended for analyzing the robustness of plans, and for
+// understanding how close the runner-up plans were to the chosen plan.
+func (o *Optimizer) OptimizeTopK(k int) ([]EnumeratedPlan, error) {
+	if k < 1 {
+		return nil, errors.AssertionFailedf("top k must be at least 1: %d", k)
+	}
+	o.topK = k
+	if _, err := o.Optimize(); err != nil {
+		return nil, err
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, errors.AssertionFailedf("can only enumerate plans for relational root expressions")
+	}
+
+	e := topKEnumerator{o: o, k: k, plans: make(map[groupStateKey][]*PlanNode)}
+	nodes := e.enumerateGroup(root, o.mem.RootProps())
+
+	plans := make([]EnumeratedPlan, 0, len(nodes))
+	seen := make(map[string]struct{}, len(nodes))
+	for _, n := range nodes {
+		fp := n.fingerprint()
+		if _, ok := seen[fp]; ok {
+			continue
+		}
+		seen[fp] = struct{}{}
+		plans = append(plans, EnumeratedPlan{Root: n, Cost: n.Cost, Fingerprint: fp})
+	}
+	return plans, nil
+}
+
+// recordTopK records the cost of a candidate for the given group state,
+// retaining only the o.topK lowest cost candidates. Members are costed again
+// each time the costs of their children are lowered, so a candidate which has
+// already been recorded has its cost replaced.
+func (o *Optimizer) recordTopK(state *groupState, candidate memo.RelExpr, cost memo.Cost) {
+	found := false
+	for i := range state.topK {
+		if sameCandidate(state.topK[i].expr, candidate) {
+			state.topK[i] = topKCandidate{expr: candidate, cost: cost}
+			found = true
+			break
+		}
+	}
+	if !found {
+		state.topK = append(state.topK, topKCandidate{expr: candidate, cost: cost})
+	}
+	sort.SliceStable(state.topK, func(i, j int) bool {
+		return state.topK[i].cost.Less(state.topK[j].cost)
+	})
+	if len(state.topK) > o.topK {
+		state.topK = state.topK[:o.topK]
+	}
+}
+
+// sameCandidate returns true if the given candidates are the same memo member,
+// or are equivalent enforcers. A new enforcer expression is constructed each
+// time an enforcer is costed, so enforcers are compared by their properties.
+func sameCandidate(a, b memo.RelExpr) bool {
+	if a == b {
+		return true
+	}
+	switch t := a.(type) {
+	case *memo.SortExpr:
+		u, ok := b.(*memo.SortExpr)
+		return ok && t.InputOrdering.Equals(&u.InputOrdering)
+	case *memo.TopKSortExpr:
+		u, ok := b.(*memo.TopKSortExpr)
+		return ok && t.K == u.K
+	case *memo.DistributeExpr:
+		_, ok := b.(*memo.DistributeExpr)
+		return ok
+	case *memo.GatherExpr:
+		u, ok := b.(*memo.GatherExpr)
+		return ok && t.InputParallelism == u.InputParallelism
+	}
+	return false
+}
+
+// topKEnumerator combines the candidates retained for each group into complete
+// plans.
+type topKEnumerator struct {
+	o *Optimizer
+	k int
+
+	// plans caches the plans for each group and set of required properties,
+	// since a group can be referenced by many parents.
+	plans map[groupStateKey][]*PlanNode
+}
+
+// enumerateGroup returns up to k of the lowest cost plans for the given group
+// and required properties, sorted by increasing cost.
+func (e *topKEnumerator) enumerateGroup(grp memo.RelExpr, required *physical.Required) []*PlanNode {
+	key := groupStateKey{group: grp.FirstExpr(), required: required}
+	if plans, ok := e.plans[key]; ok {
+		return plans
+	}
+	state := e.o.lookupOptState(key.group, required)
+	if state == nil {
+		return nil
+	}
+
+	var res []*PlanNode
+	for i := range state.topK {
+		res = append(res, e.enumerateCandidate(&state.topK[i], required)...)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Cost.Less(res[j].Cost) })
+	if len(res) > e.k {
+		res = res[:e.k]
+	}
+	e.plans[key] = res
+	return res
+}
+
+// enumerateCandidate returns up to k of the lowest cost plans rooted at the
+// given candidate.
+func (e *topKEnumerator) enumerateCandidate(
+	candidate *topKCandidate, required *physical.Required,
+) []*PlanNode {
+	// The cost of the candidate includes the lowest cost of each of its
+	// relational children. Subtract them, so that the cost of the alternatives
+	// for each child can be added instead. The costs of subqueries nested in
+	// scalar children are left as-is.
+	ownCost := candidate.cost
+	var childPlans [][]*PlanNode
+	expr := candidate.expr
+	for i, n := 0, expr.ChildCount(); i < n; i++ {
+		child, ok := expr.Child(i).(memo.RelExpr)
+		if !ok {
+			continue
+		}
+		childProps := BuildChildPhysicalProps(e.o.mem, expr, i, required)
+		childState := e.o.lookupOptState(child.FirstExpr(), childProps)
+		plans := e.enumerateGroup(child, childProps)
+		if childState == nil || len(plans) == 0 {
+			return nil
+		}
+		ownCost -= childState.cost
+		childPlans = append(childPlans, plans)
+	}
+
+	// Combine the alternatives for each child, retaining the k lowest cost
+	// combinations after each child is added.
+	type partial struct {
+		cost     memo.Cost
+		children []*PlanNode
+	}
+	partials := []partial{{cost: ownCost}}
+	for _, plans := range childPlans {
+		next := make([]partial, 0, len(partials)*len(plans))
+		for _, p := range partials {
+			for _, child := range plans {
+				children := make([]*PlanNode, len(p.children), len(p.children)+1)
+				copy(children, p.children)
+				next = append(next, partial{cost: p.cost + child.Cost, children: append(children, child)})
+			}
+		}
+		sort.SliceStable(next, func(i, j int) bool { return next[i].cost.Less(next[j].cost) })
+		if len(next) > e.k {
+			next = next[:e.k]
+		}
+		partials = next
+	}
+
+	res := make([]*PlanNode, len(partials))
+	for i, p := range partials {
+		res[i] = &PlanNode{Expr: expr, Required: required, Cost: p.cost, Children: p.children}
+	}
+	return res
+}
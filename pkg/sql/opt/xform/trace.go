@@ -0,0 +1,368 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// TraceEvent records a single application of an optimization rule.
+type TraceEvent struct {
+	// Rule is the name of the rule that was applied.
+	Rule opt.RuleName
+
+	// Time is the time at which the rule was applied.
+	Time time.Time
+
+	// Source is the expression matched by the rule. It is nil for normalization
+	// rules, which replace the expression they match rather than adding to its
+	// group.
+	Source opt.Expr
+
+	// Added contains the expressions constructed by the rule. For exploration
+	// rules, these are the expressions added to the group of Source.
+	Added []opt.Expr
+
+	// CostBefore is the lowest cost of the group that was being optimized when
+	// an exploration rule was applied, at the time it was applied. It is zero
+	// for normalization rules, and if the group had not yet been costed.
+	CostBefore memo.Cost
+
+	// CostAfter is the lowest cost of the same group once optimization is
+	// complete. It is zero for normalization rules.
+	CostAfter memo.Cost
+
+	// AddedCost is the lowest cost of any of the expressions added by an
+	// exploration rule, with respect to the properties required of the group
+	// that was being optimized, once optimization is complete. Comparing it with
+	// CostBefore attributes a change in the cost of the group to the rule. It is
+	// zero for normalization rules, and if none of the added expressions was
+	// costed, for example because it was pruned by SetCostBoundPruning.
+	AddedCost memo.Cost
+
+	// state is the state of the group that was being optimized when the rule
+	// was applied, which is used to fill in CostAfter.
+	state *groupState
+}
+
+// EnforcerDecision records the enforcers that were costed for a group with
+// respect to a set of required properties, along with the lowest cost
+// expression that was chosen, which is either one of the enforcers or a member
+// of the group that provides the properties natively.
+type EnforcerDecision struct {
+	// Group is the first expression of the group.
+	Group memo.RelExpr
+
+	// Required is the set of properties that the enforcers provide.
+	Required *physical.Required
+
+	// Candidates contains the enforcers that were costed, in the order in which
+	// they were first tried. Enforcers that were pruned before they were
+	// costed, e.g. because their input already cost more than the best
+	// expression (see SetCostBoundPruning), are not included.
+	Candidates []EnforcerCandidate
+
+	// NativeCost is the lowest cost of any member of the group that provides
+	// the required properties without an enforcer. It is zero if no such
+	// member was costed.
+	NativeCost memo.Cost
+
+	// Best is the lowest cost expression that was chosen for the group. It is
+	// an enforcer if any of the candidates was chosen, and a member of the
+	// group otherwise.
+	Best memo.RelExpr
+}
+
+// NativeChosen returns true if the lowest cost expression of the group provides
+// the required properties natively, rather than with one of the enforcers.
+func (d *EnforcerDecision) NativeChosen() bool {
+	if d.Best == nil {
+		return false
+	}
+	for i := range d.Candidates {
+		if d.Candidates[i].Chosen {
+			return false
+		}
+	}
+	return true
+}
+
+// EnforcerCandidate is an enforcer that was costed on top of a member of a
+// group. See EnforcerDecision.
+type EnforcerCandidate struct {
+	// Enforcer is the enforcer expression, such as a Sort whose InputOrdering
+	// is a prefix of the required ordering.
+	Enforcer memo.RelExpr
+
+	// Cost is the lowest cost of the enforcer, including the cost of its
+	// input.
+	Cost memo.Cost
+
+	// Chosen is true if the enforcer is the lowest cost expression of the
+	// group.
+	Chosen bool
+}
+
+// OptimizerTrace is an ordered record of the rules applied during the
+// construction and optimization of a memo. See Optimizer.EnableTracing.
+type OptimizerTrace struct {
+	// Start is the time at which tracing was enabled.
+	Start time.Time
+
+	// Events contains the rule applications in the order they occurred.
+	Events []TraceEvent
+
+	// Enforcers contains a decision for each group and set of required
+	// properties for which an enforcer was costed, in the order in which the
+	// first enforcer was costed.
+	Enforcers []EnforcerDecision
+}
+
+// String formats the trace as a report with one line per rule application,
+// followed by one line per enforcer decision, e.g.:
+//
+//   0.012ms GenerateIndexScans: select -> [scan] cost 1064.04 -> 24.57 (added 24.57)
+//   enforce scan [ordering: +3,+2]: native 1094.04, sort 1289.31, sort(+3) 1108.47 (chosen)
+//
+func (t *OptimizerTrace) String() string {
+	var buf bytes.Buffer
+	for i := range t.Events {
+		ev := &t.Events[i]
+		elapsed := ev.Time.Sub(t.Start)
+		fmt.Fprintf(&buf, "%.3fms %s:", float64(elapsed)/float64(time.Millisecond), ev.Rule)
+		if ev.Source != nil {
+			fmt.Fprintf(&buf, " %s ->", ev.Source.Op())
+		}
+		buf.WriteString(" [")
+		for j, e := range ev.Added {
+			if j > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(e.Op().String())
+		}
+		buf.WriteByte(']')
+		if ev.state != nil {
+			fmt.Fprintf(&buf, " cost %.2f -> %.2f", ev.CostBefore, ev.CostAfter)
+			if ev.AddedCost != 0 {
+				fmt.Fprintf(&buf, " (added %.2f)", ev.AddedCost)
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	for i := range t.Enforcers {
+		d := &t.Enforcers[i]
+		fmt.Fprintf(&buf, "enforce %s %s:", d.Group.Op(), d.Required)
+		if d.NativeCost != 0 {
+			fmt.Fprintf(&buf, " native %.2f", d.NativeCost)
+			if d.NativeChosen() {
+				buf.WriteString(" (chosen)")
+			}
+			buf.WriteByte(',')
+		}
+		for j := range d.Candidates {
+			c := &d.Candidates[j]
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(" " + c.Enforcer.Op().String())
+			if sort, ok := c.Enforcer.(*memo.SortExpr); ok && !sort.InputOrdering.Any() {
+				fmt.Fprintf(&buf, "(%s)", sort.InputOrdering.String())
+			}
+			fmt.Fprintf(&buf, " %.2f", c.Cost)
+			if c.Chosen {
+				buf.WriteString(" (chosen)")
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// tracer records an OptimizerTrace.
+type tracer struct {
+	trace OptimizerTrace
+
+	// exploring is the state of the group that is currently being explored by
+	// the optimizer, or nil if no group is being explored.
+	exploring *groupState
+
+	// costs contains the lowest cost computed for each candidate expression of
+	// each group state. It is used to fill in AddedCost.
+	costs map[tracedCandidate]memo.Cost
+
+	// enforced contains the group states for which an enforcer was costed,
+	// along with their groups. The enforcers are retained by the states (see
+	// groupState.tracedEnforcers), and are used to fill in Enforcers.
+	enforced []groupStateKey
+	states   []*groupState
+}
+
+// tracedCandidate identifies an expression that was costed with respect to the
+// required properties of a group state.
+type tracedCandidate struct {
+	state *groupState
+	expr  memo.RelExpr
+}
+
+// recordApplied records the application of a rule. The source is non-nil only
+// for exploration rules, in which case target is the first of the expressions
+// that the rule added to the memo.
+func (t *tracer) recordApplied(ruleName opt.RuleName, source, target opt.Expr) {
+	ev := TraceEvent{Rule: ruleName, Time: timeutil.Now(), Source: source}
+	if rel, ok := target.(memo.RelExpr); ok && source != nil {
+		// The expressions added by an exploration rule are at the end of the
+		// group, starting with the target.
+		for ; rel != nil; rel = rel.NextExpr() {
+			ev.Added = append(ev.Added, rel)
+		}
+	} else if target != nil {
+		ev.Added = []opt.Expr{target}
+	}
+	if source != nil && t.exploring != nil {
+		ev.state = t.exploring
+		ev.CostBefore = t.exploring.cost
+	}
+	t.trace.Events = append(t.trace.Events, ev)
+}
+
+// recordCost records the cost of a candidate expression with respect to the
+// required properties of the given group state.
+func (t *tracer) recordCost(state *groupState, candidate memo.RelExpr, cost memo.Cost) {
+	if t.costs == nil {
+		t.costs = make(map[tracedCandidate]memo.Cost)
+	}
+	key := tracedCandidate{state: state, expr: candidate}
+	if existing, ok := t.costs[key]; !ok || cost < existing {
+		t.costs[key] = cost
+	}
+}
+
+// recordEnforcer records an enforcer that is about to be costed on top of the
+// given member of a group, with respect to the required properties of the
+// given group state. Its cost is recorded by recordCost.
+func (t *tracer) recordEnforcer(state *groupState, member, enforcer memo.RelExpr) {
+	if len(state.tracedEnforcers) == 0 {
+		t.enforced = append(t.enforced, groupStateKey{group: member.FirstExpr(), required: state.required})
+		t.states = append(t.states, state)
+	}
+	state.tracedEnforcers = append(state.tracedEnforcers, enforcer)
+}
+
+// finish fills in the final costs of the groups that were explored, and of the
+// expressions that were added to them, and the enforcer decisions.
+func (t *tracer) finish() {
+	t.exploring = nil
+	for i := range t.trace.Events {
+		ev := &t.trace.Events[i]
+		if ev.state == nil {
+			continue
+		}
+		ev.CostAfter = ev.state.cost
+		for _, e := range ev.Added {
+			rel, ok := e.(memo.RelExpr)
+			if !ok {
+				continue
+			}
+			cost, ok := t.costs[tracedCandidate{state: ev.state, expr: rel}]
+			if ok && (ev.AddedCost == 0 || cost < ev.AddedCost) {
+				ev.AddedCost = cost
+			}
+		}
+	}
+	t.finishEnforcers()
+}
+
+// finishEnforcers fills in the enforcer decisions of the trace. An enforcer
+// can be tried again if its group is optimized in multiple passes, in which
+// case only the cheapest instance with the same input requirements is
+// reported.
+func (t *tracer) finishEnforcers() {
+	// Find the lowest cost of the members of each group that was enforced,
+	// i.e. of the candidates that are not enforcers.
+	isEnforcer := make(map[memo.RelExpr]bool)
+	for _, state := range t.states {
+		for _, e := range state.tracedEnforcers {
+			isEnforcer[e] = true
+		}
+	}
+	native := make(map[*groupState]memo.Cost, len(t.states))
+	for key, cost := range t.costs {
+		if len(key.state.tracedEnforcers) == 0 || isEnforcer[key.expr] {
+			continue
+		}
+		if existing, ok := native[key.state]; !ok || cost < existing {
+			native[key.state] = cost
+		}
+	}
+
+	t.trace.Enforcers = make([]EnforcerDecision, 0, len(t.states))
+	for i, state := range t.states {
+		d := EnforcerDecision{
+			Group:      t.enforced[i].group,
+			Required:   t.enforced[i].required,
+			NativeCost: native[state],
+			Best:       state.best,
+		}
+		for _, e := range state.tracedEnforcers {
+			cost, ok := t.costs[tracedCandidate{state: state, expr: e}]
+			if !ok {
+				continue
+			}
+			c := EnforcerCandidate{Enforcer: e, Cost: cost, Chosen: e == state.best}
+			if j := findEnforcerCandidate(d.Candidates, e); j >= 0 {
+				if c.Chosen || (!d.Candidates[j].Chosen && c.Cost < d.Candidates[j].Cost) {
+					d.Candidates[j] = c
+				}
+				continue
+			}
+			d.Candidates = append(d.Candidates, c)
+		}
+		t.trace.Enforcers = append(t.trace.Enforcers, d)
+		state.tracedEnforcers = nil
+	}
+	t.enforced, t.states = nil, nil
+}
+
+// findEnforcerCandidate returns the index of the candidate whose enforcer has
+// the same operator and input requirements as the given enforcer, or -1 if
+// there is none. The candidates of a decision all enforce properties on top of
+// the same group, so their inputs are not compared.
+func findEnforcerCandidate(candidates []EnforcerCandidate, e memo.RelExpr) int {
+	for i := range candidates {
+		c := candidates[i].Enforcer
+		if c.Op() != e.Op() {
+			continue
+		}
+		switch t := e.(type) {
+		case *memo.SortExpr:
+			if !t.InputOrdering.Equals(&c.(*memo.SortExpr).InputOrdering) {
+				continue
+			}
+		case *memo.TopKSortExpr:
+			if t.K != c.(*memo.TopKSortExpr).K {
+				continue
+			}
+		case *memo.GatherExpr:
+			if t.InputParallelism != c.(*memo.GatherExpr).InputParallelism {
+				continue
+			}
+		}
+		return i
+	}
+	return -1
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
+	"github.com/cockroachdb/cockroach/pkg/util/errorutil"
+	"github.com/cockroachdb/errors"
+)
+
+// PlanCheck identifies one of the validation passes run by ValidatePlan.
+type PlanCheck uint8
+
+const (
+	// InvariantCheck verifies that the logical properties of each expression
+	// are internally consistent.
+	InvariantCheck PlanCheck = iota
+
+	// ProvidedPropsCheck verifies that the physical properties provided by
+	// each expression are consistent with the properties required of it.
+	ProvidedPropsCheck
+
+	// CostCheck verifies that the cost of each expression is a finite,
+	// non-negative number that is no less than the cost of its inputs.
+	CostCheck
+)
+
+func (c PlanCheck) String() string {
+	switch c {
+	case InvariantCheck:
+		return "invariant"
+	case ProvidedPropsCheck:
+		return "provided-props"
+	case CostCheck:
+		return "cost"
+	default:
+		return fmt.Sprintf("PlanCheck(%d)", c)
+	}
+}
+
+// PlanViolation describes a single problem found by ValidatePlan.
+type PlanViolation struct {
+	// Check is the validation pass which found the violation.
+	Check PlanCheck
+
+	// Expr is the expression in the lowest cost tree that violates the check.
+	// It is the lowest cost member of its memo group.
+	Expr memo.RelExpr
+
+	// Path is the sequence of child ordinals that leads from the root of the
+	// plan to Expr. It is empty if Expr is the root.
+	Path []int
+
+	// Message describes the violation.
+	Message string
+}
+
+func (v PlanViolation) String() string {
+	return fmt.Sprintf("%s check failed for %s at %v: %s", v.Check, v.Expr.Op(), v.Path, v.Message)
+}
+
+// ValidatePlan runs a series of sanity checks over the lowest cost tree rooted
+// at the given expression, and returns a list of the violations that it finds.
+// It should be called after Optimize, with the expression returned by
+// Optimize. The checks include:
+//
+//   1. Invariant checks on the logical properties of each expression. More
+//      thorough checks are run in test builds.
+//   2. Provided physical property checks, which ensure that each expression
+//      provides an ordering that satisfies the ordering required of it.
+//   3. Cost sanity checks, which ensure that costs are finite, non-negative,
+//      and include the costs of their inputs.
+//
+// ValidatePlan is intended to catch planner corruption bugs before a plan is
+// executed. It is run for every query when the OptimizerValidatePlans testing
+// knob is set.
+func (o *Optimizer) ValidatePlan(root opt.Expr) []PlanViolation {
+	var v planValidator
+	if rel, ok := root.(memo.RelExpr); ok {
+		v.validate(rel)
+	}
+	return v.violations
+}
+
+// planValidator walks the lowest cost tree and accumulates violations.
+type planValidator struct {
+	path       []int
+	violations []PlanViolation
+}
+
+// addViolation records a violation for the given expression at the current
+// path.
+func (v *planValidator) addViolation(
+	check PlanCheck, e memo.RelExpr, format string, args ...interface{},
+) {
+	v.violations = append(v.violations, PlanViolation{
+		Check:   check,
+		Expr:    e,
+		Path:    append([]int(nil), v.path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// validate runs all checks on the given expression, and then recursively on
+// its relational children.
+func (v *planValidator) validate(e memo.RelExpr) {
+	v.checkInvariants(e)
+	v.checkProvidedProps(e)
+	v.checkCost(e)
+
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		if child, ok := e.Child(i).(memo.RelExpr); ok {
+			v.path = append(v.path, i)
+			v.validate(child)
+			v.path = v.path[:len(v.path)-1]
+		}
+	}
+}
+
+// checkInvariants verifies the logical properties of the given expression.
+func (v *planValidator) checkInvariants(e memo.RelExpr) {
+	rel := e.Relational()
+	if !rel.NotNullCols.SubsetOf(rel.OutputCols) {
+		v.addViolation(InvariantCheck, e,
+			"not null cols %s not a subset of output cols %s", rel.NotNullCols, rel.OutputCols)
+	}
+	if rel.OuterCols.Intersects(rel.OutputCols) {
+		v.addViolation(InvariantCheck, e,
+			"outer cols %s intersect output cols %s", rel.OuterCols, rel.OutputCols)
+	}
+	if rel.Cardinality.Min > rel.Cardinality.Max {
+		v.addViolation(InvariantCheck, e, "invalid cardinality %s", rel.Cardinality)
+	}
+
+	// Run the more expensive checks that are only performed in test builds,
+	// converting any assertion failures into violations.
+	if err := catchAssertionFailure(rel.Verify); err != nil {
+		v.addViolation(InvariantCheck, e, "%v", err)
+	}
+}
+
+// checkProvidedProps verifies that the ordering provided by the given
+// expression is consistent with the ordering required of it.
+func (v *planValidator) checkProvidedProps(e memo.RelExpr) {
+	required := e.RequiredPhysical()
+	provided := e.ProvidedPhysical()
+	rel := e.Relational()
+
+	if !provided.Ordering.ColSet().SubsetOf(rel.OutputCols) {
+		v.addViolation(ProvidedPropsCheck, e,
+			"provided ordering %s must refer only to output cols %s", provided.Ordering, rel.OutputCols)
+	}
+
+	// If an ordering is required of an expression that can return more than
+	// one row, the expression must provide an ordering that satisfies it,
+	// unless the required ordering is trivially satisfied due to functional
+	// dependencies. Both orderings are simplified using the same FDs, so that
+	// constant columns and columns determined by earlier columns are ignored.
+	if required.Ordering.Any() || rel.Cardinality.Max <= 1 {
+		return
+	}
+	simplified := required.Ordering.Copy()
+	simplified.Simplify(&rel.FuncDeps)
+	if simplified.Any() {
+		return
+	}
+	if len(provided.Ordering) == 0 {
+		v.addViolation(ProvidedPropsCheck, e,
+			"required ordering %s is not provided", required.Ordering.String())
+		return
+	}
+	var providedChoice props.OrderingChoice
+	providedChoice.FromOrdering(provided.Ordering)
+	providedChoice.Simplify(&rel.FuncDeps)
+	if !providedChoice.Implies(&simplified) {
+		v.addViolation(ProvidedPropsCheck, e,
+			"provided ordering %s does not satisfy required ordering %s",
+			provided.Ordering, required.Ordering.String())
+	}
+}
+
+// checkCost verifies that the cost of the given expression is sane.
+func (v *planValidator) checkCost(e memo.RelExpr) {
+	cost := float64(e.Cost())
+	if math.IsNaN(cost) || math.IsInf(cost, 0) || cost < 0 {
+		v.addViolation(CostCheck, e, "invalid cost %v", cost)
+		return
+	}
+
+	// The cost of an expression includes the cost of its relational inputs.
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		if child, ok := e.Child(i).(memo.RelExpr); ok && child.Cost() > e.Cost() {
+			v.addViolation(CostCheck, e,
+				"cost %v is less than the cost %v of input %d", e.Cost(), child.Cost(), i)
+		}
+	}
+}
+
+// checkComputedCost panics with an assertion failure if the cost computed by
+// the coster for the given candidate is not sane, given the cost of its inputs.
+// The cost must not be negative, so that the total cost of a candidate is at
+// least the sum of the costs of its inputs, and adding an enforcer never makes
+// a plan cheaper. Unlike checkCost, it is run for every candidate that is
+// costed in test builds, rather than only for the lowest cost tree, since a
+// costing bug can prevent a good plan from being chosen without producing an
+// invalid cost in the chosen plan.
+func checkComputedCost(candidate memo.RelExpr, inputCost, cost memo.Cost, enforcer bool) {
+	if math.IsNaN(float64(inputCost)) || inputCost < 0 {
+		panic(errors.AssertionFailedf("invalid cost %v of the inputs of %s",
+			errors.Safe(inputCost), errors.Safe(candidate.Op())))
+	}
+	if math.IsNaN(float64(cost)) || cost < 0 {
+		if enforcer {
+			panic(errors.AssertionFailedf("enforcer %s has invalid cost %v, which would change the cost %v of its input",
+				errors.Safe(candidate.Op()), errors.Safe(cost), errors.Safe(inputCost)))
+		}
+		panic(errors.AssertionFailedf("coster returned invalid cost %v for %s, which has inputs that cost %v",
+			errors.Safe(cost), errors.Safe(candidate.Op()), errors.Safe(inputCost)))
+	}
+}
+
+// catchAssertionFailure runs the given function, and returns an error if it
+// panics with an error that would otherwise be caught by Optimize.
+func catchAssertionFailure(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if ok, e := errorutil.ShouldCatch(r); ok {
+				err = e
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	fn()
+	return nil
+}
+
+// validatePlan runs ValidatePlan on the given expression, and returns an
+// assertion failure describing the violations, if any.
+func (o *Optimizer) validatePlan(root opt.Expr) error {
+	violations := o.ValidatePlan(root)
+	if len(violations) == 0 {
+		return nil
+	}
+	err := errors.AssertionFailedf("plan validation failed: %s", errors.Safe(violations[0].String()))
+	for i := 1; i < len(violations); i++ {
+		err = errors.WithDetail(err, violations[i].String())
+	}
+	return err
+}
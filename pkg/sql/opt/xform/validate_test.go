@@ -0,0 +1,82 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/testutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// TestValidatePlan tests that ValidatePlan reports no violations for the plans
+// chosen by the optimizer.
+func TestValidatePlan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t,
+		abcDDL,
+		"CREATE TABLE xyz (x INT PRIMARY KEY, y INT, z INT, INDEX (y))",
+	)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+	evalCtx.TestingKnobs.OptimizerValidatePlans = true
+
+	for _, query := range []string{
+		"SELECT a, c FROM abc WHERE c = 'foo'",
+		"SELECT * FROM abc ORDER BY c LIMIT 10",
+		"SELECT * FROM abc INNER JOIN xyz ON a = y WHERE z > 5 ORDER BY b",
+		"SELECT c, count(*) FROM abc GROUP BY c ORDER BY c",
+	} {
+		t.Run(query, func(t *testing.T) {
+			var o xform.Optimizer
+			testutils.BuildQuery(t, &o, catalog, &evalCtx, query)
+			root, err := o.Optimize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if violations := o.ValidatePlan(root); len(violations) != 0 {
+				t.Errorf("expected no violations, got %v", violations)
+			}
+		})
+	}
+}
+
+// TestValidatePlanProvidedOrdering tests that ValidatePlan reports an
+// expression whose provided ordering does not satisfy its required ordering.
+func TestValidatePlanProvidedOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	catalog := newTestCatalog(t, abcDDL)
+	evalCtx := tree.MakeTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	var o xform.Optimizer
+	testutils.BuildQuery(t, &o, catalog, &evalCtx, "SELECT a, c FROM abc ORDER BY c")
+	root, err := o.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the provided ordering of the root, which is required to be +c.
+	rel := root.(memo.RelExpr)
+	rel.ProvidedPhysical().Ordering = opt.Ordering{opt.MakeOrderingColumn(3, true /* descending */)}
+	violations := o.ValidatePlan(root)
+	if len(violations) != 1 || violations[0].Check != xform.ProvidedPropsCheck || len(violations[0].Path) != 0 {
+		t.Errorf("expected a provided-props violation at the root, got %v", violations)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/col/typeconv"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// vectorizedCostWeights contains the operators that have native
+// implementations in the vectorized execution engine. Each is mapped to the
+// fraction of its cost to which the VectorizedCostFactor applies when it runs
+// vectorized. Operators whose cost is dominated by processing rows in memory
+// have a weight of 1, while operators whose cost is dominated by I/O have a
+// lower weight, since the vectorized engine only speeds up the processing of
+// the rows that they read.
+//
+// Operators that are missing from the map, such as lookup, inverted and
+// zigzag joins, are executed by wrapping a row-by-row processor, and so are not
+// affected by the VectorizedCostFactor.
+var vectorizedCostWeights = map[opt.Operator]float64{
+	opt.ScanOp:      0.25,
+	opt.IndexJoinOp: 0.25,
+
+	opt.SelectOp:       1,
+	opt.ProjectOp:      1,
+	opt.InnerJoinOp:    1,
+	opt.LeftJoinOp:     1,
+	opt.RightJoinOp:    1,
+	opt.FullJoinOp:     1,
+	opt.SemiJoinOp:     1,
+	opt.AntiJoinOp:     1,
+	opt.MergeJoinOp:    1,
+	opt.SortOp:         1,
+	opt.TopKOp:         1,
+	opt.TopKSortOp:     1,
+	opt.LimitOp:        1,
+	opt.OffsetOp:       1,
+	opt.OrdinalityOp:   1,
+	opt.UnionOp:        1,
+	opt.IntersectOp:    1,
+	opt.ExceptOp:       1,
+	opt.UnionAllOp:     1,
+	opt.IntersectAllOp: 1,
+	opt.ExceptAllOp:    1,
+
+	opt.GroupByOp:                1,
+	opt.ScalarGroupByOp:          1,
+	opt.DistinctOnOp:             1,
+	opt.EnsureDistinctOnOp:       1,
+	opt.UpsertDistinctOnOp:       1,
+	opt.EnsureUpsertDistinctOnOp: 1,
+}
+
+// vectorizedCostMultiplier returns the factor by which the cost of the given
+// expression is multiplied to account for the speed of the vectorized engine.
+// It is 1 unless the vectorized engine is enabled for the session, the
+// operator has a native vectorized implementation, and all of its output
+// columns have types that are natively supported by the vectorized engine.
+// Columns of other types are represented by datum-backed vectors, which are
+// processed at about the speed of the row-by-row engine.
+func (c *coster) vectorizedCostMultiplier(e memo.RelExpr) float64 {
+	if !c.vectorized || c.vectorizedCostFactor == 1 {
+		return 1
+	}
+	weight, ok := vectorizedCostWeights[e.Op()]
+	if !ok {
+		return 1
+	}
+	datumVecCols := c.batch.datumVecCols
+	if c.batch.group == nil || e.FirstExpr() != c.batch.group {
+		datumVecCols = c.hasDatumVecCols(e.Relational().OutputCols)
+	}
+	if datumVecCols {
+		return 1
+	}
+	return 1 - weight*(1-c.vectorizedCostFactor)
+}
+
+// hasDatumVecCols returns true if any of the given columns has a type that is
+// not natively supported by the vectorized engine, and so is represented by a
+// datum-backed vector.
+func (c *coster) hasDatumVecCols(cols opt.ColSet) bool {
+	md := c.mem.Metadata()
+	for col, ok := cols.Next(0); ok; col, ok = cols.Next(col + 1) {
+		family := md.ColumnMeta(col).Type.Family()
+		if typeconv.TypeFamilyToCanonicalTypeFamily(family) == typeconv.DatumVecCanonicalTypeFamily {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgnotice"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// WarningKind categorizes the warnings that the optimizer can raise about the
+// plan that it produced.
+type WarningKind uint8
+
+const (
+	// MissingStatisticsWarning indicates that a table in the query has no
+	// statistics, so the row counts on which the plan was based are guesses.
+	MissingStatisticsWarning WarningKind = iota
+
+	// StaleStatisticsWarning indicates that the most recent statistics of a
+	// table in the query are older than the age set via
+	// EnableStatisticsWarnings.
+	StaleStatisticsWarning
+
+	// HintNotHonoredWarning indicates that a hint in the query could not be
+	// honored, and was ignored.
+	HintNotHonoredWarning
+
+	// BudgetExceededWarning indicates that exploration was stopped, or rules
+	// were not applied, because a budget or limit was reached.
+	BudgetExceededWarning
+)
+
+// String implements the fmt.Stringer interface.
+func (k WarningKind) String() string {
+	switch k {
+	case MissingStatisticsWarning:
+		return "missing statistics"
+	case StaleStatisticsWarning:
+		return "stale statistics"
+	case HintNotHonoredWarning:
+		return "hint not honored"
+	case BudgetExceededWarning:
+		return "budget exceeded"
+	default:
+		return fmt.Sprintf("WarningKind(%d)", k)
+	}
+}
+
+// Warning is a structured notice about the plan produced by the optimizer,
+// which warns that the plan may be suboptimal.
+type Warning struct {
+	// Kind is the category of the warning.
+	Kind WarningKind
+
+	// Message describes the cause of the warning.
+	Message string
+}
+
+// String implements the fmt.Stringer interface.
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Kind, w.Message)
+}
+
+// Warnings returns the warnings registered during the last call to Optimize,
+// in the order in which they were registered. Each warning is sent to the
+// client as a notice once Optimize completes.
+func (o *Optimizer) Warnings() []Warning {
+	return o.warnings
+}
+
+// EnableStatisticsWarnings causes Optimize to warn about each table in the
+// query that has no statistics. If staleAge is positive, it also warns about
+// each table whose most recent statistics are older than staleAge. It must be
+// called before Optimize.
+func (o *Optimizer) EnableStatisticsWarnings(staleAge time.Duration) {
+	if staleAge < 0 {
+		panic(errors.AssertionFailedf("negative statistics age: %s", staleAge))
+	}
+	o.statsWarnings = true
+	o.staleStatsAge = staleAge
+}
+
+// addWarning registers a warning of the given kind. A warning with the same
+// kind and message as one that was already registered is ignored, so that
+// checks that run for each group or each pass can register their warning
+// each time.
+func (o *Optimizer) addWarning(kind WarningKind, format string, args ...interface{}) {
+	w := Warning{Kind: kind, Message: fmt.Sprintf(format, args...)}
+	for i := range o.warnings {
+		if o.warnings[i] == w {
+			return
+		}
+	}
+	o.warnings = append(o.warnings, w)
+}
+
+// checkStatistics registers a warning for each table in the query that has no
+// statistics, or whose statistics are stale, if statistics warnings are
+// enabled. Virtual tables never have statistics, so they are skipped.
+func (o *Optimizer) checkStatistics() {
+	if !o.statsWarnings {
+		return
+	}
+	provider := o.mem.StatsProvider()
+	now := timeutil.Now()
+	for _, tabMeta := range o.mem.Metadata().AllTables() {
+		tab := tabMeta.Table
+		if tab.IsVirtualTable() {
+			continue
+		}
+		if provider.StatisticCount(tab) == 0 {
+			o.addWarning(MissingStatisticsWarning, "table %s has no statistics", tab.Name())
+			continue
+		}
+		if o.staleStatsAge > 0 {
+			if age := now.Sub(provider.Statistic(tab, 0).CreatedAt()); age > o.staleStatsAge {
+				o.addWarning(StaleStatisticsWarning,
+					"statistics of table %s were collected %s ago", tab.Name(), age.Round(time.Second))
+			}
+		}
+	}
+}
+
+// sendWarnings sends each registered warning to the client as a notice.
+func (o *Optimizer) sendWarnings() {
+	if o.evalCtx.ClientNoticeSender == nil {
+		return
+	}
+	for _, w := range o.warnings {
+		o.evalCtx.ClientNoticeSender.BufferClientNotice(o.ctx(), pgnotice.Newf(
+			"plan may be suboptimal: %s", w.Message,
+		))
+	}
+}
@@ -0,0 +1,571 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/cat"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props/physical"
+	"github.com/cockroachdb/errors"
+)
+
+// PlanShape describes the shape of a plan, or part of a plan, that is passed to
+// WhyNot. For example, a merge join between a scan of the a_b_idx index of
+// table a and a scan of table b is described as:
+//
+//   PlanShape{
+//     Op: opt.MergeJoinOp,
+//     Children: []PlanShape{
+//       {Op: opt.ScanOp, Table: "a", Index: "a_b_idx"},
+//       {Op: opt.ScanOp, Table: "b"},
+//     },
+//   }
+//
+type PlanShape struct {
+	// Op is the operator of the expression.
+	Op opt.Operator
+
+	// Table, if non-empty, is the alias of the table that the expression
+	// accesses. It can only be set for operators that access a table, such as
+	// scans and lookup joins. For zigzag joins, either table can match.
+	Table string
+
+	// Index, if non-empty, is the name of the index that the expression
+	// accesses. It can only be set for operators that access an index.
+	Index string
+
+	// Children, if non-empty, describes the relational children of the
+	// expression, in order. A child with an Op of opt.UnknownOp matches any
+	// expression. Children beyond the end of the slice also match any
+	// expression.
+	Children []PlanShape
+}
+
+// String returns a compact representation of the shape, e.g.:
+//
+//   merge-join(scan[a@a_b_idx], scan[b])
+//
+func (s *PlanShape) String() string {
+	var buf bytes.Buffer
+	s.format(&buf)
+	return buf.String()
+}
+
+func (s *PlanShape) format(buf *bytes.Buffer) {
+	if s.Op == opt.UnknownOp {
+		buf.WriteByte('*')
+	} else {
+		buf.WriteString(s.Op.String())
+	}
+	if s.Table != "" || s.Index != "" {
+		buf.WriteByte('[')
+		buf.WriteString(s.Table)
+		if s.Index != "" {
+			buf.WriteByte('@')
+			buf.WriteString(s.Index)
+		}
+		buf.WriteByte(']')
+	}
+	if len(s.Children) > 0 {
+		buf.WriteByte('(')
+		for i := range s.Children {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			s.Children[i].format(buf)
+		}
+		buf.WriteByte(')')
+	}
+}
+
+// WhyNotReport explains why the optimizer did not choose a plan with a given
+// shape. See WhyNot.
+type WhyNotReport struct {
+	// Shape is the shape that was requested.
+	Shape PlanShape
+
+	// Generated is true if the memo contains an expression with the shape.
+	Generated bool
+
+	// Rules contains the exploration rules that generate expressions with the
+	// operators in the shape that were not found in the memo. It is only set if
+	// Generated is false, and can be empty if the operators are not generated
+	// by exploration rules.
+	Rules []opt.RuleName
+
+	// Forced is the lowest cost plan which contains the shape. It is nil if the
+	// shape was not generated, or if it was only generated in a part of the memo
+	// that was never costed with the properties required by the plan.
+	Forced *PlanNode
+
+	// Chosen is the plan chosen by the optimizer.
+	Chosen *PlanNode
+}
+
+// String formats the report, including the cost of each node of the forced
+// and chosen plans.
+func (r *WhyNotReport) String() string {
+	var buf bytes.Buffer
+	switch {
+	case !r.Generated:
+		fmt.Fprintf(&buf, "shape %s was never generated", r.Shape.String())
+		if len(r.Rules) > 0 {
+			names := make([]string, len(r.Rules))
+			for i, rule := range r.Rules {
+				names[i] = rule.String()
+			}
+			fmt.Fprintf(&buf, "; it would be generated by %s", strings.Join(names, ", "))
+		}
+		buf.WriteByte('\n')
+		return buf.String()
+
+	case r.Forced == nil:
+		fmt.Fprintf(&buf, "shape %s was generated, but was not costed as part of a complete plan\n",
+			r.Shape.String())
+		return buf.String()
+	}
+
+	fmt.Fprintf(&buf, "chosen plan cost: %.2f\n", r.Chosen.Cost)
+	fmt.Fprintf(&buf, "forced plan cost: %.2f", r.Forced.Cost)
+	if r.Chosen.Cost > 0 {
+		fmt.Fprintf(&buf, " (%+.1f%%)", float64((r.Forced.Cost-r.Chosen.Cost)/r.Chosen.Cost)*100)
+	}
+	buf.WriteString("\nforced plan:\n")
+	formatPlanNode(&buf, r.Forced, 1)
+	buf.WriteString("chosen plan:\n")
+	formatPlanNode(&buf, r.Chosen, 1)
+	return buf.String()
+}
+
+func formatPlanNode(buf *bytes.Buffer, n *PlanNode, depth int) {
+	fmt.Fprintf(buf, "%s%s", strings.Repeat("  ", depth), n.Expr.Op())
+	if n.Required.Defined() {
+		fmt.Fprintf(buf, " %s", n.Required)
+	}
+	fmt.Fprintf(buf, " cost=%.2f\n", n.Cost)
+	for _, child := range n.Children {
+		formatPlanNode(buf, child, depth+1)
+	}
+}
+
+// WhyNot explains why the optimizer did not choose a plan with the given shape.
+// It must be called after Optimize. The shape can appear anywhere in the plan.
+// If the memo contains no expression with the shape, the report lists the
+// exploration rules that would have generated it. Otherwise, the report
+// contains the lowest cost plan that contains the shape, so that the cost of
+// each of its nodes can be compared with the plan that was chosen.
+//
+// Like EnumeratePlansWithin, WhyNot only considers the expressions that were
+// costed during optimization, and does not re-plan the query.
+func (o *Optimizer) WhyNot(shape PlanShape) (*WhyNotReport, error) {
+	if !o.mem.IsOptimized() {
+		return nil, errors.AssertionFailedf("cannot explain plan choices before optimization")
+	}
+	root, ok := o.mem.RootExpr().(memo.RelExpr)
+	if !ok {
+		return nil, errors.AssertionFailedf("can only explain plan choices for relational root expressions")
+	}
+	rootProps := o.mem.RootProps()
+
+	w := whyNot{
+		planEnumerator: planEnumerator{o: o},
+		withShape:      make(map[groupStateKey]*PlanNode),
+		forced:         make(map[forcedKey]*PlanNode),
+		visited:        make(map[memo.RelExpr]bool),
+		foundOps:       make(map[opt.Operator]bool),
+	}
+	report := &WhyNotReport{Shape: shape}
+	report.Chosen = w.chosenPlan(root, rootProps)
+	w.findShape(root, &shape)
+	report.Generated = w.found
+	if !report.Generated {
+		report.Rules = w.responsibleRules(&shape)
+		return report, nil
+	}
+	report.Forced = w.planWithShape(root, rootProps, &shape)
+	return report, nil
+}
+
+// shapeRules maps the operators produced by exploration rules to the rules
+// that produce them.
+var shapeRules = map[opt.Operator][]opt.RuleName{
+	opt.ScanOp: {
+		opt.GenerateIndexScans, opt.GenerateConstrainedScans, opt.GeneratePartialIndexScans,
+		opt.GenerateInvertedIndexScans, opt.GenerateLimitedScans,
+	},
+	opt.IndexJoinOp: {
+		opt.GenerateIndexScans, opt.GenerateConstrainedScans, opt.GeneratePartialIndexScans,
+		opt.GenerateInvertedIndexScans,
+	},
+	opt.MergeJoinOp: {opt.GenerateMergeJoins},
+	opt.LookupJoinOp: {
+		opt.GenerateLookupJoins, opt.GenerateLookupJoinsWithFilter,
+		opt.GenerateLookupJoinsWithVirtualCols, opt.GenerateLookupJoinsWithVirtualColsAndFilter,
+	},
+	opt.InvertedJoinOp:   {opt.GenerateInvertedJoins, opt.GenerateInvertedJoinsFromSelect},
+	opt.ZigzagJoinOp:     {opt.GenerateZigzagJoins, opt.GenerateInvertedIndexZigzagJoins},
+	opt.TopKOp:           {opt.GenerateTopK, opt.GeneratePartialOrderTopK},
+	opt.InnerJoinOp:      {opt.ReorderJoins},
+	opt.InnerJoinApplyOp: {opt.GenerateApplyJoin},
+	opt.LeftJoinApplyOp:  {opt.GenerateApplyJoin},
+	opt.SemiJoinApplyOp:  {opt.GenerateApplyJoin},
+	opt.AntiJoinApplyOp:  {opt.GenerateApplyJoin},
+}
+
+// forcedKey identifies a group, set of required properties, and shape.
+type forcedKey struct {
+	groupStateKey
+	shape *PlanShape
+}
+
+// whyNot searches the memo for plans that contain a shape.
+type whyNot struct {
+	planEnumerator
+
+	// withShape caches the lowest cost plan that contains the shape for each
+	// group and set of required properties. A nil plan is cached if there is
+	// none.
+	withShape map[groupStateKey]*PlanNode
+
+	// forced caches the lowest cost plan for each group and set of required
+	// properties whose root has a given shape.
+	forced map[forcedKey]*PlanNode
+
+	// visited, found, and foundOps are used by findShape.
+	visited  map[memo.RelExpr]bool
+	found    bool
+	foundOps map[opt.Operator]bool
+}
+
+// findShape searches the groups reachable from the given expression for a
+// member with the shape. It also records the operators that are in the memo.
+func (w *whyNot) findShape(e opt.Expr, shape *PlanShape) {
+	rel, ok := e.(memo.RelExpr)
+	if !ok {
+		// Scalar expressions can contain subqueries.
+		for i, n := 0, e.ChildCount(); i < n; i++ {
+			w.findShape(e.Child(i), shape)
+		}
+		return
+	}
+	rel = rel.FirstExpr()
+	if w.visited[rel] {
+		return
+	}
+	w.visited[rel] = true
+	for member := rel.FirstExpr(); member != nil; member = member.NextExpr() {
+		w.foundOps[member.Op()] = true
+		if !w.found && w.matches(member, shape) {
+			w.found = true
+		}
+		for i, n := 0, member.ChildCount(); i < n; i++ {
+			w.findShape(member.Child(i), shape)
+		}
+	}
+}
+
+// responsibleRules returns the rules that generate the operators in the shape
+// that were not found in the memo. If all of the operators were found, the
+// rules that generate the root operator of the shape are returned, since they
+// are responsible for combining the operators.
+func (w *whyNot) responsibleRules(shape *PlanShape) []opt.RuleName {
+	var res []opt.RuleName
+	var seen RuleSet
+	var collect func(s *PlanShape)
+	collect = func(s *PlanShape) {
+		if s.Op != opt.UnknownOp && !w.foundOps[s.Op] {
+			for _, r := range shapeRules[s.Op] {
+				if !seen.Contains(int(r)) {
+					seen.Add(int(r))
+					res = append(res, r)
+				}
+			}
+		}
+		for i := range s.Children {
+			collect(&s.Children[i])
+		}
+	}
+	collect(shape)
+	if len(res) == 0 {
+		res = append(res, shapeRules[shape.Op]...)
+	}
+	return res
+}
+
+// matches returns true if the given member has the shape, and each of its
+// children has a member with the corresponding child shape.
+func (w *whyNot) matches(member memo.RelExpr, shape *PlanShape) bool {
+	if !w.matchesRoot(member, shape) {
+		return false
+	}
+	for i, child := range w.relChildren(member) {
+		if i >= len(shape.Children) {
+			break
+		}
+		childShape := &shape.Children[i]
+		if childShape.Op == opt.UnknownOp {
+			continue
+		}
+		found := false
+		for m := child.FirstExpr(); m != nil && !found; m = m.NextExpr() {
+			found = w.matches(m, childShape)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesRoot returns true if the operator, table, and index of the given
+// expression match the shape. The children of the shape are not considered.
+func (w *whyNot) matchesRoot(e memo.RelExpr, shape *PlanShape) bool {
+	if e.Op() != shape.Op {
+		return false
+	}
+	if shape.Table == "" && shape.Index == "" {
+		return true
+	}
+	md := w.o.mem.Metadata()
+	matchesIndex := func(tabID opt.TableID, idx cat.IndexOrdinal) bool {
+		if shape.Table != "" && md.TableMeta(tabID).Alias.Object() != shape.Table {
+			return false
+		}
+		return shape.Index == "" || string(md.Table(tabID).Index(idx).Name()) == shape.Index
+	}
+	switch t := e.(type) {
+	case *memo.ScanExpr:
+		return matchesIndex(t.Table, t.Index)
+	case *memo.LookupJoinExpr:
+		return matchesIndex(t.Table, t.Index)
+	case *memo.InvertedJoinExpr:
+		return matchesIndex(t.Table, t.Index)
+	case *memo.ZigzagJoinExpr:
+		return matchesIndex(t.LeftTable, t.LeftIndex) || matchesIndex(t.RightTable, t.RightIndex)
+	case *memo.IndexJoinExpr:
+		return matchesIndex(t.Table, cat.PrimaryIndex)
+	}
+	return false
+}
+
+// relChildren returns the relational children of the given expression.
+func (w *whyNot) relChildren(e memo.RelExpr) []memo.RelExpr {
+	var res []memo.RelExpr
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		if child, ok := e.Child(i).(memo.RelExpr); ok {
+			res = append(res, child)
+		}
+	}
+	return res
+}
+
+// chosenPlan returns the plan chosen by the optimizer for the given group and
+// required properties, or nil if the group was not optimized with them.
+func (w *whyNot) chosenPlan(grp memo.RelExpr, required *physical.Required) *PlanNode {
+	state := w.o.lookupOptState(grp.FirstExpr(), required)
+	if state == nil || state.best == nil {
+		return nil
+	}
+	n := &PlanNode{Expr: state.best, Required: required, Cost: state.cost}
+	for i, c := 0, state.best.ChildCount(); i < c; i++ {
+		if child, ok := state.best.Child(i).(memo.RelExpr); ok {
+			childProps := BuildChildPhysicalProps(w.o.mem, state.best, i, required)
+			childPlan := w.chosenPlan(child, childProps)
+			if childPlan == nil {
+				return nil
+			}
+			n.Children = append(n.Children, childPlan)
+		}
+	}
+	return n
+}
+
+// planWithShape returns the lowest cost plan for the given group and required
+// properties which contains the shape anywhere within it, or nil if there is
+// no such plan.
+func (w *whyNot) planWithShape(
+	grp memo.RelExpr, required *physical.Required, shape *PlanShape,
+) *PlanNode {
+	grp = grp.FirstExpr()
+	key := groupStateKey{group: grp, required: required}
+	if n, ok := w.withShape[key]; ok {
+		return n
+	}
+	// Guard against cycles; a group with the same properties can't contain
+	// itself.
+	w.withShape[key] = nil
+	if w.o.lookupOptState(grp, required) == nil {
+		return nil
+	}
+
+	var best *PlanNode
+	consider := func(n *PlanNode) {
+		if n != nil && (best == nil || n.Cost.Less(best.Cost)) {
+			best = n
+		}
+	}
+
+	// The shape can be rooted in this group.
+	consider(w.forcedGroup(grp, required, shape))
+
+	for member := grp; member != nil; member = member.NextExpr() {
+		if !CanProvidePhysicalProps(w.o.evalCtx, member, required) {
+			continue
+		}
+		// The shape can be in one of the children of a member, with the other
+		// children using the chosen plan.
+		children, childProps, ownCost := w.memberChildren(member, required)
+		if children == nil {
+			continue
+		}
+		for i := range children {
+			sub := w.planWithShape(member.Child(childOrdinal(member, i)).(memo.RelExpr), childProps[i], shape)
+			if sub == nil {
+				continue
+			}
+			n := &PlanNode{Expr: member, Required: required, Cost: ownCost}
+			for j := range children {
+				child := children[j]
+				if j == i {
+					child = sub
+				}
+				n.Children = append(n.Children, child)
+				if !isApplyJoinRightInput(w.o.mem, member, childOrdinal(member, j)) {
+					n.Cost += child.Cost
+				}
+			}
+			consider(n)
+		}
+	}
+
+	// The shape can be below an enforcer.
+	if enforcer, inputProps := w.enforcerFor(grp, required); enforcer != nil {
+		if sub := w.planWithShape(grp, inputProps, shape); sub != nil {
+			cost := w.o.coster.ComputeCost(enforcer, required)
+			consider(&PlanNode{
+				Expr: enforcer, Required: required, Cost: cost + sub.Cost, Children: []*PlanNode{sub},
+			})
+		}
+	}
+
+	w.withShape[key] = best
+	return best
+}
+
+// forcedGroup returns the lowest cost plan for the given group and required
+// properties whose root has the shape, or nil if there is no such plan. The
+// root can be below enforcers that provide the required properties.
+func (w *whyNot) forcedGroup(
+	grp memo.RelExpr, required *physical.Required, shape *PlanShape,
+) *PlanNode {
+	grp = grp.FirstExpr()
+	key := forcedKey{groupStateKey: groupStateKey{group: grp, required: required}, shape: shape}
+	if n, ok := w.forced[key]; ok {
+		return n
+	}
+	w.forced[key] = nil
+	if w.o.lookupOptState(grp, required) == nil {
+		return nil
+	}
+
+	var best *PlanNode
+	for member := grp; member != nil; member = member.NextExpr() {
+		if !w.matchesRoot(member, shape) || !CanProvidePhysicalProps(w.o.evalCtx, member, required) {
+			continue
+		}
+		if n := w.forcedMember(member, required, shape); n != nil && (best == nil || n.Cost.Less(best.Cost)) {
+			best = n
+		}
+	}
+	if enforcer, inputProps := w.enforcerFor(grp, required); enforcer != nil {
+		if sub := w.forcedGroup(grp, inputProps, shape); sub != nil {
+			cost := w.o.coster.ComputeCost(enforcer, required) + sub.Cost
+			if best == nil || cost.Less(best.Cost) {
+				best = &PlanNode{Expr: enforcer, Required: required, Cost: cost, Children: []*PlanNode{sub}}
+			}
+		}
+	}
+
+	w.forced[key] = best
+	return best
+}
+
+// forcedMember returns the lowest cost plan rooted at the given member whose
+// children have the child shapes, or nil if there is no such plan.
+func (w *whyNot) forcedMember(
+	member memo.RelExpr, required *physical.Required, shape *PlanShape,
+) *PlanNode {
+	children, childProps, ownCost := w.memberChildren(member, required)
+	if children == nil {
+		return nil
+	}
+	n := &PlanNode{Expr: member, Required: required, Cost: ownCost}
+	for i := range children {
+		child := children[i]
+		if i < len(shape.Children) && shape.Children[i].Op != opt.UnknownOp {
+			grp := member.Child(childOrdinal(member, i)).(memo.RelExpr)
+			if child = w.forcedGroup(grp, childProps[i], &shape.Children[i]); child == nil {
+				return nil
+			}
+		}
+		n.Children = append(n.Children, child)
+		if !isApplyJoinRightInput(w.o.mem, member, childOrdinal(member, i)) {
+			n.Cost += child.Cost
+		}
+	}
+	return n
+}
+
+// memberChildren returns the chosen plan for each relational child of the
+// given member, along with the properties required of each child and the cost
+// of the member excluding its relational children. It returns nil children if
+// any child was not optimized with the required properties. A member with no
+// relational children returns an empty, non-nil slice.
+func (w *whyNot) memberChildren(
+	member memo.RelExpr, required *physical.Required,
+) (children []*PlanNode, childProps []*physical.Required, ownCost memo.Cost) {
+	children = make([]*PlanNode, 0, member.ChildCount())
+	ownCost = w.o.coster.ComputeCost(member, required)
+	for i, n := 0, member.ChildCount(); i < n; i++ {
+		switch t := member.Child(i).(type) {
+		case memo.RelExpr:
+			props := BuildChildPhysicalProps(w.o.mem, member, i, required)
+			plan := w.chosenPlan(t, props)
+			if plan == nil {
+				return nil, nil, 0
+			}
+			children = append(children, plan)
+			childProps = append(childProps, props)
+		case opt.ScalarExpr:
+			ownCost += w.scalarCost(t)
+		}
+	}
+	return children, childProps, ownCost
+}
+
+// childOrdinal returns the ordinal of the nth relational child of the given
+// expression.
+func childOrdinal(e memo.RelExpr, nth int) int {
+	for i, n := 0, e.ChildCount(); i < n; i++ {
+		if _, ok := e.Child(i).(memo.RelExpr); ok {
+			if nth == 0 {
+				return i
+			}
+			nth--
+		}
+	}
+	panic(errors.AssertionFailedf("expression has no relational child %d", nth))
+}
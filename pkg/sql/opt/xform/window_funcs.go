@@ -0,0 +1,126 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package xform
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// SplitScanIntoPerGroupLimitedScans returns a UnionAll tree of Scan operators
+// with hard limits, where each Scan reads the first K rows of a single window
+// partition from the original Scan. K is derived from a filter on the output
+// of a row_number window function, such as "rn <= K". If no such UnionAll of
+// Scans can be found, ok=false is returned.
+//
+// The transformation is only valid if discarding all but the first K rows of
+// each partition does not change the value of any window function for the
+// rows that pass the filter. This is true for row_number, rank and dense_rank,
+// whose values depend only on the current row and the rows that precede it in
+// the partition.
+//
+// The window partition columns must form a prefix of the columns of the Scan's
+// constraint, so that each single-key span on that prefix corresponds to
+// exactly one partition.
+func (c *CustomFuncs) SplitScanIntoPerGroupLimitedScans(
+	scan memo.RelExpr,
+	sp *memo.ScanPrivate,
+	windows memo.WindowsExpr,
+	private *memo.WindowPrivate,
+	filters memo.FiltersExpr,
+) (_ memo.RelExpr, ok bool) {
+	if private.Partition.Empty() {
+		// A single partition is handled by the PushLimitIntoWindow
+		// normalization rule and the limit exploration rules.
+		return nil, false
+	}
+
+	limit, ok := c.rowNumberFilterLimit(windows, filters)
+	if !ok {
+		return nil, false
+	}
+
+	cons, ok := c.getKnownScanConstraint(sp)
+	if !ok {
+		// No valid constraint was found.
+		return nil, false
+	}
+
+	// The partition columns must be exactly the prefix of the constraint
+	// columns that is split into single-key spans.
+	keyPrefixLength := private.Partition.Len()
+	if keyPrefixLength > cons.Columns.Count() {
+		return nil, false
+	}
+	var prefixCols opt.ColSet
+	for i := 0; i < keyPrefixLength; i++ {
+		prefixCols.Add(cons.Columns.Get(i).ID())
+	}
+	if !prefixCols.Equals(private.Partition) {
+		return nil, false
+	}
+
+	return c.splitScanIntoUnionScans(private.Ordering, scan, sp, cons, limit, keyPrefixLength)
+}
+
+// rowNumberFilterLimit returns the smallest K such that the given filters only
+// allow rows with a row_number value of at most K to pass. It returns ok=false
+// if no such filter exists, or if any of the window functions could produce a
+// different value when the partition is truncated to its first K rows.
+func (c *CustomFuncs) rowNumberFilterLimit(
+	windows memo.WindowsExpr, filters memo.FiltersExpr,
+) (limit int, ok bool) {
+	var rowNumCols opt.ColSet
+	for i := range windows {
+		switch windows[i].Function.Op() {
+		case opt.RowNumberOp:
+			rowNumCols.Add(windows[i].Col)
+
+		case opt.RankOp, opt.DenseRankOp:
+
+		default:
+			return 0, false
+		}
+	}
+	if rowNumCols.Empty() {
+		return 0, false
+	}
+
+	for i := range filters {
+		cond := filters[i].Condition
+		switch cond.Op() {
+		case opt.LeOp, opt.LtOp, opt.EqOp:
+		default:
+			continue
+		}
+		variable, isVar := cond.Child(0).(*memo.VariableExpr)
+		if !isVar || !rowNumCols.Contains(variable.Col) {
+			continue
+		}
+		constant, isConst := cond.Child(1).(*memo.ConstExpr)
+		if !isConst {
+			continue
+		}
+		val, isInt := constant.Value.(*tree.DInt)
+		if !isInt {
+			continue
+		}
+		k := int(*val)
+		if cond.Op() == opt.LtOp {
+			k--
+		}
+		if k > 0 && (!ok || k < limit) {
+			limit, ok = k, true
+		}
+	}
+	return limit, ok
+}
@@ -1471,6 +1471,14 @@ func (oi *optIndex) Partition(i int) cat.Partition {
 	return &oi.partitions[i]
 }
 
+// RangeDistribution is part of the cat.Index interface. The range and
+// leaseholder counts of indexes are not yet taken from the range cache, so the
+// range distribution is always unknown, and scans are not costed by the ranges
+// they touch.
+func (oi *optIndex) RangeDistribution() cat.RangeDistribution {
+	return cat.RangeDistribution{}
+}
+
 // optPartition implements cat.Partition and represents a PARTITION BY LIST
 // partition of an index.
 type optPartition struct {
@@ -2243,6 +2251,11 @@ func (oi *optVirtualIndex) Partition(i int) cat.Partition {
 	return nil
 }
 
+// RangeDistribution is part of the cat.Index interface.
+func (oi *optVirtualIndex) RangeDistribution() cat.RangeDistribution {
+	return cat.RangeDistribution{}
+}
+
 // optVirtualFamily is a dummy implementation of cat.Family for the only family
 // reported by a virtual table.
 type optVirtualFamily struct {
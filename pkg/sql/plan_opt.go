@@ -28,11 +28,14 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgnotice"
 	"github.com/cockroachdb/cockroach/pkg/sql/physicalplan"
 	"github.com/cockroachdb/cockroach/pkg/sql/querycache"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqltelemetry"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/errors"
 )
 
@@ -41,6 +44,48 @@ var queryCacheEnabled = settings.RegisterBoolSetting(
 	"sql.query_cache.enabled", "enable the query cache", true,
 )
 
+var queryCacheCompactMemos = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.query_cache.compact_memos.enabled",
+	"when enabled, optimized memos added to the query cache only retain the "+
+		"expressions of the chosen plan, which reduces their memory usage",
+	true,
+)
+
+var placeholderExplorationRestricted = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.optimizer.restrict_placeholder_exploration.enabled",
+	"when enabled, only a narrow set of index selection and limit pushdown "+
+		"exploration rules are run when reusing a prepared memo with placeholders",
+	false,
+)
+
+var preparedPlanRulesReused = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.optimizer.reuse_prepared_plan_rules.enabled",
+	"when enabled, executions of a prepared statement with placeholders only "+
+		"apply the exploration rules that generated the plan of its first "+
+		"execution, along with the rules that re-derive scan constraints",
+	false,
+)
+
+var shapeBasedPlanning = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.optimizer.shape_based_planning.enabled",
+	"when enabled, the optimizer classifies each statement before exploration, "+
+		"and plans OLTP point lookups with a reduced set of exploration rules",
+	false,
+)
+
+var fallbackOnInternalError = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.optimizer.fallback_on_internal_error.enabled",
+	"when enabled, a statement whose optimization fails with an internal error "+
+		"is reported and re-optimized with the exploration rule that caused the "+
+		"error disabled, or with exploration disabled if the rule is not known",
+	false,
+)
+
 // prepareUsingOptimizer builds a memo for a prepared statement and populates
 // the following stmt.Prepared fields:
 //  - Columns
@@ -52,6 +97,9 @@ func (p *planner) prepareUsingOptimizer(ctx context.Context) (planFlags, error)
 
 	opc := &p.optPlanningCtx
 	opc.reset()
+	if err := opc.checkStatementHints(); err != nil {
+		return 0, err
+	}
 
 	switch stmt.AST.(type) {
 	case *tree.AlterIndex, *tree.AlterTable, *tree.AlterSequence,
@@ -174,6 +222,7 @@ func (p *planner) prepareUsingOptimizer(ctx context.Context) (planFlags, error)
 			// TODO(radu): Determine if the extra object allocation is really
 			// necessary.
 			pm := stmt.Prepared.PrepareMetadata
+			opc.compactMemoForCache(memo)
 			cachedData := querycache.CachedData{
 				SQL:             stmt.SQL,
 				Memo:            memo,
@@ -192,6 +241,9 @@ func (p *planner) makeOptimizerPlan(ctx context.Context) error {
 
 	opc := &p.optPlanningCtx
 	opc.reset()
+	if err := opc.checkStatementHints(); err != nil {
+		return err
+	}
 
 	execMemo, err := opc.buildExecMemo(ctx)
 	if err != nil {
@@ -303,6 +355,7 @@ func (opc *optPlanningCtx) init(p *planner) {
 func (opc *optPlanningCtx) reset() {
 	p := opc.p
 	opc.catalog.reset()
+	p.EvalContext().OptimizerHints = xform.ExtractHintComment(p.stmt.SQL)
 	opc.optimizer.Init(p.EvalContext(), &opc.catalog)
 	opc.flags = 0
 
@@ -332,6 +385,38 @@ func (opc *optPlanningCtx) reset() {
 		opc.allowMemoReuse = false
 		opc.useCache = false
 	}
+
+	if p.instrumentation.collectBundle {
+		// Plan the statement from scratch, so that the plan can be reproduced
+		// from the diagnostics bundle (see configureOptimizer).
+		opc.allowMemoReuse = false
+		opc.useCache = false
+	}
+	opc.configureOptimizer()
+}
+
+// configureOptimizer applies the configuration of the optimizer that is
+// specific to the statement. It is called by reset after the optimizer is
+// initialized, and again by optimizeWithFallback after the optimizer is
+// reinitialized for a retry, so that the retry is planned the same way.
+func (opc *optPlanningCtx) configureOptimizer() {
+	if opc.p.instrumentation.collectBundle {
+		// Record the decision made for each matched rule, so that the plan can
+		// be reproduced from the diagnostics bundle (see opttester.ReplayBundle).
+		opc.optimizer.RecordRuleDecisions()
+	}
+}
+
+// checkStatementHints returns an error if the hint comment of the statement
+// cannot be parsed. The optimizer ignores hints that cannot be parsed, so the
+// error must be reported here rather than silently dropping the hints.
+func (opc *optPlanningCtx) checkStatementHints() error {
+	hints := opc.p.EvalContext().OptimizerHints
+	if hints == "" {
+		return nil
+	}
+	_, err := xform.ParseStatementHints(hints)
+	return err
 }
 
 func (opc *optPlanningCtx) log(ctx context.Context, msg string) {
@@ -377,9 +462,8 @@ func (opc *optPlanningCtx) buildReusableMemo(ctx context.Context) (_ *memo.Memo,
 	// that there's even less to do during the EXECUTE phase.
 	//
 	f := opc.optimizer.Factory()
-	bld := optbuilder.New(ctx, &p.semaCtx, p.EvalContext(), &opc.catalog, f, opc.p.stmt.AST)
-	bld.KeepPlaceholders = true
-	if err := bld.Build(); err != nil {
+	bld, err := opc.buildNormalized(ctx, true /* keepPlaceholders */)
+	if err != nil {
 		return nil, err
 	}
 
@@ -416,6 +500,7 @@ func (opc *optPlanningCtx) buildReusableMemo(ctx context.Context) (_ *memo.Memo,
 		// can be reused without further changes to build the execution tree.
 		if !f.FoldingControl().PreventedStableFold() {
 			opc.log(ctx, "optimizing (no placeholders)")
+			opc.setPlanningProfiles()
 			if _, err := opc.optimizer.Optimize(); err != nil {
 				return nil, err
 			}
@@ -428,6 +513,39 @@ func (opc *optPlanningCtx) buildReusableMemo(ctx context.Context) (_ *memo.Memo,
 	return opc.optimizer.DetachMemo(), nil
 }
 
+// compactMemoForCache removes the expressions that are not part of the lowest
+// cost tree from an optimized memo that is about to be added to the query
+// cache, if the sql.query_cache.compact_memos.enabled setting is on. This
+// reduces the memory accounted to the cache entry, so that the cache can hold
+// more entries. See memo.Memo.Compact.
+func (opc *optPlanningCtx) compactMemoForCache(mem *memo.Memo) {
+	if queryCacheCompactMemos.Get(&opc.p.execCfg.Settings.SV) {
+		mem.Compact()
+	}
+}
+
+// buildNormalized builds the statement into the memo of the optimizer,
+// applying normalization rules as each expression is constructed. It does so
+// within a tracing span for the normalization phase of optimization, which
+// precedes the phases traced by Optimize.
+func (opc *optPlanningCtx) buildNormalized(
+	ctx context.Context, keepPlaceholders bool,
+) (*optbuilder.Builder, error) {
+	p := opc.p
+	ctx, sp := tracing.ChildSpan(ctx, xform.NormalizeSpanName)
+	defer sp.Finish()
+	f := opc.optimizer.Factory()
+	bld := optbuilder.New(ctx, &p.semaCtx, p.EvalContext(), &opc.catalog, f, p.stmt.AST)
+	bld.KeepPlaceholders = keepPlaceholders
+	// Hints that cannot be parsed are reported by checkStatementHints.
+	if hints, err := xform.ParseStatementHints(p.EvalContext().OptimizerHints); err == nil {
+		bld.Barriers = hints.Barriers
+	}
+	err := bld.Build()
+	xform.TagMemoSize(sp, f.Memo())
+	return bld, err
+}
+
 // reuseMemo returns an optimized memo using a cached memo as a starting point.
 //
 // The cached memo is not modified; it is safe to call reuseMemo on the same
@@ -435,28 +553,131 @@ func (opc *optPlanningCtx) buildReusableMemo(ctx context.Context) (_ *memo.Memo,
 //
 // The returned memo is only safe to use in one thread, during execution of the
 // current statement.
-func (opc *optPlanningCtx) reuseMemo(cachedMemo *memo.Memo) (*memo.Memo, error) {
+//
+// Note that a prepared memo with placeholders is never optimized generically:
+// unless the placeholder fast path applies, it is re-optimized here with the
+// values bound by each execution. Index selection depends on constraints built
+// from those values, so a plan chosen at PREPARE time for a range of
+// selectivities could not use constrained scans, and dispatching among such
+// plans would not be cheaper than the custom plan built here.
+//
+// If prepared is not nil, cachedMemo is the memo of that prepared statement. If
+// the sql.optimizer.reuse_prepared_plan_rules.enabled setting is on, the
+// exploration rules that generated the plan of its first execution are then
+// recorded, and later executions only apply those rules, which reuses the
+// exploration of the first execution while constraints and costs are derived
+// again from the values of the placeholders.
+func (opc *optPlanningCtx) reuseMemo(
+	ctx context.Context, cachedMemo *memo.Memo, prepared *PreparedStatement,
+) (*memo.Memo, error) {
 	if cachedMemo.IsOptimized() {
 		// The query could have been already fully optimized if there were no
 		// placeholders or the placeholder fast path succeeded (see
-		// buildReusableMemo).
+		// buildReusableMemo). The cost ceiling may have been lowered since.
+		if root, ok := cachedMemo.RootExpr().(memo.RelExpr); ok {
+			maxCost := xform.MaxPlanCostSetting.Get(&opc.p.execCfg.Settings.SV)
+			if err := xform.CheckPlanCost(root.Op(), root.Cost(), maxCost); err != nil {
+				return nil, err
+			}
+		}
 		return cachedMemo, nil
 	}
 	f := opc.optimizer.Factory()
+	reusePlanRules := prepared != nil && preparedPlanRulesReused.Get(&opc.p.execCfg.Settings.SV)
+	recordPlanRules := false
 	// Finish optimization by assigning any remaining placeholders and
 	// applying exploration rules. Reinitialize the optimizer and construct a
 	// new memo that is copied from the prepared memo, but with placeholders
 	// assigned. Stable operators can be constant-folded at this time.
-	f.FoldingControl().AllowStableFolds()
-	if err := f.AssignPlaceholders(cachedMemo); err != nil {
+	assignPlaceholders := func() error {
+		f.FoldingControl().AllowStableFolds()
+		if err := f.AssignPlaceholders(cachedMemo); err != nil {
+			return err
+		}
+		if placeholderExplorationRestricted.Get(&opc.p.execCfg.Settings.SV) {
+			// Re-derive scan constraints and push down limits that depend on the
+			// now-constant placeholder values, but don't fully explore the memo.
+			opc.optimizer.RestrictExplorationForPlaceholders()
+		} else if reusePlanRules {
+			if prepared.planRulesRecorded {
+				opc.optimizer.RestrictExplorationToRules(prepared.planRules)
+			} else {
+				opc.optimizer.RecordPlanRules()
+				recordPlanRules = true
+			}
+		}
+		return nil
+	}
+	if err := assignPlaceholders(); err != nil {
 		return nil, err
 	}
-	if _, err := opc.optimizer.Optimize(); err != nil {
+	retried, err := opc.optimizeWithFallback(ctx, assignPlaceholders)
+	if err != nil {
 		return nil, err
 	}
+	// The rules of a plan produced by a retry are not recorded, since later
+	// executions would otherwise be restricted to the degraded plan.
+	if recordPlanRules && !retried {
+		prepared.planRules = opc.optimizer.PlanRules()
+		prepared.planRulesRecorded = true
+	}
 	return f.Memo(), nil
 }
 
+// optimizeWithFallback optimizes the memo of the optimizer. If optimization
+// fails with an internal error, and the fallback_on_internal_error setting is
+// enabled, the error is reported, and the optimizer is reinitialized with the
+// exploration rule that caused the error disabled, or with exploration
+// disabled if the rule is not known (see xform.Optimizer.DisableForRetry).
+// The statement-specific configuration of the optimizer is reapplied (see
+// configureOptimizer), and rebuild is then called to rebuild the memo and to
+// reapply any configuration that depends on it, such as the restriction of
+// exploration for placeholders. The memo is optimized again, so that the
+// statement can still be executed, and retried is true. The memo produced by a
+// retry is never cached, so that the plan is not degraded for later executions.
+func (opc *optPlanningCtx) optimizeWithFallback(
+	ctx context.Context, rebuild func() error,
+) (retried bool, _ error) {
+	p := opc.p
+	opc.setPlanningProfiles()
+	_, err := opc.optimizer.Optimize()
+	if err == nil || !fallbackOnInternalError.Get(&p.execCfg.Settings.SV) {
+		return false, err
+	}
+	if e, ok := xform.GetOptimizationError(err); !ok || e.Kind != xform.InternalError {
+		return false, err
+	}
+	sqltelemetry.RecordError(ctx, err, &p.execCfg.Settings.SV)
+
+	opc.optimizer.Init(p.EvalContext(), &opc.catalog)
+	disabled := opc.optimizer.DisableForRetry(err)
+	opc.configureOptimizer()
+	log.Warningf(ctx, "optimization failed with an internal error, retrying with %s disabled: %+v",
+		log.Safe(disabled), err)
+	if err := rebuild(); err != nil {
+		return false, err
+	}
+	opc.setPlanningProfiles()
+	if _, err := opc.optimizer.Optimize(); err != nil {
+		return false, err
+	}
+	opc.useCache = false
+	p.BufferClientNotice(ctx, pgnotice.Newf(
+		"plan may be suboptimal: optimization failed with an internal error, "+
+			"and was retried with %s disabled", disabled,
+	))
+	return true, nil
+}
+
+// setPlanningProfiles causes the optimizer to select a planning profile based
+// on the shape of the statement, if the shape_based_planning setting is
+// enabled. See xform.Optimizer.SetPlanningProfiles.
+func (opc *optPlanningCtx) setPlanningProfiles() {
+	if shapeBasedPlanning.Get(&opc.p.execCfg.Settings.SV) {
+		opc.optimizer.SetPlanningProfiles(xform.DefaultPlanningProfiles())
+	}
+}
+
 // buildExecMemo creates a fully optimized memo, possibly reusing a previously
 // cached memo as a starting point.
 //
@@ -475,13 +696,14 @@ func (opc *optPlanningCtx) buildExecMemo(ctx context.Context) (_ *memo.Memo, _ e
 			return nil, err
 		} else if isStale {
 			prepared.Memo, err = opc.buildReusableMemo(ctx)
+			prepared.planRulesRecorded = false
 			opc.log(ctx, "rebuilding cached memo")
 			if err != nil {
 				return nil, err
 			}
 		}
 		opc.log(ctx, "reusing cached memo")
-		memo, err := opc.reuseMemo(prepared.Memo)
+		memo, err := opc.reuseMemo(ctx, prepared.Memo, prepared)
 		return memo, err
 	}
 
@@ -506,7 +728,7 @@ func (opc *optPlanningCtx) buildExecMemo(ctx context.Context) (_ *memo.Memo, _ e
 				opc.log(ctx, "query cache hit")
 				opc.flags.Set(planFlagOptCacheHit)
 			}
-			memo, err := opc.reuseMemo(cachedData.Memo)
+			memo, err := opc.reuseMemo(ctx, cachedData.Memo, nil /* prepared */)
 			return memo, err
 		}
 		opc.flags.Set(planFlagOptCacheMiss)
@@ -519,8 +741,8 @@ func (opc *optPlanningCtx) buildExecMemo(ctx context.Context) (_ *memo.Memo, _ e
 	// available.
 	f := opc.optimizer.Factory()
 	f.FoldingControl().AllowStableFolds()
-	bld := optbuilder.New(ctx, &p.semaCtx, p.EvalContext(), &opc.catalog, f, opc.p.stmt.AST)
-	if err := bld.Build(); err != nil {
+	bld, err := opc.buildNormalized(ctx, false /* keepPlaceholders */)
+	if err != nil {
 		return nil, err
 	}
 
@@ -534,7 +756,11 @@ func (opc *optPlanningCtx) buildExecMemo(ctx context.Context) (_ *memo.Memo, _ e
 	}
 
 	if _, isCanned := opc.p.stmt.AST.(*tree.CannedOptPlan); !isCanned {
-		if _, err := opc.optimizer.Optimize(); err != nil {
+		if _, err := opc.optimizeWithFallback(ctx, func() error {
+			f.FoldingControl().AllowStableFolds()
+			bld, err = opc.buildNormalized(ctx, false /* keepPlaceholders */)
+			return err
+		}); err != nil {
 			return nil, err
 		}
 	}
@@ -546,6 +772,7 @@ func (opc *optPlanningCtx) buildExecMemo(ctx context.Context) (_ *memo.Memo, _ e
 	if opc.useCache && !bld.HadPlaceholders && !bld.DisableMemoReuse &&
 		!f.FoldingControl().PermittedStableFold() {
 		memo := opc.optimizer.DetachMemo()
+		opc.compactMemoForCache(memo)
 		cachedData := querycache.CachedData{
 			SQL:  opc.p.stmt.SQL,
 			Memo: memo,
@@ -619,6 +846,11 @@ func (opc *optPlanningCtx) runExecBuilder(
 		planTop.instrumentation.planGist = gf.PlanGist()
 	}
 	planTop.instrumentation.costEstimate = float64(mem.RootExpr().(memo.RelExpr).Cost())
+	planTop.instrumentation.joinReorderStats = opc.optimizer.JoinOrderBuilder().Stats()
+	planTop.instrumentation.planningReport = opc.optimizer.PlanningReport()
+	if decisions := opc.optimizer.RuleDecisions(); decisions != nil && decisions.Len() > 0 {
+		planTop.instrumentation.ruleDecisions = decisions.String()
+	}
 
 	if stmt.ExpectedTypes != nil {
 		cols := result.main.planColumns()
@@ -21,6 +21,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondatapb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
@@ -706,3 +708,63 @@ func TestPlanGistControl(t *testing.T) {
 		t.Error("expected no gist")
 	}
 }
+
+// TestOptimizerFallbackOnInternalError tests that a statement whose
+// optimization fails with an internal error is re-optimized with the failing
+// rule disabled, and that the configuration of the optimizer for the statement
+// is reapplied for the retry.
+func TestOptimizerFallbackOnInternalError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+
+	s, sqlDB, db := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, "CREATE TABLE t (a INT PRIMARY KEY, b INT, INDEX (b))")
+	execCfg := s.ExecutorConfig().(ExecutorConfig)
+
+	stmt, err := parser.ParseOne("SELECT * FROM defaultdb.public.t WHERE b = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	makePlan := func() (*planner, func(), error) {
+		internalPlanner, cleanup := NewInternalPlanner(
+			"test",
+			kv.NewTxn(ctx, db, s.NodeID()),
+			security.RootUserName(),
+			&MemoryMetrics{},
+			&execCfg,
+			sessiondatapb.SessionData{},
+		)
+		p := internalPlanner.(*planner)
+		p.stmt = makeStatement(stmt, ClusterWideID{})
+		p.EvalContext().TestingKnobs.OptimizerFailingRules = []string{"GenerateConstrainedScans"}
+		p.instrumentation.collectBundle = true
+		return p, cleanup, p.makeOptimizerPlan(ctx)
+	}
+
+	// Without the fallback, the injected failure is returned.
+	_, cleanup, err := makePlan()
+	cleanup()
+	if e, ok := xform.GetOptimizationError(err); !ok || e.Kind != xform.InternalError ||
+		e.Rule != opt.GenerateConstrainedScans {
+		t.Fatalf("expected internal error in rule, got %+v", err)
+	}
+
+	// With the fallback, the statement is re-optimized with the rule disabled,
+	// and the rule decisions for the diagnostics bundle are still recorded.
+	fallbackOnInternalError.Override(ctx, &execCfg.Settings.SV, true)
+	p, cleanup, err := makePlan()
+	defer cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.optPlanningCtx.optimizer.DisabledRules().Contains(int(opt.GenerateConstrainedScans)) {
+		t.Error("expected the failing rule to be disabled by the retry")
+	}
+	if decisions := p.optPlanningCtx.optimizer.RuleDecisions(); decisions == nil || decisions.Len() == 0 {
+		t.Error("expected the rule decisions of the retry to be recorded")
+	}
+}
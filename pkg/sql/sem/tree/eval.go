@@ -3530,10 +3530,36 @@ type EvalContextTestingKnobs struct {
 	// DisableOptimizerRuleProbability is the probability that any given
 	// transformation rule in the optimizer is disabled.
 	DisableOptimizerRuleProbability float64
+	// DisableOptimizerRuleSeed is the seed used to choose the rules that are
+	// disabled when DisableOptimizerRuleProbability is set. Every optimizer
+	// disables the same rules when given the same seed, so that failures can be
+	// reproduced. If zero, each optimizer chooses a seed at random.
+	DisableOptimizerRuleSeed int64
+	// DisableOptimizerRuleProtect is a list of the names of optimizer rules
+	// that are never disabled at random when DisableOptimizerRuleProbability
+	// is set, in addition to the essential rules without which the optimizer
+	// may fail to produce a plan.
+	DisableOptimizerRuleProtect []string
+	// DisableOptimizerRuleUnprotect is a list of the names of essential
+	// optimizer rules that may nevertheless be disabled at random when
+	// DisableOptimizerRuleProbability is set.
+	DisableOptimizerRuleUnprotect []string
+	// LogDisabledOptimizerRules causes the optimizer to log the seed and the
+	// names of all the rules that were disabled at random when
+	// DisableOptimizerRuleProbability is set and optimization fails.
+	LogDisabledOptimizerRules bool
+	// OptimizerFailingRules is a list of the names of optimizer exploration
+	// rules that fail with an internal error each time they are applied, so
+	// that the handling of internal errors during optimization can be tested.
+	OptimizerFailingRules []string
 	// OptimizerCostPerturbation is used to randomly perturb the estimated
 	// cost of each expression in the query tree for the purpose of creating
 	// alternate query plans in the optimizer.
 	OptimizerCostPerturbation float64
+	// OptimizerValidatePlans causes the optimizer to run a series of sanity
+	// checks on every plan that it produces, and to return an internal error
+	// if any of the checks fail.
+	OptimizerValidatePlans bool
 	// If set, mutations.MaxBatchSize and row.getKVBatchSize will be overridden
 	// to use the non-test value.
 	ForceProductionBatchSizes bool
@@ -3680,6 +3706,12 @@ type EvalContext struct {
 	// EXPLAIN(TYPES[, NORMALIZE]).
 	SkipNormalize bool
 
+	// OptimizerHints is the text of the hint comment of the statement that is
+	// being planned, e.g. "disable_rules(...)" for a statement that begins with
+	// "SELECT /*+ disable_rules(...) */". It is empty if the statement has no
+	// hint comment. See xform.ParseStatementHints.
+	OptimizerHints string
+
 	CollationEnv CollationEnvironment
 
 	TestingKnobs EvalContextTestingKnobs
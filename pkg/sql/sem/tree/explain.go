@@ -117,6 +117,7 @@ const (
 	ExplainFlagDeps
 	ExplainFlagMemo
 	ExplainFlagShape
+	ExplainFlagCosts
 	numExplainFlags = iota
 )
 
@@ -130,6 +131,7 @@ var explainFlagStrings = [...]string{
 	ExplainFlagDeps:    "DEPS",
 	ExplainFlagMemo:    "MEMO",
 	ExplainFlagShape:   "SHAPE",
+	ExplainFlagCosts:   "COSTS",
 }
 
 var explainFlagStringMap = func() map[string]ExplainFlag {
@@ -225,3 +225,127 @@ func NewSchemaChangerModeFromString(val string) (_ NewSchemaChangerMode, ok bool
 		return 0, false
 	}
 }
+
+// PlanGuardrailMode controls what the optimizer does when the plan it chooses
+// contains a large cross join or full scan.
+type PlanGuardrailMode int64
+
+const (
+	// PlanGuardrailOff means that plans are not checked.
+	PlanGuardrailOff PlanGuardrailMode = iota
+	// PlanGuardrailWarn means that a warning describing each large cross join
+	// and full scan is sent to the client, and the plan is used.
+	PlanGuardrailWarn
+	// PlanGuardrailError means that planning fails with an error if the plan
+	// contains a large cross join or full scan.
+	PlanGuardrailError
+)
+
+func (m PlanGuardrailMode) String() string {
+	switch m {
+	case PlanGuardrailOff:
+		return "off"
+	case PlanGuardrailWarn:
+		return "warn"
+	case PlanGuardrailError:
+		return "error"
+	default:
+		return fmt.Sprintf("invalid (%d)", m)
+	}
+}
+
+// PlanGuardrailModeFromString converts a string into a PlanGuardrailMode
+func PlanGuardrailModeFromString(val string) (_ PlanGuardrailMode, ok bool) {
+	switch strings.ToUpper(val) {
+	case "OFF":
+		return PlanGuardrailOff, true
+	case "WARN":
+		return PlanGuardrailWarn, true
+	case "ERROR":
+		return PlanGuardrailError, true
+	default:
+		return 0, false
+	}
+}
+
+// JoinShapeMode controls the shapes of the join trees that the optimizer
+// considers when it reorders joins.
+type JoinShapeMode int64
+
+const (
+	// JoinShapeAuto means that every valid join tree is considered when all
+	// orderings of the joins are enumerated, and that only left-deep join trees
+	// are considered when the joins are reordered greedily or searched.
+	JoinShapeAuto JoinShapeMode = iota
+	// JoinShapeLeftDeep means that only linear join trees are considered, in
+	// which at least one input of each join is a base relation.
+	JoinShapeLeftDeep
+	// JoinShapeBushy means that bushy join trees, in which both inputs of a join
+	// can be joins, are also considered when the joins are reordered greedily
+	// or searched.
+	JoinShapeBushy
+)
+
+func (m JoinShapeMode) String() string {
+	switch m {
+	case JoinShapeAuto:
+		return "auto"
+	case JoinShapeLeftDeep:
+		return "left_deep"
+	case JoinShapeBushy:
+		return "bushy"
+	default:
+		return fmt.Sprintf("invalid (%d)", m)
+	}
+}
+
+// JoinShapeModeFromString converts a string into a JoinShapeMode
+func JoinShapeModeFromString(val string) (_ JoinShapeMode, ok bool) {
+	switch strings.ToUpper(val) {
+	case "AUTO":
+		return JoinShapeAuto, true
+	case "LEFT_DEEP":
+		return JoinShapeLeftDeep, true
+	case "BUSHY":
+		return JoinShapeBushy, true
+	default:
+		return 0, false
+	}
+}
+
+// OptimizerGoal is the objective that the optimizer minimizes when it chooses
+// between plans.
+type OptimizerGoal int64
+
+const (
+	// OptimizerGoalTotalCost means that the optimizer chooses the plan with the
+	// lowest cost of producing all of its rows.
+	OptimizerGoalTotalCost OptimizerGoal = iota
+	// OptimizerGoalFirstRow means that the optimizer chooses the plan with the
+	// lowest cost of producing its first row. This is useful for cursors and
+	// paginated queries, whose rows may not all be consumed.
+	OptimizerGoalFirstRow
+)
+
+func (g OptimizerGoal) String() string {
+	switch g {
+	case OptimizerGoalTotalCost:
+		return "total_cost"
+	case OptimizerGoalFirstRow:
+		return "first_row"
+	default:
+		return fmt.Sprintf("invalid (%d)", g)
+	}
+}
+
+// OptimizerGoalFromString converts a string into an OptimizerGoal.
+func OptimizerGoalFromString(val string) (_ OptimizerGoal, ok bool) {
+	switch strings.ToUpper(val) {
+	case "TOTAL_COST":
+		return OptimizerGoalTotalCost, true
+	case "FIRST_ROW":
+		return OptimizerGoalFirstRow, true
+	default:
+		return 0, false
+	}
+}
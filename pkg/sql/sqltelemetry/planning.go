@@ -124,6 +124,15 @@ var ExplainGist = telemetry.GetCounterOnce("sql.plan.explain-gist")
 // run of CREATE STATISTICS occurs.
 var CreateStatisticsUseCounter = telemetry.GetCounterOnce("sql.plan.stats.created")
 
+// CostModelShadowComparisonCounter is to be incremented whenever the optimizer
+// costs a plan under a shadow cost model as well as its own cost model.
+var CostModelShadowComparisonCounter = telemetry.GetCounterOnce("sql.plan.opt.cost-model.shadow-comparison")
+
+// CostModelShadowDisagreementCounter is to be incremented whenever the shadow
+// cost model of the optimizer would have chosen a different plan than the one
+// chosen by its own cost model.
+var CostModelShadowDisagreementCounter = telemetry.GetCounterOnce("sql.plan.opt.cost-model.shadow-disagreement")
+
 // OrderByNullsNonStandardCounter is to be incremented whenever a non-standard
 // ordering of nulls is used for ORDER BY (either ASC NULLS LAST or DESC NULLS
 // FIRST).
@@ -242,3 +251,9 @@ func WindowFunctionCounter(wf string) telemetry.Counter {
 func OptNodeCounter(nodeType string) telemetry.Counter {
 	return telemetry.GetCounterOnce(fmt.Sprintf("sql.plan.opt.node.%s", nodeType))
 }
+
+// OptRuleCounter should be incremented every time the exploration rule with
+// the given name is applied by the optimizer.
+func OptRuleCounter(ruleName string) telemetry.Counter {
+	return telemetry.GetCounterOnce(fmt.Sprintf("sql.plan.opt.rule.%s", ruleName))
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/schemaexpr"
 	"github.com/cockroachdb/cockroach/pkg/sql/delegate"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/xform"
 	"github.com/cockroachdb/cockroach/pkg/sql/paramparse"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
@@ -636,6 +637,44 @@ var varGen = map[string]sessionVar{
 		},
 	},
 
+	// CockroachDB extension.
+	`reorder_joins_search_budget`: {
+		GetStringVal: makeTimeoutVarGetter(`reorder_joins_search_budget`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			budget, err := validateTimeoutVar(m.data.GetIntervalStyle(), s, "reorder_joins_search_budget")
+			if err != nil {
+				return err
+			}
+			m.SetReorderJoinsSearchBudget(budget)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			ms := evalCtx.SessionData().ReorderJoinsSearchBudget.Nanoseconds() / int64(time.Millisecond)
+			return strconv.FormatInt(ms, 10), nil
+		},
+		GlobalDefault: func(_ *settings.Values) string {
+			return "0"
+		},
+	},
+
+	// CockroachDB extension.
+	`reorder_joins_shape`: {
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			mode, ok := sessiondatapb.JoinShapeModeFromString(s)
+			if !ok {
+				return newVarValueError(`reorder_joins_shape`, s, "auto", "left_deep", "bushy")
+			}
+			m.SetReorderJoinsShape(mode)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return evalCtx.SessionData().ReorderJoinsShape.String(), nil
+		},
+		GlobalDefault: func(sv *settings.Values) string {
+			return sessiondatapb.JoinShapeAuto.String()
+		},
+	},
+
 	// CockroachDB extension.
 	`require_explicit_primary_keys`: {
 		GetStringVal: makePostgresBoolGetStringValFn(`require_explicit_primary_keys`),
@@ -732,6 +771,152 @@ var varGen = map[string]sessionVar{
 		},
 	},
 
+	// CockroachDB extension.
+	`optimizer_deterministic_tie_breaking`: {
+		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_deterministic_tie_breaking`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := paramparse.ParseBoolVar("optimizer_deterministic_tie_breaking", s)
+			if err != nil {
+				return err
+			}
+			m.SetOptimizerDeterministicTieBreaking(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatBoolAsPostgresSetting(evalCtx.SessionData().OptimizerDeterministicTieBreaking), nil
+		},
+		GlobalDefault: globalFalse,
+	},
+
+	// CockroachDB extension.
+	`optimizer_disable_rules`: {
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			var names []string
+			for _, name := range strings.Split(s, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			if _, err := xform.ParseRuleSet(names); err != nil {
+				return err
+			}
+			m.SetOptimizerDisableRules(strings.Join(names, ","))
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return evalCtx.SessionData().OptimizerDisableRules, nil
+		},
+		GlobalDefault: func(_ *settings.Values) string {
+			return ""
+		},
+	},
+
+	// CockroachDB extension.
+	`optimizer_explore_apply_joins`: {
+		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_explore_apply_joins`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := paramparse.ParseBoolVar("optimizer_explore_apply_joins", s)
+			if err != nil {
+				return err
+			}
+			m.SetOptimizerExploreApplyJoins(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatBoolAsPostgresSetting(evalCtx.SessionData().OptimizerExploreApplyJoins), nil
+		},
+		GlobalDefault: globalFalse,
+	},
+
+	// CockroachDB extension.
+	`optimizer_external_rules`: {
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			var names []string
+			for _, name := range strings.Split(s, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			if _, err := xform.ParseExternalRules(names); err != nil {
+				return err
+			}
+			m.SetOptimizerExternalRules(strings.Join(names, ","))
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return evalCtx.SessionData().OptimizerExternalRules, nil
+		},
+		GlobalDefault: func(_ *settings.Values) string {
+			return ""
+		},
+	},
+
+	// CockroachDB extension.
+	`optimizer_heuristic_planning_threshold`: {
+		GetStringVal: makeIntGetStringValFn(`optimizer_heuristic_planning_threshold`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			if b < 0 {
+				return pgerror.Newf(pgcode.InvalidParameterValue,
+					"cannot set optimizer_heuristic_planning_threshold to a negative value: %d", b)
+			}
+			m.SetOptimizerHeuristicPlanningThreshold(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return strconv.FormatInt(evalCtx.SessionData().OptimizerHeuristicPlanningThreshold, 10), nil
+		},
+		GlobalDefault: func(_ *settings.Values) string {
+			return "0"
+		},
+	},
+
+	// CockroachDB extension.
+	`optimizer_leading_tables`: {
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			var names []string
+			for _, name := range strings.Split(s, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			m.SetOptimizerLeadingTables(strings.Join(names, ","))
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return evalCtx.SessionData().OptimizerLeadingTables, nil
+		},
+		GlobalDefault: func(_ *settings.Values) string {
+			return ""
+		},
+	},
+
+	// CockroachDB extension.
+	`optimizer_max_memo_exprs`: {
+		GetStringVal: makeIntGetStringValFn(`optimizer_max_memo_exprs`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			if b < 0 {
+				return pgerror.Newf(pgcode.InvalidParameterValue,
+					"cannot set optimizer_max_memo_exprs to a negative value: %d", b)
+			}
+			m.SetOptimizerMaxMemoExprs(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return strconv.FormatInt(evalCtx.SessionData().OptimizerMaxMemoExprs, 10), nil
+		},
+		GlobalDefault: func(_ *settings.Values) string {
+			return "0"
+		},
+	},
+
 	// CockroachDB extension.
 	`optimizer_use_histograms`: {
 		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_use_histograms`),
@@ -751,6 +936,23 @@ var varGen = map[string]sessionVar{
 		},
 	},
 
+	// CockroachDB extension.
+	`optimizer_use_join_limit_hints`: {
+		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_use_join_limit_hints`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := paramparse.ParseBoolVar("optimizer_use_join_limit_hints", s)
+			if err != nil {
+				return err
+			}
+			m.SetOptimizerUseJoinLimitHints(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatBoolAsPostgresSetting(evalCtx.SessionData().OptimizerUseJoinLimitHints), nil
+		},
+		GlobalDefault: globalFalse,
+	},
+
 	// CockroachDB extension.
 	`optimizer_use_multicol_stats`: {
 		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_use_multicol_stats`),
@@ -770,6 +972,116 @@ var varGen = map[string]sessionVar{
 		},
 	},
 
+	// CockroachDB extension.
+	`optimizer_use_topk_enforcer`: {
+		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_use_topk_enforcer`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := paramparse.ParseBoolVar("optimizer_use_topk_enforcer", s)
+			if err != nil {
+				return err
+			}
+			m.SetOptimizerUseTopKEnforcer(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatBoolAsPostgresSetting(evalCtx.SessionData().OptimizerUseTopKEnforcer), nil
+		},
+		GlobalDefault: globalFalse,
+	},
+
+	// CockroachDB extension.
+	`optimizer_use_streaming_property`: {
+		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_use_streaming_property`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := paramparse.ParseBoolVar("optimizer_use_streaming_property", s)
+			if err != nil {
+				return err
+			}
+			m.SetOptimizerUseStreamingProperty(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatBoolAsPostgresSetting(evalCtx.SessionData().OptimizerUseStreamingProperty), nil
+		},
+		GlobalDefault: globalFalse,
+	},
+
+	// CockroachDB extension.
+	`optimizer_use_workmem_costing`: {
+		GetStringVal: makePostgresBoolGetStringValFn(`optimizer_use_workmem_costing`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			b, err := paramparse.ParseBoolVar("optimizer_use_workmem_costing", s)
+			if err != nil {
+				return err
+			}
+			m.SetOptimizerUseWorkMemCosting(b)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatBoolAsPostgresSetting(evalCtx.SessionData().OptimizerUseWorkMemCosting), nil
+		},
+		GlobalDefault: globalFalse,
+	},
+
+	// CockroachDB extension.
+	`optimizer_goal`: {
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			goal, ok := sessiondatapb.OptimizerGoalFromString(s)
+			if !ok {
+				return newVarValueError(`optimizer_goal`, s, "total_cost", "first_row")
+			}
+			m.SetOptimizerGoal(goal)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return evalCtx.SessionData().OptimizerGoal.String(), nil
+		},
+		GlobalDefault: func(sv *settings.Values) string {
+			return sessiondatapb.OptimizerGoalTotalCost.String()
+		},
+	},
+
+	// CockroachDB extension.
+	`optimizer_plan_guardrail`: {
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			mode, ok := sessiondatapb.PlanGuardrailModeFromString(s)
+			if !ok {
+				return newVarValueError(`optimizer_plan_guardrail`, s, "off", "warn", "error")
+			}
+			m.SetOptimizerPlanGuardrail(mode)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return evalCtx.SessionData().OptimizerPlanGuardrail.String(), nil
+		},
+		GlobalDefault: func(sv *settings.Values) string {
+			return sessiondatapb.PlanGuardrailOff.String()
+		},
+	},
+
+	// CockroachDB extension.
+	`optimizer_risk_aversion`: {
+		GetStringVal: makeFloatGetStringValFn(`optimizer_risk_aversion`),
+		Set: func(_ context.Context, m sessionDataMutator, s string) error {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return err
+			}
+			if f < 0 {
+				return pgerror.Newf(pgcode.InvalidParameterValue,
+					"optimizer_risk_aversion cannot be negative: %s", s)
+			}
+			m.SetOptimizerRiskAversion(f)
+			return nil
+		},
+		Get: func(evalCtx *extendedEvalContext) (string, error) {
+			return formatFloatAsPostgresSetting(evalCtx.SessionData().OptimizerRiskAversion), nil
+		},
+		GlobalDefault: func(sv *settings.Values) string {
+			return "0"
+		},
+	},
+
 	// CockroachDB extension.
 	`locality_optimized_partitioned_index_scan`: {
 		GetStringVal: makePostgresBoolGetStringValFn(`locality_optimized_partitioned_index_scan`),